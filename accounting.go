@@ -0,0 +1,80 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+// An Accounting is told of the memory retained by a send queue, a receive
+// backlog or a Reassembler, so that it can be counted against a limit kept
+// elsewhere, such as one shared by many connections. Acquire is called before
+// n bytes are retained, and may refuse them by returning an error. Release is
+// called once they no longer are, whether because an imsg has been written or
+// received, discarded, or because the queue was cleared or its Conn closed,
+// and every successful Acquire is matched by exactly one Release of the same
+// number of bytes. An Accounting must be safe for concurrent use, and since
+// its methods are called with queues locked, they must not block.
+type Accounting interface {
+	Acquire(n int) error
+	Release(n int)
+}
+
+// SetAccounting causes the MsgBuf to acquire the length of each imsg it queues
+// from the provided Accounting, releasing it once the imsg has been written or
+// discarded. An imsg whose length is refused isn't queued; ErrQueueFull is
+// returned instead, wrapping the error from Acquire, whatever the queue's
+// policy. Imsgs queued before SetAccounting is called, and those restored by
+// ImportPending, aren't accounted for. A nil Accounting stops accounting for
+// imsgs queued from then on.
+func (m *MsgBuf) SetAccounting(a Accounting) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.acct = a
+}
+
+// WithAccounting causes the Conn to account for the memory retained by its
+// send queue, as described by MsgBuf.SetAccounting, and by its backlog of
+// imsgs read on behalf of Recv by Call, RecvMatching and the like. An imsg
+// added to the backlog whose length is refused is held all the same, without
+// being accounted for, but nothing more is read from the socket until Recv has
+// taken an imsg from the backlog, as with WithRecvQueueLimit, and the same
+// caveats apply. Whatever remains acquired is released when the Conn is
+// closed.
+func WithAccounting(a Accounting) ConnOption {
+	return func(c *Conn) {
+		c.wq.SetAccounting(a)
+		c.ensureRecvQueue().acct = a
+	}
+}
+
+// charge acquires the lengths of the provided entries from the Accounting, if
+// any, recording it in each entry so that it can be released. If any length is
+// refused, those already acquired are released and ErrQueueFull is returned.
+// The caller must hold mu.
+func (m *MsgBuf) charge(es []msgBufEntry) error {
+	if m.acct == nil {
+		return nil
+	}
+
+	for i := range es {
+		err := m.acct.Acquire(es[i].len())
+		if err != nil {
+			for j := 0; j < i; j++ {
+				m.discharge(&es[j])
+			}
+			return &ErrQueueFull{Messages: len(m.q), Bytes: m.pending, Err: err}
+		}
+		es[i].acct = m.acct
+	}
+
+	return nil
+}
+
+// discharge releases the length of an entry leaving the queue to the
+// Accounting it was acquired from, if any.
+func (m *MsgBuf) discharge(e *msgBufEntry) {
+	if e.acct != nil {
+		e.acct.Release(e.len())
+		e.acct = nil
+	}
+}
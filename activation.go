@@ -0,0 +1,12 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import "errors"
+
+// ErrNotActivated is returned by ListenersFromActivation when the process
+// wasn't passed any sockets by a service manager, in which case a daemon would
+// typically fall back to ListenPath.
+var ErrNotActivated = errors.New("imsg: not started by socket activation")
@@ -0,0 +1,120 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// This is the first descriptor passed by the service manager. It's a variable
+// so that tests can pass descriptors of their own.
+var listenFDsStart = 3
+
+// ListenersFromActivation returns Listeners for the sockets passed to the
+// process by systemd, or any service manager implementing its socket
+// activation protocol, in the order in which they were passed. Each socket
+// must be a listening unix domain stream socket, and its name, if the service
+// manager assigned one, is reported by the Listener's Name method. The
+// protocol's environment variables are cleared, so that they aren't inherited
+// by child processes. If the process wasn't passed any sockets,
+// ErrNotActivated is returned.
+//
+// The Listeners don't remove their socket files once closed, since the files
+// belong to the service manager. ListenersFromActivation must only be called
+// once.
+func ListenersFromActivation(opts ...NetOption) ([]*Listener, error) {
+	pidEnv, fdsEnv, namesEnv := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	if pidEnv == "" || fdsEnv == "" {
+		return nil, ErrNotActivated
+	}
+	pid, err := strconv.Atoi(pidEnv)
+	if err != nil || pid != os.Getpid() {
+		// The variables were meant for another process.
+		return nil, ErrNotActivated
+	}
+	n, err := strconv.Atoi(fdsEnv)
+	if err != nil || n < 0 {
+		return nil, &ErrInvalidActivation{fmt.Sprintf("malformed LISTEN_FDS %q", fdsEnv)}
+	}
+	if n == 0 {
+		return nil, ErrNotActivated
+	}
+
+	var names []string
+	if namesEnv != "" {
+		names = strings.Split(namesEnv, ":")
+		if len(names) != n {
+			return nil, &ErrInvalidActivation{fmt.Sprintf("%d names for %d sockets", len(names), n)}
+		}
+	}
+
+	cfg, err := newNetConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	ls := make([]*Listener, 0, n)
+	for i := 0; i < n; i++ {
+		l, err := activatedListener(listenFDsStart + i)
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+
+		ul := &Listener{l: l, cfg: cfg}
+		if names != nil {
+			ul.name = names[i]
+		}
+		ls = append(ls, ul)
+	}
+
+	return ls, nil
+}
+
+// activatedListener checks that the inherited descriptor fd is a listening unix
+// domain stream socket, and wraps it in a *net.UnixListener.
+func activatedListener(fd int) (*net.UnixListener, error) {
+	unix.CloseOnExec(fd)
+
+	domain, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_DOMAIN)
+	if err != nil {
+		return nil, &ErrInvalidActivation{fmt.Sprintf("descriptor %d: %s", fd, err)}
+	}
+	typ, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TYPE)
+	if err != nil {
+		return nil, &ErrInvalidActivation{fmt.Sprintf("descriptor %d: %s", fd, err)}
+	}
+	listening, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ACCEPTCONN)
+	if err != nil {
+		return nil, &ErrInvalidActivation{fmt.Sprintf("descriptor %d: %s", fd, err)}
+	}
+	if domain != unix.AF_UNIX || typ != unix.SOCK_STREAM || listening == 0 {
+		return nil, &ErrInvalidActivation{fmt.Sprintf("descriptor %d isn't a listening unix stream socket", fd)}
+	}
+
+	f := os.NewFile(uintptr(fd), "imsg-activated-"+strconv.Itoa(fd))
+	defer f.Close()
+
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, err
+	}
+	ul := l.(*net.UnixListener)
+	ul.SetUnlinkOnClose(false)
+
+	return ul, nil
+}
@@ -0,0 +1,156 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// inheritFD duplicates the descriptor of f to fd, as though it were passed by a
+// service manager.
+func inheritFD(t *testing.T, f *os.File, fd int) {
+	t.Helper()
+
+	err := unix.Dup3(int(f.Fd()), fd, 0)
+	if err != nil {
+		t.Fatalf("unexpected Dup3 failure: %s", err)
+	}
+	f.Close()
+}
+
+// setActivationEnv fakes the environment of a socket activated process.
+func setActivationEnv(t *testing.T, pid int, fds int, names string) {
+	t.Setenv("LISTEN_PID", strconv.Itoa(pid))
+	t.Setenv("LISTEN_FDS", strconv.Itoa(fds))
+	t.Setenv("LISTEN_FDNAMES", names)
+}
+
+func TestListenersFromActivation(t *testing.T) {
+	const start = 200
+	defer func(n int) { listenFDsStart = n }(listenFDsStart)
+	listenFDsStart = start
+
+	path := filepath.Join(t.TempDir(), "imsg.sock")
+	ul, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("unexpected ListenUnix failure: %s", err)
+	}
+	f, err := ul.File()
+	if err != nil {
+		t.Fatalf("unexpected File failure: %s", err)
+	}
+	ul.SetUnlinkOnClose(false)
+	ul.Close()
+	inheritFD(t, f, start)
+
+	setActivationEnv(t, os.Getpid(), 1, "control")
+	ls, err := ListenersFromActivation()
+	if err != nil {
+		t.Fatalf("unexpected ListenersFromActivation failure: %s", err)
+	}
+	if len(ls) != 1 || ls[0].Name() != "control" {
+		t.Fatalf("unexpected listeners: %v", ls)
+	}
+	for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		if _, ok := os.LookupEnv(v); ok {
+			t.Fatalf("%s was not cleared", v)
+		}
+	}
+
+	accepted := make(chan *Conn, 1)
+	go func() {
+		c, err := ls[0].Accept()
+		if err != nil {
+			t.Errorf("unexpected Accept failure: %s", err)
+		}
+		accepted <- c
+	}()
+	a, err := DialPath(context.Background(), path)
+	if err != nil {
+		t.Fatalf("unexpected DialPath failure: %s", err)
+	}
+	defer a.Close()
+	b := <-accepted
+	if b == nil {
+		t.FailNow()
+	}
+	defer b.Close()
+	err = a.Send(&IMsg{Type: 1, Data: []byte("activated")})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	im, err := b.Recv()
+	if err != nil || im.Type != 1 || string(im.Data) != "activated" {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+
+	// The socket file belongs to the service manager.
+	ls[0].Close()
+	_, err = os.Lstat(path)
+	if err != nil {
+		t.Fatalf("socket file was removed by Close: %s", err)
+	}
+}
+
+func TestListenersFromActivationInvalid(t *testing.T) {
+	const start = 200
+	defer func(n int) { listenFDsStart = n }(listenFDsStart)
+	listenFDsStart = start
+
+	// A connected socket isn't a listener.
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("unexpected Socketpair failure: %s", err)
+	}
+	defer unix.Close(fds[1])
+	inheritFD(t, os.NewFile(uintptr(fds[0]), "socketpair"), start)
+	defer unix.Close(start)
+
+	setActivationEnv(t, os.Getpid(), 1, "")
+	_, err = ListenersFromActivation()
+	var invalid *ErrInvalidActivation
+	if !errors.As(err, &invalid) {
+		t.Fatalf("expected ErrInvalidActivation, got: %v", err)
+	}
+
+	setActivationEnv(t, os.Getpid(), 1, "a:b")
+	_, err = ListenersFromActivation()
+	if !errors.As(err, &invalid) {
+		t.Fatalf("expected ErrInvalidActivation, got: %v", err)
+	}
+}
+
+func TestListenersFromActivationAbsent(t *testing.T) {
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	_, err := ListenersFromActivation()
+	if err != ErrNotActivated {
+		t.Fatalf("expected ErrNotActivated, got: %v", err)
+	}
+
+	// The variables were meant for the parent.
+	setActivationEnv(t, os.Getppid(), 1, "")
+	_, err = ListenersFromActivation()
+	if err != ErrNotActivated {
+		t.Fatalf("expected ErrNotActivated, got: %v", err)
+	}
+	if _, ok := os.LookupEnv("LISTEN_FDS"); ok {
+		t.Fatalf("LISTEN_FDS was not cleared")
+	}
+
+	setActivationEnv(t, os.Getpid(), 0, "")
+	_, err = ListenersFromActivation()
+	if err != ErrNotActivated {
+		t.Fatalf("expected ErrNotActivated, got: %v", err)
+	}
+}
@@ -0,0 +1,13 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build !linux
+
+package imsg
+
+// ListenersFromActivation always returns ErrNotActivated on this platform,
+// where processes aren't started by socket activation.
+func ListenersFromActivation(opts ...NetOption) ([]*Listener, error) {
+	return nil, ErrNotActivated
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"log/slog"
+)
+
+// A typeAllowlist determines which types of imsgs may be received.
+type typeAllowlist struct {
+	types map[uint32]bool
+	f     func(uint32) bool
+}
+
+// newTypeAllowlist constructs an allowlist of the provided types.
+func newTypeAllowlist(types []uint32) *typeAllowlist {
+	al := &typeAllowlist{types: make(map[uint32]bool, len(types))}
+	for _, typ := range types {
+		al.types[typ] = true
+	}
+
+	return al
+}
+
+// allows reports whether imsgs of the provided type may be received. A nil
+// allowlist allows everything.
+func (al *typeAllowlist) allows(typ uint32) bool {
+	switch {
+	case al == nil:
+		return true
+	case al.f != nil:
+		return al.f(typ)
+	}
+
+	return al.types[typ]
+}
+
+// WithAllowedTypes restricts the imsgs the Conn receives to those of the
+// provided types, as SetAllowedTypes does.
+func WithAllowedTypes(types ...uint32) ConnOption {
+	return func(c *Conn) {
+		c.SetAllowedTypes(types...)
+	}
+}
+
+// WithAllowedTypeFunc restricts the imsgs the Conn receives to those whose type
+// satisfies f, as SetAllowedTypeFunc does.
+func WithAllowedTypeFunc(f func(typ uint32) bool) ConnOption {
+	return func(c *Conn) {
+		c.SetAllowedTypeFunc(f)
+	}
+}
+
+// WithCloseOnDisallowedType causes the Conn to be closed when the peer sends an
+// imsg of a type which isn't allowed, since a peer which does so, such as an
+// unprivileged child, may well be compromised. ErrTypeNotAllowed is still
+// returned by Recv, and any imsgs already read behind the offending one are
+// discarded.
+func WithCloseOnDisallowedType() ConnOption {
+	return func(c *Conn) {
+		c.closeDisallowed = true
+	}
+}
+
+// SetAllowedTypes restricts the imsgs the Conn receives to those of the
+// provided types, replacing any previous restriction; with no types, nothing is
+// allowed. The type of each imsg is checked as soon as its header is read, and
+// an imsg of any other type is discarded without its data being copied,
+// closing any descriptor passed with it, and ErrTypeNotAllowed is returned by
+// Recv. Subsequent imsgs may still be received. The allowed types may be
+// changed at any time, including while the Conn is being read. Heartbeats of
+// the type set with WithKeepalive are always allowed, and absorbed as usual.
+// The peer's offer to Handshake isn't, so the handshake should either be
+// performed before restricting the allowed types, or TypeHandshake allowed.
+func (c *Conn) SetAllowedTypes(types ...uint32) {
+	c.allowed.Store(newTypeAllowlist(types))
+}
+
+// SetAllowedTypeFunc restricts the imsgs the Conn receives to those whose type
+// satisfies f, in the manner of SetAllowedTypes, replacing any previous
+// restriction. A nil f removes the restriction. The function is called while
+// the Conn is reading, so it must not itself read from the Conn.
+func (c *Conn) SetAllowedTypeFunc(f func(typ uint32) bool) {
+	if f == nil {
+		c.allowed.Store(nil)
+		return
+	}
+
+	c.allowed.Store(&typeAllowlist{f: f})
+}
+
+// SetAllowedTypes restricts the imsgs the Decoder decodes to those of the
+// provided types, replacing any previous restriction; with no types, nothing is
+// allowed. The type of each imsg is checked before its data is read, and an
+// imsg of any other type is skipped, returning ErrTypeNotAllowed, so that
+// subsequent imsgs may still be decoded.
+func (d *Decoder) SetAllowedTypes(types ...uint32) {
+	d.allowed = newTypeAllowlist(types)
+}
+
+// SetAllowedTypeFunc restricts the imsgs the Decoder decodes to those whose
+// type satisfies f, in the manner of SetAllowedTypes. A nil f removes the
+// restriction.
+func (d *Decoder) SetAllowedTypeFunc(f func(typ uint32) bool) {
+	if f == nil {
+		d.allowed = nil
+		return
+	}
+
+	d.allowed = &typeAllowlist{f: f}
+}
+
+// skipDisallowed skips the next imsg if its type isn't allowed, returning the
+// number of bytes consumed and ErrTypeNotAllowed. If the type can't be peeked,
+// nothing is consumed, and the imsg is left for Decode to report.
+func (d *Decoder) skipDisallowed() (int, error) {
+	typ, err := d.PeekType()
+	if err != nil || d.allowed.allows(typ) {
+		return 0, nil
+	}
+
+	_, n, err := skipIMsg(d.r, d.hdr[:], d.maxSize)
+	d.off += int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	return n, &ErrTypeNotAllowed{typ}
+}
+
+// discardDisallowed discards the imsg of n bytes at the head of the read buffer
+// if its type isn't allowed, along with any descriptor passed with it,
+// returning ErrTypeNotAllowed. Heartbeats are left for recvBuffered to absorb.
+// The caller must hold rmu.
+func (c *Conn) discardDisallowed(n int) error {
+	al := c.allowed.Load()
+	if al == nil {
+		return nil
+	}
+	hdr := parseHeader(c.rbuf, endianness)
+	if al.allows(hdr.Type) || (c.ka != nil && hdr.Type == c.ka.typ) {
+		return nil
+	}
+
+	c.rbuf = c.rbuf[n:]
+	c.rpos += int64(n)
+	c.chargeBudget(len(c.rbuf))
+	c.recvd.messages.Add(1)
+	c.recvd.filtered.Add(1)
+	if hdr.Flags&FlagHasFD != 0 && len(c.fds) > 0 {
+		c.fds[0].Close()
+		c.fds = c.fds[1:]
+	}
+
+	err := &ErrTypeNotAllowed{hdr.Type}
+	if c.debugEnabled() {
+		c.logDebug("imsg type not allowed", slog.Any(logKeyErr, err))
+	}
+	if c.closeDisallowed {
+		// Nothing else the peer sent is to be trusted either.
+		c.rbuf = c.rbuf[:0]
+		c.closeHeld()
+	}
+
+	return err
+}
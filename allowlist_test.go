@@ -0,0 +1,71 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestDecoderAllowedTypes(t *testing.T) {
+	var buf bytes.Buffer
+	ims := []*IMsg{
+		{Type: 1, Data: []byte("allowed")},
+		{Type: 3, Data: []byte("disallowed")},
+		{Type: 2, Data: []byte("allowed")},
+	}
+	for _, im := range ims {
+		_, err := im.WriteTo(&buf)
+		if err != nil {
+			t.Fatalf("unexpected WriteTo failure: %s", err)
+		}
+	}
+
+	dec := NewDecoder(&buf)
+	dec.SetAllowedTypes(1, 2)
+	for _, want := range ims {
+		im, err := dec.Decode()
+		if want.Type == 3 {
+			var notAllowed *ErrTypeNotAllowed
+			if !errors.As(err, &notAllowed) || notAllowed.Type != 3 {
+				t.Fatalf("expected ErrTypeNotAllowed, got: %v", err)
+			}
+			continue
+		}
+		if err != nil || !im.Equal(want) {
+			t.Fatalf("unexpected Decode result (%v, %v)", im, err)
+		}
+	}
+	if dec.off != int64(ims[0].Len()+ims[1].Len()+ims[2].Len()) {
+		t.Fatalf("unexpected offset after decoding (%d)", dec.off)
+	}
+}
+
+func TestDecoderAllowedTypeFunc(t *testing.T) {
+	var buf bytes.Buffer
+	for typ := uint32(1); typ <= 4; typ++ {
+		_, err := (&IMsg{Type: typ}).WriteTo(&buf)
+		if err != nil {
+			t.Fatalf("unexpected WriteTo failure: %s", err)
+		}
+	}
+
+	dec := NewDecoder(&buf)
+	dec.SetAllowedTypeFunc(func(typ uint32) bool { return typ%2 == 0 })
+	for typ := uint32(1); typ <= 3; typ++ {
+		im, err := dec.Decode()
+		if typ%2 == 0 && (err != nil || im.Type != typ) || typ%2 != 0 && err == nil {
+			t.Fatalf("unexpected Decode result for type %d (%v, %v)", typ, im, err)
+		}
+	}
+
+	// Removing the restriction allows everything again.
+	dec.SetAllowedTypeFunc(nil)
+	im, err := dec.Decode()
+	if err != nil || im.Type != 4 {
+		t.Fatalf("unexpected Decode result (%v, %v)", im, err)
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConnAllowedTypes(t *testing.T) {
+	a, b := newTestFDPassPair(t)
+	b = rewrapTestConn(t, b, WithAllowedTypes(1, 2))
+	b.AllowFDPass(true)
+
+	// A disallowed imsg carrying a descriptor precedes an allowed one which
+	// carries another.
+	for _, typ := range []uint32{3, 1} {
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			t.Fatalf("unexpected Open failure: %s", err)
+		}
+		im, err := ComposeIMsgWithFile(typ, 0, []byte("test"), f)
+		if err != nil {
+			t.Fatalf("unexpected ComposeIMsgWithFile failure: %s", err)
+		}
+		err = a.Send(im)
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+	err := a.Send(&IMsg{Type: 2})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+
+	_, err = b.Recv()
+	var notAllowed *ErrTypeNotAllowed
+	if !errors.As(err, &notAllowed) || notAllowed.Type != 3 {
+		t.Fatalf("expected ErrTypeNotAllowed, got: %v", err)
+	}
+
+	// The stream and descriptors remain in step.
+	im, err := b.Recv()
+	if err != nil || im.Type != 1 || string(im.Data) != "test" || im.File() == nil {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+	im.Close()
+	im, err = b.Recv()
+	if err != nil || im.Type != 2 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+
+	// The allowed types can be changed while the Conn is in use.
+	b.SetAllowedTypes(3)
+	for _, typ := range []uint32{1, 3} {
+		err := a.Send(&IMsg{Type: typ})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+	_, err = b.Recv()
+	if !errors.As(err, &notAllowed) || notAllowed.Type != 1 {
+		t.Fatalf("expected ErrTypeNotAllowed, got: %v", err)
+	}
+	im, err = b.Recv()
+	if err != nil || im.Type != 3 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+	if s := b.Stats(); s.MessagesFiltered != 2 {
+		t.Fatalf("unexpected count of filtered imsgs: %d", s.MessagesFiltered)
+	}
+}
+
+func TestConnCloseOnDisallowedType(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	b = rewrapTestConn(t, b, WithAllowedTypes(1), WithCloseOnDisallowedType())
+
+	for _, typ := range []uint32{2, 1} {
+		err := a.Send(&IMsg{Type: typ})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+	_, err := b.Recv()
+	var notAllowed *ErrTypeNotAllowed
+	if !errors.As(err, &notAllowed) {
+		t.Fatalf("expected ErrTypeNotAllowed, got: %v", err)
+	}
+	_, err = b.Recv()
+	if err == nil {
+		t.Fatalf("Recv succeeded on a closed Conn")
+	}
+}
+
+func TestConnAllowedTypesHeartbeat(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	b = rewrapTestConn(t, b,
+		WithKeepalive(time.Hour, time.Hour, testTypeHeartbeat),
+		WithAllowedTypes(1),
+		WithCloseOnDisallowedType(),
+	)
+
+	// The heartbeat is absorbed rather than refused.
+	for _, typ := range []uint32{testTypeHeartbeat, 1} {
+		err := a.Send(&IMsg{Type: typ})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+	im, err := b.Recv()
+	if err != nil || im.Type != 1 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+	if s := b.Stats(); s.MessagesFiltered != 0 {
+		t.Fatalf("unexpected count of filtered imsgs: %d", s.MessagesFiltered)
+	}
+}
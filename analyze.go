@@ -0,0 +1,89 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"encoding/binary"
+	"io"
+	"math"
+)
+
+// An AnalyzeFunc is called by AnalyzeStream for each imsg in a stream, or for
+// each problem found in it, with the offset in bytes at which the imsg or
+// problem begins. For a complete imsg, err is nil, and data holds the imsg's
+// ancillary data, which is only valid until the function returns. When err is
+// set, hdr and data hold as much of the imsg as could be read. Returning false
+// stops the analysis.
+type AnalyzeFunc func(offset int64, hdr Header, data []byte, err error) bool
+
+// AnalyzeStream walks the imsgs in a captured stream, such as one extracted
+// from a core dump or a packet capture, calling fn for each of them. Unlike a
+// Decoder, it doesn't stop at the first problem. A header whose length is out
+// of bounds is reported with ErrLengthOutOfBounds, after which, if fn returns
+// true, the analysis continues from the next plausible header, as found by
+// Decoder.Resync. A stream which ends partway through an imsg is reported with
+// ErrTruncated at the imsg's offset. The stream is read only as far as is
+// needed, so the analysis never waits on the reader for more than the imsg it's
+// examining. Failures to read, other than the end of the stream, are returned
+// wrapped in an ErrRead. The stream is decoded in the system's byte order.
+func AnalyzeStream(r io.Reader, fn AnalyzeFunc) error {
+	return AnalyzeStreamOrder(r, endianness, fn)
+}
+
+// AnalyzeStreamOrder behaves like AnalyzeStream, decoding the stream in the
+// provided byte order, which is useful for streams captured on another system.
+func AnalyzeStreamOrder(r io.Reader, order binary.ByteOrder, fn AnalyzeFunc) error {
+	const known = FlagHasFD | FlagCompressed
+	plausible := func(hdr []byte) bool {
+		return plausibleHeader(hdr, order, MaxSizeInBytes, known)
+	}
+
+	s := resyncer{src: r}
+	for {
+		offset := int64(s.skipped)
+
+		if !s.fill(HeaderSizeInBytes) {
+			switch {
+			case s.err != io.EOF:
+				return &ErrRead{"header", s.err}
+			case len(s.buf) > 0:
+				fn(offset, Header{}, nil, &ErrTruncated{HeaderSizeInBytes, len(s.buf), "header"})
+			}
+			return nil
+		}
+
+		hdr := parseHeader(s.buf, order)
+		if hdr.Length < HeaderSizeInBytes || hdr.Length > MaxSizeInBytes {
+			err := &ErrLengthOutOfBounds{hdr.Length, HeaderSizeInBytes, MaxSizeInBytes}
+			if !fn(offset, hdr, nil, err) {
+				return nil
+			}
+
+			s.skip(1)
+			if err := s.scan(order, plausible, math.MaxInt); err != nil {
+				if err == io.EOF {
+					return nil
+				}
+				return err
+			}
+			continue
+		}
+
+		length := int(hdr.Length)
+		if !s.fill(length) {
+			if s.err != io.EOF {
+				return &ErrRead{"body", s.err}
+			}
+			data := s.buf[HeaderSizeInBytes:]
+			fn(offset, hdr, data, &ErrTruncated{length - HeaderSizeInBytes, len(data), "body"})
+			return nil
+		}
+
+		if !fn(offset, hdr, s.buf[HeaderSizeInBytes:length], nil) {
+			return nil
+		}
+		s.skip(length)
+	}
+}
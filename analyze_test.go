@@ -0,0 +1,123 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// This is a call made to an AnalyzeFunc.
+type analyzed struct {
+	offset int64
+	typ    uint32
+	length uint16
+	data   string
+	err    error
+}
+
+// analyzeAll analyzes a stream, recording each call to the AnalyzeFunc and
+// stopping after the provided number of calls.
+func analyzeAll(t *testing.T, bs []byte, order binary.ByteOrder, stopAfter int) []analyzed {
+	t.Helper()
+
+	var calls []analyzed
+	r := &chunkedReader{r: bytes.NewReader(bs), chunks: []int{1, 7, 100}}
+	err := AnalyzeStreamOrder(r, order, func(offset int64, hdr Header, data []byte, err error) bool {
+		calls = append(calls, analyzed{offset, hdr.Type, hdr.Length, string(data), err})
+		return len(calls) < stopAfter
+	})
+	if err != nil {
+		t.Fatalf("unexpected AnalyzeStreamOrder failure: %s", err)
+	}
+
+	return calls
+}
+
+func TestAnalyzeStream(t *testing.T) {
+	// The fixture is little-endian, and the length of its second imsg is
+	// corrupt, and its last imsg is truncated.
+	fixture, err := os.ReadFile(filepath.Join("testdata", "analyze_corrupt_le.bin"))
+	if err != nil {
+		t.Fatalf("failed to read fixture: %s", err)
+	}
+
+	expected := []analyzed{
+		{0, 1, 21, "hello", nil},
+		{21, 2, 0xffff, "", &ErrLengthOutOfBounds{0xffff, HeaderSizeInBytes, MaxSizeInBytes}},
+		{45, 3, 21, "world", nil},
+		{66, 4, 16, "", nil},
+		{82, 5, 26, "trun", &ErrTruncated{10, 4, "body"}},
+	}
+	calls := analyzeAll(t, fixture, binary.LittleEndian, len(expected)+1)
+	if len(calls) != len(expected) {
+		t.Fatalf("unexpected number of calls (%d != %d): %v", len(calls), len(expected), calls)
+	}
+	for i, call := range calls {
+		want := expected[i]
+		if call.offset != want.offset || call.typ != want.typ || call.length != want.length || call.data != want.data {
+			t.Fatalf("call %d does not match (%v != %v)", i, call, want)
+		}
+		if (call.err == nil) != (want.err == nil) || (call.err != nil && call.err.Error() != want.err.Error()) {
+			t.Fatalf("call %d: unexpected error (%v != %v)", i, call.err, want.err)
+		}
+	}
+
+	// The analysis stops when asked to.
+	calls = analyzeAll(t, fixture, binary.LittleEndian, 2)
+	if len(calls) != 2 {
+		t.Fatalf("expected analysis to stop after 2 calls, got %d", len(calls))
+	}
+
+	// In the wrong byte order, the first imsg appears to run past the end of
+	// the stream.
+	calls = analyzeAll(t, fixture, binary.BigEndian, 1)
+	var et *ErrTruncated
+	if len(calls) != 1 || !errors.As(calls[0].err, &et) || calls[0].length != 0x1500 {
+		t.Fatalf("expected ErrTruncated, got: %v", calls)
+	}
+}
+
+func TestAnalyzeStreamByteOrder(t *testing.T) {
+	var stream []byte
+	for _, order := range []binary.ByteOrder{binary.BigEndian, binary.LittleEndian} {
+		stream = stream[:0]
+		for typ := uint32(1); typ <= 3; typ++ {
+			hdr := make([]byte, HeaderSizeInBytes)
+			order.PutUint32(hdr[0:4], typ)
+			order.PutUint16(hdr[4:6], HeaderSizeInBytes+4)
+			stream = append(append(stream, hdr...), "test"...)
+		}
+		stream = append(stream, 1, 2, 3)
+
+		calls := analyzeAll(t, stream, order, 10)
+		if len(calls) != 4 {
+			t.Fatalf("%s: unexpected number of calls (%d)", order, len(calls))
+		}
+		for i, call := range calls[:3] {
+			if call.err != nil || call.typ != uint32(i+1) || call.data != "test" || call.offset != int64(20*i) {
+				t.Fatalf("%s: unexpected call %d (%v)", order, i, call)
+			}
+		}
+		var et *ErrTruncated
+		if !errors.As(calls[3].err, &et) || et.Stage != "header" || et.Got != 3 || calls[3].offset != 60 {
+			t.Fatalf("%s: expected truncated header, got: %v", order, calls[3])
+		}
+	}
+
+	// The system's byte order is used by default.
+	var n int
+	AnalyzeStream(bytes.NewReader(nil), func(int64, Header, []byte, error) bool {
+		n++
+		return true
+	})
+	if n != 0 {
+		t.Fatalf("unexpected calls for an empty stream")
+	}
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"context"
+	"io"
+	"os"
+	"testing"
+)
+
+// sendPipe sends an imsg of the provided type with the writing end of a new
+// pipe attached, returning the reading end.
+func sendPipe(t *testing.T, c *Conn, typ uint32) *os.File {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("unexpected Pipe failure: %s", err)
+	}
+	err = c.Send(&IMsg{Type: typ, file: w})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+
+	return r
+}
+
+func TestIMsgCloseDetach(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("unexpected Pipe failure: %s", err)
+	}
+	defer r.Close()
+
+	im := &IMsg{Type: 1, file: w, flags: FlagHasFD}
+	err = im.Close()
+	if err != nil {
+		t.Fatalf("unexpected Close failure: %s", err)
+	}
+	if im.HasFD() || im.File() != nil {
+		t.Fatalf("file remains attached after Close")
+	}
+	err = im.Close()
+	if err != nil {
+		t.Fatalf("second Close failed: %s", err)
+	}
+	if _, err = w.Write([]byte("x")); err == nil {
+		t.Fatalf("attached file was not closed")
+	}
+
+	_, w, err = os.Pipe()
+	if err != nil {
+		t.Fatalf("unexpected Pipe failure: %s", err)
+	}
+	im = &IMsg{Type: 1, file: w, flags: FlagHasFD}
+	f := im.Detach()
+	if f != w || im.HasFD() || im.Detach() != nil {
+		t.Fatalf("Detach did not transfer the file")
+	}
+	im.Close()
+	if _, err = f.Write([]byte("x")); err != nil {
+		t.Fatalf("detached file was closed by Close: %s", err)
+	}
+	f.Close()
+}
+
+func TestConnAttachmentLeaks(t *testing.T) {
+	const (
+		testTypeKept    = 1
+		testTypeDropped = 2
+		rounds          = 100
+	)
+
+	a, b := newTestSocketPair(t)
+	a.AllowFDPass(true)
+	b.AllowFDPass(true)
+	b.SetRecvFilter(func(im *IMsg) FilterAction {
+		if im.Type == testTypeDropped {
+			return Drop
+		}
+		return Accept
+	})
+
+	before := countOpenFDs(t)
+
+	// Received attachments are closed, detached, and dropped by the filter.
+	for i := 0; i < rounds; i++ {
+		readers := []*os.File{
+			sendPipe(t, a, testTypeKept),
+			sendPipe(t, a, testTypeDropped),
+			sendPipe(t, a, testTypeKept),
+		}
+		for j := 0; j < 2; j++ {
+			im, err := b.Recv()
+			if err != nil || im.Type != testTypeKept || im.File() == nil {
+				t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+			}
+			if j == 0 {
+				im.Close()
+			} else {
+				im.Detach().Close()
+			}
+		}
+		for _, r := range readers {
+			r.Close()
+		}
+	}
+
+	// Serve closes attachments once their handlers return, including those for
+	// which no handler applies.
+	m := NewMux()
+	m.Handle(testTypeKept, func(*IMsg) error { return nil })
+	var readers []*os.File
+	for i := 0; i < rounds; i++ {
+		readers = append(readers, sendPipe(t, a, testTypeKept), sendPipe(t, a, 3))
+	}
+	a.CloseWrite()
+	err := Serve(context.Background(), b, m, WithErrorHandler(func(*IMsg, error) error { return nil }))
+	if err != nil && err != io.EOF {
+		t.Fatalf("unexpected Serve failure: %s", err)
+	}
+	for _, r := range readers {
+		r.Close()
+	}
+
+	if after := countOpenFDs(t); after != before {
+		t.Fatalf("descriptors leaked (%d open before, %d after)", before, after)
+	}
+}
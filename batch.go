@@ -0,0 +1,124 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"io"
+)
+
+// This is the size in bytes of the buffer of a BatchReader, which holds an imsg
+// of any size.
+const batchBufSizeInBytes = 64 * 1024
+
+// A BatchReader reads imsgs from a plain io.Reader in batches, saving the
+// system calls which reading each imsg separately would cost. Each call to
+// ReadMany performs at most one Read, of up to 64KB, and returns every complete
+// imsg it yielded, retaining any partial imsg for the next call. Like a
+// RingDecoder, a BatchReader may consume more of the reader than the imsgs it
+// has returned.
+type BatchReader struct {
+	r       io.Reader
+	maxSize uint16
+	buf     []byte
+	start   int   // Offset within buf of the first undecoded byte
+	end     int   // Offset within buf just past the last byte read
+	err     error // Error from the last Read, reported once buf drains
+}
+
+// NewBatchReader constructs a BatchReader which reads from the provided
+// io.Reader.
+func NewBatchReader(r io.Reader) *BatchReader {
+	return &BatchReader{
+		r:       r,
+		maxSize: MaxSizeInBytes,
+	}
+}
+
+// SetMaxSize sets the maximum size in bytes of an imsg which may be read, which
+// defaults to MaxSizeInBytes. Sizes smaller than HeaderSizeInBytes are
+// rejected.
+func (br *BatchReader) SetMaxSize(n uint16) error {
+	err := validateMaxSize(n)
+	if err != nil {
+		return err
+	}
+
+	br.maxSize = n
+
+	return nil
+}
+
+// Buffered returns the number of bytes which have been read from the
+// underlying io.Reader but not yet returned as imsgs.
+func (br *BatchReader) Buffered() int {
+	return br.end - br.start
+}
+
+// ReadMany returns up to max imsgs, or every complete imsg if max isn't
+// positive. Imsgs which remain buffered from an earlier Read are returned
+// without reading again; otherwise, a single Read is performed. If that Read
+// yields no complete imsg, no imsgs are returned, and the caller should
+// simply call ReadMany again. Once the underlying io.Reader is exhausted,
+// io.EOF is returned, or io.ErrUnexpectedEOF if it ended partway through an
+// imsg. An error from the Read is only returned once the imsgs which preceded
+// it have been.
+func (br *BatchReader) ReadMany(max int) ([]*IMsg, error) {
+	ims, err := br.decode(max)
+	if len(ims) > 0 || err != nil {
+		return ims, err
+	}
+
+	if br.err == nil {
+		if br.buf == nil {
+			br.buf = make([]byte, batchBufSizeInBytes)
+		}
+		// What remains is a partial imsg, which is moved to the front of the
+		// buffer to make room behind it.
+		br.end = copy(br.buf, br.buf[br.start:br.end])
+		br.start = 0
+
+		var n int
+		n, br.err = br.r.Read(br.buf[br.end:])
+		br.end += n
+
+		ims, err = br.decode(max)
+		if len(ims) > 0 || err != nil || br.err == nil {
+			return ims, err
+		}
+	}
+
+	err = br.err
+	if err == io.EOF && br.Buffered() > 0 {
+		err = io.ErrUnexpectedEOF
+	}
+
+	return nil, err
+}
+
+// decode returns up to max of the complete imsgs which are buffered. An error
+// decoding an imsg is only returned if no imsgs precede it, since the imsg
+// remains buffered and fails again on the next call.
+func (br *BatchReader) decode(max int) ([]*IMsg, error) {
+	var ims []*IMsg
+	for max <= 0 || len(ims) < max {
+		buf := br.buf[br.start:br.end]
+		n, err := frameLength(buf, br.maxSize, endianness)
+		if err == nil && n > 0 {
+			im := &IMsg{}
+			err = im.unmarshalBinary(buf[:n], br.maxSize)
+			if err == nil {
+				br.start += n
+				ims = append(ims, im)
+				continue
+			}
+		}
+		if err != nil && len(ims) == 0 {
+			return nil, err
+		}
+		break
+	}
+
+	return ims, nil
+}
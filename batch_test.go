@@ -0,0 +1,106 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestBatchReader(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	batch, stream := testRingBatch(rng, 1000, 512)
+
+	for _, chunks := range [][]int{nil, {1}, {7, 300, 4096}} {
+		cr := &chunkedReader{r: bytes.NewReader(stream), chunks: chunks}
+		br := NewBatchReader(cr)
+
+		var got []*IMsg
+		for {
+			reads := cr.reads
+			ims, err := br.ReadMany(10)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("unexpected ReadMany failure: %s", err)
+			}
+			if len(ims) > 10 || cr.reads-reads > 1 {
+				t.Fatalf("unexpected ReadMany result (%d imsgs, %d reads)", len(ims), cr.reads-reads)
+			}
+			got = append(got, ims...)
+		}
+
+		if len(got) != len(batch) {
+			t.Fatalf("unexpected count of imsgs read with chunks %v (%d != %d)", chunks, len(got), len(batch))
+		}
+		for i := range batch {
+			if got[i].Type != batch[i].Type || got[i].PID != batch[i].PID || !bytes.Equal(got[i].Data, batch[i].Data) {
+				t.Fatalf("imsg %d does not match what was written", i)
+			}
+		}
+	}
+}
+
+func TestBatchReaderSingleRead(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	_, stream := testRingBatch(rng, 100, 64)
+
+	// Everything which arrived in one Read is returned together.
+	cr := &chunkedReader{r: bytes.NewReader(stream)}
+	br := NewBatchReader(cr)
+	ims, err := br.ReadMany(0)
+	if err != nil || len(ims) != 100 || cr.reads != 1 {
+		t.Fatalf("unexpected ReadMany result (%d imsgs, %d reads, %v)", len(ims), cr.reads, err)
+	}
+}
+
+func TestBatchReaderErrors(t *testing.T) {
+	frame, _ := (&IMsg{Type: 1, Data: []byte("test")}).MarshalBinary()
+
+	// A stream which ends partway through an imsg.
+	br := NewBatchReader(bytes.NewReader(append(frame, frame[:5]...)))
+	ims, err := br.ReadMany(0)
+	if err != nil || len(ims) != 1 {
+		t.Fatalf("unexpected ReadMany result (%d imsgs, %v)", len(ims), err)
+	}
+	_, err = br.ReadMany(0)
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got: %v", err)
+	}
+
+	// An imsg which is too large follows a valid one.
+	err = br.SetMaxSize(HeaderSizeInBytes - 1)
+	if err == nil {
+		t.Fatalf("SetMaxSize accepted a size smaller than a header")
+	}
+	large, _ := (&IMsg{Type: 2, Data: []byte("too large")}).MarshalBinary()
+	br = NewBatchReader(bytes.NewReader(append(frame, large...)))
+	br.SetMaxSize(HeaderSizeInBytes + 4)
+	ims, err = br.ReadMany(0)
+	if err != nil || len(ims) != 1 {
+		t.Fatalf("unexpected ReadMany result (%d imsgs, %v)", len(ims), err)
+	}
+	_, err = br.ReadMany(0)
+	var bounds *ErrLengthOutOfBounds
+	if !errors.As(err, &bounds) {
+		t.Fatalf("expected ErrLengthOutOfBounds, got: %v", err)
+	}
+
+	// A read error is reported once the imsgs which preceded it have been.
+	errTest := errors.New("test")
+	br = NewBatchReader(&failingReader{bytes.NewReader(frame), errTest})
+	ims, err = br.ReadMany(0)
+	if err != nil || len(ims) != 1 {
+		t.Fatalf("unexpected ReadMany result (%d imsgs, %v)", len(ims), err)
+	}
+	_, err = br.ReadMany(0)
+	if err != errTest {
+		t.Fatalf("expected the read error, got: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"bytes"
+	"net"
+	"testing"
+)
+
+// newBenchmarkStream returns the reading end of a unix socket to which a burst
+// of small imsgs is written continually until the benchmark completes.
+func newBenchmarkStream(b *testing.B) *chunkedReader {
+	b.Helper()
+
+	w, r, err := SocketPair()
+	if err != nil {
+		b.Fatalf("failed to create socketpair: %s", err)
+	}
+	b.Cleanup(func() {
+		w.Close()
+		r.Close()
+	})
+
+	frame, _ := (&IMsg{Type: 1, Data: make([]byte, 64)}).MarshalBinary()
+	burst := bytes.Repeat(frame, 100)
+	go func(nc net.Conn) {
+		for {
+			_, err := nc.Write(burst)
+			if err != nil {
+				return
+			}
+		}
+	}(w.uc)
+
+	return &chunkedReader{r: r.uc}
+}
+
+func BenchmarkBatchReader(b *testing.B) {
+	cr := newBenchmarkStream(b)
+	br := NewBatchReader(cr)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; {
+		ims, err := br.ReadMany(b.N - n)
+		if err != nil {
+			b.Fatalf("unexpected ReadMany failure: %s", err)
+		}
+		n += len(ims)
+	}
+	b.ReportMetric(float64(cr.reads)/float64(b.N), "reads/op")
+}
+
+func BenchmarkBatchReaderReadIMsg(b *testing.B) {
+	cr := newBenchmarkStream(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := ReadIMsg(cr)
+		if err != nil {
+			b.Fatalf("unexpected ReadIMsg failure: %s", err)
+		}
+	}
+	b.ReportMetric(float64(cr.reads)/float64(b.N), "reads/op")
+}
@@ -0,0 +1,45 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"math"
+)
+
+// Broadcast sends an imsg to each of the provided Conns, marshaling it only
+// once. A failure to send to one Conn doesn't prevent the imsg from being sent
+// to the rest; if any sends fail, ErrBroadcast is returned identifying them.
+// Since a descriptor can only be passed once, imsgs with files attached are
+// refused with ErrUnsupported, as are imsgs marked by WithWipe, whose shared
+// marshaling can't be wiped while it may remain queued on some of the Conns.
+func Broadcast(im *IMsg, conns ...*Conn) error {
+	if im.file != nil || im.flags&FlagHasFD != 0 {
+		return &ErrUnsupported{"descriptor passing in a broadcast"}
+	}
+	if im.wipe {
+		return &ErrUnsupported{"wiping in a broadcast"}
+	}
+
+	bs, err := im.marshalBinary(math.MaxUint16)
+	if err != nil {
+		return err
+	}
+
+	var (
+		errs   = make([]error, len(conns))
+		failed bool
+	)
+	for i, c := range conns {
+		errs[i] = c.sendMarshaled(im, bs)
+		if errs[i] != nil {
+			failed = true
+		}
+	}
+	if failed {
+		return &ErrBroadcast{errs}
+	}
+
+	return nil
+}
@@ -0,0 +1,129 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestBroadcast(t *testing.T) {
+	var senders, receivers []*Conn
+	for i := 0; i < 3; i++ {
+		a, b := newTestSocketPair(t)
+		senders = append(senders, a)
+		receivers = append(receivers, b)
+	}
+
+	im := &IMsg{Type: 1, PeerID: 2, PID: 3, Data: []byte("test")}
+	err := Broadcast(im, senders...)
+	if err != nil {
+		t.Fatalf("unexpected Broadcast failure: %s", err)
+	}
+	for _, c := range receivers {
+		got, err := c.Recv()
+		if err != nil {
+			t.Fatalf("unexpected Recv failure: %s", err)
+		}
+		if !got.Equal(im) {
+			t.Fatalf("broadcast imsg does not match (%v != %v)", got, im)
+		}
+	}
+
+	// Failed sends are identified while the rest still go out.
+	receivers[0].Close()
+	err = senders[2].SetMaxSize(HeaderSizeInBytes)
+	if err != nil {
+		t.Fatalf("unexpected SetMaxSize failure: %s", err)
+	}
+
+	var eb *ErrBroadcast
+	err = Broadcast(im, senders...)
+	if !errors.As(err, &eb) || len(eb.Errs) != 3 {
+		t.Fatalf("expected ErrBroadcast for 3 connections, got: %v", err)
+	}
+	var ew *ErrWrite
+	if !errors.As(eb.Errs[0], &ew) {
+		t.Fatalf("expected ErrWrite for closed connection, got: %v", eb.Errs[0])
+	}
+	if eb.Errs[1] != nil {
+		t.Fatalf("unexpected failure for healthy connection: %s", eb.Errs[1])
+	}
+	if !errors.Is(eb.Errs[2], ErrTooLarge) || !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected ErrDataTooLarge for limited connection, got: %v", eb.Errs[2])
+	}
+	got, err := receivers[1].Recv()
+	if err != nil || !got.Equal(im) {
+		t.Fatalf("unexpected Recv result after partial broadcast (%v, %v)", got, err)
+	}
+
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("failed to open %s: %s", os.DevNull, err)
+	}
+	defer f.Close()
+	withFile, _ := ComposeIMsgWithFile(1, 2, nil, f)
+	var eu *ErrUnsupported
+	err = Broadcast(withFile, senders[1])
+	if !errors.As(err, &eu) {
+		t.Fatalf("expected ErrUnsupported, got: %v", err)
+	}
+}
+
+// newBenchmarkConns constructs n Conns whose peers discard everything they
+// receive.
+func newBenchmarkConns(b *testing.B, n int) []*Conn {
+	b.Helper()
+
+	var conns []*Conn
+	for i := 0; i < n; i++ {
+		c, peer, err := SocketPair()
+		if err != nil {
+			b.Fatalf("failed to create socketpair: %s", err)
+		}
+		b.Cleanup(func() {
+			c.Close()
+			peer.Close()
+		})
+		go io.Copy(io.Discard, peer.conn)
+		conns = append(conns, c)
+	}
+
+	return conns
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	conns := newBenchmarkConns(b, 8)
+	im := &IMsg{Type: 1, Data: make([]byte, 1024)}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := Broadcast(im, conns...)
+		if err != nil {
+			b.Fatalf("unexpected Broadcast failure: %s", err)
+		}
+	}
+}
+
+func BenchmarkBroadcastLoop(b *testing.B) {
+	conns := newBenchmarkConns(b, 8)
+	im := &IMsg{Type: 1, Data: make([]byte, 1024)}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, c := range conns {
+			err := c.Send(im)
+			if err != nil {
+				b.Fatalf("unexpected Send failure: %s", err)
+			}
+		}
+	}
+}
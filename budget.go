@@ -0,0 +1,227 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// This is the smallest allocation made for the data of an imsg being read
+// incrementally.
+const minIncrementalAlloc = 512
+
+// An AllocationBudget caps the memory which Decoders and Conns sharing it may
+// have allocated for imsgs they've yet to finish reading. A peer which sends a
+// header claiming a large imsg and then stalls otherwise pins that much memory
+// for as long as it likes; with many such peers, a budget bounds the total. An
+// AllocationBudget is safe for concurrent use.
+type AllocationBudget struct {
+	limit int64
+	used  atomic.Int64
+}
+
+// NewAllocationBudget constructs an AllocationBudget allowing up to limit
+// bytes to be allocated at once.
+func NewAllocationBudget(limit int) *AllocationBudget {
+	return &AllocationBudget{limit: int64(limit)}
+}
+
+// Limit returns the number of bytes which may be allocated at once.
+func (b *AllocationBudget) Limit() int {
+	return int(b.limit)
+}
+
+// InUse returns the number of bytes currently allocated against the budget.
+func (b *AllocationBudget) InUse() int {
+	return int(b.used.Load())
+}
+
+// reserve allocates n bytes against the budget, returning ErrAllocationLimit
+// if that would exceed its limit.
+func (b *AllocationBudget) reserve(n int) error {
+	for {
+		used := b.used.Load()
+		if used+int64(n) > b.limit {
+			return &ErrAllocationLimit{n, int(b.limit)}
+		}
+		if b.used.CompareAndSwap(used, used+int64(n)) {
+			return nil
+		}
+	}
+}
+
+// release returns n bytes to the budget.
+func (b *AllocationBudget) release(n int) {
+	b.used.Add(-int64(n))
+}
+
+// SetAllocationBudget causes the Decoder to account for the data of each imsg
+// it reads against the provided budget, which may be shared with other
+// Decoders. Memory for an imsg's data is reserved from the budget until the
+// imsg has been read, and an imsg which doesn't fit is refused with
+// ErrAllocationLimit, after which the stream can't be resumed. A nil budget
+// removes the limit. The budget doesn't apply in zero-copy mode, in which the
+// Decoder allocates nothing per imsg.
+func (d *Decoder) SetAllocationBudget(b *AllocationBudget) {
+	d.budget = b
+}
+
+// SetIncrementalRead controls whether the Decoder allocates memory for an
+// imsg's data only as that data arrives, rather than all at once when the
+// header is read. Data is read into a buffer retained by the Decoder and
+// copied into an allocation of the exact size once complete, so a peer must
+// actually send data to cause memory to be allocated for it. Combined with
+// SetAllocationBudget, only the data received so far counts against the
+// budget.
+func (d *Decoder) SetIncrementalRead(enabled bool) {
+	d.incremental = enabled
+	d.ibuf = nil
+}
+
+// WithAllocationBudget causes the Conn to account for the data it has read but
+// not yet returned as imsgs against the provided budget, which may be shared
+// with other Conns and Decoders. A Conn always reads incrementally, holding only
+// the data which has arrived, so a stalled peer pins no more of the budget than
+// it has actually sent. A read which would exceed the budget fails the Conn with
+// ErrAllocationLimit. The Conn's share is returned as imsgs are received, and in
+// full once it's closed.
+func WithAllocationBudget(b *AllocationBudget) ConnOption {
+	return func(c *Conn) {
+		c.budget = b
+	}
+}
+
+// chargeBudget brings the Conn's reservation from its allocation budget in line
+// with the n bytes it has buffered. The caller must hold rmu.
+func (c *Conn) chargeBudget(n int) error {
+	if c.budget == nil {
+		return nil
+	}
+
+	if n > c.reserved {
+		err := c.budget.reserve(n - c.reserved)
+		if err != nil {
+			return err
+		}
+	} else {
+		c.budget.release(c.reserved - n)
+	}
+	c.reserved = n
+
+	return nil
+}
+
+// decodeGuarded reads the next imsg while accounting for its data against the
+// allocation budget, if any, reading the data incrementally if requested.
+func (d *Decoder) decodeGuarded() (*IMsg, int, error) {
+	n, err := io.ReadFull(d.r, d.hdr[:])
+	switch {
+	case err == io.EOF:
+		return nil, 0, err
+	case err == io.ErrUnexpectedEOF:
+		return nil, n, &ErrTruncated{HeaderSizeInBytes, n, "header"}
+	case err != nil:
+		return nil, n, &ErrRead{"header", err}
+	}
+
+	im := &IMsg{}
+	length, err := im.getHeader(d.hdr[:], d.maxSize)
+	if err != nil {
+		return nil, n, err
+	}
+	size := length - HeaderSizeInBytes
+	if size == 0 {
+		return im, n, nil
+	}
+
+	var m int
+	if d.incremental {
+		m, err = d.readIncremental(im, size)
+	} else {
+		m, err = d.readReserved(im, size)
+	}
+	n += m
+	if err != nil {
+		return nil, n, err
+	}
+
+	return im, n, nil
+}
+
+// readReserved reads size bytes of data into im, reserving them from the
+// budget for the duration of the read.
+func (d *Decoder) readReserved(im *IMsg, size int) (int, error) {
+	if d.budget != nil {
+		err := d.budget.reserve(size)
+		if err != nil {
+			return 0, err
+		}
+		defer d.budget.release(size)
+	}
+
+	im.Data = make([]byte, size)
+
+	m, err := io.ReadFull(d.r, im.Data)
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return m, &ErrTruncated{size, m, "body"}
+	case err != nil:
+		return m, &ErrRead{"body", err}
+	}
+
+	return m, nil
+}
+
+// readIncremental reads size bytes of data into im, growing the Decoder's
+// retained buffer only as the data arrives. Growth of the buffer is reserved
+// from the budget until the read is complete.
+func (d *Decoder) readIncremental(im *IMsg, size int) (int, error) {
+	var reserved int
+	if d.budget != nil {
+		defer func() { d.budget.release(reserved) }()
+	}
+
+	buf := d.ibuf[:0]
+	for len(buf) < size {
+		if len(buf) == cap(buf) {
+			grown := 2 * cap(buf)
+			if grown < minIncrementalAlloc {
+				grown = minIncrementalAlloc
+			}
+			if grown > size {
+				grown = size
+			}
+
+			if d.budget != nil {
+				err := d.budget.reserve(grown)
+				if err != nil {
+					return len(buf), err
+				}
+				reserved += grown
+			}
+
+			buf = append(make([]byte, 0, grown), buf...)
+			d.ibuf = buf
+		}
+
+		m, err := d.r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+m]
+		if len(buf) == size {
+			break
+		}
+		switch {
+		case err == io.EOF:
+			return len(buf), &ErrTruncated{size, len(buf), "body"}
+		case err != nil:
+			return len(buf), &ErrRead{"body", err}
+		}
+	}
+
+	im.Data = make([]byte, size)
+	copy(im.Data, buf)
+
+	return size, nil
+}
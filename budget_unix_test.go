@@ -0,0 +1,69 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"errors"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestConnAllocationBudget(t *testing.T) {
+	budget := NewAllocationBudget(100)
+
+	// A header claiming the largest imsg, followed by some of its data.
+	partial := make([]byte, HeaderSizeInBytes+10)
+	endianness.PutUint16(partial[4:6], MaxSizeInBytes)
+
+	// A stalled peer pins only as much as it has sent.
+	stalled, fd := newRawTestConn(t, WithAllocationBudget(budget))
+	t.Cleanup(func() { stalled.Close() })
+	_, err := unix.Write(fd, partial)
+	if err != nil {
+		t.Fatalf("unexpected write failure: %s", err)
+	}
+	go stalled.Recv()
+	waitForInUse(t, budget, len(partial))
+
+	// A peer which keeps sending fails the Conn once it would exceed the
+	// budget.
+	greedy, fd := newRawTestConn(t, WithAllocationBudget(budget))
+	t.Cleanup(func() { greedy.Close() })
+	_, err = unix.Write(fd, append(partial, make([]byte, 60)...))
+	if err != nil {
+		t.Fatalf("unexpected write failure: %s", err)
+	}
+	var eal *ErrAllocationLimit
+	_, err = greedy.Recv()
+	if !errors.As(err, &eal) || eal.Limit != 100 {
+		t.Fatalf("expected ErrAllocationLimit, got: %v", err)
+	}
+	_, err = greedy.Recv()
+	var ecf *ErrConnFailed
+	if !errors.As(err, &ecf) || !errors.As(err, &eal) {
+		t.Fatalf("expected ErrConnFailed, got: %v", err)
+	}
+	greedy.Close()
+	waitForInUse(t, budget, len(partial))
+
+	// Complete imsgs return their share once received.
+	c, fd := newRawTestConn(t, WithAllocationBudget(budget))
+	t.Cleanup(func() { c.Close() })
+	frame, _ := IMsg{Type: 1, Data: []byte("test")}.MarshalBinary()
+	_, err = unix.Write(fd, frame)
+	if err != nil {
+		t.Fatalf("unexpected write failure: %s", err)
+	}
+	im, err := c.Recv()
+	if err != nil || im.Type != 1 || string(im.Data) != "test" {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+	if budget.InUse() != len(partial) {
+		t.Fatalf("unexpected allocation in use (%d != %d)", budget.InUse(), len(partial))
+	}
+}
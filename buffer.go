@@ -0,0 +1,221 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"io"
+)
+
+// A Buffer queues imsgs being sent to and received from an io.ReadWriter. It
+// mirrors the imsgbuf interface of the C implementation, which makes it well
+// suited to event loops as well as to porting code which uses imsg_init,
+// imsg_compose, imsg_read, imsg_get, and imsg_flush.
+type Buffer struct {
+	rw io.ReadWriter
+
+	rbuf   []byte // Bytes read but not yet consumed
+	rtmp   []byte // Scratch space for reads
+	peeked *IMsg  // The imsg at the front of rbuf, if returned by Peek
+
+	wq *MsgBuf // Imsgs waiting to be written
+
+	maxSize uint16 // Maximum size in bytes of an imsg
+
+	recvd   recvCounters // Reported by Stats
+	metrics MetricsHook  // Notified as imsgs are received
+}
+
+// NewBuffer constructs a Buffer which sends and receives imsgs over the
+// provided io.ReadWriter. This is the equivalent of imsg_init.
+func NewBuffer(rw io.ReadWriter) *Buffer {
+	return &Buffer{
+		rw:      rw,
+		wq:      NewMsgBuf(rw),
+		maxSize: MaxSizeInBytes,
+		metrics: NopMetricsHook{},
+	}
+}
+
+// SetMaxSize sets the maximum size in bytes of an imsg which may be sent or
+// received, which defaults to MaxSizeInBytes. Peers which agree on a larger
+// maximum may exchange imsgs of up to 65535 bytes. Sizes smaller than
+// HeaderSizeInBytes are rejected. This is the equivalent of
+// imsgbuf_set_maxsize.
+func (b *Buffer) SetMaxSize(n uint16) error {
+	err := b.wq.SetMaxSize(n)
+	if err != nil {
+		return err
+	}
+
+	b.maxSize = n
+	b.peeked = nil
+
+	return nil
+}
+
+// Compose constructs an imsg and queues it for sending by a subsequent call to
+// Flush. If the included ancillary data is too large, an error is returned and
+// nothing is queued. This is the equivalent of imsg_compose.
+func (b *Buffer) Compose(typ, peerID, pid uint32, data []byte) error {
+	return b.wq.Enqueue(&IMsg{
+		Type:   typ,
+		PeerID: peerID,
+		PID:    pid,
+		Data:   data,
+	})
+}
+
+// Composev behaves like Compose, except that the ancillary data is the
+// concatenation of the provided slices. The slices are copied directly into the
+// queued imsg without first being joined. This is the equivalent of
+// imsg_composev.
+func (b *Buffer) Composev(typ, peerID, pid uint32, data ...[]byte) error {
+	return b.wq.enqueuev(typ, peerID, pid, data)
+}
+
+// Flush writes all queued imsgs to the underlying io.ReadWriter. If only part
+// of an imsg can be written, the remainder is written by the next call to
+// Flush. When the underlying io.ReadWriter is a non-blocking descriptor which
+// can't accept more data, ErrWouldBlock is returned. This is the equivalent of
+// imsg_flush.
+func (b *Buffer) Flush() error {
+	_, err := b.wq.Flush()
+	return err
+}
+
+// QueueLen returns the number of imsgs waiting to be written. This is the
+// equivalent of msgbuf_queuelen.
+func (b *Buffer) QueueLen() int {
+	return b.wq.QueueLen()
+}
+
+// PendingBytes returns the number of bytes waiting to be written.
+func (b *Buffer) PendingBytes() int {
+	return b.wq.PendingBytes()
+}
+
+// Clear drops all imsgs waiting to be written. This is the equivalent of
+// imsg_clear.
+func (b *Buffer) Clear() {
+	b.wq.Clear()
+}
+
+// Read performs a single read from the underlying io.ReadWriter, buffering
+// whatever data is available for subsequent calls to Get. io.EOF is returned
+// once the underlying io.ReadWriter has no more data. When the underlying
+// io.ReadWriter is a non-blocking descriptor with no data available,
+// ErrWouldBlock is returned. Other errors from the underlying io.ReadWriter are
+// wrapped in an ErrRead. This is the equivalent of imsg_read.
+func (b *Buffer) Read() error {
+	if b.rtmp == nil {
+		b.rtmp = make([]byte, readBufSizeInBytes)
+	}
+
+	n, err := b.rw.Read(b.rtmp)
+	if n > 0 {
+		b.rbuf = append(b.rbuf, b.rtmp[:n]...)
+		b.recvd.bytes.Add(uint64(n))
+	}
+	if err != nil && err != io.EOF {
+		if isWouldBlock(err) {
+			return ErrWouldBlock
+		}
+		b.metrics.OnError("read", err)
+		return &ErrRead{"stream", err}
+	}
+
+	return err
+}
+
+// Feed buffers data obtained by the caller for subsequent calls to Get. This
+// allows the Buffer to be driven by an event loop which performs its own
+// reads. The data is copied, so p may be reused once Feed returns.
+func (b *Buffer) Feed(p []byte) {
+	b.rbuf = append(b.rbuf, p...)
+	b.recvd.bytes.Add(uint64(len(p)))
+}
+
+// Get returns the next complete imsg which has been read or fed. If no complete
+// imsg is buffered, a nil IMsg and nil error are returned. This is the
+// equivalent of imsg_get.
+func (b *Buffer) Get() (*IMsg, error) {
+	n, err := frameLength(b.rbuf, b.maxSize, endianness)
+	if err != nil {
+		b.recvd.decodeErrors.Add(1)
+		b.metrics.OnError("decode", err)
+		return nil, err
+	}
+	if n == 0 {
+		return nil, nil
+	}
+
+	im := b.peeked
+	b.peeked = nil
+	if im == nil {
+		im = &IMsg{}
+		err = im.unmarshalBinary(b.rbuf[:n], b.maxSize)
+		if err != nil {
+			b.recvd.decodeErrors.Add(1)
+			b.metrics.OnError("decode", err)
+			return nil, err
+		}
+	} else if checkPeeked {
+		mustBeUnmodified(im, b.rbuf[:n])
+	}
+	b.rbuf = b.rbuf[n:]
+	b.recvd.messages.Add(1)
+	b.metrics.OnRecv(im.Type, n)
+
+	return im, nil
+}
+
+// Peek returns the next complete imsg which has been read or fed without
+// removing it, reporting whether there was one; the next call to Get returns
+// the same imsg. This lets an event loop decide whether to handle an imsg now
+// or leave it queued. The imsg must not be modified until it has been returned
+// by Get, which is checked when built with the imsgdebug tag. An imsg which
+// can't be decoded isn't returned, and its error is reported by Get.
+func (b *Buffer) Peek() (*IMsg, bool) {
+	if b.peeked != nil {
+		return b.peeked, true
+	}
+
+	n, err := frameLength(b.rbuf, b.maxSize, endianness)
+	if err != nil || n == 0 {
+		return nil, false
+	}
+	im := &IMsg{}
+	err = im.unmarshalBinary(b.rbuf[:n], b.maxSize)
+	if err != nil {
+		return nil, false
+	}
+	b.peeked = im
+
+	return im, true
+}
+
+// PeekHeader returns the header of the next complete imsg which has been read
+// or fed without removing it, reporting whether there was one. Unlike Peek, it
+// doesn't decode the imsg's data.
+func (b *Buffer) PeekHeader() (Header, bool) {
+	n, err := frameLength(b.rbuf, b.maxSize, endianness)
+	if err != nil || n == 0 {
+		return Header{}, false
+	}
+
+	return parseHeader(b.rbuf, endianness), true
+}
+
+// mustBeUnmodified panics if an imsg returned by Peek no longer matches the
+// frame it was decoded from.
+func mustBeUnmodified(im *IMsg, frame []byte) {
+	var orig IMsg
+	err := orig.unmarshalBinary(frame, uint16(len(frame)))
+	if err != nil || im.Type != orig.Type || im.PeerID != orig.PeerID ||
+		im.PID != orig.PID || im.flags != orig.flags || !bytes.Equal(im.Data, orig.Data) {
+		panic("imsg: imsg returned by Buffer.Peek was modified")
+	}
+}
@@ -0,0 +1,28 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build imsgdebug
+
+package imsg
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestBufferPeekModified(t *testing.T) {
+	b := NewBuffer(&bytes.Buffer{})
+	bs, _ := (&IMsg{Type: 1, Data: []byte("test")}).MarshalBinary()
+	b.Feed(bs)
+
+	im, _ := b.Peek()
+	im.Data[0] = 'b'
+
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("Get didn't panic on a modified imsg")
+		}
+	}()
+	b.Get()
+}
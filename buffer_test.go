@@ -0,0 +1,368 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestBufferComposeFlush(t *testing.T) {
+	var wire bytes.Buffer
+	b := NewBuffer(&wire)
+
+	err := b.Compose(1, 2, 3, []byte("test"))
+	if err != nil {
+		t.Fatalf("unexpected Compose failure: %s", err)
+	}
+	err = b.Compose(4, 5, 6, nil)
+	if err != nil {
+		t.Fatalf("unexpected Compose failure: %s", err)
+	}
+	if wire.Len() != 0 {
+		t.Fatalf("data was written before Flush")
+	}
+
+	var edtl *ErrDataTooLarge
+	err = b.Compose(7, 0, 0, make([]byte, MaxSizeInBytes))
+	if !errors.As(err, &edtl) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+
+	err = b.Flush()
+	if err != nil {
+		t.Fatalf("unexpected Flush failure: %s", err)
+	}
+
+	first, _ := IMsg{Type: 1, PeerID: 2, PID: 3, Data: []byte("test")}.MarshalBinary()
+	second, _ := IMsg{Type: 4, PeerID: 5, PID: 6}.MarshalBinary()
+	if !bytes.Equal(wire.Bytes(), append(first, second...)) {
+		t.Fatalf("flushed data does not match expected output (% x)", wire.Bytes())
+	}
+}
+
+func TestBufferComposev(t *testing.T) {
+	var wire, wirev bytes.Buffer
+	b := NewBuffer(&wire)
+	bv := NewBuffer(&wirev)
+
+	err := b.Compose(1, 2, 3, []byte("header+tail"))
+	if err != nil {
+		t.Fatalf("unexpected Compose failure: %s", err)
+	}
+	err = bv.Composev(1, 2, 3, []byte("header"), nil, []byte("+tail"))
+	if err != nil {
+		t.Fatalf("unexpected Composev failure: %s", err)
+	}
+
+	var edtl *ErrDataTooLarge
+	err = bv.Composev(1, 2, 3, make([]byte, MaxSizeInBytes/2), make([]byte, MaxSizeInBytes/2))
+	if !errors.As(err, &edtl) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+
+	if b.Flush() != nil || bv.Flush() != nil {
+		t.Fatalf("unexpected Flush failure")
+	}
+	if !bytes.Equal(wire.Bytes(), wirev.Bytes()) {
+		t.Fatalf("vectored output does not match expected output (% x != % x)", wirev.Bytes(), wire.Bytes())
+	}
+}
+
+func TestBufferReadGet(t *testing.T) {
+	var wire bytes.Buffer
+	b := NewBuffer(&wire)
+
+	im, err := b.Get()
+	if im != nil || err != nil {
+		t.Fatalf("Get on an empty Buffer returned (%#v, %v)", im, err)
+	}
+
+	frame, _ := IMsg{Type: 1, Data: []byte("test")}.MarshalBinary()
+
+	// Provide a partial imsg, which must not be returned.
+	wire.Write(frame[:10])
+	err = b.Read()
+	if err != nil {
+		t.Fatalf("unexpected Read failure: %s", err)
+	}
+	im, err = b.Get()
+	if im != nil || err != nil {
+		t.Fatalf("Get on an incomplete imsg returned (%#v, %v)", im, err)
+	}
+
+	// Complete the imsg and provide another in the same read.
+	wire.Write(frame[10:])
+	wire.Write(frame)
+	err = b.Read()
+	if err != nil {
+		t.Fatalf("unexpected Read failure: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		im, err = b.Get()
+		if err != nil {
+			t.Fatalf("unexpected Get failure: %s", err)
+		}
+		if im == nil || im.Type != 1 || !bytes.Equal(im.Data, []byte("test")) {
+			t.Fatalf("unexpected imsg returned by Get (%#v)", im)
+		}
+	}
+	im, err = b.Get()
+	if im != nil || err != nil {
+		t.Fatalf("Get on a drained Buffer returned (%#v, %v)", im, err)
+	}
+
+	err = b.Read()
+	if err != io.EOF {
+		t.Fatalf("expected EOF, got: %v", err)
+	}
+}
+
+func TestBufferGetInvalidLength(t *testing.T) {
+	var wire bytes.Buffer
+	b := NewBuffer(&wire)
+
+	wire.Write([]byte{0, 0, 0, 0, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0})
+	err := b.Read()
+	if err != nil {
+		t.Fatalf("unexpected Read failure: %s", err)
+	}
+
+	var eloob *ErrLengthOutOfBounds
+	_, err = b.Get()
+	if !errors.As(err, &eloob) {
+		t.Fatalf("expected ErrLengthOutOfBounds, got: %v", err)
+	}
+}
+
+func TestBufferFeedByteAtATime(t *testing.T) {
+	msgs := []*IMsg{
+		{Type: 1, PeerID: 2, PID: 3, Data: []byte("first")},
+		{Type: 4},
+		{Type: 5, Data: bytes.Repeat([]byte{0xaa}, 300)},
+	}
+
+	var stream []byte
+	for _, im := range msgs {
+		bs, _ := im.MarshalBinary()
+		stream = append(stream, bs...)
+	}
+
+	b := NewBuffer(nil)
+	var got []*IMsg
+	for i := range stream {
+		b.Feed(stream[i : i+1])
+
+		for {
+			im, err := b.Get()
+			if err != nil {
+				t.Fatalf("unexpected Get failure after %d bytes: %s", i+1, err)
+			}
+			if im == nil {
+				break
+			}
+			got = append(got, im)
+		}
+	}
+
+	if len(got) != len(msgs) {
+		t.Fatalf("unexpected number of imsgs decoded (%d != %d)", len(got), len(msgs))
+	}
+	for i := range msgs {
+		if got[i].Type != msgs[i].Type || !bytes.Equal(got[i].Data, msgs[i].Data) {
+			t.Fatalf("decoded imsg %d does not match (%#v != %#v)", i, got[i], msgs[i])
+		}
+	}
+}
+
+func TestBufferFeedMultiple(t *testing.T) {
+	first, _ := IMsg{Type: 1}.MarshalBinary()
+	second, _ := IMsg{Type: 2, Data: []byte("x")}.MarshalBinary()
+
+	// Feed two complete imsgs and the header of a third in a single call.
+	b := NewBuffer(nil)
+	b.Feed(append(append(first, second...), first[:8]...))
+
+	for _, typ := range []uint32{1, 2} {
+		im, err := b.Get()
+		if err != nil || im == nil || im.Type != typ {
+			t.Fatalf("unexpected Get result (%#v, %v)", im, err)
+		}
+	}
+
+	im, err := b.Get()
+	if im != nil || err != nil {
+		t.Fatalf("Get on a partial header returned (%#v, %v)", im, err)
+	}
+
+	b.Feed(first[8:])
+	im, err = b.Get()
+	if err != nil || im == nil || im.Type != 1 {
+		t.Fatalf("unexpected Get result (%#v, %v)", im, err)
+	}
+}
+
+func TestBufferSetMaxSize(t *testing.T) {
+	var eloob *ErrLengthOutOfBounds
+	err := NewBuffer(nil).SetMaxSize(HeaderSizeInBytes - 1)
+	if !errors.As(err, &eloob) {
+		t.Fatalf("expected ErrLengthOutOfBounds, got: %v", err)
+	}
+
+	var wire bytes.Buffer
+	sender := NewBuffer(&wire)
+	err = sender.SetMaxSize(65535)
+	if err != nil {
+		t.Fatalf("unexpected SetMaxSize failure: %s", err)
+	}
+
+	data := bytes.Repeat([]byte{0xaa}, 20000)
+	err = sender.Compose(1, 0, 0, data)
+	if err != nil {
+		t.Fatalf("unexpected Compose failure: %s", err)
+	}
+	err = sender.Flush()
+	if err != nil {
+		t.Fatalf("unexpected Flush failure: %s", err)
+	}
+	frame := append([]byte(nil), wire.Bytes()...)
+
+	// A receiver configured for the larger size accepts the imsg.
+	receiver := NewBuffer(nil)
+	err = receiver.SetMaxSize(65535)
+	if err != nil {
+		t.Fatalf("unexpected SetMaxSize failure: %s", err)
+	}
+	receiver.Feed(frame)
+	im, err := receiver.Get()
+	if err != nil {
+		t.Fatalf("unexpected Get failure: %s", err)
+	}
+	if im == nil || !bytes.Equal(im.Data, data) {
+		t.Fatalf("received imsg does not match sent imsg")
+	}
+
+	// A default receiver rejects it.
+	receiver = NewBuffer(nil)
+	receiver.Feed(frame)
+	_, err = receiver.Get()
+	if !errors.As(err, &eloob) {
+		t.Fatalf("expected ErrLengthOutOfBounds, got: %v", err)
+	}
+
+	// As does a default sender.
+	var edtl *ErrDataTooLarge
+	err = NewBuffer(&wire).Compose(1, 0, 0, data)
+	if !errors.As(err, &edtl) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+}
+
+func TestBufferStats(t *testing.T) {
+	var wire bytes.Buffer
+	b := NewBuffer(&wire)
+
+	b.Compose(1, 0, 0, []byte("test"))
+	b.Compose(2, 0, 0, nil)
+	s := b.Stats()
+	if s.MessagesSent != 0 || s.BytesSent != 0 || s.SendQueueLen != 2 || s.SendQueueHighWater != 2 {
+		t.Fatalf("unexpected stats before Flush (%+v)", s)
+	}
+
+	err := b.Flush()
+	if err != nil {
+		t.Fatalf("unexpected Flush failure: %s", err)
+	}
+	s = b.Stats()
+	if s.MessagesSent != 2 || s.BytesSent != 36 || s.SendQueueLen != 0 || s.SendQueueHighWater != 2 {
+		t.Fatalf("unexpected stats after Flush (%+v)", s)
+	}
+
+	// Read the imsgs back, followed by a frame which can't be decoded.
+	wire.Write(make([]byte, HeaderSizeInBytes))
+	err = b.Read()
+	if err != nil {
+		t.Fatalf("unexpected Read failure: %s", err)
+	}
+	for i := 0; i < 2; i++ {
+		_, err := b.Get()
+		if err != nil {
+			t.Fatalf("unexpected Get failure: %s", err)
+		}
+	}
+	_, err = b.Get()
+	if err == nil {
+		t.Fatalf("expected Get failure for invalid frame")
+	}
+
+	s = b.Stats()
+	expected := Stats{
+		MessagesSent:       2,
+		MessagesReceived:   2,
+		BytesSent:          36,
+		BytesReceived:      52,
+		SendQueueHighWater: 2,
+		DecodeErrors:       1,
+	}
+	if s != expected {
+		t.Fatalf("unexpected stats (%+v != %+v)", s, expected)
+	}
+}
+
+func TestBufferPeek(t *testing.T) {
+	b := NewBuffer(&bytes.Buffer{})
+
+	_, ok := b.Peek()
+	if ok {
+		t.Fatalf("Peek returned an imsg from an empty buffer")
+	}
+
+	stream, _ := MarshalAll([]*IMsg{
+		{Type: 1, PeerID: 2, PID: 3, Data: []byte("first")},
+		{Type: 2, Data: []byte("second")},
+		{Type: 3},
+	})
+	// Only part of the last imsg has arrived.
+	b.Feed(stream[:len(stream)-1])
+
+	for i, typ := range []uint32{1, 2} {
+		hdr, ok := b.PeekHeader()
+		if !ok || hdr.Type != typ {
+			t.Fatalf("unexpected PeekHeader result (%v, %t)", hdr, ok)
+		}
+		peeked, ok := b.Peek()
+		if !ok || peeked.Type != typ {
+			t.Fatalf("unexpected Peek result (%v, %t)", peeked, ok)
+		}
+		again, _ := b.Peek()
+		if again != peeked {
+			t.Fatalf("repeated Peek returned a different imsg")
+		}
+
+		im, err := b.Get()
+		if err != nil || im != peeked {
+			t.Fatalf("Get returned a different imsg than Peek (%v, %v)", im, err)
+		}
+		if i == 0 && (im.PeerID != 2 || im.PID != 3 || string(im.Data) != "first") {
+			t.Fatalf("unexpected imsg (%v)", im)
+		}
+	}
+
+	// The incomplete imsg can't be peeked until the rest of it arrives.
+	_, ok = b.Peek()
+	if _, hok := b.PeekHeader(); ok || hok {
+		t.Fatalf("an incomplete imsg was peeked")
+	}
+	b.Feed(stream[len(stream)-1:])
+	im, err := b.Get()
+	if err != nil || im.Type != 3 {
+		t.Fatalf("unexpected Get result (%v, %v)", im, err)
+	}
+	if s := b.Stats(); s.MessagesReceived != 3 {
+		t.Fatalf("unexpected count of received imsgs: %d", s.MessagesReceived)
+	}
+}
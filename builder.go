@@ -0,0 +1,90 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"errors"
+)
+
+// ErrBuilderDone is returned when a Builder is used after it has been closed or
+// aborted.
+var ErrBuilderDone = errors.New("imsg: builder already closed or aborted")
+
+// A Builder incrementally builds the ancillary data of an imsg which is sent
+// once the Builder is closed, mirroring imsg_create, imsg_add, and imsg_close in
+// the C implementation. Nothing is written to the Conn until Close is called. A
+// Builder isn't safe for concurrent use.
+type Builder struct {
+	c    *Conn
+	im   *IMsg
+	max  int
+	done bool
+}
+
+// Create begins building an imsg with the provided header fields, to be sent
+// over the Conn once its data has been added. expectedLen is a hint of how
+// large the data will grow, which is used to size the Builder's buffer up
+// front. An expectedLen larger than the Conn allows is refused with
+// ErrDataTooLarge.
+func (c *Conn) Create(typ, peerID, pid uint32, expectedLen int) (*Builder, error) {
+	max := int(c.maxSize.Load()) - HeaderSizeInBytes
+	if expectedLen > max {
+		return nil, &ErrDataTooLarge{expectedLen, max, typ, peerID}
+	}
+	if expectedLen < 0 {
+		expectedLen = 0
+	}
+
+	return &Builder{
+		c: c,
+		im: &IMsg{
+			Type:   typ,
+			PeerID: peerID,
+			PID:    pid,
+			Data:   make([]byte, 0, expectedLen),
+		},
+		max: max,
+	}, nil
+}
+
+// Add appends bs to the imsg's data. If doing so would exceed the maximum size
+// of an imsg sent over the Conn, ErrDataTooLarge is returned and nothing is
+// appended, leaving the Builder usable.
+func (b *Builder) Add(bs []byte) error {
+	if b.done {
+		return ErrBuilderDone
+	}
+
+	n := len(b.im.Data) + len(bs)
+	if n > b.max {
+		return &ErrDataTooLarge{n, b.max, b.im.Type, b.im.PeerID}
+	}
+	b.im.Data = append(b.im.Data, bs...)
+
+	return nil
+}
+
+// Len returns the length in bytes of the data added so far.
+func (b *Builder) Len() int {
+	return len(b.im.Data)
+}
+
+// Close finalizes the imsg and sends it over the Conn as Send does. The Builder
+// may not be used afterward, even if sending fails.
+func (b *Builder) Close() error {
+	if b.done {
+		return ErrBuilderDone
+	}
+	b.done = true
+
+	return b.c.Send(b.im)
+}
+
+// Abort discards the imsg without sending anything. Calling Abort on a Builder
+// which has already been closed or aborted is harmless.
+func (b *Builder) Abort() {
+	b.done = true
+	b.im.Data = nil
+}
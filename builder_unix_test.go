@@ -0,0 +1,106 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestBuilder(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	bd, err := a.Create(1, 2, 3, 16)
+	if err != nil {
+		t.Fatalf("unexpected Create failure: %s", err)
+	}
+	var want []byte
+	for i := 0; i < 1000; i++ {
+		chunk := []byte{byte(i), byte(i >> 8), 0xaa}
+		err = bd.Add(chunk)
+		if err != nil {
+			t.Fatalf("unexpected Add failure: %s", err)
+		}
+		want = append(want, chunk...)
+	}
+
+	// Nothing is written until the Builder is closed.
+	b.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = b.Recv()
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a timeout before Close, got: %v", err)
+	}
+	b.SetReadDeadline(time.Time{})
+
+	err = bd.Close()
+	if err != nil {
+		t.Fatalf("unexpected Close failure: %s", err)
+	}
+	im, err := b.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	if im.Type != 1 || im.PeerID != 2 || im.PID != 3 || !bytes.Equal(im.Data, want) {
+		t.Fatalf("unexpected imsg received (%d, %d, %d, %d bytes)", im.Type, im.PeerID, im.PID, len(im.Data))
+	}
+
+	err = bd.Add([]byte("late"))
+	if err != ErrBuilderDone {
+		t.Fatalf("expected ErrBuilderDone, got: %v", err)
+	}
+	err = bd.Close()
+	if err != ErrBuilderDone {
+		t.Fatalf("expected ErrBuilderDone, got: %v", err)
+	}
+}
+
+func TestBuilderMaxSize(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	err := a.SetMaxSize(HeaderSizeInBytes + 8)
+	if err != nil {
+		t.Fatalf("unexpected SetMaxSize failure: %s", err)
+	}
+
+	_, err = a.Create(1, 0, 0, 9)
+	var tooLarge *ErrDataTooLarge
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+
+	bd, err := a.Create(1, 0, 0, 0)
+	if err != nil {
+		t.Fatalf("unexpected Create failure: %s", err)
+	}
+	err = bd.Add([]byte("12345"))
+	if err != nil {
+		t.Fatalf("unexpected Add failure: %s", err)
+	}
+	// The chunk which would exceed the maximum is refused whole.
+	err = bd.Add([]byte("6789"))
+	if !errors.As(err, &tooLarge) || tooLarge.DataLengthInBytes != 9 {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+	err = bd.Add([]byte("678"))
+	if err != nil || bd.Len() != 8 {
+		t.Fatalf("unexpected Add result (%d, %v)", bd.Len(), err)
+	}
+
+	// An aborted imsg is never sent.
+	bd.Abort()
+	bd.Abort()
+	err = a.Send(&IMsg{Type: 2})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	im, err := b.Recv()
+	if err != nil || im.Type != 2 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+)
+
+// A correlation reads and writes the value which ties a reply to its request.
+type correlation struct {
+	get func(*IMsg) uint32
+	set func(*IMsg, uint32)
+}
+
+// By convention, a reply carries the PeerID of its request.
+var peerIDCorrelation = correlation{
+	get: func(im *IMsg) uint32 { return im.PeerID },
+	set: func(im *IMsg, id uint32) { im.PeerID = id },
+}
+
+// WithCorrelation changes where Call stores the correlation value tying a reply
+// to its request, which is the PeerID field by default. Call passes each
+// request to set along with the value assigned to it, and a received imsg of
+// the awaited type is a reply when get returns that same value.
+func WithCorrelation(get func(*IMsg) uint32, set func(*IMsg, uint32)) ConnOption {
+	return func(c *Conn) {
+		c.corr = correlation{get, set}
+	}
+}
+
+// Call sends a request and waits for its reply, which is the first imsg of
+// type replyType carrying the correlation value assigned to the request. Any
+// other imsgs which arrive in the meantime remain available to Recv, and
+// therefore to Serve. Several calls may be outstanding at once, each with its
+// own correlation value. If the context is done before the reply arrives, its
+// error is returned and a reply arriving later is treated like any other imsg.
+//
+// The correlation value is stored in the request's PeerID unless configured
+// otherwise with WithCorrelation, so the peer is expected to echo it back.
+//
+// If the peer answers with an error reply, composed with ComposeError, the
+// error it carries is returned as a *RemoteError. See WithRecvQueueLimit for
+// how Call behaves when the imsgs arriving ahead of the reply reach a limit.
+func (c *Conn) Call(ctx context.Context, req *IMsg, replyType uint32) (*IMsg, error) {
+	id := c.callID.Add(1)
+	c.corr.set(req, id)
+
+	reqType := req.Type
+	ch, cancel := c.calls.register(id, func(im *IMsg) bool {
+		return im.Type == replyType || isErrorReplyTo(im, reqType)
+	})
+	defer cancel()
+
+	err := c.Send(req)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		// Whoever is reading delivers the reply, so read only when nobody else
+		// is.
+		select {
+		case im := <-ch:
+			return reply(im, replyType)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case c.rsem <- struct{}{}:
+		}
+
+		select {
+		case im := <-ch:
+			<-c.rsem
+			return reply(im, replyType)
+		default:
+		}
+
+		space, err := c.readForCall(ctx)
+		<-c.rsem
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+
+		// Whoever reads next makes room for the imsgs ahead of the reply.
+		if space != nil {
+			select {
+			case im := <-ch:
+				return reply(im, replyType)
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-space:
+			}
+		}
+	}
+}
+
+// reply returns the reply delivered to Call, or the error it carries if it's an
+// error reply.
+func reply(im *IMsg, replyType uint32) (*IMsg, error) {
+	if im != nil && im.Type != replyType {
+		if re, ok := AsError(im); ok {
+			im.Close()
+			return nil, re
+		}
+	}
+
+	return im, nil
+}
+
+// readForCall reads a single imsg on behalf of Call, delivering it if it's an
+// awaited reply and setting it aside for Recv otherwise. If there's no room to
+// set another imsg aside, readForCall reads nothing and instead returns a
+// channel which is closed once there may be. The caller must hold rsem.
+func (c *Conn) readForCall(ctx context.Context) (<-chan struct{}, error) {
+	defer c.interruptOnDone(ctx)()
+
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	if space := c.backlogSpace(); space != nil {
+		return space, nil
+	}
+
+	im, err := c.recv()
+	if err != nil {
+		return nil, err
+	}
+	if !c.deliver(im) {
+		c.pushBacklog(im)
+	}
+
+	return nil, nil
+}
+
+// deliver passes a received imsg to the Call awaiting it, reporting whether
+// there was one.
+func (c *Conn) deliver(im *IMsg) bool {
+	return c.calls.Resolve(c.corr.get(im), im)
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testTypeQuery  = 1
+	testTypeReply  = 2
+	testTypeNotice = 3
+)
+
+func TestConnCall(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	// The peer answers queries in reverse order, sending an unrelated notice
+	// ahead of each reply.
+	const calls = 4
+	go func() {
+		var queries []*IMsg
+		for len(queries) < calls {
+			im, err := b.Recv()
+			if err != nil {
+				return
+			}
+			queries = append(queries, im)
+		}
+		for i := len(queries) - 1; i >= 0; i-- {
+			q := queries[i]
+			b.Send(&IMsg{Type: testTypeNotice, Data: q.Data})
+			b.Send(&IMsg{Type: testTypeReply, PeerID: q.PeerID, Data: q.Data})
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < calls; i++ {
+		wg.Add(1)
+		go func(i byte) {
+			defer wg.Done()
+			reply, err := a.Call(context.Background(), &IMsg{Type: testTypeQuery, Data: []byte{i}}, testTypeReply)
+			if err != nil {
+				t.Errorf("unexpected Call failure: %s", err)
+				return
+			}
+			if len(reply.Data) != 1 || reply.Data[0] != i {
+				t.Errorf("reply does not match request %d (%v)", i, reply.Data)
+			}
+		}(byte(i))
+	}
+	wg.Wait()
+
+	// Every notice remains available to Recv.
+	seen := make(map[byte]bool)
+	for i := 0; i < calls; i++ {
+		im, err := a.Recv()
+		if err != nil {
+			t.Fatalf("unexpected Recv failure: %s", err)
+		}
+		if im.Type != testTypeNotice {
+			t.Fatalf("unexpected type received (%d != %d)", im.Type, testTypeNotice)
+		}
+		seen[im.Data[0]] = true
+	}
+	if len(seen) != calls {
+		t.Fatalf("unexpected notices received (%v)", seen)
+	}
+	if a.calls.Len() != 0 {
+		t.Fatalf("pending table was not emptied (%d entries)", a.calls.Len())
+	}
+}
+
+func TestConnCallWithRecv(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	// A concurrent Recv, as run by Serve, delivers the reply to Call.
+	notices := make(chan *IMsg, 1)
+	go func() {
+		im, err := a.Recv()
+		if err == nil {
+			notices <- im
+		}
+	}()
+
+	go func() {
+		q, err := b.Recv()
+		if err != nil {
+			return
+		}
+		b.Send(&IMsg{Type: testTypeReply, PeerID: q.PeerID})
+		b.Send(&IMsg{Type: testTypeNotice})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := a.Call(ctx, &IMsg{Type: testTypeQuery}, testTypeReply)
+	if err != nil {
+		t.Fatalf("unexpected Call failure: %s", err)
+	}
+
+	select {
+	case im := <-notices:
+		if im.Type != testTypeNotice {
+			t.Fatalf("unexpected type received (%d != %d)", im.Type, testTypeNotice)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("notice was not received")
+	}
+}
+
+func TestConnCallTimeout(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := a.Call(ctx, &IMsg{Type: testTypeQuery}, testTypeReply)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got: %v", err)
+	}
+	if a.calls.Len() != 0 {
+		t.Fatalf("pending table was not emptied (%d entries)", a.calls.Len())
+	}
+
+	// A late reply is received like any other imsg.
+	q, err := b.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	err = b.Send(&IMsg{Type: testTypeReply, PeerID: q.PeerID})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	im, err := a.Recv()
+	if err != nil || im.Type != testTypeReply || im.PeerID != q.PeerID {
+		t.Fatalf("unexpected Recv result after timeout (%v, %v)", im, err)
+	}
+}
+
+func TestConnCallCorrelation(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	WithCorrelation(
+		func(im *IMsg) uint32 { return im.PID },
+		func(im *IMsg, id uint32) { im.PID = id },
+	)(a)
+
+	go func() {
+		q, err := b.Recv()
+		if err != nil {
+			return
+		}
+		// A reply with the wrong correlation value is not accepted.
+		b.Send(&IMsg{Type: testTypeReply, PID: q.PID + 1})
+		b.Send(&IMsg{Type: testTypeReply, PID: q.PID, PeerID: 9})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reply, err := a.Call(ctx, &IMsg{Type: testTypeQuery, PeerID: 5}, testTypeReply)
+	if err != nil {
+		t.Fatalf("unexpected Call failure: %s", err)
+	}
+	if reply.PeerID != 9 {
+		t.Fatalf("unexpected reply accepted (%v)", reply)
+	}
+
+	im, err := a.Recv()
+	if err != nil || im.PeerID != 0 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+}
+
+func TestConnCallErrorReply(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	go func() {
+		q, err := b.Recv()
+		if err != nil {
+			return
+		}
+		// An error reply to another type of request is not accepted.
+		other, _ := ComposeError(&IMsg{Type: testTypeNotice, PeerID: q.PeerID}, 1, "wrong request")
+		b.Send(other)
+		reply, _ := ComposeError(q, 13, "permission denied")
+		b.Send(reply)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := a.Call(ctx, &IMsg{Type: testTypeQuery}, testTypeReply)
+	var re *RemoteError
+	if !errors.As(err, &re) || re.Type != testTypeQuery || re.Code != 13 || re.Message != "permission denied" {
+		t.Fatalf("expected RemoteError, got: %v", err)
+	}
+
+	im, err := a.Recv()
+	if err != nil || im.Type != TypeError {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+}
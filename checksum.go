@@ -0,0 +1,66 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"hash/crc32"
+)
+
+// ChecksumSizeInBytes is the size in bytes of the checksum appended to the data
+// of each imsg when checksums are enabled.
+const ChecksumSizeInBytes = 4
+
+// This is the Castagnoli polynomial table used to compute CRC32C checksums.
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// SetChecksum controls whether the Encoder appends a CRC32C checksum of each
+// imsg's header and data to the imsg's data, which is disabled by default. The
+// checksum counts against the maximum size of the imsg, so less data may be
+// sent. It's computed last, covering any compression and HMAC.
+//
+// Checksummed imsgs can only be understood by a Decoder which has also enabled
+// checksums, and not by the C implementation, so this must only be enabled
+// when the peer is known to enable it as well.
+func (e *Encoder) SetChecksum(enabled bool) {
+	e.checksum = enabled
+}
+
+// SetChecksum controls whether the Decoder verifies the CRC32C checksum
+// appended to the data of each imsg by an Encoder which has also enabled
+// checksums, stripping it from the decoded imsg. An imsg whose checksum doesn't
+// match is consumed and ErrChecksumMismatch is returned, reporting where in the
+// stream the imsg began. The checksum is verified before any HMAC or
+// decompression.
+func (d *Decoder) SetChecksum(enabled bool) {
+	d.checksum = enabled
+}
+
+// appendChecksum returns an imsg equivalent to im whose data has the checksum
+// of im appended, or an error if that makes the imsg larger than maxSize bytes.
+func appendChecksum(im *IMsg, maxSize uint16) (*IMsg, error) {
+	return appendTrailer(im, ChecksumSizeInBytes, maxSize, func(dst, hdr, data []byte) []byte {
+		var sum [ChecksumSizeInBytes]byte
+		endianness.PutUint32(sum[:], crc32.Update(crc32.Checksum(hdr, crc32c), crc32c, data))
+		return append(dst, sum[:]...)
+	})
+}
+
+// verifyChecksum checks the checksum appended to the data of a received imsg,
+// which began at offset off in the stream, stripping it from the imsg if it
+// matches.
+func verifyChecksum(im *IMsg, off int64) error {
+	hdr, data, trailer, ok := splitTrailer(im, ChecksumSizeInBytes)
+	if !ok {
+		return &ErrChecksumMismatch{off, im.Type}
+	}
+
+	sum := crc32.Update(crc32.Checksum(hdr[:], crc32c), crc32c, data)
+	if sum != endianness.Uint32(trailer) {
+		return &ErrChecksumMismatch{off, im.Type}
+	}
+	im.Data = data
+
+	return nil
+}
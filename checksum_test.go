@@ -0,0 +1,131 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+func TestChecksumRoundTrip(t *testing.T) {
+	ims := []*IMsg{
+		{Type: 1, PeerID: 2, PID: 3},
+		{Type: 4, Data: []byte("test")},
+		{Type: 5, Data: make([]byte, MaxSizeInBytes-HeaderSizeInBytes-ChecksumSizeInBytes)},
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetChecksum(true)
+	for _, im := range ims {
+		err := enc.Encode(im)
+		if err != nil {
+			t.Fatalf("unexpected Encode failure: %s", err)
+		}
+	}
+
+	dec := NewDecoder(&buf)
+	dec.SetChecksum(true)
+	for _, expected := range ims {
+		im, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("unexpected Decode failure: %s", err)
+		}
+		if !im.Equal(expected) {
+			t.Fatalf("decoded imsg does not match (%v != %v)", im, expected)
+		}
+	}
+
+	err := enc.Encode(&IMsg{Type: 6, Data: make([]byte, MaxSizeInBytes-HeaderSizeInBytes)})
+	var edtl *ErrDataTooLarge
+	if !errors.As(err, &edtl) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+}
+
+func TestChecksumMismatch(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetChecksum(true)
+	enc.Encode(&IMsg{Type: 1, Data: []byte("first")})
+	enc.Encode(&IMsg{Type: 2, PeerID: 3, Data: []byte("second")})
+	enc.Encode(&IMsg{Type: 4, Data: []byte("third")})
+	stream := buf.Bytes()
+	second := HeaderSizeInBytes + len("first") + ChecksumSizeInBytes
+
+	tests := []struct {
+		name string
+		pos  int
+	}{
+		{"header", second + 8},
+		{"payload", second + HeaderSizeInBytes + 2},
+		{"checksum", second + HeaderSizeInBytes + len("second")},
+	}
+	for _, test := range tests {
+		corrupt := append([]byte{}, stream...)
+		corrupt[test.pos] ^= 0x80
+
+		dec := NewDecoder(bytes.NewReader(corrupt))
+		dec.SetChecksum(true)
+		im, err := dec.Decode()
+		if err != nil || im.Type != 1 {
+			t.Fatalf("%s: unexpected Decode result (%v, %v)", test.name, im, err)
+		}
+
+		_, err = dec.Decode()
+		var ecm *ErrChecksumMismatch
+		if !errors.As(err, &ecm) || ecm.Offset != int64(second) || ecm.Type != 2 {
+			t.Fatalf("%s: expected ErrChecksumMismatch at offset %d, got: %v", test.name, second, err)
+		}
+
+		im, err = dec.Decode()
+		if err != nil || im.Type != 4 {
+			t.Fatalf("%s: unexpected Decode result after mismatch (%v, %v)", test.name, im, err)
+		}
+	}
+}
+
+func TestFramingExtensionOrder(t *testing.T) {
+	key := []byte("key")
+	im := &IMsg{Type: 1, Data: bytes.Repeat([]byte("text "), 1000)}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetCompression(0)
+	enc.SetHMAC(key, sha256.New)
+	enc.SetChecksum(true)
+	err := enc.Encode(im)
+	if err != nil {
+		t.Fatalf("unexpected Encode failure: %s", err)
+	}
+
+	// The checksum is outermost, so corruption is reported as such rather than
+	// as an authentication failure.
+	corrupt := append([]byte{}, buf.Bytes()...)
+	corrupt[HeaderSizeInBytes] ^= 0x01
+	dec := NewDecoder(bytes.NewReader(corrupt))
+	dec.SetChecksum(true)
+	dec.SetHMAC(key, sha256.New)
+	dec.SetDecompressionLimit(DefaultDecompressionLimit)
+	_, err = dec.Decode()
+	var ecm *ErrChecksumMismatch
+	if !errors.As(err, &ecm) {
+		t.Fatalf("expected ErrChecksumMismatch, got: %v", err)
+	}
+
+	dec = NewDecoder(&buf)
+	dec.SetChecksum(true)
+	dec.SetHMAC(key, sha256.New)
+	dec.SetDecompressionLimit(DefaultDecompressionLimit)
+	decoded, err := dec.Decode()
+	if err != nil {
+		t.Fatalf("unexpected Decode failure: %s", err)
+	}
+	if !decoded.Equal(im) {
+		t.Fatalf("decoded imsg does not match (%v != %v)", decoded, im)
+	}
+}
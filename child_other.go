@@ -0,0 +1,18 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build !unix
+
+package imsg
+
+import (
+	"os/exec"
+	"runtime"
+)
+
+// ExecChild is unsupported on this platform, and returns
+// ErrUnsupportedPlatform.
+func ExecChild(cmd *exec.Cmd, opts ...ConnOption) (*Conn, error) {
+	return nil, &ErrUnsupportedPlatform{"socketpairs", runtime.GOOS}
+}
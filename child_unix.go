@@ -0,0 +1,55 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// ExecChild starts the command with one end of a unix domain socketpair as an
+// extra file, and returns a Conn with the provided options over the other end.
+// The socket is appended to cmd.ExtraFiles, so a child without other extra
+// files finds it at descriptor 3, and can construct its own Conn from it with
+// os.NewFile, net.FileConn, and NewConn. Closing the Conn signals the child,
+// whose reads then return io.EOF. The caller is responsible for waiting on the
+// command once it has been started.
+func ExecChild(cmd *exec.Cmd, opts ...ConnOption) (*Conn, error) {
+	// SOCK_CLOEXEC isn't available everywhere, so the descriptors are marked
+	// close-on-exec separately, holding the fork lock so that no child started
+	// in between inherits them.
+	syscall.ForkLock.RLock()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err == nil {
+		unix.CloseOnExec(fds[0])
+		unix.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, os.NewSyscallError("socketpair", err)
+	}
+
+	local, err := unixConnFromFD(fds[0], "imsg-child-parent")
+	if err != nil {
+		unix.Close(fds[1])
+		return nil, err
+	}
+	remote := os.NewFile(uintptr(fds[1]), "imsg-child")
+	defer remote.Close()
+
+	cmd.ExtraFiles = append(cmd.ExtraFiles, remote)
+	err = cmd.Start()
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+
+	return NewConn(local, opts...), nil
+}
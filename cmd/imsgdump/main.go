@@ -0,0 +1,308 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+// Imsgdump prints the imsgs in a stream of wire-format imsg frames, such as one
+// captured from a socket, one line per imsg.
+//
+// Usage:
+//
+//	imsgdump [-x] [-json] [-k] [-e little|big|auto] [-names file] [file]
+//
+// The stream is read from the named file, or from standard input if none is
+// named. Each line holds the offset of the imsg in the stream, in hex, followed
+// by its type, peer ID, PID, and length. The flags are:
+//
+//	-x
+//		Follow each line with a hex dump of the imsg's data.
+//	-json
+//		Print each imsg as a JSON object holding its offset and the imsg as
+//		marshaled by the library.
+//	-k
+//		Keep going after a malformed imsg, resuming at the next plausible
+//		header.
+//	-e order
+//		Decode the stream as little-endian, big-endian, or, by default, in
+//		whichever order makes the first header plausible.
+//	-names file
+//		Print types symbolically using the type=NAME pairs in file, one per
+//		line. Blank lines and lines beginning with # are ignored.
+//
+// Imsgdump exits with status 1 if the stream is malformed, even with -k, and
+// with status 2 if it can't be read.
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/schultz-is/go-imsg"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// These are the exit statuses.
+const (
+	exitOK        = 0
+	exitMalformed = 1
+	exitError     = 2
+)
+
+// This holds the options set by flags.
+type options struct {
+	hexDump   bool
+	json      bool
+	keepGoing bool
+	order     string
+	names     string
+}
+
+// run runs imsgdump with the provided arguments, returning its exit status.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	var opts options
+
+	fs := flag.NewFlagSet("imsgdump", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.BoolVar(&opts.hexDump, "x", false, "print a hex dump of each imsg's data")
+	fs.BoolVar(&opts.json, "json", false, "print each imsg as JSON")
+	fs.BoolVar(&opts.keepGoing, "k", false, "keep going after a malformed imsg")
+	fs.StringVar(&opts.order, "e", "auto", "byte order: little, big, or auto")
+	fs.StringVar(&opts.names, "names", "", "file of type=NAME pairs")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: imsgdump [-x] [-json] [-k] [-e little|big|auto] [-names file] [file]")
+		fs.PrintDefaults()
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return exitError
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return exitError
+	}
+
+	if opts.names != "" {
+		err = loadNames(opts.names)
+		if err != nil {
+			fmt.Fprintf(stderr, "imsgdump: %s\n", err)
+			return exitError
+		}
+	}
+
+	in := stdin
+	if fs.NArg() == 1 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(stderr, "imsgdump: %s\n", err)
+			return exitError
+		}
+		defer f.Close()
+		in = f
+	}
+
+	br := bufio.NewReaderSize(in, 2*imsg.MaxSizeInBytes)
+	order, err := byteOrder(opts.order, br)
+	if err != nil {
+		fmt.Fprintf(stderr, "imsgdump: %s\n", err)
+		return exitError
+	}
+
+	w := bufio.NewWriter(stdout)
+	defer w.Flush()
+
+	d := dumper{w: w, opts: opts, order: order}
+	err = imsg.AnalyzeStreamOrder(br, order, d.dump)
+	if err != nil {
+		w.Flush()
+		fmt.Fprintf(stderr, "imsgdump: %s\n", err)
+		return exitError
+	}
+	if d.malformed {
+		return exitMalformed
+	}
+
+	return exitOK
+}
+
+// loadNames registers the type names in the named file.
+func loadNames(path string) error {
+	bs, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	names := make(map[uint32]string)
+	for i, line := range strings.Split(string(bs), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		typ, name, ok := strings.Cut(line, "=")
+		if !ok {
+			return fmt.Errorf("%s:%d: expected type=NAME", path, i+1)
+		}
+		n, err := strconv.ParseUint(strings.TrimSpace(typ), 0, 32)
+		if err != nil {
+			return fmt.Errorf("%s:%d: invalid type %q", path, i+1, typ)
+		}
+		names[uint32(n)] = strings.TrimSpace(name)
+	}
+
+	return imsg.RegisterTypeNames(names)
+}
+
+// byteOrder returns the byte order named by order, which may be auto, in which
+// case the order is chosen by peeking at the start of the stream.
+func byteOrder(order string, br *bufio.Reader) (binary.ByteOrder, error) {
+	switch order {
+	case "little":
+		return binary.LittleEndian, nil
+	case "big":
+		return binary.BigEndian, nil
+	case "auto":
+	default:
+		return nil, fmt.Errorf("unknown byte order %q", order)
+	}
+
+	native := imsg.SystemEndianness()
+	other := binary.ByteOrder(binary.BigEndian)
+	if native == binary.BigEndian {
+		other = binary.LittleEndian
+	}
+
+	// An order is preferred if the first imsg is followed by another plausible
+	// header or by the end of the stream, and failing that, if the first
+	// header alone is plausible.
+	start, err := br.Peek(br.Size())
+	if err != nil && err != io.EOF && err != bufio.ErrBufferFull {
+		return nil, err
+	}
+	for _, strict := range []bool{true, false} {
+		for _, o := range []binary.ByteOrder{native, other} {
+			if plausibleStart(start, o, strict) {
+				return o, nil
+			}
+		}
+	}
+
+	return native, nil
+}
+
+// plausibleStart reports whether bs could begin with an imsg encoded in the
+// provided byte order. If strict is set, the imsg must also be followed by
+// another plausible header or by the end of bs.
+func plausibleStart(bs []byte, order binary.ByteOrder, strict bool) bool {
+	if !plausibleHeader(bs, order) {
+		return false
+	}
+	if !strict {
+		return true
+	}
+
+	length := int(order.Uint16(bs[4:6]))
+
+	return len(bs) == length || (len(bs) > length && plausibleHeader(bs[length:], order))
+}
+
+// plausibleHeader reports whether bs begins with a header whose length is
+// within bounds when decoded in the provided byte order.
+func plausibleHeader(bs []byte, order binary.ByteOrder) bool {
+	if len(bs) < imsg.HeaderSizeInBytes {
+		return false
+	}
+
+	length := order.Uint16(bs[4:6])
+
+	return length >= imsg.HeaderSizeInBytes && length <= imsg.MaxSizeInBytes
+}
+
+// A dumper prints what's found in a stream.
+type dumper struct {
+	w         *bufio.Writer
+	opts      options
+	order     binary.ByteOrder
+	malformed bool
+}
+
+// This is the JSON representation of a line of output.
+type jsonLine struct {
+	Offset int64      `json:"offset"`
+	IMsg   *imsg.IMsg `json:"imsg,omitempty"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// dump implements imsg.AnalyzeFunc.
+func (d *dumper) dump(offset int64, hdr imsg.Header, data []byte, err error) bool {
+	if err != nil {
+		d.malformed = true
+		if d.opts.json {
+			d.printJSON(jsonLine{Offset: offset, Error: err.Error()})
+		} else {
+			fmt.Fprintf(d.w, "%08x error: %s\n", offset, err)
+		}
+		return d.opts.keepGoing
+	}
+
+	im, err := reconstruct(hdr, data)
+	if err != nil {
+		d.malformed = true
+		fmt.Fprintf(d.w, "%08x error: %s\n", offset, err)
+		return d.opts.keepGoing
+	}
+
+	if d.opts.json {
+		d.printJSON(jsonLine{Offset: offset, IMsg: im})
+		return true
+	}
+
+	fmt.Fprintf(d.w, "%08x %v\n", offset, im)
+	if d.opts.hexDump && len(data) > 0 {
+		for _, line := range strings.SplitAfter(hex.Dump(data), "\n") {
+			if line != "" {
+				fmt.Fprintf(d.w, "\t%s", line)
+			}
+		}
+	}
+
+	return true
+}
+
+// reconstruct rebuilds an imsg, including its flags, from its header and data
+// by way of its encoding in the system's byte order.
+func reconstruct(hdr imsg.Header, data []byte) (*imsg.IMsg, error) {
+	frame := make([]byte, imsg.HeaderSizeInBytes, int(hdr.Length))
+	native := imsg.SystemEndianness()
+	native.PutUint32(frame[0:4], hdr.Type)
+	native.PutUint16(frame[4:6], hdr.Length)
+	native.PutUint16(frame[6:8], uint16(hdr.Flags))
+	native.PutUint32(frame[8:12], hdr.PeerID)
+	native.PutUint32(frame[12:16], hdr.PID)
+	frame = append(frame, data...)
+
+	im := &imsg.IMsg{}
+	err := im.UnmarshalBinary(frame)
+	if err != nil {
+		return nil, err
+	}
+
+	return im, nil
+}
+
+// printJSON prints a line of JSON output.
+func (d *dumper) printJSON(line jsonLine) {
+	bs, _ := json.Marshal(line)
+	d.w.Write(bs)
+	d.w.WriteByte('\n')
+}
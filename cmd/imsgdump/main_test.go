@@ -0,0 +1,128 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// TestMain runs the command in place of the tests when invoked by runCommand.
+func TestMain(m *testing.M) {
+	if os.Getenv("IMSGDUMP_RUN") != "" {
+		os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+	}
+
+	os.Exit(m.Run())
+}
+
+// runCommand runs the command in a separate process, since it registers type
+// names globally, returning its output and exit status.
+func runCommand(t *testing.T, args []string) (string, string, int) {
+	t.Helper()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), "IMSGDUMP_RUN=1")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err := cmd.Run()
+	var eerr *exec.ExitError
+	switch {
+	case errors.As(err, &eerr):
+		return stdout.String(), stderr.String(), eerr.ExitCode()
+	case err != nil:
+		t.Fatalf("failed to run command: %s", err)
+	}
+
+	return stdout.String(), stderr.String(), exitOK
+}
+
+func TestStdin(t *testing.T) {
+	stream, err := os.ReadFile("testdata/stream_le.bin")
+	if err != nil {
+		t.Fatalf("failed to read stream: %s", err)
+	}
+	expected, err := os.ReadFile("testdata/plain.golden")
+	if err != nil {
+		t.Fatalf("failed to read golden file: %s", err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	status := run(nil, bytes.NewReader(stream), &stdout, &stderr)
+	if status != exitOK || stdout.String() != string(expected) {
+		t.Fatalf("unexpected output from stdin (%d): %s", status, stdout.String())
+	}
+}
+
+func TestUsageErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		msg  string
+	}{
+		{"bad order", []string{"-e", "middle", "testdata/stream_le.bin"}, "unknown byte order"},
+		{"missing file", []string{"testdata/missing.bin"}, "no such file"},
+		{"extra arguments", []string{"a", "b"}, "usage"},
+		{"bad flag", []string{"-z"}, "not defined"},
+	}
+	for _, test := range tests {
+		var stdout, stderr bytes.Buffer
+		status := run(test.args, nil, &stdout, &stderr)
+		if status != exitError || !strings.Contains(stderr.String(), test.msg) {
+			t.Fatalf("%s: unexpected result (%d): %s", test.name, status, stderr.String())
+		}
+	}
+}
+
+func TestGolden(t *testing.T) {
+	tests := []struct {
+		name   string
+		args   []string
+		status int
+	}{
+		{"plain", []string{"testdata/stream_le.bin"}, exitOK},
+		{"auto_big", []string{"testdata/stream_be.bin"}, exitOK},
+		{"explicit_big", []string{"-e", "big", "testdata/stream_be.bin"}, exitOK},
+		{"hex", []string{"-x", "testdata/stream_le.bin"}, exitOK},
+		{"json", []string{"-json", "testdata/stream_le.bin"}, exitOK},
+		{"corrupt", []string{"testdata/corrupt_le.bin"}, exitMalformed},
+		{"corrupt_keep_going", []string{"-k", "testdata/corrupt_le.bin"}, exitMalformed},
+		{"corrupt_json", []string{"-k", "-json", "testdata/corrupt_le.bin"}, exitMalformed},
+		{"names", []string{"-names", "testdata/names.txt", "testdata/stream_le.bin"}, exitOK},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stdout, stderr, status := runCommand(t, test.args)
+			if status != test.status {
+				t.Fatalf("unexpected exit status (%d != %d): %s", status, test.status, stderr)
+			}
+
+			golden := filepath.Join("testdata", test.name+".golden")
+			if *update {
+				err := os.WriteFile(golden, []byte(stdout), 0o644)
+				if err != nil {
+					t.Fatalf("failed to update golden file: %s", err)
+				}
+			}
+			expected, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatalf("failed to read golden file: %s", err)
+			}
+			if stdout != string(expected) {
+				t.Fatalf("output does not match golden file:\n%s\nexpected:\n%s", stdout, expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// emit writes the unformatted code generated for msgs, defined in the named
+// source file of the named package.
+func emit(w io.Writer, source, pkg string, msgs []message) {
+	p := func(format string, args ...any) {
+		fmt.Fprintf(w, format+"\n", args...)
+	}
+
+	p("// Code generated by imsggen from %s. DO NOT EDIT.", source)
+	p("")
+	p("package %s", pkg)
+	p("")
+	p("import (")
+	p("imsg %q", "github.com/schultz-is/go-imsg")
+	p(")")
+	p("")
+
+	p("// These are the imsg types defined in %s and the exact lengths in bytes of", source)
+	p("// the data they carry.")
+	p("const (")
+	for _, m := range msgs {
+		p("%sType uint32 = %d", m.name, m.typ)
+		p("%sSize = %d", m.name, m.size)
+	}
+	p(")")
+	p("")
+
+	p("func init() {")
+	for _, m := range msgs {
+		p("imsg.MustRegisterType(%[1]sType, %[1]q, %[1]sSize)", m.name)
+	}
+	p("}")
+
+	for _, m := range msgs {
+		p("")
+		emitCompose(p, m)
+		p("")
+		emitParse(p, m)
+	}
+}
+
+// emitCompose writes the function composing imsgs carrying m.
+func emitCompose(p func(string, ...any), m message) {
+	p("// Compose%[1]s constructs an imsg of type %[1]sType carrying v, encoded field", m.name)
+	p("// by field in the system byte order. The PID field is filled in as with")
+	p("// imsg.ComposeIMsg.")
+	p("func Compose%[1]s(peerID uint32, v %[1]s, opts ...imsg.ComposeOption) (*imsg.IMsg, error) {", m.name)
+
+	if m.size == 0 {
+		p("return imsg.ComposeIMsg(%sType, peerID, nil, opts...)", m.name)
+		p("}")
+		return
+	}
+
+	// Lengths are checked before anything is allocated.
+	for _, f := range m.fields {
+		switch {
+		case f.enc == "cstring":
+			p("if len(v.%s) >= %d {", f.name, f.size)
+			p("return nil, &imsg.ErrFieldTooLong{Type: %sType, Field: %q, LengthInBytes: len(v.%s) + 1, MaxInBytes: %d}", m.name, f.name, f.name, f.size)
+			p("}")
+			p("")
+		case f.enc == "bytes" && f.slice:
+			p("if len(v.%s) > %d {", f.name, f.size)
+			p("return nil, &imsg.ErrFieldTooLong{Type: %sType, Field: %q, LengthInBytes: len(v.%s), MaxInBytes: %d}", m.name, f.name, f.name, f.size)
+			p("}")
+			p("")
+		}
+	}
+
+	p("data := make([]byte, %sSize)", m.name)
+	if needsOrder(m) {
+		p("order := imsg.SystemEndianness()")
+	}
+	for _, f := range m.fields {
+		span := fmt.Sprintf("data[%d:%d]", f.off, f.off+f.size)
+		switch f.enc {
+		case "u8":
+			p("data[%d] = v.%s", f.off, f.name)
+		case "i8":
+			p("data[%d] = uint8(v.%s)", f.off, f.name)
+		case "u16", "u32", "u64":
+			p("order.PutUint%d(%s, v.%s)", 8*f.size, span, f.name)
+		case "i16", "i32", "i64":
+			p("order.PutUint%d(%s, uint%d(v.%s))", 8*f.size, span, 8*f.size, f.name)
+		case "bytes":
+			if f.slice {
+				p("copy(%s, v.%s)", span, f.name)
+			} else {
+				p("copy(%s, v.%s[:])", span, f.name)
+			}
+		case "cstring":
+			p("copy(%s, v.%s)", span, f.name)
+		}
+	}
+	p("")
+	p("return imsg.ComposeIMsg(%sType, peerID, data, opts...)", m.name)
+	p("}")
+}
+
+// emitParse writes the function parsing imsgs carrying m.
+func emitParse(p func(string, ...any), m message) {
+	p("// Parse%[1]s decodes the data of an imsg composed by Compose%[1]s, whose", m.name)
+	p("// length must be exactly %sSize.", m.name)
+	p("func Parse%[1]s(im *imsg.IMsg) (%[1]s, error) {", m.name)
+	p("var v %s", m.name)
+	p("if len(im.Data) != %sSize {", m.name)
+	p("return v, &imsg.ErrSizeMismatch{Type: im.Type, Want: %[1]sSize, WantMax: %[1]sSize, Got: len(im.Data)}", m.name)
+	p("}")
+	p("")
+
+	if needsOrder(m) {
+		p("order := imsg.SystemEndianness()")
+	}
+	for _, f := range m.fields {
+		span := fmt.Sprintf("im.Data[%d:%d]", f.off, f.off+f.size)
+		switch f.enc {
+		case "u8":
+			p("v.%s = im.Data[%d]", f.name, f.off)
+		case "i8":
+			p("v.%s = int8(im.Data[%d])", f.name, f.off)
+		case "u16", "u32", "u64":
+			p("v.%s = order.Uint%d(%s)", f.name, 8*f.size, span)
+		case "i16", "i32", "i64":
+			p("v.%s = int%d(order.Uint%d(%s))", f.name, 8*f.size, 8*f.size, span)
+		case "bytes":
+			if f.slice {
+				p("v.%s = append([]byte(nil), %s...)", f.name, span)
+			} else {
+				p("copy(v.%s[:], %s)", f.name, span)
+			}
+		case "cstring":
+			p("v.%s = imsg.FixedCString(%s)", f.name, span)
+		}
+	}
+	p("")
+	p("return v, nil")
+	p("}")
+}
+
+// needsOrder reports whether any field of m is an integer wider than a byte.
+func needsOrder(m message) bool {
+	for _, f := range m.fields {
+		switch f.enc {
+		case "u16", "u32", "u64", "i16", "i32", "i64":
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,303 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/schultz-is/go-imsg"
+)
+
+// This is the prefix of the directive marking a struct as the data of an imsg
+// type.
+const typeDirective = "//imsg:type="
+
+// The types which each integer encoding requires of its field.
+var intTypes = map[string][]string{
+	"u8":  {"uint8", "byte"},
+	"u16": {"uint16"},
+	"u32": {"uint32"},
+	"u64": {"uint64"},
+	"i8":  {"int8"},
+	"i16": {"int16"},
+	"i32": {"int32"},
+	"i64": {"int64"},
+}
+
+// This describes the encoding of a single field.
+type field struct {
+	name  string
+	enc   string // Encoding named by the tag, such as "u32" or "cstring"
+	slice bool   // Whether a bytes field is a []byte rather than an array
+	off   int
+	size  int
+}
+
+// This describes the data of an imsg type, as defined by an annotated struct.
+type message struct {
+	name   string
+	typ    uint32
+	size   int
+	fields []field
+}
+
+// generate returns the code generated for the annotated structs in src, which
+// was read from the named file.
+func generate(path string, src []byte) ([]byte, error) {
+	fset := token.NewFileSet()
+	f, err := parser.ParseFile(fset, path, src, parser.ParseComments)
+	if err != nil {
+		return nil, err
+	}
+
+	msgs, err := parseMessages(fset, f)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, fmt.Errorf("%s: no structs marked with %sN", path, typeDirective)
+	}
+
+	var b bytes.Buffer
+	emit(&b, filepath.Base(path), f.Name.Name, msgs)
+
+	code, err := format.Source(b.Bytes())
+	if err != nil {
+		// This indicates a bug in emit rather than in the input.
+		return nil, fmt.Errorf("formatting generated code: %s", err)
+	}
+
+	return code, nil
+}
+
+// parseMessages returns the annotated structs in f, in the order they're
+// declared.
+func parseMessages(fset *token.FileSet, f *ast.File) ([]message, error) {
+	var msgs []message
+	seen := make(map[uint32]string)
+
+	for _, decl := range f.Decls {
+		gd, ok := decl.(*ast.GenDecl)
+		if !ok || gd.Tok != token.TYPE {
+			continue
+		}
+
+		for _, spec := range gd.Specs {
+			ts := spec.(*ast.TypeSpec)
+			doc := ts.Doc
+			if doc == nil && len(gd.Specs) == 1 {
+				doc = gd.Doc
+			}
+			typ, ok, err := typeOf(doc)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s: %s", fset.Position(ts.Pos()), ts.Name.Name, err)
+			}
+			if !ok {
+				continue
+			}
+
+			st, ok := ts.Type.(*ast.StructType)
+			if !ok || ts.TypeParams != nil {
+				return nil, fmt.Errorf("%s: %s is not a struct", fset.Position(ts.Pos()), ts.Name.Name)
+			}
+			if other, ok := seen[typ]; ok {
+				return nil, fmt.Errorf(
+					"%s: %s has type %d, as does %s",
+					fset.Position(ts.Pos()),
+					ts.Name.Name,
+					typ,
+					other,
+				)
+			}
+			seen[typ] = ts.Name.Name
+
+			msg := message{name: ts.Name.Name, typ: typ}
+			for _, af := range st.Fields.List {
+				fs, err := parseField(af)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %s: %s", fset.Position(af.Pos()), ts.Name.Name, err)
+				}
+				for _, f := range fs {
+					f.off = msg.size
+					msg.size += f.size
+					msg.fields = append(msg.fields, f)
+				}
+			}
+			if msg.size > imsg.MaxSizeInBytes-imsg.HeaderSizeInBytes {
+				return nil, fmt.Errorf(
+					"%s: %s is too large (%d bytes > %d bytes)",
+					fset.Position(ts.Pos()),
+					ts.Name.Name,
+					msg.size,
+					imsg.MaxSizeInBytes-imsg.HeaderSizeInBytes,
+				)
+			}
+
+			msgs = append(msgs, msg)
+		}
+	}
+
+	return msgs, nil
+}
+
+// typeOf returns the imsg type named by the directive in a doc comment,
+// reporting whether there was one.
+func typeOf(doc *ast.CommentGroup) (uint32, bool, error) {
+	if doc == nil {
+		return 0, false, nil
+	}
+
+	for _, c := range doc.List {
+		arg, ok := strings.CutPrefix(c.Text, typeDirective)
+		if !ok {
+			continue
+		}
+		typ, err := strconv.ParseUint(strings.TrimSpace(arg), 0, 32)
+		if err != nil {
+			return 0, false, fmt.Errorf("invalid imsg type %q", arg)
+		}
+		return uint32(typ), true, nil
+	}
+
+	return 0, false, nil
+}
+
+// parseField validates the tag of a field declaration against its type,
+// returning a field for each name it declares. Fields tagged "-" are omitted.
+func parseField(af *ast.Field) ([]field, error) {
+	if len(af.Names) == 0 {
+		return nil, fmt.Errorf("embedded fields are not supported")
+	}
+	names := make([]string, len(af.Names))
+	for i, n := range af.Names {
+		names[i] = n.Name
+	}
+	name := strings.Join(names, ", ")
+
+	var raw string
+	if af.Tag != nil {
+		raw, _ = strconv.Unquote(af.Tag.Value)
+	}
+	tag, ok := reflect.StructTag(raw).Lookup("imsg")
+	if !ok {
+		return nil, fmt.Errorf("field %s is missing an imsg tag", name)
+	}
+	if tag == "-" {
+		return nil, nil
+	}
+
+	invalid := func(format string, args ...any) ([]field, error) {
+		return nil, fmt.Errorf("field %s has invalid tag %q: %s", name, tag, fmt.Sprintf(format, args...))
+	}
+
+	f := field{}
+	enc, arg, hasArg := strings.Cut(tag, ",")
+	f.enc = enc
+	if hasArg {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			return invalid("size must be a positive integer")
+		}
+		f.size = n
+	}
+
+	typ := types.ExprString(af.Type)
+	switch enc {
+	case "u8", "u16", "u32", "u64", "i8", "i16", "i32", "i64":
+		if hasArg {
+			return invalid("%s does not take a size", enc)
+		}
+		bits, _ := strconv.Atoi(enc[1:])
+		f.size = bits / 8
+		if !contains(intTypes[enc], typ) {
+			return invalid("field of type %s cannot be encoded as %s", typ, enc)
+		}
+
+	case "bytes":
+		if !hasArg {
+			return invalid("bytes requires a size")
+		}
+		n, ok := byteArray(af.Type)
+		switch {
+		case typ == "[]byte" || typ == "[]uint8":
+			f.slice = true
+		case !ok:
+			return invalid("field of type %s cannot be encoded as bytes", typ)
+		case n != f.size:
+			return invalid("array of %d bytes does not match size %d", n, f.size)
+		}
+
+	case "cstring":
+		if !hasArg {
+			return invalid("cstring requires a size")
+		}
+		if typ != "string" {
+			return invalid("field of type %s cannot be encoded as cstring", typ)
+		}
+
+	case "pad":
+		if !hasArg {
+			return invalid("pad requires a size")
+		}
+		n, ok := byteArray(af.Type)
+		if name != "_" || !ok || n != f.size {
+			return invalid("pad requires a blank [%d]byte field", f.size)
+		}
+
+	default:
+		return invalid("unknown encoding %q", enc)
+	}
+
+	fs := make([]field, len(names))
+	for i, n := range names {
+		fs[i] = f
+		fs[i].name = n
+	}
+
+	return fs, nil
+}
+
+// byteArray returns the length of a byte array type, reporting whether the
+// type is one whose length is given as a literal.
+func byteArray(expr ast.Expr) (int, bool) {
+	at, ok := expr.(*ast.ArrayType)
+	if !ok || at.Len == nil {
+		return 0, false
+	}
+	if elt := types.ExprString(at.Elt); elt != "byte" && elt != "uint8" {
+		return 0, false
+	}
+	lit, ok := at.Len.(*ast.BasicLit)
+	if !ok || lit.Kind != token.INT {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(lit.Value, 0, 32)
+	if err != nil {
+		return 0, false
+	}
+
+	return int(n), true
+}
+
+// contains reports whether s is among ss.
+func contains(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+
+	return false
+}
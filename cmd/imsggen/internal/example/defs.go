@@ -0,0 +1,53 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+// Package example holds imsg definitions exercising every encoding supported
+// by imsggen. The code generated from them is checked in, and serves as the
+// golden file for imsggen's tests.
+package example
+
+//go:generate go run github.com/schultz-is/go-imsg/cmd/imsggen defs.go
+
+// Hello is the first imsg a peer sends.
+//
+//imsg:type=1
+type Hello struct {
+	Version uint16  `imsg:"u16"`
+	Flags   uint8   `imsg:"u8"`
+	_       [1]byte `imsg:"pad,1"`
+	PID     uint32  `imsg:"u32"`
+	Name    string  `imsg:"cstring,16"`
+}
+
+// Sample carries a reading of every integer width.
+//
+//imsg:type=0x10
+type Sample struct {
+	A uint8  `imsg:"u8"`
+	B int8   `imsg:"i8"`
+	C int16  `imsg:"i16"`
+	D int32  `imsg:"i32"`
+	E uint64 `imsg:"u64"`
+	F int64  `imsg:"i64"`
+
+	Cached bool `imsg:"-"`
+}
+
+// Blob carries opaque data of fixed and bounded lengths.
+//
+//imsg:type=17
+type Blob struct {
+	Digest [8]byte `imsg:"bytes,8"`
+	Extra  []byte  `imsg:"bytes,12"`
+}
+
+// Ping carries no data.
+//
+//imsg:type=18
+type Ping struct{}
+
+// notAnIMsg lacks a directive, so nothing is generated for it.
+type notAnIMsg struct {
+	X int
+}
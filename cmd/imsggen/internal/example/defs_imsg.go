@@ -0,0 +1,144 @@
+// Code generated by imsggen from defs.go. DO NOT EDIT.
+
+package example
+
+import (
+	imsg "github.com/schultz-is/go-imsg"
+)
+
+// These are the imsg types defined in defs.go and the exact lengths in bytes of
+// the data they carry.
+const (
+	HelloType  uint32 = 1
+	HelloSize         = 24
+	SampleType uint32 = 16
+	SampleSize        = 24
+	BlobType   uint32 = 17
+	BlobSize          = 20
+	PingType   uint32 = 18
+	PingSize          = 0
+)
+
+func init() {
+	imsg.MustRegisterType(HelloType, "Hello", HelloSize)
+	imsg.MustRegisterType(SampleType, "Sample", SampleSize)
+	imsg.MustRegisterType(BlobType, "Blob", BlobSize)
+	imsg.MustRegisterType(PingType, "Ping", PingSize)
+}
+
+// ComposeHello constructs an imsg of type HelloType carrying v, encoded field
+// by field in the system byte order. The PID field is filled in as with
+// imsg.ComposeIMsg.
+func ComposeHello(peerID uint32, v Hello, opts ...imsg.ComposeOption) (*imsg.IMsg, error) {
+	if len(v.Name) >= 16 {
+		return nil, &imsg.ErrFieldTooLong{Type: HelloType, Field: "Name", LengthInBytes: len(v.Name) + 1, MaxInBytes: 16}
+	}
+
+	data := make([]byte, HelloSize)
+	order := imsg.SystemEndianness()
+	order.PutUint16(data[0:2], v.Version)
+	data[2] = v.Flags
+	order.PutUint32(data[4:8], v.PID)
+	copy(data[8:24], v.Name)
+
+	return imsg.ComposeIMsg(HelloType, peerID, data, opts...)
+}
+
+// ParseHello decodes the data of an imsg composed by ComposeHello, whose
+// length must be exactly HelloSize.
+func ParseHello(im *imsg.IMsg) (Hello, error) {
+	var v Hello
+	if len(im.Data) != HelloSize {
+		return v, &imsg.ErrSizeMismatch{Type: im.Type, Want: HelloSize, WantMax: HelloSize, Got: len(im.Data)}
+	}
+
+	order := imsg.SystemEndianness()
+	v.Version = order.Uint16(im.Data[0:2])
+	v.Flags = im.Data[2]
+	v.PID = order.Uint32(im.Data[4:8])
+	v.Name = imsg.FixedCString(im.Data[8:24])
+
+	return v, nil
+}
+
+// ComposeSample constructs an imsg of type SampleType carrying v, encoded field
+// by field in the system byte order. The PID field is filled in as with
+// imsg.ComposeIMsg.
+func ComposeSample(peerID uint32, v Sample, opts ...imsg.ComposeOption) (*imsg.IMsg, error) {
+	data := make([]byte, SampleSize)
+	order := imsg.SystemEndianness()
+	data[0] = v.A
+	data[1] = uint8(v.B)
+	order.PutUint16(data[2:4], uint16(v.C))
+	order.PutUint32(data[4:8], uint32(v.D))
+	order.PutUint64(data[8:16], v.E)
+	order.PutUint64(data[16:24], uint64(v.F))
+
+	return imsg.ComposeIMsg(SampleType, peerID, data, opts...)
+}
+
+// ParseSample decodes the data of an imsg composed by ComposeSample, whose
+// length must be exactly SampleSize.
+func ParseSample(im *imsg.IMsg) (Sample, error) {
+	var v Sample
+	if len(im.Data) != SampleSize {
+		return v, &imsg.ErrSizeMismatch{Type: im.Type, Want: SampleSize, WantMax: SampleSize, Got: len(im.Data)}
+	}
+
+	order := imsg.SystemEndianness()
+	v.A = im.Data[0]
+	v.B = int8(im.Data[1])
+	v.C = int16(order.Uint16(im.Data[2:4]))
+	v.D = int32(order.Uint32(im.Data[4:8]))
+	v.E = order.Uint64(im.Data[8:16])
+	v.F = int64(order.Uint64(im.Data[16:24]))
+
+	return v, nil
+}
+
+// ComposeBlob constructs an imsg of type BlobType carrying v, encoded field
+// by field in the system byte order. The PID field is filled in as with
+// imsg.ComposeIMsg.
+func ComposeBlob(peerID uint32, v Blob, opts ...imsg.ComposeOption) (*imsg.IMsg, error) {
+	if len(v.Extra) > 12 {
+		return nil, &imsg.ErrFieldTooLong{Type: BlobType, Field: "Extra", LengthInBytes: len(v.Extra), MaxInBytes: 12}
+	}
+
+	data := make([]byte, BlobSize)
+	copy(data[0:8], v.Digest[:])
+	copy(data[8:20], v.Extra)
+
+	return imsg.ComposeIMsg(BlobType, peerID, data, opts...)
+}
+
+// ParseBlob decodes the data of an imsg composed by ComposeBlob, whose
+// length must be exactly BlobSize.
+func ParseBlob(im *imsg.IMsg) (Blob, error) {
+	var v Blob
+	if len(im.Data) != BlobSize {
+		return v, &imsg.ErrSizeMismatch{Type: im.Type, Want: BlobSize, WantMax: BlobSize, Got: len(im.Data)}
+	}
+
+	copy(v.Digest[:], im.Data[0:8])
+	v.Extra = append([]byte(nil), im.Data[8:20]...)
+
+	return v, nil
+}
+
+// ComposePing constructs an imsg of type PingType carrying v, encoded field
+// by field in the system byte order. The PID field is filled in as with
+// imsg.ComposeIMsg.
+func ComposePing(peerID uint32, v Ping, opts ...imsg.ComposeOption) (*imsg.IMsg, error) {
+	return imsg.ComposeIMsg(PingType, peerID, nil, opts...)
+}
+
+// ParsePing decodes the data of an imsg composed by ComposePing, whose
+// length must be exactly PingSize.
+func ParsePing(im *imsg.IMsg) (Ping, error) {
+	var v Ping
+	if len(im.Data) != PingSize {
+		return v, &imsg.ErrSizeMismatch{Type: im.Type, Want: PingSize, WantMax: PingSize, Got: len(im.Data)}
+	}
+
+	return v, nil
+}
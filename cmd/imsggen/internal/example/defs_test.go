@@ -0,0 +1,135 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package example
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/schultz-is/go-imsg"
+	"github.com/schultz-is/go-imsg/cstruct"
+)
+
+func TestRoundTrip(t *testing.T) {
+	hello := Hello{Version: 3, Flags: 0x81, PID: 1234, Name: "imsggen"}
+	sample := Sample{A: 0xff, B: -2, C: -300, D: -70000, E: 1 << 60, F: -1 << 40}
+	blob := Blob{Digest: [8]byte{1, 2, 3, 4, 5, 6, 7, 8}, Extra: bytes.Repeat([]byte{0xaa}, 12)}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		imsg.SetSystemEndianness(order)
+
+		im, err := ComposeHello(7, hello)
+		if err != nil {
+			t.Fatalf("unexpected ComposeHello failure: %s", err)
+		}
+		if im.Type != HelloType || im.PeerID != 7 || len(im.Data) != HelloSize {
+			t.Fatalf("unexpected imsg composed: %v", im)
+		}
+		gotHello, err := ParseHello(im)
+		if err != nil || gotHello != hello {
+			t.Fatalf("unexpected ParseHello result (%+v, %v)", gotHello, err)
+		}
+
+		im, err = ComposeSample(0, sample)
+		if err != nil {
+			t.Fatalf("unexpected ComposeSample failure: %s", err)
+		}
+		gotSample, err := ParseSample(im)
+		if err != nil || gotSample != sample {
+			t.Fatalf("unexpected ParseSample result (%+v, %v)", gotSample, err)
+		}
+
+		im, err = ComposeBlob(0, blob)
+		if err != nil {
+			t.Fatalf("unexpected ComposeBlob failure: %s", err)
+		}
+		gotBlob, err := ParseBlob(im)
+		if err != nil || !reflect.DeepEqual(gotBlob, blob) {
+			t.Fatalf("unexpected ParseBlob result (%+v, %v)", gotBlob, err)
+		}
+
+		im, err = ComposePing(0, Ping{})
+		if err != nil || len(im.Data) != 0 {
+			t.Fatalf("unexpected ComposePing result (%v, %v)", im, err)
+		}
+		_, err = ParsePing(im)
+		if err != nil {
+			t.Fatalf("unexpected ParsePing failure: %s", err)
+		}
+	}
+	imsg.SetSystemEndianness(nil)
+}
+
+func TestMatchesCStruct(t *testing.T) {
+	// The generated code lays out data exactly as a cstruct.Codec does.
+	sample := Sample{A: 1, B: -1, C: 2, D: -3, E: 4, F: -5}
+	im, err := ComposeSample(0, sample)
+	if err != nil {
+		t.Fatalf("unexpected ComposeSample failure: %s", err)
+	}
+	bs, err := cstruct.MustRegister[Sample]().Marshal(sample)
+	if err != nil {
+		t.Fatalf("unexpected Marshal failure: %s", err)
+	}
+	if !bytes.Equal(im.Data, bs) {
+		t.Fatalf("layouts differ (% x != % x)", im.Data, bs)
+	}
+}
+
+func TestComposeTooLong(t *testing.T) {
+	_, err := ComposeHello(0, Hello{Name: "sixteen bytes!!!"})
+	var tooLong *imsg.ErrFieldTooLong
+	if !errors.As(err, &tooLong) || tooLong.Field != "Name" || tooLong.LengthInBytes != 17 {
+		t.Fatalf("expected ErrFieldTooLong, got: %v", err)
+	}
+
+	_, err = ComposeBlob(0, Blob{Extra: make([]byte, 13)})
+	if !errors.As(err, &tooLong) || tooLong.Field != "Extra" || tooLong.Type != BlobType {
+		t.Fatalf("expected ErrFieldTooLong, got: %v", err)
+	}
+
+	// A short slice is zero-padded.
+	im, err := ComposeBlob(0, Blob{Extra: []byte{1}})
+	if err != nil {
+		t.Fatalf("unexpected ComposeBlob failure: %s", err)
+	}
+	blob, err := ParseBlob(im)
+	if err != nil || !bytes.Equal(blob.Extra, append([]byte{1}, make([]byte, 11)...)) {
+		t.Fatalf("unexpected ParseBlob result (%+v, %v)", blob, err)
+	}
+}
+
+func TestParseSizeMismatch(t *testing.T) {
+	im := &imsg.IMsg{Type: HelloType, Data: make([]byte, HelloSize-1)}
+	_, err := ParseHello(im)
+	var mismatch *imsg.ErrSizeMismatch
+	if !errors.As(err, &mismatch) || mismatch.Want != HelloSize || mismatch.Got != HelloSize-1 {
+		t.Fatalf("expected ErrSizeMismatch, got: %v", err)
+	}
+}
+
+func TestRegistered(t *testing.T) {
+	name, ok := imsg.TypeName(SampleType)
+	if !ok || name != "Sample" {
+		t.Fatalf("unexpected TypeName result (%q, %t)", name, ok)
+	}
+
+	// Sizes are registered for the size check.
+	im := &imsg.IMsg{Type: HelloType, Data: make([]byte, HelloSize+1)}
+	bs, err := im.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected MarshalBinary failure: %s", err)
+	}
+	d := imsg.NewDecoder(bytes.NewReader(bs))
+	d.SetSizeCheck(true)
+	_, err = d.Decode()
+	var mismatch *imsg.ErrSizeMismatch
+	if !errors.As(err, &mismatch) || mismatch.Want != HelloSize {
+		t.Fatalf("expected ErrSizeMismatch, got: %v", err)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+// Imsggen generates code which composes and parses imsgs carrying the structs
+// defined in a Go source file, encoding each field explicitly rather than by
+// reflection.
+//
+// Usage:
+//
+//	imsggen [-o file] file.go
+//
+// Each struct whose doc comment holds an //imsg:type=N directive describes the
+// data of imsgs of type N, where N may be given in decimal or, with a prefix,
+// in hex or octal. Every field carries an imsg tag describing its encoding, in
+// the vocabulary of package cstruct:
+//
+//	u8, u16, u32, u64   unsigned integer of the given width
+//	i8, i16, i32, i64   signed integer of the given width
+//	bytes,N             N raw bytes ([N]byte, or []byte zero-padded to N)
+//	cstring,N           string NUL-padded to N bytes, including the terminator
+//	pad,N               N zero bytes (blank [N]byte fields only)
+//	-                   the field is ignored
+//
+// Fields are laid out in declaration order with no implicit padding, and
+// integers are encoded in the system byte order, as reported by
+// imsg.SystemEndianness when the generated code runs. For a struct X, the
+// generated file holds:
+//
+//	XType, the imsg type
+//	XSize, the exact length in bytes of the data
+//	ComposeX(peerID uint32, v X, opts ...imsg.ComposeOption) (*imsg.IMsg, error)
+//	ParseX(im *imsg.IMsg) (X, error)
+//
+// along with an init function registering the name of each type and the size
+// of its data, so that imsgs are printed symbolically and checked by
+// imsg.WithSizeCheck. ParseX doesn't check the type of the imsg, only the
+// length of its data.
+//
+// The generated code is written to the named output file, or by default to a
+// file beside the input whose name ends in _imsg.go rather than .go, such as
+// from a //go:generate imsggen defs.go directive. The same input always
+// produces the same output. Imsggen exits with status 1 if the definitions are
+// invalid, and with status 2 if the files can't be read or written.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stderr))
+}
+
+// These are the exit statuses.
+const (
+	exitOK      = 0
+	exitInvalid = 1
+	exitError   = 2
+)
+
+// run runs imsggen with the provided arguments, returning its exit status.
+func run(args []string, stderr io.Writer) int {
+	fs := flag.NewFlagSet("imsggen", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	out := fs.String("o", "", "output file")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: imsggen [-o file] file.go")
+		fs.PrintDefaults()
+	}
+
+	err := fs.Parse(args)
+	if err != nil {
+		return exitError
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitError
+	}
+
+	in := fs.Arg(0)
+	src, err := os.ReadFile(in)
+	if err != nil {
+		fmt.Fprintf(stderr, "imsggen: %s\n", err)
+		return exitError
+	}
+
+	code, err := generate(in, src)
+	if err != nil {
+		fmt.Fprintf(stderr, "imsggen: %s\n", err)
+		return exitInvalid
+	}
+
+	if *out == "" {
+		*out = strings.TrimSuffix(in, ".go") + "_imsg.go"
+	}
+	if filepath.Clean(*out) == filepath.Clean(in) {
+		fmt.Fprintf(stderr, "imsggen: refusing to overwrite input %s\n", in)
+		return exitError
+	}
+	err = os.WriteFile(*out, code, 0o644)
+	if err != nil {
+		fmt.Fprintf(stderr, "imsggen: %s\n", err)
+		return exitError
+	}
+
+	return exitOK
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// The generated code checked in beside the example definitions is the golden
+// file.
+const (
+	exampleDefs   = "internal/example/defs.go"
+	exampleGolden = "internal/example/defs_imsg.go"
+)
+
+func TestGolden(t *testing.T) {
+	src, err := os.ReadFile(exampleDefs)
+	if err != nil {
+		t.Fatalf("failed to read definitions: %s", err)
+	}
+
+	code, err := generate(exampleDefs, src)
+	if err != nil {
+		t.Fatalf("unexpected generate failure: %s", err)
+	}
+	if *update {
+		err = os.WriteFile(exampleGolden, code, 0o644)
+		if err != nil {
+			t.Fatalf("failed to update golden file: %s", err)
+		}
+	}
+
+	expected, err := os.ReadFile(exampleGolden)
+	if err != nil {
+		t.Fatalf("failed to read golden file: %s", err)
+	}
+	if !bytes.Equal(code, expected) {
+		t.Fatalf("generated code differs from %s; rerun with -update\n%s", exampleGolden, code)
+	}
+
+	// The output depends on nothing but the input.
+	again, err := generate(exampleDefs, src)
+	if err != nil || !bytes.Equal(again, code) {
+		t.Fatalf("generated code is not deterministic (%v)", err)
+	}
+}
+
+func TestRun(t *testing.T) {
+	dir := t.TempDir()
+	in := filepath.Join(dir, "defs.go")
+	src, err := os.ReadFile(exampleDefs)
+	if err != nil {
+		t.Fatalf("failed to read definitions: %s", err)
+	}
+	err = os.WriteFile(in, src, 0o644)
+	if err != nil {
+		t.Fatalf("failed to write definitions: %s", err)
+	}
+
+	var stderr bytes.Buffer
+	status := run([]string{in}, &stderr)
+	if status != exitOK {
+		t.Fatalf("unexpected exit status %d: %s", status, stderr.String())
+	}
+	code, err := os.ReadFile(filepath.Join(dir, "defs_imsg.go"))
+	if err != nil {
+		t.Fatalf("failed to read generated code: %s", err)
+	}
+	expected, err := os.ReadFile(exampleGolden)
+	if err != nil {
+		t.Fatalf("failed to read golden file: %s", err)
+	}
+	if !bytes.Equal(code, expected) {
+		t.Fatalf("generated code differs from %s", exampleGolden)
+	}
+
+	status = run([]string{"-o", in, in}, &stderr)
+	if status != exitError {
+		t.Fatalf("unexpected exit status when overwriting input: %d", status)
+	}
+	status = run([]string{filepath.Join(dir, "missing.go")}, &stderr)
+	if status != exitError {
+		t.Fatalf("unexpected exit status for missing input: %d", status)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		src  string
+		want string
+	}{
+		{
+			"no directives",
+			"type T struct{ A uint8 `imsg:\"u8\"` }",
+			"no structs marked",
+		},
+		{
+			"bad type",
+			"//imsg:type=x\ntype T struct{}",
+			`invalid imsg type "x"`,
+		},
+		{
+			"not a struct",
+			"//imsg:type=1\ntype T uint32",
+			"T is not a struct",
+		},
+		{
+			"duplicate type",
+			"//imsg:type=1\ntype T struct{}\n//imsg:type=1\ntype U struct{}",
+			"U has type 1, as does T",
+		},
+		{
+			"missing tag",
+			"//imsg:type=1\ntype T struct{ A uint8 }",
+			"field A is missing an imsg tag",
+		},
+		{
+			"mismatched width",
+			"//imsg:type=1\ntype T struct{ A uint16 `imsg:\"u32\"` }",
+			"field of type uint16 cannot be encoded as u32",
+		},
+		{
+			"mismatched array",
+			"//imsg:type=1\ntype T struct{ A [4]byte `imsg:\"bytes,8\"` }",
+			"array of 4 bytes does not match size 8",
+		},
+		{
+			"named pad",
+			"//imsg:type=1\ntype T struct{ P [4]byte `imsg:\"pad,4\"` }",
+			"pad requires a blank [4]byte field",
+		},
+		{
+			"unknown encoding",
+			"//imsg:type=1\ntype T struct{ A float32 `imsg:\"f32\"` }",
+			`unknown encoding "f32"`,
+		},
+		{
+			"embedded",
+			"//imsg:type=1\ntype T struct{ U }",
+			"embedded fields are not supported",
+		},
+		{
+			"too large",
+			"//imsg:type=1\ntype T struct{ A [65535]byte `imsg:\"bytes,65535\"` }",
+			"T is too large",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := generate("defs.go", []byte("package p\n\n"+test.src+"\n"))
+			if err == nil || !strings.Contains(err.Error(), test.want) {
+				t.Fatalf("expected error containing %q, got: %v", test.want, err)
+			}
+		})
+	}
+}
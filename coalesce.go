@@ -0,0 +1,143 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bufio"
+	"time"
+)
+
+// WithWriteBufferSize causes the Conn to coalesce sent imsgs rather than
+// writing each one as it's sent. Imsgs accumulate in the send queue until at
+// least n bytes are pending, at which point they're written together with a
+// single writev. Unless WithFlushInterval is also provided, imsgs short of the
+// threshold are written only by Flush or Close.
+func WithWriteBufferSize(n int) ConnOption {
+	return func(c *Conn) {
+		c.wbufSize = n
+	}
+}
+
+// WithFlushInterval causes the Conn to coalesce sent imsgs, writing them no
+// later than d after the first of them was sent. Errors encountered while
+// writing in the background are returned by the next Send or Flush.
+func WithFlushInterval(d time.Duration) ConnOption {
+	return func(c *Conn) {
+		c.flushInterval = d
+	}
+}
+
+// coalescing reports whether sent imsgs are left queued to be written
+// together, or by an EventLoop.
+func (c *Conn) coalescing() bool {
+	return c.wbufSize > 0 || c.flushInterval > 0 || c.loop.Load() != nil
+}
+
+// flushQueued writes queued imsgs, or when coalescing, only once enough have
+// accumulated, arranging for them to be written later otherwise. An error from
+// an earlier background flush is returned first. Imsgs sent over a Conn added to
+// an EventLoop are left for the loop to write.
+func (c *Conn) flushQueued() error {
+	err := c.takeFlushError()
+	if err != nil {
+		return err
+	}
+
+	if l := c.loop.Load(); l != nil {
+		l.wake()
+		return nil
+	}
+
+	if !c.coalescing() || (c.wbufSize > 0 && c.wq.PendingBytes() >= c.wbufSize) {
+		_, err := c.wq.Flush()
+		return err
+	}
+
+	if c.flushInterval > 0 {
+		c.armFlushTimer()
+	}
+
+	return nil
+}
+
+// armFlushTimer schedules a flush after the flush interval, unless one is
+// already scheduled or the Conn has been closed.
+func (c *Conn) armFlushTimer() {
+	c.tmu.Lock()
+	defer c.tmu.Unlock()
+
+	if c.ftimer != nil || c.closed.Load() {
+		return
+	}
+
+	c.ftimer = time.AfterFunc(c.flushInterval, c.timedFlush)
+}
+
+// timedFlush writes the imsgs queued since the flush timer was armed.
+func (c *Conn) timedFlush() {
+	c.tmu.Lock()
+	c.ftimer = nil
+	c.tmu.Unlock()
+
+	_, err := c.wq.Flush()
+	if err != nil {
+		c.werr.Store(&err)
+	}
+}
+
+// stopFlushTimer cancels a scheduled flush.
+func (c *Conn) stopFlushTimer() {
+	c.tmu.Lock()
+	defer c.tmu.Unlock()
+
+	if c.ftimer != nil {
+		c.ftimer.Stop()
+		c.ftimer = nil
+	}
+}
+
+// takeFlushError returns and clears the error encountered by the most recent
+// background flush, if any.
+func (c *Conn) takeFlushError() error {
+	errp := c.werr.Swap(nil)
+	if errp == nil {
+		return nil
+	}
+
+	return *errp
+}
+
+// SetWriteBufferSize causes the Encoder to buffer encoded imsgs, writing them
+// once n bytes have accumulated or Flush is called. A size of zero or less
+// writes anything buffered and disables buffering.
+func (e *Encoder) SetWriteBufferSize(n int) error {
+	err := e.Flush()
+	if err != nil {
+		return err
+	}
+
+	if n <= 0 {
+		e.bw = nil
+		return nil
+	}
+
+	e.bw = bufio.NewWriterSize(e.w, n)
+
+	return nil
+}
+
+// Flush writes any imsgs buffered by the Encoder.
+func (e *Encoder) Flush() error {
+	if e.bw == nil {
+		return nil
+	}
+
+	err := e.bw.Flush()
+	if err != nil {
+		return &ErrWrite{err}
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// newCoalescingTestConns constructs a connected pair of Conns, the first of
+// which is configured with the provided options.
+func newCoalescingTestConns(t *testing.T, opts ...ConnOption) (*Conn, *Conn) {
+	t.Helper()
+
+	a, b := newTestSocketPair(t)
+	a = rewrapTestConn(t, a, opts...)
+
+	return a, b
+}
+
+// expectNothingReceived confirms that nothing arrives at c for a short while.
+func expectNothingReceived(t *testing.T, c *Conn) {
+	t.Helper()
+
+	c.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	defer c.SetReadDeadline(time.Time{})
+
+	im, err := c.Recv()
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected nothing to be received, got: %v, %v", im, err)
+	}
+}
+
+func TestConnWriteBufferSize(t *testing.T) {
+	a, b := newCoalescingTestConns(t, WithWriteBufferSize(4*HeaderSizeInBytes))
+
+	for typ := uint32(0); typ < 3; typ++ {
+		err := a.Send(&IMsg{Type: typ})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+	expectNothingReceived(t, b)
+
+	// The fourth imsg reaches the threshold.
+	err := a.Send(&IMsg{Type: 3})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	for typ := uint32(0); typ < 4; typ++ {
+		im, err := b.Recv()
+		if err != nil || im.Type != typ {
+			t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+		}
+	}
+
+	err = a.Send(&IMsg{Type: 4, Data: []byte("test")})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	expectNothingReceived(t, b)
+
+	err = a.Flush()
+	if err != nil {
+		t.Fatalf("unexpected Flush failure: %s", err)
+	}
+	im, err := b.Recv()
+	if err != nil || im.Type != 4 || string(im.Data) != "test" {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+}
+
+func TestConnFlushInterval(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	a, b := newCoalescingTestConns(t, WithWriteBufferSize(1<<20), WithFlushInterval(interval))
+
+	for round := 0; round < 3; round++ {
+		start := time.Now()
+		for typ := uint32(0); typ < 10; typ++ {
+			err := a.Send(&IMsg{Type: typ})
+			if err != nil {
+				t.Fatalf("unexpected Send failure: %s", err)
+			}
+		}
+
+		for typ := uint32(0); typ < 10; typ++ {
+			im, err := b.Recv()
+			if err != nil || im.Type != typ {
+				t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+			}
+		}
+		if elapsed := time.Since(start); elapsed < interval || elapsed > time.Second {
+			t.Fatalf("imsgs were not written at the flush interval (%s)", elapsed)
+		}
+
+		// The timed flush which wrote the imsgs may still be returning, and
+		// would write the next round's imsgs early. Flush waits for it.
+		err := a.Flush()
+		if err != nil {
+			t.Fatalf("unexpected Flush failure: %s", err)
+		}
+	}
+}
+
+func TestConnCoalescedClose(t *testing.T) {
+	a, b := newCoalescingTestConns(t, WithWriteBufferSize(1<<20), WithFlushInterval(time.Hour))
+
+	for typ := uint32(0); typ < 10; typ++ {
+		err := a.Send(&IMsg{Type: typ})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+
+	err := a.Close()
+	if err != nil {
+		t.Fatalf("unexpected Close failure: %s", err)
+	}
+
+	a.tmu.Lock()
+	ftimer := a.ftimer
+	a.tmu.Unlock()
+	if ftimer != nil {
+		t.Fatalf("flush timer was not stopped by Close")
+	}
+
+	for typ := uint32(0); typ < 10; typ++ {
+		im, err := b.Recv()
+		if err != nil || im.Type != typ {
+			t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+		}
+	}
+	_, err = b.Recv()
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF, got: %v", err)
+	}
+
+	// Sends after Close don't rearm the timer.
+	a.Send(&IMsg{Type: 10})
+	if a.ftimer != nil {
+		t.Fatalf("flush timer was armed after Close")
+	}
+}
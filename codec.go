@@ -0,0 +1,98 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+)
+
+// A Codec encodes Go values into the ancillary data of imsgs and decodes them
+// back out. A Conn's Codec is used by SendValue and RecvValue.
+type Codec interface {
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// GobCodec is a Codec which uses encoding/gob. Each imsg is encoded
+// independently, so type information accompanies every value. This is the
+// default Codec of a Conn.
+type GobCodec struct{}
+
+// Marshal implements the Codec interface.
+func (GobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+
+	err := gob.NewEncoder(&buf).Encode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Unmarshal implements the Codec interface.
+func (GobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// JSONCodec is a Codec which uses encoding/json.
+type JSONCodec struct{}
+
+// Marshal implements the Codec interface.
+func (JSONCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal implements the Codec interface.
+func (JSONCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+// WithCodec sets the Codec used by SendValue and RecvValue, which defaults to
+// GobCodec.
+func WithCodec(codec Codec) ConnOption {
+	return func(c *Conn) {
+		c.codec = codec
+	}
+}
+
+// SendValue encodes v with the Conn's Codec and sends it as the ancillary data
+// of an imsg of the provided type. The PID field is filled in as described by
+// WithPIDFunc. An error from the Codec is wrapped in an ErrPayloadCodec, and if
+// the encoded value is too large, ErrDataTooLarge is returned.
+func (c *Conn) SendValue(typ, peerID uint32, v any) error {
+	data, err := c.codec.Marshal(v)
+	if err != nil {
+		return &ErrPayloadCodec{"marshal", err}
+	}
+
+	return c.Send(&IMsg{
+		Type:   typ,
+		PeerID: peerID,
+		PID:    c.pid(),
+		Data:   data,
+	})
+}
+
+// RecvValue receives the next imsg and decodes its ancillary data into v with
+// the Conn's Codec, returning the imsg's header fields. An error from the Codec
+// is wrapped in an ErrPayloadCodec, in which case the header fields are still
+// returned. Any file attached to the imsg is closed.
+func (c *Conn) RecvValue(v any) (typ, peerID, pid uint32, err error) {
+	im, err := c.Recv()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	im.closeFile()
+
+	err = c.codec.Unmarshal(im.Data, v)
+	if err != nil {
+		err = &ErrPayloadCodec{"unmarshal", err}
+	}
+
+	return im.Type, im.PeerID, im.PID, err
+}
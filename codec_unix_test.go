@@ -0,0 +1,110 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+type codecTestValue struct {
+	Name  string
+	Addrs []string
+	MTU   int
+}
+
+// This is a Codec which always fails.
+type failingCodec struct{}
+
+var errFailingCodec = errors.New("failing codec")
+
+func (failingCodec) Marshal(v any) ([]byte, error)      { return nil, errFailingCodec }
+func (failingCodec) Unmarshal(data []byte, v any) error { return errFailingCodec }
+
+// This is a Codec which produces oversized payloads.
+type bloatedCodec struct{}
+
+func (bloatedCodec) Marshal(v any) ([]byte, error)      { return make([]byte, MaxSizeInBytes), nil }
+func (bloatedCodec) Unmarshal(data []byte, v any) error { return nil }
+
+func newTestCodecPair(t *testing.T, codec Codec) (*Conn, *Conn) {
+	a, b := newTestSocketPair(t)
+	a.codec = codec
+	b.codec = codec
+
+	return a, b
+}
+
+func TestConnSendRecvValue(t *testing.T) {
+	in := codecTestValue{"em0", []string{"192.0.2.1", "2001:db8::1"}, 1500}
+
+	for _, codec := range []Codec{GobCodec{}, JSONCodec{}} {
+		t.Run(reflect.TypeOf(codec).Name(), func(t *testing.T) {
+			a, b := newTestCodecPair(t, codec)
+
+			err := a.SendValue(1, 2, in)
+			if err != nil {
+				t.Fatalf("unexpected SendValue failure: %s", err)
+			}
+
+			var out codecTestValue
+			typ, peerID, pid, err := b.RecvValue(&out)
+			if err != nil {
+				t.Fatalf("unexpected RecvValue failure: %s", err)
+			}
+			if typ != 1 || peerID != 2 || pid != uint32(os.Getpid()) {
+				t.Fatalf("unexpected header fields (%d, %d, %d)", typ, peerID, pid)
+			}
+			if !reflect.DeepEqual(out, in) {
+				t.Fatalf("received value does not match sent value (%#v != %#v)", out, in)
+			}
+		})
+	}
+}
+
+func TestConnSendRecvValueErrors(t *testing.T) {
+	var epc *ErrPayloadCodec
+
+	a, b := newTestCodecPair(t, failingCodec{})
+	err := a.SendValue(1, 2, "test")
+	if !errors.As(err, &epc) || !errors.Is(err, errFailingCodec) {
+		t.Fatalf("expected wrapped codec error, got: %v", err)
+	}
+
+	im, _ := ComposeIMsg(1, 2, []byte("test"))
+	err = a.Send(im)
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	typ, _, _, err := b.RecvValue(new(string))
+	if !errors.As(err, &epc) || !errors.Is(err, errFailingCodec) {
+		t.Fatalf("expected wrapped codec error, got: %v", err)
+	}
+	if typ != 1 {
+		t.Fatalf("header fields not returned alongside codec error")
+	}
+
+	var edtl *ErrDataTooLarge
+	a, _ = newTestCodecPair(t, bloatedCodec{})
+	err = a.SendValue(1, 2, "test")
+	if !errors.As(err, &edtl) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+}
+
+func TestWithCodec(t *testing.T) {
+	c := NewConn(nil, WithCodec(JSONCodec{}))
+	if _, ok := c.codec.(JSONCodec); !ok {
+		t.Fatalf("codec was not set (%T)", c.codec)
+	}
+	c = NewConn(nil)
+	if _, ok := c.codec.(GobCodec); !ok {
+		t.Fatalf("unexpected default codec (%T)", c.codec)
+	}
+}
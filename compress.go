@@ -0,0 +1,140 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+// FlagCompressed is set in the header of an imsg whose data has been
+// deflate-compressed. It has no counterpart in the C implementation, which
+// passes the compressed data through to the application unchanged, so
+// compression must only be enabled when both peers are known to support it.
+const FlagCompressed Flags = 0x8000
+
+// DefaultDecompressionLimit is the default limit on the size in bytes to which
+// the data of a received imsg may decompress.
+const DefaultDecompressionLimit = 1 << 20
+
+// flateWriters holds flate.Writers for reuse, since each is costly to allocate.
+var flateWriters = sync.Pool{
+	New: func() any {
+		w, _ := flate.NewWriter(nil, flate.DefaultCompression)
+		return w
+	},
+}
+
+// WithCompression enables compression of the data of imsgs sent over the Conn
+// and decompression of the data of imsgs received over it. Data larger than
+// threshold bytes is deflate-compressed and the imsg is marked with
+// FlagCompressed, unless compression fails to make it smaller. Since data is
+// compressed before its size is checked, data which would otherwise be too
+// large may be sent if it compresses well enough. Received data decompresses to
+// at most DefaultDecompressionLimit bytes unless WithDecompressionLimit is also
+// provided. Imsgs sent by Broadcast, which are marshaled once for every Conn,
+// aren't compressed.
+//
+// Compressed imsgs can't be understood by the C implementation or by peers
+// without compression enabled, so this must only be enabled when the peer is
+// known to enable it as well.
+func WithCompression(threshold int) ConnOption {
+	return func(c *Conn) {
+		c.compressAbove.Store(int64(threshold))
+		if c.decompressLimit.Load() <= 0 {
+			c.decompressLimit.Store(DefaultDecompressionLimit)
+		}
+	}
+}
+
+// WithDecompressionLimit enables decompression of the data of imsgs received
+// over the Conn, limiting the size in bytes to which the data of an imsg may
+// decompress. An imsg whose data would decompress to more than n bytes is
+// consumed and ErrDecompression is returned from Recv. Like WithCompression,
+// this isn't compatible with the C implementation.
+func WithDecompressionLimit(n int) ConnOption {
+	return func(c *Conn) {
+		c.decompressLimit.Store(int64(n))
+	}
+}
+
+// SetCompression controls whether the Encoder compresses the data of the imsgs
+// it encodes, as described by WithCompression. Data larger than threshold bytes
+// is compressed, while a negative threshold disables compression, which is the
+// default. Compressed imsgs may only be decoded by a Decoder which has enabled
+// decompression with SetDecompressionLimit.
+func (e *Encoder) SetCompression(threshold int) {
+	e.compressAbove = threshold
+}
+
+// SetDecompressionLimit controls whether the Decoder decompresses the data of
+// imsgs marked with FlagCompressed, limiting the size in bytes to which the
+// data of an imsg may decompress. A limit of zero or less disables
+// decompression, which is the default, leaving the data of such imsgs as it
+// was received.
+func (d *Decoder) SetDecompressionLimit(n int) {
+	d.decompressLimit = n
+}
+
+// compressIMsg returns an imsg equivalent to im whose data is compressed if
+// it's larger than threshold bytes and compressing it makes it smaller. A
+// negative threshold disables compression, and imsgs marked by WithWipe aren't
+// compressed, since the compressor's internal state can't be wiped. Otherwise,
+// im itself is returned.
+func compressIMsg(im *IMsg, threshold int) *IMsg {
+	if threshold < 0 || len(im.Data) <= threshold || im.flags&FlagCompressed != 0 || im.wipe {
+		return im
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(im.Data))
+
+	w := flateWriters.Get().(*flate.Writer)
+	w.Reset(&buf)
+	w.Write(im.Data)
+	w.Close()
+	flateWriters.Put(w)
+
+	if buf.Len() >= len(im.Data) {
+		return im
+	}
+
+	return &IMsg{
+		Type:   im.Type,
+		PeerID: im.PeerID,
+		PID:    im.PID,
+		Data:   buf.Bytes(),
+		flags:  im.flags | FlagCompressed,
+		file:   im.file,
+	}
+}
+
+// decompress replaces the data of an imsg marked with FlagCompressed with the
+// result of decompressing it, which may be at most limit bytes, and clears the
+// flag.
+func (im *IMsg) decompress(limit int) error {
+	if im.flags&FlagCompressed == 0 {
+		return nil
+	}
+
+	r := flate.NewReader(bytes.NewReader(im.Data))
+	defer r.Close()
+
+	// One byte beyond the limit is read so that exceeding it can be detected.
+	data, err := io.ReadAll(io.LimitReader(r, int64(limit)+1))
+	if err != nil {
+		return &ErrDecompression{im.Type, limit, err}
+	}
+	if len(data) > limit {
+		return &ErrDecompression{im.Type, limit, nil}
+	}
+
+	im.Data = data
+	im.flags &^= FlagCompressed
+
+	return nil
+}
@@ -0,0 +1,103 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestCompressionRoundTrip(t *testing.T) {
+	incompressible := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(incompressible)
+
+	tests := []struct {
+		name       string
+		data       []byte
+		compressed bool
+	}{
+		{"empty", nil, false},
+		{"below threshold", bytes.Repeat([]byte("a"), 64), false},
+		{"compressible", bytes.Repeat([]byte(`{"key": "value"} `), 100), true},
+		{"larger than maximum", bytes.Repeat([]byte("a"), 4*MaxSizeInBytes), true},
+		{"incompressible", incompressible, false},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		enc := NewEncoder(&buf)
+		enc.SetCompression(64)
+
+		im := &IMsg{Type: 1, PeerID: 2, PID: 3, Data: test.data}
+		err := enc.Encode(im)
+		if err != nil {
+			t.Fatalf("%s: unexpected Encode failure: %s", test.name, err)
+		}
+		if compressed := buf.Len() < im.Len(); compressed != test.compressed {
+			t.Fatalf("%s: unexpected encoded length (%d for %d bytes of data)", test.name, buf.Len(), len(test.data))
+		}
+
+		// Without decompression, the data is left as it was received.
+		raw, err := NewDecoder(bytes.NewReader(buf.Bytes())).Decode()
+		if err != nil {
+			t.Fatalf("%s: unexpected Decode failure: %s", test.name, err)
+		}
+		if (raw.flags&FlagCompressed != 0) != test.compressed {
+			t.Fatalf("%s: unexpected flags (%#x)", test.name, raw.flags)
+		}
+
+		dec := NewDecoder(&buf)
+		dec.SetDecompressionLimit(DefaultDecompressionLimit)
+		decoded, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("%s: unexpected Decode failure: %s", test.name, err)
+		}
+		if !decoded.Equal(im) {
+			t.Fatalf("%s: decoded imsg does not match (%v != %v)", test.name, decoded, im)
+		}
+	}
+}
+
+func TestCompressionOffByDefault(t *testing.T) {
+	var buf bytes.Buffer
+	data := bytes.Repeat([]byte("a"), 1000)
+	err := NewEncoder(&buf).Encode(&IMsg{Type: 1, Data: data})
+	if err != nil {
+		t.Fatalf("unexpected Encode failure: %s", err)
+	}
+	if buf.Len() != HeaderSizeInBytes+len(data) {
+		t.Fatalf("unexpected encoded length (%d)", buf.Len())
+	}
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	// A few kilobytes of zeroes expand to far more than the limit.
+	var bomb bytes.Buffer
+	w, _ := flate.NewWriter(&bomb, flate.BestCompression)
+	w.Write(make([]byte, 8<<20))
+	w.Close()
+	if bomb.Len() > MaxSizeInBytes-HeaderSizeInBytes {
+		t.Fatalf("bomb is too large to send (%d bytes)", bomb.Len())
+	}
+
+	frame, _ := (&IMsg{Type: 1, Data: bomb.Bytes(), flags: FlagCompressed}).MarshalBinary()
+	dec := NewDecoder(bytes.NewReader(frame))
+	dec.SetDecompressionLimit(1 << 20)
+	_, err := dec.Decode()
+	var ed *ErrDecompression
+	if !errors.As(err, &ed) || ed.Type != 1 || ed.Limit != 1<<20 || ed.Err != nil {
+		t.Fatalf("expected ErrDecompression for exceeded limit, got: %v", err)
+	}
+
+	frame, _ = (&IMsg{Type: 2, Data: []byte("garbage"), flags: FlagCompressed}).MarshalBinary()
+	dec = NewDecoder(bytes.NewReader(frame))
+	dec.SetDecompressionLimit(1 << 20)
+	_, err = dec.Decode()
+	if !errors.As(err, &ed) || ed.Type != 2 || ed.Err == nil {
+		t.Fatalf("expected wrapped ErrDecompression, got: %v", err)
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"testing"
+)
+
+func TestConnCompression(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	a = rewrapTestConn(t, a, WithCompression(128))
+	b = rewrapTestConn(t, b, WithCompression(128))
+
+	large := bytes.Repeat([]byte("text "), 2*MaxSizeInBytes)
+	small := []byte("test")
+
+	err := a.Send(&IMsg{Type: 1, Data: large})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	err = a.Composev(2, 0, large[:1000], large[:1000])
+	if err != nil {
+		t.Fatalf("unexpected Composev failure: %s", err)
+	}
+	err = a.SendBatch(&IMsg{Type: 3, Data: small}, &IMsg{Type: 4, Data: large})
+	if err != nil {
+		t.Fatalf("unexpected SendBatch failure: %s", err)
+	}
+
+	expected := [][]byte{large, large[:2000], small, large}
+	for i, data := range expected {
+		im, err := b.Recv()
+		if err != nil {
+			t.Fatalf("unexpected Recv failure: %s", err)
+		}
+		if im.Type != uint32(i+1) || !bytes.Equal(im.Data, data) || im.flags != 0 {
+			t.Fatalf("unexpected imsg received (%v)", im)
+		}
+	}
+}
+
+func TestConnDecompressionLimit(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	b = rewrapTestConn(t, b, WithDecompressionLimit(1000))
+
+	var bomb bytes.Buffer
+	w, _ := flate.NewWriter(&bomb, flate.BestCompression)
+	w.Write(make([]byte, 1001))
+	w.Close()
+
+	bs, _ := (&IMsg{Type: 1, Data: bomb.Bytes(), flags: FlagCompressed}).MarshalBinary()
+	_, err := a.conn.Write(bs)
+	if err != nil {
+		t.Fatalf("failed to write imsg: %s", err)
+	}
+	err = a.Composev(2, 0, []byte("test"))
+	if err != nil {
+		t.Fatalf("unexpected Composev failure: %s", err)
+	}
+
+	_, err = b.Recv()
+	var ed *ErrDecompression
+	if !errors.As(err, &ed) || ed.Limit != 1000 {
+		t.Fatalf("expected ErrDecompression, got: %v", err)
+	}
+
+	// The offending imsg is consumed.
+	im, err := b.Recv()
+	if err != nil || im.Type != 2 {
+		t.Fatalf("unexpected Recv result after decompression failure (%v, %v)", im, err)
+	}
+}
@@ -0,0 +1,1252 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const (
+	// This is the size of the buffer used for each read from the underlying
+	// socket. It matches IBUF_READ_SIZE in the C implementation.
+	readBufSizeInBytes = 65535
+	// This is the maximum number of descriptors accepted in a single read from
+	// the underlying socket.
+	maxFDsPerRead = 16
+)
+
+// DefaultMaxPendingFDs is the default limit on received descriptors awaiting
+// attachment to an imsg. The C implementation refuses further descriptors only
+// once the process's descriptor table is nearly exhausted; this limit keeps a
+// misbehaving peer well short of that point.
+const DefaultMaxPendingFDs = 64
+
+// DefaultLinger is the default limit on how long Close spends writing imsgs
+// which remain queued before closing the underlying socket.
+const DefaultLinger = time.Second
+
+// A Conn sends and receives imsgs over a unix domain socket. In addition to
+// the imsgs themselves, a Conn passes any attached file descriptors to the
+// peer using SCM_RIGHTS control messages. A Conn may also be constructed over
+// another kind of stream connection, such as a TCP connection or a *tls.Conn,
+// in which case descriptors can't be passed.
+//
+// A Conn is safe for concurrent use. Each imsg is written to the socket whole,
+// never interleaved with another, and imsgs of the same priority sent by a
+// single goroutine are delivered in the order they were sent; an imsg composed
+// with a higher priority by WithPriority may overtake them while they're
+// queued. No ordering is guaranteed between imsgs sent concurrently by
+// different goroutines.
+//
+// A file attached to an imsg has exactly one owner, and no finalizer closes it
+// on the owner's behalf. A file attached to a sent imsg passes to the Conn once
+// the imsg is queued, and the Conn closes it once it has been transmitted or
+// discarded. If the imsg is refused before being queued, such as with
+// ErrFDPassDisabled, the file remains attached, as File reports, and still
+// belongs to the caller. A file attached to a received imsg belongs to the
+// caller of Recv, who must either close it with the imsg's Close or take it
+// with Detach; Serve does so on its handlers' behalf once each returns. The
+// Conn closes the file itself, and returns nothing to the caller, when an imsg
+// is dropped or rejected by a filter, absorbed as a heartbeat, or refused
+// because of an error such as ErrUnknownFlags, and closes any received
+// descriptors which can no longer be matched to an imsg when decoding fails or
+// the Conn is closed.
+type Conn struct {
+	conn io.ReadWriteCloser
+	uc   fdConn // Set when conn supports descriptor passing
+
+	rsem    chan struct{} // Held by whichever of Recv and Call is reading
+	rmu     sync.Mutex
+	rbuf    []byte     // Bytes read from the socket but not yet consumed
+	rtmp    []byte     // Scratch space for reads from the socket
+	fds     []*os.File // Descriptors received but not yet attached to an imsg
+	backlog []*IMsg    // Imsgs read by Call or RecvMatching which are awaiting Recv
+
+	umu    sync.Mutex
+	unread []*IMsg // Imsgs pushed back by Unread, the last unread at the end
+
+	passCreds bool       // Whether received credentials are attached to imsgs
+	rpos      int64      // Offset in the stream of the start of rbuf
+	cmarks    []credMark // Credentials received with the bytes of rbuf
+
+	wq *MsgBuf // Imsgs being sent, which are queued while another is written
+
+	maxSize atomic.Uint32    // Maximum size in bytes of a received imsg
+	order   binary.ByteOrder // Byte order of headers on the wire
+	packet  bool             // Whether each datagram read holds a single imsg
+
+	allowFDPass   atomic.Bool // Whether descriptors may be sent and received
+	maxPendingFDs int         // Limit on the length of fds
+	keepFDs       bool        // Whether unclaimed descriptors are left open on Close
+
+	linger time.Duration // Limit on draining wq during Close
+	closed atomic.Bool   // Set by the first call to Close
+
+	smu       sync.Mutex            // Held while changing state
+	state     atomic.Int32          // The ConnState of the Conn
+	ferr      atomic.Pointer[error] // Reported by Err once the Conn has failed
+	stateFunc StateFunc             // Set by WithStateFunc
+
+	wbufSize      int           // Pending bytes which trigger a flush when coalescing
+	flushInterval time.Duration // Limit on how long coalesced imsgs wait
+
+	tmu    sync.Mutex
+	ftimer *time.Timer           // Scheduled flush of coalesced imsgs
+	werr   atomic.Pointer[error] // Error from the last background flush
+
+	loop atomic.Pointer[EventLoop] // Set while the Conn is added to an EventLoop
+
+	credMu sync.Mutex
+	cred   *PeerCred // Cached result of PeerCred
+
+	verifyPID     bool // Whether received PIDs are checked against PeerCred
+	verifyZeroPID bool // Whether received PIDs of zero are checked as well
+	strictFlags   bool // Whether received imsgs with unknown flags are refused
+	sizeCheck     bool // Whether received imsgs are checked against expected sizes
+
+	allowed         atomic.Pointer[typeAllowlist] // Set by SetAllowedTypes
+	closeDisallowed bool                          // Set by WithCloseOnDisallowedType
+
+	filter   atomic.Pointer[recvFilter] // Set by SetRecvFilter
+	recvMode atomic.Int32               // Positive while serving, negative while RecvMatching
+
+	interrupts atomic.Int32 // Reads being interrupted by interruptOnDone
+
+	trace    TraceFunc       // Observes imsgs sent and received
+	traceErr DecodeErrorFunc // Observes received data which can't be decoded
+	logger   *slog.Logger    // Receives debug-level records when set
+
+	recvd   recvCounters // Reported by Stats
+	metrics MetricsHook  // Notified as imsgs are received
+
+	limiter   Limiter   // Paces sent imsgs when set
+	limitUnit LimitUnit // What the limiter counts
+
+	compressAbove   atomic.Int64 // Size beyond which sent data is compressed, if not negative
+	decompressLimit atomic.Int64 // Limit on the size of decompressed data, if positive
+
+	codec  Codec      // Used by SendValue and RecvValue
+	pidSrc *pidSource // Overrides the package-level PID source when set
+
+	ka     *keepalive   // Set by WithKeepalive
+	idle   *idleTimeout // Set by WithIdleTimeout
+	stall  *writeStall  // Set by WithWriteStallTimeout
+	rate   *recvRate    // Set by WithMaxRecvRate
+	rqueue *recvQueue   // Set by WithRecvQueueLimit
+	quota  *recvQuota   // Set by WithRecvQuota and WithRecvFDQuota
+
+	budget   *AllocationBudget // Set by WithAllocationBudget
+	reserved int               // Bytes of rbuf reserved from budget
+
+	calls  Pending       // Calls awaiting a reply
+	callID atomic.Uint32 // Last correlation value assigned by Call
+	corr   correlation   // Accesses the correlation value of an imsg
+
+	defaultPeerID atomic.Uint32 // Set by SetDefaultPeerID
+}
+
+// An fdConn is a connection over which descriptors can be passed alongside the
+// stream in SCM_RIGHTS control messages, such as a *net.UnixConn. Connections
+// layered over a socket, such as a *tls.Conn, don't qualify, since writing
+// their stream directly to the socket isn't possible.
+type fdConn interface {
+	net.Conn
+	syscall.Conn
+	ReadMsgUnix(b, oob []byte) (n, oobn, flags int, addr *net.UnixAddr, err error)
+}
+
+// A ConnOption configures optional behavior of a Conn.
+type ConnOption func(*Conn)
+
+// WithMaxPendingFDs limits the number of received descriptors which may await
+// attachment to an imsg. Descriptors received beyond this limit are closed
+// immediately and ErrTooManyFDs is returned from Recv.
+func WithMaxPendingFDs(n int) ConnOption {
+	return func(c *Conn) {
+		c.maxPendingFDs = n
+	}
+}
+
+// WithoutFDAutoClose prevents a Conn from closing received descriptors which
+// haven't been attached to an imsg when the Conn is closed. This is intended
+// for callers which take ownership of those descriptors out-of-band by way of
+// TakePendingFDs.
+func WithoutFDAutoClose() ConnOption {
+	return func(c *Conn) {
+		c.keepFDs = true
+	}
+}
+
+// WithLinger sets how long Close may spend writing imsgs which remain queued,
+// such as those left behind by an interrupted SendContext, before closing the
+// underlying socket. It defaults to DefaultLinger. A linger of zero or less
+// discards queued imsgs immediately. A Conn closed because of what its peer
+// sent, by a QuotaFunc or WithCloseOnDisallowedType, doesn't linger.
+func WithLinger(d time.Duration) ConnOption {
+	return func(c *Conn) {
+		c.linger = d
+	}
+}
+
+// WithVerifyPID causes Recv to compare the PID in the header of each received
+// imsg against the PID reported by PeerCred, returning ErrPIDMismatch when they
+// differ. Since many applications leave the PID unset, imsgs with a PID of zero
+// are exempt unless WithVerifyZeroPID is also provided.
+func WithVerifyPID() ConnOption {
+	return func(c *Conn) {
+		c.verifyPID = true
+	}
+}
+
+// WithVerifyZeroPID behaves like WithVerifyPID, but doesn't exempt imsgs with a
+// PID of zero from verification.
+func WithVerifyZeroPID() ConnOption {
+	return func(c *Conn) {
+		c.verifyPID = true
+		c.verifyZeroPID = true
+	}
+}
+
+// WithStrictFlags causes Recv to refuse imsgs with unknown flags set in their
+// header, returning ErrUnknownFlags. The imsg is consumed, with its attached
+// descriptor closed, so subsequent imsgs may still be received. The has-fd flag
+// is always known, and FlagCompressed is known while decompression is enabled.
+// By default, unknown flags are preserved and otherwise ignored.
+func WithStrictFlags() ConnOption {
+	return func(c *Conn) {
+		c.strictFlags = true
+	}
+}
+
+// WithByteOrder sets the byte order of imsg headers on the wire, which defaults
+// to the system's, as in the C implementation. Peers on hosts which may differ
+// in endianness, such as those connected over TCP, must agree on a fixed order.
+func WithByteOrder(order binary.ByteOrder) ConnOption {
+	return func(c *Conn) {
+		c.order = order
+	}
+}
+
+// NewConn constructs a Conn which sends and receives imsgs over the provided
+// connection, typically a unix domain socket. Any net.Conn may be used, such as
+// a TCP connection or a *tls.Conn, in which case descriptors can't be passed;
+// see NewStreamConn.
+func NewConn(conn net.Conn, opts ...ConnOption) *Conn {
+	return NewStreamConn(conn, opts...)
+}
+
+// NewStreamConn constructs a Conn which sends and receives imsgs over any
+// reliable byte stream, such as a named pipe or one end of a net.Pipe. Every
+// feature of a Conn besides descriptor passing is available. Descriptors can
+// only be passed, and the peer's credentials looked up, when the stream is a
+// unix domain socket, such as a *net.UnixConn, rather than another layer over
+// one; otherwise imsgs with attached files are refused with
+// ErrFDPassUnsupported, and PeerCred returns ErrUnsupported.
+//
+// Features which depend on deadlines degrade when the stream doesn't support
+// them, as a net.Conn does: SetReadDeadline, SetWriteDeadline, and
+// RecvTimeout return ErrUnsupported, and a done context stops Serve, Call, and
+// SendContext only once a blocked read or write returns of its own accord.
+// Over a *tls.Conn, whose stream is left unusable by a write which times out,
+// a done context likewise never interrupts a write in progress, though reads
+// are interrupted as usual.
+func NewStreamConn(rw io.ReadWriteCloser, opts ...ConnOption) *Conn {
+	c := &Conn{
+		conn:          rw,
+		rsem:          make(chan struct{}, 1),
+		wq:            NewMsgBuf(rw),
+		maxPendingFDs: DefaultMaxPendingFDs,
+		linger:        DefaultLinger,
+		order:         endianness,
+		codec:         GobCodec{},
+		corr:          peerIDCorrelation,
+		metrics:       NopMetricsHook{},
+	}
+
+	c.uc, _ = rw.(fdConn)
+	c.maxSize.Store(MaxSizeInBytes)
+	c.compressAbove.Store(-1)
+
+	for _, opt := range opts {
+		opt(c)
+	}
+	c.wq.order = c.order
+
+	if c.ka != nil {
+		c.startKeepalive()
+	}
+	if c.idle != nil && c.idle.d > 0 {
+		c.startIdleTimer()
+	}
+	if c.stall != nil && c.stall.d > 0 {
+		c.startStallTimer()
+	}
+	if c.debugEnabled() {
+		c.logDebug("imsg connection opened")
+	}
+
+	return c
+}
+
+// SetMaxSize sets the maximum size in bytes of an imsg which may be sent or
+// received, which defaults to MaxSizeInBytes. Peers which agree on a larger
+// maximum may exchange imsgs of up to 65535 bytes. Sizes smaller than
+// HeaderSizeInBytes are rejected. This is the equivalent of
+// imsgbuf_set_maxsize.
+func (c *Conn) SetMaxSize(n uint16) error {
+	err := c.wq.SetMaxSize(n)
+	if err != nil {
+		return err
+	}
+
+	c.maxSize.Store(uint32(n))
+
+	return nil
+}
+
+// AllowFDPass controls whether descriptors may be passed over the Conn, which
+// is disallowed by default. While disallowed, imsgs with attached files are
+// refused by Send, and any descriptors passed by the peer are closed as soon as
+// they arrive, with ErrUnexpectedFD returned from Recv. This is the equivalent
+// of imsgbuf_allow_fdpass.
+func (c *Conn) AllowFDPass(allow bool) {
+	c.allowFDPass.Store(allow)
+}
+
+// Send writes an imsg to the underlying socket. If a file is attached to the
+// imsg, its descriptor is passed alongside the imsg and the has-fd flag is set
+// in the transmitted header. Ownership of an attached file passes to the Conn,
+// which closes it once it has been transmitted. An imsg with the has-fd flag
+// set but no file attached is refused with ErrNoAttachment, and an imsg with a
+// file attached is refused with ErrFDPassDisabled unless descriptor passing has
+// been allowed with AllowFDPass.
+func (c *Conn) Send(im *IMsg) error {
+	return c.SendContext(context.Background(), im)
+}
+
+// SendContext behaves like Send, except that if the context is done while
+// waiting for the send limiter or for room in the send queue, the context's
+// error is returned and nothing is sent. If the context is done once the imsg
+// has been queued, the context's error is likewise returned, but the imsg
+// remains queued and is written by a subsequent Send or Flush. Either way, an
+// imsg is queued whole or not at all, including while imsgs are being
+// coalesced, so the stream remains intact.
+func (c *Conn) SendContext(ctx context.Context, im *IMsg) error {
+	return c.send(ctx, im, false)
+}
+
+// send behaves like SendContext, unless verbatim is set, in which case the
+// imsg is neither compressed nor stamped with the default PeerID.
+func (c *Conn) send(ctx context.Context, im *IMsg, verbatim bool) error {
+	if err := c.failure(); err != nil {
+		return err
+	}
+	if im.file != nil && c.uc == nil {
+		return &ErrFDPassUnsupported{im.Type}
+	}
+	if im.file != nil && !c.allowFDPass.Load() {
+		return &ErrFDPassDisabled{im.Type}
+	}
+
+	if !verbatim {
+		im = c.stampPeerID(im)
+		im = compressIMsg(im, int(c.compressAbove.Load()))
+	}
+	err := im.ValidateMax(uint16(c.maxSize.Load()))
+	if err != nil {
+		return err
+	}
+
+	err = c.wait(ctx, im.Len())
+	if err != nil {
+		return err
+	}
+
+	hasFD := im.HasFD()
+
+	// Unless imsgs are being coalesced, the imsg's data is written directly
+	// from im.Data alongside the header, and is only copied if it's left
+	// queued.
+	coalesce := c.coalescing()
+	err = c.wq.enqueue(ctx, im, !coalesce)
+	if err != nil {
+		return err
+	}
+
+	if coalesce {
+		err = c.flushQueued()
+	} else {
+		_, err = c.wq.flushBorrowed(ctx)
+	}
+	if serr := c.stallErr(); err != nil && serr != nil {
+		err = serr
+	}
+	err = c.failOnWrite(err)
+	c.sent(im, hasFD, err)
+
+	return err
+}
+
+// Flush writes any imsgs left queued, whether by an earlier send which was
+// interrupted, such as by the context passed to SendContext, or because sent
+// imsgs are being coalesced. It returns once everything queued has been
+// written.
+func (c *Conn) Flush() error {
+	if err := c.failure(); err != nil {
+		return err
+	}
+	err := c.takeFlushError()
+	if err == nil {
+		_, err = c.wq.Flush()
+	}
+
+	return c.failOnWrite(err)
+}
+
+// FlushContext behaves like Flush, except that it stops once the context is
+// done and returns the context's error. Anything left unwritten, including the
+// rest of a partially written imsg, remains queued, so the stream stays intact
+// for a subsequent Flush.
+func (c *Conn) FlushContext(ctx context.Context) error {
+	if err := c.failure(); err != nil {
+		return err
+	}
+	_, err := c.wq.FlushContext(ctx)
+
+	return c.failOnWrite(err)
+}
+
+// FlushDeadline behaves like FlushContext with a context which expires at the
+// provided time.
+func (c *Conn) FlushDeadline(t time.Time) error {
+	if err := c.failure(); err != nil {
+		return err
+	}
+	_, err := c.wq.FlushDeadline(t)
+
+	return c.failOnWrite(err)
+}
+
+// sendMarshaled sends an imsg which has already been marshaled into bs. The
+// imsg must not have a file attached.
+func (c *Conn) sendMarshaled(im *IMsg, bs []byte) error {
+	if err := c.failure(); err != nil {
+		return err
+	}
+	err := im.ValidateMax(uint16(c.maxSize.Load()))
+	if err != nil {
+		return err
+	}
+
+	err = c.wait(context.Background(), len(bs))
+	if err != nil {
+		return err
+	}
+
+	if im.PeerID == 0 && !im.explicitPeerID && c.defaultPeerID.Load() != 0 {
+		// Neither the imsg nor bs may be modified, as both may be shared
+		// with other Conns.
+		stamped := *im
+		stamped.PeerID = c.defaultPeerID.Load()
+		im = &stamped
+		bs = append([]byte(nil), bs...)
+		endianness.PutUint32(bs[8:12], im.PeerID)
+	} else if c.order != endianness {
+		// The header is converted in place, but bs may be shared with other
+		// Conns.
+		bs = append([]byte(nil), bs...)
+	}
+	err = c.wq.push(context.Background(), msgBufEntry{bs: bs})
+	if err != nil {
+		return err
+	}
+
+	err = c.flushQueued()
+	err = c.failOnWrite(err)
+	c.sent(im, false, err)
+
+	return err
+}
+
+// Composev sends an imsg of the provided type whose ancillary data is the
+// concatenation of the provided slices, which are copied directly into the
+// outgoing imsg without first being joined. The PID field is filled in as
+// described by WithPIDFunc.
+func (c *Conn) Composev(typ, peerID uint32, data ...[]byte) error {
+	peerID = c.peerIDOr(peerID)
+	if threshold := int(c.compressAbove.Load()); threshold >= 0 && vecLen(data) > threshold {
+		im := &IMsg{Type: typ, PeerID: peerID, PID: c.pid()}
+		for _, bs := range data {
+			im.Data = append(im.Data, bs...)
+		}
+		return c.Send(im)
+	}
+	if err := c.failure(); err != nil {
+		return err
+	}
+
+	err := c.wait(context.Background(), HeaderSizeInBytes+vecLen(data))
+	if err != nil {
+		return err
+	}
+
+	pid := c.pid()
+	err = c.wq.enqueuev(typ, peerID, pid, data)
+	if err != nil {
+		return err
+	}
+
+	err = c.failOnWrite(c.flushQueued())
+	if err == nil {
+		c.markActive(false)
+	}
+	if c.trace != nil || c.debugEnabled() {
+		im := &IMsg{Type: typ, PeerID: peerID, PID: pid}
+		for _, bs := range data {
+			im.Data = append(im.Data, bs...)
+		}
+		c.sent(im, false, err)
+	}
+
+	return err
+}
+
+// SendBatch sends several imsgs, writing them to the socket together with a
+// single writev where possible, which saves both system calls and wakeups of
+// the peer. Every imsg is validated first, so either all of them are queued to
+// be sent or none are, in which case the offending imsg's error is returned
+// wrapped in an ErrBatch. Attached files aren't supported in a batch.
+func (c *Conn) SendBatch(ims ...*IMsg) error {
+	if err := c.failure(); err != nil {
+		return err
+	}
+	maxSize := uint16(c.maxSize.Load())
+
+	// The caller's slice and imsgs are left alone, and stamped or compressed
+	// copies sent in their place.
+	threshold := int(c.compressAbove.Load())
+	if c.defaultPeerID.Load() != 0 || threshold >= 0 {
+		prepared := make([]*IMsg, len(ims))
+		for i, im := range ims {
+			prepared[i] = compressIMsg(c.stampPeerID(im), threshold)
+		}
+		ims = prepared
+	}
+
+	var size int
+	for i, im := range ims {
+		if im.file != nil || im.flags&FlagHasFD != 0 {
+			return &ErrBatch{i, &ErrUnsupported{"descriptor passing in a batch"}}
+		}
+
+		err := im.ValidateMax(maxSize)
+		if err != nil {
+			return &ErrBatch{i, err}
+		}
+		size += im.Len()
+	}
+
+	n := len(ims)
+	if c.limitUnit == LimitBytes {
+		n = size
+	}
+	if c.limiter != nil {
+		err := c.limiter.WaitN(context.Background(), n)
+		if err != nil {
+			return err
+		}
+	}
+
+	// As with SendContext, the imsgs' data is written directly from each
+	// imsg's Data unless the imsgs are being coalesced.
+	coalesce := c.coalescing()
+	es := make([]msgBufEntry, len(ims))
+	for i, im := range ims {
+		if coalesce {
+			es[i].bs = make([]byte, im.Len())
+			copy(es[i].bs[HeaderSizeInBytes:], im.Data)
+		} else {
+			es[i].bs = make([]byte, HeaderSizeInBytes)
+			es[i].data = im.Data
+		}
+		im.putHeader(es[i].bs)
+		if im.wipe {
+			es[i].wipe = true
+			es[i].orig = im.Data
+		}
+	}
+
+	err := c.wq.push(context.Background(), es...)
+	if err != nil {
+		return err
+	}
+
+	if coalesce {
+		err = c.flushQueued()
+	} else {
+		_, err = c.wq.flushBorrowed(context.Background())
+	}
+	err = c.failOnWrite(err)
+	for _, im := range ims {
+		c.sent(im, false, err)
+	}
+
+	return err
+}
+
+// sent reports the outcome of sending an imsg to the trace function and the
+// logger, if any.
+func (c *Conn) sent(im *IMsg, hasFD bool, err error) {
+	if err == nil {
+		if c.ka != nil {
+			c.ka.lastSend.Store(time.Now().UnixNano())
+		}
+		c.markActive(c.isHeartbeat(im))
+		if c.trace != nil {
+			c.trace(Outbound, im, im.Len())
+		}
+		if c.debugEnabled() {
+			c.logIMsg("imsg sent", im, hasFD)
+		}
+		return
+	}
+
+	if (err == ErrWouldBlock || err == io.ErrShortWrite) && c.debugEnabled() {
+		c.logDebug(
+			"imsg send stalled",
+			slog.Int(logKeyPending, c.wq.PendingBytes()),
+			slog.Any(logKeyErr, err),
+		)
+	}
+}
+
+// Recv reads the next imsg from the underlying socket, blocking until a
+// complete imsg is available. If the imsg was sent with a descriptor attached,
+// the descriptor is available via the File method of the returned IMsg. An imsg
+// with the has-fd flag set which arrives without a descriptor is consumed and
+// ErrMissingFD is returned. An imsg which fails verification is likewise
+// consumed, with its attached descriptor closed, as is an imsg refused by the
+// function set with SetRecvFilter. Replies awaited by Call are delivered to the
+// caller of Call rather than being returned.
+//
+// Concurrent calls to Recv are serialized, so each caller receives whole imsgs
+// and no imsg is received twice, but which caller receives a given imsg is
+// unspecified.
+func (c *Conn) Recv() (*IMsg, error) {
+	c.rsem <- struct{}{}
+	defer func() { <-c.rsem }()
+
+	return c.recvHeld()
+}
+
+// RecvBatch blocks until at least one imsg is available, as Recv does, and
+// returns it along with any further imsgs which can be returned without
+// reading from the underlying socket again, up to max imsgs in all, or without
+// limit if max isn't positive. Since several imsgs often arrive in a single
+// read, this lets handlers amortize their work over a batch. If an error occurs
+// after some imsgs have been received, those imsgs are returned along with the
+// error; the offending imsg, if any, is consumed as it would be by Recv.
+func (c *Conn) RecvBatch(max int) ([]*IMsg, error) {
+	c.rsem <- struct{}{}
+	defer func() { <-c.rsem }()
+
+	im, err := c.recvHeld()
+	if err != nil {
+		return nil, err
+	}
+
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	ims := []*IMsg{im}
+	for max <= 0 || len(ims) < max {
+		if im := c.popBacklog(); im != nil {
+			ims = append(ims, im)
+			continue
+		}
+
+		im, err := c.recvBuffered(false)
+		if err == errRecvDelayed {
+			break
+		}
+		if err != nil {
+			return ims, err
+		}
+		if im == nil {
+			break
+		}
+		if !c.deliver(im) {
+			ims = append(ims, im)
+		}
+	}
+
+	return ims, nil
+}
+
+// recvHeld behaves like Recv. The caller must hold rsem.
+func (c *Conn) recvHeld() (*IMsg, error) {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	if err := c.failure(); err != nil {
+		return nil, err
+	}
+
+	if im := c.popBacklog(); im != nil {
+		return im, nil
+	}
+
+	for {
+		im, err := c.recv()
+		if err != nil {
+			return nil, err
+		}
+		if !c.deliver(im) {
+			return im, nil
+		}
+	}
+}
+
+// recv reads the next imsg from the underlying socket, blocking until a
+// complete imsg is available. The caller must hold rmu.
+func (c *Conn) recv() (*IMsg, error) {
+	if err := c.failure(); err != nil {
+		return nil, err
+	}
+
+	for {
+		im, err := c.recvBuffered(true)
+		if im != nil || err != nil {
+			return im, err
+		}
+
+		err = c.read(true)
+		if err != nil {
+			if err == io.EOF && len(c.rbuf) > 0 {
+				return nil, c.fail(io.ErrUnexpectedEOF)
+			}
+			return nil, c.failOnRead(err)
+		}
+	}
+}
+
+// recvBuffered returns the next imsg which has already been read from the
+// underlying socket, or nil if no complete imsg has been. If the receive rate
+// doesn't yet allow another imsg, recvBuffered waits if wait is set, and
+// otherwise returns errRecvDelayed. The caller must hold rmu.
+func (c *Conn) recvBuffered(wait bool) (*IMsg, error) {
+	for {
+		err := c.awaitRecvRate(wait)
+		if err != nil {
+			return nil, err
+		}
+		im, err := c.get()
+		if im == nil || err != nil {
+			return nil, err
+		}
+
+		err = c.checkRecvRate(im)
+		if err == nil {
+			err = c.chargeMessage(im)
+		}
+		if err == nil {
+			err = c.verify(im)
+		}
+		if limit := int(c.decompressLimit.Load()); err == nil && limit > 0 {
+			err = im.decompress(limit)
+		}
+		if err == nil && c.sizeCheck {
+			err = checkSize(im)
+		}
+		if err != nil {
+			im.closeFile()
+			return nil, err
+		}
+		if c.isHeartbeat(im) {
+			im.closeFile()
+			continue
+		}
+		ok, err := c.applyFilter(im)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			continue
+		}
+
+		if c.trace != nil {
+			c.trace(Inbound, im, im.Len())
+		}
+		if c.debugEnabled() {
+			c.logIMsg("imsg received", im, im.HasFD())
+		}
+		return im, nil
+	}
+}
+
+// interruptOnDone expires the read deadline of the underlying socket when ctx
+// is done, unblocking any pending read. The returned function must be called
+// once the reads are complete; it restores the deadline if it was expired.
+func (c *Conn) interruptOnDone(ctx context.Context) func() {
+	rd, ok := c.conn.(readDeadliner)
+	if !ok || ctx.Done() == nil {
+		return func() {}
+	}
+
+	var interrupted bool
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			// The timeout which results isn't the caller's, and doesn't
+			// fail the Conn even partway through an imsg.
+			c.interrupts.Add(1)
+			interrupted = true
+			rd.SetReadDeadline(time.Unix(1, 0))
+			c.noteReadDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+		if interrupted {
+			// Leave the Conn usable for subsequent reads.
+			rd.SetReadDeadline(time.Time{})
+			c.noteReadDeadline(time.Time{})
+			c.interrupts.Add(-1)
+		}
+	}
+}
+
+// Close closes the underlying socket along with any received descriptors that
+// have not yet been attached to an imsg, unless WithoutFDAutoClose was
+// provided. Imsgs which remain queued are written first, for up to the linger
+// set with WithLinger; any which can't be written in that time are discarded.
+// Calling Close more than once is harmless, and only the first call has any
+// effect.
+func (c *Conn) Close() error {
+	if c.closed.Swap(true) {
+		return nil
+	}
+
+	// The socket is closed first so that a blocked Recv gives up its hold on
+	// the pending descriptors.
+	err := c.shutdown(true)
+
+	c.rmu.Lock()
+	if !c.keepFDs {
+		c.closePendingFDs()
+	}
+	c.chargeBudget(0)
+	c.rmu.Unlock()
+
+	if c.debugEnabled() {
+		c.logDebug("imsg connection closed")
+	}
+
+	return err
+}
+
+// closeHeld behaves like Close, except that imsgs which remain queued are
+// discarded rather than written, since other reads would wait out the linger.
+// The caller must hold rmu.
+func (c *Conn) closeHeld() error {
+	if c.closed.Swap(true) {
+		return nil
+	}
+
+	err := c.shutdown(false)
+	if !c.keepFDs {
+		c.closePendingFDs()
+	}
+	c.chargeBudget(0)
+
+	if c.debugEnabled() {
+		c.logDebug("imsg connection closed")
+	}
+
+	return err
+}
+
+// shutdown stops the background activity of the Conn, writes any imsgs which
+// remain queued for up to the linger if linger is set, and closes the
+// underlying socket.
+func (c *Conn) shutdown(linger bool) error {
+	if l := c.loop.Load(); l != nil {
+		// The loop holds the socket open while polling it.
+		l.wake()
+	}
+	c.stopFlushTimer()
+	c.stopKeepalive()
+	c.stopIdleTimer()
+	c.stopStallTimer()
+	c.stopRecvRate()
+	c.wakeBacklogWaiters()
+
+	// There's no point lingering once writes have stalled, and the write in
+	// progress may only return once the socket is closed.
+	if linger && c.linger > 0 && c.wq.QueueLen() > 0 && c.stallErr() == nil {
+		c.setState(StateDraining, nil)
+
+		// The write deadline also bounds a write already in progress, which
+		// the flush's context can't interrupt over a *tls.Conn.
+		deadline := time.Now().Add(c.linger)
+		if wd, ok := c.conn.(writeDeadliner); ok {
+			wd.SetWriteDeadline(deadline)
+		}
+		c.wq.FlushDeadline(deadline)
+	}
+	stalled := c.wq.QueueLen() > 0 || c.keepaliveErr() != nil || c.idleErr() != nil || c.stallErr() != nil
+	c.wq.Clear()
+
+	// Closing a layered connection such as a *tls.Conn writes a closure alert,
+	// which would block if the peer has stopped reading, so the connection
+	// beneath it is closed instead.
+	conn := c.conn
+	if nc, ok := conn.(interface{ NetConn() net.Conn }); ok && stalled {
+		conn = nc.NetConn()
+	}
+	err := conn.Close()
+	c.setState(StateClosed, nil)
+
+	return err
+}
+
+// CloseWrite writes any imsgs which remain queued and then shuts down the
+// writing side of the underlying socket, so that the peer sees EOF once it has
+// received everything sent. Imsgs may still be received until the peer closes
+// its end. If the underlying connection can't be shut down for writing alone,
+// ErrUnsupported is returned.
+func (c *Conn) CloseWrite() error {
+	err := c.Flush()
+	if err != nil {
+		return err
+	}
+
+	if c.debugEnabled() {
+		c.logDebug("imsg connection closed for writing")
+	}
+
+	cw, ok := c.conn.(interface{ CloseWrite() error })
+	if !ok {
+		return &ErrUnsupported{"closing for writing"}
+	}
+	err = cw.CloseWrite()
+	if err == nil {
+		c.setState(StateDraining, nil)
+	}
+
+	return err
+}
+
+// SyscallConn returns a raw network connection to the underlying socket, which
+// allows the Conn to be integrated into an external poll loop: the loop waits
+// for the descriptor, obtained with the RawConn's Control method, to become
+// readable, and then receives from the Conn with TryRecv. The descriptor must
+// not be read from, written to, or closed directly, as doing so would corrupt
+// the stream. If the underlying connection doesn't expose its descriptor,
+// ErrUnsupported is returned.
+func (c *Conn) SyscallConn() (syscall.RawConn, error) {
+	sc, ok := c.conn.(syscall.Conn)
+	if !ok {
+		return nil, &ErrUnsupported{"raw access to the connection"}
+	}
+
+	return sc.SyscallConn()
+}
+
+// TryRecv returns the next imsg without blocking. An imsg which has already
+// been buffered is returned straight away; otherwise a single non-blocking read
+// is made from the underlying socket, and the imsg is returned if that
+// completes one. If no complete imsg is available, or another call to Recv is
+// in progress, TryRecv returns a nil imsg and a nil error. Errors, including
+// io.EOF once the peer has closed the connection, are returned as by Recv, and
+// the received imsg is processed as it would be by Recv.
+//
+// TryRecv is intended for use with SyscallConn in an external poll loop, which
+// calls it repeatedly once the descriptor is readable until it returns nil. If
+// the underlying connection isn't a unix domain socket, TryRecv returns only
+// imsgs which have already been buffered, and ErrUnsupported otherwise.
+func (c *Conn) TryRecv() (*IMsg, error) {
+	select {
+	case c.rsem <- struct{}{}:
+	default:
+		return nil, nil
+	}
+	defer func() { <-c.rsem }()
+
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	if im := c.popBacklog(); im != nil {
+		return im, nil
+	}
+
+	read := false
+	for {
+		im, err := c.recvBuffered(false)
+		if err == errRecvDelayed {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if im != nil {
+			if c.deliver(im) {
+				continue
+			}
+			return im, nil
+		}
+		if read {
+			return nil, nil
+		}
+
+		err = c.read(false)
+		if err == ErrWouldBlock {
+			return nil, nil
+		}
+		read = true
+		if err != nil {
+			if err == io.EOF && len(c.rbuf) > 0 {
+				return nil, c.fail(io.ErrUnexpectedEOF)
+			}
+			return nil, c.failOnRead(err)
+		}
+	}
+}
+
+// TakePendingFDs removes and returns all received descriptors which have not
+// yet been attached to an imsg. The caller becomes responsible for closing
+// them.
+func (c *Conn) TakePendingFDs() []*os.File {
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	fds := c.fds
+	c.fds = nil
+
+	return fds
+}
+
+// closePendingFDs closes all received descriptors which have not yet been
+// attached to an imsg.
+func (c *Conn) closePendingFDs() {
+	for _, f := range c.fds {
+		f.Close()
+	}
+	c.fds = nil
+}
+
+// verify checks a received imsg against the verification options configured
+// on the Conn.
+func (c *Conn) verify(im *IMsg) error {
+	if c.strictFlags {
+		known := FlagHasFD
+		if c.decompressLimit.Load() > 0 {
+			known |= FlagCompressed
+		}
+		err := checkFlags(im.flags, known)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !c.verifyPID || (im.PID == 0 && !c.verifyZeroPID) {
+		return nil
+	}
+
+	cred, err := c.PeerCred()
+	if err != nil {
+		return err
+	}
+	if cred.PID == 0 {
+		return &ErrUnsupported{"peer PID verification"}
+	}
+	if cred.PID != im.PID {
+		return &ErrPIDMismatch{im.PID, cred.PID}
+	}
+
+	return nil
+}
+
+// get extracts the next complete imsg from the read buffer. If no complete
+// imsg has been buffered, a nil IMsg and nil error are returned.
+func (c *Conn) get() (*IMsg, error) {
+	maxSize := uint16(c.maxSize.Load())
+	n, err := frameLength(c.rbuf, maxSize, c.order)
+	if err != nil {
+		c.recvd.decodeErrors.Add(1)
+		c.metrics.OnError("decode", err)
+		if c.traceErr != nil {
+			c.traceErr(c.rbuf[:HeaderSizeInBytes], err)
+		}
+		if c.debugEnabled() {
+			c.logDebug("imsg decode failed", slog.Any(logKeyErr, err))
+		}
+		// The stream position is lost, so no pending descriptor can be matched
+		// to an imsg anymore.
+		c.closePendingFDs()
+		return nil, c.fail(err)
+	}
+	if n == 0 {
+		return nil, nil
+	}
+
+	if c.order != endianness {
+		swapHeader(c.rbuf)
+	}
+	err = c.discardDisallowed(n)
+	if err != nil {
+		return nil, err
+	}
+	im := &IMsg{}
+	err = im.unmarshalBinary(c.rbuf[:n], maxSize)
+	if err != nil {
+		c.recvd.decodeErrors.Add(1)
+		c.metrics.OnError("decode", err)
+		return nil, c.fail(err)
+	}
+	if c.passCreds {
+		im.creds = c.credsAt()
+	}
+	c.rbuf = c.rbuf[n:]
+	c.rpos += int64(n)
+	c.chargeBudget(len(c.rbuf))
+	c.recvd.messages.Add(1)
+	c.metrics.OnRecv(im.Type, n)
+	c.markActive(c.isHeartbeat(im))
+
+	// Descriptors are queued in the order they arrive and are attached to imsgs
+	// carrying the has-fd flag in that same order, as in the C implementation.
+	if im.flags&FlagHasFD != 0 {
+		if len(c.fds) == 0 {
+			return nil, &ErrMissingFD{im.Type}
+		}
+		im.file = c.fds[0]
+		c.fds = c.fds[1:]
+	}
+
+	return im, nil
+}
+
+// read performs a single read from the underlying socket, appending data to
+// the read buffer and queueing any received descriptors. Unless wait is set,
+// the read doesn't block, and ErrWouldBlock is returned if nothing can be read
+// right away.
+func (c *Conn) read(wait bool) error {
+	if c.rtmp == nil {
+		if c.packet {
+			c.rtmp = make([]byte, packetBufSizeInBytes)
+		} else {
+			c.rtmp = make([]byte, readBufSizeInBytes)
+		}
+	}
+
+	var (
+		n     int
+		fds   []*os.File
+		creds *Creds
+		err   error
+	)
+	switch {
+	case !wait && c.uc == nil:
+		return &ErrUnsupported{"non-blocking receives"}
+	case !wait:
+		n, fds, creds, err = tryReadWithFDs(c.uc, c.rtmp)
+		if isWouldBlock(err) {
+			return ErrWouldBlock
+		}
+	case c.uc != nil:
+		n, fds, creds, err = readWithFDs(c.uc, c.rtmp)
+	default:
+		n, err = c.conn.Read(c.rtmp)
+	}
+	if c.packet && n > 0 {
+		// Each read returns a single datagram, which is discarded unless it
+		// holds exactly one imsg.
+		if perr := c.checkPacket(c.rtmp[:n]); perr != nil {
+			for _, f := range fds {
+				f.Close()
+			}
+			return perr
+		}
+	}
+	if berr := c.chargeBudget(len(c.rbuf) + n); berr != nil {
+		for _, f := range fds {
+			f.Close()
+		}
+		return c.fail(berr)
+	}
+	c.rbuf = append(c.rbuf, c.rtmp[:n]...)
+	c.markCreds(creds, n)
+	c.recvd.bytes.Add(uint64(n))
+	if c.ka != nil && n > 0 {
+		c.ka.lastRecv.Store(time.Now().UnixNano())
+	}
+	c.recvd.fds.Add(uint64(len(fds)))
+
+	if len(fds) > 0 && !c.allowFDPass.Load() {
+		for _, f := range fds {
+			f.Close()
+		}
+		return &ErrUnexpectedFD{len(fds)}
+	}
+	if err := c.chargeFDs(len(fds)); err != nil {
+		for _, f := range fds {
+			f.Close()
+		}
+		return err
+	}
+
+	var excess []*os.File
+	if room := c.maxPendingFDs - len(c.fds); len(fds) > room {
+		if room < 0 {
+			room = 0
+		}
+		fds, excess = fds[:room], fds[room:]
+	}
+	c.fds = append(c.fds, fds...)
+	for _, f := range excess {
+		f.Close()
+	}
+
+	if err != nil {
+		if err == io.EOF {
+			return err
+		}
+		if kerr := c.keepaliveErr(); kerr != nil {
+			return kerr
+		}
+		if ierr := c.idleErr(); ierr != nil {
+			return ierr
+		}
+		if serr := c.stallErr(); serr != nil {
+			return serr
+		}
+		c.metrics.OnError("read", err)
+		return &ErrRead{"stream", err}
+	}
+	if len(excess) > 0 {
+		return &ErrTooManyFDs{c.maxPendingFDs}
+	}
+	if n == 0 && len(fds) == 0 {
+		return io.EOF
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build !unix
+
+package imsg
+
+import (
+	"errors"
+	"os"
+	"runtime"
+)
+
+// This is returned when attempting to pass a descriptor on a platform without
+// SCM_RIGHTS support.
+var errFDPassUnsupported = errors.New("imsg: descriptor passing is not supported on this platform")
+
+// Descriptors can't be passed on this platform.
+const fdPassing = false
+
+// SocketPair is unsupported on this platform, and returns
+// ErrUnsupportedPlatform.
+func SocketPair(opts ...SocketPairOption) (*Conn, *Conn, error) {
+	return nil, nil, &ErrUnsupportedPlatform{"socketpairs", runtime.GOOS}
+}
+
+// writeWithFD is unsupported on this platform.
+func writeWithFD(conn fdConn, bufs [][]byte, f *os.File, creds, wait bool) (int, error) {
+	return 0, errFDPassUnsupported
+}
+
+// readWithFDs performs a single read from the socket into buf. Descriptors
+// cannot be received on this platform.
+func readWithFDs(conn fdConn, buf []byte) (int, []*os.File, *Creds, error) {
+	n, err := conn.Read(buf)
+	return n, nil, nil, err
+}
+
+// tryReadWithFDs is unsupported on this platform.
+func tryReadWithFDs(conn fdConn, buf []byte) (int, []*os.File, *Creds, error) {
+	return 0, nil, nil, &ErrUnsupported{"non-blocking receives"}
+}
+
+// isWouldBlock reports whether err indicates that an operation on a
+// non-blocking descriptor would have blocked. Non-blocking descriptors aren't
+// supported on this platform.
+func isWouldBlock(err error) bool {
+	return false
+}
+
+// isMessageTooLong reports whether err indicates that a datagram was too large
+// for the socket to send. Datagram sockets aren't supported on this platform.
+func isMessageTooLong(err error) bool {
+	return false
+}
@@ -0,0 +1,242 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"errors"
+	"net"
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// Descriptors can be passed over unix domain sockets on this platform.
+const fdPassing = true
+
+// SocketPair constructs a pair of connected Conns backed by a unix domain
+// socketpair. This is most useful for communicating with a child process, which
+// can inherit one end of the pair. The socketpair is of type SOCK_STREAM unless
+// WithSeqPacket is provided.
+func SocketPair(opts ...SocketPairOption) (*Conn, *Conn, error) {
+	var cfg socketPairConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	typ := unix.SOCK_STREAM
+	if cfg.seqPacket {
+		typ = unix.SOCK_SEQPACKET
+	}
+	fds, err := unix.Socketpair(unix.AF_UNIX, typ, 0)
+	if err != nil {
+		return nil, nil, os.NewSyscallError("socketpair", err)
+	}
+
+	a, err := unixConnFromFD(fds[0], "imsg-socketpair-a")
+	if err != nil {
+		unix.Close(fds[1])
+		return nil, nil, err
+	}
+
+	b, err := unixConnFromFD(fds[1], "imsg-socketpair-b")
+	if err != nil {
+		a.Close()
+		return nil, nil, err
+	}
+
+	if cfg.seqPacket {
+		return NewPacketConn(a), NewPacketConn(b), nil
+	}
+
+	return NewConn(a), NewConn(b), nil
+}
+
+// unixConnFromFD wraps a raw socket descriptor in a *net.UnixConn. The
+// descriptor is consumed regardless of whether an error is returned.
+func unixConnFromFD(fd int, name string) (*net.UnixConn, error) {
+	f := os.NewFile(uintptr(fd), name)
+	defer f.Close()
+
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+
+	return conn.(*net.UnixConn), nil
+}
+
+// writeWithFD writes bufs to the socket in a single sendmsg, passing the
+// descriptor of f, if not nil, in an SCM_RIGHTS control message alongside the
+// first byte written, and the process's credentials in an SCM_CREDENTIALS
+// control message if creds is set. The number of bytes written is returned,
+// which may be less than the combined length of bufs. Unless wait is set, the
+// write is attempted only once, and if the socket can't accept anything, the
+// returned error satisfies isWouldBlock.
+func writeWithFD(conn fdConn, bufs [][]byte, f *os.File, creds, wait bool) (int, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	var oob []byte
+	if f != nil {
+		oob = unix.UnixRights(int(f.Fd()))
+	}
+	if creds {
+		oob = append(oob, credsMessage()...)
+	}
+
+	var (
+		n    int
+		serr error
+	)
+	err = rc.Write(func(fd uintptr) bool {
+		n, serr = unix.SendmsgBuffers(int(fd), bufs, oob, nil, 0)
+		return !wait || serr != unix.EAGAIN
+	})
+	runtime.KeepAlive(f)
+	if n < 0 {
+		n = 0
+	}
+	if err == nil && serr != nil {
+		err = &net.OpError{
+			Op:     "write",
+			Net:    "unix",
+			Source: conn.LocalAddr(),
+			Addr:   conn.RemoteAddr(),
+			Err:    os.NewSyscallError("sendmsg", serr),
+		}
+	}
+
+	return n, err
+}
+
+// readWithFDs performs a single read from the socket into buf, returning the
+// number of bytes read along with any descriptors received via SCM_RIGHTS and
+// any credentials received via SCM_CREDENTIALS.
+func readWithFDs(conn fdConn, buf []byte) (int, []*os.File, *Creds, error) {
+	oob := make([]byte, unix.CmsgSpace(maxFDsPerRead*4)+credsSpace)
+
+	n, oobn, flags, _, err := conn.ReadMsgUnix(buf, oob)
+	if n < 0 {
+		// Some failures, such as an expired deadline, report a negative count.
+		n = 0
+	}
+
+	return receivedControl(n, oob[:oobn], flags, err)
+}
+
+// tryReadWithFDs behaves like readWithFDs, except that it never waits for the
+// socket to become readable. If nothing can be read right away, the returned
+// error satisfies isWouldBlock.
+func tryReadWithFDs(conn fdConn, buf []byte) (int, []*os.File, *Creds, error) {
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	oob := make([]byte, unix.CmsgSpace(maxFDsPerRead*4)+credsSpace)
+
+	var (
+		n, oobn, flags int
+		serr           error
+	)
+	err = rc.Read(func(fd uintptr) bool {
+		n, oobn, flags, _, serr = unix.Recvmsg(int(fd), buf, oob, recvmsgFlags)
+		return serr != unix.EINTR
+	})
+	if n < 0 {
+		n = 0
+	}
+	if err == nil && serr != nil {
+		err = &net.OpError{
+			Op:     "read",
+			Net:    "unix",
+			Source: conn.LocalAddr(),
+			Addr:   conn.RemoteAddr(),
+			Err:    os.NewSyscallError("recvmsg", serr),
+		}
+	}
+
+	return receivedControl(n, oob[:oobn], flags, err)
+}
+
+// receivedControl returns the result of a read of n bytes which received the
+// control data oob with the provided recvmsg flags and failed with err, if at
+// all. If the control data can't be used, any descriptors it holds are closed
+// and the reason is returned instead of err.
+func receivedControl(n int, oob []byte, flags int, err error) (int, []*os.File, *Creds, error) {
+	if len(oob) == 0 && flags&unix.MSG_CTRUNC == 0 {
+		return n, nil, nil, err
+	}
+
+	files, creds, perr := parseControl(oob)
+	if perr == nil && flags&unix.MSG_CTRUNC != 0 {
+		// The descriptors which didn't fit were closed by the kernel, so those
+		// which did can no longer be matched to the imsgs they accompany.
+		perr = &ErrControlTruncated{len(files)}
+	}
+	if perr != nil {
+		for _, f := range files {
+			f.Close()
+		}
+		return n, nil, nil, perr
+	}
+
+	return n, files, creds, err
+}
+
+// parseControl extracts the descriptors from SCM_RIGHTS control messages,
+// marking each close-on-exec, along with the credentials from any
+// SCM_CREDENTIALS control message. If a control message is malformed, the
+// descriptors extracted from those before it are closed.
+func parseControl(oob []byte) ([]*os.File, *Creds, error) {
+	var (
+		files []*os.File
+		creds *Creds
+	)
+	for len(oob) >= unix.CmsgLen(0) {
+		hdr, data, rest, err := unix.ParseOneSocketControlMessage(oob)
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, nil, err
+		}
+		oob = rest
+
+		if c := parseCreds(hdr.Level, hdr.Type, data); c != nil {
+			creds = c
+			continue
+		}
+		fds, err := unix.ParseUnixRights(&unix.SocketControlMessage{Header: hdr, Data: data})
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			// Where recvmsgFlags can't ask for this atomically, a process
+			// forked meanwhile may still inherit the descriptor.
+			unix.CloseOnExec(fd)
+			files = append(files, os.NewFile(uintptr(fd), "imsg-fd"))
+		}
+	}
+
+	return files, creds, nil
+}
+
+// isWouldBlock reports whether err indicates that an operation on a
+// non-blocking descriptor would have blocked.
+func isWouldBlock(err error) bool {
+	return errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EWOULDBLOCK)
+}
+
+// isMessageTooLong reports whether err indicates that a datagram was too large
+// for the socket to send.
+func isMessageTooLong(err error) bool {
+	return errors.Is(err, unix.EMSGSIZE)
+}
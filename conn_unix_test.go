@@ -0,0 +1,1327 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// newTestSocketPair constructs a pair of connected Conns which are closed when
+// the test completes.
+func newTestSocketPair(t *testing.T) (*Conn, *Conn) {
+	t.Helper()
+
+	a, b, err := SocketPair()
+	if err != nil {
+		t.Fatalf("failed to create socketpair: %s", err)
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	return a, b
+}
+
+// rewrapTestConn constructs a Conn with the provided options over the socket of
+// c, which is closed when the test completes.
+func rewrapTestConn(t *testing.T, c *Conn, opts ...ConnOption) *Conn {
+	t.Helper()
+
+	c = NewConn(c.uc, opts...)
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+func TestConnSendRecv(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	for i := 0; i < 3; i++ {
+		im, err := ComposeIMsg(uint32(i), 0xee, []byte("test"))
+		if err != nil {
+			t.Fatalf("failed to compose imsg: %s", err)
+		}
+
+		err = a.Send(im)
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		im, err := b.Recv()
+		if err != nil {
+			t.Fatalf("unexpected Recv failure: %s", err)
+		}
+
+		if im.Type != uint32(i) || im.PeerID != 0xee || !bytes.Equal(im.Data, []byte("test")) {
+			t.Fatalf("received imsg does not match sent imsg (%#v)", im)
+		}
+		if im.File() != nil {
+			t.Fatalf("received imsg unexpectedly has a file attached")
+		}
+	}
+
+	a.Close()
+	_, err := b.Recv()
+	if err != io.EOF {
+		t.Fatalf("expected EOF after peer closed, got: %v", err)
+	}
+}
+
+func TestConnComposev(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	err := a.Composev(1, 0xee, []byte("te"), nil, []byte("st"))
+	if err != nil {
+		t.Fatalf("unexpected Composev failure: %s", err)
+	}
+
+	im, err := b.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	if im.Type != 1 || im.PeerID != 0xee || im.PID != uint32(os.Getpid()) || !bytes.Equal(im.Data, []byte("test")) {
+		t.Fatalf("received imsg does not match sent imsg (%#v)", im)
+	}
+}
+
+func TestConnSendRecvFile(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	a.AllowFDPass(true)
+	b.AllowFDPass(true)
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %s", err)
+	}
+	defer pr.Close()
+
+	// Send a plain imsg ahead of the one carrying a descriptor to ensure the
+	// descriptor is attached to the correct imsg.
+	im, _ := ComposeIMsg(1, 0, nil)
+	err = a.Send(im)
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+
+	im, err = ComposeIMsgWithFile(2, 0, []byte("pipe"), pw)
+	if err != nil {
+		t.Fatalf("failed to compose imsg: %s", err)
+	}
+	err = a.Send(im)
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	if im.File() != nil {
+		t.Fatalf("sent imsg still has a file attached")
+	}
+
+	im, err = b.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	if im.Type != 1 || im.File() != nil {
+		t.Fatalf("descriptor attached to the wrong imsg (%#v)", im)
+	}
+
+	im, err = b.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	if im.Type != 2 || im.File() == nil {
+		t.Fatalf("received imsg is missing its descriptor (%#v)", im)
+	}
+	if im.flags&FlagHasFD == 0 {
+		t.Fatalf("received imsg does not have the has-fd flag set")
+	}
+
+	_, err = im.File().Write([]byte("hello"))
+	if err != nil {
+		t.Fatalf("failed to write through received descriptor: %s", err)
+	}
+	im.File().Close()
+
+	bs, err := io.ReadAll(pr)
+	if err != nil {
+		t.Fatalf("failed to read from pipe: %s", err)
+	}
+	if string(bs) != "hello" {
+		t.Fatalf("unexpected data read from pipe (%q)", bs)
+	}
+}
+
+func TestConnRecvFileSplitAcrossReads(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("failed to create socketpair: %s", err)
+	}
+	defer unix.Close(fds[0])
+
+	conn, err := unixConnFromFD(fds[1], "test")
+	if err != nil {
+		t.Fatalf("failed to wrap socket: %s", err)
+	}
+	c := NewConn(conn)
+	c.AllowFDPass(true)
+	defer c.Close()
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %s", err)
+	}
+	defer pr.Close()
+	defer pw.Close()
+
+	bs, err := IMsg{Type: 3, Data: []byte("split"), flags: FlagHasFD}.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to marshal imsg: %s", err)
+	}
+
+	// Deliver the descriptor with the first few header bytes, followed by the
+	// rest of the frame in a separate write.
+	err = unix.Sendmsg(fds[0], bs[:4], unix.UnixRights(int(pw.Fd())), nil, 0)
+	if err != nil {
+		t.Fatalf("failed to send partial frame: %s", err)
+	}
+	_, err = unix.Write(fds[0], bs[4:])
+	if err != nil {
+		t.Fatalf("failed to send remaining frame: %s", err)
+	}
+
+	im, err := c.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	if im.File() == nil {
+		t.Fatalf("received imsg is missing its descriptor")
+	}
+	defer im.File().Close()
+	if !bytes.Equal(im.Data, []byte("split")) {
+		t.Fatalf("unexpected data received (%q)", im.Data)
+	}
+}
+
+func TestConnSendFlagWithoutFile(t *testing.T) {
+	a, _ := newTestSocketPair(t)
+
+	var ena *ErrNoAttachment
+	err := a.Send(&IMsg{Type: 4, flags: FlagHasFD})
+	if !errors.As(err, &ena) {
+		t.Fatalf("expected ErrNoAttachment, got: %v", err)
+	}
+	if ena.Type != 4 {
+		t.Fatalf("error reports unexpected type (%d)", ena.Type)
+	}
+}
+
+func TestConnRecvFlagWithoutFD(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("failed to create socketpair: %s", err)
+	}
+	defer unix.Close(fds[0])
+
+	conn, err := unixConnFromFD(fds[1], "test")
+	if err != nil {
+		t.Fatalf("failed to wrap socket: %s", err)
+	}
+	c := NewConn(conn)
+	defer c.Close()
+
+	// Write a frame claiming to carry a descriptor without actually passing
+	// one, followed by a well-formed frame.
+	bad, _ := IMsg{Type: 5, flags: FlagHasFD}.MarshalBinary()
+	good, _ := IMsg{Type: 6}.MarshalBinary()
+	_, err = unix.Write(fds[0], append(bad, good...))
+	if err != nil {
+		t.Fatalf("failed to write frames: %s", err)
+	}
+
+	var emf *ErrMissingFD
+	_, err = c.Recv()
+	if !errors.As(err, &emf) {
+		t.Fatalf("expected ErrMissingFD, got: %v", err)
+	}
+	if emf.Type != 5 {
+		t.Fatalf("error reports unexpected type (%d)", emf.Type)
+	}
+
+	im, err := c.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	if im.Type != 6 {
+		t.Fatalf("received unexpected imsg (%#v)", im)
+	}
+}
+
+// countOpenFDs returns the number of descriptors currently open in the test
+// process.
+func countOpenFDs(t *testing.T) int {
+	t.Helper()
+
+	entries, err := os.ReadDir("/dev/fd")
+	if err != nil {
+		t.Skipf("unable to count open descriptors: %s", err)
+	}
+
+	return len(entries)
+}
+
+// newRawTestConn constructs a Conn which allows descriptor passing, along with
+// the raw descriptor of its peer, allowing tests to write arbitrary data and
+// control messages. Both are closed when the test completes.
+func newRawTestConn(t *testing.T, opts ...ConnOption) (*Conn, int) {
+	t.Helper()
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("failed to create socketpair: %s", err)
+	}
+	t.Cleanup(func() { unix.Close(fds[0]) })
+
+	conn, err := unixConnFromFD(fds[1], "test")
+	if err != nil {
+		t.Fatalf("failed to wrap socket: %s", err)
+	}
+
+	c := NewConn(conn, opts...)
+	c.AllowFDPass(true)
+	t.Cleanup(func() { c.Close() })
+
+	return c, fds[0]
+}
+
+// sendRawFDs writes a frame for im to the raw descriptor, passing n fresh
+// descriptors alongside it.
+func sendRawFDs(t *testing.T, fd int, im IMsg, n int) {
+	t.Helper()
+
+	var rights []int
+	for i := 0; i < n; i++ {
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			t.Fatalf("failed to open %s: %s", os.DevNull, err)
+		}
+		defer f.Close()
+		rights = append(rights, int(f.Fd()))
+	}
+
+	bs, err := im.MarshalBinary()
+	if err != nil {
+		t.Fatalf("failed to marshal imsg: %s", err)
+	}
+
+	err = unix.Sendmsg(fd, bs, unix.UnixRights(rights...), nil, 0)
+	if err != nil {
+		t.Fatalf("failed to send frame: %s", err)
+	}
+}
+
+func TestConnCloseUnclaimedFDs(t *testing.T) {
+	before := countOpenFDs(t)
+
+	c, fd := newRawTestConn(t)
+
+	// Descriptors passed alongside an imsg without the has-fd flag are never
+	// claimed and remain pending.
+	sendRawFDs(t, fd, IMsg{Type: 1}, 3)
+
+	_, err := c.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+
+	// The test socket accounts for two descriptors, with the three unclaimed
+	// descriptors pending on top of that.
+	if n := countOpenFDs(t); n != before+5 {
+		t.Fatalf("unexpected descriptor count with unclaimed descriptors pending (%d != %d)", n, before+5)
+	}
+
+	c.Close()
+	unix.Close(fd)
+	if n := countOpenFDs(t); n != before {
+		t.Fatalf("unexpected descriptor count after Close (%d != %d)", n, before)
+	}
+}
+
+func TestConnWithoutFDAutoClose(t *testing.T) {
+	c, fd := newRawTestConn(t, WithoutFDAutoClose())
+
+	sendRawFDs(t, fd, IMsg{Type: 1}, 2)
+
+	_, err := c.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	c.Close()
+
+	fds := c.TakePendingFDs()
+	if len(fds) != 2 {
+		t.Fatalf("unexpected number of pending descriptors (%d)", len(fds))
+	}
+	for _, f := range fds {
+		_, err = f.Stat()
+		if err != nil {
+			t.Fatalf("pending descriptor was closed: %s", err)
+		}
+		f.Close()
+	}
+}
+
+func TestConnMaxPendingFDs(t *testing.T) {
+	before := countOpenFDs(t)
+
+	c, fd := newRawTestConn(t, WithMaxPendingFDs(1))
+
+	sendRawFDs(t, fd, IMsg{Type: 1}, 3)
+
+	var etmf *ErrTooManyFDs
+	_, err := c.Recv()
+	if !errors.As(err, &etmf) {
+		t.Fatalf("expected ErrTooManyFDs, got: %v", err)
+	}
+	if n := countOpenFDs(t); n != before+3 {
+		t.Fatalf("excess descriptors were not closed (%d != %d)", n, before+3)
+	}
+
+	// The imsg itself is still delivered.
+	im, err := c.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	if im.Type != 1 {
+		t.Fatalf("received unexpected imsg (%#v)", im)
+	}
+
+	c.Close()
+	unix.Close(fd)
+	if n := countOpenFDs(t); n != before {
+		t.Fatalf("unexpected descriptor count after Close (%d != %d)", n, before)
+	}
+}
+
+func TestConnControlTruncated(t *testing.T) {
+	for _, try := range []bool{false, true} {
+		before := countOpenFDs(t)
+
+		c, fd := newRawTestConn(t)
+
+		// More descriptors than fit in a single read are passed, so the
+		// kernel discards the rest, and those which arrived are closed.
+		sendRawFDs(t, fd, IMsg{Type: 1, flags: FlagHasFD}, 4*maxFDsPerRead)
+
+		var (
+			err error
+			ect *ErrControlTruncated
+		)
+		if try {
+			deadline := time.Now().Add(5 * time.Second)
+			for err == nil && time.Now().Before(deadline) {
+				_, err = c.TryRecv()
+			}
+		} else {
+			_, err = c.Recv()
+		}
+		if !errors.As(err, &ect) {
+			t.Fatalf("expected ErrControlTruncated, got: %v", err)
+		}
+		if n := countOpenFDs(t); n != before+2 {
+			t.Fatalf("received descriptors were not closed (%d != %d)", n, before+2)
+		}
+
+		c.Close()
+		unix.Close(fd)
+	}
+}
+
+func TestConnSetMaxSize(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	var eloob *ErrLengthOutOfBounds
+	err := a.SetMaxSize(HeaderSizeInBytes - 1)
+	if !errors.As(err, &eloob) {
+		t.Fatalf("expected ErrLengthOutOfBounds, got: %v", err)
+	}
+
+	data := bytes.Repeat([]byte{0xaa}, 20000)
+
+	// A default sender refuses the imsg outright.
+	var edtl *ErrDataTooLarge
+	err = a.Send(&IMsg{Type: 1, Data: data})
+	if !errors.As(err, &edtl) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+
+	for _, c := range []*Conn{a, b} {
+		err = c.SetMaxSize(65535)
+		if err != nil {
+			t.Fatalf("unexpected SetMaxSize failure: %s", err)
+		}
+	}
+
+	go a.Send(&IMsg{Type: 1, Data: data})
+	im, err := b.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	if !bytes.Equal(im.Data, data) {
+		t.Fatalf("received imsg does not match sent imsg")
+	}
+
+	// A default receiver rejects it.
+	c, d := newTestSocketPair(t)
+	err = c.SetMaxSize(65535)
+	if err != nil {
+		t.Fatalf("unexpected SetMaxSize failure: %s", err)
+	}
+	go c.Send(&IMsg{Type: 1, Data: data})
+	_, err = d.Recv()
+	if !errors.As(err, &eloob) {
+		t.Fatalf("expected ErrLengthOutOfBounds, got: %v", err)
+	}
+}
+
+func TestConnFDPassDisabled(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %s", err)
+	}
+	defer pr.Close()
+	defer pw.Close()
+
+	// Sending is refused, leaving the attachment with the caller.
+	var efpd *ErrFDPassDisabled
+	im := &IMsg{Type: 1, file: pw}
+	err = a.Send(im)
+	if !errors.As(err, &efpd) {
+		t.Fatalf("expected ErrFDPassDisabled, got: %v", err)
+	}
+	if im.File() != pw {
+		t.Fatalf("refused imsg lost its attachment")
+	}
+
+	// Descriptors arriving at a Conn which hasn't allowed them are closed.
+	before := countOpenFDs(t)
+	a.AllowFDPass(true)
+	err = a.Send(im)
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+
+	var eufd *ErrUnexpectedFD
+	_, err = b.Recv()
+	if !errors.As(err, &eufd) {
+		t.Fatalf("expected ErrUnexpectedFD, got: %v", err)
+	}
+	if eufd.Count != 1 {
+		t.Fatalf("error reports unexpected count (%d)", eufd.Count)
+	}
+
+	// Send closed the sender's copy, and the receiver closed its copy.
+	if n := countOpenFDs(t); n != before-1 {
+		t.Fatalf("unexpected descriptor count (%d != %d)", n, before-1)
+	}
+
+	// The imsg itself arrives without its descriptor.
+	var emf *ErrMissingFD
+	_, err = b.Recv()
+	if !errors.As(err, &emf) {
+		t.Fatalf("expected ErrMissingFD, got: %v", err)
+	}
+}
+
+func TestConnReadErrorWrapping(t *testing.T) {
+	a, _ := newTestSocketPair(t)
+	a.Close()
+
+	_, err := a.Recv()
+	var er *ErrRead
+	if !errors.As(err, &er) || er.Stage != "stream" || !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected wrapped net.ErrClosed, got: %v", err)
+	}
+
+	im, _ := ComposeIMsg(1, 2, nil)
+	err = a.Send(im)
+	var ew *ErrWrite
+	if !errors.As(err, &ew) || !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected wrapped net.ErrClosed, got: %v", err)
+	}
+}
+
+func TestConnSendContextFlush(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	a.SetMaxSize(65535)
+	b.SetMaxSize(65535)
+
+	// Send until the socket buffer fills and a send is interrupted.
+	data := bytes.Repeat([]byte{0xaa}, 65535-HeaderSizeInBytes)
+	var sent int
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		err := a.SendContext(ctx, &IMsg{Type: uint32(sent), Data: data})
+		cancel()
+		sent++
+		if err == context.DeadlineExceeded {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected SendContext failure: %s", err)
+		}
+		if sent == 100 {
+			t.Fatalf("socket buffer never filled")
+		}
+	}
+
+	errc := make(chan error, 1)
+	go func() {
+		for i := 0; i < sent; i++ {
+			im, err := b.Recv()
+			if err != nil {
+				errc <- err
+				return
+			}
+			if im.Type != uint32(i) || !bytes.Equal(im.Data, data) {
+				errc <- errors.New("received imsg was corrupted")
+				return
+			}
+		}
+		errc <- nil
+	}()
+
+	err := a.Flush()
+	if err != nil {
+		t.Fatalf("unexpected Flush failure: %s", err)
+	}
+	err = <-errc
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+}
+
+func TestConnSendContextQueueFull(t *testing.T) {
+	modes := []struct {
+		name string
+		opts []ConnOption
+	}{
+		{"Direct", nil},
+		{"Coalescing", []ConnOption{WithWriteBufferSize(1 << 20), WithFlushInterval(time.Hour)}},
+	}
+
+	for _, mode := range modes {
+		t.Run(mode.name, func(t *testing.T) {
+			a, b := newTestSocketPair(t)
+			a = rewrapTestConn(t, a, append(mode.opts, WithSendQueueLimit(4, 0, QueueBlock))...)
+			a.SetMaxSize(65535)
+			b.SetMaxSize(65535)
+
+			// Send until the queue fills.
+			data := bytes.Repeat([]byte{0xaa}, 65535-HeaderSizeInBytes)
+			var sent int
+			for a.wq.QueueLen() < 4 {
+				ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+				err := a.SendContext(ctx, &IMsg{Type: uint32(sent), Data: data})
+				cancel()
+				if err != nil && err != context.DeadlineExceeded {
+					t.Fatalf("unexpected SendContext failure: %s", err)
+				}
+				sent++
+				if sent == 100 {
+					t.Fatalf("send queue never filled")
+				}
+			}
+
+			// A send which blocks waiting for room gives up with the context.
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			err := a.SendContext(ctx, &IMsg{Type: uint32(sent), Data: data})
+			cancel()
+			if err != context.DeadlineExceeded || a.wq.QueueLen() != 4 {
+				t.Fatalf("unexpected SendContext result (%d queued, %v)", a.wq.QueueLen(), err)
+			}
+
+			// The cancelled imsg wasn't queued, and the stream is intact.
+			errc := make(chan error, 1)
+			go func() { errc <- a.Flush() }()
+			for i := 0; i < sent; i++ {
+				im, err := b.Recv()
+				if err != nil || im.Type != uint32(i) || !bytes.Equal(im.Data, data) {
+					t.Fatalf("unexpected Recv result for imsg %d (%v)", i, err)
+				}
+			}
+			err = <-errc
+			if err != nil {
+				t.Fatalf("unexpected Flush failure: %s", err)
+			}
+
+			err = a.Send(&IMsg{Type: 1000})
+			if err == nil {
+				err = a.Flush()
+			}
+			if err != nil {
+				t.Fatalf("unexpected Send failure: %s", err)
+			}
+			im, err := b.Recv()
+			if err != nil || im.Type != 1000 {
+				t.Fatalf("unexpected Recv result after cancellation (%v, %v)", im, err)
+			}
+		})
+	}
+}
+
+func TestConnRecvBatch(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	// Five imsgs arrive in a single write.
+	var stream []byte
+	for i := 0; i < 5; i++ {
+		bs, _ := (&IMsg{Type: uint32(i), Data: []byte("test")}).MarshalBinary()
+		stream = append(stream, bs...)
+	}
+	_, err := a.conn.Write(stream)
+	if err != nil {
+		t.Fatalf("failed to write imsgs: %s", err)
+	}
+
+	ims, err := b.RecvBatch(0)
+	if err != nil || len(ims) != 5 {
+		t.Fatalf("unexpected RecvBatch result (%d imsgs, %v)", len(ims), err)
+	}
+	for i, im := range ims {
+		if im.Type != uint32(i) || string(im.Data) != "test" {
+			t.Fatalf("unexpected imsg %d in batch (%v)", i, im)
+		}
+	}
+
+	// A batch is limited to max imsgs, leaving the rest for the next.
+	_, err = a.conn.Write(stream)
+	if err != nil {
+		t.Fatalf("failed to write imsgs: %s", err)
+	}
+	ims, err = b.RecvBatch(3)
+	if err != nil || len(ims) != 3 || ims[2].Type != 2 {
+		t.Fatalf("unexpected RecvBatch result (%d imsgs, %v)", len(ims), err)
+	}
+	ims, err = b.RecvBatch(3)
+	if err != nil || len(ims) != 2 || ims[0].Type != 3 {
+		t.Fatalf("unexpected RecvBatch result (%d imsgs, %v)", len(ims), err)
+	}
+
+	// An error after some imsgs is returned along with them.
+	bad, _ := (&IMsg{Type: 9}).MarshalBinary()
+	endianness.PutUint16(bad[4:6], 1)
+	_, err = a.conn.Write(append(stream[:2*(HeaderSizeInBytes+4)], bad...))
+	if err != nil {
+		t.Fatalf("failed to write imsgs: %s", err)
+	}
+	ims, err = b.RecvBatch(0)
+	var bounds *ErrLengthOutOfBounds
+	if len(ims) != 2 || !errors.As(err, &bounds) {
+		t.Fatalf("unexpected RecvBatch result (%d imsgs, %v)", len(ims), err)
+	}
+}
+
+func TestConnCloseDrains(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	a.SetMaxSize(65535)
+	b.SetMaxSize(65535)
+
+	// Leave imsgs queued by interrupting a send once the socket buffer fills.
+	data := bytes.Repeat([]byte{0xaa}, 65535-HeaderSizeInBytes)
+	var sent int
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		err := a.SendContext(ctx, &IMsg{Type: uint32(sent), Data: data})
+		cancel()
+		sent++
+		if err == context.DeadlineExceeded {
+			break
+		}
+		if sent == 100 {
+			t.Fatalf("socket buffer never filled")
+		}
+	}
+
+	received := make(chan int, 1)
+	go func() {
+		var n int
+		for {
+			im, err := b.Recv()
+			if err != nil {
+				break
+			}
+			if im.Type != uint32(n) || !bytes.Equal(im.Data, data) {
+				break
+			}
+			n++
+		}
+		received <- n
+	}()
+
+	err := a.Close()
+	if err != nil {
+		t.Fatalf("unexpected Close failure: %s", err)
+	}
+	err = a.Close()
+	if err != nil {
+		t.Fatalf("unexpected failure closing twice: %s", err)
+	}
+
+	n := <-received
+	if n != sent {
+		t.Fatalf("unexpected imsgs received (%d != %d)", n, sent)
+	}
+}
+
+func TestConnCloseWhileReceiving(t *testing.T) {
+	a, _ := newTestSocketPair(t)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := a.Recv()
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	a.Close()
+	select {
+	case err := <-errc:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("expected net.ErrClosed, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Recv was not unblocked by Close")
+	}
+}
+
+func TestConnCloseWrite(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	err := a.Send(&IMsg{Type: 1})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	err = a.CloseWrite()
+	if err != nil {
+		t.Fatalf("unexpected CloseWrite failure: %s", err)
+	}
+
+	im, err := b.Recv()
+	if err != nil || im.Type != 1 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+	_, err = b.Recv()
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF, got: %v", err)
+	}
+
+	// The reading side of the half-closed Conn still works.
+	err = b.Send(&IMsg{Type: 2})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	im, err = a.Recv()
+	if err != nil || im.Type != 2 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+}
+
+func TestConnConcurrentSend(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	const (
+		senders = 50
+		count   = 100
+	)
+
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(sender uint32) {
+			defer wg.Done()
+			for seq := uint32(0); seq < count; seq++ {
+				data := make([]byte, 4+int(seq))
+				endianness.PutUint32(data, seq)
+				err := a.Send(&IMsg{Type: sender, Data: data})
+				if err != nil {
+					t.Errorf("unexpected Send failure: %s", err)
+					return
+				}
+			}
+		}(uint32(i))
+	}
+
+	next := make([]uint32, senders)
+	for i := 0; i < senders*count; i++ {
+		im, err := b.Recv()
+		if err != nil {
+			t.Fatalf("unexpected Recv failure after %d imsgs: %s", i, err)
+		}
+		if im.Type >= senders || len(im.Data) < 4 {
+			t.Fatalf("received corrupted imsg (%v)", im)
+		}
+		seq := endianness.Uint32(im.Data)
+		if seq != next[im.Type] || len(im.Data) != 4+int(seq) {
+			t.Fatalf("imsg from sender %d out of order (%d != %d)", im.Type, seq, next[im.Type])
+		}
+		next[im.Type]++
+	}
+
+	wg.Wait()
+}
+
+func TestConnConcurrentRecv(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	const (
+		receivers = 8
+		count     = 2000
+	)
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		seen = make(map[uint32]bool)
+	)
+	for i := 0; i < receivers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				im, err := b.Recv()
+				if err == io.EOF {
+					return
+				}
+				if err != nil {
+					t.Errorf("unexpected Recv failure: %s", err)
+					return
+				}
+				if len(im.Data) != int(im.Type%64) || !bytes.Equal(im.Data, bytes.Repeat([]byte{byte(im.Type)}, len(im.Data))) {
+					t.Errorf("received corrupted imsg (%v)", im)
+					return
+				}
+
+				mu.Lock()
+				if seen[im.Type] {
+					t.Errorf("imsg %d received twice", im.Type)
+				}
+				seen[im.Type] = true
+				mu.Unlock()
+			}
+		}()
+	}
+
+	for typ := uint32(0); typ < count; typ++ {
+		data := bytes.Repeat([]byte{byte(typ)}, int(typ%64))
+		err := a.Send(&IMsg{Type: typ, Data: data})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+	a.CloseWrite()
+
+	wg.Wait()
+	if len(seen) != count {
+		t.Fatalf("unexpected imsgs received (%d != %d)", len(seen), count)
+	}
+}
+
+func TestConnSendVectored(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	a.AllowFDPass(true)
+	b.AllowFDPass(true)
+
+	data := bytes.Repeat([]byte{0xaa}, 1000)
+	err := a.Send(&IMsg{Type: 1, Data: data})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %s", err)
+	}
+	defer pr.Close()
+	withFile, _ := ComposeIMsgWithFile(2, 3, data, pw)
+	err = a.Send(withFile)
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+
+	// Data written before Send returns may be reused immediately.
+	data[0] = 0xbb
+
+	for typ := uint32(1); typ <= 2; typ++ {
+		im, err := b.Recv()
+		if err != nil {
+			t.Fatalf("unexpected Recv failure: %s", err)
+		}
+		if im.Type != typ || len(im.Data) != 1000 || im.Data[0] != 0xaa {
+			t.Fatalf("received corrupted imsg (%v)", im)
+		}
+		if typ == 2 {
+			if im.File() == nil {
+				t.Fatalf("descriptor was not received")
+			}
+			im.File().Close()
+		}
+	}
+}
+
+func TestConnSendVectoredLeftQueued(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	a.SetMaxSize(65535)
+	b.SetMaxSize(65535)
+
+	// Keep sending until a send is interrupted, leaving its imsg queued, then
+	// overwrite the data of every imsg sent.
+	var (
+		sent [][]byte
+		err  error
+	)
+	for err != context.DeadlineExceeded {
+		if len(sent) == 100 {
+			t.Fatalf("socket buffer never filled")
+		}
+		data := bytes.Repeat([]byte{byte(len(sent))}, 65535-HeaderSizeInBytes)
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		err = a.SendContext(ctx, &IMsg{Type: uint32(len(sent)), Data: data})
+		cancel()
+		sent = append(sent, data)
+	}
+	for _, data := range sent {
+		data[0] = 0xff
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- a.Flush() }()
+
+	for i := range sent {
+		im, err := b.Recv()
+		if err != nil {
+			t.Fatalf("unexpected Recv failure: %s", err)
+		}
+		if im.Type != uint32(i) || !bytes.Equal(im.Data, bytes.Repeat([]byte{byte(i)}, 65535-HeaderSizeInBytes)) {
+			t.Fatalf("imsg %d was corrupted", i)
+		}
+	}
+	err = <-errc
+	if err != nil {
+		t.Fatalf("unexpected Flush failure: %s", err)
+	}
+}
+
+func BenchmarkConnSend(b *testing.B) {
+	c := newBenchmarkConns(b, 1)[0]
+	im := &IMsg{Type: 1, Data: make([]byte, MaxSizeInBytes-HeaderSizeInBytes)}
+
+	b.SetBytes(int64(im.Len()))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := c.Send(im)
+		if err != nil {
+			b.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+}
+
+func BenchmarkConnSendCopied(b *testing.B) {
+	c := newBenchmarkConns(b, 1)[0]
+	im := &IMsg{Type: 1, Data: make([]byte, MaxSizeInBytes-HeaderSizeInBytes)}
+
+	// This is the path Send took before writing the header and data separately.
+	b.SetBytes(int64(im.Len()))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := c.wq.Enqueue(im)
+		if err == nil {
+			_, err = c.wq.Flush()
+		}
+		if err != nil {
+			b.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+}
+
+func TestConnSendBatch(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	var batch []*IMsg
+	for typ := uint32(0); typ < 100; typ++ {
+		batch = append(batch, &IMsg{Type: typ, PeerID: typ, Data: bytes.Repeat([]byte{byte(typ)}, int(typ))})
+	}
+
+	err := a.SendBatch(batch...)
+	if err != nil {
+		t.Fatalf("unexpected SendBatch failure: %s", err)
+	}
+	for _, expected := range batch {
+		im, err := b.Recv()
+		if err != nil {
+			t.Fatalf("unexpected Recv failure: %s", err)
+		}
+		if !im.Equal(expected) {
+			t.Fatalf("received imsg does not match (%v != %v)", im, expected)
+		}
+	}
+
+	// A batch with an invalid imsg is refused as a whole.
+	batch = batch[:3]
+	batch[1] = &IMsg{Type: 1, Data: make([]byte, MaxSizeInBytes)}
+	var eb *ErrBatch
+	var edtl *ErrDataTooLarge
+	err = a.SendBatch(batch...)
+	if !errors.As(err, &eb) || eb.Index != 1 || !errors.As(err, &edtl) {
+		t.Fatalf("expected ErrBatch wrapping ErrDataTooLarge, got: %v", err)
+	}
+
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("failed to open %s: %s", os.DevNull, err)
+	}
+	defer f.Close()
+	a.AllowFDPass(true)
+	batch[1], _ = ComposeIMsgWithFile(1, 2, nil, f)
+	var eu *ErrUnsupported
+	err = a.SendBatch(batch...)
+	if !errors.As(err, &eb) || eb.Index != 1 || !errors.As(err, &eu) {
+		t.Fatalf("expected ErrBatch wrapping ErrUnsupported, got: %v", err)
+	}
+
+	if a.wq.QueueLen() != 0 {
+		t.Fatalf("refused batch was partially queued")
+	}
+	expectNothingReceived(t, b)
+}
+
+func BenchmarkConnSendBatch(b *testing.B) {
+	c := newBenchmarkConns(b, 1)[0]
+	batch := make([]*IMsg, 16)
+	for i := range batch {
+		batch[i] = &IMsg{Type: uint32(i), Data: make([]byte, 64)}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		err := c.SendBatch(batch...)
+		if err != nil {
+			b.Fatalf("unexpected SendBatch failure: %s", err)
+		}
+	}
+}
+
+func BenchmarkConnSendBatchLoop(b *testing.B) {
+	c := newBenchmarkConns(b, 1)[0]
+	batch := make([]*IMsg, 16)
+	for i := range batch {
+		batch[i] = &IMsg{Type: uint32(i), Data: make([]byte, 64)}
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, im := range batch {
+			err := c.Send(im)
+			if err != nil {
+				b.Fatalf("unexpected Send failure: %s", err)
+			}
+		}
+	}
+}
+
+func TestConnStrictFlags(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	b = rewrapTestConn(t, b, WithStrictFlags())
+
+	bs, _ := (&IMsg{Type: 1, Data: []byte("test"), flags: 0x0200}).MarshalBinary()
+	_, err := a.conn.Write(bs)
+	if err != nil {
+		t.Fatalf("failed to write imsg: %s", err)
+	}
+	err = a.Send(&IMsg{Type: 2})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+
+	_, err = b.Recv()
+	var euf *ErrUnknownFlags
+	if !errors.As(err, &euf) || euf.Flags != 0x0200 {
+		t.Fatalf("expected ErrUnknownFlags, got: %v", err)
+	}
+
+	im, err := b.Recv()
+	if err != nil || im.Type != 2 {
+		t.Fatalf("unexpected Recv result after refused imsg (%v, %v)", im, err)
+	}
+}
+
+func TestConnSizeCheck(t *testing.T) {
+	registerTestSizes(t)
+	a, b := newTestSocketPair(t)
+	b = rewrapTestConn(t, b, WithSizeCheck())
+
+	for _, test := range sizeCheckTests {
+		err := a.Send(&IMsg{Type: test.typ, Data: make([]byte, test.size)})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+	for _, test := range sizeCheckTests {
+		im, err := b.Recv()
+		var mismatch *ErrSizeMismatch
+		if test.ok && (err != nil || im.Type != test.typ) || !test.ok && !errors.As(err, &mismatch) {
+			t.Fatalf("unexpected Recv result for %d bytes of type %#x (%v, %v)", test.size, test.typ, im, err)
+		}
+	}
+}
+
+func TestConnSyscallConn(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	rc, err := b.SyscallConn()
+	if err != nil {
+		t.Fatalf("unexpected SyscallConn failure: %s", err)
+	}
+	var (
+		fd   int
+		ferr error
+	)
+	err = rc.Control(func(sysfd uintptr) {
+		fd = int(sysfd)
+		_, ferr = unix.FcntlInt(sysfd, unix.F_GETFD, 0)
+	})
+	if err != nil || ferr != nil {
+		t.Fatalf("descriptor is not valid (%v, %v)", err, ferr)
+	}
+
+	// Once the descriptor is reported readable, an imsg can be received.
+	a.Send(&IMsg{Type: 1})
+	fds := []unix.PollFd{{Fd: int32(fd), Events: unix.POLLIN}}
+	n, err := unix.Poll(fds, 1000)
+	if err != nil || n != 1 || fds[0].Revents&unix.POLLIN == 0 {
+		t.Fatalf("descriptor was not reported readable (%d, %v)", n, err)
+	}
+	im, err := b.Recv()
+	if err != nil || im.Type != 1 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+}
+
+func TestConnTryRecv(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	im, err := b.TryRecv()
+	if im != nil || err != nil {
+		t.Fatalf("expected nothing to be received, got: %v, %v", im, err)
+	}
+
+	first, err := (&IMsg{Type: 1, PeerID: 2, Data: []byte("dribbled")}).MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected MarshalBinary failure: %s", err)
+	}
+	second, err := (&IMsg{Type: 3}).MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected MarshalBinary failure: %s", err)
+	}
+
+	// The peer writes the first imsg a few bytes at a time, with the second
+	// following in the same write as the last few bytes of the first.
+	var chunks [][]byte
+	for len(first) > 5 {
+		chunks = append(chunks, first[:5])
+		first = first[5:]
+	}
+	chunks = append(chunks, append(first, second...))
+	done := make(chan error, 1)
+	go func() {
+		for _, chunk := range chunks {
+			_, err := a.conn.Write(chunk)
+			if err != nil {
+				done <- err
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		done <- nil
+	}()
+
+	var (
+		got   []*IMsg
+		polls int
+	)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(got) < 2 && time.Now().Before(deadline) {
+		im, err := b.TryRecv()
+		if err != nil {
+			t.Fatalf("unexpected TryRecv failure: %s", err)
+		}
+		if im == nil {
+			polls++
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		got = append(got, im)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected write failure: %s", err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("expected 2 imsgs, got %d", len(got))
+	}
+	if got[0].Type != 1 || got[0].PeerID != 2 || string(got[0].Data) != "dribbled" || got[1].Type != 3 {
+		t.Fatalf("unexpected imsgs received: %v, %v", got[0], got[1])
+	}
+	if polls == 0 {
+		t.Fatalf("expected TryRecv to report incomplete imsgs")
+	}
+
+	im, err = b.TryRecv()
+	if im != nil || err != nil {
+		t.Fatalf("expected nothing to be received, got: %v, %v", im, err)
+	}
+
+	// Once the peer has closed the connection, TryRecv reports io.EOF.
+	a.Close()
+	im, err = b.TryRecv()
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF, got: %v, %v", im, err)
+	}
+}
+
+func TestConnTryRecvPartialEOF(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	a.conn.Write(make([]byte, HeaderSizeInBytes/2))
+	a.Close()
+
+	// The first call reads the partial header, and the second reaches the end
+	// of the stream.
+	im, err := b.TryRecv()
+	if im != nil || err != nil {
+		t.Fatalf("expected nothing to be received, got: %v, %v", im, err)
+	}
+	im, err = b.TryRecv()
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got: %v, %v", im, err)
+	}
+}
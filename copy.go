@@ -0,0 +1,77 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"io"
+)
+
+// A CopyFunc is called by CopyMessagesFunc with the header of each imsg before
+// it's written. Returning an error stops the copy, and the error is returned.
+type CopyFunc func(hdr Header) error
+
+// CopyMessages copies up to n imsgs from src to dst, or every imsg until src is
+// exhausted if n is negative, returning the number of imsgs copied. Each imsg is
+// written exactly as it was read, flags included, with a single write. Reaching
+// the end of src between imsgs isn't an error, but reaching it partway through
+// one results in ErrTruncated, and a header whose length is out of bounds in
+// ErrLengthOutOfBounds. Failures to read are returned wrapped in an ErrRead, and
+// failures to write in an ErrWrite.
+func CopyMessages(dst io.Writer, src io.Reader, n int) (int, error) {
+	return CopyMessagesFunc(dst, src, n, nil)
+}
+
+// CopyMessagesFunc behaves like CopyMessages, additionally calling fn, if it's
+// not nil, for each imsg copied, such as to count or log imsgs by type.
+func CopyMessagesFunc(dst io.Writer, src io.Reader, n int, fn CopyFunc) (int, error) {
+	var (
+		buf    []byte
+		copied int
+	)
+	for n < 0 || copied < n {
+		if buf == nil {
+			buf = make([]byte, MaxSizeInBytes)
+		}
+
+		m, err := io.ReadFull(src, buf[:HeaderSizeInBytes])
+		switch {
+		case err == io.EOF:
+			return copied, nil
+		case err == io.ErrUnexpectedEOF:
+			return copied, &ErrTruncated{HeaderSizeInBytes, m, "header"}
+		case err != nil:
+			return copied, &ErrRead{"header", err}
+		}
+
+		hdr := parseHeader(buf, endianness)
+		if hdr.Length < HeaderSizeInBytes || hdr.Length > MaxSizeInBytes {
+			return copied, &ErrLengthOutOfBounds{hdr.Length, HeaderSizeInBytes, MaxSizeInBytes}
+		}
+
+		body := buf[HeaderSizeInBytes:hdr.Length]
+		m, err = io.ReadFull(src, body)
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			return copied, &ErrTruncated{len(body), m, "body"}
+		case err != nil:
+			return copied, &ErrRead{"body", err}
+		}
+
+		if fn != nil {
+			err = fn(hdr)
+			if err != nil {
+				return copied, err
+			}
+		}
+
+		_, err = dst.Write(buf[:hdr.Length])
+		if err != nil {
+			return copied, &ErrWrite{err}
+		}
+		copied++
+	}
+
+	return copied, nil
+}
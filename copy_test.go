@@ -0,0 +1,131 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestCopyMessages(t *testing.T) {
+	batch := []*IMsg{
+		{Type: 1, PeerID: 2, PID: 3, Data: []byte("test"), flags: FlagHasFD},
+		{Type: 4},
+		{Type: 5, Data: bytes.Repeat([]byte{0xaa}, 100)},
+	}
+	stream, _ := MarshalAll(batch)
+
+	testCases := []struct {
+		name     string
+		n        int
+		expected int
+	}{
+		{"all", -1, 3},
+		{"limited", 2, 2},
+		{"beyond end", 5, 3},
+		{"none", 0, 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var dst bytes.Buffer
+			src := bytes.NewReader(stream)
+			copied, err := CopyMessages(&dst, src, tc.n)
+			if err != nil {
+				t.Fatalf("unexpected CopyMessages failure: %s", err)
+			}
+			if copied != tc.expected {
+				t.Fatalf("unexpected number of imsgs copied (%d != %d)", copied, tc.expected)
+			}
+
+			expected, _ := MarshalAll(batch[:tc.expected])
+			if !bytes.Equal(dst.Bytes(), expected) {
+				t.Fatalf("copied bytes do not match:\n%x\n%x", dst.Bytes(), expected)
+			}
+			if src.Len() != len(stream)-len(expected) {
+				t.Fatalf("read beyond the copied imsgs (%d bytes remain)", src.Len())
+			}
+		})
+	}
+}
+
+func TestCopyMessagesEmpty(t *testing.T) {
+	var dst bytes.Buffer
+	copied, err := CopyMessages(&dst, bytes.NewReader(nil), -1)
+	if copied != 0 || err != nil || dst.Len() != 0 {
+		t.Fatalf("unexpected CopyMessages result for empty input (%d, %v)", copied, err)
+	}
+}
+
+func TestCopyMessagesTruncated(t *testing.T) {
+	stream, _ := MarshalAll([]*IMsg{{Type: 1}, {Type: 2, Data: []byte("test")}})
+
+	testCases := []struct {
+		name  string
+		len   int
+		stage string
+	}{
+		{"header", HeaderSizeInBytes + 5, "header"},
+		{"body", len(stream) - 1, "body"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			var dst bytes.Buffer
+			copied, err := CopyMessages(&dst, bytes.NewReader(stream[:tc.len]), -1)
+			var et *ErrTruncated
+			if !errors.As(err, &et) || et.Stage != tc.stage {
+				t.Fatalf("expected ErrTruncated in %s, got: %v", tc.stage, err)
+			}
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("error does not match io.ErrUnexpectedEOF (%v)", err)
+			}
+			if copied != 1 || dst.Len() != HeaderSizeInBytes {
+				t.Fatalf("unexpected progress before truncation (%d imsgs, %d bytes)", copied, dst.Len())
+			}
+		})
+	}
+}
+
+func TestCopyMessagesFunc(t *testing.T) {
+	stream, _ := MarshalAll([]*IMsg{{Type: 1}, {Type: 2}, {Type: 3}})
+
+	var types []uint32
+	stop := errors.New("stop")
+	copied, err := CopyMessagesFunc(io.Discard, bytes.NewReader(stream), -1, func(hdr Header) error {
+		if hdr.Type == 3 {
+			return stop
+		}
+		types = append(types, hdr.Type)
+		return nil
+	})
+	if err != stop {
+		t.Fatalf("expected the callback's error, got: %v", err)
+	}
+	if copied != 2 || len(types) != 2 || types[0] != 1 || types[1] != 2 {
+		t.Fatalf("unexpected imsgs copied (%d, %v)", copied, types)
+	}
+}
+
+func TestCopyMessagesErrors(t *testing.T) {
+	bad := make([]byte, HeaderSizeInBytes)
+	_, err := CopyMessages(io.Discard, bytes.NewReader(bad), -1)
+	var eloob *ErrLengthOutOfBounds
+	if !errors.As(err, &eloob) {
+		t.Fatalf("expected ErrLengthOutOfBounds, got: %v", err)
+	}
+
+	stream, _ := MarshalAll([]*IMsg{{Type: 1}})
+	failing := writerFunc(func(p []byte) (int, error) {
+		return 0, io.ErrClosedPipe
+	})
+	_, err = CopyMessages(failing, bytes.NewReader(stream), -1)
+	var ew *ErrWrite
+	if !errors.As(err, &ew) || !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("expected ErrWrite, got: %v", err)
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+// Creds describes the process which sent an imsg, as verified by the kernel
+// when the imsg was sent. Unlike the PID in an imsg's header, which the sender
+// may set to anything, Creds can't be forged by an unprivileged sender.
+type Creds struct {
+	PID uint32
+	UID uint32
+	GID uint32
+}
+
+// Creds returns the credentials of the process which sent a received imsg,
+// which are only available when the receiving Conn has credential passing
+// enabled with EnableCredentials.
+func (im *IMsg) Creds() (*Creds, bool) {
+	return im.creds, im.creds != nil
+}
+
+// A credMark records the credentials which accompanied the bytes of the
+// stream from offset off onwards.
+type credMark struct {
+	off   int64
+	creds *Creds
+}
+
+// EnableCredentials enables per-imsg credential passing over the Conn. The
+// kernel is asked to report the sender's credentials alongside each received
+// imsg, which are then available from its Creds method, and the Conn's own
+// credentials are sent alongside each imsg it sends, as SCM_CREDENTIALS
+// control messages. Both ends must enable credential passing for the
+// credentials to be sent explicitly, although on Linux the kernel reports them
+// to a receiver which has enabled it regardless. This is only supported on
+// Linux, and only over a unix domain socket; elsewhere, ErrUnsupported is
+// returned.
+func (c *Conn) EnableCredentials() error {
+	if c.uc == nil {
+		return &ErrUnsupported{"credential passing"}
+	}
+
+	rc, err := c.uc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var serr error
+	err = rc.Control(func(fd uintptr) {
+		serr = setPassCred(fd)
+	})
+	if err != nil {
+		return err
+	}
+	if serr != nil {
+		return serr
+	}
+
+	c.rmu.Lock()
+	c.passCreds = true
+	c.rmu.Unlock()
+	c.wq.sendCreds.Store(true)
+
+	return nil
+}
+
+// markCreds records the credentials which accompanied n bytes just appended to
+// the read buffer. The caller must hold rmu.
+func (c *Conn) markCreds(creds *Creds, n int) {
+	if !c.passCreds || n == 0 {
+		return
+	}
+
+	off := c.rpos + int64(len(c.rbuf)-n)
+	if last := len(c.cmarks) - 1; last >= 0 && credsEqual(c.cmarks[last].creds, creds) {
+		return
+	}
+	c.cmarks = append(c.cmarks, credMark{off, creds})
+}
+
+// credsAt returns the credentials which accompanied the byte of the stream at
+// the start of the read buffer, discarding marks which no longer apply. The
+// caller must hold rmu.
+func (c *Conn) credsAt() *Creds {
+	i := 0
+	for i+1 < len(c.cmarks) && c.cmarks[i+1].off <= c.rpos {
+		i++
+	}
+	c.cmarks = c.cmarks[i:]
+	if len(c.cmarks) == 0 || c.cmarks[0].off > c.rpos || c.cmarks[0].creds == nil {
+		return nil
+	}
+
+	creds := *c.cmarks[0].creds
+	return &creds
+}
+
+// credsEqual reports whether a and b describe the same credentials.
+func credsEqual(a, b *Creds) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// This is the space needed to receive an SCM_CREDENTIALS control message.
+var credsSpace = unix.CmsgSpace(unix.SizeofUcred)
+
+// setPassCred enables SO_PASSCRED on a socket.
+func setPassCred(fd uintptr) error {
+	err := unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_PASSCRED, 1)
+	if err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+
+	return nil
+}
+
+// credsMessage returns an SCM_CREDENTIALS control message carrying the
+// credentials of the current process.
+func credsMessage() []byte {
+	return unix.UnixCredentials(&unix.Ucred{
+		Pid: int32(os.Getpid()),
+		Uid: uint32(os.Getuid()),
+		Gid: uint32(os.Getgid()),
+	})
+}
+
+// parseCreds returns the credentials carried by a control message of the
+// provided level and type, or nil if it doesn't carry any.
+func parseCreds(level, typ int32, data []byte) *Creds {
+	if level != unix.SOL_SOCKET || typ != unix.SCM_CREDENTIALS {
+		return nil
+	}
+
+	scm := unix.SocketControlMessage{Data: data}
+	scm.Header.Level, scm.Header.Type = level, typ
+	ucred, err := unix.ParseUnixCredentials(&scm)
+	if err != nil {
+		return nil
+	}
+
+	return &Creds{
+		PID: uint32(ucred.Pid),
+		UID: ucred.Uid,
+		GID: ucred.Gid,
+	}
+}
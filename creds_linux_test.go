@@ -0,0 +1,88 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+)
+
+func TestConnCredentials(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	for _, c := range []*Conn{a, b} {
+		err := c.EnableCredentials()
+		if err != nil {
+			t.Fatalf("unexpected EnableCredentials failure: %s", err)
+		}
+	}
+	a.AllowFDPass(true)
+	b.AllowFDPass(true)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("unexpected Pipe failure: %s", err)
+	}
+	defer r.Close()
+
+	// The in-band PID is deliberately wrong.
+	err = a.SendBatch(&IMsg{Type: 1, PID: 1}, &IMsg{Type: 2, Data: []byte("test")})
+	if err != nil {
+		t.Fatalf("unexpected SendBatch failure: %s", err)
+	}
+	err = a.Send(&IMsg{Type: 3, file: w})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+
+	for typ := uint32(1); typ <= 3; typ++ {
+		im, err := b.Recv()
+		if err != nil || im.Type != typ {
+			t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+		}
+		if f := im.File(); f != nil {
+			f.Close()
+		}
+
+		creds, ok := im.Creds()
+		if !ok {
+			t.Fatalf("no credentials received with type %d", typ)
+		}
+		want := Creds{uint32(os.Getpid()), uint32(os.Getuid()), uint32(os.Getgid())}
+		if *creds != want {
+			t.Fatalf("unexpected credentials (%+v != %+v)", *creds, want)
+		}
+		if clone, _ := im.Clone().Creds(); clone == nil || *clone != want {
+			t.Fatalf("credentials not preserved by Clone")
+		}
+	}
+}
+
+func TestConnCredentialsDisabled(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	err := a.Send(&IMsg{Type: 1})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	im, err := b.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	if _, ok := im.Creds(); ok {
+		t.Fatalf("credentials attached without EnableCredentials")
+	}
+
+	pa, pb := net.Pipe()
+	defer pb.Close()
+	c := NewStreamConn(pa)
+	defer c.Close()
+	err = c.EnableCredentials()
+	var eu *ErrUnsupported
+	if !errors.As(err, &eu) {
+		t.Fatalf("expected ErrUnsupported, got: %v", err)
+	}
+}
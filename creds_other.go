@@ -0,0 +1,25 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build !linux
+
+package imsg
+
+// Credentials are never received on this platform.
+const credsSpace = 0
+
+// setPassCred is unsupported on this platform.
+func setPassCred(fd uintptr) error {
+	return &ErrUnsupported{"credential passing"}
+}
+
+// credsMessage is unsupported on this platform.
+func credsMessage() []byte {
+	return nil
+}
+
+// parseCreds is unsupported on this platform.
+func parseCreds(level, typ int32, data []byte) *Creds {
+	return nil
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"unicode/utf8"
+)
+
+// ComposeStringIMsg constructs an IMsg of the provided type whose ancillary
+// data is s followed by a terminating NUL, as expected by C peers. If the
+// string is too large, an error is returned. The PID field is filled in as
+// with ComposeIMsg.
+func ComposeStringIMsg(
+	typ, peerID uint32,
+	s string,
+) (*IMsg, error) {
+	if len(s)+1 > (MaxSizeInBytes - HeaderSizeInBytes) {
+		return nil, &ErrDataTooLarge{
+			DataLengthInBytes: len(s) + 1,
+			MaxLengthInBytes:  MaxSizeInBytes - HeaderSizeInBytes,
+			Type:              typ,
+			PeerID:            peerID,
+		}
+	}
+
+	data := make([]byte, len(s)+1)
+	copy(data, s)
+
+	return ComposeIMsg(typ, peerID, data)
+}
+
+// DataAsCString returns the ancillary data of the imsg as a string. The data
+// must consist of exactly one NUL-terminated string which is valid UTF-8. This
+// is the equivalent of imsg_get_string.
+func (im *IMsg) DataAsCString() (string, error) {
+	s, err := im.DataAsRawCString()
+	if err != nil {
+		return "", err
+	}
+
+	if !utf8.ValidString(s) {
+		off := 0
+		for off < len(s) {
+			r, n := utf8.DecodeRuneInString(s[off:])
+			if r == utf8.RuneError && n <= 1 {
+				break
+			}
+			off += n
+		}
+		return "", &ErrInvalidUTF8{off}
+	}
+
+	return s, nil
+}
+
+// DataAsRawCString behaves like DataAsCString, except that the string isn't
+// required to be valid UTF-8. This suits peers which send paths or other
+// strings in arbitrary encodings.
+func (im *IMsg) DataAsRawCString() (string, error) {
+	i := bytes.IndexByte(im.Data, 0)
+	if i < 0 {
+		return "", &ErrUnterminatedString{len(im.Data)}
+	}
+	if i != len(im.Data)-1 {
+		return "", &ErrEmbeddedNUL{i}
+	}
+
+	return string(im.Data[:i]), nil
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestComposeStringIMsg(t *testing.T) {
+	im, err := ComposeStringIMsg(1, 2, "/var/run/test.sock")
+	if err != nil {
+		t.Fatalf("unexpected ComposeStringIMsg failure: %s", err)
+	}
+	if !bytes.Equal(im.Data, []byte("/var/run/test.sock\x00")) {
+		t.Fatalf("composed imsg data does not match expected output (% x)", im.Data)
+	}
+
+	s, err := im.DataAsCString()
+	if err != nil {
+		t.Fatalf("unexpected DataAsCString failure: %s", err)
+	}
+	if s != "/var/run/test.sock" {
+		t.Fatalf("unexpected string (%q)", s)
+	}
+
+	var edtl *ErrDataTooLarge
+	_, err = ComposeStringIMsg(1, 2, string(make([]byte, MaxSizeInBytes-HeaderSizeInBytes)))
+	if !errors.As(err, &edtl) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+	_, err = ComposeStringIMsg(1, 2, string(make([]byte, MaxSizeInBytes-HeaderSizeInBytes-1)))
+	if err != nil {
+		t.Fatalf("unexpected failure composing maximum length string: %s", err)
+	}
+}
+
+func TestDataAsCString(t *testing.T) {
+	var tests = []struct {
+		name           string
+		data           []byte
+		expected       string
+		expectedErr    error
+		expectedRawErr error
+	}{
+		{"empty string", []byte{0}, "", nil, nil},
+		{"string", []byte("em0\x00"), "em0", nil, nil},
+		{"utf-8", []byte("h\xc3\xa9\x00"), "hé", nil, nil},
+		{"no data", nil, "", &ErrUnterminatedString{}, &ErrUnterminatedString{}},
+		{"missing terminator", []byte("em0"), "", &ErrUnterminatedString{}, &ErrUnterminatedString{}},
+		{"embedded nul", []byte("em\x000\x00"), "", &ErrEmbeddedNUL{}, &ErrEmbeddedNUL{}},
+		{"trailing data", []byte("em0\x00\x00"), "", &ErrEmbeddedNUL{}, &ErrEmbeddedNUL{}},
+		{"invalid utf-8", []byte("h\xc3\x00"), "", &ErrInvalidUTF8{}, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im := &IMsg{Data: tt.data}
+
+			s, err := im.DataAsCString()
+			if tt.expectedErr != nil {
+				if !errorIsType(err, tt.expectedErr) {
+					t.Fatalf("expected %T, got: %v", tt.expectedErr, err)
+				}
+			} else if err != nil || s != tt.expected {
+				t.Fatalf("unexpected DataAsCString result (%q, %v)", s, err)
+			}
+
+			_, err = im.DataAsRawCString()
+			if tt.expectedRawErr != nil {
+				if !errorIsType(err, tt.expectedRawErr) {
+					t.Fatalf("expected %T, got: %v", tt.expectedRawErr, err)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected DataAsRawCString failure: %s", err)
+			}
+		})
+	}
+
+	var eiu *ErrInvalidUTF8
+	_, err := (&IMsg{Data: []byte("ab\xff\x00")}).DataAsCString()
+	if !errors.As(err, &eiu) || eiu.OffsetInBytes != 2 {
+		t.Fatalf("unexpected ErrInvalidUTF8 (%v)", err)
+	}
+}
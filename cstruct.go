@@ -0,0 +1,223 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// MarshalCStruct lays out the provided struct, or pointer to a struct, as a C
+// compiler would: each member is naturally aligned, and the struct is padded to
+// a multiple of its most strictly aligned member. Integers are encoded in the
+// system byte order and padding is zeroed. This allows the ancillary data of
+// an imsg to be exchanged with C peers which memcpy structs into and out of
+// imsgs.
+//
+// Supported member types are fixed-size integers, floats, bools, arrays, and
+// nested structs. Blank (_) members may be used for explicit padding. Other
+// types, including int, uint, slices, strings, and pointers, produce an error.
+func MarshalCStruct(v any) ([]byte, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() == reflect.Pointer && !rv.IsNil() {
+		rv = rv.Elem()
+	}
+	if rv.Kind() != reflect.Struct {
+		return nil, &ErrUnsupportedCType{"", fmt.Sprintf("%T", v)}
+	}
+
+	size, _, err := cLayout(rv.Type(), "")
+	if err != nil {
+		return nil, err
+	}
+
+	bs := make([]byte, size)
+	putC(bs, rv)
+
+	return bs, nil
+}
+
+// UnmarshalCStruct decodes data laid out by a C compiler, as described by
+// MarshalCStruct, into the struct pointed to by v. The length of data must
+// exactly match the size of the struct.
+func UnmarshalCStruct(data []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return &ErrUnsupportedCType{"", fmt.Sprintf("%T", v)}
+	}
+	rv = rv.Elem()
+
+	size, _, err := cLayout(rv.Type(), "")
+	if err != nil {
+		return err
+	}
+	if len(data) != size {
+		return &ErrDataSizeMismatch{size, len(data)}
+	}
+
+	getC(data, rv)
+
+	return nil
+}
+
+// cLayout returns the size and alignment in bytes of t when laid out as a C
+// type. The path identifies t in errors.
+func cLayout(t reflect.Type, path string) (int, int, error) {
+	switch t.Kind() {
+	case reflect.Bool, reflect.Int8, reflect.Uint8:
+		return 1, 1, nil
+	case reflect.Int16, reflect.Uint16:
+		return 2, 2, nil
+	case reflect.Int32, reflect.Uint32, reflect.Float32:
+		return 4, 4, nil
+	case reflect.Int64, reflect.Uint64, reflect.Float64:
+		return 8, 8, nil
+
+	case reflect.Array:
+		size, align, err := cLayout(t.Elem(), path+"[]")
+		if err != nil {
+			return 0, 0, err
+		}
+		return size * t.Len(), align, nil
+
+	case reflect.Struct:
+		var off, maxAlign = 0, 1
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			fpath := f.Name
+			if path != "" {
+				fpath = path + "." + f.Name
+			}
+			if !f.IsExported() && f.Name != "_" {
+				return 0, 0, &ErrUnsupportedCType{fpath, "unexported " + f.Type.String()}
+			}
+
+			size, align, err := cLayout(f.Type, fpath)
+			if err != nil {
+				return 0, 0, err
+			}
+			off = alignUp(off, align) + size
+			if align > maxAlign {
+				maxAlign = align
+			}
+		}
+		return alignUp(off, maxAlign), maxAlign, nil
+	}
+
+	return 0, 0, &ErrUnsupportedCType{path, t.String()}
+}
+
+// alignUp rounds n up to a multiple of align.
+func alignUp(n, align int) int {
+	return (n + align - 1) / align * align
+}
+
+// putC encodes v into bs, which must be exactly the C size of v's type. The
+// type must already have been validated by cLayout.
+func putC(bs []byte, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			bs[0] = 1
+		}
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		putCUint(bs, uint64(v.Int()))
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		putCUint(bs, v.Uint())
+	case reflect.Float32:
+		endianness.PutUint32(bs, math.Float32bits(float32(v.Float())))
+	case reflect.Float64:
+		endianness.PutUint64(bs, math.Float64bits(v.Float()))
+
+	case reflect.Array:
+		if v.Len() == 0 {
+			return
+		}
+		n := len(bs) / v.Len()
+		for i := 0; i < v.Len(); i++ {
+			putC(bs[i*n:(i+1)*n], v.Index(i))
+		}
+
+	case reflect.Struct:
+		off := 0
+		for i := 0; i < v.NumField(); i++ {
+			size, align, _ := cLayout(v.Type().Field(i).Type, "")
+			off = alignUp(off, align)
+			if v.Type().Field(i).Name != "_" {
+				putC(bs[off:off+size], v.Field(i))
+			}
+			off += size
+		}
+	}
+}
+
+// getC decodes bs, which must be exactly the C size of v's type, into v.
+func getC(bs []byte, v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(bs[0] != 0)
+	case reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		// Sign-extend from the width of the field.
+		shift := 64 - 8*len(bs)
+		v.SetInt(int64(getCUint(bs)<<shift) >> shift)
+	case reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(getCUint(bs))
+	case reflect.Float32:
+		v.SetFloat(float64(math.Float32frombits(endianness.Uint32(bs))))
+	case reflect.Float64:
+		v.SetFloat(math.Float64frombits(endianness.Uint64(bs)))
+
+	case reflect.Array:
+		if v.Len() == 0 {
+			return
+		}
+		n := len(bs) / v.Len()
+		for i := 0; i < v.Len(); i++ {
+			getC(bs[i*n:(i+1)*n], v.Index(i))
+		}
+
+	case reflect.Struct:
+		off := 0
+		for i := 0; i < v.NumField(); i++ {
+			size, align, _ := cLayout(v.Type().Field(i).Type, "")
+			off = alignUp(off, align)
+			if v.Type().Field(i).Name != "_" {
+				getC(bs[off:off+size], v.Field(i))
+			}
+			off += size
+		}
+	}
+}
+
+// putCUint encodes an integer into bs, whose length determines its width.
+func putCUint(bs []byte, u uint64) {
+	switch len(bs) {
+	case 1:
+		bs[0] = uint8(u)
+	case 2:
+		endianness.PutUint16(bs, uint16(u))
+	case 4:
+		endianness.PutUint32(bs, uint32(u))
+	case 8:
+		endianness.PutUint64(bs, u)
+	}
+}
+
+// getCUint decodes an integer from bs, whose length determines its width.
+func getCUint(bs []byte) uint64 {
+	switch len(bs) {
+	case 1:
+		return uint64(bs[0])
+	case 2:
+		return uint64(endianness.Uint16(bs))
+	case 4:
+		return uint64(endianness.Uint32(bs))
+	case 8:
+		return endianness.Uint64(bs)
+	}
+
+	return 0
+}
@@ -0,0 +1,306 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+// Package cstruct marshals Go structs into explicitly described fixed layouts,
+// such as the structs which C daemons copy into the ancillary data of imsgs.
+//
+// Each exported field of a registered struct carries an imsg tag describing
+// its encoding:
+//
+//	u8, u16, u32, u64   unsigned integer of the given width
+//	i8, i16, i32, i64   signed integer of the given width
+//	bytes,N             N raw bytes ([N]byte, or []byte zero-padded to N)
+//	cstring,N           string NUL-padded to N bytes, including the terminator
+//	pad,N               N zero bytes (blank [N]byte fields only)
+//	-                   the field is ignored
+//
+// Fields are laid out in declaration order with no implicit padding, so the
+// layout is exactly what the tags describe. Integers are encoded in the system
+// byte order unless the Codec is configured otherwise.
+package cstruct
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	imsg "github.com/schultz-is/go-imsg"
+)
+
+// The kinds of encoding a field may have.
+const (
+	kindUint = iota
+	kindInt
+	kindBytes
+	kindCString
+	kindPad
+)
+
+// This describes the encoding of a single field.
+type field struct {
+	name  string
+	index int
+	kind  int
+	off   int
+	size  int
+}
+
+// A Codec marshals values of type T to and from the layout described by T's
+// field tags. A Codec is safe for concurrent use once configured.
+type Codec[T any] struct {
+	fields []field
+	size   int
+	order  binary.ByteOrder
+}
+
+// Register validates the tags of the struct type T and constructs a Codec for
+// it. Any malformed tag, or tag which disagrees with the type or size of its
+// field, produces an error, so mistakes surface once at startup rather than
+// with each message.
+func Register[T any]() (*Codec[T], error) {
+	t := reflect.TypeOf((*T)(nil)).Elem()
+	if t.Kind() != reflect.Struct {
+		return nil, &ErrInvalidType{t.String()}
+	}
+
+	c := &Codec[T]{order: imsg.SystemEndianness()}
+
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag, ok := sf.Tag.Lookup("imsg")
+		if tag == "-" {
+			continue
+		}
+		if !ok {
+			return nil, &ErrInvalidTag{sf.Name, "", "missing imsg tag"}
+		}
+
+		f, err := parseField(sf, tag)
+		if err != nil {
+			return nil, err
+		}
+
+		f.index = i
+		f.off = c.size
+		c.size += f.size
+		c.fields = append(c.fields, f)
+	}
+
+	return c, nil
+}
+
+// MustRegister behaves like Register, but panics on error. It's intended for
+// initializing package-level Codecs.
+func MustRegister[T any]() *Codec[T] {
+	c, err := Register[T]()
+	if err != nil {
+		panic(err)
+	}
+
+	return c
+}
+
+// parseField validates a field's tag against its type.
+func parseField(sf reflect.StructField, tag string) (field, error) {
+	f := field{name: sf.Name}
+	invalid := func(format string, args ...any) (field, error) {
+		return field{}, &ErrInvalidTag{sf.Name, tag, fmt.Sprintf(format, args...)}
+	}
+
+	name, arg, hasArg := strings.Cut(tag, ",")
+	if hasArg {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			return invalid("size must be a positive integer")
+		}
+		f.size = n
+	}
+
+	if name == "pad" {
+		if !hasArg {
+			return invalid("pad requires a size")
+		}
+		if sf.Name != "_" || sf.Type.Kind() != reflect.Array || sf.Type.Elem().Kind() != reflect.Uint8 || sf.Type.Len() != f.size {
+			return invalid("pad requires a blank [%d]byte field", f.size)
+		}
+		f.kind = kindPad
+		return f, nil
+	}
+
+	if !sf.IsExported() {
+		return invalid("field is not exported")
+	}
+
+	switch name {
+	case "u8", "u16", "u32", "u64", "i8", "i16", "i32", "i64":
+		if hasArg {
+			return invalid("%s does not take a size", name)
+		}
+		bits, _ := strconv.Atoi(name[1:])
+		f.size = bits / 8
+		f.kind = kindUint
+		want := reflect.Uint8
+		if name[0] == 'i' {
+			f.kind = kindInt
+			want = reflect.Int8
+		}
+		switch bits {
+		case 16:
+			want++
+		case 32:
+			want += 2
+		case 64:
+			want += 3
+		}
+		if sf.Type.Kind() != want {
+			return invalid("field of type %s cannot be encoded as %s", sf.Type, name)
+		}
+
+	case "bytes":
+		if !hasArg {
+			return invalid("bytes requires a size")
+		}
+		f.kind = kindBytes
+		switch {
+		case sf.Type.Kind() == reflect.Slice && sf.Type.Elem().Kind() == reflect.Uint8:
+		case sf.Type.Kind() == reflect.Array && sf.Type.Elem().Kind() == reflect.Uint8:
+			if sf.Type.Len() != f.size {
+				return invalid("array of %d bytes does not match size %d", sf.Type.Len(), f.size)
+			}
+		default:
+			return invalid("field of type %s cannot be encoded as bytes", sf.Type)
+		}
+
+	case "cstring":
+		if !hasArg {
+			return invalid("cstring requires a size")
+		}
+		if sf.Type.Kind() != reflect.String {
+			return invalid("field of type %s cannot be encoded as cstring", sf.Type)
+		}
+		f.kind = kindCString
+
+	default:
+		return invalid("unknown encoding %q", name)
+	}
+
+	return f, nil
+}
+
+// SetByteOrder sets the byte order used to encode integers, which defaults to
+// the system byte order. It must not be called concurrently with Marshal or
+// Unmarshal.
+func (c *Codec[T]) SetByteOrder(order binary.ByteOrder) {
+	c.order = order
+}
+
+// Size returns the size in bytes of the layout.
+func (c *Codec[T]) Size() int {
+	return c.size
+}
+
+// Marshal encodes v into the layout described by T's field tags.
+func (c *Codec[T]) Marshal(v T) ([]byte, error) {
+	rv := reflect.ValueOf(&v).Elem()
+	bs := make([]byte, c.size)
+
+	for _, f := range c.fields {
+		dst := bs[f.off : f.off+f.size]
+		fv := rv.Field(f.index)
+
+		switch f.kind {
+		case kindUint:
+			c.putUint(dst, fv.Uint())
+		case kindInt:
+			c.putUint(dst, uint64(fv.Int()))
+		case kindBytes:
+			if fv.Kind() == reflect.Array {
+				reflect.Copy(reflect.ValueOf(dst), fv)
+				break
+			}
+			if fv.Len() > f.size {
+				return nil, &ErrFieldTooLong{f.name, fv.Len(), f.size}
+			}
+			copy(dst, fv.Bytes())
+		case kindCString:
+			// Room must be left for the terminator.
+			if fv.Len() >= f.size {
+				return nil, &ErrFieldTooLong{f.name, fv.Len() + 1, f.size}
+			}
+			copy(dst, fv.String())
+		}
+	}
+
+	return bs, nil
+}
+
+// Unmarshal decodes data laid out as described by T's field tags. The length
+// of data must exactly match the size of the layout.
+func (c *Codec[T]) Unmarshal(data []byte) (T, error) {
+	var v T
+	if len(data) != c.size {
+		return v, &ErrSizeMismatch{c.size, len(data)}
+	}
+
+	rv := reflect.ValueOf(&v).Elem()
+	for _, f := range c.fields {
+		src := data[f.off : f.off+f.size]
+		fv := rv.Field(f.index)
+
+		switch f.kind {
+		case kindUint:
+			fv.SetUint(c.getUint(src))
+		case kindInt:
+			// Sign-extend from the width of the field.
+			shift := 64 - 8*f.size
+			fv.SetInt(int64(c.getUint(src)<<shift) >> shift)
+		case kindBytes:
+			if fv.Kind() == reflect.Array {
+				reflect.Copy(fv, reflect.ValueOf(src))
+				break
+			}
+			fv.SetBytes(append([]byte(nil), src...))
+		case kindCString:
+			if i := bytes.IndexByte(src, 0); i >= 0 {
+				src = src[:i]
+			}
+			fv.SetString(string(src))
+		}
+	}
+
+	return v, nil
+}
+
+// putUint encodes an integer into bs, whose length determines its width.
+func (c *Codec[T]) putUint(bs []byte, u uint64) {
+	switch len(bs) {
+	case 1:
+		bs[0] = uint8(u)
+	case 2:
+		c.order.PutUint16(bs, uint16(u))
+	case 4:
+		c.order.PutUint32(bs, uint32(u))
+	case 8:
+		c.order.PutUint64(bs, u)
+	}
+}
+
+// getUint decodes an integer from bs, whose length determines its width.
+func (c *Codec[T]) getUint(bs []byte) uint64 {
+	switch len(bs) {
+	case 1:
+		return uint64(bs[0])
+	case 2:
+		return uint64(c.order.Uint16(bs))
+	case 4:
+		return uint64(c.order.Uint32(bs))
+	case 8:
+		return c.order.Uint64(bs)
+	}
+
+	return 0
+}
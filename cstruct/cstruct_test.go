@@ -0,0 +1,170 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package cstruct
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+type ifaceInfo struct {
+	Index   uint32  `imsg:"u32"`
+	Flags   uint16  `imsg:"u16"`
+	_       [2]byte `imsg:"pad,2"`
+	Name    string  `imsg:"cstring,8"`
+	HWAddr  [6]byte `imsg:"bytes,6"`
+	Opaque  []byte  `imsg:"bytes,4"`
+	Metric  int8    `imsg:"i8"`
+	Ignored string  `imsg:"-"`
+	MTU     uint64  `imsg:"u64"`
+	Offset  int32   `imsg:"i32"`
+}
+
+func TestCodec(t *testing.T) {
+	c, err := Register[ifaceInfo]()
+	if err != nil {
+		t.Fatalf("unexpected Register failure: %s", err)
+	}
+	c.SetByteOrder(binary.BigEndian)
+
+	if c.Size() != 39 {
+		t.Fatalf("unexpected layout size (%d != 39)", c.Size())
+	}
+
+	in := ifaceInfo{
+		Index:   0x01020304,
+		Flags:   0x0506,
+		Name:    "em0",
+		HWAddr:  [6]byte{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff},
+		Opaque:  []byte{0x07, 0x08},
+		Metric:  -1,
+		Ignored: "not encoded",
+		MTU:     1500,
+		Offset:  -2,
+	}
+	expected := []byte{
+		0x01, 0x02, 0x03, 0x04, // Index
+		0x05, 0x06, // Flags
+		0x00, 0x00, // padding
+		'e', 'm', '0', 0, 0, 0, 0, 0, // Name
+		0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0xff, // HWAddr
+		0x07, 0x08, 0x00, 0x00, // Opaque
+		0xff,                                           // Metric
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x05, 0xdc, // MTU
+		0xff, 0xff, 0xff, 0xfe, // Offset
+	}
+
+	bs, err := c.Marshal(in)
+	if err != nil {
+		t.Fatalf("unexpected Marshal failure: %s", err)
+	}
+	if !bytes.Equal(bs, expected) {
+		t.Fatalf("marshaled data does not match expected output (% x != % x)", bs, expected)
+	}
+
+	out, err := c.Unmarshal(bs)
+	if err != nil {
+		t.Fatalf("unexpected Unmarshal failure: %s", err)
+	}
+	if out.Index != in.Index || out.Flags != in.Flags || out.Name != in.Name ||
+		out.HWAddr != in.HWAddr || !bytes.Equal(out.Opaque, []byte{0x07, 0x08, 0x00, 0x00}) ||
+		out.Metric != in.Metric || out.Ignored != "" || out.MTU != in.MTU || out.Offset != in.Offset {
+		t.Fatalf("unmarshaled value does not match (%#v)", out)
+	}
+}
+
+func TestCodecMarshalErrors(t *testing.T) {
+	c := MustRegister[ifaceInfo]()
+
+	var eftl *ErrFieldTooLong
+	_, err := c.Marshal(ifaceInfo{Name: "12345678"})
+	if !errors.As(err, &eftl) || eftl.Field != "Name" {
+		t.Fatalf("expected ErrFieldTooLong for Name, got: %v", err)
+	}
+	_, err = c.Marshal(ifaceInfo{Opaque: make([]byte, 5)})
+	if !errors.As(err, &eftl) || eftl.Field != "Opaque" {
+		t.Fatalf("expected ErrFieldTooLong for Opaque, got: %v", err)
+	}
+
+	var esm *ErrSizeMismatch
+	_, err = c.Unmarshal(make([]byte, c.Size()-1))
+	if !errors.As(err, &esm) {
+		t.Fatalf("expected ErrSizeMismatch, got: %v", err)
+	}
+}
+
+func TestRegisterErrors(t *testing.T) {
+	var eit *ErrInvalidTag
+
+	check := func(name string, err error) {
+		t.Helper()
+		if !errors.As(err, &eit) {
+			t.Fatalf("%s: expected ErrInvalidTag, got: %v", name, err)
+		}
+	}
+
+	_, err := Register[struct {
+		A uint32 `imsg:"u16"`
+	}]()
+	check("integer width mismatch", err)
+
+	_, err = Register[struct {
+		A int32 `imsg:"u32"`
+	}]()
+	check("integer sign mismatch", err)
+
+	_, err = Register[struct {
+		A [8]byte `imsg:"bytes,16"`
+	}]()
+	check("array size mismatch", err)
+
+	_, err = Register[struct {
+		A string `imsg:"bytes,16"`
+	}]()
+	check("bytes type mismatch", err)
+
+	_, err = Register[struct {
+		A []byte `imsg:"cstring,16"`
+	}]()
+	check("cstring type mismatch", err)
+
+	_, err = Register[struct {
+		A string `imsg:"cstring"`
+	}]()
+	check("missing size", err)
+
+	_, err = Register[struct {
+		A string `imsg:"cstring,0"`
+	}]()
+	check("zero size", err)
+
+	_, err = Register[struct {
+		A uint32 `imsg:"u32,4"`
+	}]()
+	check("unexpected size", err)
+
+	_, err = Register[struct {
+		_ [2]byte `imsg:"pad,4"`
+	}]()
+	check("pad size mismatch", err)
+
+	_, err = Register[struct {
+		A uint32 `imsg:"f32"`
+	}]()
+	check("unknown encoding", err)
+
+	_, err = Register[struct {
+		A uint32
+	}]()
+	check("missing tag", err)
+
+	var eit2 *ErrInvalidType
+	_, err = Register[uint32]()
+	if !errors.As(err, &eit2) {
+		t.Fatalf("expected ErrInvalidType, got: %v", err)
+	}
+}
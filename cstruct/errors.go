@@ -0,0 +1,70 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package cstruct
+
+import "fmt"
+
+// ErrInvalidType is returned by Register when the provided type isn't a
+// struct.
+type ErrInvalidType struct {
+	Type string
+}
+
+// Error implements the error interface.
+func (e *ErrInvalidType) Error() string {
+	return fmt.Sprintf("cstruct: %s is not a struct", e.Type)
+}
+
+// ErrInvalidTag is returned by Register when a field's tag is malformed or
+// doesn't agree with the field's type.
+type ErrInvalidTag struct {
+	Field  string
+	Tag    string
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *ErrInvalidTag) Error() string {
+	return fmt.Sprintf(
+		"cstruct: field %s has invalid tag %q: %s",
+		e.Field,
+		e.Tag,
+		e.Reason,
+	)
+}
+
+// ErrFieldTooLong is returned by Marshal when a variable-length field doesn't
+// fit in the space its tag allots.
+type ErrFieldTooLong struct {
+	Field         string
+	LengthInBytes int
+	MaxInBytes    int
+}
+
+// Error implements the error interface.
+func (e *ErrFieldTooLong) Error() string {
+	return fmt.Sprintf(
+		"cstruct: field %s is too long (%d bytes > %d bytes)",
+		e.Field,
+		e.LengthInBytes,
+		e.MaxInBytes,
+	)
+}
+
+// ErrSizeMismatch is returned by Unmarshal when the provided data isn't
+// exactly the size of the layout.
+type ErrSizeMismatch struct {
+	ExpectedBytes int
+	ActualBytes   int
+}
+
+// Error implements the error interface.
+func (e *ErrSizeMismatch) Error() string {
+	return fmt.Sprintf(
+		"cstruct: data size mismatch (expected %d bytes, got %d bytes)",
+		e.ExpectedBytes,
+		e.ActualBytes,
+	)
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// These mirror the structs in testdata/cstruct.c.
+type cMixed struct {
+	A uint8
+	B uint32
+	C uint8
+	D uint64
+	E uint8
+}
+
+type cNested struct {
+	X    uint16
+	M    cMixed
+	Name [3]byte
+	Y    int32
+	Z    uint8
+}
+
+var (
+	testCMixed = cMixed{
+		A: 0x11,
+		B: 0x22334455,
+		C: 0x66,
+		D: 0x778899aabbccddee,
+		E: 0xff,
+	}
+	testCNested = cNested{
+		X:    0x0102,
+		M:    testCMixed,
+		Name: [3]byte{'e', 'm', '0'},
+		Y:    -2,
+		Z:    0x03,
+	}
+)
+
+func TestCStructGolden(t *testing.T) {
+	// The fixtures were generated on a little-endian system.
+	if endianness != binary.LittleEndian {
+		t.Skip("fixtures require a little-endian system")
+	}
+
+	var tests = []struct {
+		fixture string
+		value   any
+		decoded any
+	}{
+		{"cstruct_mixed.bin", &testCMixed, &cMixed{}},
+		{"cstruct_nested.bin", &testCNested, &cNested{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			expected, err := os.ReadFile(filepath.Join("testdata", tt.fixture))
+			if err != nil {
+				t.Fatalf("failed to read fixture: %s", err)
+			}
+
+			bs, err := MarshalCStruct(tt.value)
+			if err != nil {
+				t.Fatalf("unexpected MarshalCStruct failure: %s", err)
+			}
+			if !bytes.Equal(bs, expected) {
+				t.Fatalf("marshaled struct does not match fixture (% x != % x)", bs, expected)
+			}
+
+			err = UnmarshalCStruct(expected, tt.decoded)
+			if err != nil {
+				t.Fatalf("unexpected UnmarshalCStruct failure: %s", err)
+			}
+			bs, _ = MarshalCStruct(tt.decoded)
+			if !bytes.Equal(bs, expected) {
+				t.Fatalf("unmarshaled struct does not match fixture (%#v)", tt.decoded)
+			}
+		})
+	}
+}
+
+func TestCStructRoundTrip(t *testing.T) {
+	type explicit struct {
+		Flag  bool
+		_     [3]byte
+		Ratio float32
+		Temps [2]float64
+		Delta int16
+	}
+	in := explicit{Flag: true, Ratio: 0.5, Temps: [2]float64{-1.25, 100}, Delta: -300}
+
+	bs, err := MarshalCStruct(in)
+	if err != nil {
+		t.Fatalf("unexpected MarshalCStruct failure: %s", err)
+	}
+	if len(bs) != 32 {
+		t.Fatalf("unexpected struct size (%d != 32)", len(bs))
+	}
+
+	var out explicit
+	err = UnmarshalCStruct(bs, &out)
+	if err != nil {
+		t.Fatalf("unexpected UnmarshalCStruct failure: %s", err)
+	}
+	if out != in {
+		t.Fatalf("round-tripped struct does not match (%#v != %#v)", out, in)
+	}
+}
+
+func TestCStructErrors(t *testing.T) {
+	type withSlice struct {
+		A uint32
+		B []byte
+	}
+	type withString struct{ S string }
+	type withPointer struct{ P *uint32 }
+	type withInt struct{ I int }
+	type withNested struct{ N withPointer }
+	type withUnexported struct{ u uint32 }
+
+	var tests = []struct {
+		name  string
+		value any
+		field string
+	}{
+		{"slice", withSlice{}, "B"},
+		{"string", withString{}, "S"},
+		{"pointer", withPointer{}, "P"},
+		{"int", withInt{}, "I"},
+		{"nested", withNested{}, "N.P"},
+		{"unexported", withUnexported{}, "u"},
+		{"not a struct", uint32(0), ""},
+		{"nil", nil, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := MarshalCStruct(tt.value)
+			e, ok := err.(*ErrUnsupportedCType)
+			if !ok {
+				t.Fatalf("expected ErrUnsupportedCType, got: %v", err)
+			}
+			if e.Field != tt.field {
+				t.Fatalf("unexpected field in error (%q != %q)", e.Field, tt.field)
+			}
+		})
+	}
+
+	var m cMixed
+	err := UnmarshalCStruct(make([]byte, 8), &m)
+	if !errorIsType(err, &ErrDataSizeMismatch{}) {
+		t.Fatalf("expected ErrDataSizeMismatch, got: %v", err)
+	}
+	err = UnmarshalCStruct(make([]byte, 32), m)
+	if !errorIsType(err, &ErrUnsupportedCType{}) {
+		t.Fatalf("expected ErrUnsupportedCType, got: %v", err)
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// A DataBuffer reads fields from the ancillary data of an imsg, checking each
+// read against the bounds of the data. It's the counterpart of IBuf, mirroring
+// the ibuf_get family of functions in the C implementation. A failed read
+// returns an error and consumes nothing.
+type DataBuffer struct {
+	data  []byte
+	off   int
+	order binary.ByteOrder
+}
+
+// NewDataBuffer constructs a DataBuffer which reads from data, decoding
+// integers in the system byte order.
+func NewDataBuffer(data []byte) *DataBuffer {
+	return &DataBuffer{
+		data:  data,
+		order: endianness,
+	}
+}
+
+// DataBuffer constructs a DataBuffer which reads from the imsg's ancillary
+// data.
+func (im *IMsg) DataBuffer() *DataBuffer {
+	return NewDataBuffer(im.Data)
+}
+
+// SetByteOrder sets the byte order used by subsequent integer reads.
+func (d *DataBuffer) SetByteOrder(order binary.ByteOrder) {
+	d.order = order
+}
+
+// Remaining returns the number of bytes which have yet to be read.
+func (d *DataBuffer) Remaining() int {
+	return len(d.data) - d.off
+}
+
+// next consumes and returns the next n bytes.
+func (d *DataBuffer) next(n int) ([]byte, error) {
+	if n < 0 || n > d.Remaining() {
+		return nil, &ErrTruncatedData{n, d.Remaining()}
+	}
+
+	bs := d.data[d.off : d.off+n]
+	d.off += n
+
+	return bs, nil
+}
+
+// GetUint8 reads a single byte.
+func (d *DataBuffer) GetUint8() (uint8, error) {
+	bs, err := d.next(1)
+	if err != nil {
+		return 0, err
+	}
+
+	return bs[0], nil
+}
+
+// GetUint16 reads a 16-bit integer in the DataBuffer's byte order.
+func (d *DataBuffer) GetUint16() (uint16, error) {
+	bs, err := d.next(2)
+	if err != nil {
+		return 0, err
+	}
+
+	return d.order.Uint16(bs), nil
+}
+
+// GetUint32 reads a 32-bit integer in the DataBuffer's byte order.
+func (d *DataBuffer) GetUint32() (uint32, error) {
+	bs, err := d.next(4)
+	if err != nil {
+		return 0, err
+	}
+
+	return d.order.Uint32(bs), nil
+}
+
+// GetUint64 reads a 64-bit integer in the DataBuffer's byte order.
+func (d *DataBuffer) GetUint64() (uint64, error) {
+	bs, err := d.next(8)
+	if err != nil {
+		return 0, err
+	}
+
+	return d.order.Uint64(bs), nil
+}
+
+// GetBytes reads n bytes. The returned slice aliases the underlying data.
+func (d *DataBuffer) GetBytes(n int) ([]byte, error) {
+	return d.next(n)
+}
+
+// GetString reads a NUL-terminated string, consuming the terminator but not
+// including it in the result.
+func (d *DataBuffer) GetString() (string, error) {
+	i := bytes.IndexByte(d.data[d.off:], 0)
+	if i < 0 {
+		return "", &ErrUnterminatedString{d.Remaining()}
+	}
+
+	s := string(d.data[d.off : d.off+i])
+	d.off += i + 1
+
+	return s, nil
+}
@@ -0,0 +1,134 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// readAllFields reads back the fields written by buildTestPayload.
+func readAllFields(d *DataBuffer) error {
+	if _, err := d.GetUint8(); err != nil {
+		return err
+	}
+	if _, err := d.GetUint16(); err != nil {
+		return err
+	}
+	if _, err := d.GetUint32(); err != nil {
+		return err
+	}
+	if _, err := d.GetUint64(); err != nil {
+		return err
+	}
+	if _, err := d.GetString(); err != nil {
+		return err
+	}
+	_, err := d.GetBytes(2)
+	return err
+}
+
+func buildTestPayload(t *testing.T, order binary.ByteOrder) []byte {
+	b := NewIBuf()
+	b.SetByteOrder(order)
+	b.AddUint8(0x01)
+	b.AddUint16(0x0102)
+	b.AddUint32(0x01020304)
+	b.AddUint64(0x0102030405060708)
+	b.AddCString("em0")
+	b.Add([]byte{0xaa, 0xbb})
+	if b.Err() != nil {
+		t.Fatalf("unexpected IBuf failure: %s", b.Err())
+	}
+
+	return b.Bytes()
+}
+
+func TestDataBuffer(t *testing.T) {
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		t.Run(order.String(), func(t *testing.T) {
+			im := &IMsg{Data: buildTestPayload(t, order)}
+			d := im.DataBuffer()
+			d.SetByteOrder(order)
+
+			u8, err := d.GetUint8()
+			if err != nil || u8 != 0x01 {
+				t.Fatalf("unexpected uint8 (%#x, %v)", u8, err)
+			}
+			u16, err := d.GetUint16()
+			if err != nil || u16 != 0x0102 {
+				t.Fatalf("unexpected uint16 (%#x, %v)", u16, err)
+			}
+			u32, err := d.GetUint32()
+			if err != nil || u32 != 0x01020304 {
+				t.Fatalf("unexpected uint32 (%#x, %v)", u32, err)
+			}
+			u64, err := d.GetUint64()
+			if err != nil || u64 != 0x0102030405060708 {
+				t.Fatalf("unexpected uint64 (%#x, %v)", u64, err)
+			}
+			s, err := d.GetString()
+			if err != nil || s != "em0" {
+				t.Fatalf("unexpected string (%q, %v)", s, err)
+			}
+			if d.Remaining() != 2 {
+				t.Fatalf("unexpected remaining byte count (%d != 2)", d.Remaining())
+			}
+			bs, err := d.GetBytes(2)
+			if err != nil || !bytes.Equal(bs, []byte{0xaa, 0xbb}) {
+				t.Fatalf("unexpected bytes (% x, %v)", bs, err)
+			}
+			if d.Remaining() != 0 {
+				t.Fatalf("unexpected remaining byte count (%d != 0)", d.Remaining())
+			}
+		})
+	}
+}
+
+func TestDataBufferTruncated(t *testing.T) {
+	payload := buildTestPayload(t, endianness)
+
+	// Every truncation of the payload must fail cleanly with a typed error.
+	for i := 0; i < len(payload); i++ {
+		err := readAllFields(NewDataBuffer(payload[:i]))
+
+		var etd *ErrTruncatedData
+		var eus *ErrUnterminatedString
+		if !errors.As(err, &etd) && !errors.As(err, &eus) {
+			t.Fatalf("unexpected error reading %d byte truncation: %v", i, err)
+		}
+	}
+
+	err := readAllFields(NewDataBuffer(payload))
+	if err != nil {
+		t.Fatalf("unexpected failure reading complete payload: %s", err)
+	}
+}
+
+func TestDataBufferFailedReadConsumesNothing(t *testing.T) {
+	d := NewDataBuffer([]byte{1, 2, 3})
+
+	var etd *ErrTruncatedData
+	_, err := d.GetUint32()
+	if !errors.As(err, &etd) {
+		t.Fatalf("expected ErrTruncatedData, got: %v", err)
+	}
+	_, err = d.GetBytes(-1)
+	if !errors.As(err, &etd) {
+		t.Fatalf("expected ErrTruncatedData, got: %v", err)
+	}
+
+	var eus *ErrUnterminatedString
+	_, err = d.GetString()
+	if !errors.As(err, &eus) {
+		t.Fatalf("expected ErrUnterminatedString, got: %v", err)
+	}
+
+	if d.Remaining() != 3 {
+		t.Fatalf("failed reads consumed data (%d bytes remain)", d.Remaining())
+	}
+}
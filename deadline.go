@@ -0,0 +1,72 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+	"time"
+)
+
+// SetReadDeadline sets the deadline for reads from the underlying socket, as
+// with net.Conn. Once it passes, a blocked Recv fails with an error for which
+// os.IsTimeout reports true. Between imsgs, the Conn remains usable once the
+// deadline is extended or cleared with the zero time. Partway through an imsg,
+// a peer which has stalled mid-frame can't be told apart from one which is
+// merely slow, so the Conn fails, and subsequent receives return ErrConnFailed
+// wrapping the timeout. Cancelling the context of Serve or Call clears the
+// deadline, and doesn't fail the Conn.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	rd, ok := c.conn.(readDeadliner)
+	if !ok {
+		return &ErrUnsupported{"deadlines"}
+	}
+	c.noteReadDeadline(t)
+
+	return rd.SetReadDeadline(t)
+}
+
+// SetWriteDeadline sets the deadline for writes to the underlying socket, as
+// with net.Conn. Once it passes, a blocked send fails with an error for which
+// os.IsTimeout reports true. Any part of an imsg not yet written remains
+// queued, and is written by a subsequent send or Flush once the deadline is
+// extended or cleared with the zero time. Cancelling the context of SendContext
+// clears the deadline. Over a *tls.Conn, a write which times out leaves the
+// stream unusable, so a write deadline is only suitable as a last resort.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	wd, ok := c.conn.(writeDeadliner)
+	if !ok {
+		return &ErrUnsupported{"deadlines"}
+	}
+
+	return wd.SetWriteDeadline(t)
+}
+
+// RecvTimeout behaves like Recv, failing with an error for which os.IsTimeout
+// reports true if no complete imsg arrives within d. As with SetReadDeadline,
+// the Conn fails if only part of an imsg arrived in time. The read deadline is
+// cleared afterwards.
+func (c *Conn) RecvTimeout(d time.Duration) (*IMsg, error) {
+	c.rsem <- struct{}{}
+	defer func() { <-c.rsem }()
+
+	err := c.SetReadDeadline(time.Now().Add(d))
+	if err != nil {
+		return nil, err
+	}
+	defer c.SetReadDeadline(time.Time{})
+
+	return c.recvHeld()
+}
+
+// SendTimeout behaves like SendContext with a context which expires after d,
+// returning context.DeadlineExceeded, for which os.IsTimeout reports true, if
+// the imsg can't be sent in time. As with SendContext, an imsg which was queued
+// but not completely written remains queued.
+func (c *Conn) SendTimeout(im *IMsg, d time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), d)
+	defer cancel()
+
+	return c.SendContext(ctx, im)
+}
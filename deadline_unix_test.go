@@ -0,0 +1,121 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConnRecvTimeout(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	frame, _ := (&IMsg{Type: 1, Data: []byte("test")}).MarshalBinary()
+
+	// The peer sends half a header and stalls.
+	_, err := a.conn.Write(frame[:HeaderSizeInBytes/2])
+	if err != nil {
+		t.Fatalf("failed to write partial header: %s", err)
+	}
+
+	start := time.Now()
+	_, err = b.RecvTimeout(20 * time.Millisecond)
+	var ne net.Error
+	if !os.IsTimeout(err) || !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("expected a timeout, got: %v", err)
+	}
+	if time.Since(start) < 20*time.Millisecond {
+		t.Fatalf("RecvTimeout gave up early")
+	}
+
+	// The timeout came partway through an imsg, so the Conn has failed, and
+	// stays failed even once the rest of the imsg arrives.
+	a.conn.Write(frame[HeaderSizeInBytes/2:])
+	for i := 0; i < 2; i++ {
+		_, err = b.RecvTimeout(time.Second)
+		var ecf *ErrConnFailed
+		if !errors.As(err, &ecf) || !errors.As(err, &ne) || !ne.Timeout() {
+			t.Fatalf("expected ErrConnFailed, got: %v", err)
+		}
+	}
+	if b.State() != StateFailed {
+		t.Fatalf("unexpected state after timeout (%s)", b.State())
+	}
+}
+
+func TestConnRecvTimeoutBetweenIMsgs(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	// A deadline which passes between imsgs leaves the Conn usable, and
+	// persists until it's cleared.
+	b.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	for i := 0; i < 2; i++ {
+		_, err := b.Recv()
+		if !os.IsTimeout(err) {
+			t.Fatalf("expected a timeout, got: %v", err)
+		}
+	}
+	b.SetReadDeadline(time.Time{})
+
+	err := a.Send(&IMsg{Type: 1, Data: []byte("test")})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	im, err := b.RecvTimeout(time.Second)
+	if err != nil || im.Type != 1 || string(im.Data) != "test" {
+		t.Fatalf("unexpected RecvTimeout result after deadline (%v, %v)", im, err)
+	}
+}
+
+func TestConnSendTimeout(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	// Fill the socket's buffer until a send times out.
+	im := &IMsg{Type: 1, Data: make([]byte, MaxSizeInBytes-HeaderSizeInBytes)}
+	var (
+		sent int
+		err  error
+	)
+	for sent = 0; sent < 10000; sent++ {
+		err = a.SendTimeout(im, 20*time.Millisecond)
+		if err != nil {
+			break
+		}
+	}
+	if !os.IsTimeout(err) || err != context.DeadlineExceeded {
+		t.Fatalf("expected a timeout, got: %v", err)
+	}
+
+	// The imsg which timed out remains queued and is written once the peer
+	// catches up.
+	done := make(chan error, 1)
+	go func() { done <- a.Flush() }()
+	for i := 0; i <= sent; i++ {
+		_, err := b.Recv()
+		if err != nil {
+			t.Fatalf("unexpected Recv failure after %d imsgs: %s", i, err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected Flush failure: %s", err)
+	}
+
+	// An explicit write deadline fails sends with a timeout as well.
+	a.SetWriteDeadline(time.Now().Add(20 * time.Millisecond))
+	for i := 0; i < 10000; i++ {
+		err = a.Send(im)
+		if err != nil {
+			break
+		}
+	}
+	if !os.IsTimeout(err) {
+		t.Fatalf("expected a timeout, got: %v", err)
+	}
+}
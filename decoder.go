@@ -0,0 +1,241 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"hash"
+	"io"
+)
+
+// A Decoder reads imsgs from an io.Reader. Each call to Decode reads exactly
+// one imsg, consuming no more of the reader than that imsg occupies.
+type Decoder struct {
+	r        io.Reader
+	maxSize  uint16
+	hdr      [HeaderSizeInBytes]byte
+	trace    TraceFunc
+	traceErr DecodeErrorFunc
+
+	zeroCopy bool   // Set by SetZeroCopy
+	zim      IMsg   // Returned by each Decode in zero-copy mode
+	zbuf     []byte // Holds the data of zim
+
+	budget      *AllocationBudget // Set by SetAllocationBudget
+	incremental bool              // Set by SetIncrementalRead
+	ibuf        []byte            // Holds data read incrementally
+
+	decompressLimit int // Set by SetDecompressionLimit
+
+	macHash func() hash.Hash // Set by SetHMACKeyFunc
+	macKeys HMACKeyFunc      // Set by SetHMACKeyFunc
+	macSize int              // Size in bytes of an HMAC appended to the data
+
+	checksum bool  // Set by SetChecksum
+	off      int64 // Number of bytes consumed from r
+
+	strictFlags bool // Set by SetStrictFlags
+	sizeCheck   bool // Set by SetSizeCheck
+
+	allowed *typeAllowlist // Set by SetAllowedTypes
+
+	resyncTypes map[uint32]bool // Set by SetResyncTypes
+	badHdr      bool            // Whether the last header read was corrupt
+}
+
+// NewDecoder constructs a Decoder which reads from the provided io.Reader.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{
+		r:       r,
+		maxSize: MaxSizeInBytes,
+	}
+}
+
+// SetMaxSize sets the maximum size in bytes of an imsg which may be decoded,
+// which defaults to MaxSizeInBytes. Sizes smaller than HeaderSizeInBytes are
+// rejected.
+func (d *Decoder) SetMaxSize(n uint16) error {
+	err := validateMaxSize(n)
+	if err != nil {
+		return err
+	}
+
+	d.maxSize = n
+	if cap(d.zbuf) < int(n)-HeaderSizeInBytes {
+		d.zbuf = nil
+	}
+
+	return nil
+}
+
+// SetZeroCopy controls whether the Decoder avoids allocating for each imsg it
+// decodes. In zero-copy mode, Decode returns the same IMsg each time, and its
+// Data aliases a buffer belonging to the Decoder. Both are only valid until the
+// next call to Decode, so callers which need to retain an imsg beyond that must
+// copy it, such as with Clone or DataCopy.
+//
+// When built with the imsgdebug tag, the Decoder overwrites the data of each
+// imsg with a poison pattern once it's no longer valid, which makes retention
+// of that data easy to spot in tests.
+func (d *Decoder) SetZeroCopy(enabled bool) {
+	d.zeroCopy = enabled
+	d.zim = IMsg{}
+	d.zbuf = nil
+}
+
+// SetStrictFlags controls whether the Decoder refuses imsgs with unknown flags
+// set in their header, returning ErrUnknownFlags. The imsg is consumed, so
+// subsequent imsgs may still be decoded. The has-fd flag is always known, and
+// FlagCompressed is known while decompression is enabled. By default, unknown
+// flags are preserved and otherwise ignored.
+func (d *Decoder) SetStrictFlags(enabled bool) {
+	d.strictFlags = enabled
+}
+
+// knownFlags returns the flags which the Decoder understands.
+func (d *Decoder) knownFlags() Flags {
+	known := FlagHasFD
+	if d.decompressLimit > 0 {
+		known |= FlagCompressed
+	}
+
+	return known
+}
+
+// Decode reads the next imsg from the underlying io.Reader, reporting errors as
+// ReadIMsg does.
+func (d *Decoder) Decode() (*IMsg, error) {
+	im, _, err := d.DecodeN()
+	return im, err
+}
+
+// DecodeN behaves like Decode, additionally returning the number of bytes
+// consumed from the underlying io.Reader as ReadIMsgN does.
+func (d *Decoder) DecodeN() (*IMsg, int, error) {
+	if d.allowed != nil {
+		n, err := d.skipDisallowed()
+		if err != nil {
+			d.badHdr = isBadHeader(err)
+			return nil, n, err
+		}
+	}
+
+	var (
+		im  *IMsg
+		n   int
+		err error
+	)
+	switch {
+	case d.zeroCopy:
+		im, n, err = d.decodeShared()
+	case d.budget != nil || d.incremental:
+		im, n, err = d.decodeGuarded()
+	default:
+		im, n, err = readIMsgHdr(d.r, d.hdr[:], d.maxSize)
+	}
+	off := d.off
+	d.off += int64(n)
+	d.badHdr = isBadHeader(err)
+	if err == nil && d.checksum {
+		err = verifyChecksum(im, off)
+	}
+	if err == nil && d.strictFlags {
+		err = checkFlags(im.flags, d.knownFlags())
+	}
+	if err == nil && d.macKeys != nil {
+		err = d.verifyHMAC(im)
+	}
+	if err == nil && d.decompressLimit > 0 {
+		err = im.decompress(d.decompressLimit)
+	}
+	if err == nil && d.sizeCheck {
+		err = checkSize(im)
+	}
+	if err != nil {
+		if d.traceErr != nil && err != io.EOF {
+			hdr := d.hdr[:]
+			if n < len(hdr) {
+				hdr = hdr[:n]
+			}
+			d.traceErr(hdr, err)
+		}
+		return nil, n, err
+	}
+	if d.trace != nil {
+		d.trace(Inbound, im, n)
+	}
+
+	return im, n, nil
+}
+
+// Skip discards the next imsg from the underlying io.Reader without allocating
+// space for its data, returning its header, as SkipIMsg does. The skipped
+// imsg's data isn't verified, such as against its checksum or HMAC, nor is it
+// traced.
+func (d *Decoder) Skip() (Header, error) {
+	h, n, err := skipIMsg(d.r, d.hdr[:], d.maxSize)
+	d.off += int64(n)
+	d.badHdr = isBadHeader(err)
+
+	return h, err
+}
+
+// PeekType returns the type of the next imsg without consuming it, so that the
+// following Decode or Skip still returns that imsg. The header is read from the
+// underlying io.Reader and held by the Decoder until then. If the reader would
+// block before a whole header is available, ErrNeedMore reports how many more
+// bytes are needed, and the bytes read so far are likewise held. Otherwise,
+// errors are reported as Decode reports them.
+func (d *Decoder) PeekType() (uint32, error) {
+	src := d.r
+	n, err := io.ReadFull(src, d.hdr[:])
+	if pr, ok := src.(*pushbackReader); ok && len(pr.buf) == 0 {
+		// The bytes held by an earlier peek have all been read again.
+		src = pr.r
+	}
+	d.off += int64(n)
+	d.setPushback(src, append([]byte(nil), d.hdr[:n]...))
+	if err != nil {
+		return 0, peekError(n, err)
+	}
+
+	err = checkLength(endianness.Uint16(d.hdr[4:6]), d.maxSize)
+	if err != nil {
+		return 0, err
+	}
+
+	return endianness.Uint32(d.hdr[0:4]), nil
+}
+
+// decodeShared reads the next imsg into the IMsg and buffer shared by each call
+// in zero-copy mode.
+func (d *Decoder) decodeShared() (*IMsg, int, error) {
+	if poisonReleased && d.zbuf != nil {
+		// The previous imsg's data is left poisoned, and a new buffer is used
+		// so that it stays that way.
+		poison(d.zbuf)
+		d.zbuf = nil
+	}
+	if d.zbuf == nil {
+		d.zbuf = make([]byte, int(d.maxSize)-HeaderSizeInBytes)
+	}
+
+	d.zim = IMsg{}
+	n, err := readIMsgInto(d.r, d.hdr[:], d.maxSize, &d.zim, d.zbuf)
+	if err != nil {
+		return nil, n, err
+	}
+
+	return &d.zim, n, nil
+}
+
+// This is the byte with which poisoned buffers are filled.
+const poisonByte = 0xdb
+
+// poison overwrites bs with poisonByte.
+func poison(bs []byte) {
+	for i := range bs {
+		bs[i] = poisonByte
+	}
+}
@@ -0,0 +1,36 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build imsgdebug
+
+package imsg
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDecoderZeroCopyPoison(t *testing.T) {
+	stream, _ := MarshalAll([]*IMsg{
+		{Type: 1, Data: []byte("test")},
+		{Type: 2},
+	})
+
+	dec := NewDecoder(bytes.NewReader(stream))
+	dec.SetZeroCopy(true)
+
+	im, err := dec.Decode()
+	if err != nil {
+		t.Fatalf("unexpected Decode failure: %s", err)
+	}
+	retained := im.Data
+
+	_, err = dec.Decode()
+	if err != nil {
+		t.Fatalf("unexpected Decode failure: %s", err)
+	}
+	if !bytes.Equal(retained, bytes.Repeat([]byte{poisonByte}, len(retained))) {
+		t.Fatalf("retained data was not poisoned (% x)", retained)
+	}
+}
@@ -0,0 +1,375 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestDecoder(t *testing.T) {
+	var buf bytes.Buffer
+	first := &IMsg{Type: 1, PeerID: 2, PID: 3, Data: []byte("test")}
+	second := &IMsg{Type: 4}
+	for _, im := range []*IMsg{first, second} {
+		_, err := im.WriteTo(&buf)
+		if err != nil {
+			t.Fatalf("unexpected WriteTo failure: %s", err)
+		}
+	}
+	buf.Write([]byte{0, 0, 0})
+
+	dec := NewDecoder(&buf)
+	for _, expected := range []*IMsg{first, second} {
+		im, n, err := dec.DecodeN()
+		if err != nil {
+			t.Fatalf("unexpected DecodeN failure: %s", err)
+		}
+		if !im.Equal(expected) {
+			t.Fatalf("decoded imsg does not match (%v != %v)", im, expected)
+		}
+		if n != expected.Len() {
+			t.Fatalf("unexpected byte count (%d != %d)", n, expected.Len())
+		}
+	}
+
+	var et *ErrTruncated
+	_, n, err := dec.DecodeN()
+	if !errors.As(err, &et) || n != 3 {
+		t.Fatalf("expected ErrTruncated after 3 bytes, got: (%d, %v)", n, err)
+	}
+
+	_, err = dec.Decode()
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF, got: %v", err)
+	}
+}
+
+func TestDecoderSkip(t *testing.T) {
+	var buf bytes.Buffer
+	first := &IMsg{Type: 1, Data: []byte("skipped")}
+	second := &IMsg{Type: 2, Data: []byte("decoded")}
+	for _, im := range []*IMsg{first, second} {
+		_, err := im.WriteTo(&buf)
+		if err != nil {
+			t.Fatalf("unexpected WriteTo failure: %s", err)
+		}
+	}
+
+	dec := NewDecoder(&buf)
+	hdr, err := dec.Skip()
+	if err != nil || hdr.Type != 1 || int(hdr.Length) != first.Len() {
+		t.Fatalf("unexpected Skip result (%+v, %v)", hdr, err)
+	}
+	if dec.off != int64(first.Len()) {
+		t.Fatalf("unexpected offset after Skip (%d != %d)", dec.off, first.Len())
+	}
+
+	im, err := dec.Decode()
+	if err != nil || !im.Equal(second) {
+		t.Fatalf("unexpected Decode result (%v, %v)", im, err)
+	}
+}
+
+func TestDecoderPeekType(t *testing.T) {
+	first := &IMsg{Type: 1, Data: []byte("first")}
+	second := &IMsg{Type: 2, Data: []byte("second")}
+	full, _ := first.MarshalBinary()
+	bs, _ := second.MarshalBinary()
+
+	// The source would block partway through the second header.
+	var src bytes.Buffer
+	src.Write(full)
+	src.Write(bs[:5])
+	dec := NewDecoder(&failingReader{&src, ErrWouldBlock})
+
+	for i := 0; i < 3; i++ {
+		typ, err := dec.PeekType()
+		if err != nil || typ != 1 {
+			t.Fatalf("unexpected PeekType result (%d, %v)", typ, err)
+		}
+	}
+	im, n, err := dec.DecodeN()
+	if err != nil || !im.Equal(first) || n != len(full) {
+		t.Fatalf("unexpected DecodeN result (%v, %d, %v)", im, n, err)
+	}
+	if dec.off != int64(len(full)) {
+		t.Fatalf("unexpected offset after peeking (%d != %d)", dec.off, len(full))
+	}
+
+	_, err = dec.PeekType()
+	var enm *ErrNeedMore
+	if !errors.As(err, &enm) || enm.Need != HeaderSizeInBytes-5 {
+		t.Fatalf("expected ErrNeedMore, got: %v", err)
+	}
+
+	src.Write(bs[5:])
+	typ, err := dec.PeekType()
+	if err != nil || typ != 2 {
+		t.Fatalf("unexpected PeekType result (%d, %v)", typ, err)
+	}
+	im, err = dec.Decode()
+	if err != nil || !im.Equal(second) {
+		t.Fatalf("unexpected Decode result (%v, %v)", im, err)
+	}
+}
+
+func TestDecoderSetMaxSize(t *testing.T) {
+	bs, _ := (&IMsg{Data: []byte("tests")}).MarshalBinary()
+	dec := NewDecoder(bytes.NewReader(bs))
+
+	var eloob *ErrLengthOutOfBounds
+	err := dec.SetMaxSize(HeaderSizeInBytes - 1)
+	if !errors.As(err, &eloob) {
+		t.Fatalf("expected ErrLengthOutOfBounds, got: %v", err)
+	}
+
+	err = dec.SetMaxSize(HeaderSizeInBytes + 4)
+	if err != nil {
+		t.Fatalf("unexpected SetMaxSize failure: %s", err)
+	}
+
+	_, n, err := dec.DecodeN()
+	if !errors.As(err, &eloob) {
+		t.Fatalf("expected ErrLengthOutOfBounds, got: %v", err)
+	}
+	if n != HeaderSizeInBytes {
+		t.Fatalf("unexpected byte count (%d != %d)", n, HeaderSizeInBytes)
+	}
+}
+
+func TestDecoderZeroCopy(t *testing.T) {
+	first := &IMsg{Type: 1, PeerID: 2, PID: 3, Data: []byte("test")}
+	second := &IMsg{Type: 4}
+	third := &IMsg{Type: 5, Data: []byte("testing")}
+	stream, _ := MarshalAll([]*IMsg{first, second, third})
+
+	dec := NewDecoder(bytes.NewReader(stream))
+	dec.SetZeroCopy(true)
+
+	var prev *IMsg
+	for _, expected := range []*IMsg{first, second, third} {
+		im, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("unexpected Decode failure: %s", err)
+		}
+		if !im.Equal(expected) {
+			t.Fatalf("decoded imsg does not match (%v != %v)", im, expected)
+		}
+		if !poisonReleased && prev != nil && im != prev {
+			t.Fatalf("zero-copy Decode returned a new imsg")
+		}
+		prev = im
+	}
+
+	_, err := dec.Decode()
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF, got: %v", err)
+	}
+}
+
+func BenchmarkDecoder(b *testing.B) {
+	benchmarkDecoder(b, false)
+}
+
+func BenchmarkDecoderZeroCopy(b *testing.B) {
+	benchmarkDecoder(b, true)
+}
+
+func benchmarkDecoder(b *testing.B, zeroCopy bool) {
+	frame, _ := (&IMsg{Type: 1, Data: make([]byte, 1024)}).MarshalBinary()
+	stream := bytes.Repeat(frame, 1000)
+	r := bytes.NewReader(stream)
+
+	dec := NewDecoder(r)
+	dec.SetZeroCopy(zeroCopy)
+
+	b.SetBytes(int64(len(frame)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if r.Len() == 0 {
+			r.Reset(stream)
+		}
+		_, err := dec.Decode()
+		if err != nil {
+			b.Fatalf("unexpected Decode failure: %s", err)
+		}
+	}
+}
+
+// startStalledDecode begins decoding, in the background, an imsg whose header
+// claims size bytes of data of which only sent bytes ever arrive, returning
+// a channel which receives the result.
+func startStalledDecode(t *testing.T, dec func(io.Reader) *Decoder, size, sent int) chan error {
+	pr, pw := io.Pipe()
+	t.Cleanup(func() { pw.Close() })
+	d := dec(pr)
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := d.Decode()
+		errc <- err
+	}()
+
+	hdr := make([]byte, HeaderSizeInBytes+sent)
+	endianness.PutUint16(hdr[4:6], uint16(HeaderSizeInBytes+size))
+	go pw.Write(hdr)
+
+	return errc
+}
+
+// waitForInUse waits for the allocations against b to reach n bytes.
+func waitForInUse(t *testing.T, b *AllocationBudget, n int) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for b.InUse() != n {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected allocation in use (%d != %d)", b.InUse(), n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestDecoderAllocationBudget(t *testing.T) {
+	const size = MaxSizeInBytes - HeaderSizeInBytes
+	budget := NewAllocationBudget(2*size + 100)
+	newDecoder := func(r io.Reader) *Decoder {
+		d := NewDecoder(r)
+		d.SetAllocationBudget(budget)
+		return d
+	}
+
+	// Two stalled peers claiming the largest imsg use up the budget, so the
+	// third is refused.
+	startStalledDecode(t, newDecoder, size, 10)
+	startStalledDecode(t, newDecoder, size, 10)
+	waitForInUse(t, budget, 2*size)
+
+	var eal *ErrAllocationLimit
+	err := <-startStalledDecode(t, newDecoder, size, 10)
+	if !errors.As(err, &eal) || eal.Requested != size || eal.Limit != 2*size+100 {
+		t.Fatalf("expected ErrAllocationLimit, got: %v", err)
+	}
+
+	// Smaller imsgs which complete return their allocation to the budget.
+	stream, _ := MarshalAll([]*IMsg{{Type: 1, Data: []byte("test")}, {Type: 2}})
+	d := newDecoder(bytes.NewReader(stream))
+	for typ := uint32(1); typ <= 2; typ++ {
+		im, err := d.Decode()
+		if err != nil || im.Type != typ {
+			t.Fatalf("unexpected Decode result (%v, %v)", im, err)
+		}
+	}
+	if budget.InUse() != 2*size {
+		t.Fatalf("unexpected allocation in use (%d != %d)", budget.InUse(), 2*size)
+	}
+}
+
+func TestDecoderIncrementalRead(t *testing.T) {
+	const size = MaxSizeInBytes - HeaderSizeInBytes
+	budget := NewAllocationBudget(4 * minIncrementalAlloc)
+	newDecoder := func(r io.Reader) *Decoder {
+		d := NewDecoder(r)
+		d.SetAllocationBudget(budget)
+		d.SetIncrementalRead(true)
+		return d
+	}
+
+	// Stalled peers pin only as much as they've sent.
+	startStalledDecode(t, newDecoder, size, 10)
+	startStalledDecode(t, newDecoder, size, 10)
+	waitForInUse(t, budget, 2*minIncrementalAlloc)
+
+	// A peer which keeps sending grows its allocation until it hits the limit.
+	var eal *ErrAllocationLimit
+	err := <-startStalledDecode(t, newDecoder, size, 4*minIncrementalAlloc)
+	if !errors.As(err, &eal) {
+		t.Fatalf("expected ErrAllocationLimit, got: %v", err)
+	}
+	waitForInUse(t, budget, 2*minIncrementalAlloc)
+
+	var (
+		batch  []*IMsg
+		stream []byte
+	)
+	for _, n := range []int{0, 1, minIncrementalAlloc, 3 * minIncrementalAlloc / 2, 10} {
+		im := &IMsg{Type: uint32(n), Data: bytes.Repeat([]byte{byte(n)}, n)}
+		frame, _ := im.MarshalBinary()
+		batch = append(batch, im)
+		stream = append(stream, frame...)
+	}
+
+	budget = NewAllocationBudget(4 * minIncrementalAlloc)
+	d := newDecoder(&chunkedReader{r: bytes.NewReader(stream), chunks: []int{7, 300}})
+	for _, expected := range batch {
+		im, err := d.Decode()
+		if err != nil {
+			t.Fatalf("unexpected Decode failure: %s", err)
+		}
+		if !im.Equal(expected) {
+			t.Fatalf("decoded imsg does not match (%v != %v)", im, expected)
+		}
+	}
+	if budget.InUse() != 0 {
+		t.Fatalf("unexpected allocation in use (%d != 0)", budget.InUse())
+	}
+
+	// The stream ends 100 bytes into the data of the third imsg.
+	d = newDecoder(bytes.NewReader(stream[:HeaderSizeInBytes+HeaderSizeInBytes+1+HeaderSizeInBytes+100]))
+	d.Decode()
+	d.Decode()
+	var et *ErrTruncated
+	_, err = d.Decode()
+	if !errors.As(err, &et) || et.Stage != "body" || et.Got != 100 {
+		t.Fatalf("expected truncated body, got: %v", err)
+	}
+}
+
+func TestDecoderStrictFlags(t *testing.T) {
+	var stream []byte
+	for _, im := range []*IMsg{
+		{Type: 1, Data: []byte("test"), flags: 0x0100},
+		compressIMsg(&IMsg{Type: 2, Data: make([]byte, 100)}, 0),
+		{Type: 3, Data: []byte("test"), flags: FlagHasFD},
+	} {
+		bs, _ := im.MarshalBinary()
+		stream = append(stream, bs...)
+	}
+
+	// By default, unknown flags are preserved.
+	ims, err := DecodeAll(stream)
+	if err != nil || ims[0].flags != 0x0100 {
+		t.Fatalf("unexpected DecodeAll result (%v, %v)", ims, err)
+	}
+
+	dec := NewDecoder(bytes.NewReader(stream))
+	dec.SetStrictFlags(true)
+	for _, flags := range []Flags{0x0100, FlagCompressed} {
+		_, err = dec.Decode()
+		var euf *ErrUnknownFlags
+		if !errors.As(err, &euf) || euf.Flags != flags {
+			t.Fatalf("expected ErrUnknownFlags, got: %v", err)
+		}
+	}
+	im, err := dec.Decode()
+	if err != nil || im.Type != 3 {
+		t.Fatalf("unexpected Decode result after refused imsgs (%v, %v)", im, err)
+	}
+
+	// FlagCompressed is known while decompression is enabled.
+	dec = NewDecoder(bytes.NewReader(stream))
+	dec.SetStrictFlags(true)
+	dec.SetDecompressionLimit(DefaultDecompressionLimit)
+	dec.Decode()
+	im, err = dec.Decode()
+	if err != nil || im.Type != 2 {
+		t.Fatalf("unexpected Decode result with decompression (%v, %v)", im, err)
+	}
+}
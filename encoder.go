@@ -0,0 +1,125 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bufio"
+	"hash"
+	"io"
+)
+
+// An Encoder writes imsgs to an io.Writer. Unlike a MsgBuf, an Encoder doesn't
+// queue imsgs: each is written by the call to Encode, and the writer is
+// expected to accept all of it.
+type Encoder struct {
+	w       io.Writer
+	bw      *bufio.Writer // Set by SetWriteBufferSize
+	maxSize uint16
+	trace   TraceFunc
+
+	compressAbove int       // Set by SetCompression
+	mac           hash.Hash // Set by SetHMAC
+	checksum      bool      // Set by SetChecksum
+}
+
+// NewEncoder constructs an Encoder which writes to the provided io.Writer.
+func NewEncoder(w io.Writer) *Encoder {
+	return &Encoder{
+		w:             w,
+		maxSize:       MaxSizeInBytes,
+		compressAbove: -1,
+	}
+}
+
+// SetMaxSize sets the maximum size in bytes of an imsg which may be encoded,
+// which defaults to MaxSizeInBytes. Sizes smaller than HeaderSizeInBytes are
+// rejected.
+func (e *Encoder) SetMaxSize(n uint16) error {
+	err := validateMaxSize(n)
+	if err != nil {
+		return err
+	}
+
+	e.maxSize = n
+
+	return nil
+}
+
+// Encode writes an imsg to the underlying io.Writer. The imsg is validated
+// first, so an imsg which is too large is refused before anything is written.
+// Framing extensions enabled with SetCompression, SetHMAC, or SetChecksum are
+// applied before it's validated. If buffering was enabled with
+// SetWriteBufferSize, the imsg may instead be buffered until a later Encode or
+// Flush, unless it's marked by WithWipe, in which case the buffer is flushed so
+// that it can be wiped.
+func (e *Encoder) Encode(im *IMsg) error {
+	var w io.Writer = e.w
+	if e.bw != nil {
+		w = e.bw
+	}
+
+	out, err := e.extend(im)
+	if err != nil {
+		return err
+	}
+
+	n, err := out.writeTo(w, e.maxSize)
+	if err != nil {
+		return err
+	}
+	if e.trace != nil {
+		e.trace(Outbound, out, int(n))
+	}
+	if im.wipe {
+		return e.wipe(im, out)
+	}
+
+	return nil
+}
+
+// wipe overwrites the data of an imsg marked by WithWipe once it has been
+// written, along with the copy made by the framing extensions, if any, and the
+// write buffer, which is flushed first.
+func (e *Encoder) wipe(im, out *IMsg) error {
+	if out != im {
+		wipeBytes(out.Data)
+	}
+	wipeBytes(im.Data)
+
+	if e.bw == nil {
+		return nil
+	}
+
+	err := e.Flush()
+	if err != nil {
+		return err
+	}
+	buf := e.bw.AvailableBuffer()
+	wipeBytes(buf[:cap(buf)])
+
+	return nil
+}
+
+// extend applies the enabled framing extensions to an imsg in the order
+// compression, HMAC, checksum.
+func (e *Encoder) extend(im *IMsg) (*IMsg, error) {
+	im = compressIMsg(im, e.compressAbove)
+
+	var err error
+	if e.mac != nil {
+		im, err = sign(e.mac, im, e.maxSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if e.checksum {
+		im, err = appendChecksum(im, e.maxSize)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return im, nil
+}
@@ -0,0 +1,107 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestEncoder(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	first := &IMsg{Type: 1, PeerID: 2, PID: 3, Data: []byte("test")}
+	second := &IMsg{Type: 4}
+	for _, im := range []*IMsg{first, second} {
+		err := enc.Encode(im)
+		if err != nil {
+			t.Fatalf("unexpected Encode failure: %s", err)
+		}
+	}
+
+	a, _ := first.MarshalBinary()
+	b, _ := second.MarshalBinary()
+	if !bytes.Equal(buf.Bytes(), append(a, b...)) {
+		t.Fatalf("encoded data does not match expected output (% x)", buf.Bytes())
+	}
+}
+
+func TestEncoderSetMaxSize(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+
+	var eloob *ErrLengthOutOfBounds
+	err := enc.SetMaxSize(HeaderSizeInBytes - 1)
+	if !errors.As(err, &eloob) {
+		t.Fatalf("expected ErrLengthOutOfBounds, got: %v", err)
+	}
+
+	err = enc.SetMaxSize(HeaderSizeInBytes + 4)
+	if err != nil {
+		t.Fatalf("unexpected SetMaxSize failure: %s", err)
+	}
+
+	var edtl *ErrDataTooLarge
+	err = enc.Encode(&IMsg{Data: []byte("tests")})
+	if !errors.As(err, &edtl) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("oversized imsg was partially written (%d bytes)", buf.Len())
+	}
+
+	err = enc.Encode(&IMsg{Data: []byte("test")})
+	if err != nil {
+		t.Fatalf("unexpected Encode failure: %s", err)
+	}
+}
+
+func TestEncoderWriteBufferSize(t *testing.T) {
+	var writes int
+	var buf bytes.Buffer
+	enc := NewEncoder(writerFunc(func(p []byte) (int, error) {
+		writes++
+		return buf.Write(p)
+	}))
+
+	err := enc.SetWriteBufferSize(4 * HeaderSizeInBytes)
+	if err != nil {
+		t.Fatalf("unexpected SetWriteBufferSize failure: %s", err)
+	}
+
+	var want []byte
+	for typ := uint32(0); typ < 5; typ++ {
+		im := &IMsg{Type: typ}
+		err = enc.Encode(im)
+		if err != nil {
+			t.Fatalf("unexpected Encode failure: %s", err)
+		}
+		bs, _ := im.MarshalBinary()
+		want = append(want, bs...)
+	}
+	if writes != 1 || buf.Len() != 4*HeaderSizeInBytes {
+		t.Fatalf("unexpected writes before Flush (%d writes, %d bytes)", writes, buf.Len())
+	}
+
+	err = enc.Flush()
+	if err != nil {
+		t.Fatalf("unexpected Flush failure: %s", err)
+	}
+	if writes != 2 || !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("encoded data does not match expected output (% x)", buf.Bytes())
+	}
+
+	// Disabling buffering writes each imsg immediately.
+	err = enc.SetWriteBufferSize(0)
+	if err != nil {
+		t.Fatalf("unexpected SetWriteBufferSize failure: %s", err)
+	}
+	enc.Encode(&IMsg{Type: 5})
+	if writes != 3 {
+		t.Fatalf("imsg was buffered after disabling buffering")
+	}
+}
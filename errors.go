@@ -4,17 +4,53 @@
 
 package imsg
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// These are sentinel values which allow errors.Is to be used in place of
+// errors.As for the corresponding error types. Any error of the same type
+// matches, regardless of its fields.
+var (
+	ErrTooLarge    error = &ErrDataTooLarge{}
+	ErrOutOfBounds error = &ErrLengthOutOfBounds{}
+	ErrShortData   error = &ErrInsufficientData{}
+)
 
 // ErrDataTooLarge is returned when the provided ancillary data is larger than
-// is allowed.
+// is allowed. When the data belongs to a particular imsg, Type and PeerID
+// identify it, which allows a failure within a batch to be attributed.
 type ErrDataTooLarge struct {
 	DataLengthInBytes int
-	MaxLengthInBytes  uint16
+	MaxLengthInBytes  int
+	Type              uint32
+	PeerID            uint32
 }
 
-// Error implements the error interface.
+// NewErrDataTooLarge constructs an ErrDataTooLarge for data of dataLen bytes
+// exceeding a limit of maxLen bytes.
+func NewErrDataTooLarge(dataLen, maxLen int) *ErrDataTooLarge {
+	return &ErrDataTooLarge{
+		DataLengthInBytes: dataLen,
+		MaxLengthInBytes:  maxLen,
+	}
+}
+
+// Error implements the error interface. The type of the offending imsg is
+// included when it is nonzero.
 func (e *ErrDataTooLarge) Error() string {
+	if e.Type != 0 {
+		return fmt.Sprintf(
+			"imsg: provided data is too large for type %d (%d bytes > %d bytes)",
+			e.Type,
+			e.DataLengthInBytes,
+			e.MaxLengthInBytes,
+		)
+	}
+
 	return fmt.Sprintf(
 		"imsg: provided data is too large (%d bytes > %d bytes)",
 		e.DataLengthInBytes,
@@ -22,6 +58,13 @@ func (e *ErrDataTooLarge) Error() string {
 	)
 }
 
+// Is reports whether target is also an ErrDataTooLarge, which allows
+// errors.Is to match any error of this type.
+func (e *ErrDataTooLarge) Is(target error) bool {
+	_, ok := target.(*ErrDataTooLarge)
+	return ok
+}
+
 // ErrLengthOutOfBounds is returned when the length parameter is either smaller
 // than the imsg header size or larger than the allowed maximum size.
 type ErrLengthOutOfBounds struct {
@@ -40,8 +83,16 @@ func (e *ErrLengthOutOfBounds) Error() string {
 	)
 }
 
+// Is reports whether target is also an ErrLengthOutOfBounds, which allows
+// errors.Is to match any error of this type.
+func (e *ErrLengthOutOfBounds) Is(target error) bool {
+	_, ok := target.(*ErrLengthOutOfBounds)
+	return ok
+}
+
 // ErrInsufficientData is returned when reading an imsg produces less data than
-// is expected.
+// is expected. Truncated input is now reported with ErrTruncated, which
+// matches ErrInsufficientData with errors.Is.
 type ErrInsufficientData struct {
 	ExpectedBytes uint16
 	ReadBytes     int
@@ -55,3 +106,1126 @@ func (e *ErrInsufficientData) Error() string {
 		e.ReadBytes,
 	)
 }
+
+// Is reports whether target is also an ErrInsufficientData, which allows
+// errors.Is to match any error of this type.
+func (e *ErrInsufficientData) Is(target error) bool {
+	_, ok := target.(*ErrInsufficientData)
+	return ok
+}
+
+// ErrNoAttachment is returned when attempting to send an imsg which has the
+// has-fd flag set but no file attached.
+type ErrNoAttachment struct {
+	Type uint32
+}
+
+// Error implements the error interface.
+func (e *ErrNoAttachment) Error() string {
+	return fmt.Sprintf(
+		"imsg: has-fd flag is set but no file is attached (type %d)",
+		e.Type,
+	)
+}
+
+// ErrMissingFD is returned when a received imsg has the has-fd flag set but no
+// descriptor was received to accompany it.
+type ErrMissingFD struct {
+	Type uint32
+}
+
+// Error implements the error interface.
+func (e *ErrMissingFD) Error() string {
+	return fmt.Sprintf(
+		"imsg: received imsg with has-fd flag set but no descriptor (type %d)",
+		e.Type,
+	)
+}
+
+// ErrTooManyFDs is returned when the peer passes more descriptors than may be
+// queued awaiting attachment to an imsg. The excess descriptors are closed.
+type ErrTooManyFDs struct {
+	Limit int
+}
+
+// Error implements the error interface.
+func (e *ErrTooManyFDs) Error() string {
+	return fmt.Sprintf(
+		"imsg: too many pending descriptors received (limit %d)",
+		e.Limit,
+	)
+}
+
+// ErrUnsupported is returned when a feature isn't available on the current
+// platform or socket type.
+type ErrUnsupported struct {
+	Feature string
+}
+
+// Error implements the error interface.
+func (e *ErrUnsupported) Error() string {
+	return fmt.Sprintf("imsg: %s not supported", e.Feature)
+}
+
+// ErrFDPassUnsupported is returned when attempting to send an imsg with a file
+// attached over a connection which can't pass descriptors, such as one
+// constructed with NewStreamConn over anything but a unix domain socket.
+type ErrFDPassUnsupported struct {
+	Type uint32
+}
+
+// Error implements the error interface.
+func (e *ErrFDPassUnsupported) Error() string {
+	return fmt.Sprintf("imsg: descriptor passing not supported by the connection (type %d)", e.Type)
+}
+
+// ErrPIDMismatch is returned when the PID in the header of a received imsg
+// doesn't match the PID of the peer process as reported by the kernel.
+type ErrPIDMismatch struct {
+	HeaderPID uint32
+	PeerPID   uint32
+}
+
+// Error implements the error interface.
+func (e *ErrPIDMismatch) Error() string {
+	return fmt.Sprintf(
+		"imsg: header PID (%d) does not match peer PID (%d)",
+		e.HeaderPID,
+		e.PeerPID,
+	)
+}
+
+// ErrFDPassDisabled is returned when attempting to send an imsg with a file
+// attached over a Conn which doesn't allow descriptor passing.
+type ErrFDPassDisabled struct {
+	Type uint32
+}
+
+// Error implements the error interface.
+func (e *ErrFDPassDisabled) Error() string {
+	return fmt.Sprintf(
+		"imsg: descriptor passing is not allowed (type %d)",
+		e.Type,
+	)
+}
+
+// ErrUnexpectedFD is returned when descriptors are received over a Conn which
+// doesn't allow descriptor passing. The descriptors are closed immediately.
+type ErrUnexpectedFD struct {
+	Count int
+}
+
+// Error implements the error interface.
+func (e *ErrUnexpectedFD) Error() string {
+	return fmt.Sprintf(
+		"imsg: received %d unexpected descriptors",
+		e.Count,
+	)
+}
+
+// ErrTruncatedData is returned when reading a field from the ancillary data of
+// an imsg would run past the end of the data.
+type ErrTruncatedData struct {
+	WantedBytes    int
+	RemainingBytes int
+}
+
+// Error implements the error interface.
+func (e *ErrTruncatedData) Error() string {
+	return fmt.Sprintf(
+		"imsg: data is truncated (wanted %d bytes, %d bytes remain)",
+		e.WantedBytes,
+		e.RemainingBytes,
+	)
+}
+
+// ErrUnterminatedString is returned when reading a C string from the ancillary
+// data of an imsg finds no terminating NUL.
+type ErrUnterminatedString struct {
+	RemainingBytes int
+}
+
+// Error implements the error interface.
+func (e *ErrUnterminatedString) Error() string {
+	return fmt.Sprintf(
+		"imsg: string is not NUL-terminated (%d bytes remain)",
+		e.RemainingBytes,
+	)
+}
+
+// ErrEmbeddedNUL is returned when a string carried in the ancillary data of an
+// imsg contains a NUL before its terminator.
+type ErrEmbeddedNUL struct {
+	OffsetInBytes int
+}
+
+// Error implements the error interface.
+func (e *ErrEmbeddedNUL) Error() string {
+	return fmt.Sprintf(
+		"imsg: string contains an embedded NUL (offset %d)",
+		e.OffsetInBytes,
+	)
+}
+
+// ErrInvalidUTF8 is returned when a string carried in the ancillary data of an
+// imsg isn't valid UTF-8.
+type ErrInvalidUTF8 struct {
+	OffsetInBytes int
+}
+
+// Error implements the error interface.
+func (e *ErrInvalidUTF8) Error() string {
+	return fmt.Sprintf(
+		"imsg: string is not valid UTF-8 (offset %d)",
+		e.OffsetInBytes,
+	)
+}
+
+// ErrUnsupportedCType is returned when a Go type can't be laid out as a C
+// struct, such as when it contains slices, strings, or pointers.
+type ErrUnsupportedCType struct {
+	Field string
+	Type  string
+}
+
+// Error implements the error interface.
+func (e *ErrUnsupportedCType) Error() string {
+	if e.Field == "" {
+		return fmt.Sprintf(
+			"imsg: type %s cannot be laid out as a C struct",
+			e.Type,
+		)
+	}
+
+	return fmt.Sprintf(
+		"imsg: field %s of type %s cannot be laid out as a C struct",
+		e.Field,
+		e.Type,
+	)
+}
+
+// ErrDataSizeMismatch is returned when the ancillary data of an imsg isn't the
+// size required by the type it's being decoded into.
+type ErrDataSizeMismatch struct {
+	ExpectedBytes int
+	ActualBytes   int
+}
+
+// Error implements the error interface.
+func (e *ErrDataSizeMismatch) Error() string {
+	return fmt.Sprintf(
+		"imsg: data size mismatch (expected %d bytes, got %d bytes)",
+		e.ExpectedBytes,
+		e.ActualBytes,
+	)
+}
+
+// ErrNotFixedSize is returned when a value can't be encoded with
+// encoding/binary because its type doesn't have a fixed size.
+type ErrNotFixedSize struct {
+	Type string
+}
+
+// Error implements the error interface.
+func (e *ErrNotFixedSize) Error() string {
+	return fmt.Sprintf("imsg: type %s does not have a fixed size", e.Type)
+}
+
+// ErrPayloadCodec wraps an error returned while encoding or decoding the
+// ancillary data of an imsg.
+type ErrPayloadCodec struct {
+	Op  string // "marshal" or "unmarshal"
+	Err error
+}
+
+// Error implements the error interface.
+func (e *ErrPayloadCodec) Error() string {
+	return fmt.Sprintf("imsg: failed to %s payload: %s", e.Op, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ErrPayloadCodec) Unwrap() error {
+	return e.Err
+}
+
+// ErrMissingField is returned when decoding an encoded imsg which lacks a
+// required field.
+type ErrMissingField struct {
+	Field string
+}
+
+// Error implements the error interface.
+func (e *ErrMissingField) Error() string {
+	return fmt.Sprintf("imsg: required field %q is missing", e.Field)
+}
+
+// ErrInvalidText is returned when decoding the text representation of an imsg
+// fails.
+type ErrInvalidText struct {
+	Field  string
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *ErrInvalidText) Error() string {
+	return fmt.Sprintf("imsg: invalid text field %q: %s", e.Field, e.Reason)
+}
+
+// ErrTypeNameConflict is returned when registering a name for an imsg type
+// which has already been registered under a different name.
+type ErrTypeNameConflict struct {
+	Type         uint32
+	ExistingName string
+	Name         string
+}
+
+// Error implements the error interface.
+func (e *ErrTypeNameConflict) Error() string {
+	return fmt.Sprintf(
+		"imsg: type %d is already registered as %q (cannot register as %q)",
+		e.Type,
+		e.ExistingName,
+		e.Name,
+	)
+}
+
+// ErrConflictingOptions is returned when options which can't be used together
+// are provided.
+type ErrConflictingOptions struct {
+	First  string
+	Second string
+}
+
+// Error implements the error interface.
+func (e *ErrConflictingOptions) Error() string {
+	return fmt.Sprintf(
+		"imsg: options %s and %s conflict",
+		e.First,
+		e.Second,
+	)
+}
+
+// ErrRead wraps an error returned by the underlying reader, recording the stage
+// of reading at which it occurred.
+type ErrRead struct {
+	Stage string // "header", "body", or "stream"
+	Err   error
+}
+
+// Error implements the error interface.
+func (e *ErrRead) Error() string {
+	return fmt.Sprintf("imsg: reading %s: %s", e.Stage, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ErrRead) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the read failed because a deadline passed, which
+// allows os.IsTimeout to recognize it.
+func (e *ErrRead) Timeout() bool {
+	return isTimeout(e.Err)
+}
+
+// ErrWrite wraps an error returned by the underlying writer.
+type ErrWrite struct {
+	Err error
+}
+
+// Error implements the error interface.
+func (e *ErrWrite) Error() string {
+	return fmt.Sprintf("imsg: writing: %s", e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ErrWrite) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the write failed because a deadline passed, which
+// allows os.IsTimeout to recognize it.
+func (e *ErrWrite) Timeout() bool {
+	return isTimeout(e.Err)
+}
+
+// isTimeout reports whether err, or any error it wraps, is a timeout.
+func isTimeout(err error) bool {
+	var t interface{ Timeout() bool }
+	return errors.As(err, &t) && t.Timeout()
+}
+
+// ErrTruncated is returned when input ends partway through an imsg. Stage is
+// "header" or "body", and Expected and Got count the bytes of that stage. It
+// unwraps to io.ErrUnexpectedEOF and matches ErrShortData, so existing checks
+// for either continue to work.
+type ErrTruncated struct {
+	Expected int
+	Got      int
+	Stage    string
+}
+
+// Error implements the error interface.
+func (e *ErrTruncated) Error() string {
+	return fmt.Sprintf(
+		"imsg: truncated %s (expected %d bytes, got %d bytes)",
+		e.Stage,
+		e.Expected,
+		e.Got,
+	)
+}
+
+// Unwrap returns io.ErrUnexpectedEOF.
+func (e *ErrTruncated) Unwrap() error {
+	return io.ErrUnexpectedEOF
+}
+
+// Is reports whether target is an ErrTruncated or an ErrInsufficientData,
+// which allows errors.Is to match ErrShortData.
+func (e *ErrTruncated) Is(target error) bool {
+	switch target.(type) {
+	case *ErrTruncated, *ErrInsufficientData:
+		return true
+	}
+
+	return false
+}
+
+// ErrNoHandler is returned when an imsg is dispatched by a Mux which has
+// neither a handler for its type nor a default handler.
+type ErrNoHandler struct {
+	Type uint32
+}
+
+// Error implements the error interface.
+func (e *ErrNoHandler) Error() string {
+	return fmt.Sprintf("imsg: no handler for type %d", e.Type)
+}
+
+// ErrHandlerPanic is returned when a handler invoked by a Mux panics. Value is
+// the value passed to panic and Stack is the stack trace of the panicking
+// goroutine.
+type ErrHandlerPanic struct {
+	Type  uint32
+	Value any
+	Stack []byte
+}
+
+// Error implements the error interface.
+func (e *ErrHandlerPanic) Error() string {
+	return fmt.Sprintf("imsg: handler for type %d panicked: %v", e.Type, e.Value)
+}
+
+// ErrNameInUse is returned when a connection is added to a Multiplexer under a
+// name which is already in use.
+type ErrNameInUse struct {
+	Name string
+}
+
+// Error implements the error interface.
+func (e *ErrNameInUse) Error() string {
+	return fmt.Sprintf("imsg: connection name %q is already in use", e.Name)
+}
+
+// ErrConnFailed is returned by a Multiplexer when one of its connections stops
+// delivering imsgs. Err is io.EOF when the peer closed the connection cleanly
+// and ErrRemoved when the connection was removed from the Multiplexer. It's
+// also returned, without a Name, by every Send and Recv on a Conn which has
+// failed, in which case Err is the error reported by the Conn's Err.
+type ErrConnFailed struct {
+	Name string
+	Err  error
+}
+
+// Error implements the error interface.
+func (e *ErrConnFailed) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("imsg: connection failed: %s", e.Err)
+	}
+
+	return fmt.Sprintf("imsg: connection %q: %s", e.Name, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ErrConnFailed) Unwrap() error {
+	return e.Err
+}
+
+// ErrBroadcast is returned by Broadcast when sending to some of the Conns
+// failed. Errs holds an error for each Conn, in the order they were provided,
+// which is nil for each Conn the imsg was sent to.
+type ErrBroadcast struct {
+	Errs []error
+}
+
+// Error implements the error interface.
+func (e *ErrBroadcast) Error() string {
+	var (
+		failed int
+		first  error
+		index  int
+	)
+	for i, err := range e.Errs {
+		if err == nil {
+			continue
+		}
+		if first == nil {
+			first, index = err, i
+		}
+		failed++
+	}
+
+	return fmt.Sprintf(
+		"imsg: broadcast failed for %d of %d connections (connection %d: %s)",
+		failed,
+		len(e.Errs),
+		index,
+		first,
+	)
+}
+
+// Unwrap returns the errors of the sends which failed.
+func (e *ErrBroadcast) Unwrap() []error {
+	var errs []error
+	for _, err := range e.Errs {
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errs
+}
+
+// ErrRejected is returned when a received imsg is rejected by the function set
+// with SetRecvFilter.
+type ErrRejected struct {
+	Type uint32
+}
+
+// Error implements the error interface.
+func (e *ErrRejected) Error() string {
+	return fmt.Sprintf("imsg: received message of type %d was rejected", e.Type)
+}
+
+// ErrQueueFull is returned when an imsg can't be queued for sending because the
+// send queue is at its limit, or because its Accounting refused the memory the
+// imsg would retain, in which case Err is the error returned by Acquire.
+// Messages and Bytes describe the queue at the time.
+type ErrQueueFull struct {
+	Messages int
+	Bytes    int
+	Err      error
+}
+
+// Error implements the error interface.
+func (e *ErrQueueFull) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf(
+			"imsg: send queue is full (%d messages, %d bytes): %s",
+			e.Messages,
+			e.Bytes,
+			e.Err,
+		)
+	}
+
+	return fmt.Sprintf(
+		"imsg: send queue is full (%d messages, %d bytes)",
+		e.Messages,
+		e.Bytes,
+	)
+}
+
+// Unwrap returns the error returned by Accounting.Acquire, if any.
+func (e *ErrQueueFull) Unwrap() error {
+	return e.Err
+}
+
+// ErrBatch is returned when one of a batch of imsgs can't be processed. Index
+// is the position of the offending imsg within the batch.
+type ErrBatch struct {
+	Index int
+	Err   error
+}
+
+// Error implements the error interface.
+func (e *ErrBatch) Error() string {
+	return fmt.Sprintf("imsg: message %d of batch: %s", e.Index, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ErrBatch) Unwrap() error {
+	return e.Err
+}
+
+// ErrAllocationLimit is returned when decoding an imsg would require more
+// memory than remains in the AllocationBudget shared by its Decoder or Conn.
+// Requested is the number of bytes needed, and Limit is the budget's limit.
+type ErrAllocationLimit struct {
+	Requested int
+	Limit     int
+}
+
+// Error implements the error interface.
+func (e *ErrAllocationLimit) Error() string {
+	return fmt.Sprintf(
+		"imsg: allocating %d bytes would exceed the limit of %d bytes",
+		e.Requested,
+		e.Limit,
+	)
+}
+
+// ErrFragment is returned when an imsg can't be fragmented or reassembled.
+// Reason describes the problem.
+type ErrFragment struct {
+	Type   uint32
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *ErrFragment) Error() string {
+	return fmt.Sprintf("imsg: fragment of type %d: %s", e.Type, e.Reason)
+}
+
+// ErrDecompression is returned when the data of a received imsg marked with
+// FlagCompressed can't be decompressed. Err is the error encountered while
+// decompressing, or nil if the data would decompress to more than Limit bytes.
+type ErrDecompression struct {
+	Type  uint32
+	Limit int
+	Err   error
+}
+
+// Error implements the error interface.
+func (e *ErrDecompression) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf(
+			"imsg: data of type %d decompresses to more than %d bytes",
+			e.Type,
+			e.Limit,
+		)
+	}
+
+	return fmt.Sprintf("imsg: failed to decompress data of type %d: %s", e.Type, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ErrDecompression) Unwrap() error {
+	return e.Err
+}
+
+// ErrAuthFailed is returned when the HMAC appended to the data of a received
+// imsg doesn't match any of the keys with which it may have been authenticated.
+type ErrAuthFailed struct {
+	Type uint32
+}
+
+// Error implements the error interface.
+func (e *ErrAuthFailed) Error() string {
+	return fmt.Sprintf("imsg: authentication of message of type %d failed", e.Type)
+}
+
+// ErrChecksumMismatch is returned when the checksum appended to the data of a
+// received imsg doesn't match the imsg. Offset is the position in the stream at
+// which the imsg began. Since the imsg's length may itself be corrupt, the
+// stream can't be assumed to remain intact.
+type ErrChecksumMismatch struct {
+	Offset int64
+	Type   uint32
+}
+
+// Error implements the error interface.
+func (e *ErrChecksumMismatch) Error() string {
+	return fmt.Sprintf(
+		"imsg: checksum mismatch in message of type %d at offset %d",
+		e.Type,
+		e.Offset,
+	)
+}
+
+// ErrUnknownFlags is returned in strict mode when a received imsg has flags set
+// in its header which the implementation doesn't know, which usually indicates
+// a version mismatch with the peer or corruption. Flags holds all of the
+// imsg's flags.
+type ErrUnknownFlags struct {
+	Flags Flags
+}
+
+// Error implements the error interface.
+func (e *ErrUnknownFlags) Error() string {
+	return fmt.Sprintf("imsg: unknown flags set in header (%#04x)", uint16(e.Flags))
+}
+
+// ErrResyncFailed is returned when no plausible header is found within the
+// maximum distance scanned by Resync.
+type ErrResyncFailed struct {
+	MaxScan int
+}
+
+// Error implements the error interface.
+func (e *ErrResyncFailed) Error() string {
+	return fmt.Sprintf("imsg: no header found within %d bytes", e.MaxScan)
+}
+
+// ErrCorruptRecording is returned when a record in a recording can't be parsed.
+// Offset is the position in the recording at which the record begins.
+type ErrCorruptRecording struct {
+	Offset int64
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *ErrCorruptRecording) Error() string {
+	return fmt.Sprintf("imsg: corrupt recording at offset %d: %s", e.Offset, e.Reason)
+}
+
+// ErrTruncatedRecording is returned when a recording ends partway through a
+// record. Offset is the position in the recording at which the record begins,
+// and Expected and Got count the bytes of the record. It unwraps to
+// io.ErrUnexpectedEOF.
+type ErrTruncatedRecording struct {
+	Offset   int64
+	Expected int
+	Got      int
+}
+
+// Error implements the error interface.
+func (e *ErrTruncatedRecording) Error() string {
+	return fmt.Sprintf(
+		"imsg: truncated recording at offset %d (expected %d bytes, got %d bytes)",
+		e.Offset,
+		e.Expected,
+		e.Got,
+	)
+}
+
+// Unwrap returns io.ErrUnexpectedEOF.
+func (e *ErrTruncatedRecording) Unwrap() error {
+	return io.ErrUnexpectedEOF
+}
+
+// ErrInterrupted is returned when reading an imsg is abandoned because its
+// context is done. Stage is "header" or "body", and Err is the context's error.
+type ErrInterrupted struct {
+	Stage string
+	Err   error
+}
+
+// Error implements the error interface.
+func (e *ErrInterrupted) Error() string {
+	return fmt.Sprintf("imsg: reading %s interrupted: %s", e.Stage, e.Err)
+}
+
+// Unwrap returns the context's error.
+func (e *ErrInterrupted) Unwrap() error {
+	return e.Err
+}
+
+// ErrNeedMore is returned by FrameSize when the provided bytes don't yet hold a
+// complete imsg. Need is the number of further bytes required to complete the
+// header, or the imsg if the header is already present.
+type ErrNeedMore struct {
+	Need int
+}
+
+// Error implements the error interface.
+func (e *ErrNeedMore) Error() string {
+	return fmt.Sprintf("imsg: incomplete message (need %d more bytes)", e.Need)
+}
+
+// ErrFileClosed is returned when attempting to forward an imsg whose attached
+// file has already been closed.
+type ErrFileClosed struct {
+	Type uint32
+}
+
+// Error implements the error interface.
+func (e *ErrFileClosed) Error() string {
+	return fmt.Sprintf("imsg: attached file has been closed (type %d)", e.Type)
+}
+
+// ErrPeerUnresponsive is returned when a Conn configured with WithKeepalive has
+// been closed because nothing was received from the peer for Timeout.
+type ErrPeerUnresponsive struct {
+	Timeout time.Duration
+}
+
+// Error implements the error interface.
+func (e *ErrPeerUnresponsive) Error() string {
+	return fmt.Sprintf("imsg: peer unresponsive (nothing received for %s)", e.Timeout)
+}
+
+// ErrUnexportedFDs is returned by ExportPending when queued imsgs with files
+// attached were left out of the exported queue. Types holds the type of each.
+type ErrUnexportedFDs struct {
+	Types []uint32
+}
+
+// Error implements the error interface.
+func (e *ErrUnexportedFDs) Error() string {
+	return fmt.Sprintf("imsg: %d queued messages with descriptors not exported", len(e.Types))
+}
+
+// ErrCorruptPending is returned by ImportPending when the provided blob can't
+// be imported.
+type ErrCorruptPending struct {
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *ErrCorruptPending) Error() string {
+	return fmt.Sprintf("imsg: can't import pending queue: %s", e.Reason)
+}
+
+// ErrBufferTooSmall is returned by EncodeInto when the destination can't hold
+// the whole imsg, which requires Need bytes.
+type ErrBufferTooSmall struct {
+	Need int
+}
+
+// Error implements the error interface.
+func (e *ErrBufferTooSmall) Error() string {
+	return fmt.Sprintf("imsg: buffer too small (need %d bytes)", e.Need)
+}
+
+// ErrUnsupportedPlatform is returned by functions which are only available on
+// certain platforms, such as SocketPair, when called on any other. It wraps an
+// ErrUnsupported for the same feature.
+type ErrUnsupportedPlatform struct {
+	Feature string
+	GOOS    string
+}
+
+// Error implements the error interface.
+func (e *ErrUnsupportedPlatform) Error() string {
+	return fmt.Sprintf("imsg: %s not supported on %s", e.Feature, e.GOOS)
+}
+
+// Unwrap returns the equivalent ErrUnsupported.
+func (e *ErrUnsupportedPlatform) Unwrap() error {
+	return &ErrUnsupported{e.Feature}
+}
+
+// ErrSocketInUse is returned by ListenPath when a process is already listening
+// on the socket at Path.
+type ErrSocketInUse struct {
+	Path string
+}
+
+// Error implements the error interface.
+func (e *ErrSocketInUse) Error() string {
+	return fmt.Sprintf("imsg: socket %s is in use", e.Path)
+}
+
+// ErrInvalidActivation is returned by ListenersFromActivation when the
+// environment describes the inherited sockets inconsistently, or a socket
+// isn't a listening unix domain stream socket.
+type ErrInvalidActivation struct {
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *ErrInvalidActivation) Error() string {
+	return fmt.Sprintf("imsg: invalid socket activation: %s", e.Reason)
+}
+
+// ErrNotTransferable is returned when a listener or connection can't be passed
+// to another process, such as one which isn't backed by a socket descriptor.
+type ErrNotTransferable struct {
+	Type   string // Go type of the listener or connection
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *ErrNotTransferable) Error() string {
+	return fmt.Sprintf("imsg: %s can't be transferred: %s", e.Type, e.Reason)
+}
+
+// ErrInvalidShared is returned by RecvShared when the memory passed by the peer
+// can't be safely mapped, such as when it's smaller than advertised or could
+// still be modified by the peer.
+type ErrInvalidShared struct {
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *ErrInvalidShared) Error() string {
+	return fmt.Sprintf("imsg: invalid shared memory: %s", e.Reason)
+}
+
+// ErrQuotaExceeded is returned when the peer exceeds a receive quota set with
+// WithRecvQuota or WithRecvFDQuota. Resource is "messages", "bytes", or
+// "descriptors", and Window is zero for a quota over the life of the Conn.
+type ErrQuotaExceeded struct {
+	Resource string
+	Limit    uint64
+	Window   time.Duration
+}
+
+// Error implements the error interface.
+func (e *ErrQuotaExceeded) Error() string {
+	if e.Window == 0 {
+		return fmt.Sprintf("imsg: receive quota of %d %s exceeded", e.Limit, e.Resource)
+	}
+	return fmt.Sprintf(
+		"imsg: receive quota of %d %s per %s exceeded",
+		e.Limit, e.Resource, e.Window,
+	)
+}
+
+// ErrSizeMismatch is returned when a received imsg carries data of a length
+// other than that registered for its type with RegisterExpectedSize or
+// RegisterSizeRange. Want and WantMax are equal unless a range was registered.
+type ErrSizeMismatch struct {
+	Type    uint32
+	Want    int
+	WantMax int
+	Got     int
+}
+
+// Error implements the error interface.
+func (e *ErrSizeMismatch) Error() string {
+	if e.Want == e.WantMax {
+		return fmt.Sprintf(
+			"imsg: type %d carries %d bytes of data (want %d)",
+			e.Type, e.Got, e.Want,
+		)
+	}
+	return fmt.Sprintf(
+		"imsg: type %d carries %d bytes of data (want %d to %d)",
+		e.Type, e.Got, e.Want, e.WantMax,
+	)
+}
+
+// ErrUndecodable is returned by a TypedConn when the data of a received imsg
+// can't be decoded by its Codec. IMsg is the offending imsg, for diagnosis.
+type ErrUndecodable struct {
+	IMsg *IMsg
+	Err  error
+}
+
+// Error implements the error interface.
+func (e *ErrUndecodable) Error() string {
+	return fmt.Sprintf(
+		"imsg: failed to decode payload of type %d (%d bytes): %s",
+		e.IMsg.Type, len(e.IMsg.Data), e.Err,
+	)
+}
+
+// Unwrap returns the underlying error.
+func (e *ErrUndecodable) Unwrap() error {
+	return e.Err
+}
+
+// ErrIdleTimeout is returned when a Conn was closed because no imsg was sent or
+// received for the timeout set with WithIdleTimeout.
+type ErrIdleTimeout struct {
+	Timeout time.Duration
+}
+
+// Error implements the error interface.
+func (e *ErrIdleTimeout) Error() string {
+	return fmt.Sprintf("imsg: connection idle (nothing sent or received for %s)", e.Timeout)
+}
+
+// ErrRecvRateExceeded is returned when the peer sends imsgs faster than the
+// rate set with WithMaxRecvRate, under RecvRateFail.
+type ErrRecvRateExceeded struct {
+	Rate  float64
+	Burst int
+}
+
+// Error implements the error interface.
+func (e *ErrRecvRateExceeded) Error() string {
+	return fmt.Sprintf(
+		"imsg: receive rate of %g imsgs per second (burst %d) exceeded",
+		e.Rate, e.Burst,
+	)
+}
+
+// ErrBacklogFull is returned by RecvMatching when the imsgs it holds for Recv
+// have reached the limit, so that no more may be read until Recv drains them.
+type ErrBacklogFull struct {
+	Limit int
+}
+
+// Error implements the error interface.
+func (e *ErrBacklogFull) Error() string {
+	return fmt.Sprintf("imsg: too many unmatched imsgs awaiting Recv (limit %d)", e.Limit)
+}
+
+// ErrSupervisorStopped is returned when starting a child with a Supervisor
+// which has been stopped.
+type ErrSupervisorStopped struct {
+	Name string
+}
+
+// Error implements the error interface.
+func (e *ErrSupervisorStopped) Error() string {
+	return fmt.Sprintf("imsg: supervisor stopped (child %s)", e.Name)
+}
+
+// ErrUnreadFull is returned by Conn.Unread when as many imsgs as it allows are
+// already awaiting Recv after being pushed back.
+type ErrUnreadFull struct {
+	Limit int
+}
+
+// Error implements the error interface.
+func (e *ErrUnreadFull) Error() string {
+	return fmt.Sprintf("imsg: too many unread imsgs awaiting Recv (limit %d)", e.Limit)
+}
+
+// ErrWriteStalled is returned once a Conn has been closed because imsgs were
+// queued for sending without any progress for the timeout set with
+// WithWriteStallTimeout, typically because the peer stopped reading.
+type ErrWriteStalled struct {
+	QueueLen int           // Imsgs which were waiting to be written
+	HeadAge  time.Duration // How long the imsg at the head of the queue had waited
+	Timeout  time.Duration
+}
+
+// Error implements the error interface.
+func (e *ErrWriteStalled) Error() string {
+	return fmt.Sprintf(
+		"imsg: no bytes written for %s with %d imsgs queued, the oldest for %s",
+		e.Timeout,
+		e.QueueLen,
+		e.HeadAge,
+	)
+}
+
+// ErrTypeNotAllowed is returned when an imsg is received whose type isn't
+// allowed by SetAllowedTypes or SetAllowedTypeFunc. The imsg is discarded.
+type ErrTypeNotAllowed struct {
+	Type uint32
+}
+
+// Error implements the error interface.
+func (e *ErrTypeNotAllowed) Error() string {
+	return fmt.Sprintf("imsg: type %d not allowed", e.Type)
+}
+
+// ErrFieldTooLong is returned by code generated by imsggen when a
+// variable-length field of an imsg being composed doesn't fit in the space
+// its tag allots. For a cstring field, the length includes the terminator.
+type ErrFieldTooLong struct {
+	Type          uint32
+	Field         string
+	LengthInBytes int
+	MaxInBytes    int
+}
+
+// Error implements the error interface.
+func (e *ErrFieldTooLong) Error() string {
+	return fmt.Sprintf(
+		"imsg: field %s of type %d is too long (%d bytes > %d bytes)",
+		e.Field,
+		e.Type,
+		e.LengthInBytes,
+		e.MaxInBytes,
+	)
+}
+
+// ErrMalformedFrame is returned by FrameIter.Err when the frames being walked
+// are structurally invalid. Offset is the position in bytes of the offending
+// frame, and Err describes the problem, such as ErrLengthOutOfBounds or
+// ErrTruncated.
+type ErrMalformedFrame struct {
+	Offset int
+	Err    error
+}
+
+// Error implements the error interface.
+func (e *ErrMalformedFrame) Error() string {
+	return fmt.Sprintf("imsg: malformed frame at offset %d: %s", e.Offset, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ErrMalformedFrame) Unwrap() error {
+	return e.Err
+}
+
+// ErrPacketLength is returned by a Conn constructed with NewPacketConn when a
+// datagram received doesn't hold exactly one imsg: either it's too short to
+// hold a header, in which case HeaderLength is zero, or its length differs from
+// the Length field of its header. The datagram and any descriptors which
+// accompanied it are discarded.
+type ErrPacketLength struct {
+	PacketBytes  int
+	HeaderLength int
+}
+
+// Error implements the error interface.
+func (e *ErrPacketLength) Error() string {
+	if e.PacketBytes < HeaderSizeInBytes {
+		return fmt.Sprintf(
+			"imsg: datagram of %d bytes is too short to hold a header",
+			e.PacketBytes,
+		)
+	}
+
+	return fmt.Sprintf(
+		"imsg: datagram of %d bytes holds an imsg of length %d",
+		e.PacketBytes,
+		e.HeaderLength,
+	)
+}
+
+// ErrPacketTooLarge is returned by a Conn constructed with NewPacketConn when
+// an imsg doesn't fit in a single datagram. The imsg is dropped from the send
+// queue, along with any attached file.
+type ErrPacketTooLarge struct {
+	Type          uint32
+	LengthInBytes int
+	Err           error
+}
+
+// Error implements the error interface.
+func (e *ErrPacketTooLarge) Error() string {
+	return fmt.Sprintf(
+		"imsg: imsg of type %d and length %d does not fit in a datagram: %s",
+		e.Type,
+		e.LengthInBytes,
+		e.Err,
+	)
+}
+
+// Unwrap returns the underlying error.
+func (e *ErrPacketTooLarge) Unwrap() error {
+	return e.Err
+}
+
+// ErrHandshake is returned by Handshake when the capabilities offered, either
+// by the caller or by the peer, are malformed. Reason describes the problem.
+type ErrHandshake struct {
+	Reason string
+}
+
+// Error implements the error interface.
+func (e *ErrHandshake) Error() string {
+	return fmt.Sprintf("imsg: capability handshake failed: %s", e.Reason)
+}
+
+// ErrControlTruncated is returned when the descriptors passed by the peer
+// didn't all fit in the space a Conn reserves for them in a single read, so
+// that the kernel discarded the rest. The Received descriptors which did
+// arrive are closed, since they can no longer be matched to their imsgs.
+type ErrControlTruncated struct {
+	Received int
+}
+
+// Error implements the error interface.
+func (e *ErrControlTruncated) Error() string {
+	return fmt.Sprintf("imsg: control message truncated after %d descriptors", e.Received)
+}
+
+// ErrNegativeLength is returned by ComposeIMsgFromReader and SendFromReader
+// when the length of the data to be read is negative.
+type ErrNegativeLength struct {
+	LengthInBytes int
+}
+
+// Error implements the error interface.
+func (e *ErrNegativeLength) Error() string {
+	return fmt.Sprintf("imsg: data length (%d bytes) is negative", e.LengthInBytes)
+}
@@ -0,0 +1,79 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"fmt"
+)
+
+// TypeError is the type reserved for error replies, which are composed with
+// ComposeError. Protocols using error replies must not use it for anything
+// else.
+const TypeError uint32 = 0xffffffff
+
+// MaxErrorMessageLen is the length in bytes beyond which ComposeError truncates
+// the message of an error reply.
+const MaxErrorMessageLen = 1024
+
+// The data of an error reply is the type of the request it answers and the
+// error code, each a uint32 in host byte order, followed by the message.
+const errorReplyHeaderLen = 8
+
+// A RemoteError is an error reported by the peer with an error reply.
+type RemoteError struct {
+	Type    uint32 // Type of the request which failed
+	Code    uint32
+	Message string
+}
+
+// Error implements the error interface.
+func (e *RemoteError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("imsg: peer failed request of type %d with code %d", e.Type, e.Code)
+	}
+	return fmt.Sprintf("imsg: peer failed request of type %d with code %d: %s", e.Type, e.Code, e.Message)
+}
+
+// ComposeError constructs an error reply to inReplyTo, which reports that the
+// request failed with the provided code and message. The reply has type
+// TypeError and carries the request's PeerID, which ties it to the request
+// awaiting it in Call. A message longer than MaxErrorMessageLen bytes is
+// truncated. Replies to a Conn configured with WithCorrelation must have their
+// correlation value set by the caller.
+func ComposeError(inReplyTo *IMsg, code uint32, msg string) (*IMsg, error) {
+	if len(msg) > MaxErrorMessageLen {
+		msg = msg[:MaxErrorMessageLen]
+	}
+
+	data := make([]byte, errorReplyHeaderLen+len(msg))
+	endianness.PutUint32(data[0:4], inReplyTo.Type)
+	endianness.PutUint32(data[4:8], code)
+	copy(data[errorReplyHeaderLen:], msg)
+
+	return ComposeIMsg(TypeError, inReplyTo.PeerID, data)
+}
+
+// AsError returns the error reported by an error reply, or false if im isn't a
+// well-formed error reply.
+func AsError(im *IMsg) (*RemoteError, bool) {
+	if im.Type != TypeError {
+		return nil, false
+	}
+	if len(im.Data) < errorReplyHeaderLen || len(im.Data) > errorReplyHeaderLen+MaxErrorMessageLen {
+		return nil, false
+	}
+
+	return &RemoteError{
+		Type:    endianness.Uint32(im.Data[0:4]),
+		Code:    endianness.Uint32(im.Data[4:8]),
+		Message: string(im.Data[errorReplyHeaderLen:]),
+	}, true
+}
+
+// isErrorReplyTo reports whether im is an error reply to a request of type typ.
+func isErrorReplyTo(im *IMsg, typ uint32) bool {
+	re, ok := AsError(im)
+	return ok && re.Type == typ
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestErrorReply(t *testing.T) {
+	req := &IMsg{Type: 7, PeerID: 42}
+	capped := strings.Repeat("x", MaxErrorMessageLen)
+
+	tests := []struct {
+		name string
+		msg  string
+		want string
+	}{
+		{"empty", "", ""},
+		{"short", "no such file", "no such file"},
+		{"at cap", capped, capped},
+		{"over cap", capped + "y", capped},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			im, err := ComposeError(req, 2, test.msg)
+			if err != nil {
+				t.Fatalf("unexpected ComposeError failure: %s", err)
+			}
+			if im.Type != TypeError || im.PeerID != req.PeerID {
+				t.Fatalf("unexpected error reply header (%d, %d)", im.Type, im.PeerID)
+			}
+
+			// Round trip the reply through its wire format.
+			buf, err := im.MarshalBinary()
+			if err != nil {
+				t.Fatalf("unexpected MarshalBinary failure: %s", err)
+			}
+			var out IMsg
+			err = out.UnmarshalBinary(buf)
+			if err != nil {
+				t.Fatalf("unexpected UnmarshalBinary failure: %s", err)
+			}
+
+			re, ok := AsError(&out)
+			if !ok {
+				t.Fatalf("error reply not recognized")
+			}
+			if re.Type != req.Type || re.Code != 2 || re.Message != test.want {
+				t.Fatalf("unexpected RemoteError (%d, %d, %d bytes)", re.Type, re.Code, len(re.Message))
+			}
+		})
+	}
+}
+
+func TestAsErrorMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		im   *IMsg
+	}{
+		{"other type", &IMsg{Type: 1, Data: make([]byte, errorReplyHeaderLen)}},
+		{"truncated", &IMsg{Type: TypeError, Data: make([]byte, errorReplyHeaderLen-1)}},
+		{"oversized", &IMsg{Type: TypeError, Data: make([]byte, errorReplyHeaderLen+MaxErrorMessageLen+1)}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if re, ok := AsError(test.im); ok {
+				t.Fatalf("unexpected RemoteError (%v)", re)
+			}
+		})
+	}
+}
+
+func TestRemoteErrorString(t *testing.T) {
+	re := &RemoteError{Type: 1, Code: 2, Message: "denied"}
+	if !strings.HasSuffix(re.Error(), ": denied") {
+		t.Fatalf("unexpected error string (%q)", re.Error())
+	}
+}
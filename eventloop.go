@@ -0,0 +1,219 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"syscall"
+)
+
+var (
+	// ErrAlreadyAdded is returned by EventLoop.Add for a Conn which has already
+	// been added to an EventLoop.
+	ErrAlreadyAdded = errors.New("imsg: connection already added to an event loop")
+
+	// ErrLoopRunning is returned by EventLoop.Run if the loop is already
+	// running.
+	ErrLoopRunning = errors.New("imsg: event loop already running")
+)
+
+// This is the most imsgs an EventLoop receives from a single Conn before
+// attending to the others.
+const maxLoopRecvs = 64
+
+// Handlers are the callbacks through which an EventLoop reports activity on a
+// Conn. Each is called on the loop's goroutine, so a handler which blocks holds
+// up every Conn on the loop. Any of them may be nil.
+type Handlers struct {
+	// OnMessage is called with each imsg received, which the handler then
+	// owns, along with any attached file. If OnMessage is nil, received imsgs
+	// are discarded.
+	OnMessage func(c *Conn, im *IMsg)
+
+	// OnWritable is called once everything queued has been written after the
+	// socket stopped accepting writes, so that a sender holding back imsgs
+	// while the peer catches up knows when to resume.
+	OnWritable func(c *Conn)
+
+	// OnError is called when receiving from or writing to the Conn fails,
+	// with io.EOF once the peer has closed the connection, or with
+	// net.ErrClosed once the Conn has been closed. The Conn has been removed
+	// from the loop by the time OnError is called, but isn't closed.
+	OnError func(c *Conn, err error)
+}
+
+// An EventLoop drives any number of Conns from a single goroutine, as an
+// alternative to dedicating goroutines to each one. Run waits for the Conns'
+// sockets to become readable or writable with a single poll, receiving imsgs as
+// they arrive and writing those sent as the sockets accept them, and reports
+// what happens through each Conn's Handlers.
+//
+// While a Conn is added to a loop, Send queues imsgs without writing them,
+// leaving them for the loop, so that a peer which reads slowly never blocks
+// the sender or the loop, and imsgs must only be received by way of OnMessage.
+// Conns may be added and removed at any time, including from within a
+// handler. An EventLoop doesn't take ownership of its Conns, which remain
+// usable once removed. Only Conns over unix domain sockets can be added.
+type EventLoop struct {
+	mu      sync.Mutex
+	conns   map[*Conn]*loopConn
+	running bool
+	wakefd  int // Write end of the loop's wakeup pipe while running, or -1
+}
+
+// A loopConn tracks a Conn added to an EventLoop.
+type loopConn struct {
+	h  Handlers
+	rc syscall.RawConn
+
+	fresh   bool // Whether the Conn should be read without waiting
+	blocked bool // Whether the socket stopped accepting writes
+}
+
+// NewEventLoop constructs an EventLoop without any Conns.
+func NewEventLoop() *EventLoop {
+	return &EventLoop{conns: make(map[*Conn]*loopConn), wakefd: -1}
+}
+
+// Add starts driving c with the loop, reporting its activity through the
+// provided handlers. Imsgs which were queued or buffered by c beforehand are
+// picked up by the loop. ErrAlreadyAdded is returned if c is already driven by
+// an EventLoop, and ErrUnsupported if c isn't over a unix domain socket.
+func (l *EventLoop) Add(c *Conn, h Handlers) error {
+	if c.uc == nil {
+		return &ErrUnsupported{"event loops over connections other than unix domain sockets"}
+	}
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	if !c.loop.CompareAndSwap(nil, l) {
+		return ErrAlreadyAdded
+	}
+
+	l.mu.Lock()
+	l.conns[c] = &loopConn{h: h, rc: rc, fresh: true}
+	l.mu.Unlock()
+	l.wake()
+
+	return nil
+}
+
+// Remove stops driving c with the loop, reporting whether it had been added.
+// Imsgs which remain queued are written by the next Send or Flush. If Remove
+// is called from another goroutine while the loop is calling one of c's
+// handlers, that call may complete after Remove returns.
+func (l *EventLoop) Remove(c *Conn) bool {
+	l.mu.Lock()
+	_, ok := l.conns[c]
+	delete(l.conns, c)
+	l.mu.Unlock()
+
+	if ok {
+		c.loop.CompareAndSwap(l, nil)
+		l.wake()
+	}
+
+	return ok
+}
+
+// registered reports whether lc still tracks c on the loop.
+func (l *EventLoop) registered(c *Conn, lc *loopConn) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.conns[c] == lc
+}
+
+// snapshot returns the Conns on the loop.
+func (l *EventLoop) snapshot() ([]*Conn, []*loopConn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	conns := make([]*Conn, 0, len(l.conns))
+	lcs := make([]*loopConn, 0, len(l.conns))
+	for c, lc := range l.conns {
+		conns = append(conns, c)
+		lcs = append(lcs, lc)
+	}
+
+	return conns, lcs
+}
+
+// fail removes c from the loop and reports err to its OnError handler, unless
+// it has already been removed.
+func (l *EventLoop) fail(c *Conn, lc *loopConn, err error) {
+	l.mu.Lock()
+	if l.conns[c] != lc {
+		l.mu.Unlock()
+		return
+	}
+	delete(l.conns, c)
+	l.mu.Unlock()
+
+	c.loop.CompareAndSwap(l, nil)
+	if lc.h.OnError != nil {
+		lc.h.OnError(c, err)
+	}
+}
+
+// handle receives whatever has arrived for c if it's readable, and then writes
+// whatever is queued for it if its socket may accept it.
+func (l *EventLoop) handle(c *Conn, lc *loopConn, readable, writable bool) {
+	if c.closed.Load() {
+		l.fail(c, lc, net.ErrClosed)
+		return
+	}
+
+	if readable || lc.fresh {
+		lc.fresh = false
+		for i := 0; ; i++ {
+			if !l.registered(c, lc) {
+				return
+			}
+			if i == maxLoopRecvs {
+				// The rest is picked up on the next pass.
+				lc.fresh = true
+				break
+			}
+
+			im, err := c.TryRecv()
+			if err != nil {
+				l.fail(c, lc, err)
+				return
+			}
+			if im == nil {
+				break
+			}
+
+			if lc.h.OnMessage != nil {
+				lc.h.OnMessage(c, im)
+			} else {
+				im.Close()
+			}
+		}
+	}
+
+	if (writable || !lc.blocked) && c.wq.QueueLen() > 0 && l.registered(c, lc) {
+		_, err := c.wq.TryFlush()
+		if err == ErrWouldBlock {
+			lc.blocked = true
+			return
+		}
+		if err != nil {
+			l.fail(c, lc, err)
+			return
+		}
+		if lc.blocked {
+			lc.blocked = false
+			if lc.h.OnWritable != nil {
+				lc.h.OnWritable(c)
+			}
+		}
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build !unix
+
+package imsg
+
+import "context"
+
+// Run is unsupported on this platform.
+func (l *EventLoop) Run(ctx context.Context) error {
+	return &ErrUnsupported{"event loops"}
+}
+
+// wake does nothing, as the loop can't run on this platform.
+func (l *EventLoop) wake() {}
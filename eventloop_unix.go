@@ -0,0 +1,160 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"context"
+	"os"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Run drives the loop's Conns until the context is done, at which point it
+// returns the context's error. Conns remain added once Run returns, and Run may
+// be called again to resume driving them; in the meantime, imsgs sent over
+// them stay queued. ErrLoopRunning is returned if the loop is already running.
+func (l *EventLoop) Run(ctx context.Context) error {
+	var p [2]int
+	err := unix.Pipe(p[:])
+	if err != nil {
+		return os.NewSyscallError("pipe", err)
+	}
+	for _, fd := range p {
+		unix.CloseOnExec(fd)
+		unix.SetNonblock(fd, true)
+	}
+
+	l.mu.Lock()
+	if l.running {
+		l.mu.Unlock()
+		unix.Close(p[0])
+		unix.Close(p[1])
+		return ErrLoopRunning
+	}
+	l.running = true
+	l.wakefd = p[1]
+	l.mu.Unlock()
+
+	defer func() {
+		l.mu.Lock()
+		l.running = false
+		l.wakefd = -1
+		l.mu.Unlock()
+		unix.Close(p[0])
+		unix.Close(p[1])
+	}()
+
+	stop := context.AfterFunc(ctx, l.wake)
+	defer stop()
+
+	for ctx.Err() == nil {
+		err := l.poll(p[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	return ctx.Err()
+}
+
+// wake interrupts the loop's poll, if it's running, so that changes to its
+// Conns are noticed.
+func (l *EventLoop) wake() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.wakefd >= 0 {
+		// If the pipe is full, a wakeup is already pending.
+		unix.Write(l.wakefd, []byte{0})
+	}
+}
+
+// poll waits for the wakeup pipe or any of the loop's Conns to need attention,
+// and then attends to them.
+func (l *EventLoop) poll(wakefd int) error {
+	conns, lcs := l.snapshot()
+
+	fds := make([]unix.PollFd, len(conns)+1)
+	fds[0] = unix.PollFd{Fd: int32(wakefd), Events: unix.POLLIN}
+	rcs := make([]syscall.RawConn, len(conns))
+	timeout := -1
+	for i, c := range conns {
+		fds[i+1].Fd = -1
+		if c.closed.Load() || lcs[i].fresh {
+			timeout = 0
+		}
+		if c.closed.Load() {
+			continue
+		}
+
+		rcs[i] = lcs[i].rc
+		fds[i+1].Events = unix.POLLIN
+		if c.wq.QueueLen() > 0 {
+			fds[i+1].Events |= unix.POLLOUT
+		}
+	}
+
+	err := pollHeld(rcs, fds, timeout)
+	if err != nil {
+		return os.NewSyscallError("poll", err)
+	}
+
+	if fds[0].Revents != 0 {
+		var buf [64]byte
+		for {
+			n, err := unix.Read(wakefd, buf[:])
+			if n <= 0 || err != nil {
+				break
+			}
+		}
+	}
+
+	for i, c := range conns {
+		if !l.registered(c, lcs[i]) {
+			continue
+		}
+
+		rev := fds[i+1].Revents
+		readable := rev&(unix.POLLIN|unix.POLLHUP|unix.POLLERR|unix.POLLNVAL) != 0
+		writable := rev&(unix.POLLOUT|unix.POLLHUP|unix.POLLERR) != 0
+		l.handle(c, lcs[i], readable, writable)
+	}
+
+	return nil
+}
+
+// pollHeld polls fds, the first of which is the wakeup pipe and the rest of
+// which are filled in with the descriptors of rcs. Each descriptor is held open
+// for the duration of the poll, so that a Conn closed meanwhile can't have its
+// descriptor number reused before the poll returns. A nil RawConn, or one whose
+// connection has already been closed, is left out of the poll.
+func pollHeld(rcs []syscall.RawConn, fds []unix.PollFd, timeout int) error {
+	i := len(fds) - len(rcs) - 1
+	if len(rcs) == 0 {
+		for {
+			_, err := unix.Poll(fds, timeout)
+			if err != unix.EINTR {
+				return err
+			}
+		}
+	}
+	if rcs[0] == nil {
+		return pollHeld(rcs[1:], fds, timeout)
+	}
+
+	var perr error
+	err := rcs[0].Control(func(fd uintptr) {
+		fds[i+1].Fd = int32(fd)
+		perr = pollHeld(rcs[1:], fds, timeout)
+	})
+	if err != nil {
+		return pollHeld(rcs[1:], fds, timeout)
+	}
+
+	return perr
+}
@@ -0,0 +1,269 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// runTestEventLoop runs an EventLoop until the test completes. The loop stops
+// before any Conns constructed beforehand are cleaned up.
+func runTestEventLoop(t *testing.T) *EventLoop {
+	t.Helper()
+
+	l := NewEventLoop()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- l.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	return l
+}
+
+// echoHandlers returns Handlers which send each imsg received back to the
+// peer.
+func echoHandlers(t *testing.T) Handlers {
+	return Handlers{
+		OnMessage: func(c *Conn, im *IMsg) {
+			err := c.Send(im)
+			if err != nil {
+				t.Errorf("unexpected Send failure: %s", err)
+			}
+		},
+	}
+}
+
+func TestEventLoopExchange(t *testing.T) {
+	a1, b1 := newTestSocketPair(t)
+	a2, b2 := newTestSocketPair(t)
+	l := runTestEventLoop(t)
+
+	for _, c := range []*Conn{a1, a2} {
+		err := l.Add(c, echoHandlers(t))
+		if err != nil {
+			t.Fatalf("unexpected Add failure: %s", err)
+		}
+	}
+	err := l.Add(a1, Handlers{})
+	if err != ErrAlreadyAdded {
+		t.Fatalf("expected ErrAlreadyAdded, got: %v", err)
+	}
+
+	for typ := uint32(0); typ < 10; typ++ {
+		for _, b := range []*Conn{b1, b2} {
+			err := b.Send(&IMsg{Type: typ, Data: []byte("echo")})
+			if err != nil {
+				t.Fatalf("unexpected Send failure: %s", err)
+			}
+			im, err := b.Recv()
+			if err != nil || im.Type != typ || string(im.Data) != "echo" {
+				t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+			}
+		}
+	}
+
+	// Once removed, a Conn is left alone by the loop.
+	if !l.Remove(a2) {
+		t.Fatalf("Remove did not find an added Conn")
+	}
+	if l.Remove(a2) {
+		t.Fatalf("Remove found a removed Conn")
+	}
+	err = b2.Send(&IMsg{Type: 100})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	im, err := a2.Recv()
+	if err != nil || im.Type != 100 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+
+	// An imsg which arrived before the Conn was added is picked up.
+	err = b2.Send(&IMsg{Type: 101})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	err = l.Add(a2, echoHandlers(t))
+	if err != nil {
+		t.Fatalf("unexpected Add failure: %s", err)
+	}
+	im, err = b2.Recv()
+	if err != nil || im.Type != 101 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+}
+
+func TestEventLoopSlowPeer(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	c, d := newTestSocketPair(t)
+	l := runTestEventLoop(t)
+
+	var writable atomic.Int32
+	err := l.Add(a, Handlers{
+		OnWritable: func(*Conn) { writable.Add(1) },
+		OnError:    func(_ *Conn, err error) { t.Errorf("unexpected loop failure: %s", err) },
+	})
+	if err != nil {
+		t.Fatalf("unexpected Add failure: %s", err)
+	}
+	err = l.Add(c, echoHandlers(t))
+	if err != nil {
+		t.Fatalf("unexpected Add failure: %s", err)
+	}
+
+	// Far more is sent than the socket can hold, which doesn't block the
+	// sender.
+	const count = 400
+	data := make([]byte, 8192)
+	for typ := uint32(0); typ < count; typ++ {
+		err := a.Send(&IMsg{Type: typ, Data: data})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+	if a.wq.QueueLen() == 0 {
+		t.Fatalf("nothing was left queued for the loop")
+	}
+
+	// The loop continues to serve other Conns while the peer isn't reading.
+	time.Sleep(20 * time.Millisecond)
+	err = d.Send(&IMsg{Type: 1})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	im, err := d.RecvTimeout(time.Second)
+	if err != nil || im.Type != 1 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+	if writable.Load() != 0 {
+		t.Fatalf("OnWritable was called while the peer wasn't reading")
+	}
+
+	for typ := uint32(0); typ < count; typ++ {
+		if typ%50 == 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+		im, err := b.Recv()
+		if err != nil || im.Type != typ || len(im.Data) != len(data) {
+			t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+		}
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for writable.Load() == 0 || a.wq.QueueLen() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("OnWritable was not called once the queue drained")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestEventLoopErrors(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	c, _ := newTestSocketPair(t)
+	l := runTestEventLoop(t)
+
+	errs := make(chan error, 2)
+	h := Handlers{OnError: func(_ *Conn, err error) { errs <- err }}
+	for _, conn := range []*Conn{a, c} {
+		err := l.Add(conn, h)
+		if err != nil {
+			t.Fatalf("unexpected Add failure: %s", err)
+		}
+	}
+
+	b.Close()
+	select {
+	case err := <-errs:
+		if err != io.EOF {
+			t.Fatalf("expected io.EOF, got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("peer closure was not reported")
+	}
+	if l.Remove(a) {
+		t.Fatalf("failed Conn was not removed")
+	}
+
+	closed := make(chan struct{})
+	go func() {
+		c.Close()
+		close(closed)
+	}()
+	select {
+	case err := <-errs:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Fatalf("expected net.ErrClosed, got: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("closure was not reported")
+	}
+	<-closed
+
+	pa, pb := net.Pipe()
+	defer pb.Close()
+	err := l.Add(NewStreamConn(pa), Handlers{})
+	var unsupported *ErrUnsupported
+	if !errors.As(err, &unsupported) {
+		t.Fatalf("expected ErrUnsupported, got: %v", err)
+	}
+}
+
+func TestEventLoopShutdown(t *testing.T) {
+	l := NewEventLoop()
+	a, b := newTestSocketPair(t)
+
+	received := make(chan *IMsg, 1)
+	err := l.Add(a, Handlers{OnMessage: func(_ *Conn, im *IMsg) { received <- im }})
+	if err != nil {
+		t.Fatalf("unexpected Add failure: %s", err)
+	}
+
+	for round := 0; round < 2; round++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- l.Run(ctx)
+		}()
+
+		err := b.Send(&IMsg{Type: uint32(round)})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+		im := <-received
+		if im.Type != uint32(round) {
+			t.Fatalf("unexpected imsg received (type %d)", im.Type)
+		}
+
+		err = l.Run(ctx)
+		if err != ErrLoopRunning {
+			t.Fatalf("expected ErrLoopRunning, got: %v", err)
+		}
+
+		cancel()
+		select {
+		case err := <-done:
+			if err != context.Canceled {
+				t.Fatalf("expected context.Canceled, got: %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Run did not return once cancelled")
+		}
+	}
+}
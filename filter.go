@@ -0,0 +1,58 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+// A FilterAction tells a Conn what to do with a received imsg.
+type FilterAction int
+
+const (
+	// Accept delivers the imsg as usual.
+	Accept FilterAction = iota
+	// Drop discards the imsg silently, closing any attached file.
+	Drop
+	// Reject discards the imsg, closing any attached file, and reports
+	// ErrRejected to the reader.
+	Reject
+)
+
+// A recvFilter holds the function set by SetRecvFilter.
+type recvFilter struct {
+	f func(*IMsg) FilterAction
+}
+
+// SetRecvFilter sets a function which is consulted for every imsg received by
+// the Conn before it's delivered by Recv, Call, or Serve, replacing any
+// previously set function. A nil function accepts everything. The function is
+// called while the Conn is reading, so it must not itself read from the Conn.
+func (c *Conn) SetRecvFilter(f func(*IMsg) FilterAction) {
+	if f == nil {
+		c.filter.Store(nil)
+		return
+	}
+
+	c.filter.Store(&recvFilter{f})
+}
+
+// applyFilter consults the receive filter about an imsg, returning whether it
+// should be delivered. A dropped or rejected imsg has its attached file closed.
+func (c *Conn) applyFilter(im *IMsg) (bool, error) {
+	rf := c.filter.Load()
+	if rf == nil {
+		return true, nil
+	}
+
+	switch rf.f(im) {
+	case Drop:
+		c.recvd.filtered.Add(1)
+		im.closeFile()
+		return false, nil
+	case Reject:
+		c.recvd.filtered.Add(1)
+		im.closeFile()
+		return false, &ErrRejected{im.Type}
+	}
+
+	return true, nil
+}
@@ -0,0 +1,115 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+const (
+	testTypeKeepalive = 10
+	testTypeForbidden = 11
+)
+
+func testRecvFilter(im *IMsg) FilterAction {
+	switch im.Type {
+	case testTypeKeepalive:
+		return Drop
+	case testTypeForbidden:
+		return Reject
+	}
+	return Accept
+}
+
+func TestConnRecvFilter(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	a.AllowFDPass(true)
+	b.AllowFDPass(true)
+	b.SetRecvFilter(testRecvFilter)
+
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("failed to open %s: %s", os.DevNull, err)
+	}
+	dropped, _ := ComposeIMsgWithFile(testTypeKeepalive, 0, nil, f)
+	for _, im := range []*IMsg{dropped, {Type: 1}, {Type: testTypeForbidden}, {Type: 2}} {
+		err = a.Send(im)
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+
+	im, err := b.Recv()
+	if err != nil || im.Type != 1 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+
+	var er *ErrRejected
+	_, err = b.Recv()
+	if !errors.As(err, &er) || er.Type != testTypeForbidden {
+		t.Fatalf("expected ErrRejected, got: %v", err)
+	}
+
+	im, err = b.Recv()
+	if err != nil || im.Type != 2 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+
+	// Removing the filter delivers everything.
+	b.SetRecvFilter(nil)
+	a.Send(&IMsg{Type: testTypeKeepalive})
+	im, err = b.Recv()
+	if err != nil || im.Type != testTypeKeepalive {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+}
+
+func TestConnRecvFilterServeAndCall(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	b.SetRecvFilter(testRecvFilter)
+
+	go func() {
+		q, err := a.Recv()
+		if err != nil {
+			return
+		}
+		// The keepalive carries the correlation value of the reply, but is
+		// dropped before Call can see it.
+		a.Send(&IMsg{Type: testTypeKeepalive, PeerID: q.PeerID})
+		a.Send(&IMsg{Type: testTypeReply, PeerID: q.PeerID})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reply, err := b.Call(ctx, &IMsg{Type: testTypeQuery}, testTypeReply)
+	if err != nil || reply.Type != testTypeReply {
+		t.Fatalf("unexpected Call result (%v, %v)", reply, err)
+	}
+
+	var seen []uint32
+	m := NewMux()
+	m.HandleDefault(func(im *IMsg) error {
+		seen = append(seen, im.Type)
+		return nil
+	})
+	for _, typ := range []uint32{testTypeKeepalive, 1, testTypeKeepalive, 2} {
+		a.Send(&IMsg{Type: typ})
+	}
+	a.Close()
+
+	err = Serve(context.Background(), b, m)
+	if err != nil {
+		t.Fatalf("unexpected Serve failure: %s", err)
+	}
+	if len(seen) != 2 || seen[0] != 1 || seen[1] != 2 {
+		t.Fatalf("filtered imsgs reached the handler (%v)", seen)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Flags is the flags word of an imsg header. Bits which the library doesn't
+// know are carried through decoding and encoding untouched, so that forwarded
+// imsgs are bit-identical to those received.
+type Flags uint16
+
+// These are the flags managed by the library itself, which SetFlags leaves
+// alone.
+const reservedFlags = FlagHasFD | FlagCompressed
+
+// This names the known flags, in the order String prints them.
+var flagNames = []struct {
+	flag Flags
+	name string
+}{
+	{FlagHasFD, "hasfd"},
+	{FlagCompressed, "compressed"},
+}
+
+// Has reports whether all of the bits of flag are set.
+func (f Flags) Has(flag Flags) bool {
+	return f&flag == flag
+}
+
+// String returns the names of the known flags which are set, separated by "|",
+// followed by any unknown bits in hex. No flags at all print as "0".
+func (f Flags) String() string {
+	if f == 0 {
+		return "0"
+	}
+
+	var names []string
+	for _, fn := range flagNames {
+		if f.Has(fn.flag) {
+			names = append(names, fn.name)
+			f &^= fn.flag
+		}
+	}
+	if f != 0 {
+		names = append(names, "0x"+strconv.FormatUint(uint64(f), 16))
+	}
+
+	return strings.Join(names, "|")
+}
+
+// Flags returns the flags word of the imsg's header, including any bits which
+// the library doesn't know.
+func (im *IMsg) Flags() Flags {
+	return im.flags
+}
+
+// SetFlags sets the bits of the imsg's flags word which applications are free
+// to use. The bits managed by the library, FlagHasFD and FlagCompressed, are
+// ignored in f and keep their current values, as they follow the attachment of
+// a file and the compression of the data.
+func (im *IMsg) SetFlags(f Flags) {
+	im.flags = im.flags&reservedFlags | f&^reservedFlags
+}
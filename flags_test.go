@@ -0,0 +1,96 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestFlagsString(t *testing.T) {
+	tests := []struct {
+		flags Flags
+		want  string
+	}{
+		{0, "0"},
+		{FlagHasFD, "hasfd"},
+		{FlagHasFD | FlagCompressed, "hasfd|compressed"},
+		{FlagCompressed | 0x0110, "compressed|0x110"},
+		{0x0002, "0x2"},
+	}
+
+	for _, test := range tests {
+		if got := test.flags.String(); got != test.want {
+			t.Errorf("unexpected String result for %#04x (%q != %q)", uint16(test.flags), got, test.want)
+		}
+	}
+
+	f := FlagHasFD | 0x0100
+	if !f.Has(FlagHasFD) || !f.Has(FlagHasFD|0x0100) || f.Has(FlagCompressed) || f.Has(FlagHasFD|FlagCompressed) {
+		t.Fatalf("unexpected Has results for %s", f)
+	}
+}
+
+func TestSetFlags(t *testing.T) {
+	im := &IMsg{Type: 1, flags: FlagHasFD}
+
+	// The bits managed by the library are left as they were.
+	im.SetFlags(0x0110 | FlagCompressed)
+	if im.Flags() != FlagHasFD|0x0110 {
+		t.Fatalf("unexpected flags after SetFlags (%s)", im.Flags())
+	}
+	im.SetFlags(0)
+	if im.Flags() != FlagHasFD {
+		t.Fatalf("unexpected flags after SetFlags (%s)", im.Flags())
+	}
+}
+
+func TestFlagsRoundTrip(t *testing.T) {
+	// Every flag pattern survives decoding and encoding untouched, so that a
+	// forwarded frame is bit-identical to the one received.
+	patterns := []Flags{0, 0xffff, 0x5555, 0xaaaa, FlagHasFD, FlagCompressed, 0x0100}
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 64; i++ {
+		patterns = append(patterns, Flags(rng.Intn(1<<16)))
+	}
+
+	for _, flags := range patterns {
+		src := &IMsg{Type: 1, PeerID: 2, PID: 3, Data: []byte("test"), flags: flags}
+		frame, err := src.MarshalBinary()
+		if err != nil {
+			t.Fatalf("unexpected MarshalBinary failure: %s", err)
+		}
+
+		var im IMsg
+		err = im.UnmarshalBinary(frame)
+		if err != nil {
+			t.Fatalf("unexpected UnmarshalBinary failure: %s", err)
+		}
+		if im.Flags() != flags {
+			t.Fatalf("flags changed by UnmarshalBinary (%#04x != %#04x)", uint16(im.Flags()), uint16(flags))
+		}
+		again, err := im.MarshalBinary()
+		if err != nil {
+			t.Fatalf("unexpected MarshalBinary failure: %s", err)
+		}
+		if !bytes.Equal(again, frame) {
+			t.Fatalf("frame with flags %#04x changed by a round trip (% x != % x)", uint16(flags), again, frame)
+		}
+
+		var buf bytes.Buffer
+		decoded, err := NewDecoder(bytes.NewReader(frame)).Decode()
+		if err != nil {
+			t.Fatalf("unexpected Decode failure: %s", err)
+		}
+		err = NewEncoder(&buf).Encode(decoded)
+		if err != nil {
+			t.Fatalf("unexpected Encode failure: %s", err)
+		}
+		if !bytes.Equal(buf.Bytes(), frame) {
+			t.Fatalf("frame with flags %#04x changed by a Decoder and Encoder (% x != % x)", uint16(flags), buf.Bytes(), frame)
+		}
+	}
+}
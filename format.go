@@ -0,0 +1,130 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// This is the number of bytes of ancillary data included in the preview
+// printed by the %+v verb.
+const formatPreviewBytes = 16
+
+// This has the fields of IMsg but none of its methods, which allows the
+// default Go-syntax representation to be produced.
+type plainIMsg IMsg
+
+// String returns a one-line summary of the imsg's header, with the type's
+// registered name if it has one. The ancillary data is never included, so the
+// result is safe to log even when the data may be sensitive. A nil IMsg
+// returns "<nil>".
+func (im *IMsg) String() string {
+	if im == nil {
+		return "<nil>"
+	}
+
+	typ := fmt.Sprintf("%#x", im.Type)
+	if name, ok := TypeName(im.Type); ok {
+		typ = name + "(" + typ + ")"
+	}
+
+	return fmt.Sprintf(
+		"imsg type=%s peer=%#x pid=%#x len=%d",
+		typ,
+		im.PeerID,
+		im.PID,
+		im.Len(),
+	)
+}
+
+// Format implements the fmt.Formatter interface. The %v and %s verbs print a
+// one-line summary of the header, including the type's registered name, and %+v
+// adds a preview of the ancillary data in hex. The %x and %X verbs print the
+// full wire encoding of the imsg, as produced by MarshalBinary, honoring flags
+// such as "% x". The %#v verb prints the usual Go-syntax representation. A nil
+// IMsg prints as "<nil>".
+func (im *IMsg) Format(f fmt.State, verb rune) {
+	if im == nil {
+		f.Write([]byte("<nil>"))
+		return
+	}
+
+	switch verb {
+	case 'v', 's':
+		if verb == 'v' && f.Flag('#') {
+			s := fmt.Sprintf("%#v", (*plainIMsg)(im))
+			f.Write([]byte(strings.Replace(s, "imsg.plainIMsg", "imsg.IMsg", 1)))
+			return
+		}
+
+		var b strings.Builder
+		b.WriteString("type=")
+		if name, ok := TypeName(im.Type); ok {
+			b.WriteString(name)
+			b.WriteString("(")
+			b.WriteString(strconv.FormatUint(uint64(im.Type), 10))
+			b.WriteString(")")
+		} else {
+			b.WriteString(strconv.FormatUint(uint64(im.Type), 10))
+		}
+		b.WriteString(" peer=")
+		b.WriteString(strconv.FormatUint(uint64(im.PeerID), 10))
+		b.WriteString(" pid=")
+		b.WriteString(strconv.FormatUint(uint64(im.PID), 10))
+		b.WriteString(" len=")
+		b.WriteString(strconv.Itoa(im.Len()))
+		if im.HasFD() {
+			b.WriteString(" fd")
+		}
+		if verb == 'v' && f.Flag('+') {
+			b.WriteString(" data=")
+			if len(im.Data) > formatPreviewBytes {
+				b.WriteString(hex.EncodeToString(im.Data[:formatPreviewBytes]))
+				b.WriteString("...")
+			} else {
+				b.WriteString(hex.EncodeToString(im.Data))
+			}
+		}
+		f.Write([]byte(b.String()))
+
+	case 'x', 'X':
+		bs, err := im.marshalBinary(math.MaxUint16)
+		if err != nil {
+			fmt.Fprintf(f, "%%!%c(%s)", verb, err)
+			return
+		}
+		fmt.Fprintf(f, formatDirective(f, verb), bs)
+
+	default:
+		fmt.Fprintf(f, "%%!%c(*imsg.IMsg)", verb)
+	}
+}
+
+// formatDirective reconstructs the formatting directive described by f and
+// verb.
+func formatDirective(f fmt.State, verb rune) string {
+	var b strings.Builder
+
+	b.WriteByte('%')
+	for _, flag := range " #+-0" {
+		if f.Flag(int(flag)) {
+			b.WriteRune(flag)
+		}
+	}
+	if w, ok := f.Width(); ok {
+		b.WriteString(strconv.Itoa(w))
+	}
+	if p, ok := f.Precision(); ok {
+		b.WriteByte('.')
+		b.WriteString(strconv.Itoa(p))
+	}
+	b.WriteRune(verb)
+
+	return b.String()
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestFormat(t *testing.T) {
+	im := &IMsg{Type: 42, PeerID: 7, PID: 1234, Data: []byte("test")}
+	long := &IMsg{Type: 1, Data: []byte("0123456789abcdefXYZ"), flags: FlagHasFD}
+
+	var nilIMsg *IMsg
+
+	var tests = []struct {
+		name     string
+		format   string
+		value    any
+		expected string
+	}{
+		{"summary", "%v", im, "type=42 peer=7 pid=1234 len=20"},
+		{"string", "%s", im, "type=42 peer=7 pid=1234 len=20"},
+		{"preview", "%+v", im, "type=42 peer=7 pid=1234 len=20 data=74657374"},
+		{"truncated preview", "%+v", long, "type=1 peer=0 pid=0 len=35 fd data=30313233343536373839616263646566..."},
+	}
+
+	if endianness == binary.LittleEndian {
+		tests = append(tests, []struct {
+			name     string
+			format   string
+			value    any
+			expected string
+		}{
+			{"hex", "%x", im, "2a0000001400000007000000d204000074657374"},
+			{"spaced hex", "% x", im, "2a 00 00 00 14 00 00 00 07 00 00 00 d2 04 00 00 74 65 73 74"},
+			{"upper hex", "%X", im, "2A0000001400000007000000D204000074657374"},
+		}...)
+	}
+
+	tests = append(tests, []struct {
+		name     string
+		format   string
+		value    any
+		expected string
+	}{
+		{"nil summary", "%v", nilIMsg, "<nil>"},
+		{"nil hex", "%x", nilIMsg, "<nil>"},
+		{"bad verb", "%d", im, "%!d(*imsg.IMsg)"},
+	}...)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := fmt.Sprintf(tt.format, tt.value)
+			if s != tt.expected {
+				t.Fatalf("formatted output does not match expected output (%q != %q)", s, tt.expected)
+			}
+		})
+	}
+
+	// Go syntax covers the unexported fields as well, which come after the
+	// exported ones, so only the latter are checked.
+	s := fmt.Sprintf("%#v", &IMsg{Type: 1, Data: []byte{0xff}})
+	const goSyntax = "&imsg.IMsg{Type:0x1, PeerID:0x0, PID:0x0, Data:[]uint8{0xff}, "
+	if !strings.HasPrefix(s, goSyntax) {
+		t.Fatalf("Go syntax output does not begin with the exported fields (%q)", s)
+	}
+}
+
+func TestString(t *testing.T) {
+	var nilIMsg *IMsg
+
+	var tests = []struct {
+		name     string
+		im       *IMsg
+		expected string
+	}{
+		{"nil", nilIMsg, "<nil>"},
+		{"empty", &IMsg{}, "imsg type=0x0 peer=0x0 pid=0x0 len=16"},
+		{
+			"with data",
+			&IMsg{Type: 0xff, PeerID: 0xee, PID: 0xdd, Data: []byte("secret")},
+			"imsg type=0xff peer=0xee pid=0xdd len=22",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := tt.im.String()
+			if s != tt.expected {
+				t.Fatalf("string does not match expected output (%q != %q)", s, tt.expected)
+			}
+		})
+	}
+}
+
+func TestFormatSummaryDoesNotMarshal(t *testing.T) {
+	im := &IMsg{Type: 1, Data: make([]byte, MaxSizeInBytes-HeaderSizeInBytes)}
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for i := 0; i < 100; i++ {
+		fmt.Fprintf(io.Discard, "%v", im)
+	}
+	runtime.ReadMemStats(&after)
+
+	// Marshaling would allocate the full imsg on each iteration.
+	if after.TotalAlloc-before.TotalAlloc > 100*MaxSizeInBytes/4 {
+		t.Fatalf("formatting a summary allocated too much (%d bytes)", after.TotalAlloc-before.TotalAlloc)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+	"os"
+)
+
+// Forward sends an imsg exactly as it was received, typically from another
+// Conn, for brokers which relay imsgs between peers. This is the equivalent of
+// imsg_forward. The imsg's type, peer ID, PID, data, and flags are all
+// preserved, and its data is never compressed, even if compression is enabled
+// with WithCompression. As with Send, the attached file, if any, is passed
+// alongside the imsg and is then owned by the Conn, which requires descriptor
+// passing to be allowed with AllowFDPass. An imsg whose attached file has
+// already been closed is refused with ErrFileClosed, and one with the has-fd
+// flag set but no file attached with ErrNoAttachment.
+func (c *Conn) Forward(im *IMsg) error {
+	if im.file != nil && !isOpen(im.file) {
+		return &ErrFileClosed{im.Type}
+	}
+
+	return c.send(context.Background(), im, true)
+}
+
+// Forward sends an imsg to dst exactly as it was received. See Conn.Forward.
+func Forward(dst *Conn, im *IMsg) error {
+	return dst.Forward(im)
+}
+
+// isOpen reports whether f hasn't yet been closed.
+func isOpen(f *os.File) bool {
+	rc, err := f.SyscallConn()
+	if err != nil {
+		return false
+	}
+
+	return rc.Control(func(uintptr) {}) == nil
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestForward(t *testing.T) {
+	sender, relayIn := newTestSocketPair(t)
+	relayOut, receiver := newTestSocketPair(t)
+	for _, c := range []*Conn{sender, relayIn, relayOut, receiver} {
+		c.AllowFDPass(true)
+	}
+	// The relay's compression mustn't alter the forwarded data.
+	relayOut = rewrapTestConn(t, relayOut, WithCompression(0))
+	relayOut.AllowFDPass(true)
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %s", err)
+	}
+	defer pr.Close()
+
+	data := make([]byte, 1024)
+	im, _ := ComposeIMsg(1, 2, data, WithFile(pw), WithPID(3))
+	im.flags |= 0x10
+	err = sender.Send(im)
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+
+	relayed, err := relayIn.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	err = Forward(relayOut, relayed)
+	if err != nil {
+		t.Fatalf("unexpected Forward failure: %s", err)
+	}
+
+	got, err := receiver.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	expected := &IMsg{Type: 1, PeerID: 2, PID: 3, Data: data, flags: 0x10 | FlagHasFD}
+	if !got.Equal(expected) {
+		t.Fatalf("forwarded imsg does not match (%v != %v)", got, expected)
+	}
+	if got.File() == nil {
+		t.Fatalf("forwarded imsg is missing its descriptor")
+	}
+
+	// The descriptor refers to the original pipe.
+	_, err = got.File().Write([]byte("relayed"))
+	got.File().Close()
+	if err != nil {
+		t.Fatalf("failed to write to forwarded descriptor: %s", err)
+	}
+	buf := make([]byte, 7)
+	_, err = io.ReadFull(pr, buf)
+	if err != nil || string(buf) != "relayed" {
+		t.Fatalf("unexpected pipe contents (%q, %v)", buf, err)
+	}
+}
+
+func TestForwardClosedFile(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	a.AllowFDPass(true)
+	b.AllowFDPass(true)
+
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("failed to open %s: %s", os.DevNull, err)
+	}
+	im, _ := ComposeIMsgWithFile(1, 2, nil, f)
+	err = a.Send(im)
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	im, err = b.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	im.File().Close()
+
+	err = b.Forward(im)
+	var efc *ErrFileClosed
+	if !errors.As(err, &efc) || efc.Type != 1 {
+		t.Fatalf("expected ErrFileClosed, got: %v", err)
+	}
+
+	err = b.Forward(&IMsg{Type: 2, flags: FlagHasFD})
+	var ena *ErrNoAttachment
+	if !errors.As(err, &ena) {
+		t.Fatalf("expected ErrNoAttachment, got: %v", err)
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"fmt"
+)
+
+// FragmentHeaderSizeInBytes is the size of the header which ComposeFragments
+// places at the start of the data of each fragment.
+const FragmentHeaderSizeInBytes = 16
+
+// This marks the data of an imsg as a fragment. It spells "IMFR".
+const fragmentMagic = 0x494d4652
+
+// ComposeFragments splits data which may be too large for a single imsg into
+// an ordered series of imsgs of the provided type, each no larger than maxFrag
+// bytes, header included. Each fragment's data begins with a header of
+// FragmentHeaderSizeInBytes holding its sequence number, the total number of
+// fragments, and the offset of its chunk within data, followed by the chunk.
+// The PID field of each fragment is filled in as with ComposeIMsg.
+//
+// Fragmentation is a convention of this package, not of imsg itself: a peer
+// using the C implementation sees the fragments as ordinary imsgs whose data
+// carries an unfamiliar header. It should only be used with peers which expect
+// it, such as those using a Reassembler.
+func ComposeFragments(
+	typ, peerID uint32,
+	data []byte,
+	maxFrag int,
+) ([]*IMsg, error) {
+	chunk := maxFrag - HeaderSizeInBytes - FragmentHeaderSizeInBytes
+	if chunk <= 0 || maxFrag > 0xffff {
+		return nil, &ErrFragment{
+			typ,
+			fmt.Sprintf("fragment size %d is out of bounds", maxFrag),
+		}
+	}
+
+	total := (len(data) + chunk - 1) / chunk
+	if total == 0 {
+		total = 1
+	}
+
+	pid := currentPID()
+	frags := make([]*IMsg, total)
+	for seq := range frags {
+		off := seq * chunk
+		end := off + chunk
+		if end > len(data) {
+			end = len(data)
+		}
+
+		fd := make([]byte, FragmentHeaderSizeInBytes+end-off)
+		endianness.PutUint32(fd[0:4], fragmentMagic)
+		endianness.PutUint32(fd[4:8], uint32(seq))
+		endianness.PutUint32(fd[8:12], uint32(total))
+		endianness.PutUint32(fd[12:16], uint32(off))
+		copy(fd[FragmentHeaderSizeInBytes:], data[off:end])
+
+		frags[seq] = &IMsg{Type: typ, PeerID: peerID, PID: pid, Data: fd}
+	}
+
+	return frags, nil
+}
+
+// This identifies a series of fragments being reassembled.
+type fragmentKey struct {
+	typ    uint32
+	peerID uint32
+}
+
+// This is a series of fragments which has been partially reassembled.
+type fragmentState struct {
+	next  uint32 // Sequence number of the next fragment expected
+	total uint32
+	data  []byte
+
+	acct    Accounting // Charged for each fragment's data, if set
+	charged []int      // Lengths acquired from acct, one per fragment
+}
+
+// A Reassembler reverses ComposeFragments, reassembling the data of series of
+// fragments as they're received. Series of fragments with differing types or
+// peer IDs may be interleaved, but the fragments of each series must arrive in
+// order. A Reassembler isn't safe for concurrent use.
+type Reassembler struct {
+	maxSize int
+	partial map[fragmentKey]*fragmentState
+	acct    Accounting
+}
+
+// NewReassembler constructs a Reassembler which refuses to reassemble more than
+// maxSize bytes of data from any series of fragments.
+func NewReassembler(maxSize int) *Reassembler {
+	return &Reassembler{
+		maxSize: maxSize,
+		partial: make(map[fragmentKey]*fragmentState),
+	}
+}
+
+// SetAccounting causes the Reassembler to acquire the data of each fragment it
+// retains from the provided Accounting, releasing it once the series of
+// fragments has been reassembled, and the data returned, or discarded. A
+// fragment whose data is refused is itself refused with ErrFragment, and its
+// partially reassembled series is discarded. Series begun before SetAccounting
+// is called aren't accounted for.
+func (r *Reassembler) SetAccounting(a Accounting) {
+	r.acct = a
+}
+
+// Add adds a received fragment to the Reassembler. Once the final fragment of a
+// series is added, the reassembled data is returned and done is true. An imsg
+// which doesn't carry a fragment header is refused with ErrFragment, as is a
+// fragment which duplicates one already added. A fragment which arrives out of
+// order, disagrees with the earlier fragments of its series, or takes the
+// series beyond the maximum size is refused with ErrFragment, and the partially
+// reassembled series is discarded.
+func (r *Reassembler) Add(im *IMsg) ([]byte, bool, error) {
+	if len(im.Data) < FragmentHeaderSizeInBytes ||
+		endianness.Uint32(im.Data[0:4]) != fragmentMagic {
+		return nil, false, &ErrFragment{im.Type, "missing fragment header"}
+	}
+
+	seq := endianness.Uint32(im.Data[4:8])
+	total := endianness.Uint32(im.Data[8:12])
+	off := endianness.Uint32(im.Data[12:16])
+	chunk := im.Data[FragmentHeaderSizeInBytes:]
+
+	if total == 0 || seq >= total {
+		return nil, false, &ErrFragment{
+			im.Type,
+			fmt.Sprintf("invalid sequence number %d of %d", seq, total),
+		}
+	}
+
+	key := fragmentKey{im.Type, im.PeerID}
+	st := r.partial[key]
+	if st == nil {
+		st = &fragmentState{total: total}
+	}
+
+	var reason string
+	switch {
+	case seq < st.next:
+		return nil, false, &ErrFragment{
+			im.Type,
+			fmt.Sprintf("duplicate fragment %d of %d", seq, total),
+		}
+	case seq > st.next:
+		reason = fmt.Sprintf("fragment %d arrived before fragment %d", seq, st.next)
+	case total != st.total:
+		reason = fmt.Sprintf("fragment count changed from %d to %d", st.total, total)
+	case int(off) != len(st.data):
+		reason = fmt.Sprintf("fragment %d has offset %d rather than %d", seq, off, len(st.data))
+	case len(st.data)+len(chunk) > r.maxSize:
+		reason = fmt.Sprintf("reassembled data exceeds %d bytes", r.maxSize)
+	}
+	if reason == "" && r.acct != nil && st.next == 0 {
+		st.acct = r.acct
+	}
+	if reason == "" && st.acct != nil {
+		if err := st.acct.Acquire(len(chunk)); err != nil {
+			reason = fmt.Sprintf("retaining %d more bytes refused: %s", len(chunk), err)
+		} else {
+			st.charged = append(st.charged, len(chunk))
+		}
+	}
+	if reason != "" {
+		st.discard()
+		delete(r.partial, key)
+		return nil, false, &ErrFragment{im.Type, reason}
+	}
+
+	st.data = append(st.data, chunk...)
+	st.next++
+	if st.next < st.total {
+		r.partial[key] = st
+		return nil, false, nil
+	}
+
+	st.discard()
+	delete(r.partial, key)
+	if st.data == nil {
+		st.data = []byte{}
+	}
+
+	return st.data, true, nil
+}
+
+// Pending returns the number of series of fragments which have been partially
+// reassembled.
+func (r *Reassembler) Pending() int {
+	return len(r.partial)
+}
+
+// Reset discards every partially reassembled series of fragments, such as once
+// the peer sending them has gone away.
+func (r *Reassembler) Reset() {
+	for key, st := range r.partial {
+		st.discard()
+		delete(r.partial, key)
+	}
+}
+
+// discard releases the data retained for the series to the Accounting it was
+// acquired from, if any.
+func (st *fragmentState) discard() {
+	for _, n := range st.charged {
+		st.acct.Release(n)
+	}
+	st.charged = nil
+}
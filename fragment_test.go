@@ -0,0 +1,160 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+)
+
+func TestFragmentRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	big := make([]byte, 3<<20)
+	rng.Read(big)
+
+	tests := []struct {
+		name    string
+		data    []byte
+		maxFrag int
+		count   int
+	}{
+		{"empty", nil, MaxSizeInBytes, 1},
+		{"single", []byte("test"), MaxSizeInBytes, 1},
+		{"exact", make([]byte, 4*10), HeaderSizeInBytes + FragmentHeaderSizeInBytes + 10, 4},
+		{"remainder", make([]byte, 4*10+1), HeaderSizeInBytes + FragmentHeaderSizeInBytes + 10, 5},
+		{"large", big, MaxSizeInBytes, 193},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frags, err := ComposeFragments(1, 2, tt.data, tt.maxFrag)
+			if err != nil {
+				t.Fatalf("unexpected ComposeFragments failure: %s", err)
+			}
+			if len(frags) != tt.count {
+				t.Fatalf("unexpected number of fragments (%d != %d)", len(frags), tt.count)
+			}
+
+			r := NewReassembler(len(tt.data))
+			for i, frag := range frags {
+				if frag.Len() > tt.maxFrag || frag.Type != 1 || frag.PeerID != 2 {
+					t.Fatalf("unexpected fragment (%v)", frag)
+				}
+
+				data, done, err := r.Add(frag)
+				if err != nil {
+					t.Fatalf("unexpected Add failure: %s", err)
+				}
+				if done != (i == len(frags)-1) {
+					t.Fatalf("unexpected completion at fragment %d", i)
+				}
+				if done && !bytes.Equal(data, tt.data) {
+					t.Fatalf("reassembled data does not match")
+				}
+			}
+			if r.Pending() != 0 {
+				t.Fatalf("unexpected pending series (%d)", r.Pending())
+			}
+		})
+	}
+
+	var ef *ErrFragment
+	_, err := ComposeFragments(1, 2, nil, HeaderSizeInBytes+FragmentHeaderSizeInBytes)
+	if !errors.As(err, &ef) {
+		t.Fatalf("expected ErrFragment, got: %v", err)
+	}
+	_, err = ComposeFragments(1, 2, nil, 0x10000)
+	if !errors.As(err, &ef) {
+		t.Fatalf("expected ErrFragment, got: %v", err)
+	}
+}
+
+func TestReassemblerInterleaved(t *testing.T) {
+	a, _ := ComposeFragments(1, 0, bytes.Repeat([]byte{1}, 100), 64)
+	b, _ := ComposeFragments(1, 1, bytes.Repeat([]byte{2}, 100), 64)
+	c, _ := ComposeFragments(2, 0, bytes.Repeat([]byte{3}, 100), 64)
+
+	r := NewReassembler(100)
+	var completed [][]byte
+	for i := range a {
+		for _, frag := range []*IMsg{a[i], b[i], c[i]} {
+			data, done, err := r.Add(frag)
+			if err != nil {
+				t.Fatalf("unexpected Add failure: %s", err)
+			}
+			if done {
+				completed = append(completed, data)
+			}
+		}
+	}
+
+	if len(completed) != 3 {
+		t.Fatalf("unexpected number of completed series (%d != 3)", len(completed))
+	}
+	for i, data := range completed {
+		if !bytes.Equal(data, bytes.Repeat([]byte{byte(i + 1)}, 100)) {
+			t.Fatalf("reassembled data of series %d does not match", i)
+		}
+	}
+}
+
+func TestReassemblerErrors(t *testing.T) {
+	frags, _ := ComposeFragments(1, 0, make([]byte, 100), 64)
+
+	tests := []struct {
+		name    string
+		frags   []*IMsg
+		pending int
+	}{
+		{"missing header", []*IMsg{{Type: 1, Data: []byte("test")}}, 0},
+		{"wrong magic", []*IMsg{{Type: 1, Data: make([]byte, 32)}}, 0},
+		{"duplicate", []*IMsg{frags[0], frags[0]}, 1},
+		{"out of order", []*IMsg{frags[0], frags[2]}, 0},
+		{"missing first", []*IMsg{frags[1]}, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReassembler(100)
+
+			var err error
+			for _, frag := range tt.frags {
+				_, _, err = r.Add(frag)
+			}
+
+			var ef *ErrFragment
+			if !errors.As(err, &ef) || ef.Type != 1 {
+				t.Fatalf("expected ErrFragment, got: %v", err)
+			}
+			if r.Pending() != tt.pending {
+				t.Fatalf("unexpected pending series (%d != %d)", r.Pending(), tt.pending)
+			}
+		})
+	}
+
+	// The maximum size is enforced as fragments arrive.
+	r := NewReassembler(99)
+	var err error
+	for _, frag := range frags {
+		_, _, err = r.Add(frag)
+		if err != nil {
+			break
+		}
+	}
+	var ef *ErrFragment
+	if !errors.As(err, &ef) || r.Pending() != 0 {
+		t.Fatalf("expected ErrFragment, got: %v", err)
+	}
+
+	// A fragment whose header disagrees with its series is refused.
+	bad := frags[1].Clone()
+	endianness.PutUint32(bad.Data[12:16], 0)
+	r = NewReassembler(100)
+	r.Add(frags[0])
+	_, _, err = r.Add(bad)
+	if !errors.As(err, &ef) {
+		t.Fatalf("expected ErrFragment, got: %v", err)
+	}
+}
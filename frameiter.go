@@ -0,0 +1,119 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"encoding/binary"
+)
+
+// A FrameIter walks the imsg frames held in a byte slice, such as a capture
+// read into memory, exposing the header of each frame and the position of its
+// data without constructing an IMsg. Walking the frames allocates nothing, so
+// indexers and filters can scan large captures cheaply, calling Materialize
+// for only the frames they want. The iteration stops at the first frame which
+// is structurally invalid, as reported by Err.
+//
+//	it := imsg.NewFrameIter(capture, imsg.SystemEndianness())
+//	for it.Next() {
+//		if it.Header().Type == wanted {
+//			ims = append(ims, it.Materialize())
+//		}
+//	}
+//	if err := it.Err(); err != nil {
+//		// ...
+//	}
+type FrameIter struct {
+	b     []byte
+	order binary.ByteOrder
+
+	off  int    // Offset of the current frame, or -1 before the first
+	next int    // Offset of the frame following the current one
+	hdr  Header // Header of the current frame
+	err  error
+}
+
+// NewFrameIter constructs a FrameIter over the frames in b, whose headers are
+// encoded in the provided byte order, or in the system byte order if order is
+// nil. The frames must follow one another with nothing in between. The
+// FrameIter refers to b rather than a copy of it.
+func NewFrameIter(b []byte, order binary.ByteOrder) *FrameIter {
+	if order == nil {
+		order = endianness
+	}
+
+	return &FrameIter{b: b, order: order, off: -1}
+}
+
+// Next advances to the next frame, reporting whether there is one. It returns
+// false once the frames are exhausted or a frame is found to be structurally
+// invalid, in which case Err reports the problem.
+func (it *FrameIter) Next() bool {
+	if it.err != nil || it.next >= len(it.b) {
+		it.off = -1
+		return false
+	}
+
+	off := it.next
+	length, err := validateWire(it.b[off:], it.order, MaxSizeInBytes)
+	if err != nil {
+		it.off = -1
+		it.err = &ErrMalformedFrame{off, err}
+		return false
+	}
+
+	it.off = off
+	it.next = off + length
+	it.hdr = parseHeader(it.b[off:], it.order)
+
+	return true
+}
+
+// Err returns the error which ended the iteration, or nil if it ended because
+// the frames were exhausted. The error is an ErrMalformedFrame wrapping
+// ErrLengthOutOfBounds for a header whose length is invalid, or ErrTruncated
+// for a frame which the slice ends partway through.
+func (it *FrameIter) Err() error {
+	return it.err
+}
+
+// Header returns the header of the current frame.
+func (it *FrameIter) Header() Header {
+	return it.hdr
+}
+
+// Offset returns the offset in bytes of the current frame within the slice.
+func (it *FrameIter) Offset() int {
+	return it.off
+}
+
+// DataOffset returns the offset in bytes within the slice of the ancillary
+// data of the current frame, which immediately follows its header.
+func (it *FrameIter) DataOffset() int {
+	return it.off + HeaderSizeInBytes
+}
+
+// DataLen returns the length in bytes of the ancillary data of the current
+// frame.
+func (it *FrameIter) DataLen() int {
+	return int(it.hdr.Length) - HeaderSizeInBytes
+}
+
+// Materialize constructs an IMsg from the current frame, with a copy of its
+// data, so that the IMsg remains valid once the slice is reused. It returns
+// nil if there's no current frame, such as once Next has returned false.
+func (it *FrameIter) Materialize() *IMsg {
+	if it.off < 0 {
+		return nil
+	}
+
+	im := &IMsg{}
+	im.setHeader(it.hdr)
+	if n := it.DataLen(); n > 0 {
+		off := it.DataOffset()
+		im.Data = append([]byte(nil), it.b[off:off+n]...)
+	}
+
+	return im
+}
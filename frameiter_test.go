@@ -0,0 +1,150 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// frameCapture returns the frames of the provided imsgs encoded in the provided
+// byte order, one after another.
+func frameCapture(order binary.ByteOrder, ims ...*IMsg) []byte {
+	var b []byte
+	for _, im := range ims {
+		hdr := im.RawHeader(order)
+		b = append(b, hdr[:]...)
+		b = append(b, im.Data...)
+	}
+
+	return b
+}
+
+func TestFrameIter(t *testing.T) {
+	ims := []*IMsg{
+		{Type: 1, PeerID: 2, PID: 3, Data: []byte("test")},
+		{Type: 4},
+		{Type: 5, Data: bytes.Repeat([]byte{0xaa}, 100)},
+	}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		capture := frameCapture(order, ims...)
+		it := NewFrameIter(capture, order)
+
+		off := 0
+		for i, want := range ims {
+			if !it.Next() {
+				t.Fatalf("iteration ended early at frame %d: %v", i, it.Err())
+			}
+			hdr := it.Header()
+			if hdr.Type != want.Type || hdr.PeerID != want.PeerID || hdr.PID != want.PID || int(hdr.Length) != want.Len() {
+				t.Fatalf("unexpected header of frame %d: %+v", i, hdr)
+			}
+			if it.Offset() != off || it.DataOffset() != off+HeaderSizeInBytes || it.DataLen() != len(want.Data) {
+				t.Fatalf(
+					"unexpected position of frame %d (%d, %d, %d)",
+					i, it.Offset(), it.DataOffset(), it.DataLen(),
+				)
+			}
+			got := it.Materialize()
+			if !got.Equal(want) {
+				t.Fatalf("unexpected imsg materialized from frame %d: %v", i, got)
+			}
+			off += want.Len()
+		}
+		if it.Next() || it.Err() != nil {
+			t.Fatalf("unexpected end of iteration (%v)", it.Err())
+		}
+		if it.Materialize() != nil {
+			t.Fatalf("Materialize succeeded after iteration ended")
+		}
+	}
+}
+
+func TestFrameIterMaterializeCopies(t *testing.T) {
+	capture := frameCapture(endianness, &IMsg{Type: 1, Data: []byte("test")})
+	it := NewFrameIter(capture, nil)
+	if !it.Next() {
+		t.Fatalf("unexpected Next failure: %v", it.Err())
+	}
+	im := it.Materialize()
+
+	capture[HeaderSizeInBytes] = 'b'
+	if string(im.Data) != "test" {
+		t.Fatalf("materialized imsg refers to the capture: %q", im.Data)
+	}
+}
+
+func TestFrameIterMalformed(t *testing.T) {
+	good := frameCapture(endianness, &IMsg{Type: 1, Data: []byte("test")})
+
+	// A header whose length is out of bounds stops the iteration at its
+	// offset.
+	bad := make([]byte, HeaderSizeInBytes)
+	capture := append(append([]byte(nil), good...), bad...)
+	it := NewFrameIter(capture, nil)
+	for it.Next() {
+	}
+	var malformed *ErrMalformedFrame
+	var bounds *ErrLengthOutOfBounds
+	if !errors.As(it.Err(), &malformed) || malformed.Offset != len(good) || !errors.As(it.Err(), &bounds) {
+		t.Fatalf("expected ErrMalformedFrame wrapping ErrLengthOutOfBounds, got: %v", it.Err())
+	}
+
+	// So does a frame which is cut short, whether in its header or its data.
+	for _, n := range []int{len(good) - 1, HeaderSizeInBytes - 1} {
+		capture := append(append([]byte(nil), good...), good[:n]...)
+		it := NewFrameIter(capture, nil)
+		for it.Next() {
+		}
+		var truncated *ErrTruncated
+		if !errors.As(it.Err(), &malformed) || malformed.Offset != len(good) || !errors.As(it.Err(), &truncated) {
+			t.Fatalf("expected ErrMalformedFrame wrapping ErrTruncated, got: %v", it.Err())
+		}
+		if it.Next() {
+			t.Fatalf("iteration resumed after failure")
+		}
+	}
+}
+
+func TestFrameIterAllocs(t *testing.T) {
+	capture := frameCapture(endianness, &IMsg{Type: 1, Data: make([]byte, 100)}, &IMsg{Type: 2})
+	it := NewFrameIter(capture, nil)
+
+	allocs := testing.AllocsPerRun(100, func() {
+		*it = FrameIter{b: capture, order: endianness, off: -1}
+		for it.Next() {
+			_ = it.Header()
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("unexpected allocations per iteration: %v", allocs)
+	}
+}
+
+func BenchmarkFrameIter(b *testing.B) {
+	// This is a capture of several megabytes with frames of varying sizes.
+	var ims []*IMsg
+	for i := 0; i < 8192; i++ {
+		ims = append(ims, &IMsg{Type: uint32(i), Data: make([]byte, (i*37)%1024)})
+	}
+	capture := frameCapture(endianness, ims...)
+
+	b.SetBytes(int64(len(capture)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var n int
+		it := NewFrameIter(capture, nil)
+		for it.Next() {
+			n += it.DataLen()
+		}
+		if it.Err() != nil || n == 0 {
+			b.Fatalf("unexpected iteration result (%d, %v)", n, it.Err())
+		}
+	}
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+)
+
+// This is the size in bytes of the chunks in which SendFromReader reads data
+// and writes it to the socket.
+const readerChunkInBytes = 4096
+
+// ComposeIMsgFromReader constructs an IMsg of the provided type whose ancillary
+// data is the next n bytes read from r, which are read directly into the
+// IMsg's Data. The length is checked before anything is read, and a negative
+// length is refused with ErrNegativeLength. If r ends before n bytes have been
+// read, ErrTruncated is returned, which wraps io.ErrUnexpectedEOF, and other
+// failures to read are returned wrapped in an ErrRead. The PID field is filled
+// in as with ComposeIMsg.
+func ComposeIMsgFromReader(typ, peerID uint32, r io.Reader, n int) (*IMsg, error) {
+	data, err := readData(typ, peerID, r, n, MaxSizeInBytes-HeaderSizeInBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return ComposeIMsg(typ, peerID, data)
+}
+
+// readData reads the n bytes of data of an imsg from r, once n has been
+// checked against a limit of limit bytes.
+func readData(typ, peerID uint32, r io.Reader, n, limit int) ([]byte, error) {
+	if n < 0 {
+		return nil, &ErrNegativeLength{n}
+	}
+	if n > limit {
+		return nil, &ErrDataTooLarge{
+			DataLengthInBytes: n,
+			MaxLengthInBytes:  limit,
+			Type:              typ,
+			PeerID:            peerID,
+		}
+	}
+	if n == 0 {
+		return nil, nil
+	}
+
+	data := make([]byte, n)
+	m, err := io.ReadFull(r, data)
+	if err != nil {
+		return nil, dataReadErr(n, m, err)
+	}
+
+	return data, nil
+}
+
+// dataReadErr returns the error reported for a failure to read want bytes of
+// data, of which got were read, with io.ReadFull.
+func dataReadErr(want, got int, err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return &ErrTruncated{want, got, "body"}
+	}
+
+	return &ErrRead{"body", err}
+}
+
+// SendFromReader sends an imsg of the provided type whose ancillary data is the
+// next n bytes read from r, without holding all of it at once: the header is
+// written together with the first chunk of data in a single writev, and the
+// rest follows a chunk at a time, ahead of anything sent in the meantime. The
+// length is checked against the maximum size of the Conn before anything is
+// read, and errors are returned as by ComposeIMsgFromReader. The PID field is
+// filled in as described by WithPIDFunc.
+//
+// Nothing is written unless the first chunk is read in full, but if r fails
+// once the header has been written, the peer has been promised data which
+// never arrives, so the Conn fails. When the data is to be compressed, the
+// Conn is in packet mode, credentials accompany each write, or sent imsgs are
+// traced or logged, the data is read in full and sent as by Send.
+func (c *Conn) SendFromReader(typ, peerID uint32, r io.Reader, n int) error {
+	if err := c.failure(); err != nil {
+		return err
+	}
+
+	if n < 0 {
+		return &ErrNegativeLength{n}
+	}
+
+	peerID = c.peerIDOr(peerID)
+	limit := int(c.maxSize.Load()) - HeaderSizeInBytes
+	threshold := int(c.compressAbove.Load())
+	if c.packet ||
+		(threshold >= 0 && n > threshold) ||
+		c.wq.sendCreds.Load() ||
+		c.trace != nil ||
+		c.debugEnabled() {
+		data, err := readData(typ, peerID, r, n, limit)
+		if err != nil {
+			return err
+		}
+		return c.Send(&IMsg{Type: typ, PeerID: peerID, PID: c.pid(), Data: data})
+	}
+	if n > limit {
+		return &ErrDataTooLarge{
+			DataLengthInBytes: n,
+			MaxLengthInBytes:  limit,
+			Type:              typ,
+			PeerID:            peerID,
+		}
+	}
+
+	err := c.wait(context.Background(), HeaderSizeInBytes+n)
+	if err != nil {
+		return err
+	}
+
+	im := &IMsg{Type: typ, PeerID: peerID, PID: c.pid()}
+	hdr := make([]byte, HeaderSizeInBytes)
+	im.putHeaderOrder(hdr, c.order)
+	c.order.PutUint16(hdr[4:6], uint16(HeaderSizeInBytes+n))
+
+	wrote, err := c.wq.writeFrom(hdr, r, n)
+	var ew *ErrWrite
+	if wrote && err != nil && !errors.As(err, &ew) {
+		err = c.fail(err)
+	}
+	err = c.failOnWrite(err)
+	c.sent(im, false, err)
+
+	return err
+}
+
+// writeFrom writes, after anything already queued, an imsg whose marshaled
+// header is hdr and whose data is the next n bytes of r, reading and writing
+// the data a chunk at a time. Nothing is written unless the first chunk is
+// read in full. It reports whether the header was written, after which a
+// failure leaves the stream unusable.
+func (m *MsgBuf) writeFrom(hdr []byte, r io.Reader, n int) (bool, error) {
+	m.fmu.Lock()
+	defer m.fmu.Unlock()
+
+	_, err := m.flush(context.Background(), false)
+	if err != nil {
+		return false, err
+	}
+
+	buf := make([]byte, min(n, readerChunkInBytes))
+	got, err := io.ReadFull(r, buf)
+	if err != nil {
+		return false, dataReadErr(n, got, err)
+	}
+
+	// The header accompanies the first chunk, which is written with a single
+	// writev when the writer is a *net.UnixConn.
+	bufs := net.Buffers{hdr, buf}
+	written, err := bufs.WriteTo(m.w)
+	m.sent.bytes.Add(uint64(written))
+	if err != nil {
+		m.metrics.OnError("write", err)
+		return written > 0, &ErrWrite{err}
+	}
+
+	for done := len(buf); done < n; {
+		chunk := buf[:min(n-done, len(buf))]
+		got, err := io.ReadFull(r, chunk)
+		if err != nil {
+			return true, dataReadErr(n, done+got, err)
+		}
+		_, err = m.w.Write(chunk)
+		if err != nil {
+			m.metrics.OnError("write", err)
+			return true, &ErrWrite{err}
+		}
+		m.sent.bytes.Add(uint64(len(chunk)))
+		done += len(chunk)
+	}
+
+	m.sent.messages.Add(1)
+	m.metrics.OnSend(m.order.Uint32(hdr[0:4]), HeaderSizeInBytes+n)
+
+	return true, nil
+}
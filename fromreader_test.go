@@ -0,0 +1,65 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestComposeIMsgFromReader(t *testing.T) {
+	const limit = MaxSizeInBytes - HeaderSizeInBytes
+	data := bytes.Repeat([]byte{0xaa}, limit)
+
+	for _, n := range []int{0, 1, limit} {
+		r := iotest.OneByteReader(bytes.NewReader(data))
+		im, err := ComposeIMsgFromReader(1, 2, r, n)
+		if err != nil {
+			t.Fatalf("unexpected ComposeIMsgFromReader failure: %s", err)
+		}
+		if im.Type != 1 || im.PeerID != 2 || im.PID != currentPID() || !bytes.Equal(im.Data, data[:n]) {
+			t.Fatalf("unexpected imsg composed from %d bytes: %v", n, im)
+		}
+	}
+}
+
+func TestComposeIMsgFromReaderTooLarge(t *testing.T) {
+	// The length is refused before anything is read.
+	r := iotest.ErrReader(errors.New("read"))
+	_, err := ComposeIMsgFromReader(1, 0, r, MaxSizeInBytes-HeaderSizeInBytes+1)
+	var tooLarge *ErrDataTooLarge
+	if !errors.As(err, &tooLarge) || tooLarge.MaxLengthInBytes != MaxSizeInBytes-HeaderSizeInBytes {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+}
+
+func TestComposeIMsgFromReaderNegative(t *testing.T) {
+	r := iotest.ErrReader(errors.New("read"))
+	_, err := ComposeIMsgFromReader(1, 0, r, -1)
+	var negative *ErrNegativeLength
+	if !errors.As(err, &negative) || negative.LengthInBytes != -1 {
+		t.Fatalf("expected ErrNegativeLength, got: %v", err)
+	}
+}
+
+func TestComposeIMsgFromReaderShort(t *testing.T) {
+	for _, r := range []io.Reader{bytes.NewReader(nil), bytes.NewReader([]byte("abc"))} {
+		_, err := ComposeIMsgFromReader(1, 0, r, 8)
+		var truncated *ErrTruncated
+		if !errors.As(err, &truncated) || truncated.Expected != 8 || !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("expected ErrTruncated, got: %v", err)
+		}
+	}
+
+	errTest := errors.New("test")
+	_, err := ComposeIMsgFromReader(1, 0, iotest.ErrReader(errTest), 8)
+	var er *ErrRead
+	if !errors.As(err, &er) || !errors.Is(err, errTest) {
+		t.Fatalf("expected ErrRead, got: %v", err)
+	}
+}
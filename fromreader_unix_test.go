@@ -0,0 +1,101 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestConnSendFromReader(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	const limit = MaxSizeInBytes - HeaderSizeInBytes
+	data := make([]byte, limit)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	for _, n := range []int{0, 1, readerChunkInBytes + 1, limit} {
+		// The receiver runs alongside, since the largest imsgs needn't fit in
+		// the socket's buffer.
+		done := make(chan error, 1)
+		go func() {
+			done <- a.SendFromReader(1, uint32(n), iotest.HalfReader(bytes.NewReader(data)), n)
+		}()
+
+		im, err := b.Recv()
+		if err != nil {
+			t.Fatalf("unexpected Recv failure: %s", err)
+		}
+		if im.Type != 1 || im.PeerID != uint32(n) || !bytes.Equal(im.Data, data[:n]) {
+			t.Fatalf("unexpected imsg received for %d bytes: %v", n, im)
+		}
+		err = <-done
+		if err != nil {
+			t.Fatalf("unexpected SendFromReader failure: %s", err)
+		}
+	}
+
+	stats := a.Stats()
+	if stats.MessagesSent != 4 || stats.BytesSent != 4*HeaderSizeInBytes+1+readerChunkInBytes+1+limit {
+		t.Fatalf("unexpected counts of sent imsgs and bytes (%d, %d)", stats.MessagesSent, stats.BytesSent)
+	}
+}
+
+func TestConnSendFromReaderTooLarge(t *testing.T) {
+	a, _ := newTestSocketPair(t)
+
+	err := a.SendFromReader(1, 0, bytes.NewReader(nil), MaxSizeInBytes)
+	var tooLarge *ErrDataTooLarge
+	if !errors.As(err, &tooLarge) || tooLarge.MaxLengthInBytes != MaxSizeInBytes-HeaderSizeInBytes {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+}
+
+func TestConnSendFromReaderNegative(t *testing.T) {
+	a, _ := newTestSocketPair(t)
+
+	err := a.SendFromReader(1, 0, bytes.NewReader(nil), -1)
+	var negative *ErrNegativeLength
+	if !errors.As(err, &negative) || negative.LengthInBytes != -1 {
+		t.Fatalf("expected ErrNegativeLength, got: %v", err)
+	}
+}
+
+func TestConnSendFromReaderShort(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	// A reader which ends within the first chunk leaves nothing written.
+	err := a.SendFromReader(1, 0, bytes.NewReader([]byte("abc")), 8)
+	var truncated *ErrTruncated
+	if !errors.As(err, &truncated) || truncated.Got != 3 || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected ErrTruncated, got: %v", err)
+	}
+	err = a.Send(&IMsg{Type: 2})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	im, err := b.Recv()
+	if err != nil || im.Type != 2 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+
+	// One which ends once the header has been written fails the Conn.
+	n := readerChunkInBytes * 2
+	r := bytes.NewReader(make([]byte, readerChunkInBytes+1))
+	err = a.SendFromReader(1, 0, r, n)
+	if !errors.As(err, &truncated) || truncated.Expected != n || truncated.Got != readerChunkInBytes+1 {
+		t.Fatalf("expected ErrTruncated, got: %v", err)
+	}
+	if a.State() != StateFailed {
+		t.Fatalf("unexpected state after truncated data: %s", a.State())
+	}
+}
@@ -0,0 +1,38 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// This file holds the runtime support for code generated by cmd/imsggen, which
+// turns annotated struct definitions into functions composing and parsing
+// imsgs field by field, without reflection.
+
+// MustRegisterType registers the name of an imsg type along with the exact
+// length in bytes of the data it carries, as RegisterTypeName and
+// RegisterExpectedSize do. It's called from the init functions generated by
+// imsggen, and panics if the name conflicts with an existing registration, so
+// that two definitions claiming one type are caught at startup.
+func MustRegisterType(typ uint32, name string, size int) {
+	err := RegisterTypeName(typ, name)
+	if err != nil {
+		panic(fmt.Sprintf("imsg: registering generated type: %s", err))
+	}
+
+	RegisterExpectedSize(typ, size)
+}
+
+// FixedCString returns the string held in a fixed-size field of a C struct,
+// which ends at the first NUL or, failing that, at the end of the field.
+func FixedCString(bs []byte) string {
+	if i := bytes.IndexByte(bs, 0); i >= 0 {
+		bs = bs[:i]
+	}
+
+	return string(bs)
+}
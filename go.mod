@@ -1,3 +1,5 @@
 module github.com/schultz-is/go-imsg
 
-go 1.13
+go 1.21
+
+require golang.org/x/sys v0.30.0
@@ -0,0 +1,139 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+)
+
+// An exported queue begins with this magic, followed by the number of bytes of
+// the first imsg which had already been written, as a big-endian 32-bit
+// integer, and then each queued imsg as it appears on the wire.
+const (
+	pendingMagic      = "imsgpnd1"
+	pendingPrefixSize = len(pendingMagic) + 4
+)
+
+// ExportPending returns the imsgs which remain queued, including the unwritten
+// remainder of one which has been partially written, as a compact blob which
+// ImportPending restores. This allows a process which re-executes itself to
+// hand its queue to the new image, which resumes writing at the byte where the
+// old one left off, so the peer's stream stays intact. The queue itself is
+// left untouched.
+//
+// Descriptors can't be carried in the blob, so imsgs with files attached are
+// left out of it, and ErrUnexportedFDs is returned along with the blob to
+// report them. The blob remains usable, but the peer won't receive those
+// imsgs.
+func (m *MsgBuf) ExportPending() ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	size := pendingPrefixSize
+	for i := range m.q {
+		size += m.q[i].len()
+	}
+	blob := make([]byte, pendingPrefixSize, size)
+	copy(blob, pendingMagic)
+	binary.BigEndian.PutUint32(blob[len(pendingMagic):], uint32(m.off))
+
+	var skipped []uint32
+	for i := range m.q {
+		e := &m.q[i]
+		if e.file != nil {
+			// Only an unwritten imsg can still have its file attached, since
+			// the descriptor is passed with the first byte written.
+			skipped = append(skipped, m.order.Uint32(e.bs[0:4]))
+			continue
+		}
+		blob = append(blob, e.bs...)
+		blob = append(blob, e.data...)
+	}
+
+	if len(skipped) > 0 {
+		return blob, &ErrUnexportedFDs{skipped}
+	}
+
+	return blob, nil
+}
+
+// ImportPending queues the imsgs in a blob returned by ExportPending, to be
+// written by a subsequent Flush, which begins with the unwritten remainder of
+// the first if it had been partially written. Imported imsgs aren't subject to
+// the limits set with SetQueueLimit. A blob which begins partway through an
+// imsg can only be imported into an empty queue, since it must be written
+// first. A blob which can't be parsed is refused with ErrCorruptPending, and
+// nothing is queued.
+func (m *MsgBuf) ImportPending(blob []byte) error {
+	if len(blob) < pendingPrefixSize || string(blob[:len(pendingMagic)]) != pendingMagic {
+		return &ErrCorruptPending{"not an exported queue"}
+	}
+	off := int(binary.BigEndian.Uint32(blob[len(pendingMagic):]))
+
+	var (
+		es   []msgBufEntry
+		size int
+	)
+	for rest := blob[pendingPrefixSize:]; len(rest) > 0; {
+		n, err := frameLength(rest, math.MaxUint16, m.order)
+		if err != nil {
+			return &ErrCorruptPending{err.Error()}
+		}
+		if n == 0 {
+			return &ErrCorruptPending{"truncated imsg"}
+		}
+		es = append(es, msgBufEntry{bs: append([]byte(nil), rest[:n]...)})
+		size += n
+		rest = rest[n:]
+	}
+	if off > 0 && (len(es) == 0 || off >= es[0].len()) {
+		return &ErrCorruptPending{fmt.Sprintf("write offset %d out of bounds", off)}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if off > 0 {
+		if len(m.q) > 0 {
+			return &ErrCorruptPending{"partially written imsg imported into a non-empty queue"}
+		}
+		m.off = off
+	}
+	m.q = append(m.q, es...)
+	m.pending += size - off
+	if len(m.q) > m.highWater {
+		m.highWater = len(m.q)
+	}
+	m.metrics.OnQueueDepth(len(m.q))
+
+	return nil
+}
+
+// ExportPending returns the imsgs waiting to be written as a blob which
+// ImportPending restores. See MsgBuf.ExportPending.
+func (b *Buffer) ExportPending() ([]byte, error) {
+	return b.wq.ExportPending()
+}
+
+// ImportPending queues the imsgs in a blob returned by ExportPending. See
+// MsgBuf.ImportPending.
+func (b *Buffer) ImportPending(blob []byte) error {
+	return b.wq.ImportPending(blob)
+}
+
+// ExportPending returns the imsgs which remain queued, such as after a send
+// was interrupted or while sent imsgs are being coalesced, as a blob which
+// ImportPending restores. See MsgBuf.ExportPending.
+func (c *Conn) ExportPending() ([]byte, error) {
+	return c.wq.ExportPending()
+}
+
+// ImportPending queues the imsgs in a blob returned by ExportPending, to be
+// written by a subsequent Send or Flush. See MsgBuf.ImportPending.
+func (c *Conn) ImportPending(blob []byte) error {
+	return c.wq.ImportPending(blob)
+}
@@ -0,0 +1,147 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestMsgBufExportImportPending(t *testing.T) {
+	w := &throttledWriter{perCall: 7, budget: 25}
+	m := NewMsgBuf(w)
+
+	var expected []byte
+	for i := 0; i < 3; i++ {
+		im := &IMsg{Type: uint32(i), Data: []byte("test")}
+		err := m.Enqueue(im)
+		if err != nil {
+			t.Fatalf("unexpected Enqueue failure: %s", err)
+		}
+		bs, _ := im.MarshalBinary()
+		expected = append(expected, bs...)
+	}
+
+	// The second imsg is cut off partway through.
+	_, err := m.Flush()
+	if !errors.Is(err, errFull) {
+		t.Fatalf("expected errFull, got: %v", err)
+	}
+
+	blob, err := m.ExportPending()
+	if err != nil {
+		t.Fatalf("unexpected ExportPending failure: %s", err)
+	}
+	if m.QueueLen() != 2 {
+		t.Fatalf("export modified the queue (%d imsgs queued)", m.QueueLen())
+	}
+
+	// After the re-exec, the new queue resumes at the byte where the old one
+	// left off.
+	var resumed bytes.Buffer
+	n := NewMsgBuf(&resumed)
+	err = n.ImportPending(blob)
+	if err != nil {
+		t.Fatalf("unexpected ImportPending failure: %s", err)
+	}
+	if n.QueueLen() != 2 || n.PendingBytes() != m.PendingBytes() {
+		t.Fatalf("imported queue does not match (%d imsgs, %d bytes)", n.QueueLen(), n.PendingBytes())
+	}
+	_, err = n.Flush()
+	if err != nil {
+		t.Fatalf("unexpected Flush failure: %s", err)
+	}
+
+	stream := append(w.Bytes(), resumed.Bytes()...)
+	if !bytes.Equal(stream, expected) {
+		t.Fatalf("resumed stream does not match:\n%x\n%x", stream, expected)
+	}
+	ims, err := DecodeAll(stream)
+	if err != nil || len(ims) != 3 {
+		t.Fatalf("resumed stream does not decode (%d imsgs, %v)", len(ims), err)
+	}
+}
+
+func TestBufferExportImportPendingEmpty(t *testing.T) {
+	b := NewBuffer(&bytes.Buffer{})
+	blob, err := b.ExportPending()
+	if err != nil {
+		t.Fatalf("unexpected ExportPending failure: %s", err)
+	}
+
+	var rw bytes.Buffer
+	nb := NewBuffer(&rw)
+	err = nb.ImportPending(blob)
+	if err != nil || nb.QueueLen() != 0 {
+		t.Fatalf("unexpected ImportPending result (%d imsgs, %v)", nb.QueueLen(), err)
+	}
+
+	// Imported imsgs are queued behind any already queued.
+	nb.Compose(1, 0, 0, nil)
+	b.Compose(2, 0, 0, []byte("test"))
+	blob, _ = b.ExportPending()
+	err = nb.ImportPending(blob)
+	if err != nil {
+		t.Fatalf("unexpected ImportPending failure: %s", err)
+	}
+	nb.Flush()
+	ims, err := DecodeAll(rw.Bytes())
+	if err != nil || len(ims) != 2 || ims[0].Type != 1 || ims[1].Type != 2 {
+		t.Fatalf("unexpected imsgs written (%v, %v)", ims, err)
+	}
+}
+
+func TestMsgBufImportPendingCorrupt(t *testing.T) {
+	w := &throttledWriter{perCall: 5, budget: 5}
+	m := NewMsgBuf(w)
+	m.Enqueue(&IMsg{Type: 1, Data: []byte("test")})
+	m.Flush()
+	partial, _ := m.ExportPending()
+
+	whole, _ := NewMsgBuf(w).ExportPending()
+	frame, _ := IMsg{Type: 2}.MarshalBinary()
+	whole = append(whole, frame...)
+
+	outOfBounds := append([]byte(nil), partial...)
+	outOfBounds[len(pendingMagic)+3] = 0xff
+
+	testCases := []struct {
+		name string
+		blob []byte
+	}{
+		{"empty", nil},
+		{"bad magic", append([]byte("notmagic"), partial[len(pendingMagic):]...)},
+		{"truncated", partial[:len(partial)-1]},
+		{"bad length", append(append([]byte(nil), whole...), make([]byte, HeaderSizeInBytes)...)},
+		{"offset out of bounds", outOfBounds},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			n := NewMsgBuf(&bytes.Buffer{})
+			err := n.ImportPending(tc.blob)
+			var ecp *ErrCorruptPending
+			if !errors.As(err, &ecp) {
+				t.Fatalf("expected ErrCorruptPending, got: %v", err)
+			}
+			if n.QueueLen() != 0 {
+				t.Fatalf("corrupt blob was partially imported (%d imsgs)", n.QueueLen())
+			}
+		})
+	}
+
+	// A partially written imsg must be written first.
+	n := NewMsgBuf(&bytes.Buffer{})
+	err := n.ImportPending(whole)
+	if err != nil {
+		t.Fatalf("unexpected ImportPending failure: %s", err)
+	}
+	err = n.ImportPending(partial)
+	var ecp *ErrCorruptPending
+	if !errors.As(err, &ecp) {
+		t.Fatalf("expected ErrCorruptPending, got: %v", err)
+	}
+}
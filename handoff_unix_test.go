@@ -0,0 +1,59 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConnExportPendingFDs(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	a = rewrapTestConn(t, a, WithFlushInterval(time.Hour))
+	a.AllowFDPass(true)
+	b.AllowFDPass(true)
+
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("failed to open %s: %s", os.DevNull, err)
+	}
+	withFile, _ := ComposeIMsgWithFile(2, 0, nil, f)
+	for _, im := range []*IMsg{{Type: 1}, withFile, {Type: 3}} {
+		err = a.Send(im)
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+
+	blob, err := a.ExportPending()
+	var eue *ErrUnexportedFDs
+	if !errors.As(err, &eue) || !reflect.DeepEqual(eue.Types, []uint32{2}) {
+		t.Fatalf("expected ErrUnexportedFDs, got: %v", err)
+	}
+
+	// The blob holds the rest of the queue, which a new Conn over the same
+	// socket delivers.
+	c := rewrapTestConn(t, a)
+	err = c.ImportPending(blob)
+	if err != nil {
+		t.Fatalf("unexpected ImportPending failure: %s", err)
+	}
+	err = c.Flush()
+	if err != nil {
+		t.Fatalf("unexpected Flush failure: %s", err)
+	}
+	for _, typ := range []uint32{1, 3} {
+		im, err := b.Recv()
+		if err != nil || im.Type != typ {
+			t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+		}
+	}
+	a.wq.Clear()
+}
@@ -0,0 +1,217 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+	"errors"
+	"math"
+	"time"
+)
+
+// TypeHandshake is the type reserved for the offers exchanged by Handshake.
+// Protocols using the handshake must not use it for anything else.
+const TypeHandshake uint32 = 0xfffffffe
+
+// DefaultHandshakeTimeout is how long Handshake waits for the peer's offer
+// before leaving the Conn as it was.
+const DefaultHandshakeTimeout = time.Second
+
+// The data of an offer is the version of the handshake, the feature bits, the
+// maximum size and the compression threshold, each a uint32 in host byte
+// order. Later versions may append parameters, which are ignored.
+const (
+	handshakeVersion     = 1
+	handshakeLenInBytes  = 16
+	handshakeNoThreshold = 0xffffffff
+)
+
+// A Feature is an extension to the imsg protocol which both ends of a Conn
+// must enable for it to be used, as negotiated by Handshake.
+type Feature uint32
+
+// These are the features which may be negotiated by Handshake.
+const (
+	// FeatureFDPass allows descriptors to be passed, as by AllowFDPass.
+	FeatureFDPass Feature = 1 << iota
+
+	// FeatureCompression compresses data larger than the agreed threshold,
+	// as by WithCompression.
+	FeatureCompression
+
+	// FeatureMaxSize sets the agreed maximum size, as by SetMaxSize.
+	FeatureMaxSize
+)
+
+// These are the features known to this version of the handshake.
+const knownFeatures = FeatureFDPass | FeatureCompression | FeatureMaxSize
+
+// Capabilities describes the features offered to the peer by Handshake, or
+// those agreed upon by both ends, along with their parameters.
+type Capabilities struct {
+	Features Feature
+
+	MaxSize       uint16 // Maximum size in bytes of an imsg, with FeatureMaxSize
+	CompressAbove int    // Size beyond which data is compressed, with FeatureCompression
+}
+
+// Has reports whether all of the provided features are set.
+func (caps Capabilities) Has(f Feature) bool {
+	return caps.Features&f == f
+}
+
+// Handshake behaves like HandshakeContext with a context which expires after
+// DefaultHandshakeTimeout.
+func Handshake(c *Conn, offer Capabilities) (Capabilities, error) {
+	return HandshakeContext(context.Background(), c, offer)
+}
+
+// HandshakeContext negotiates the protocol extensions used over the Conn by
+// sending the peer an imsg of type TypeHandshake offering the provided
+// capabilities and awaiting the peer's own offer. The agreed capabilities are
+// the features both ends offered, with the smaller of the two maximum sizes and
+// the larger of the two compression thresholds, so both ends agree without
+// further exchanges. Feature bits unknown to either end are never agreed.
+//
+// The agreed settings replace those of the Conn: descriptor passing is allowed
+// only with FeatureFDPass, compression is enabled only with FeatureCompression,
+// and the maximum size reverts to MaxSizeInBytes without FeatureMaxSize. They're
+// applied together once the handshake has succeeded, and not at all if it
+// fails, so the handshake should be performed before the Conn is otherwise
+// used. Imsgs which arrive ahead of the peer's offer are held for Recv.
+//
+// If the context has no deadline, DefaultHandshakeTimeout applies. A peer which
+// doesn't answer before the deadline is taken not to implement the handshake,
+// such as the C implementation, and the Conn is left as it was with no
+// capabilities agreed and no error. Such a peer receives the offer as an
+// imsg of type TypeHandshake, which it must ignore, as it must any answer
+// which arrives too late. A malformed offer from the peer is reported with
+// ErrHandshake.
+func HandshakeContext(ctx context.Context, c *Conn, offer Capabilities) (Capabilities, error) {
+	if offer.Has(FeatureMaxSize) && offer.MaxSize < HeaderSizeInBytes {
+		return Capabilities{}, &ErrHandshake{"maximum size offered is smaller than a header"}
+	}
+	if offer.Has(FeatureCompression) &&
+		(offer.CompressAbove < 0 || uint64(offer.CompressAbove) >= handshakeNoThreshold) {
+		return Capabilities{}, &ErrHandshake{"compression threshold offered is out of range"}
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultHandshakeTimeout)
+		defer cancel()
+	}
+
+	// The offer is sent as is, neither compressed nor stamped with a PeerID.
+	im := &IMsg{Type: TypeHandshake, PID: c.pid(), Data: offer.marshal()}
+	err := c.send(ctx, im, true)
+	if err != nil {
+		return Capabilities{}, err
+	}
+
+	reply, err := c.RecvMatching(ctx, func(im *IMsg) bool {
+		return im.Type == TypeHandshake
+	})
+	if errors.Is(err, context.DeadlineExceeded) {
+		return Capabilities{}, nil
+	}
+	if err != nil {
+		return Capabilities{}, err
+	}
+	defer reply.Close()
+
+	peer, err := parseOffer(reply.Data)
+	if err != nil {
+		return Capabilities{}, err
+	}
+
+	agreed := offer.intersect(peer)
+	c.applyCapabilities(agreed)
+
+	return agreed, nil
+}
+
+// marshal returns the data of an imsg offering the capabilities.
+func (caps Capabilities) marshal() []byte {
+	threshold := uint32(handshakeNoThreshold)
+	if caps.Has(FeatureCompression) {
+		threshold = uint32(caps.CompressAbove)
+	}
+
+	data := make([]byte, handshakeLenInBytes)
+	endianness.PutUint32(data[0:4], handshakeVersion)
+	endianness.PutUint32(data[4:8], uint32(caps.Features))
+	endianness.PutUint32(data[8:12], uint32(caps.MaxSize))
+	endianness.PutUint32(data[12:16], threshold)
+
+	return data
+}
+
+// parseOffer returns the capabilities offered by the peer in the data of an
+// imsg of type TypeHandshake.
+func parseOffer(data []byte) (Capabilities, error) {
+	if len(data) < handshakeLenInBytes {
+		return Capabilities{}, &ErrHandshake{"offer too short"}
+	}
+	if endianness.Uint32(data[0:4]) < handshakeVersion {
+		return Capabilities{}, &ErrHandshake{"unsupported version"}
+	}
+
+	caps := Capabilities{Features: Feature(endianness.Uint32(data[4:8]))}
+	if caps.Has(FeatureMaxSize) {
+		maxSize := endianness.Uint32(data[8:12])
+		if maxSize < HeaderSizeInBytes || maxSize > 0xffff {
+			return Capabilities{}, &ErrHandshake{"maximum size out of range"}
+		}
+		caps.MaxSize = uint16(maxSize)
+	}
+	if caps.Has(FeatureCompression) {
+		threshold := endianness.Uint32(data[12:16])
+		if threshold == handshakeNoThreshold || uint64(threshold) > math.MaxInt {
+			return Capabilities{}, &ErrHandshake{"compression threshold out of range"}
+		}
+		caps.CompressAbove = int(threshold)
+	}
+
+	return caps, nil
+}
+
+// intersect returns the capabilities agreed upon given those offered by the
+// peer.
+func (caps Capabilities) intersect(peer Capabilities) Capabilities {
+	agreed := Capabilities{Features: caps.Features & peer.Features & knownFeatures}
+	if agreed.Has(FeatureMaxSize) {
+		agreed.MaxSize = min(caps.MaxSize, peer.MaxSize)
+	}
+	if agreed.Has(FeatureCompression) {
+		agreed.CompressAbove = max(caps.CompressAbove, peer.CompressAbove)
+	}
+
+	return agreed
+}
+
+// applyCapabilities replaces the settings of the Conn with those agreed upon by
+// a handshake.
+func (c *Conn) applyCapabilities(agreed Capabilities) {
+	maxSize := uint16(MaxSizeInBytes)
+	if agreed.Has(FeatureMaxSize) {
+		maxSize = agreed.MaxSize
+	}
+	// The size has been checked against the size of a header, so this can't
+	// fail.
+	_ = c.SetMaxSize(maxSize)
+
+	c.AllowFDPass(agreed.Has(FeatureFDPass))
+
+	// The settings may be read by sends and receives in progress, so each is
+	// stored once, atomically.
+	if !agreed.Has(FeatureCompression) {
+		c.compressAbove.Store(-1)
+		return
+	}
+	if c.decompressLimit.Load() <= 0 {
+		c.decompressLimit.Store(DefaultDecompressionLimit)
+	}
+	c.compressAbove.Store(int64(agreed.CompressAbove))
+}
@@ -0,0 +1,237 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// handshakePair performs a handshake over both ends of a connection at once,
+// returning the capabilities each end agreed upon.
+func handshakePair(t *testing.T, a, b *Conn, offerA, offerB Capabilities) (Capabilities, Capabilities) {
+	t.Helper()
+
+	type result struct {
+		caps Capabilities
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		caps, err := Handshake(b, offerB)
+		done <- result{caps, err}
+	}()
+
+	agreedA, err := Handshake(a, offerA)
+	if err != nil {
+		t.Fatalf("unexpected Handshake failure: %s", err)
+	}
+	res := <-done
+	if res.err != nil {
+		t.Fatalf("unexpected Handshake failure: %s", res.err)
+	}
+
+	return agreedA, res.caps
+}
+
+func TestHandshakeAgreement(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	offer := Capabilities{
+		Features:      FeatureFDPass | FeatureCompression | FeatureMaxSize,
+		MaxSize:       32768,
+		CompressAbove: 64,
+	}
+	agreedA, agreedB := handshakePair(t, a, b, offer, offer)
+	if agreedA != offer || agreedB != offer {
+		t.Fatalf("unexpected capabilities agreed (%+v, %+v)", agreedA, agreedB)
+	}
+
+	for _, c := range []*Conn{a, b} {
+		if !c.allowFDPass.Load() || c.maxSize.Load() != 32768 || c.compressAbove.Load() != 64 {
+			t.Fatalf(
+				"agreed settings not applied (fd passing %t, max size %d, compression above %d)",
+				c.allowFDPass.Load(), c.maxSize.Load(), c.compressAbove.Load(),
+			)
+		}
+	}
+
+	// Imsgs larger than the default maximum size may now be exchanged, and
+	// their data is compressed along the way.
+	data := bytes.Repeat([]byte("test"), 5000)
+	err := a.Send(&IMsg{Type: 1, Data: data})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	im, err := b.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	if !bytes.Equal(im.Data, data) {
+		t.Fatalf("unexpected data received (%d bytes)", len(im.Data))
+	}
+	if stats := a.Stats(); stats.BytesSent >= uint64(len(data)) {
+		t.Fatalf("data not compressed (%d bytes sent)", stats.BytesSent)
+	}
+}
+
+func TestHandshakeIntersection(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	a.AllowFDPass(true)
+
+	offerA := Capabilities{
+		Features:      FeatureFDPass | FeatureCompression | FeatureMaxSize | 0x100,
+		MaxSize:       32768,
+		CompressAbove: 64,
+	}
+	offerB := Capabilities{
+		Features:      FeatureCompression | FeatureMaxSize | 0x100,
+		MaxSize:       20000,
+		CompressAbove: 128,
+	}
+	want := Capabilities{
+		Features:      FeatureCompression | FeatureMaxSize,
+		MaxSize:       20000,
+		CompressAbove: 128,
+	}
+
+	// Both ends agree on the common features, unknown ones aside, with the
+	// smaller maximum size and the larger threshold.
+	agreedA, agreedB := handshakePair(t, a, b, offerA, offerB)
+	if agreedA != want || agreedB != want {
+		t.Fatalf("unexpected capabilities agreed (%+v, %+v)", agreedA, agreedB)
+	}
+	if a.allowFDPass.Load() {
+		t.Fatalf("descriptor passing left allowed without agreement")
+	}
+	for _, c := range []*Conn{a, b} {
+		if c.maxSize.Load() != 20000 || c.compressAbove.Load() != 128 {
+			t.Fatalf("agreed settings not applied (max size %d, compression above %d)", c.maxSize.Load(), c.compressAbove.Load())
+		}
+	}
+
+	// Without a feature in common, the defaults apply.
+	a, b = newTestSocketPair(t)
+	agreedA, agreedB = handshakePair(
+		t, a, b,
+		Capabilities{Features: FeatureFDPass},
+		Capabilities{Features: FeatureMaxSize, MaxSize: 20000},
+	)
+	if agreedA != (Capabilities{}) || agreedB != (Capabilities{}) {
+		t.Fatalf("unexpected capabilities agreed (%+v, %+v)", agreedA, agreedB)
+	}
+	for _, c := range []*Conn{a, b} {
+		if c.allowFDPass.Load() || c.maxSize.Load() != MaxSizeInBytes || c.compressAbove.Load() != -1 {
+			t.Fatalf("unexpected settings without agreement")
+		}
+	}
+}
+
+func TestHandshakeConcurrentSend(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	// The agreed settings are applied while imsgs are being sent, which the
+	// race detector checks.
+	const count = 50
+	sent := make(chan error, 1)
+	go func() {
+		data := bytes.Repeat([]byte("test"), 64)
+		for i := 0; i < count; i++ {
+			err := a.Send(&IMsg{Type: 1, Data: data})
+			if err != nil {
+				sent <- err
+				return
+			}
+		}
+		sent <- nil
+	}()
+
+	offer := Capabilities{Features: FeatureCompression, CompressAbove: 64}
+	handshakePair(t, a, b, offer, offer)
+	err := <-sent
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	for i := 0; i < count; i++ {
+		im, err := b.Recv()
+		if err != nil || im.Type != 1 {
+			t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+		}
+	}
+}
+
+func TestHandshakeSilentPeer(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	a.AllowFDPass(true)
+
+	// A peer which doesn't implement the handshake goes about its business.
+	err := b.Send(&IMsg{Type: 1})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	offer := Capabilities{Features: FeatureCompression | FeatureMaxSize, MaxSize: 32768}
+	agreed, err := HandshakeContext(ctx, a, offer)
+	if err != nil {
+		t.Fatalf("unexpected HandshakeContext failure: %s", err)
+	}
+	if agreed != (Capabilities{}) {
+		t.Fatalf("unexpected capabilities agreed (%+v)", agreed)
+	}
+	if a.Err() != nil {
+		t.Fatalf("unexpected Conn failure: %s", a.Err())
+	}
+	if !a.allowFDPass.Load() || a.maxSize.Load() != MaxSizeInBytes || a.compressAbove.Load() != -1 {
+		t.Fatalf("settings changed without agreement")
+	}
+
+	// The peer sees the offer as an imsg of a type it doesn't know, and plain
+	// imsgs flow both ways.
+	im, err := b.Recv()
+	if err != nil || im.Type != TypeHandshake {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+	im, err = a.Recv()
+	if err != nil || im.Type != 1 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+	err = a.Send(&IMsg{Type: 2})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	im, err = b.Recv()
+	if err != nil || im.Type != 2 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+}
+
+func TestHandshakeMalformed(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	_, err := Handshake(a, Capabilities{Features: FeatureMaxSize, MaxSize: 8})
+	var eh *ErrHandshake
+	if !errors.As(err, &eh) {
+		t.Fatalf("expected ErrHandshake, got: %v", err)
+	}
+
+	err = b.Send(&IMsg{Type: TypeHandshake, Data: []byte("test")})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	_, err = Handshake(a, Capabilities{Features: FeatureFDPass})
+	if !errors.As(err, &eh) {
+		t.Fatalf("expected ErrHandshake, got: %v", err)
+	}
+	if a.allowFDPass.Load() {
+		t.Fatalf("settings applied despite a malformed offer")
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"crypto/hmac"
+	"hash"
+)
+
+// An HMACKeyFunc returns the keys with which a received imsg may have been
+// authenticated, in the order they should be tried. It's provided the imsg with
+// its header decoded, so keys may be chosen by its PeerID, for instance. During
+// key rotation, it may return both the new key and the old one.
+type HMACKeyFunc func(im *IMsg) [][]byte
+
+// SetHMAC causes the Encoder to authenticate each imsg it encodes by appending
+// an HMAC of the imsg's header and data, computed with the provided key and
+// hash function, to the imsg's data. The HMAC counts against the maximum size
+// of the imsg, so less data may be sent. A nil key disables authentication,
+// which is the default. If compression is also enabled, the compressed data is
+// authenticated, and if a checksum is also enabled, it covers the HMAC.
+//
+// Authenticated imsgs can only be understood by a Decoder configured with the
+// same key and hash function, and not by the C implementation, so this must
+// only be enabled when the peer is known to enable it as well.
+func (e *Encoder) SetHMAC(key []byte, hashFn func() hash.Hash) {
+	if key == nil {
+		e.mac = nil
+		return
+	}
+
+	e.mac = hmac.New(hashFn, key)
+}
+
+// SetHMAC causes the Decoder to verify the HMAC appended to the data of each
+// imsg by an Encoder configured with the same key and hash function, stripping
+// it from the decoded imsg. An imsg whose HMAC doesn't match is consumed and
+// ErrAuthFailed is returned. A nil key disables verification, which is the
+// default.
+func (d *Decoder) SetHMAC(key []byte, hashFn func() hash.Hash) {
+	if key == nil {
+		d.SetHMACKeyFunc(nil, nil)
+		return
+	}
+
+	d.SetHMACKeyFunc(hashFn, func(*IMsg) [][]byte { return [][]byte{key} })
+}
+
+// SetHMACKeyFunc behaves like SetHMAC, except that each imsg is verified
+// against the keys returned by f, succeeding if any of them matches. A nil f
+// disables verification.
+func (d *Decoder) SetHMACKeyFunc(hashFn func() hash.Hash, f HMACKeyFunc) {
+	d.macHash = hashFn
+	d.macKeys = f
+	d.macSize = 0
+	if f != nil {
+		d.macSize = hashFn().Size()
+	}
+}
+
+// sign returns an imsg equivalent to im whose data has the HMAC of im appended,
+// or an error if that makes the imsg larger than maxSize bytes.
+func sign(mac hash.Hash, im *IMsg, maxSize uint16) (*IMsg, error) {
+	return appendTrailer(im, mac.Size(), maxSize, func(dst, hdr, data []byte) []byte {
+		mac.Reset()
+		mac.Write(hdr)
+		mac.Write(data)
+		return mac.Sum(dst)
+	})
+}
+
+// verifyHMAC checks the HMAC appended to the data of a received imsg against
+// each of the keys returned by the HMACKeyFunc, stripping it from the imsg if
+// one matches.
+func (d *Decoder) verifyHMAC(im *IMsg) error {
+	hdr, data, sum, ok := splitTrailer(im, d.macSize)
+	if !ok {
+		return &ErrAuthFailed{im.Type}
+	}
+
+	for _, key := range d.macKeys(im) {
+		mac := hmac.New(d.macHash, key)
+		mac.Write(hdr[:])
+		mac.Write(data)
+		if hmac.Equal(mac.Sum(nil), sum) {
+			im.Data = data
+			return nil
+		}
+	}
+
+	return &ErrAuthFailed{im.Type}
+}
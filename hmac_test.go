@@ -0,0 +1,165 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"testing"
+)
+
+func TestHMACRoundTrip(t *testing.T) {
+	key := []byte("key")
+	ims := []*IMsg{
+		{Type: 1, PeerID: 2, PID: 3},
+		{Type: 4, PeerID: 5, PID: 6, Data: []byte("test")},
+		{Type: 7, Data: bytes.Repeat([]byte("a"), MaxSizeInBytes-HeaderSizeInBytes-sha256.Size)},
+	}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetHMAC(key, sha256.New)
+	for _, im := range ims {
+		err := enc.Encode(im)
+		if err != nil {
+			t.Fatalf("unexpected Encode failure: %s", err)
+		}
+	}
+
+	dec := NewDecoder(&buf)
+	dec.SetHMAC(key, sha256.New)
+	for _, expected := range ims {
+		im, err := dec.Decode()
+		if err != nil {
+			t.Fatalf("unexpected Decode failure: %s", err)
+		}
+		if !im.Equal(expected) {
+			t.Fatalf("decoded imsg does not match (%v != %v)", im, expected)
+		}
+	}
+
+	// The HMAC counts against the maximum size.
+	large := &IMsg{Type: 8, Data: make([]byte, MaxSizeInBytes-HeaderSizeInBytes-sha256.Size+1)}
+	err := enc.Encode(large)
+	var edtl *ErrDataTooLarge
+	if !errors.As(err, &edtl) || edtl.MaxLengthInBytes != MaxSizeInBytes-HeaderSizeInBytes-sha256.Size {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+}
+
+func TestHMACTamper(t *testing.T) {
+	key := []byte("key")
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetHMAC(key, sha256.New)
+	enc.Encode(&IMsg{Type: 1, PeerID: 2, PID: 3, Data: []byte("test")})
+	frame := buf.Bytes()
+
+	// Altering any byte other than the length, which would misframe the imsg,
+	// is detected.
+	for i := range frame {
+		if i == 4 || i == 5 {
+			continue
+		}
+		tampered := append([]byte{}, frame...)
+		tampered[i] ^= 0x01
+
+		dec := NewDecoder(bytes.NewReader(tampered))
+		dec.SetHMAC(key, sha256.New)
+		_, err := dec.Decode()
+		var eaf *ErrAuthFailed
+		if !errors.As(err, &eaf) {
+			t.Fatalf("byte %d: expected ErrAuthFailed, got: %v", i, err)
+		}
+	}
+
+	// A frame too short to hold an HMAC is refused.
+	short, _ := (&IMsg{Type: 1, Data: []byte("test")}).MarshalBinary()
+	dec := NewDecoder(bytes.NewReader(short))
+	dec.SetHMAC(key, sha256.New)
+	_, err := dec.Decode()
+	var eaf *ErrAuthFailed
+	if !errors.As(err, &eaf) || eaf.Type != 1 {
+		t.Fatalf("expected ErrAuthFailed for short frame, got: %v", err)
+	}
+
+	// So is a frame authenticated with another key, and the stream remains
+	// intact afterward.
+	buf.Reset()
+	enc.Encode(&IMsg{Type: 2})
+	enc.SetHMAC([]byte("other"), sha256.New)
+	enc.Encode(&IMsg{Type: 3})
+	dec = NewDecoder(&buf)
+	dec.SetHMAC([]byte("other"), sha256.New)
+	_, err = dec.Decode()
+	if !errors.As(err, &eaf) || eaf.Type != 2 {
+		t.Fatalf("expected ErrAuthFailed for wrong key, got: %v", err)
+	}
+	im, err := dec.Decode()
+	if err != nil || im.Type != 3 {
+		t.Fatalf("unexpected Decode result after failure (%v, %v)", im, err)
+	}
+}
+
+func TestHMACKeyRotation(t *testing.T) {
+	oldKey, newKey := []byte("old"), []byte("new")
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetHMAC(oldKey, sha256.New)
+	enc.Encode(&IMsg{Type: 1})
+	enc.SetHMAC(newKey, sha256.New)
+	enc.Encode(&IMsg{Type: 2})
+	enc.SetHMAC([]byte("unknown"), sha256.New)
+	enc.Encode(&IMsg{Type: 3})
+
+	var calls int
+	dec := NewDecoder(&buf)
+	dec.SetHMACKeyFunc(sha256.New, func(im *IMsg) [][]byte {
+		calls++
+		return [][]byte{newKey, oldKey}
+	})
+	for typ := uint32(1); typ <= 2; typ++ {
+		im, err := dec.Decode()
+		if err != nil || im.Type != typ {
+			t.Fatalf("unexpected Decode result (%v, %v)", im, err)
+		}
+	}
+	_, err := dec.Decode()
+	var eaf *ErrAuthFailed
+	if !errors.As(err, &eaf) || eaf.Type != 3 {
+		t.Fatalf("expected ErrAuthFailed, got: %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("unexpected number of key function calls (%d)", calls)
+	}
+}
+
+func TestHMACWithCompression(t *testing.T) {
+	key := []byte("key")
+	im := &IMsg{Type: 1, Data: bytes.Repeat([]byte("text "), 1000)}
+
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetCompression(0)
+	enc.SetHMAC(key, sha256.New)
+	err := enc.Encode(im)
+	if err != nil {
+		t.Fatalf("unexpected Encode failure: %s", err)
+	}
+
+	dec := NewDecoder(&buf)
+	dec.SetDecompressionLimit(DefaultDecompressionLimit)
+	dec.SetHMAC(key, sha256.New)
+	decoded, err := dec.Decode()
+	if err != nil {
+		t.Fatalf("unexpected Decode failure: %s", err)
+	}
+	if !decoded.Equal(im) {
+		t.Fatalf("decoded imsg does not match (%v != %v)", decoded, im)
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"encoding/binary"
+)
+
+// An IBuf incrementally builds the ancillary data of an imsg, mirroring the
+// ibuf_add family of functions in the C implementation. Errors are sticky: once
+// an Add fails, all subsequent Adds are ignored and the error is reported by
+// Err, so a sequence of Adds can be checked once at the end.
+type IBuf struct {
+	buf     []byte
+	order   binary.ByteOrder
+	maxSize uint16
+	err     error
+}
+
+// NewIBuf constructs an empty IBuf which encodes integers in the system byte
+// order and holds no more data than fits in an imsg of MaxSizeInBytes.
+func NewIBuf() *IBuf {
+	return &IBuf{
+		order:   endianness,
+		maxSize: MaxSizeInBytes,
+	}
+}
+
+// SetByteOrder sets the byte order used by subsequent integer Adds. Protocols
+// which use network byte order, as with ibuf_add_n16 and friends, should use
+// binary.BigEndian.
+func (b *IBuf) SetByteOrder(order binary.ByteOrder) {
+	b.order = order
+}
+
+// SetMaxSize sets the maximum size in bytes of the imsg the IBuf's data is
+// destined for, which defaults to MaxSizeInBytes. Sizes smaller than
+// HeaderSizeInBytes are rejected.
+func (b *IBuf) SetMaxSize(n uint16) error {
+	err := validateMaxSize(n)
+	if err != nil {
+		return err
+	}
+
+	b.maxSize = n
+
+	return nil
+}
+
+// Add appends bs to the IBuf. If doing so would exceed the maximum size, the
+// IBuf's error is set to ErrDataTooLarge and nothing is appended.
+func (b *IBuf) Add(bs []byte) {
+	if b.err != nil {
+		return
+	}
+
+	max := int(b.maxSize) - HeaderSizeInBytes
+	if len(b.buf)+len(bs) > max {
+		b.err = NewErrDataTooLarge(len(b.buf)+len(bs), max)
+		return
+	}
+
+	b.buf = append(b.buf, bs...)
+}
+
+// AddUint8 appends a single byte to the IBuf.
+func (b *IBuf) AddUint8(v uint8) {
+	b.Add([]byte{v})
+}
+
+// AddUint16 appends a 16-bit integer to the IBuf in its byte order.
+func (b *IBuf) AddUint16(v uint16) {
+	var bs [2]byte
+	b.order.PutUint16(bs[:], v)
+	b.Add(bs[:])
+}
+
+// AddUint32 appends a 32-bit integer to the IBuf in its byte order.
+func (b *IBuf) AddUint32(v uint32) {
+	var bs [4]byte
+	b.order.PutUint32(bs[:], v)
+	b.Add(bs[:])
+}
+
+// AddUint64 appends a 64-bit integer to the IBuf in its byte order.
+func (b *IBuf) AddUint64(v uint64) {
+	var bs [8]byte
+	b.order.PutUint64(bs[:], v)
+	b.Add(bs[:])
+}
+
+// AddString appends the bytes of s to the IBuf without a terminator.
+func (b *IBuf) AddString(s string) {
+	b.Add([]byte(s))
+}
+
+// AddCString appends the bytes of s to the IBuf followed by a terminating NUL,
+// as expected by C peers.
+func (b *IBuf) AddCString(s string) {
+	if b.err != nil {
+		return
+	}
+
+	n := len(b.buf)
+	b.AddString(s)
+	b.AddUint8(0)
+	if b.err != nil {
+		// Don't leave a partial string behind.
+		b.buf = b.buf[:n]
+	}
+}
+
+// ComposeIMsgFromIBuf constructs an IMsg of the provided type whose ancillary
+// data is the contents of buf. The IMsg takes ownership of buf's backing
+// storage without copying it, and buf is left empty. If buf has recorded an
+// error, that error is returned instead, and if it holds more data than fits in
+// an imsg of the IBuf's maximum size, ErrDataTooLarge is returned. The PID field
+// is filled in as with ComposeIMsg. This is the equivalent of
+// imsg_compose_ibuf.
+func ComposeIMsgFromIBuf(
+	typ, peerID uint32,
+	buf *IBuf,
+) (*IMsg, error) {
+	if buf.err != nil {
+		return nil, buf.err
+	}
+
+	im, err := composeIMsg(typ, peerID, buf.buf, buf.maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	buf.buf = nil
+
+	return im, nil
+}
+
+// Bytes returns the data accumulated in the IBuf.
+func (b *IBuf) Bytes() []byte {
+	return b.buf
+}
+
+// Len returns the number of bytes accumulated in the IBuf.
+func (b *IBuf) Len() int {
+	return len(b.buf)
+}
+
+// Err returns the first error encountered while adding to the IBuf, if any.
+func (b *IBuf) Err() error {
+	return b.err
+}
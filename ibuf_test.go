@@ -0,0 +1,171 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestIBuf(t *testing.T) {
+	var tests = []struct {
+		name     string
+		order    binary.ByteOrder
+		expected []byte
+	}{
+		{
+			"little endian",
+			binary.LittleEndian,
+			[]byte{
+				0x01,
+				0x02, 0x01,
+				0x04, 0x03, 0x02, 0x01,
+				0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01,
+				'h', 'i',
+				'e', 'm', '0', 0,
+				0xaa, 0xbb,
+			},
+		},
+		{
+			"big endian",
+			binary.BigEndian,
+			[]byte{
+				0x01,
+				0x01, 0x02,
+				0x01, 0x02, 0x03, 0x04,
+				0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+				'h', 'i',
+				'e', 'm', '0', 0,
+				0xaa, 0xbb,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := NewIBuf()
+			b.SetByteOrder(tt.order)
+
+			b.AddUint8(0x01)
+			b.AddUint16(0x0102)
+			b.AddUint32(0x01020304)
+			b.AddUint64(0x0102030405060708)
+			b.AddString("hi")
+			b.AddCString("em0")
+			b.Add([]byte{0xaa, 0xbb})
+
+			if b.Err() != nil {
+				t.Fatalf("unexpected IBuf failure: %s", b.Err())
+			}
+			if !bytes.Equal(b.Bytes(), tt.expected) {
+				t.Fatalf("IBuf contents do not match expected output (% x != % x)", b.Bytes(), tt.expected)
+			}
+			if b.Len() != len(tt.expected) {
+				t.Fatalf("unexpected IBuf length (%d != %d)", b.Len(), len(tt.expected))
+			}
+		})
+	}
+}
+
+func TestIBufMaxSize(t *testing.T) {
+	var eloob *ErrLengthOutOfBounds
+	err := NewIBuf().SetMaxSize(HeaderSizeInBytes - 1)
+	if !errors.As(err, &eloob) {
+		t.Fatalf("expected ErrLengthOutOfBounds, got: %v", err)
+	}
+
+	b := NewIBuf()
+	err = b.SetMaxSize(HeaderSizeInBytes + 4)
+	if err != nil {
+		t.Fatalf("unexpected SetMaxSize failure: %s", err)
+	}
+
+	b.AddUint16(1)
+	b.AddCString("abc")
+	b.AddUint16(2)
+	b.AddUint8(3)
+
+	// The C string doesn't fit, and neither it nor anything after it is added.
+	var edtl *ErrDataTooLarge
+	if !errors.As(b.Err(), &edtl) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", b.Err())
+	}
+	if b.Len() != 2 {
+		t.Fatalf("unexpected IBuf length after failure (%d != 2)", b.Len())
+	}
+}
+
+func TestComposeIMsgFromIBuf(t *testing.T) {
+	b := NewIBuf()
+	b.AddUint32(0xdeadbeef)
+	b.AddCString("em0")
+
+	expected := append([]byte(nil), b.Bytes()...)
+
+	im, err := ComposeIMsgFromIBuf(1, 2, b)
+	if err != nil {
+		t.Fatalf("unexpected ComposeIMsgFromIBuf failure: %s", err)
+	}
+	if im.Type != 1 || im.PeerID != 2 || im.PID != uint32(os.Getpid()) {
+		t.Fatalf("composed imsg has unexpected header fields (%#v)", im)
+	}
+	if !bytes.Equal(im.Data, expected) {
+		t.Fatalf("composed imsg data does not match IBuf contents (% x != % x)", im.Data, expected)
+	}
+	if b.Len() != 0 {
+		t.Fatalf("IBuf was not emptied (%d bytes remain)", b.Len())
+	}
+
+	// Subsequent use of the IBuf must not disturb the composed imsg.
+	b.AddUint32(0)
+	if !bytes.Equal(im.Data, expected) {
+		t.Fatalf("composed imsg data was modified by reuse of the IBuf")
+	}
+}
+
+func TestComposeIMsgFromIBufErrors(t *testing.T) {
+	var edtl *ErrDataTooLarge
+
+	// A sticky error is returned in place of an imsg.
+	b := NewIBuf()
+	b.Add(make([]byte, MaxSizeInBytes))
+	im, err := ComposeIMsgFromIBuf(1, 2, b)
+	if im != nil || !errors.As(err, &edtl) {
+		t.Fatalf("expected ErrDataTooLarge, got: (%#v, %v)", im, err)
+	}
+
+	// An IBuf which permits larger imsgs composes them.
+	b = NewIBuf()
+	err = b.SetMaxSize(MaxSizeInBytes * 2)
+	if err != nil {
+		t.Fatalf("unexpected SetMaxSize failure: %s", err)
+	}
+	b.Add(make([]byte, MaxSizeInBytes))
+	im, err = ComposeIMsgFromIBuf(1, 2, b)
+	if err != nil {
+		t.Fatalf("unexpected ComposeIMsgFromIBuf failure: %s", err)
+	}
+	if len(im.Data) != MaxSizeInBytes {
+		t.Fatalf("unexpected data length (%d != %d)", len(im.Data), MaxSizeInBytes)
+	}
+
+	// An IBuf whose maximum size was lowered may hold too much data.
+	b = NewIBuf()
+	b.Add(make([]byte, 8))
+	err = b.SetMaxSize(HeaderSizeInBytes + 4)
+	if err != nil {
+		t.Fatalf("unexpected SetMaxSize failure: %s", err)
+	}
+	im, err = ComposeIMsgFromIBuf(1, 2, b)
+	if im != nil || !errors.As(err, &edtl) || edtl.MaxLengthInBytes != 4 {
+		t.Fatalf("expected ErrDataTooLarge, got: (%#v, %v)", im, err)
+	}
+	if b.Len() != 8 {
+		t.Fatalf("IBuf was emptied despite failure")
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// This is the state of a Conn's idle timeout, which is set by WithIdleTimeout.
+type idleTimeout struct {
+	d          time.Duration
+	heartbeats bool // Set by WithIdleHeartbeats
+
+	lastActive atomic.Int64 // When an imsg was last sent or received, in Unix nanoseconds
+
+	mu      sync.Mutex
+	t       *time.Timer
+	stopped bool
+
+	err atomic.Pointer[error] // Set if the Conn was closed for being idle
+}
+
+// WithIdleTimeout causes the Conn to be closed once no imsg has been sent or
+// received for the provided duration, after which Recv returns ErrIdleTimeout.
+// This reclaims connections abandoned by peers which neither close them nor
+// use them, such as a command-line client which was suspended and forgotten.
+// Heartbeats sent and received under WithKeepalive don't count as activity
+// unless WithIdleHeartbeats is also provided.
+func WithIdleTimeout(d time.Duration) ConnOption {
+	return func(c *Conn) {
+		c.idleState().d = d
+	}
+}
+
+// WithIdleHeartbeats causes heartbeats sent and received under WithKeepalive to
+// count as activity for the idle timeout set with WithIdleTimeout, so that only
+// a peer which has stopped responding altogether is disconnected.
+func WithIdleHeartbeats() ConnOption {
+	return func(c *Conn) {
+		c.idleState().heartbeats = true
+	}
+}
+
+// WithNetIdleTimeout applies WithIdleTimeout to each connection's Conn.
+func WithNetIdleTimeout(d time.Duration) NetOption {
+	return WithNetConnOptions(WithIdleTimeout(d))
+}
+
+// idleState returns the idle timeout state of the Conn, creating it if none
+// has been set.
+func (c *Conn) idleState() *idleTimeout {
+	if c.idle == nil {
+		c.idle = &idleTimeout{}
+	}
+
+	return c.idle
+}
+
+// startIdleTimer starts the timer which closes the Conn once it's idle.
+func (c *Conn) startIdleTimer() {
+	c.idle.lastActive.Store(time.Now().UnixNano())
+
+	c.idle.mu.Lock()
+	c.idle.t = time.AfterFunc(c.idle.d, c.idleExpired)
+	c.idle.mu.Unlock()
+}
+
+// idleExpired is called by the timer once the idle timeout may have elapsed.
+// Unless there has been activity in the meantime, which rearms the timer for
+// the remainder, the Conn is closed.
+func (c *Conn) idleExpired() {
+	c.idle.mu.Lock()
+	if c.idle.stopped {
+		c.idle.mu.Unlock()
+		return
+	}
+	idle := time.Since(time.Unix(0, c.idle.lastActive.Load()))
+	if idle < c.idle.d {
+		c.idle.t.Reset(c.idle.d - idle)
+		c.idle.mu.Unlock()
+		return
+	}
+	c.idle.stopped = true
+	c.idle.mu.Unlock()
+
+	var err error = &ErrIdleTimeout{c.idle.d}
+	c.idle.err.Store(&err)
+	c.fail(err)
+	if c.debugEnabled() {
+		c.logDebug("imsg connection idle")
+	}
+	c.Close()
+}
+
+// markActive records that an imsg was sent or received, postponing the idle
+// timeout. A heartbeat only counts if WithIdleHeartbeats was provided.
+func (c *Conn) markActive(heartbeat bool) {
+	if c.idle == nil || c.idle.d <= 0 || (heartbeat && !c.idle.heartbeats) {
+		return
+	}
+
+	c.idle.lastActive.Store(time.Now().UnixNano())
+}
+
+// stopIdleTimer stops the idle timer, if any.
+func (c *Conn) stopIdleTimer() {
+	if c.idle == nil {
+		return
+	}
+
+	c.idle.mu.Lock()
+	c.idle.stopped = true
+	if c.idle.t != nil {
+		c.idle.t.Stop()
+	}
+	c.idle.mu.Unlock()
+}
+
+// idleErr returns ErrIdleTimeout if the Conn was closed for being idle, and
+// nil otherwise.
+func (c *Conn) idleErr() error {
+	if c.idle == nil {
+		return nil
+	}
+	errp := c.idle.err.Load()
+	if errp == nil {
+		return nil
+	}
+
+	return *errp
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// recvIdleTimeout receives from c until it fails, expecting ErrIdleTimeout, and
+// returns how long that took.
+func recvIdleTimeout(t *testing.T, c *Conn) time.Duration {
+	t.Helper()
+
+	start := time.Now()
+	errc := make(chan error, 1)
+	go func() {
+		for {
+			_, err := c.Recv()
+			if err != nil {
+				errc <- err
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-errc:
+		var eit *ErrIdleTimeout
+		if !errors.As(err, &eit) {
+			t.Fatalf("expected ErrIdleTimeout, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("idle connection was not closed")
+	}
+
+	return time.Since(start)
+}
+
+func TestConnIdleTimeout(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+	a, b := newTestSocketPair(t)
+	a = rewrapTestConn(t, a, WithIdleTimeout(timeout))
+
+	// Activity in either direction postpones the timeout.
+	go func() {
+		for i := 0; i < 6; i++ {
+			time.Sleep(timeout / 2)
+			if i%2 == 0 {
+				b.Send(&IMsg{Type: 1})
+			} else {
+				a.Send(&IMsg{Type: 2})
+			}
+		}
+	}()
+	elapsed := recvIdleTimeout(t, a)
+	if elapsed < 3*timeout {
+		t.Fatalf("idle connection was closed despite activity (after %s)", elapsed)
+	}
+
+	_, err := a.Recv()
+	var eit *ErrIdleTimeout
+	if !errors.As(err, &eit) || eit.Timeout != timeout {
+		t.Fatalf("expected ErrIdleTimeout from subsequent Recv, got: %v", err)
+	}
+}
+
+func TestConnIdleTimeoutClose(t *testing.T) {
+	a, _ := newTestSocketPair(t)
+	a = rewrapTestConn(t, a, WithIdleTimeout(50*time.Millisecond))
+
+	err := a.Close()
+	if err != nil {
+		t.Fatalf("unexpected Close failure: %s", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := a.idleErr(); err != nil {
+		t.Fatalf("unexpected idle error after Close: %s", err)
+	}
+}
+
+func TestConnIdleTimeoutHeartbeats(t *testing.T) {
+	const timeout = 100 * time.Millisecond
+
+	for _, counted := range []bool{false, true} {
+		a, b := newTestSocketPair(t)
+		opts := []ConnOption{
+			WithIdleTimeout(timeout),
+			WithKeepalive(10*time.Millisecond, time.Hour, testTypeHeartbeat),
+		}
+		if counted {
+			opts = append(opts, WithIdleHeartbeats())
+		}
+		a = rewrapTestConn(t, a, opts...)
+
+		// The peer echoes heartbeats.
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			for ctx.Err() == nil {
+				im, err := b.Recv()
+				if err != nil {
+					return
+				}
+				b.Send(im)
+			}
+		}()
+
+		if !counted {
+			recvIdleTimeout(t, a)
+			cancel()
+			continue
+		}
+
+		errc := make(chan error, 1)
+		go func() {
+			_, err := a.Recv()
+			errc <- err
+		}()
+		select {
+		case err := <-errc:
+			t.Fatalf("connection with heartbeats was closed: %v", err)
+		case <-time.After(3 * timeout):
+		}
+		cancel()
+		a.Close()
+	}
+}
+
+func TestListenerIdleTimeout(t *testing.T) {
+	a, b := newTestTCPPair(t, WithNetIdleTimeout(50*time.Millisecond))
+
+	if a.idle == nil || b.idle == nil {
+		t.Fatalf("idle timeout was not applied to both connections")
+	}
+	recvIdleTimeout(t, b)
+}
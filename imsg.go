@@ -6,11 +6,14 @@
 package imsg
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"io"
+	"math"
+	"net"
 	"os"
-	"unsafe"
+	"time"
 )
 
 const (
@@ -21,30 +24,57 @@ const (
 	MaxSizeInBytes = 16384
 )
 
+// FlagHasFD is set in the header of an imsg which has a file descriptor
+// attached. It matches IMSGF_HASFD in the C implementation.
+const FlagHasFD Flags = 1
+
+// checkFlags returns ErrUnknownFlags if any bits other than those of known are
+// set in flags.
+func checkFlags(flags, known Flags) error {
+	if flags&^known != 0 {
+		return &ErrUnknownFlags{flags}
+	}
+
+	return nil
+}
+
 // This is the system's endianness, which is used to convert imsgs to and from
-// binary.
-var endianness binary.ByteOrder
-
-func init() {
-	// N.B. This is a gross little hack to determine the system's endianness by
-	// creating an unsafe.Pointer of a 16-bit int and directly inspecting its
-	// in-memory layout.
-	var x uint16 = 1
-	bs := (*[2]byte)(unsafe.Pointer(&x))
+// binary. It's always binary.LittleEndian or binary.BigEndian, so that it can
+// be compared against either.
+var endianness = concreteOrder(binary.NativeEndian)
+
+// concreteOrder returns whichever of binary.LittleEndian and binary.BigEndian
+// matches the provided byte order, such as binary.NativeEndian.
+func concreteOrder(order binary.ByteOrder) binary.ByteOrder {
+	var bs [2]byte
+	order.PutUint16(bs[:], 1)
 	if bs[0] == 1 {
-		endianness = binary.LittleEndian
-	} else {
-		endianness = binary.BigEndian
+		return binary.LittleEndian
 	}
+
+	return binary.BigEndian
 }
 
-// This is a fixed-size header used to simplify marshaling and unmarshaling.
-type imsgHeader struct {
-	Type   uint32
-	Length uint16
-	Flags  uint16
-	PeerID uint32
-	PID    uint32
+// A Header is the fixed-size header which prepends each imsg on the wire. Its
+// layout matches struct imsg_hdr in the C implementation.
+type Header struct {
+	Type   uint32 // Describes the meaning of the message
+	Length uint16 // Size in bytes of the imsg, including the header
+	Flags  Flags  // Used internally, such as to mark an attached descriptor
+	PeerID uint32 // Free for use by caller; intended to identify message sender
+	PID    uint32 // Free for use by caller; intended to identify message sender
+}
+
+// parseHeader decodes a header encoded in the provided byte order from bs,
+// which must be at least HeaderSizeInBytes long.
+func parseHeader(bs []byte, order binary.ByteOrder) Header {
+	return Header{
+		Type:   order.Uint32(bs[0:4]),
+		Length: order.Uint16(bs[4:6]),
+		Flags:  Flags(order.Uint16(bs[6:8])),
+		PeerID: order.Uint32(bs[8:12]),
+		PID:    order.Uint32(bs[12:16]),
+	}
 }
 
 // An IMsg is a message used to aid inter-process communication over sockets,
@@ -55,74 +85,651 @@ type IMsg struct {
 	PID    uint32 // Free for use by caller; intended to identify message sender
 	Data   []byte // Ancillary data included with the imsg
 
-	// Flags are used internally by imsg functions in the C implementation and
-	// should not be used by applications. For that reason, they're included but
-	// unused in this library.
-	flags uint16
+	// This is the flags word of the header. FlagHasFD marks an imsg sent with
+	// a file attached and FlagCompressed one whose data is compressed, both of
+	// which the library manages itself. Any other bits are carried through
+	// untouched and are accessed with Flags and SetFlags.
+	flags Flags
+
+	// This is a file whose descriptor accompanies the imsg when it's sent over
+	// a Conn.
+	file *os.File
+
+	// This is set by WithWipe.
+	wipe bool
+
+	// This is the time after which the imsg is discarded from a send queue
+	// rather than written, as set by WithTTL.
+	expires time.Time
+
+	// This is the priority with which the imsg is queued, as set by
+	// WithPriority.
+	prio Priority
+
+	// This is set by WithExplicitPeerID.
+	explicitPeerID bool
+
+	// These are the sender's credentials, as verified by the kernel, which
+	// accompany an imsg received over a Conn with credential passing enabled.
+	creds *Creds
+}
+
+// A ComposeOption configures an IMsg as it's composed. Options are applied in
+// order, so a later option overrides an earlier one of the same kind.
+type ComposeOption func(*composeConfig)
+
+// This is the configuration accumulated from ComposeOptions.
+type composeConfig struct {
+	pid      uint32
+	withPID  bool // Whether WithPID was provided
+	noPID    bool // Whether WithoutPID was provided
+	copyData bool
+	wipe     bool
+	ttl      time.Duration
+	prio     Priority
+	file     *os.File
+
+	explicitPeerID bool
+}
+
+// WithPID sets the PID field of the IMsg rather than filling it in from the
+// function set by SetPIDFunc. It can't be combined with WithoutPID.
+func WithPID(pid uint32) ComposeOption {
+	return func(c *composeConfig) {
+		c.pid = pid
+		c.withPID = true
+	}
+}
+
+// WithoutPID leaves the PID field of the IMsg zero rather than filling it in
+// from the function set by SetPIDFunc. It can't be combined with WithPID.
+func WithoutPID() ComposeOption {
+	return func(c *composeConfig) {
+		c.noPID = true
+	}
+}
+
+// WithDataCopy causes the ancillary data to be copied when an IMsg is
+// composed, so that later modification of the caller's slice doesn't affect
+// the IMsg.
+func WithDataCopy() ComposeOption {
+	return func(c *composeConfig) {
+		c.copyData = true
+	}
+}
+
+// WithFile attaches a file to the IMsg, as with ComposeIMsgWithFile.
+func WithFile(f *os.File) ComposeOption {
+	return func(c *composeConfig) {
+		c.file = f
+	}
 }
 
 // ComposeIMsg constructs an IMsg of the provided type. If the included
 // ancillary data is too large, an error is returned. When composing an IMsg
 // using this function, the PID field is filled in automatically by a call to
-// os.Getpid(). This can be overwritten as desired.
+// os.Getpid(), or to the function set by SetPIDFunc. This can be overwritten as
+// desired, or controlled with the WithPID and WithoutPID options. Conflicting
+// options produce ErrConflictingOptions.
+//
+// By default, the IMsg's Data refers to the provided slice rather than a copy
+// of it, so the slice must not be modified until the IMsg has been sent. The
+// WithDataCopy option removes this restriction at the cost of a copy.
 func ComposeIMsg(
 	typ, peerID uint32,
 	data []byte,
+	opts ...ComposeOption,
 ) (*IMsg, error) {
-	if len(data) > (MaxSizeInBytes - HeaderSizeInBytes) {
-		return nil, &ErrDataTooLarge{len(data), (MaxSizeInBytes - HeaderSizeInBytes)}
+	return composeIMsg(typ, peerID, data, MaxSizeInBytes, opts...)
+}
+
+// composeIMsg behaves like ComposeIMsg, limiting the size of the imsg to
+// maxSize bytes.
+func composeIMsg(
+	typ, peerID uint32,
+	data []byte,
+	maxSize uint16,
+	opts ...ComposeOption,
+) (*IMsg, error) {
+	if len(data) > int(maxSize)-HeaderSizeInBytes {
+		return nil, &ErrDataTooLarge{
+			DataLengthInBytes: len(data),
+			MaxLengthInBytes:  int(maxSize) - HeaderSizeInBytes,
+			Type:              typ,
+			PeerID:            peerID,
+		}
 	}
 
-	return &IMsg{
+	var cfg composeConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+	if cfg.withPID && cfg.noPID {
+		return nil, &ErrConflictingOptions{"WithPID", "WithoutPID"}
+	}
+
+	im := &IMsg{
 		Type:   typ,
 		PeerID: peerID,
-		PID:    uint32(os.Getpid()),
 		Data:   data,
-	}, nil
+		file:   cfg.file,
+		wipe:   cfg.wipe,
+		prio:   cfg.prio,
+
+		explicitPeerID: cfg.explicitPeerID,
+	}
+	if cfg.ttl > 0 {
+		im.expires = time.Now().Add(cfg.ttl)
+	}
+
+	switch {
+	case cfg.withPID:
+		im.PID = cfg.pid
+	case !cfg.noPID:
+		im.PID = currentPID()
+	}
+
+	if cfg.copyData && data != nil {
+		im.Data = append([]byte{}, data...)
+	}
+
+	return im, nil
+}
+
+// ComposeIMsgWithFile constructs an IMsg of the provided type, attaching the
+// provided file. When the IMsg is sent over a Conn, the file's descriptor is
+// passed to the peer alongside the IMsg and the file is closed. This is
+// equivalent to ComposeIMsg with the WithFile option.
+func ComposeIMsgWithFile(
+	typ, peerID uint32,
+	data []byte,
+	f *os.File,
+) (*IMsg, error) {
+	return ComposeIMsg(typ, peerID, data, WithFile(f))
+}
+
+// ComposeIMsgv constructs an IMsg of the provided type whose ancillary data is
+// the concatenation of the provided slices. The combined length is checked
+// before anything is copied, and empty slices are permitted. This is the
+// equivalent of imsg_composev.
+func ComposeIMsgv(
+	typ, peerID uint32,
+	data ...[]byte,
+) (*IMsg, error) {
+	n := vecLen(data)
+	if n > (MaxSizeInBytes - HeaderSizeInBytes) {
+		return nil, &ErrDataTooLarge{
+			DataLengthInBytes: n,
+			MaxLengthInBytes:  MaxSizeInBytes - HeaderSizeInBytes,
+			Type:              typ,
+			PeerID:            peerID,
+		}
+	}
+
+	var buf []byte
+	if n > 0 {
+		buf = make([]byte, 0, n)
+		for _, bs := range data {
+			buf = append(buf, bs...)
+		}
+	}
+
+	return ComposeIMsg(typ, peerID, buf)
+}
+
+// ComposeIMsgString constructs an IMsg of the provided type whose ancillary
+// data is the bytes of s, without a terminator. Unlike ComposeStringIMsg, which
+// produces C strings, any string round-trips unchanged, including one with
+// embedded NULs. The PID field is filled in as with ComposeIMsg.
+func ComposeIMsgString(
+	typ, peerID uint32,
+	s string,
+) (*IMsg, error) {
+	if len(s) > (MaxSizeInBytes - HeaderSizeInBytes) {
+		return nil, &ErrDataTooLarge{
+			DataLengthInBytes: len(s),
+			MaxLengthInBytes:  MaxSizeInBytes - HeaderSizeInBytes,
+			Type:              typ,
+			PeerID:            peerID,
+		}
+	}
+
+	var data []byte
+	if len(s) > 0 {
+		data = []byte(s)
+	}
+
+	return ComposeIMsg(typ, peerID, data)
+}
+
+// vecLen returns the combined length in bytes of the provided slices.
+func vecLen(data [][]byte) int {
+	var n int
+	for _, bs := range data {
+		n += len(bs)
+	}
+
+	return n
+}
+
+// marshalv marshals an imsg whose ancillary data is the concatenation of the
+// provided slices, copying each directly into place rather than joining them
+// first. The size of the imsg is limited to maxSize bytes.
+func marshalv(
+	typ, peerID, pid uint32,
+	data [][]byte,
+	maxSize uint16,
+) ([]byte, error) {
+	n := vecLen(data)
+	if n+HeaderSizeInBytes > int(maxSize) {
+		return nil, &ErrDataTooLarge{
+			DataLengthInBytes: n,
+			MaxLengthInBytes:  int(maxSize) - HeaderSizeInBytes,
+			Type:              typ,
+			PeerID:            peerID,
+		}
+	}
+
+	bs := make([]byte, HeaderSizeInBytes, HeaderSizeInBytes+n)
+	endianness.PutUint32(bs[0:4], typ)
+	endianness.PutUint16(bs[4:6], uint16(HeaderSizeInBytes+n))
+	endianness.PutUint32(bs[8:12], peerID)
+	endianness.PutUint32(bs[12:16], pid)
+	for _, d := range data {
+		bs = append(bs, d...)
+	}
+
+	return bs, nil
 }
 
 // ReadIMsg constructs an IMsg by reading from an io.Reader. If the incoming
 // data is malformed, this function can block by attempting to read more data
-// than is present.
+// than is present. If the reader is exhausted before any data is read, io.EOF
+// is returned; if it's exhausted partway through an imsg, ErrTruncated is
+// returned.
 func ReadIMsg(r io.Reader) (*IMsg, error) {
+	im, _, err := readIMsgN(r, MaxSizeInBytes)
+	return im, err
+}
+
+// ReadIMsgInto behaves like ReadIMsg, decoding into the provided imsg rather
+// than allocating a new one. The imsg's Data is resliced to hold the incoming
+// data if it has sufficient capacity and is only reallocated otherwise, so
+// reading a stream of imsgs into a single IMsg, or into imsgs drawn from a
+// sync.Pool after Reset, needn't allocate. As with Reset, an attached file is
+// detached but not closed. On failure, the imsg is left in an unspecified but
+// valid state.
+func ReadIMsgInto(r io.Reader, im *IMsg) error {
+	_, err := im.ReadFrom(r)
+	return err
+}
+
+// ReadIMsgN behaves like ReadIMsg, additionally returning the number of bytes
+// consumed from the io.Reader, header included. The count is accurate even when
+// an error is returned, so a header read which fails after 7 bytes reports 7.
+func ReadIMsgN(r io.Reader) (*IMsg, int, error) {
+	return readIMsgN(r, MaxSizeInBytes)
+}
+
+// SkipIMsg reads the header of the next imsg from an io.Reader and discards the
+// imsg's data without allocating space for it, leaving the reader positioned
+// at the start of the following imsg. This suits callers which decide from the
+// header alone that an imsg isn't wanted. Errors are reported as ReadIMsg
+// reports them.
+func SkipIMsg(r io.Reader) (Header, error) {
+	var hdr [HeaderSizeInBytes]byte
+	h, _, err := skipIMsg(r, hdr[:], MaxSizeInBytes)
+	return h, err
+}
+
+// PeekHeader returns the header of the next imsg buffered by br without
+// consuming anything, so that a caller can decide how to handle an imsg before
+// committing to reading it. If br can't buffer a whole header because its
+// source would block, ErrNeedMore reports how many more bytes are needed.
+// Otherwise, errors, including a header whose length is out of bounds, are
+// reported as ReadIMsg reports them.
+func PeekHeader(br *bufio.Reader) (Header, error) {
+	bs, err := br.Peek(HeaderSizeInBytes)
+	if err != nil {
+		return Header{}, peekError(len(bs), err)
+	}
+
+	h := parseHeader(bs, endianness)
+	err = checkLength(h.Length, MaxSizeInBytes)
+	if err != nil {
+		return Header{}, err
+	}
+
+	return h, nil
+}
+
+// peekError maps err, encountered after n bytes of a header were read while
+// peeking at it, to the error reported to the caller.
+func peekError(n int, err error) error {
+	switch {
+	case err == io.EOF && n == 0:
+		return io.EOF
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return &ErrTruncated{HeaderSizeInBytes, n, "header"}
+	case err == ErrWouldBlock || isWouldBlock(err):
+		return &ErrNeedMore{HeaderSizeInBytes - n}
+	}
+
+	return &ErrRead{"header", err}
+}
+
+// skipIMsg behaves like SkipIMsg, reading the header into hdr, which must be
+// HeaderSizeInBytes long, and limiting the size of the imsg to maxSize bytes.
+// The number of bytes consumed is returned as by ReadIMsgN.
+func skipIMsg(r io.Reader, hdr []byte, maxSize uint16) (Header, int, error) {
+	n, err := io.ReadFull(r, hdr)
+	switch {
+	case err == io.EOF:
+		return Header{}, 0, err
+	case err == io.ErrUnexpectedEOF:
+		return Header{}, n, &ErrTruncated{HeaderSizeInBytes, n, "header"}
+	case err != nil:
+		return Header{}, n, &ErrRead{"header", err}
+	}
+
+	h := parseHeader(hdr, endianness)
+	err = checkLength(h.Length, maxSize)
+	if err != nil {
+		return Header{}, n, err
+	}
+
+	// io.Discard reads into a small pooled buffer.
+	size := int64(h.Length) - HeaderSizeInBytes
+	m, err := io.CopyN(io.Discard, r, size)
+	n += int(m)
+	switch {
+	case err == io.EOF:
+		return h, n, &ErrTruncated{int(size), int(m), "body"}
+	case err != nil:
+		return h, n, &ErrRead{"body", err}
+	}
+
+	return h, n, nil
+}
+
+// readIMsgN behaves like ReadIMsgN, limiting the size of the imsg to maxSize
+// bytes.
+func readIMsgN(r io.Reader, maxSize uint16) (*IMsg, int, error) {
+	var hdr [HeaderSizeInBytes]byte
+	return readIMsgHdr(r, hdr[:], maxSize)
+}
+
+// readIMsgHdr behaves like readIMsgN, reading the header into hdr, which must
+// be HeaderSizeInBytes long. This leaves the header bytes available to the
+// caller when decoding fails.
+func readIMsgHdr(r io.Reader, hdr []byte, maxSize uint16) (*IMsg, int, error) {
 	im := &IMsg{}
 
-	var hdr imsgHeader
-	err := binary.Read(r, endianness, &hdr)
+	n, err := readIMsgInto(r, hdr, maxSize, im, nil)
 	if err != nil {
-		return nil, err
+		return nil, n, err
 	}
 
-	if hdr.Length < HeaderSizeInBytes || hdr.Length > MaxSizeInBytes {
-		return nil, &ErrLengthOutOfBounds{
-			hdr.Length,
-			HeaderSizeInBytes,
-			MaxSizeInBytes,
+	return im, n, nil
+}
+
+// readIMsgInto behaves like readIMsgHdr, decoding into im. The imsg's data is
+// read into buf if it has sufficient capacity, and into a newly allocated
+// slice otherwise. On failure, im is left in an unspecified state.
+func readIMsgInto(
+	r io.Reader,
+	hdr []byte,
+	maxSize uint16,
+	im *IMsg,
+	buf []byte,
+) (int, error) {
+	n, err := io.ReadFull(r, hdr)
+	switch {
+	case err == io.EOF:
+		// A clean end of stream between imsgs isn't an error.
+		return 0, err
+	case err == io.ErrUnexpectedEOF:
+		return n, &ErrTruncated{HeaderSizeInBytes, n, "header"}
+	case err != nil:
+		return n, &ErrRead{"header", err}
+	}
+
+	length, err := im.getHeader(hdr, maxSize)
+	if err != nil {
+		return n, err
+	}
+
+	im.Data = buf[:0]
+	if length > HeaderSizeInBytes {
+		if size := length - HeaderSizeInBytes; cap(buf) >= size {
+			im.Data = buf[:size]
+		} else {
+			im.Data = make([]byte, size)
+		}
+
+		m, err := io.ReadFull(r, im.Data)
+		n += m
+		switch {
+		case err == io.EOF || err == io.ErrUnexpectedEOF:
+			return n, &ErrTruncated{len(im.Data), m, "body"}
+		case err != nil:
+			return n, &ErrRead{"body", err}
 		}
 	}
 
-	im.Type = hdr.Type
-	im.PeerID = hdr.PeerID
-	im.PID = hdr.PID
-	im.flags = hdr.Flags
+	return n, nil
+}
+
+// MarshalAll returns the concatenated wire encodings of the provided imsgs,
+// which DecodeAll reverses. If any of the imsgs is too large, nothing is
+// marshaled and the imsg's ErrDataTooLarge is returned wrapped in an ErrBatch.
+func MarshalAll(ims []*IMsg) ([]byte, error) {
+	var size int
+	for i, im := range ims {
+		err := im.Validate()
+		if err != nil {
+			return nil, &ErrBatch{i, err}
+		}
+		size += im.Len()
+	}
 
-	if hdr.Length > HeaderSizeInBytes {
-		im.Data = make([]byte, hdr.Length-HeaderSizeInBytes)
+	bs := make([]byte, size)
+	off := 0
+	for _, im := range ims {
+		im.putHeader(bs[off:])
+		copy(bs[off+HeaderSizeInBytes:], im.Data)
+		off += im.Len()
+	}
 
-		n, err := r.Read(im.Data)
+	return bs, nil
+}
+
+// DecodeAll decodes every imsg in data, which holds zero or more consecutive
+// imsgs. If data ends partway through an imsg, the imsgs decoded so far are
+// returned along with ErrTruncated.
+func DecodeAll(data []byte) ([]*IMsg, error) {
+	var ims []*IMsg
+
+	for len(data) > 0 {
+		im := &IMsg{}
+		err := im.UnmarshalBinary(data)
 		if err != nil {
-			return nil, err
+			return ims, err
+		}
+
+		ims = append(ims, im)
+		data = data[im.Len():]
+	}
+
+	return ims, nil
+}
+
+// getHeader decodes the header at the start of bs, which must be at least
+// HeaderSizeInBytes long, into the imsg, returning the length of the imsg. The
+// length may be no larger than maxSize bytes.
+func (im *IMsg) getHeader(bs []byte, maxSize uint16) (int, error) {
+	length := endianness.Uint16(bs[4:6])
+	err := checkLength(length, maxSize)
+	if err != nil {
+		return 0, err
+	}
+
+	im.Type = endianness.Uint32(bs[0:4])
+	im.flags = Flags(endianness.Uint16(bs[6:8]))
+	im.PeerID = endianness.Uint32(bs[8:12])
+	im.PID = endianness.Uint32(bs[12:16])
+
+	return int(length), nil
+}
+
+// frameLength returns the length in bytes of the imsg at the start of buf,
+// whose header is in the provided byte order and which may be no larger than
+// maxSize bytes. If buf doesn't yet hold a complete imsg, zero is returned.
+func frameLength(buf []byte, maxSize uint16, order binary.ByteOrder) (int, error) {
+	if len(buf) < HeaderSizeInBytes {
+		return 0, nil
+	}
+
+	length := order.Uint16(buf[4:6])
+	err := checkLength(length, maxSize)
+	if err != nil {
+		return 0, err
+	}
+	if len(buf) < int(length) {
+		return 0, nil
+	}
+
+	return int(length), nil
+}
+
+// checkLength checks the length field of a header against the bounds imposed
+// by HeaderSizeInBytes and maxSize.
+func checkLength(length, maxSize uint16) error {
+	if length < HeaderSizeInBytes || length > maxSize {
+		return &ErrLengthOutOfBounds{
+			length,
+			HeaderSizeInBytes,
+			maxSize,
 		}
+	}
+
+	return nil
+}
+
+// ValidateWire checks that b begins with a structurally valid imsg in the
+// system's byte order, without decoding it: b must hold a whole header, whose
+// length must lie within the bounds imposed by HeaderSizeInBytes and
+// MaxSizeInBytes, and the rest of the imsg. Bytes beyond the imsg are ignored.
+// The errors are those UnmarshalBinary returns, ErrTruncated and
+// ErrLengthOutOfBounds, and UnmarshalBinary succeeds exactly when ValidateWire
+// does. Nothing is allocated unless an error is returned.
+func ValidateWire(b []byte) error {
+	_, err := validateWire(b, endianness, MaxSizeInBytes)
+	return err
+}
+
+// ValidateWireOrder behaves like ValidateWire for an imsg whose header is in
+// the provided byte order.
+func ValidateWireOrder(b []byte, order binary.ByteOrder) error {
+	_, err := validateWire(b, order, MaxSizeInBytes)
+	return err
+}
+
+// validateWire behaves like ValidateWireOrder, limiting the size of the imsg to
+// maxSize bytes and returning its length.
+func validateWire(b []byte, order binary.ByteOrder, maxSize uint16) (int, error) {
+	if len(b) < HeaderSizeInBytes {
+		return 0, &ErrTruncated{HeaderSizeInBytes, len(b), "header"}
+	}
 
-		if n != int(hdr.Length)-HeaderSizeInBytes {
-			return nil, &ErrInsufficientData{
-				hdr.Length - HeaderSizeInBytes,
-				n,
-			}
+	n, err := frameLength(b, maxSize, order)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, &ErrTruncated{
+			int(order.Uint16(b[4:6])) - HeaderSizeInBytes,
+			len(b) - HeaderSizeInBytes,
+			"body",
 		}
 	}
 
-	return im, nil
+	return n, nil
+}
+
+// swapHeader reverses the bytes of each field of the header at the start of
+// bs, converting it between the system's byte order and the opposite one.
+func swapHeader(bs []byte) {
+	for _, field := range [...][2]int{{0, 4}, {4, 6}, {6, 8}, {8, 12}, {12, 16}} {
+		f := bs[field[0]:field[1]]
+		for i, j := 0, len(f)-1; i < j; i, j = i+1, j-1 {
+			f[i], f[j] = f[j], f[i]
+		}
+	}
+}
+
+// FrameSize reports the length in bytes of the imsg at the start of b, which
+// holds bytes buffered from an imsg stream, so that custom framing layers can
+// determine when a complete imsg is present. Once b holds at least a header,
+// the imsg's length is returned, and if b also holds the rest of the imsg, the
+// error is nil. Otherwise, ErrNeedMore reports how many more bytes are needed:
+// to complete the header if b is shorter than it, or the imsg if not. A length
+// outside the bounds imposed by HeaderSizeInBytes and MaxSizeInBytes results
+// in ErrLengthOutOfBounds. FrameSize neither copies nor retains b.
+func FrameSize(b []byte) (int, error) {
+	if len(b) < HeaderSizeInBytes {
+		return 0, &ErrNeedMore{HeaderSizeInBytes - len(b)}
+	}
+
+	length := endianness.Uint16(b[4:6])
+	if length < HeaderSizeInBytes || length > MaxSizeInBytes {
+		return 0, &ErrLengthOutOfBounds{
+			length,
+			HeaderSizeInBytes,
+			MaxSizeInBytes,
+		}
+	}
+	if len(b) < int(length) {
+		return int(length), &ErrNeedMore{int(length) - len(b)}
+	}
+
+	return int(length), nil
+}
+
+// validateMaxSize checks that a configured maximum imsg size can accommodate
+// at least the imsg header.
+func validateMaxSize(n uint16) error {
+	if n < HeaderSizeInBytes {
+		return &ErrLengthOutOfBounds{n, HeaderSizeInBytes, math.MaxUint16}
+	}
+
+	return nil
+}
+
+// Validate checks that the imsg can be transmitted, returning ErrDataTooLarge
+// if its ancillary data exceeds the limit imposed by MaxSizeInBytes.
+func (im *IMsg) Validate() error {
+	return im.ValidateMax(MaxSizeInBytes)
+}
+
+// ValidateMax behaves like Validate, but checks the imsg against a maximum
+// size of maxSize bytes, such as one configured with SetMaxSize.
+func (im *IMsg) ValidateMax(maxSize uint16) error {
+	err := validateMaxSize(maxSize)
+	if err != nil {
+		return err
+	}
+
+	if im.Len() > int(maxSize) {
+		return &ErrDataTooLarge{
+			DataLengthInBytes: len(im.Data),
+			MaxLengthInBytes:  int(maxSize) - HeaderSizeInBytes,
+			Type:              im.Type,
+			PeerID:            im.PeerID,
+		}
+	}
+
+	return nil
 }
 
 // Len returns the size in bytes of the imsg.
@@ -130,18 +737,238 @@ func (im *IMsg) Len() int {
 	return len(im.Data) + HeaderSizeInBytes
 }
 
+// File returns the file attached to the imsg, if any. The caller owns a file
+// attached to a received imsg and is responsible for closing it, such as with
+// Close, or taking ownership of it with Detach.
+func (im *IMsg) File() *os.File {
+	return im.file
+}
+
+// Close closes the file attached to the imsg, if any, and clears the has-fd
+// flag, so the imsg no longer carries a descriptor. Only the first call closes
+// the file; later calls do nothing and return nil. Close is the counterpart of
+// Detach for a caller which doesn't need the file.
+func (im *IMsg) Close() error {
+	f := im.Detach()
+	if f == nil {
+		return nil
+	}
+
+	return f.Close()
+}
+
+// Detach removes the file attached to the imsg, if any, and clears the has-fd
+// flag, transferring ownership of the file to the caller, who becomes
+// responsible for closing it. A subsequent Close or Detach does nothing.
+func (im *IMsg) Detach() *os.File {
+	f := im.file
+	im.file = nil
+	im.flags &^= FlagHasFD
+
+	return f
+}
+
+// HasFD reports whether a descriptor accompanies the imsg, either because a
+// file is attached or because the has-fd flag is set in its header.
+func (im *IMsg) HasFD() bool {
+	return im.file != nil || im.flags&FlagHasFD != 0
+}
+
+// Equal reports whether two imsgs have the same Type, PeerID, PID, flags, and
+// ancillary data. Nil and empty data are considered equal. Attached files don't
+// participate, since the same descriptor passed twice arrives as two distinct
+// files. Two nil imsgs are equal, but a nil imsg is not equal to a non-nil one.
+func (im *IMsg) Equal(other *IMsg) bool {
+	if im == nil || other == nil {
+		return im == other
+	}
+
+	return im.Type == other.Type &&
+		im.PeerID == other.PeerID &&
+		im.PID == other.PID &&
+		im.flags == other.flags &&
+		bytes.Equal(im.Data, other.Data)
+}
+
+// Clone returns a copy of the imsg whose ancillary data doesn't alias that of
+// the original. Flags and any marking by WithWipe, WithTTL, WithPriority, or
+// WithExplicitPeerID are carried over, but an attached file is not: the clone
+// has no file attached, so a clone of an imsg which arrived with a descriptor
+// still reports HasFD but can't be sent until a file is attached. A nil IMsg
+// returns nil.
+func (im *IMsg) Clone() *IMsg {
+	if im == nil {
+		return nil
+	}
+
+	c := &IMsg{
+		Type:    im.Type,
+		PeerID:  im.PeerID,
+		PID:     im.PID,
+		flags:   im.flags,
+		wipe:    im.wipe,
+		expires: im.expires,
+		prio:    im.prio,
+
+		explicitPeerID: im.explicitPeerID,
+	}
+	if im.Data != nil {
+		c.Data = append([]byte{}, im.Data...)
+	}
+	if im.creds != nil {
+		creds := *im.creds
+		c.creds = &creds
+	}
+
+	return c
+}
+
+// Reset clears the imsg's header fields and truncates its Data to zero length
+// while retaining its capacity, so that the imsg can be reused, for example
+// from a sync.Pool, without allocating. An attached file is detached but not
+// closed, since the caller owns it. Since Data's backing storage is reused,
+// an imsg must not be reset or returned to a pool while its Data is still
+// referenced elsewhere; use Clone to retain an imsg beyond that point.
+func (im *IMsg) Reset() {
+	*im = IMsg{Data: im.Data[:0]}
+}
+
+// DataLen returns the size in bytes of the imsg's ancillary data.
+func (im *IMsg) DataLen() int {
+	return len(im.Data)
+}
+
+// DataReader returns a reader over the imsg's ancillary data, which is useful
+// for decoding structured data with binary.Read, gob.NewDecoder, and the like.
+// An imsg without data returns an empty reader.
+func (im *IMsg) DataReader() *bytes.Reader {
+	return bytes.NewReader(im.Data)
+}
+
+// DataString returns the imsg's ancillary data as a string, as composed by
+// ComposeIMsgString.
+func (im *IMsg) DataString() string {
+	return string(im.Data)
+}
+
+// DataCopy returns a copy of the imsg's ancillary data, which remains valid
+// after the imsg is reset or reused. If the imsg has no data, nil is returned.
+func (im *IMsg) DataCopy() []byte {
+	if len(im.Data) == 0 {
+		return nil
+	}
+
+	return append([]byte{}, im.Data...)
+}
+
+// closeFile closes and detaches the file attached to the imsg, if any.
+func (im *IMsg) closeFile() {
+	if im.file != nil {
+		im.file.Close()
+		im.file = nil
+	}
+}
+
+// WriteTo implements the io.WriterTo interface, writing the imsg's header and
+// ancillary data to w without first joining them. When w is a network
+// connection, they're written with a single vectored write.
+func (im *IMsg) WriteTo(w io.Writer) (int64, error) {
+	return im.writeTo(w, MaxSizeInBytes)
+}
+
+// writeTo behaves like WriteTo, limiting the size of the imsg to maxSize
+// bytes.
+func (im *IMsg) writeTo(w io.Writer, maxSize uint16) (int64, error) {
+	err := im.ValidateMax(maxSize)
+	if err != nil {
+		return 0, err
+	}
+
+	var hdr [HeaderSizeInBytes]byte
+	im.putHeader(hdr[:])
+
+	bufs := net.Buffers{hdr[:]}
+	if len(im.Data) > 0 {
+		bufs = append(bufs, im.Data)
+	}
+
+	n, err := bufs.WriteTo(w)
+	if err != nil {
+		return n, &ErrWrite{err}
+	}
+
+	return n, nil
+}
+
+// RawHeader returns the header of the imsg encoded in the provided byte order,
+// exactly as it would prepend the imsg on the wire, including its flags and
+// its length computed from Data. With the byte order reported by
+// SystemEndianness, this is the start of what MarshalBinary returns. The
+// length is only meaningful if the imsg is valid; see Validate.
+func (im *IMsg) RawHeader(order binary.ByteOrder) [HeaderSizeInBytes]byte {
+	var bs [HeaderSizeInBytes]byte
+	im.putHeaderOrder(bs[:], order)
+
+	return bs
+}
+
+// putHeader encodes the imsg's header into bs, which must be at least
+// HeaderSizeInBytes long.
+func (im *IMsg) putHeader(bs []byte) {
+	im.putHeaderOrder(bs, endianness)
+}
+
+// putHeaderOrder encodes the imsg's header in the provided byte order into bs,
+// which must be at least HeaderSizeInBytes long.
+func (im *IMsg) putHeaderOrder(bs []byte, order binary.ByteOrder) {
+	order.PutUint32(bs[0:4], im.Type)
+	order.PutUint16(bs[4:6], uint16(im.Len()))
+	order.PutUint16(bs[6:8], uint16(im.flags))
+	order.PutUint32(bs[8:12], im.PeerID)
+	order.PutUint32(bs[12:16], im.PID)
+}
+
 // MarshalBinary implements the encoding.BinaryMarshaler interface.
 func (im IMsg) MarshalBinary() ([]byte, error) {
+	return im.marshalBinary(MaxSizeInBytes)
+}
+
+// EncodeInto encodes the imsg into the start of dst, returning the number of
+// bytes written, without allocating. The imsg is validated as with
+// MarshalBinary. If dst is shorter than the imsg, ErrBufferTooSmall is
+// returned and dst is left untouched. Bytes of dst beyond the imsg are never
+// modified.
+func (im IMsg) EncodeInto(dst []byte) (int, error) {
+	err := im.ValidateMax(MaxSizeInBytes)
+	if err != nil {
+		return 0, err
+	}
+
+	n := im.Len()
+	if len(dst) < n {
+		return 0, &ErrBufferTooSmall{n}
+	}
+	im.putHeader(dst)
+	copy(dst[HeaderSizeInBytes:n], im.Data)
+
+	return n, nil
+}
+
+// marshalBinary behaves like MarshalBinary, limiting the size of the imsg to
+// maxSize bytes.
+func (im *IMsg) marshalBinary(maxSize uint16) ([]byte, error) {
 	var buf bytes.Buffer
 
-	if im.Len() > MaxSizeInBytes {
+	if im.Len() > int(maxSize) {
 		return nil, &ErrDataTooLarge{
-			len(im.Data),
-			MaxSizeInBytes - HeaderSizeInBytes,
+			DataLengthInBytes: len(im.Data),
+			MaxLengthInBytes:  int(maxSize) - HeaderSizeInBytes,
+			Type:              im.Type,
+			PeerID:            im.PeerID,
 		}
 	}
 
-	hdr := imsgHeader{
+	hdr := Header{
 		Type:   im.Type,
 		Length: uint16(im.Len()),
 		Flags:  im.flags,
@@ -151,36 +978,88 @@ func (im IMsg) MarshalBinary() ([]byte, error) {
 
 	err := binary.Write(&buf, endianness, hdr)
 	if err != nil {
-		return nil, err
+		return nil, &ErrWrite{err}
 	}
 
 	_, err = buf.Write(im.Data)
 	if err != nil {
-		return nil, err
+		return nil, &ErrWrite{err}
 	}
 
 	return buf.Bytes(), nil
 }
 
-// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface.
+// UnmarshalBinary implements the encoding.BinaryUnmarshaler interface. The
+// imsg's Data is a copy of the data, so data may be reused afterward. If data
+// is too short to hold the imsg, ErrTruncated is returned.
 func (im *IMsg) UnmarshalBinary(data []byte) error {
-	buf := bytes.NewReader(data)
+	return im.unmarshalBinary(data, MaxSizeInBytes)
+}
 
-	im2, err := ReadIMsg(buf)
+// UnmarshalBinaryNoCopy decodes the imsg at the start of data, which may be
+// followed by further imsgs, returning the number of bytes it occupies. Unlike
+// UnmarshalBinary, the imsg's Data is set to a subslice of data rather than a
+// copy, so the imsg is only valid for as long as data is, and reflects any
+// later changes to it. Data's capacity ends with the imsg, so appending to it
+// doesn't overwrite the imsg which follows. If data is too short to hold the
+// imsg, ErrTruncated is returned.
+func (im *IMsg) UnmarshalBinaryNoCopy(data []byte) (int, error) {
+	length, err := validateWire(data, endianness, MaxSizeInBytes)
+	if err != nil {
+		return 0, err
+	}
+
+	im.setHeader(parseHeader(data, endianness))
+	im.Data = nil
+	if length > HeaderSizeInBytes {
+		im.Data = data[HeaderSizeInBytes:length:length]
+	}
+
+	return length, nil
+}
+
+// unmarshalBinary behaves like UnmarshalBinary, limiting the size of the imsg
+// to maxSize bytes.
+func (im *IMsg) unmarshalBinary(data []byte, maxSize uint16) error {
+	length, err := validateWire(data, endianness, maxSize)
 	if err != nil {
 		return err
 	}
 
-	im.Type = im2.Type
-	im.PeerID = im2.PeerID
-	im.PID = im2.PID
-	im.Data = im2.Data
-	im.flags = im2.flags
+	im.setHeader(parseHeader(data, endianness))
+	im.Data = nil
+	if length > HeaderSizeInBytes {
+		im.Data = make([]byte, length-HeaderSizeInBytes)
+		copy(im.Data, data[HeaderSizeInBytes:length])
+	}
 
 	return nil
 }
 
-// SystemEndianness returns the determined system byte order.
+// setHeader sets the imsg's header fields, other than its length, from hdr.
+func (im *IMsg) setHeader(hdr Header) {
+	im.Type = hdr.Type
+	im.PeerID = hdr.PeerID
+	im.PID = hdr.PID
+	im.flags = hdr.Flags
+}
+
+// SystemEndianness returns the determined system byte order, which is either
+// binary.LittleEndian or binary.BigEndian.
 func SystemEndianness() binary.ByteOrder {
 	return endianness
 }
+
+// SetSystemEndianness overrides the byte order in which imsgs are converted to
+// and from binary, such as to exchange imsgs with a peer whose host differs in
+// endianness. Any byte order, including binary.NativeEndian, is mapped to
+// binary.LittleEndian or binary.BigEndian. A nil order restores the system's
+// native byte order. SetSystemEndianness isn't safe to call while imsgs are
+// being converted, so it should be called during initialization.
+func SetSystemEndianness(order binary.ByteOrder) {
+	if order == nil {
+		order = binary.NativeEndian
+	}
+
+	endianness = concreteOrder(order)
+}
@@ -5,12 +5,17 @@
 package imsg
 
 import (
+	"bufio"
 	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
+	"os"
 	"reflect"
+	"strings"
+	"sync"
 	"testing"
 )
 
@@ -24,17 +29,33 @@ type imsgTest struct {
 
 var marshalTests = []imsgTest{
 	{"valid empty", &IMsg{}, []byte{0, 0, 0, 0, 16, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, []byte{0, 0, 0, 0, 0, 16, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, nil},
-	{"valid simple", &IMsg{0xff, 0xee, 0xdd, []byte("test"), 0xcc}, []byte{0xff, 0, 0, 0, 20, 0, 0xcc, 0, 0xee, 0, 0, 0, 0xdd, 0, 0, 0, 0x74, 0x65, 0x73, 0x74}, []byte{0, 0, 0, 0xff, 0, 20, 0, 0xcc, 0, 0, 0, 0xee, 0, 0, 0, 0xdd, 0x74, 0x65, 0x73, 0x74}, nil},
+	{"valid simple", &IMsg{Type: 0xff, PeerID: 0xee, PID: 0xdd, Data: []byte("test"), flags: 0xcc}, []byte{0xff, 0, 0, 0, 20, 0, 0xcc, 0, 0xee, 0, 0, 0, 0xdd, 0, 0, 0, 0x74, 0x65, 0x73, 0x74}, []byte{0, 0, 0, 0xff, 0, 20, 0, 0xcc, 0, 0, 0, 0xee, 0, 0, 0, 0xdd, 0x74, 0x65, 0x73, 0x74}, nil},
 	{"invalid data too large", &IMsg{Data: make([]byte, MaxSizeInBytes+1)}, nil, nil, &ErrDataTooLarge{}},
 }
 
 var unmarshalTests = []imsgTest{
 	{"valid empty", &IMsg{}, []byte{0, 0, 0, 0, 16, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, []byte{0, 0, 0, 0, 0, 16, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, nil},
-	{"valid simple", &IMsg{0xff, 0xee, 0xdd, []byte("test"), 0xcc}, []byte{0xff, 0, 0, 0, 20, 0, 0xcc, 0, 0xee, 0, 0, 0, 0xdd, 0, 0, 0, 0x74, 0x65, 0x73, 0x74}, []byte{0, 0, 0, 0xff, 0, 20, 0, 0xcc, 0, 0, 0, 0xee, 0, 0, 0, 0xdd, 0x74, 0x65, 0x73, 0x74}, nil},
+	{"valid simple", &IMsg{Type: 0xff, PeerID: 0xee, PID: 0xdd, Data: []byte("test"), flags: 0xcc}, []byte{0xff, 0, 0, 0, 20, 0, 0xcc, 0, 0xee, 0, 0, 0, 0xdd, 0, 0, 0, 0x74, 0x65, 0x73, 0x74}, []byte{0, 0, 0, 0xff, 0, 20, 0, 0xcc, 0, 0, 0, 0xee, 0, 0, 0, 0xdd, 0x74, 0x65, 0x73, 0x74}, nil},
 	{"invalid < min length", nil, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, &ErrLengthOutOfBounds{}},
 	{"invalid > max length", nil, []byte{0, 0, 0, 0, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, []byte{0, 0, 0, 0, 0xff, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, &ErrLengthOutOfBounds{}},
-	{"invalid insufficient data", nil, []byte{0, 0, 0, 0, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, []byte{0, 0, 0, 0, 0, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, &ErrInsufficientData{}},
-	{"invalid insufficient data", nil, []byte{0, 0, 0}, []byte{0, 0, 0}, io.ErrUnexpectedEOF},
+	{"invalid insufficient data", nil, []byte{0, 0, 0, 0, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, []byte{0, 0, 0, 0, 0, 0xff, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, &ErrTruncated{}},
+	{"invalid insufficient data", nil, []byte{0, 0, 0}, []byte{0, 0, 0}, &ErrTruncated{}},
+}
+
+// errorIsType reports whether err matches target, either directly or by having
+// the same concrete type as target or any error it wraps.
+func errorIsType(err, target error) bool {
+	if errors.Is(err, target) {
+		return true
+	}
+
+	for ; err != nil; err = errors.Unwrap(err) {
+		if reflect.TypeOf(err) == reflect.TypeOf(target) {
+			return true
+		}
+	}
+
+	return false
 }
 
 func TestComposeIMsg(t *testing.T) {
@@ -56,6 +77,222 @@ func TestComposeIMsg(t *testing.T) {
 	}
 }
 
+func TestComposeIMsgOptions(t *testing.T) {
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("failed to open %s: %s", os.DevNull, err)
+	}
+	defer f.Close()
+
+	pid := uint32(os.Getpid())
+
+	var tests = []struct {
+		name        string
+		opts        []ComposeOption
+		pid         uint32
+		file        *os.File
+		expectedErr error
+	}{
+		{"no options", nil, pid, nil, nil},
+		{"with pid", []ComposeOption{WithPID(42)}, 42, nil, nil},
+		{"with zero pid", []ComposeOption{WithPID(0)}, 0, nil, nil},
+		{"later pid wins", []ComposeOption{WithPID(42), WithPID(43)}, 43, nil, nil},
+		{"without pid", []ComposeOption{WithoutPID()}, 0, nil, nil},
+		{"with file", []ComposeOption{WithFile(f)}, pid, f, nil},
+		{"later file wins", []ComposeOption{WithFile(f), WithFile(nil)}, pid, nil, nil},
+		{"with data copy", []ComposeOption{WithDataCopy()}, pid, nil, nil},
+		{"combined", []ComposeOption{WithDataCopy(), WithPID(7), WithFile(f)}, 7, f, nil},
+		{"with and without pid", []ComposeOption{WithPID(42), WithoutPID()}, 0, nil, &ErrConflictingOptions{}},
+		{"without and with pid", []ComposeOption{WithoutPID(), WithPID(42)}, 0, nil, &ErrConflictingOptions{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im, err := ComposeIMsg(1, 2, []byte("test"), tt.opts...)
+			if tt.expectedErr != nil {
+				if im != nil || !errorIsType(err, tt.expectedErr) {
+					t.Fatalf("expected %T, got: (%v, %v)", tt.expectedErr, im, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected ComposeIMsg failure: %s", err)
+			}
+
+			if im.Type != 1 || im.PeerID != 2 || !bytes.Equal(im.Data, []byte("test")) {
+				t.Fatalf("composed imsg has unexpected contents (%#v)", im)
+			}
+			if im.PID != tt.pid {
+				t.Fatalf("unexpected PID (%d != %d)", im.PID, tt.pid)
+			}
+			if im.File() != tt.file {
+				t.Fatalf("unexpected attached file (%v != %v)", im.File(), tt.file)
+			}
+		})
+	}
+}
+
+func TestComposeIMsgDataOwnership(t *testing.T) {
+	data := []byte("test")
+
+	shared, err := ComposeIMsg(1, 2, data)
+	if err != nil {
+		t.Fatalf("unexpected ComposeIMsg failure: %s", err)
+	}
+	copied, err := ComposeIMsg(1, 2, data, WithDataCopy())
+	if err != nil {
+		t.Fatalf("unexpected ComposeIMsg failure: %s", err)
+	}
+
+	// Mutate the caller's slice after composing.
+	data[0] = 'b'
+
+	if !bytes.Equal(shared.Data, []byte("best")) {
+		t.Fatalf("default compose did not share the caller's slice (%q)", shared.Data)
+	}
+	if !bytes.Equal(copied.Data, []byte("test")) {
+		t.Fatalf("copied data was modified by the caller (%q)", copied.Data)
+	}
+
+	empty, _ := ComposeIMsg(1, 2, nil, WithDataCopy())
+	if empty.Data != nil {
+		t.Fatalf("copying nil data produced non-nil data")
+	}
+}
+
+func TestComposeIMsgString(t *testing.T) {
+	for _, s := range []string{"", "test", "em\x000\x00", "\x00"} {
+		im, err := ComposeIMsgString(1, 2, s)
+		if err != nil {
+			t.Fatalf("unexpected ComposeIMsgString failure: %s", err)
+		}
+		if im.DataLen() != len(s) {
+			t.Fatalf("unexpected data length (%d != %d)", im.DataLen(), len(s))
+		}
+		if im.DataString() != s {
+			t.Fatalf("string did not round-trip (%q != %q)", im.DataString(), s)
+		}
+	}
+
+	var edtl *ErrDataTooLarge
+	_, err := ComposeIMsgString(1, 2, string(make([]byte, MaxSizeInBytes-HeaderSizeInBytes+1)))
+	if !errors.As(err, &edtl) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+
+	im := &IMsg{Data: []byte("test")}
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = im.DataString()
+	})
+	if allocs > 1 {
+		t.Fatalf("DataString allocated more than once (%.0f allocations)", allocs)
+	}
+}
+
+func TestDataReader(t *testing.T) {
+	im := &IMsg{Data: []byte{0x01, 0x02, 0x03, 0x04, 'h', 'i'}}
+	if im.DataLen() != 6 {
+		t.Fatalf("unexpected data length (%d != 6)", im.DataLen())
+	}
+
+	r := im.DataReader()
+	var v uint32
+	err := binary.Read(r, binary.BigEndian, &v)
+	if err != nil || v != 0x01020304 {
+		t.Fatalf("unexpected binary.Read result (%#x, %v)", v, err)
+	}
+	rest, _ := io.ReadAll(r)
+	if !bytes.Equal(rest, []byte("hi")) {
+		t.Fatalf("unexpected remaining data (%q)", rest)
+	}
+
+	for _, im := range []*IMsg{{}, {Data: []byte{}}} {
+		if im.DataLen() != 0 {
+			t.Fatalf("unexpected data length (%d != 0)", im.DataLen())
+		}
+		r := im.DataReader()
+		if r == nil || r.Len() != 0 {
+			t.Fatalf("unexpected reader for empty data (%v)", r)
+		}
+		_, err := r.ReadByte()
+		if err != io.EOF {
+			t.Fatalf("expected EOF from empty reader, got: %v", err)
+		}
+	}
+}
+
+func TestDataCopy(t *testing.T) {
+	im := &IMsg{Data: []byte("test")}
+
+	c := im.DataCopy()
+	if !bytes.Equal(c, im.Data) {
+		t.Fatalf("copy does not match data (%q != %q)", c, im.Data)
+	}
+
+	c[0] = 'b'
+	frame, _ := IMsg{Data: []byte("xxxx")}.MarshalBinary()
+	im.Reset()
+	_ = im.UnmarshalBinary(frame)
+	if !bytes.Equal(c, []byte("best")) {
+		t.Fatalf("copy was affected by reuse of the imsg (%q)", c)
+	}
+
+	if (&IMsg{}).DataCopy() != nil {
+		t.Fatalf("copy of empty data is not nil")
+	}
+}
+
+func TestComposeIMsgv(t *testing.T) {
+	var edtl *ErrDataTooLarge
+
+	var tests = []struct {
+		name   string
+		pieces [][]byte
+	}{
+		{"none", nil},
+		{"single", [][]byte{[]byte("test")}},
+		{"multiple", [][]byte{{0x01, 0x02}, []byte("test"), {0xff}}},
+		{"empty pieces", [][]byte{{}, []byte("te"), nil, []byte("st"), {}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			imv, err := ComposeIMsgv(1, 2, tt.pieces...)
+			if err != nil {
+				t.Fatalf("unexpected ComposeIMsgv failure: %s", err)
+			}
+			im, err := ComposeIMsg(1, 2, bytes.Join(tt.pieces, nil))
+			if err != nil {
+				t.Fatalf("unexpected ComposeIMsg failure: %s", err)
+			}
+
+			bsv, _ := imv.MarshalBinary()
+			bs, _ := im.MarshalBinary()
+			if !bytes.Equal(bsv, bs) {
+				t.Fatalf("vectored imsg does not match expected output (% x != % x)", bsv, bs)
+			}
+
+			direct, err := marshalv(1, 2, im.PID, tt.pieces, MaxSizeInBytes)
+			if err != nil {
+				t.Fatalf("unexpected marshalv failure: %s", err)
+			}
+			if !bytes.Equal(direct, bs) {
+				t.Fatalf("marshalv output does not match expected output (% x != % x)", direct, bs)
+			}
+		})
+	}
+
+	half := make([]byte, (MaxSizeInBytes-HeaderSizeInBytes)/2+1)
+	_, err := ComposeIMsgv(0, 0, half, half)
+	if !errors.As(err, &edtl) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+	_, err = marshalv(0, 0, 0, [][]byte{half, half}, MaxSizeInBytes)
+	if !errors.As(err, &edtl) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+}
+
 func TestReadIMsg(t *testing.T) {
 	// Store out the determined system endianness before manually manipulating it
 	systemEndianness := endianness
@@ -89,7 +326,7 @@ func TestReadIMsg(t *testing.T) {
 						t.Fatalf("incorrectly read imsg")
 					}
 
-					if !errors.As(err, &tt.expectedErrorType) {
+					if !errorIsType(err, tt.expectedErrorType) {
 						t.Fatalf("failed to read imsg in unexpected way: %s", err)
 					}
 				}
@@ -118,7 +355,7 @@ func TestReadIMsg(t *testing.T) {
 						t.Fatalf("incorrectly read imsg")
 					}
 
-					if !errors.As(err, &tt.expectedErrorType) {
+					if !errorIsType(err, tt.expectedErrorType) {
 						t.Fatalf("failed to read imsg in unexpected way: %s", err)
 					}
 				}
@@ -161,7 +398,7 @@ func TestUnmarshalBinary(t *testing.T) {
 						t.Fatalf("incorrectly read imsg")
 					}
 
-					if !errors.As(err, &tt.expectedErrorType) {
+					if !errorIsType(err, tt.expectedErrorType) {
 						t.Fatalf("failed to read imsg in unexpected way: %s", err)
 					}
 				}
@@ -190,7 +427,7 @@ func TestUnmarshalBinary(t *testing.T) {
 						t.Fatalf("incorrectly read imsg")
 					}
 
-					if !errors.As(err, &tt.expectedErrorType) {
+					if !errorIsType(err, tt.expectedErrorType) {
 						t.Fatalf("failed to read imsg in unexpected way: %s", err)
 					}
 				}
@@ -232,7 +469,7 @@ func TestMarshalBinary(t *testing.T) {
 						t.Fatal("incorrectly marshalled imsg to binary")
 					}
 
-					if !errors.As(err, &tt.expectedErrorType) {
+					if !errorIsType(err, tt.expectedErrorType) {
 						t.Fatalf("failed to marshal imsg to binary in unexpected way: %s", err)
 					}
 				}
@@ -260,7 +497,7 @@ func TestMarshalBinary(t *testing.T) {
 						t.Fatal("incorrectly marshalled imsg to binary")
 					}
 
-					if !errors.As(err, &tt.expectedErrorType) {
+					if !errorIsType(err, tt.expectedErrorType) {
 						t.Fatalf("failed to marshal imsg to binary in unexpected way: %s", err)
 					}
 				}
@@ -271,6 +508,30 @@ func TestMarshalBinary(t *testing.T) {
 	endianness = systemEndianness
 }
 
+func TestRawHeader(t *testing.T) {
+	defer SetSystemEndianness(nil)
+
+	ims := []*IMsg{
+		{},
+		{Type: 0xff, PeerID: 0xee, PID: 0xdd, Data: []byte("test"), flags: 0xcc},
+		{Type: 0x01020304, PeerID: 0x05060708, PID: 0x090a0b0c, flags: FlagHasFD},
+		{Type: 1, Data: make([]byte, MaxSizeInBytes-HeaderSizeInBytes)},
+	}
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		SetSystemEndianness(order)
+		for _, im := range ims {
+			bs, err := im.MarshalBinary()
+			if err != nil {
+				t.Fatalf("unexpected MarshalBinary failure: %s", err)
+			}
+			hdr := im.RawHeader(order)
+			if !bytes.Equal(hdr[:], bs[:HeaderSizeInBytes]) {
+				t.Fatalf("raw header does not match marshaled imsg in %v order (% x != % x)", order, hdr, bs[:HeaderSizeInBytes])
+			}
+		}
+	}
+}
+
 func TestSystemEndianness(t *testing.T) {
 	// Store out the determined system endianness before manually manipulating it
 	systemEndianness := endianness
@@ -293,6 +554,44 @@ func TestSystemEndianness(t *testing.T) {
 	endianness = systemEndianness
 }
 
+func TestSetSystemEndianness(t *testing.T) {
+	systemEndianness := endianness
+	defer SetSystemEndianness(nil)
+
+	if systemEndianness != binary.LittleEndian && systemEndianness != binary.BigEndian {
+		t.Fatalf("determined endianness is not concrete: %v", systemEndianness)
+	}
+	if systemEndianness != concreteOrder(binary.NativeEndian) {
+		t.Fatalf("determined endianness does not match binary.NativeEndian")
+	}
+
+	for _, order := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		SetSystemEndianness(order)
+		if SystemEndianness() != order {
+			t.Fatalf("unexpected SystemEndianness after override (%v != %v)", SystemEndianness(), order)
+		}
+
+		bs, err := (&IMsg{Type: 0x01020304}).MarshalBinary()
+		if err != nil {
+			t.Fatalf("unexpected MarshalBinary failure: %s", err)
+		}
+		if order.Uint32(bs[0:4]) != 0x01020304 {
+			t.Fatalf("imsg not marshaled in %v order: % x", order, bs[0:4])
+		}
+	}
+
+	SetSystemEndianness(binary.NativeEndian)
+	if SystemEndianness() != systemEndianness {
+		t.Fatalf("binary.NativeEndian was not mapped to %v", systemEndianness)
+	}
+
+	SetSystemEndianness(binary.BigEndian)
+	SetSystemEndianness(nil)
+	if SystemEndianness() != systemEndianness {
+		t.Fatalf("nil order did not restore %v", systemEndianness)
+	}
+}
+
 func TestLen(t *testing.T) {
 	imsg := &IMsg{}
 
@@ -300,3 +599,1037 @@ func TestLen(t *testing.T) {
 		t.Fatalf("empty imsg length (%d) should match header length (%d)", imsg.Len(), HeaderSizeInBytes)
 	}
 }
+
+func TestHasFD(t *testing.T) {
+	im := &IMsg{}
+	if im.HasFD() {
+		t.Fatalf("imsg without flag or attachment reports a descriptor")
+	}
+
+	im = &IMsg{file: os.Stdin}
+	if !im.HasFD() {
+		t.Fatalf("imsg with an attachment does not report a descriptor")
+	}
+
+	// The flag must survive a marshal round trip untouched so that forwarded
+	// imsgs are reproduced faithfully.
+	bs, err := IMsg{Type: 1, flags: FlagHasFD}.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected MarshalBinary failure: %s", err)
+	}
+
+	im = &IMsg{}
+	err = im.UnmarshalBinary(bs)
+	if err != nil {
+		t.Fatalf("unexpected UnmarshalBinary failure: %s", err)
+	}
+	if !im.HasFD() || im.File() != nil {
+		t.Fatalf("has-fd flag did not survive round trip (%#v)", im)
+	}
+
+	bs2, err := im.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected MarshalBinary failure: %s", err)
+	}
+	if !bytes.Equal(bs, bs2) {
+		t.Fatalf("round trip altered wire bytes (% x != % x)", bs, bs2)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	var tests = []struct {
+		name        string
+		dataLen     int
+		maxSize     uint16
+		expectedErr error
+	}{
+		{"empty", 0, MaxSizeInBytes, nil},
+		{"maximum data", 16368, MaxSizeInBytes, nil},
+		{"data too large", 16369, MaxSizeInBytes, &ErrDataTooLarge{}},
+		{"custom maximum", 48, 64, nil},
+		{"custom maximum exceeded", 49, 64, &ErrDataTooLarge{}},
+		{"raised maximum", 16369, 65535, nil},
+		{"maximum smaller than header", 0, HeaderSizeInBytes - 1, &ErrLengthOutOfBounds{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			im := &IMsg{Data: make([]byte, tt.dataLen)}
+
+			err := im.ValidateMax(tt.maxSize)
+			if tt.expectedErr == nil && err != nil {
+				t.Fatalf("unexpected ValidateMax failure: %s", err)
+			}
+			if tt.expectedErr != nil && !errorIsType(err, tt.expectedErr) {
+				t.Fatalf("expected %T, got: %v", tt.expectedErr, err)
+			}
+
+			if tt.maxSize == MaxSizeInBytes {
+				err2 := im.Validate()
+				if (err == nil) != (err2 == nil) {
+					t.Fatalf("Validate disagrees with ValidateMax (%v != %v)", err2, err)
+				}
+			}
+		})
+	}
+}
+
+func TestWriteTo(t *testing.T) {
+	for _, im := range []*IMsg{
+		{Type: 1, PeerID: 2, PID: 3, Data: []byte("test"), flags: 0xcc},
+		{Type: 1},
+	} {
+		var buf bytes.Buffer
+		n, err := im.WriteTo(&buf)
+		if err != nil {
+			t.Fatalf("unexpected WriteTo failure: %s", err)
+		}
+
+		expected, _ := im.MarshalBinary()
+		if n != int64(len(expected)) || !bytes.Equal(buf.Bytes(), expected) {
+			t.Fatalf("WriteTo output does not match MarshalBinary (% x != % x)", buf.Bytes(), expected)
+		}
+	}
+
+	var buf bytes.Buffer
+	var edtl *ErrDataTooLarge
+	_, err := (&IMsg{Data: make([]byte, 16369)}).WriteTo(&buf)
+	if !errors.As(err, &edtl) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("oversized imsg was partially written (%d bytes)", buf.Len())
+	}
+}
+
+func TestEqual(t *testing.T) {
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("failed to open %s: %s", os.DevNull, err)
+	}
+	defer f.Close()
+
+	var nilIMsg *IMsg
+	base := &IMsg{Type: 1, PeerID: 2, PID: 3, Data: []byte("test")}
+
+	var tests = []struct {
+		name     string
+		a, b     *IMsg
+		expected bool
+	}{
+		{"identical", base, &IMsg{Type: 1, PeerID: 2, PID: 3, Data: []byte("test")}, true},
+		{"same pointer", base, base, true},
+		{"nil data and empty data", &IMsg{Type: 1}, &IMsg{Type: 1, Data: []byte{}}, true},
+		{"empty data and nil data", &IMsg{Type: 1, Data: []byte{}}, &IMsg{Type: 1}, true},
+		{"both nil", nilIMsg, nilIMsg, true},
+		{"nil receiver", nilIMsg, base, false},
+		{"nil argument", base, nilIMsg, false},
+		{"different type", base, &IMsg{Type: 9, PeerID: 2, PID: 3, Data: []byte("test")}, false},
+		{"different peer id", base, &IMsg{Type: 1, PeerID: 9, PID: 3, Data: []byte("test")}, false},
+		{"different pid", base, &IMsg{Type: 1, PeerID: 2, PID: 9, Data: []byte("test")}, false},
+		{"different data", base, &IMsg{Type: 1, PeerID: 2, PID: 3, Data: []byte("tess")}, false},
+		{"different flags", base, &IMsg{Type: 1, PeerID: 2, PID: 3, Data: []byte("test"), flags: FlagHasFD}, false},
+		{"attached file", base, &IMsg{Type: 1, PeerID: 2, PID: 3, Data: []byte("test"), file: f}, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.a.Equal(tt.b) != tt.expected {
+				t.Fatalf("unexpected Equal result (%t)", !tt.expected)
+			}
+		})
+	}
+}
+
+func TestClone(t *testing.T) {
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("failed to open %s: %s", os.DevNull, err)
+	}
+	defer f.Close()
+
+	im := &IMsg{Type: 1, PeerID: 2, PID: 3, Data: []byte("test"), flags: FlagHasFD, file: f}
+
+	c := im.Clone()
+	if !c.Equal(im) {
+		t.Fatalf("clone does not match original (%#v != %#v)", c, im)
+	}
+	if c.File() != nil {
+		t.Fatalf("clone unexpectedly has a file attached")
+	}
+
+	c.Data[0] = 'b'
+	c.Data = append(c.Data, '!')
+	if !bytes.Equal(im.Data, []byte("test")) {
+		t.Fatalf("mutating the clone modified the original (%q)", im.Data)
+	}
+
+	if (&IMsg{}).Clone().Data != nil {
+		t.Fatalf("clone of nil data is not nil")
+	}
+	if (&IMsg{Data: []byte{}}).Clone().Data == nil {
+		t.Fatalf("clone of empty data is nil")
+	}
+
+	var nilIMsg *IMsg
+	if nilIMsg.Clone() != nil {
+		t.Fatalf("clone of nil imsg is not nil")
+	}
+}
+
+func TestReset(t *testing.T) {
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("failed to open %s: %s", os.DevNull, err)
+	}
+	defer f.Close()
+
+	im := &IMsg{Type: 1, PeerID: 2, PID: 3, Data: make([]byte, 4, 64), flags: FlagHasFD, file: f}
+	im.Reset()
+
+	if !im.Equal(&IMsg{}) || im.File() != nil {
+		t.Fatalf("imsg was not reset (%#v)", im)
+	}
+	if len(im.Data) != 0 || cap(im.Data) != 64 {
+		t.Fatalf("data capacity was not retained (len %d, cap %d)", len(im.Data), cap(im.Data))
+	}
+
+	// The attached file belongs to the caller and must remain open.
+	_, err = f.Stat()
+	if err != nil {
+		t.Fatalf("attached file was closed by Reset: %s", err)
+	}
+}
+
+func TestUnmarshalBinaryFreshData(t *testing.T) {
+	frame, _ := IMsg{Type: 1, Data: []byte("test")}.MarshalBinary()
+
+	prev := make([]byte, 0, 64)
+	im := &IMsg{Data: prev}
+
+	err := im.UnmarshalBinary(frame)
+	if err != nil {
+		t.Fatalf("unexpected UnmarshalBinary failure: %s", err)
+	}
+	if !bytes.Equal(im.Data, []byte("test")) {
+		t.Fatalf("unexpected data (%q)", im.Data)
+	}
+	if &im.Data[0] == &prev[:1][0] {
+		t.Fatalf("data was read into the previous data's storage")
+	}
+
+	// The data doesn't alias the frame.
+	frame[HeaderSizeInBytes] = 'T'
+	if !bytes.Equal(im.Data, []byte("test")) {
+		t.Fatalf("data aliases the frame (%q)", im.Data)
+	}
+}
+
+func TestUnmarshalBinaryNoCopy(t *testing.T) {
+	var buf []byte
+	for _, im := range []IMsg{
+		{Type: 1, PeerID: 2, PID: 3, Data: []byte("first")},
+		{Type: 4},
+		{Type: 5, Data: []byte("third")},
+	} {
+		frame, _ := im.MarshalBinary()
+		buf = append(buf, frame...)
+	}
+
+	var (
+		ims  []*IMsg
+		rest = buf
+	)
+	for len(rest) > 0 {
+		im := &IMsg{}
+		n, err := im.UnmarshalBinaryNoCopy(rest)
+		if err != nil {
+			t.Fatalf("unexpected UnmarshalBinaryNoCopy failure: %s", err)
+		}
+		if n != im.Len() {
+			t.Fatalf("consumed %d bytes of a %d-byte imsg", n, im.Len())
+		}
+		ims = append(ims, im)
+		rest = rest[n:]
+	}
+	if len(ims) != 3 ||
+		ims[0].Type != 1 || ims[0].PeerID != 2 || ims[0].PID != 3 || string(ims[0].Data) != "first" ||
+		ims[1].Type != 4 || ims[1].Data != nil ||
+		ims[2].Type != 5 || string(ims[2].Data) != "third" {
+		t.Fatalf("unexpected imsgs decoded (%v)", ims)
+	}
+
+	// The data aliases the source.
+	buf[HeaderSizeInBytes] = 'F'
+	if string(ims[0].Data) != "First" {
+		t.Fatalf("data does not alias the source (%q)", ims[0].Data)
+	}
+
+	// Appending to the data doesn't overwrite the following imsg.
+	_ = append(ims[0].Data, 'X')
+	if buf[len("first")+HeaderSizeInBytes] == 'X' {
+		t.Fatalf("append overwrote the following imsg")
+	}
+
+	last := buf[len(buf)-ims[2].Len():]
+	_, err := (&IMsg{}).UnmarshalBinaryNoCopy(last[:len(last)-1])
+	var truncated *ErrTruncated
+	if !errors.As(err, &truncated) {
+		t.Fatalf("expected ErrTruncated, got: %v", err)
+	}
+}
+
+func TestEncodeInto(t *testing.T) {
+	im := IMsg{Type: 1, PeerID: 2, PID: 3, Data: []byte("test")}
+	want, _ := im.MarshalBinary()
+
+	dst := bytes.Repeat([]byte{0xff}, len(want)+4)
+	n, err := im.EncodeInto(dst)
+	if err != nil {
+		t.Fatalf("unexpected EncodeInto failure: %s", err)
+	}
+	if n != len(want) || !bytes.Equal(dst[:n], want) {
+		t.Fatalf("unexpected encoding (% x)", dst[:n])
+	}
+	if !bytes.Equal(dst[n:], []byte{0xff, 0xff, 0xff, 0xff}) {
+		t.Fatalf("bytes beyond the imsg were modified (% x)", dst[n:])
+	}
+
+	short := bytes.Repeat([]byte{0xff}, len(want)-1)
+	_, err = im.EncodeInto(short)
+	var small *ErrBufferTooSmall
+	if !errors.As(err, &small) || small.Need != len(want) {
+		t.Fatalf("expected ErrBufferTooSmall, got: %v", err)
+	}
+	if !bytes.Equal(short, bytes.Repeat([]byte{0xff}, len(want)-1)) {
+		t.Fatalf("short buffer was modified")
+	}
+
+	_, err = IMsg{Data: make([]byte, MaxSizeInBytes)}.EncodeInto(make([]byte, 2*MaxSizeInBytes))
+	if !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+}
+
+func BenchmarkEncodeInto(b *testing.B) {
+	im := IMsg{Type: 1, Data: make([]byte, 1024)}
+	dst := make([]byte, im.Len())
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := im.EncodeInto(dst)
+		if err != nil {
+			b.Fatalf("unexpected EncodeInto failure: %s", err)
+		}
+	}
+	b.StopTimer()
+
+	allocs := testing.AllocsPerRun(100, func() {
+		_, _ = im.EncodeInto(dst)
+	})
+	if allocs != 0 {
+		b.Fatalf("EncodeInto allocated (%.0f allocations)", allocs)
+	}
+}
+
+// TestUnmarshalBinaryMatchesReadIMsg checks that decoding a slice directly
+// fails in the same way as decoding it from a stream, for every prefix of
+// random frames, some of which have corrupt lengths.
+func TestUnmarshalBinaryMatchesReadIMsg(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 200; i++ {
+		data := make([]byte, rng.Intn(64))
+		rng.Read(data)
+		frame, _ := IMsg{Type: rng.Uint32(), PeerID: rng.Uint32(), PID: rng.Uint32(), Data: data}.MarshalBinary()
+		if i%4 == 0 {
+			endianness.PutUint16(frame[4:6], uint16(rng.Intn(2*len(frame))))
+		}
+
+		for k := 1; k <= len(frame); k++ {
+			direct := &IMsg{}
+			derr := direct.UnmarshalBinary(frame[:k])
+			streamed, serr := ReadIMsg(bytes.NewReader(frame[:k]))
+
+			if !reflect.DeepEqual(derr, serr) {
+				t.Fatalf("frame %d, prefix %d: UnmarshalBinary failed with %v, ReadIMsg with %v", i, k, derr, serr)
+			}
+			if derr == nil && !reflect.DeepEqual(direct, streamed) {
+				t.Fatalf("frame %d, prefix %d: decoded imsgs differ (%#v != %#v)", i, k, direct, streamed)
+			}
+		}
+	}
+}
+
+func TestValidateWire(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+
+	for i := 0; i < 500; i++ {
+		b := make([]byte, rng.Intn(3*HeaderSizeInBytes))
+		rng.Read(b)
+		if len(b) >= HeaderSizeInBytes && i%2 == 0 {
+			// Keep the length plausible so that valid imsgs turn up.
+			endianness.PutUint16(b[4:6], uint16(HeaderSizeInBytes+rng.Intn(2*HeaderSizeInBytes)))
+		}
+
+		verr := ValidateWire(b)
+		uerr := (&IMsg{}).UnmarshalBinary(b)
+		if !reflect.DeepEqual(verr, uerr) {
+			t.Fatalf("ValidateWire and UnmarshalBinary disagree on % x (%v != %v)", b, verr, uerr)
+		}
+	}
+
+	// The length of 0x41 reads as 0x4100 in the opposite byte order.
+	frame, _ := IMsg{Type: 1, Data: make([]byte, 0x41-HeaderSizeInBytes)}.MarshalBinary()
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = ValidateWire(frame)
+	})
+	if allocs != 0 {
+		t.Fatalf("ValidateWire allocated (%.0f allocations)", allocs)
+	}
+
+	// Validating in the opposite byte order sees a length out of bounds.
+	other := binary.ByteOrder(binary.BigEndian)
+	if endianness == binary.BigEndian {
+		other = binary.LittleEndian
+	}
+	var eloob *ErrLengthOutOfBounds
+	if err := ValidateWireOrder(frame, other); !errors.As(err, &eloob) {
+		t.Fatalf("expected ErrLengthOutOfBounds, got: %v", err)
+	}
+	swapHeader(frame)
+	if err := ValidateWireOrder(frame, other); err != nil {
+		t.Fatalf("unexpected ValidateWireOrder failure: %s", err)
+	}
+}
+
+func BenchmarkUnmarshalBinary(b *testing.B) {
+	frame, _ := IMsg{Type: 1, Data: make([]byte, 64)}.MarshalBinary()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		im := &IMsg{}
+		err := im.UnmarshalBinary(frame)
+		if err != nil {
+			b.Fatalf("unexpected UnmarshalBinary failure: %s", err)
+		}
+	}
+}
+
+// BenchmarkUnmarshalBinaryReader decodes the same frame as
+// BenchmarkUnmarshalBinary by way of a bytes.Reader, for comparison.
+func BenchmarkUnmarshalBinaryReader(b *testing.B) {
+	frame, _ := IMsg{Type: 1, Data: make([]byte, 64)}.MarshalBinary()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := ReadIMsg(bytes.NewReader(frame))
+		if err != nil {
+			b.Fatalf("unexpected ReadIMsg failure: %s", err)
+		}
+	}
+}
+
+func BenchmarkReadFromPooled(b *testing.B) {
+	frame, _ := IMsg{Type: 1, Data: make([]byte, 1024)}.MarshalBinary()
+	pool := sync.Pool{New: func() any { return &IMsg{} }}
+	r := bytes.NewReader(frame)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		im := pool.Get().(*IMsg)
+		r.Reset(frame)
+		_, err := im.ReadFrom(r)
+		if err != nil {
+			b.Fatalf("unexpected ReadFrom failure: %s", err)
+		}
+		im.Reset()
+		pool.Put(im)
+	}
+}
+
+func TestErrorSentinels(t *testing.T) {
+	_, err := IMsg{Data: make([]byte, MaxSizeInBytes)}.MarshalBinary()
+	var edtl *ErrDataTooLarge
+	if !errors.Is(err, ErrTooLarge) || !errors.As(err, &edtl) {
+		t.Fatalf("MarshalBinary error does not match ErrTooLarge (%v)", err)
+	}
+	if errors.Is(err, ErrOutOfBounds) || errors.Is(err, ErrShortData) {
+		t.Fatalf("MarshalBinary error matches unrelated sentinels (%v)", err)
+	}
+
+	frame := make([]byte, HeaderSizeInBytes)
+	endianness.PutUint16(frame[4:6], HeaderSizeInBytes-1)
+	_, err = ReadIMsg(bytes.NewReader(frame))
+	var eloob *ErrLengthOutOfBounds
+	if !errors.Is(err, ErrOutOfBounds) || !errors.As(err, &eloob) {
+		t.Fatalf("ReadIMsg error does not match ErrOutOfBounds (%v)", err)
+	}
+	if errors.Is(err, ErrTooLarge) {
+		t.Fatalf("ReadIMsg error matches unrelated sentinel (%v)", err)
+	}
+
+	frame = make([]byte, HeaderSizeInBytes+1)
+	endianness.PutUint16(frame[4:6], HeaderSizeInBytes+4)
+	_, err = ReadIMsg(bytes.NewReader(frame))
+	var et *ErrTruncated
+	if !errors.Is(err, ErrShortData) || !errors.As(err, &et) {
+		t.Fatalf("ReadIMsg error does not match ErrShortData (%v)", err)
+	}
+
+	// Wrapped errors still match.
+	wrapped := fmt.Errorf("context: %w", err)
+	if !errors.Is(wrapped, ErrShortData) {
+		t.Fatalf("wrapped error does not match ErrShortData (%v)", wrapped)
+	}
+}
+
+func TestReadIMsgInto(t *testing.T) {
+	batch := []*IMsg{
+		{Type: 1, PeerID: 2, PID: 3, Data: []byte("test")},
+		{Type: 4},
+		{Type: 5, Data: bytes.Repeat([]byte{0xaa}, 100)},
+		{Type: 6, Data: []byte("testing")},
+	}
+	stream, _ := MarshalAll(batch)
+	r := bytes.NewReader(stream)
+
+	im := &IMsg{}
+	for _, expected := range batch {
+		err := ReadIMsgInto(r, im)
+		if err != nil {
+			t.Fatalf("unexpected ReadIMsgInto failure: %s", err)
+		}
+		if !im.Equal(expected) {
+			t.Fatalf("decoded imsg does not match (%v != %v)", im, expected)
+		}
+	}
+
+	// The capacity grown for the largest imsg is reused, and survives io.EOF.
+	if cap(im.Data) < 100 {
+		t.Fatalf("imsg data was not reused (capacity %d)", cap(im.Data))
+	}
+	err := ReadIMsgInto(r, im)
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF, got: %v", err)
+	}
+	if cap(im.Data) < 100 {
+		t.Fatalf("imsg data capacity was lost (capacity %d)", cap(im.Data))
+	}
+
+	// So does an imsg without data.
+	empty, _ := IMsg{Type: 7}.MarshalBinary()
+	err = ReadIMsgInto(bytes.NewReader(empty), im)
+	if err != nil {
+		t.Fatalf("unexpected ReadIMsgInto failure: %s", err)
+	}
+	if len(im.Data) != 0 || cap(im.Data) < 100 {
+		t.Fatalf("imsg data capacity was lost (len %d, capacity %d)", len(im.Data), cap(im.Data))
+	}
+
+	var et *ErrTruncated
+	err = ReadIMsgInto(bytes.NewReader(stream[:HeaderSizeInBytes+2]), im)
+	if !errors.As(err, &et) || et.Stage != "body" {
+		t.Fatalf("expected truncated body, got: %v", err)
+	}
+}
+
+func BenchmarkReadIMsgInto(b *testing.B) {
+	frame, _ := (&IMsg{Type: 1, Data: make([]byte, 64)}).MarshalBinary()
+	stream := bytes.Repeat(frame, 10000)
+	r := bytes.NewReader(stream)
+	im := &IMsg{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if r.Len() == 0 {
+			r.Reset(stream)
+		}
+		err := ReadIMsgInto(r, im)
+		if err != nil {
+			b.Fatalf("unexpected ReadIMsgInto failure: %s", err)
+		}
+	}
+}
+
+func TestErrDataTooLargeFields(t *testing.T) {
+	max := MaxSizeInBytes - HeaderSizeInBytes
+
+	var edtl *ErrDataTooLarge
+	_, err := ComposeIMsg(42, 7, make([]byte, max+1))
+	if !errors.As(err, &edtl) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+	expected := ErrDataTooLarge{max + 1, max, 42, 7}
+	if *edtl != expected {
+		t.Fatalf("unexpected ComposeIMsg error fields (%+v != %+v)", *edtl, expected)
+	}
+	if msg := edtl.Error(); !strings.Contains(msg, "type 42") {
+		t.Fatalf("error text does not include type (%q)", msg)
+	}
+
+	_, err = IMsg{Type: 3, PeerID: 4, Data: make([]byte, max+2)}.MarshalBinary()
+	if !errors.As(err, &edtl) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+	expected = ErrDataTooLarge{max + 2, max, 3, 4}
+	if *edtl != expected {
+		t.Fatalf("unexpected MarshalBinary error fields (%+v != %+v)", *edtl, expected)
+	}
+
+	m := NewMsgBuf(io.Discard)
+	err = m.SetMaxSize(64)
+	if err != nil {
+		t.Fatalf("unexpected SetMaxSize failure: %s", err)
+	}
+	err = m.Enqueue(&IMsg{Type: 5, PeerID: 6, Data: make([]byte, 49)})
+	if !errors.As(err, &edtl) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+	expected = ErrDataTooLarge{49, 48, 5, 6}
+	if *edtl != expected {
+		t.Fatalf("unexpected Enqueue error fields (%+v != %+v)", *edtl, expected)
+	}
+	err = m.enqueuev(8, 9, 0, [][]byte{make([]byte, 40), make([]byte, 10)})
+	if !errors.As(err, &edtl) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+	expected = ErrDataTooLarge{50, 48, 8, 9}
+	if *edtl != expected {
+		t.Fatalf("unexpected enqueuev error fields (%+v != %+v)", *edtl, expected)
+	}
+
+	edtl = NewErrDataTooLarge(10, 5)
+	if edtl.Type != 0 || edtl.PeerID != 0 {
+		t.Fatalf("unexpected constructor fields (%+v)", *edtl)
+	}
+	if msg := edtl.Error(); strings.Contains(msg, "type") {
+		t.Fatalf("error text includes unset type (%q)", msg)
+	}
+}
+
+// This is an io.Reader which returns data from r until it's exhausted and err
+// thereafter.
+type failingReader struct {
+	r   io.Reader
+	err error
+}
+
+func (f *failingReader) Read(p []byte) (int, error) {
+	n, err := f.r.Read(p)
+	if err == io.EOF {
+		return n, f.err
+	}
+	return n, err
+}
+
+func TestIOErrorWrapping(t *testing.T) {
+	errReset := errors.New("connection reset")
+	frame, _ := IMsg{Type: 1, Data: []byte("test")}.MarshalBinary()
+
+	var tests = []struct {
+		name  string
+		data  []byte
+		stage string
+	}{
+		{"header", frame[:0], "header"},
+		{"partial header", frame[:HeaderSizeInBytes-1], "header"},
+		{"body", frame[:HeaderSizeInBytes], "body"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ReadIMsg(&failingReader{bytes.NewReader(tt.data), errReset})
+
+			var er *ErrRead
+			if !errors.As(err, &er) || er.Stage != tt.stage {
+				t.Fatalf("expected ErrRead at stage %q, got: %v", tt.stage, err)
+			}
+			if !errors.Is(err, errReset) {
+				t.Fatalf("wrapped error does not match underlying error (%v)", err)
+			}
+			if err.Error() != "imsg: reading "+tt.stage+": connection reset" {
+				t.Fatalf("unexpected error message (%q)", err.Error())
+			}
+		})
+	}
+
+	// A clean end of stream is reported as is.
+	_, err := ReadIMsg(bytes.NewReader(nil))
+	if err != io.EOF {
+		t.Fatalf("expected EOF, got: %v", err)
+	}
+
+	b := NewBuffer(struct {
+		io.Reader
+		io.Writer
+	}{&failingReader{bytes.NewReader(nil), errReset}, nil})
+	err = b.Read()
+	var er *ErrRead
+	if !errors.As(err, &er) || er.Stage != "stream" || !errors.Is(err, errReset) {
+		t.Fatalf("expected wrapped stream error, got: %v", err)
+	}
+
+	w := writerFunc(func(p []byte) (int, error) { return 0, errReset })
+	var ew *ErrWrite
+	err = NewEncoder(w).Encode(&IMsg{Type: 1})
+	if !errors.As(err, &ew) || !errors.Is(err, errReset) {
+		t.Fatalf("expected wrapped Encode error, got: %v", err)
+	}
+	_, err = (&IMsg{Type: 1}).WriteTo(w)
+	if !errors.As(err, &ew) || !errors.Is(err, errReset) {
+		t.Fatalf("expected wrapped WriteTo error, got: %v", err)
+	}
+
+	m := NewMsgBuf(w)
+	_ = m.Enqueue(&IMsg{Type: 1})
+	_, err = m.Flush()
+	if !errors.As(err, &ew) || !errors.Is(err, errReset) {
+		t.Fatalf("expected wrapped Flush error, got: %v", err)
+	}
+}
+
+func TestTruncation(t *testing.T) {
+	frame, _ := IMsg{Type: 1, PeerID: 2, PID: 3, Data: []byte("test")}.MarshalBinary()
+
+	for i := 0; i < len(frame); i++ {
+		expected := &ErrTruncated{HeaderSizeInBytes, i, "header"}
+		if i >= HeaderSizeInBytes {
+			expected = &ErrTruncated{len(frame) - HeaderSizeInBytes, i - HeaderSizeInBytes, "body"}
+		}
+
+		check := func(name string, err error) {
+			t.Helper()
+
+			var et *ErrTruncated
+			if !errors.As(err, &et) || *et != *expected {
+				t.Fatalf("%s of %d bytes: expected %v, got: %v", name, i, expected, err)
+			}
+			if !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Fatalf("%s of %d bytes: error does not unwrap to io.ErrUnexpectedEOF", name, i)
+			}
+		}
+
+		// A clean end of stream before any data is read isn't a truncation.
+		_, err := ReadIMsg(bytes.NewReader(frame[:i]))
+		if i == 0 {
+			if err != io.EOF {
+				t.Fatalf("ReadIMsg of 0 bytes: expected EOF, got: %v", err)
+			}
+		} else {
+			check("ReadIMsg", err)
+		}
+
+		err = (&IMsg{}).UnmarshalBinary(frame[:i])
+		check("UnmarshalBinary", err)
+
+		// DecodeAll reports the truncation of a trailing imsg after those which
+		// are complete.
+		ims, err := DecodeAll(append(append([]byte{}, frame...), frame[:i]...))
+		if i == 0 {
+			if err != nil || len(ims) != 1 {
+				t.Fatalf("unexpected DecodeAll result (%d imsgs, %v)", len(ims), err)
+			}
+			continue
+		}
+		check("DecodeAll", err)
+		if len(ims) != 1 {
+			t.Fatalf("DecodeAll of %d bytes: unexpected number of imsgs (%d != 1)", i, len(ims))
+		}
+	}
+}
+
+func TestReadIMsgN(t *testing.T) {
+	full, _ := (&IMsg{Type: 1, Data: []byte("test")}).MarshalBinary()
+	empty, _ := (&IMsg{Type: 2}).MarshalBinary()
+
+	var tests = []struct {
+		name        string
+		input       []byte
+		readErr     error
+		expectedN   int
+		expectedErr error
+	}{
+		{"empty imsg", empty, nil, HeaderSizeInBytes, nil},
+		{"imsg with data", full, nil, len(full), nil},
+		{"no data", nil, nil, 0, io.EOF},
+		{"truncated header", full[:7], nil, 7, &ErrTruncated{}},
+		{"truncated body", full[:HeaderSizeInBytes+2], nil, HeaderSizeInBytes + 2, &ErrTruncated{}},
+		{"failed header read", full[:7], errors.New("boom"), 7, &ErrRead{}},
+		{"failed body read", full[:HeaderSizeInBytes+1], errors.New("boom"), HeaderSizeInBytes + 1, &ErrRead{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r io.Reader = bytes.NewReader(tt.input)
+			if tt.readErr != nil {
+				r = &failingReader{r, tt.readErr}
+			}
+
+			im, n, err := ReadIMsgN(r)
+			if n != tt.expectedN {
+				t.Fatalf("unexpected byte count (%d != %d)", n, tt.expectedN)
+			}
+			if tt.expectedErr != nil {
+				if im != nil || !errorIsType(err, tt.expectedErr) {
+					t.Fatalf("expected %T, got: (%v, %v)", tt.expectedErr, im, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected ReadIMsgN failure: %s", err)
+			}
+		})
+	}
+}
+
+func TestSkipIMsg(t *testing.T) {
+	var stream bytes.Buffer
+	skipped := &IMsg{Type: 1, PeerID: 2, PID: 3, Data: bytes.Repeat([]byte{0xaa}, MaxSizeInBytes-HeaderSizeInBytes)}
+	next := &IMsg{Type: 4, Data: []byte("next")}
+	for _, im := range []*IMsg{skipped, {Type: 5}, next} {
+		_, err := im.WriteTo(&stream)
+		if err != nil {
+			t.Fatalf("unexpected WriteTo failure: %s", err)
+		}
+	}
+
+	hdr, err := SkipIMsg(&stream)
+	if err != nil {
+		t.Fatalf("unexpected SkipIMsg failure: %s", err)
+	}
+	if hdr != (Header{Type: 1, Length: MaxSizeInBytes, PeerID: 2, PID: 3}) {
+		t.Fatalf("unexpected header: %+v", hdr)
+	}
+	hdr, err = SkipIMsg(&stream)
+	if err != nil || hdr.Type != 5 || hdr.Length != HeaderSizeInBytes {
+		t.Fatalf("unexpected SkipIMsg result (%+v, %v)", hdr, err)
+	}
+
+	// The stream is left at the start of the following imsg.
+	im, err := ReadIMsg(&stream)
+	if err != nil || !im.Equal(next) {
+		t.Fatalf("unexpected ReadIMsg result (%v, %v)", im, err)
+	}
+	_, err = SkipIMsg(&stream)
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF, got: %v", err)
+	}
+
+	// Errors match those of ReadIMsg.
+	full, _ := next.MarshalBinary()
+	for _, input := range [][]byte{full[:7], full[:HeaderSizeInBytes+2]} {
+		_, expected := ReadIMsg(bytes.NewReader(input))
+		_, err := SkipIMsg(bytes.NewReader(input))
+		if !reflect.DeepEqual(err, expected) {
+			t.Fatalf("unexpected SkipIMsg failure (%v != %v)", err, expected)
+		}
+	}
+
+	// The reader, header, and limited reader are allocated, but never space
+	// for the data.
+	large, _ := skipped.MarshalBinary()
+	allocs := testing.AllocsPerRun(100, func() {
+		SkipIMsg(bytes.NewReader(large))
+	})
+	if allocs > 3 {
+		t.Fatalf("SkipIMsg allocated %.0f times", allocs)
+	}
+}
+
+func TestPeekHeader(t *testing.T) {
+	first := &IMsg{Type: 1, PeerID: 2, PID: 3, Data: []byte("first")}
+	second := &IMsg{Type: 4}
+	full, _ := first.MarshalBinary()
+	bs, _ := second.MarshalBinary()
+
+	// The source would block partway through the second header.
+	var src bytes.Buffer
+	src.Write(full)
+	src.Write(bs[:5])
+	br := bufio.NewReader(&failingReader{&src, ErrWouldBlock})
+
+	for i := 0; i < 2; i++ {
+		hdr, err := PeekHeader(br)
+		if err != nil {
+			t.Fatalf("unexpected PeekHeader failure: %s", err)
+		}
+		if hdr != (Header{Type: 1, Length: uint16(first.Len()), PeerID: 2, PID: 3}) {
+			t.Fatalf("unexpected header: %+v", hdr)
+		}
+	}
+	im, err := ReadIMsg(br)
+	if err != nil || !im.Equal(first) {
+		t.Fatalf("unexpected ReadIMsg result (%v, %v)", im, err)
+	}
+
+	_, err = PeekHeader(br)
+	var enm *ErrNeedMore
+	if !errors.As(err, &enm) || enm.Need != HeaderSizeInBytes-5 {
+		t.Fatalf("expected ErrNeedMore, got: %v", err)
+	}
+
+	src.Write(bs[5:])
+	hdr, err := PeekHeader(br)
+	if err != nil || hdr.Type != 4 {
+		t.Fatalf("unexpected PeekHeader result (%+v, %v)", hdr, err)
+	}
+	im, err = ReadIMsg(br)
+	if err != nil || !im.Equal(second) {
+		t.Fatalf("unexpected ReadIMsg result (%v, %v)", im, err)
+	}
+
+	_, err = PeekHeader(bufio.NewReader(bytes.NewReader(nil)))
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF, got: %v", err)
+	}
+	_, err = PeekHeader(bufio.NewReader(bytes.NewReader(full[:7])))
+	var et *ErrTruncated
+	if !errors.As(err, &et) {
+		t.Fatalf("expected ErrTruncated, got: %v", err)
+	}
+}
+
+func TestDecodeAll(t *testing.T) {
+	var stream []byte
+	var expected []*IMsg
+	for i := 0; i < 3; i++ {
+		im := &IMsg{Type: uint32(i), Data: bytes.Repeat([]byte{byte(i)}, i)}
+		bs, _ := im.MarshalBinary()
+		stream = append(stream, bs...)
+		expected = append(expected, im)
+	}
+
+	ims, err := DecodeAll(stream)
+	if err != nil {
+		t.Fatalf("unexpected DecodeAll failure: %s", err)
+	}
+	if len(ims) != len(expected) {
+		t.Fatalf("unexpected number of imsgs (%d != %d)", len(ims), len(expected))
+	}
+	for i := range ims {
+		if !ims[i].Equal(expected[i]) {
+			t.Fatalf("decoded imsg does not match (%v != %v)", ims[i], expected[i])
+		}
+	}
+
+	ims, err = DecodeAll(nil)
+	if err != nil || len(ims) != 0 {
+		t.Fatalf("unexpected DecodeAll result for empty input (%d imsgs, %v)", len(ims), err)
+	}
+
+	var eloob *ErrLengthOutOfBounds
+	_, err = DecodeAll(make([]byte, HeaderSizeInBytes))
+	if !errors.As(err, &eloob) {
+		t.Fatalf("expected ErrLengthOutOfBounds, got: %v", err)
+	}
+}
+
+func TestMarshalAll(t *testing.T) {
+	batch := []*IMsg{
+		{Type: 1},
+		{Type: 2, PeerID: 3, PID: 4, Data: []byte("test")},
+		{Type: 5, Data: bytes.Repeat([]byte{0xaa}, MaxSizeInBytes-HeaderSizeInBytes)},
+		{Type: 6, Data: []byte{0}},
+	}
+
+	bs, err := MarshalAll(batch)
+	if err != nil {
+		t.Fatalf("unexpected MarshalAll failure: %s", err)
+	}
+
+	var expected []byte
+	for _, im := range batch {
+		frame, _ := im.MarshalBinary()
+		expected = append(expected, frame...)
+	}
+	if !bytes.Equal(bs, expected) {
+		t.Fatalf("marshaled batch does not match individually marshaled imsgs")
+	}
+
+	ims, err := DecodeAll(bs)
+	if err != nil {
+		t.Fatalf("unexpected DecodeAll failure: %s", err)
+	}
+	if len(ims) != len(batch) {
+		t.Fatalf("unexpected number of imsgs (%d != %d)", len(ims), len(batch))
+	}
+	for i := range ims {
+		if !ims[i].Equal(batch[i]) {
+			t.Fatalf("decoded imsg does not match (%v != %v)", ims[i], batch[i])
+		}
+	}
+
+	bs, err = MarshalAll(nil)
+	if err != nil || len(bs) != 0 {
+		t.Fatalf("unexpected MarshalAll result for empty batch (%d bytes, %v)", len(bs), err)
+	}
+
+	batch[2].Data = append(batch[2].Data, 0)
+	var eb *ErrBatch
+	var edtl *ErrDataTooLarge
+	_, err = MarshalAll(batch)
+	if !errors.As(err, &eb) || eb.Index != 2 || !errors.As(err, &edtl) {
+		t.Fatalf("expected ErrBatch wrapping ErrDataTooLarge, got: %v", err)
+	}
+}
+
+func TestFrameSize(t *testing.T) {
+	frame, _ := IMsg{Type: 1, Data: []byte("test")}.MarshalBinary()
+	stream := append(append([]byte(nil), frame...), 0xaa, 0xbb)
+
+	testCases := []struct {
+		name     string
+		bs       []byte
+		expected int
+		need     int
+	}{
+		{"empty", nil, 0, HeaderSizeInBytes},
+		{"partial header", frame[:5], 0, HeaderSizeInBytes - 5},
+		{"header only", frame[:HeaderSizeInBytes], len(frame), 4},
+		{"partial data", frame[:len(frame)-1], len(frame), 1},
+		{"complete", frame, len(frame), 0},
+		{"followed by more", stream, len(frame), 0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			n, err := FrameSize(tc.bs)
+			if n != tc.expected {
+				t.Fatalf("unexpected frame size (%d != %d)", n, tc.expected)
+			}
+			if tc.need == 0 {
+				if err != nil {
+					t.Fatalf("unexpected FrameSize failure: %s", err)
+				}
+				return
+			}
+			var enm *ErrNeedMore
+			if !errors.As(err, &enm) || enm.Need != tc.need {
+				t.Fatalf("expected ErrNeedMore for %d bytes, got: %v", tc.need, err)
+			}
+		})
+	}
+
+	bad := make([]byte, HeaderSizeInBytes)
+	for _, length := range []uint16{0, HeaderSizeInBytes - 1, MaxSizeInBytes + 1} {
+		endianness.PutUint16(bad[4:6], length)
+		_, err := FrameSize(bad)
+		var eloob *ErrLengthOutOfBounds
+		if !errors.As(err, &eloob) || eloob.LengthInBytes != length {
+			t.Fatalf("expected ErrLengthOutOfBounds for length %d, got: %v", length, err)
+		}
+	}
+
+	allocs := testing.AllocsPerRun(100, func() {
+		FrameSize(stream)
+	})
+	if allocs != 0 {
+		t.Fatalf("FrameSize allocated (%.1f allocations per call)", allocs)
+	}
+}
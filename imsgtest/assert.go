@@ -0,0 +1,182 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsgtest
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	imsg "github.com/schultz-is/go-imsg"
+)
+
+const (
+	// This is the number of bytes of each side of a row of a comparison dump.
+	dumpRowBytes = 8
+	// This is the number of rows of a comparison dump shown on either side of
+	// the row holding the first difference.
+	dumpContextRows = 3
+)
+
+// AssertEqual fails the test if got isn't equal to want, as reported by
+// IMsg.Equal, so that nil and empty Data are equal. The failure lists each
+// header field which differs, including the flags, and shows the data side by
+// side in hex around the first byte which differs, which is highlighted.
+func AssertEqual(t testing.TB, want, got *imsg.IMsg) {
+	t.Helper()
+
+	if want.Equal(got) {
+		return
+	}
+	if want == nil || got == nil {
+		t.Errorf("imsgtest: imsgs differ: want %v, got %v", want, got)
+		return
+	}
+
+	order := imsg.SystemEndianness()
+	wantHdr, gotHdr := want.RawHeader(order), got.RawHeader(order)
+	t.Errorf(
+		"imsgtest: imsgs differ:\n%s",
+		describeDiff(parseHeader(wantHdr[:]), parseHeader(gotHdr[:]), want.Data, got.Data),
+	)
+}
+
+// AssertWireEqual fails the test if the frame got isn't identical to the frame
+// want, each of which is an imsg encoded in the system byte order as on the
+// wire. Both headers are parsed, so that the failure lists each field which
+// differs, and the data which follows is shown as by AssertEqual. Frames too
+// short to hold a header are shown whole.
+func AssertWireEqual(t testing.TB, want, got []byte) {
+	t.Helper()
+
+	if bytes.Equal(want, got) {
+		return
+	}
+	if len(want) < imsg.HeaderSizeInBytes || len(got) < imsg.HeaderSizeInBytes {
+		t.Errorf(
+			"imsgtest: frames differ (%d bytes != %d bytes), at least one without a whole header:\n%s",
+			len(want),
+			len(got),
+			dumpDiff(want, got),
+		)
+		return
+	}
+
+	t.Errorf(
+		"imsgtest: frames differ:\n%s",
+		describeDiff(
+			parseHeader(want),
+			parseHeader(got),
+			want[imsg.HeaderSizeInBytes:],
+			got[imsg.HeaderSizeInBytes:],
+		),
+	)
+}
+
+// parseHeader decodes the header at the start of bs, which must be at least
+// HeaderSizeInBytes long, in the system byte order.
+func parseHeader(bs []byte) imsg.Header {
+	order := imsg.SystemEndianness()
+
+	return imsg.Header{
+		Type:   order.Uint32(bs[0:4]),
+		Length: order.Uint16(bs[4:6]),
+		Flags:  imsg.Flags(order.Uint16(bs[6:8])),
+		PeerID: order.Uint32(bs[8:12]),
+		PID:    order.Uint32(bs[12:16]),
+	}
+}
+
+// describeDiff describes the differences between two imsgs with the provided
+// headers and data.
+func describeDiff(want, got imsg.Header, wantData, gotData []byte) string {
+	var b strings.Builder
+
+	fields := []struct {
+		name      string
+		want, got uint64
+	}{
+		{"Type", uint64(want.Type), uint64(got.Type)},
+		{"Length", uint64(want.Length), uint64(got.Length)},
+		{"Flags", uint64(want.Flags), uint64(got.Flags)},
+		{"PeerID", uint64(want.PeerID), uint64(got.PeerID)},
+		{"PID", uint64(want.PID), uint64(got.PID)},
+	}
+	for _, f := range fields {
+		if f.want != f.got {
+			fmt.Fprintf(&b, "  %s: want %d (%#x), got %d (%#x)\n", f.name, f.want, f.want, f.got, f.got)
+		}
+	}
+
+	if !bytes.Equal(wantData, gotData) {
+		fmt.Fprintf(&b, "  Data: want %d bytes, got %d bytes\n", len(wantData), len(gotData))
+		b.WriteString(dumpDiff(wantData, gotData))
+	}
+
+	return b.String()
+}
+
+// dumpDiff shows want and got side by side in hex, highlighting the first byte
+// at which they differ, which may be just past the end of the shorter of them.
+// Only the rows around that byte are shown.
+func dumpDiff(want, got []byte) string {
+	var b strings.Builder
+
+	diff := firstDiff(want, got)
+	fmt.Fprintf(&b, "  first difference at offset %d (%#x)\n", diff, diff)
+
+	rows := (max(len(want), len(got)) + dumpRowBytes - 1) / dumpRowBytes
+	first := max(diff/dumpRowBytes-dumpContextRows, 0)
+	last := min(diff/dumpRowBytes+dumpContextRows, rows-1)
+
+	fmt.Fprintf(&b, "  %-8s  %-*s  %s\n", "offset", 4*dumpRowBytes, " want", " got")
+	if first > 0 {
+		b.WriteString("  ...\n")
+	}
+	for row := first; row <= last; row++ {
+		off := row * dumpRowBytes
+		fmt.Fprintf(&b, "  %08x  %s  %s\n", off, dumpRow(want, off, diff), dumpRow(got, off, diff))
+	}
+	if last < rows-1 {
+		b.WriteString("  ...\n")
+	}
+
+	return b.String()
+}
+
+// dumpRow formats the row of bs starting at off in hex, bracketing the byte at
+// diff.
+func dumpRow(bs []byte, off, diff int) string {
+	var b strings.Builder
+
+	for i := off; i < off+dumpRowBytes; i++ {
+		switch {
+		case i >= len(bs) && i == diff:
+			b.WriteString("[--]")
+		case i >= len(bs):
+			b.WriteString("    ")
+		case i == diff:
+			fmt.Fprintf(&b, "[%02x]", bs[i])
+		default:
+			fmt.Fprintf(&b, " %02x ", bs[i])
+		}
+	}
+
+	return b.String()
+}
+
+// firstDiff returns the offset of the first byte at which a and b differ,
+// which is the length of the shorter of them if one is a prefix of the other.
+func firstDiff(a, b []byte) int {
+	n := min(len(a), len(b))
+	for i := 0; i < n; i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsgtest
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	imsg "github.com/schultz-is/go-imsg"
+)
+
+func TestAssertEqual(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 8)
+	changed := append([]byte(nil), data...)
+	changed[70] = 'X'
+
+	tests := []struct {
+		name      string
+		want, got *imsg.IMsg
+		expected  []string // Substrings of the failure, if any
+	}{
+		{"equal", &imsg.IMsg{Type: 1, Data: data}, &imsg.IMsg{Type: 1, Data: data}, nil},
+		{"nil and empty data", &imsg.IMsg{Type: 1}, &imsg.IMsg{Type: 1, Data: []byte{}}, nil},
+		{"both nil", nil, nil, nil},
+		{"one nil", &imsg.IMsg{Type: 1}, nil, []string{"want", "<nil>"}},
+		{
+			"header fields",
+			&imsg.IMsg{Type: 1, PeerID: 2, PID: 3},
+			&imsg.IMsg{Type: 4, PeerID: 2, PID: 5},
+			[]string{"Type: want 1 (0x1), got 4 (0x4)", "PID: want 3 (0x3), got 5 (0x5)"},
+		},
+		{
+			"data",
+			&imsg.IMsg{Type: 1, Data: data},
+			&imsg.IMsg{Type: 1, Data: changed},
+			[]string{"first difference at offset 70 (0x46)", "[36]", "[58]", "..."},
+		},
+		{
+			"data length",
+			&imsg.IMsg{Type: 1, Data: []byte("test")},
+			&imsg.IMsg{Type: 1, Data: []byte("tested")},
+			[]string{"Length: want 20", "want 4 bytes, got 6 bytes", "offset 4 (0x4)", "[--]", "[65]"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ft := &fakeT{TB: t}
+			AssertEqual(ft, test.want, test.got)
+			checkFailure(t, ft.end(), test.expected)
+		})
+	}
+}
+
+func TestAssertWireEqual(t *testing.T) {
+	marshal := func(im *imsg.IMsg) []byte {
+		bs, err := im.MarshalBinary()
+		if err != nil {
+			t.Fatalf("unexpected MarshalBinary failure: %s", err)
+		}
+		return bs
+	}
+
+	want := marshal(&imsg.IMsg{Type: 1, PeerID: 2, Data: []byte("test")})
+	tests := []struct {
+		name     string
+		got      []byte
+		expected []string
+	}{
+		{"equal", marshal(&imsg.IMsg{Type: 1, PeerID: 2, Data: []byte("test")}), nil},
+		{
+			"header and data",
+			marshal(&imsg.IMsg{Type: 1, PeerID: 7, Data: []byte("text")}),
+			[]string{"PeerID: want 2 (0x2), got 7 (0x7)", "offset 2 (0x2)", "[73]", "[78]"},
+		},
+		{"short", want[:10], []string{"without a whole header", "offset 10 (0xa)"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ft := &fakeT{TB: t}
+			AssertWireEqual(ft, want, test.got)
+			checkFailure(t, ft.end(), test.expected)
+		})
+	}
+}
+
+// checkFailure checks that a single failure containing each of the expected
+// substrings was reported, or none if there are none.
+func checkFailure(t *testing.T, errs []string, expected []string) {
+	t.Helper()
+
+	if len(expected) == 0 {
+		if len(errs) != 0 {
+			t.Fatalf("unexpected failures: %q", errs)
+		}
+		return
+	}
+	if len(errs) != 1 {
+		t.Fatalf("unexpected count of failures: %q", errs)
+	}
+	for _, s := range expected {
+		if !strings.Contains(errs[0], s) {
+			t.Fatalf("failure does not contain %q:\n%s", s, errs[0])
+		}
+	}
+}
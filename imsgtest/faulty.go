@@ -0,0 +1,246 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsgtest
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// A Fault is a step in the script of a FaultyReader or FaultyWriter, which
+// determines the outcome of a single call to Read or Write.
+type Fault struct {
+	limit   int             // Most bytes transferred, if positive
+	err     error           // Returned without transferring anything, if set
+	release <-chan struct{} // Awaited before the call proceeds, if set
+}
+
+// Transfer returns a Fault which lets a call read or write at most n bytes, as
+// a short read or a short write. A short write reports no error, leaving the
+// caller to write the rest.
+func Transfer(n int) Fault {
+	if n < 1 {
+		n = 1
+	}
+
+	return Fault{limit: n}
+}
+
+// FailWith returns a Fault which fails a call with err, such as io.EOF,
+// io.ErrUnexpectedEOF or syscall.EAGAIN, without transferring anything. The
+// error is returned once, and the following call proceeds with the next step.
+func FailWith(err error) Fault {
+	return Fault{err: err}
+}
+
+// Block returns a Fault which holds up a call until release is closed, after
+// which the call proceeds with the next step. Closing the FaultyReader or
+// FaultyWriter also ends the wait, failing the call with io.ErrClosedPipe.
+func Block(release <-chan struct{}) Fault {
+	return Fault{release: release}
+}
+
+// A faultScript is the sequence of Faults which remain to be played out.
+type faultScript struct {
+	mu     sync.Mutex
+	faults []Fault
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newFaultScript(faults []Fault) *faultScript {
+	return &faultScript{
+		faults: faults,
+		closed: make(chan struct{}),
+	}
+}
+
+// inject appends faults to the script.
+func (s *faultScript) inject(faults []Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.faults = append(s.faults, faults...)
+}
+
+// next plays out the steps which apply to a call transferring up to n bytes,
+// returning how many bytes it may transfer or the error it must return
+// instead. Once the script is exhausted, calls proceed unhindered.
+func (s *faultScript) next(n int) (int, error) {
+	for {
+		s.mu.Lock()
+		if len(s.faults) == 0 {
+			s.mu.Unlock()
+			return n, nil
+		}
+		f := s.faults[0]
+		s.faults = s.faults[1:]
+		s.mu.Unlock()
+
+		switch {
+		case f.release != nil:
+			select {
+			case <-f.release:
+			case <-s.closed:
+				return 0, io.ErrClosedPipe
+			}
+		case f.err != nil:
+			return 0, f.err
+		default:
+			return min(n, f.limit), nil
+		}
+	}
+}
+
+// remaining returns the number of steps which have yet to be played out.
+func (s *faultScript) remaining() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.faults)
+}
+
+// close ends any wait for a release.
+func (s *faultScript) close() {
+	s.closeOnce.Do(func() { close(s.closed) })
+}
+
+// A FaultyReader wraps an io.Reader, playing out a script of Faults against
+// successive calls to Read, so that tests can deterministically exercise the
+// handling of short reads, errors and stalls. Once the script is exhausted,
+// reads pass straight through. It implements SetReadDeadline as a no-op, so
+// that it can back a Conn; see NewFaultyStream.
+type FaultyReader struct {
+	r      io.Reader
+	script *faultScript
+}
+
+// NewFaultyReader constructs a FaultyReader which reads from r according to
+// the provided script.
+func NewFaultyReader(r io.Reader, faults ...Fault) *FaultyReader {
+	return &FaultyReader{r: r, script: newFaultScript(faults)}
+}
+
+// Inject appends faults to the script.
+func (r *FaultyReader) Inject(faults ...Fault) {
+	r.script.inject(faults)
+}
+
+// Remaining returns the number of steps of the script which have yet to be
+// played out.
+func (r *FaultyReader) Remaining() int {
+	return r.script.remaining()
+}
+
+// Read implements the io.Reader interface.
+func (r *FaultyReader) Read(p []byte) (int, error) {
+	n, err := r.script.next(len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	return r.r.Read(p[:n])
+}
+
+// SetReadDeadline does nothing.
+func (r *FaultyReader) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+// Close ends any wait for a release and closes the underlying reader, if it
+// can be closed.
+func (r *FaultyReader) Close() error {
+	r.script.close()
+	if c, ok := r.r.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+// A FaultyWriter wraps an io.Writer, playing out a script of Faults against
+// successive calls to Write, so that tests can deterministically exercise the
+// handling of short writes, errors and stalls, such as the resumption of a
+// partially written imsg. Once the script is exhausted, writes pass straight
+// through. It implements SetWriteDeadline as a no-op, so that it can back a
+// Conn; see NewFaultyStream.
+type FaultyWriter struct {
+	w      io.Writer
+	script *faultScript
+}
+
+// NewFaultyWriter constructs a FaultyWriter which writes to w according to the
+// provided script.
+func NewFaultyWriter(w io.Writer, faults ...Fault) *FaultyWriter {
+	return &FaultyWriter{w: w, script: newFaultScript(faults)}
+}
+
+// Inject appends faults to the script.
+func (w *FaultyWriter) Inject(faults ...Fault) {
+	w.script.inject(faults)
+}
+
+// Remaining returns the number of steps of the script which have yet to be
+// played out.
+func (w *FaultyWriter) Remaining() int {
+	return w.script.remaining()
+}
+
+// Write implements the io.Writer interface.
+func (w *FaultyWriter) Write(p []byte) (int, error) {
+	n, err := w.script.next(len(p))
+	if err != nil {
+		return 0, err
+	}
+
+	return w.w.Write(p[:n])
+}
+
+// SetWriteDeadline does nothing.
+func (w *FaultyWriter) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// Close ends any wait for a release and closes the underlying writer, if it
+// can be closed.
+func (w *FaultyWriter) Close() error {
+	w.script.close()
+	if c, ok := w.w.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+// A FaultyStream joins a FaultyReader and a FaultyWriter into a stream which
+// can back a Conn constructed with imsg.NewStreamConn. Faults are injected
+// through either of the two.
+type FaultyStream struct {
+	*FaultyReader
+	*FaultyWriter
+}
+
+// NewFaultyStream constructs a FaultyStream which reads from r and writes to w.
+func NewFaultyStream(r *FaultyReader, w *FaultyWriter) *FaultyStream {
+	return &FaultyStream{r, w}
+}
+
+// SetDeadline does nothing.
+func (s *FaultyStream) SetDeadline(t time.Time) error {
+	return nil
+}
+
+// Close closes both the FaultyReader and the FaultyWriter.
+func (s *FaultyStream) Close() error {
+	rerr := s.FaultyReader.Close()
+	werr := s.FaultyWriter.Close()
+	if rerr != nil {
+		return rerr
+	}
+
+	return werr
+}
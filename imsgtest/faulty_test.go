@@ -0,0 +1,156 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsgtest
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	imsg "github.com/schultz-is/go-imsg"
+)
+
+var errFault = errors.New("injected fault")
+
+// testIMsgs returns a few imsgs of varying sizes.
+func testIMsgs() []*imsg.IMsg {
+	return []*imsg.IMsg{
+		{Type: 1, PeerID: 2, PID: 3, Data: []byte("test")},
+		{Type: 4},
+		{Type: 5, Data: bytes.Repeat([]byte{0xaa}, 100)},
+	}
+}
+
+func TestFaultyWriterMsgBufResume(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewFaultyWriter(&buf, Transfer(5), Transfer(15), Transfer(4), FailWith(errFault))
+	m := imsg.NewMsgBuf(w)
+
+	ims := testIMsgs()
+	for _, im := range ims {
+		err := m.Enqueue(im)
+		if err != nil {
+			t.Fatalf("unexpected Enqueue failure: %s", err)
+		}
+	}
+
+	// Short writes are resumed until the error, which leaves the second imsg
+	// partially written.
+	_, err := m.Flush()
+	if !errors.Is(err, errFault) {
+		t.Fatalf("expected injected fault, got: %v", err)
+	}
+	if m.QueueLen() != 2 || buf.Len() != 24 {
+		t.Fatalf("unexpected state after fault (%d imsgs queued, %d bytes written)", m.QueueLen(), buf.Len())
+	}
+
+	// The next flush picks up where the last left off.
+	_, err = m.Flush()
+	if err != nil {
+		t.Fatalf("unexpected Flush failure: %s", err)
+	}
+	for _, want := range ims {
+		got, err := imsg.ReadIMsg(&buf)
+		if err != nil {
+			t.Fatalf("unexpected ReadIMsg failure: %s", err)
+		}
+		AssertEqual(t, want, got)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("unexpected trailing bytes: % x", buf.Bytes())
+	}
+}
+
+func TestFaultyReader(t *testing.T) {
+	var frames []byte
+	ims := testIMsgs()
+	for _, im := range ims {
+		bs, err := im.MarshalBinary()
+		if err != nil {
+			t.Fatalf("unexpected MarshalBinary failure: %s", err)
+		}
+		frames = append(frames, bs...)
+	}
+
+	// Short reads are reassembled into whole imsgs.
+	r := NewFaultyReader(bytes.NewReader(frames), Transfer(3), Transfer(1), Transfer(17))
+	for _, want := range ims {
+		got, err := imsg.ReadIMsg(r)
+		if err != nil {
+			t.Fatalf("unexpected ReadIMsg failure: %s", err)
+		}
+		AssertEqual(t, want, got)
+	}
+	if r.Remaining() != 0 {
+		t.Fatalf("script was not played out (%d steps remain)", r.Remaining())
+	}
+
+	// An EOF partway through an imsg truncates it.
+	r = NewFaultyReader(bytes.NewReader(frames), Transfer(18), FailWith(io.EOF))
+	_, err := imsg.ReadIMsg(r)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got: %v", err)
+	}
+}
+
+func TestFaultyStreamConn(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewFaultyWriter(&buf, Transfer(3), FailWith(errFault))
+	c := imsg.NewStreamConn(NewFaultyStream(NewFaultyReader(bytes.NewReader(nil)), w))
+	defer c.Close()
+
+	// A write failing partway through an imsg fails the Conn for good.
+	err := c.Send(&imsg.IMsg{Type: 1})
+	if !errors.Is(err, errFault) {
+		t.Fatalf("expected injected fault, got: %v", err)
+	}
+	err = c.Send(&imsg.IMsg{Type: 2})
+	var failed *imsg.ErrConnFailed
+	if !errors.As(err, &failed) || !errors.Is(err, errFault) {
+		t.Fatalf("expected ErrConnFailed, got: %v", err)
+	}
+	if c.State() != imsg.StateFailed || buf.Len() != 3 {
+		t.Fatalf("unexpected state after fault (%s, %d bytes written)", c.State(), buf.Len())
+	}
+}
+
+func TestFaultyWriterBlock(t *testing.T) {
+	var buf bytes.Buffer
+	release := make(chan struct{})
+	w := NewFaultyWriter(&buf, Block(release), Transfer(2))
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := w.Write([]byte("test"))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("Write returned before being released: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// Once released, the write proceeds with the next step.
+	close(release)
+	err := <-done
+	if err != nil || buf.String() != "te" {
+		t.Fatalf("unexpected Write result (%q, %v)", buf.String(), err)
+	}
+
+	// Closing ends the wait.
+	w.Inject(Block(make(chan struct{})))
+	go func() {
+		_, err := w.Write([]byte("test"))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	w.Close()
+	err = <-done
+	if err != io.ErrClosedPipe {
+		t.Fatalf("expected io.ErrClosedPipe, got: %v", err)
+	}
+}
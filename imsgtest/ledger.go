@@ -0,0 +1,152 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsgtest
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// ErrOverLimit is returned by Ledger.Acquire when acquiring would exceed the
+// Ledger's limit.
+var ErrOverLimit = errors.New("imsgtest: accounting limit exceeded")
+
+// A Ledger is an imsg.Accounting which counts the bytes acquired against a
+// limit, and records each acquisition so that tests can check that every one
+// is matched by a release of the same size. A Ledger is safe for concurrent
+// use.
+type Ledger struct {
+	mu       sync.Mutex
+	limit    int
+	inUse    int
+	held     map[int]int // Outstanding acquisitions, counted by size
+	acquired int         // Successful calls to Acquire
+	refused  int         // Calls to Acquire which returned ErrOverLimit
+	problems []string    // Releases which matched no acquisition
+}
+
+// NewLedger constructs a Ledger which refuses to have more than limit bytes
+// acquired at once, where a limit of zero means no limit.
+func NewLedger(limit int) *Ledger {
+	return &Ledger{limit: limit, held: make(map[int]int)}
+}
+
+// SetLimit changes the limit of the Ledger, without affecting what has already
+// been acquired.
+func (l *Ledger) SetLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.limit = limit
+}
+
+// Acquire implements the imsg.Accounting interface. It returns ErrOverLimit if
+// acquiring n bytes would exceed the limit.
+func (l *Ledger) Acquire(n int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.limit > 0 && l.inUse+n > l.limit {
+		l.refused++
+		return ErrOverLimit
+	}
+	l.inUse += n
+	l.held[n]++
+	l.acquired++
+
+	return nil
+}
+
+// Release implements the imsg.Accounting interface. A release which doesn't
+// match an outstanding acquisition of the same size is recorded as a problem,
+// to be reported by AssertBalanced.
+func (l *Ledger) Release(n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.held[n] == 0 {
+		l.problems = append(l.problems, fmt.Sprintf("release of %d bytes matches no acquisition", n))
+		return
+	}
+	l.held[n]--
+	l.inUse -= n
+}
+
+// InUse returns the number of bytes currently acquired.
+func (l *Ledger) InUse() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.inUse
+}
+
+// Outstanding returns the number of acquisitions which have yet to be
+// released.
+func (l *Ledger) Outstanding() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var n int
+	for _, count := range l.held {
+		n += count
+	}
+
+	return n
+}
+
+// Acquired returns the number of successful calls to Acquire.
+func (l *Ledger) Acquired() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.acquired
+}
+
+// Refused returns the number of calls to Acquire which were refused.
+func (l *Ledger) Refused() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.refused
+}
+
+// AssertBalanced fails the test unless every acquisition has been matched by a
+// release of the same size, and nothing was released without having been
+// acquired.
+func AssertBalanced(t testing.TB, l *Ledger) {
+	t.Helper()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, p := range l.problems {
+		t.Errorf("imsgtest: %s", p)
+	}
+
+	var (
+		outstanding int
+		sizes       []int
+	)
+	for n, count := range l.held {
+		if count > 0 {
+			outstanding += count
+			sizes = append(sizes, n)
+		}
+	}
+	if outstanding == 0 {
+		return
+	}
+	sort.Ints(sizes)
+
+	var b strings.Builder
+	for _, n := range sizes {
+		fmt.Fprintf(&b, " %d of %d bytes", l.held[n], n)
+	}
+	t.Errorf("imsgtest: %d acquisitions totaling %d bytes remain unreleased:%s", outstanding, l.inUse, b.String())
+}
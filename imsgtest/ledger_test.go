@@ -0,0 +1,199 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsgtest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	imsg "github.com/schultz-is/go-imsg"
+)
+
+func TestLedger(t *testing.T) {
+	l := NewLedger(10)
+	if err := l.Acquire(6); err != nil {
+		t.Fatalf("unexpected Acquire failure: %s", err)
+	}
+	if err := l.Acquire(6); err != ErrOverLimit {
+		t.Fatalf("expected ErrOverLimit, got: %v", err)
+	}
+	if l.InUse() != 6 || l.Outstanding() != 1 || l.Acquired() != 1 || l.Refused() != 1 {
+		t.Fatalf(
+			"unexpected Ledger state (%d in use, %d outstanding, %d acquired, %d refused)",
+			l.InUse(), l.Outstanding(), l.Acquired(), l.Refused(),
+		)
+	}
+
+	// A release must match an acquisition of the same size.
+	ft := &fakeT{TB: t}
+	l.Release(4)
+	AssertBalanced(ft, l)
+	if errs := ft.end(); len(errs) != 2 {
+		t.Fatalf("expected 2 failures, got: %q", errs)
+	}
+
+	ft = &fakeT{TB: t}
+	l = NewLedger(0)
+	l.Acquire(6)
+	l.Release(6)
+	AssertBalanced(ft, l)
+	if errs := ft.end(); len(errs) != 0 {
+		t.Fatalf("unexpected failures: %q", errs)
+	}
+}
+
+func TestLedgerMsgBuf(t *testing.T) {
+	l := NewLedger(0)
+	var buf bytes.Buffer
+	w := NewFaultyWriter(&buf, Transfer(5), FailWith(errFault))
+	m := imsg.NewMsgBuf(w)
+	m.SetAccounting(l)
+	m.SetQueueLimit(3, 0, imsg.QueueDropOldest)
+
+	// Imsgs are accounted for while queued, and released once written,
+	// dropped or cleared.
+	for _, im := range testIMsgs() {
+		if err := m.Enqueue(im); err != nil {
+			t.Fatalf("unexpected Enqueue failure: %s", err)
+		}
+	}
+	if l.Outstanding() != 3 || l.InUse() != m.PendingBytes() {
+		t.Fatalf("unexpected accounting (%d outstanding, %d in use)", l.Outstanding(), l.InUse())
+	}
+	_, err := m.Flush()
+	if !errors.Is(err, errFault) {
+		t.Fatalf("expected injected fault, got: %v", err)
+	}
+	if err := m.Enqueue(&imsg.IMsg{Type: 6}); err != nil {
+		t.Fatalf("unexpected Enqueue failure: %s", err)
+	}
+	if m.Dropped() != 1 || l.Outstanding() != 3 {
+		t.Fatalf("unexpected accounting after drop (%d dropped, %d outstanding)", m.Dropped(), l.Outstanding())
+	}
+	if _, err := m.Flush(); err != nil {
+		t.Fatalf("unexpected Flush failure: %s", err)
+	}
+	AssertBalanced(t, l)
+
+	// A refused imsg isn't queued, and a queue which is cleared releases
+	// everything it held.
+	l.SetLimit(imsg.HeaderSizeInBytes)
+	if err := m.Enqueue(&imsg.IMsg{Type: 7}); err != nil {
+		t.Fatalf("unexpected Enqueue failure: %s", err)
+	}
+	err = m.Enqueue(&imsg.IMsg{Type: 8})
+	var full *imsg.ErrQueueFull
+	if !errors.As(err, &full) || !errors.Is(err, ErrOverLimit) {
+		t.Fatalf("expected ErrQueueFull, got: %v", err)
+	}
+	if m.QueueLen() != 1 {
+		t.Fatalf("unexpected queue length: %d", m.QueueLen())
+	}
+	m.Clear()
+	AssertBalanced(t, l)
+}
+
+func TestLedgerConn(t *testing.T) {
+	l := NewLedger(imsg.HeaderSizeInBytes)
+	a, b := Pipe(imsg.WithAccounting(l))
+	defer b.Close()
+
+	// Sent imsgs are released once written.
+	for typ := uint32(1); typ <= 3; typ++ {
+		if err := b.Send(&imsg.IMsg{Type: typ}); err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+	AssertBalanced(t, l)
+
+	// Once an imsg set aside for Recv is refused, nothing more is read until
+	// Recv makes room.
+	isReply := func(im *imsg.IMsg) bool { return im.Type == 3 }
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := a.RecvMatching(ctx, isReply)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got: %v", err)
+	}
+	if l.Outstanding() != 1 || l.Refused() != 1 {
+		t.Fatalf("unexpected accounting (%d outstanding, %d refused)", l.Outstanding(), l.Refused())
+	}
+	im, err := a.Recv()
+	if err != nil || im.Type != 1 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+	im, err = a.RecvMatching(context.Background(), isReply)
+	if err != nil || im.Type != 3 {
+		t.Fatalf("unexpected RecvMatching result (%v, %v)", im, err)
+	}
+	im, err = a.Recv()
+	if err != nil || im.Type != 2 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+	AssertBalanced(t, l)
+
+	// Imsgs left in the backlog are released on Close.
+	b.Send(&imsg.IMsg{Type: 4})
+	b.Send(&imsg.IMsg{Type: 3})
+	_, err = a.RecvMatching(context.Background(), isReply)
+	if err != nil || l.Outstanding() != 1 {
+		t.Fatalf("unexpected RecvMatching result (%d outstanding, %v)", l.Outstanding(), err)
+	}
+	a.Close()
+	AssertBalanced(t, l)
+}
+
+func TestLedgerReassembler(t *testing.T) {
+	l := NewLedger(0)
+	r := imsg.NewReassembler(1024)
+	r.SetAccounting(l)
+
+	data := bytes.Repeat([]byte{0xaa}, 25)
+	frags, err := imsg.ComposeFragments(1, 0, data, 2*imsg.HeaderSizeInBytes+10)
+	if err != nil {
+		t.Fatalf("unexpected ComposeFragments failure: %s", err)
+	}
+	if len(frags) != 3 {
+		t.Fatalf("unexpected fragment count: %d", len(frags))
+	}
+
+	// A completed series is released once returned.
+	for i, frag := range frags {
+		got, done, err := r.Add(frag)
+		if err != nil {
+			t.Fatalf("unexpected Add failure: %s", err)
+		}
+		if done != (i == len(frags)-1) {
+			t.Fatalf("unexpected completion after fragment %d", i)
+		}
+		if done && !bytes.Equal(got, data) {
+			t.Fatalf("unexpected reassembled data: % x", got)
+		}
+	}
+	AssertBalanced(t, l)
+
+	// A refused fragment discards its series.
+	l.SetLimit(15)
+	r.Add(frags[0])
+	_, _, err = r.Add(frags[1])
+	var ef *imsg.ErrFragment
+	if !errors.As(err, &ef) || r.Pending() != 0 {
+		t.Fatalf("expected ErrFragment, got: %v", err)
+	}
+	AssertBalanced(t, l)
+
+	// So does Reset.
+	l.SetLimit(0)
+	r.Add(frags[0])
+	r.Add(frags[1])
+	if l.Outstanding() != 2 {
+		t.Fatalf("unexpected outstanding count: %d", l.Outstanding())
+	}
+	r.Reset()
+	AssertBalanced(t, l)
+}
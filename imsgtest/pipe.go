@@ -0,0 +1,247 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+// Package imsgtest provides utilities for testing code built on imsg.Conn
+// without standing up a peer process.
+package imsgtest
+
+import (
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	imsg "github.com/schultz-is/go-imsg"
+)
+
+// Pipe constructs a pair of connected Conns backed by an in-memory duplex pipe,
+// with the provided options applied to both. Imsgs sent on one are received on
+// the other, closing one causes the other to receive io.EOF once it has
+// received everything sent, and deadlines interrupt blocked reads, so that
+// cancelling the context passed to Serve or Call works as it would on a
+// socket. Unlike net.Pipe, writes are buffered without limit, so a test may
+// send and then receive from a single goroutine. Descriptors can't be passed
+// over the pipe; see SocketPair for a pair which supports descriptor passing.
+func Pipe(opts ...imsg.ConnOption) (a, b *imsg.Conn) {
+	ab, ba := newHalfPipe(), newHalfPipe()
+	pa := &pipeConn{r: ba, w: ab, name: "imsgtest-pipe-a"}
+	pb := &pipeConn{r: ab, w: ba, name: "imsgtest-pipe-b"}
+
+	return imsg.NewConn(pa, opts...), imsg.NewConn(pb, opts...)
+}
+
+// A halfPipe buffers the bytes written by one end of a pipe until they're read
+// by the other.
+type halfPipe struct {
+	mu      sync.Mutex
+	buf     []byte
+	wclosed bool          // Whether the writing end is closed
+	rclosed bool          // Whether the reading end is closed
+	ready   chan struct{} // Signalled when buf grows or the writing end closes
+	done    chan struct{} // Closed when the reading end closes
+}
+
+func newHalfPipe() *halfPipe {
+	return &halfPipe{
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+	}
+}
+
+// signal wakes a read waiting on the halfPipe.
+func (h *halfPipe) signal() {
+	select {
+	case h.ready <- struct{}{}:
+	default:
+	}
+}
+
+// A pipeConn is one end of a Pipe. It implements the net.Conn interface.
+type pipeConn struct {
+	r, w *halfPipe
+	name string
+
+	rdl, wdl deadline
+}
+
+// Read implements the io.Reader interface.
+func (p *pipeConn) Read(bs []byte) (int, error) {
+	for {
+		p.r.mu.Lock()
+		switch {
+		case p.r.rclosed:
+			p.r.mu.Unlock()
+			return 0, net.ErrClosed
+		case len(p.r.buf) > 0:
+			n := copy(bs, p.r.buf)
+			p.r.buf = p.r.buf[n:]
+			p.r.mu.Unlock()
+			return n, nil
+		case p.r.wclosed:
+			p.r.mu.Unlock()
+			return 0, io.EOF
+		}
+		p.r.mu.Unlock()
+
+		select {
+		case <-p.r.ready:
+		case <-p.r.done:
+		case <-p.rdl.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// Write implements the io.Writer interface. Writes never block.
+func (p *pipeConn) Write(bs []byte) (int, error) {
+	select {
+	case <-p.wdl.wait():
+		return 0, os.ErrDeadlineExceeded
+	default:
+	}
+
+	p.w.mu.Lock()
+	defer p.w.mu.Unlock()
+
+	switch {
+	case p.w.wclosed:
+		return 0, net.ErrClosed
+	case p.w.rclosed:
+		return 0, io.ErrClosedPipe
+	}
+	p.w.buf = append(p.w.buf, bs...)
+	p.w.signal()
+
+	return len(bs), nil
+}
+
+// Close implements the io.Closer interface.
+func (p *pipeConn) Close() error {
+	p.CloseWrite()
+
+	p.r.mu.Lock()
+	if !p.r.rclosed {
+		p.r.rclosed = true
+		p.r.buf = nil
+		close(p.r.done)
+	}
+	p.r.mu.Unlock()
+
+	return nil
+}
+
+// CloseWrite closes the writing end of the pipe, so that the peer reads io.EOF
+// once it has read everything written.
+func (p *pipeConn) CloseWrite() error {
+	p.w.mu.Lock()
+	p.w.wclosed = true
+	p.w.signal()
+	p.w.mu.Unlock()
+
+	return nil
+}
+
+// LocalAddr implements the net.Conn interface.
+func (p *pipeConn) LocalAddr() net.Addr {
+	return pipeAddr(p.name)
+}
+
+// RemoteAddr implements the net.Conn interface.
+func (p *pipeConn) RemoteAddr() net.Addr {
+	return pipeAddr(p.name)
+}
+
+// SetDeadline implements the net.Conn interface.
+func (p *pipeConn) SetDeadline(t time.Time) error {
+	p.rdl.set(t)
+	p.wdl.set(t)
+
+	return nil
+}
+
+// SetReadDeadline implements the net.Conn interface.
+func (p *pipeConn) SetReadDeadline(t time.Time) error {
+	p.rdl.set(t)
+	return nil
+}
+
+// SetWriteDeadline implements the net.Conn interface.
+func (p *pipeConn) SetWriteDeadline(t time.Time) error {
+	p.wdl.set(t)
+	return nil
+}
+
+// A pipeAddr is the address of either end of a Pipe.
+type pipeAddr string
+
+// Network implements the net.Addr interface.
+func (pipeAddr) Network() string {
+	return "pipe"
+}
+
+// String implements the net.Addr interface.
+func (a pipeAddr) String() string {
+	return string(a)
+}
+
+// A deadline provides a channel which is closed once a time set on it passes.
+type deadline struct {
+	mu      sync.Mutex
+	timer   *time.Timer
+	expired chan struct{}
+}
+
+// set arranges for the channel returned by wait to be closed at t. The zero
+// time clears the deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		// The timer has fired, so its channel is closed or about to be.
+		<-d.expired
+	}
+	d.timer = nil
+
+	if d.expired == nil || isClosed(d.expired) {
+		d.expired = make(chan struct{})
+	}
+	if t.IsZero() {
+		return
+	}
+
+	dur := time.Until(t)
+	if dur <= 0 {
+		close(d.expired)
+		return
+	}
+
+	expired := d.expired
+	d.timer = time.AfterFunc(dur, func() {
+		close(expired)
+	})
+}
+
+// wait returns a channel which is closed once the deadline passes.
+func (d *deadline) wait() chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.expired == nil {
+		d.expired = make(chan struct{})
+	}
+
+	return d.expired
+}
+
+// isClosed reports whether ch has been closed.
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsgtest
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	imsg "github.com/schultz-is/go-imsg"
+)
+
+func TestPipe(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	// Sends are buffered, so both directions work from a single goroutine.
+	for i, pair := range [][2]*imsg.Conn{{a, b}, {b, a}} {
+		sent := &imsg.IMsg{Type: uint32(i), Data: []byte("test")}
+		err := pair[0].Send(sent)
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+		im, err := pair[1].Recv()
+		if err != nil {
+			t.Fatalf("unexpected Recv failure: %s", err)
+		}
+		if !im.Equal(sent) {
+			t.Fatalf("received imsg does not match (%v != %v)", im, sent)
+		}
+	}
+
+	// There's no descriptor to expose.
+	_, err := a.SyscallConn()
+	var eu *imsg.ErrUnsupported
+	if !errors.As(err, &eu) {
+		t.Fatalf("expected ErrUnsupported, got: %v", err)
+	}
+
+	// Descriptors can't be passed.
+	a.AllowFDPass(true)
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %s", err)
+	}
+	defer w.Close()
+	im, _ := imsg.ComposeIMsgWithFile(1, 0, nil, r)
+	err = a.Send(im)
+	var efpu *imsg.ErrFDPassUnsupported
+	if !errors.As(err, &efpu) {
+		t.Fatalf("expected ErrFDPassUnsupported, got: %v", err)
+	}
+	r.Close()
+
+	// Closing one end delivers what was sent before EOF.
+	a.Send(&imsg.IMsg{Type: 5})
+	a.Close()
+	im, err = b.Recv()
+	if err != nil || im.Type != 5 {
+		t.Fatalf("unexpected Recv result after Close (%v, %v)", im, err)
+	}
+	_, err = b.Recv()
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF, got: %v", err)
+	}
+	err = b.Send(&imsg.IMsg{Type: 6})
+	if err == nil {
+		t.Fatalf("expected Send to a closed pipe to fail")
+	}
+}
+
+func TestPipeDeadline(t *testing.T) {
+	a, b := Pipe()
+	defer a.Close()
+	defer b.Close()
+
+	// Cancelling the context of Serve interrupts its blocked Recv.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := imsg.Serve(ctx, b, imsg.NewMux())
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got: %v", err)
+	}
+
+	// The interrupted Conn remains usable.
+	a.Send(&imsg.IMsg{Type: 1})
+	im, err := b.Recv()
+	if err != nil || im.Type != 1 {
+		t.Fatalf("unexpected Recv result after deadline (%v, %v)", im, err)
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsgtest
+
+import (
+	"context"
+	"io"
+	"net"
+	"sync"
+
+	imsg "github.com/schultz-is/go-imsg"
+)
+
+// A RecordingConn is a test double for an imsg.Conn. It provides the same Send
+// and Recv methods, recording a copy of each imsg sent for inspection with Sent
+// and returning imsgs queued by the test with QueueRecv from Recv. It is safe
+// for concurrent use, so the code under test may send and receive from
+// background goroutines.
+type RecordingConn struct {
+	mu     sync.Mutex
+	sent   []*imsg.IMsg
+	recv   []*imsg.IMsg
+	end    error         // Returned by Recv once recv is drained, if set
+	ready  chan struct{} // Closed and replaced when recv or end changes
+	closed bool
+}
+
+// NewRecordingConn constructs an empty RecordingConn.
+func NewRecordingConn() *RecordingConn {
+	return &RecordingConn{ready: make(chan struct{})}
+}
+
+// Send records a copy of an imsg. Attached files aren't retained by the copy.
+// Once the RecordingConn is closed, net.ErrClosed is returned instead.
+func (c *RecordingConn) Send(im *imsg.IMsg) error {
+	return c.SendBatch(im)
+}
+
+// SendContext behaves like Send, returning the context's error instead if it's
+// already done.
+func (c *RecordingConn) SendContext(ctx context.Context, im *imsg.IMsg) error {
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	return c.Send(im)
+}
+
+// SendBatch records copies of several imsgs, in order.
+func (c *RecordingConn) SendBatch(ims ...*imsg.IMsg) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return net.ErrClosed
+	}
+	for _, im := range ims {
+		c.sent = append(c.sent, im.Clone())
+	}
+
+	return nil
+}
+
+// Sent returns copies of the imsgs sent so far, in the order they were sent.
+func (c *RecordingConn) Sent() []*imsg.IMsg {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	sent := make([]*imsg.IMsg, len(c.sent))
+	for i, im := range c.sent {
+		sent[i] = im.Clone()
+	}
+
+	return sent
+}
+
+// QueueRecv queues imsgs to be returned, in order, by subsequent calls to Recv.
+func (c *RecordingConn) QueueRecv(ims ...*imsg.IMsg) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.recv = append(c.recv, ims...)
+	c.notify()
+}
+
+// EndRecv causes Recv to return err once the imsgs queued with QueueRecv have
+// all been received. A nil error is replaced by io.EOF, as though the peer had
+// closed the connection.
+func (c *RecordingConn) EndRecv(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.end = err
+	c.notify()
+}
+
+// notify wakes calls to Recv waiting for the queue to change. The caller must
+// hold c.mu.
+func (c *RecordingConn) notify() {
+	close(c.ready)
+	c.ready = make(chan struct{})
+}
+
+// Recv returns the next imsg queued with QueueRecv. Once the queue is empty, it
+// returns the error provided to EndRecv, or, if EndRecv hasn't been called,
+// waits for more imsgs to be queued. Once the RecordingConn is closed,
+// net.ErrClosed is returned.
+func (c *RecordingConn) Recv() (*imsg.IMsg, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		switch {
+		case c.closed:
+			return nil, net.ErrClosed
+		case len(c.recv) > 0:
+			im := c.recv[0]
+			c.recv = c.recv[1:]
+			return im, nil
+		case c.end != nil:
+			return nil, c.end
+		}
+
+		ready := c.ready
+		c.mu.Unlock()
+		<-ready
+		c.mu.Lock()
+	}
+}
+
+// Close causes subsequent sends to fail, and pending and subsequent calls to
+// Recv to return net.ErrClosed. Imsgs already sent remain available from Sent.
+// Calling Close more than once is harmless.
+func (c *RecordingConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		c.notify()
+	}
+
+	return nil
+}
@@ -0,0 +1,138 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsgtest
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	imsg "github.com/schultz-is/go-imsg"
+)
+
+// A sendRecver is the surface shared by imsg.Conn and RecordingConn.
+type sendRecver interface {
+	Send(*imsg.IMsg) error
+	Recv() (*imsg.IMsg, error)
+	Close() error
+}
+
+var (
+	_ sendRecver = (*imsg.Conn)(nil)
+	_ sendRecver = (*RecordingConn)(nil)
+)
+
+func TestRecordingConnSent(t *testing.T) {
+	c := NewRecordingConn()
+
+	// Each goroutine's imsgs are recorded in the order it sent them.
+	const senders, perSender = 4, 100
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(peerID uint32) {
+			defer wg.Done()
+			for j := 0; j < perSender; j++ {
+				c.Send(&imsg.IMsg{Type: uint32(j), PeerID: peerID})
+			}
+		}(uint32(i))
+	}
+	wg.Wait()
+
+	sent := c.Sent()
+	if len(sent) != senders*perSender {
+		t.Fatalf("unexpected number of sent imsgs (%d != %d)", len(sent), senders*perSender)
+	}
+	next := make(map[uint32]uint32)
+	for _, im := range sent {
+		if im.Type != next[im.PeerID] {
+			t.Fatalf("imsgs from sender %d out of order (%d != %d)", im.PeerID, im.Type, next[im.PeerID])
+		}
+		next[im.PeerID]++
+	}
+
+	// Sent imsgs are copies, unaffected by later changes to the originals.
+	data := []byte("test")
+	c = NewRecordingConn()
+	c.Send(&imsg.IMsg{Type: 1, Data: data})
+	data[0] = 'b'
+	if string(c.Sent()[0].Data) != "test" {
+		t.Fatalf("sent imsg was not copied: %q", c.Sent()[0].Data)
+	}
+
+	c.Close()
+	err := c.Send(&imsg.IMsg{Type: 2})
+	if err != net.ErrClosed || len(c.Sent()) != 1 {
+		t.Fatalf("expected net.ErrClosed, got: %v", err)
+	}
+}
+
+func TestRecordingConnRecv(t *testing.T) {
+	c := NewRecordingConn()
+
+	// Recv waits for imsgs to be queued.
+	recvd := make(chan *imsg.IMsg)
+	go func() {
+		for {
+			im, err := c.Recv()
+			if err != nil {
+				close(recvd)
+				return
+			}
+			recvd <- im
+		}
+	}()
+
+	c.QueueRecv(&imsg.IMsg{Type: 1}, &imsg.IMsg{Type: 2})
+	for _, typ := range []uint32{1, 2} {
+		im := <-recvd
+		if im.Type != typ {
+			t.Fatalf("unexpected imsg received (%d != %d)", im.Type, typ)
+		}
+	}
+	c.QueueRecv(&imsg.IMsg{Type: 3})
+	if im := <-recvd; im.Type != 3 {
+		t.Fatalf("unexpected imsg received (%d != 3)", im.Type)
+	}
+	c.EndRecv(nil)
+	if _, ok := <-recvd; ok {
+		t.Fatalf("expected Recv to fail after EndRecv")
+	}
+
+	// Queued imsgs are received before the end error.
+	errTest := errors.New("test")
+	c = NewRecordingConn()
+	c.QueueRecv(&imsg.IMsg{Type: 4})
+	c.EndRecv(errTest)
+	im, err := c.Recv()
+	if err != nil || im.Type != 4 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+	_, err = c.Recv()
+	if err != errTest {
+		t.Fatalf("expected the end error, got: %v", err)
+	}
+
+	c = NewRecordingConn()
+	c.EndRecv(nil)
+	_, err = c.Recv()
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF, got: %v", err)
+	}
+
+	// Close unblocks a waiting Recv.
+	c = NewRecordingConn()
+	errc := make(chan error)
+	go func() {
+		_, err := c.Recv()
+		errc <- err
+	}()
+	c.Close()
+	if err := <-errc; err != net.ErrClosed {
+		t.Fatalf("expected net.ErrClosed, got: %v", err)
+	}
+}
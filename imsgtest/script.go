@@ -0,0 +1,236 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsgtest
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	imsg "github.com/schultz-is/go-imsg"
+)
+
+// DefaultScriptTimeout is the default limit on how long a Script waits for each
+// expected imsg.
+const DefaultScriptTimeout = 5 * time.Second
+
+// A Script is a fake peer which plays out a sequence of steps against one end
+// of a connection, such as one provided by Pipe, while the component under
+// test drives the other. Each Expect step receives an imsg and checks it, and
+// each Reply step sends one. The test fails if the component sends an imsg
+// which doesn't match the next expectation, sends nothing within the timeout,
+// or sends anything once the script is complete, and if any expectations
+// remain unmet when the test ends.
+//
+// Steps are added before the Script is run, and calls which add them may be
+// chained:
+//
+//	a, b := imsgtest.Pipe()
+//	imsgtest.NewScript(t).
+//		ExpectData(msgHello, []byte("v1")).
+//		Reply(msgWelcome, nil).
+//		Run(b)
+//	runComponent(a)
+type Script struct {
+	t       testing.TB
+	timeout time.Duration
+	steps   []scriptStep
+
+	done   chan struct{}   // Closed once the steps have been played out
+	failed bool            // Whether a step failed, set before done is closed
+	recv   chan *imsg.IMsg // Imsgs received from conn
+	stop   chan struct{}   // Closed when the test ends
+	once   sync.Once
+	conn   *imsg.Conn
+}
+
+// A scriptStep either expects an imsg, when match is set, or sends reply.
+type scriptStep struct {
+	typ   uint32
+	desc  string
+	match func(data []byte) bool
+	data  []byte // Expected data, if exact
+	reply *imsg.IMsg
+}
+
+// NewScript constructs an empty Script which reports failures to t.
+func NewScript(t testing.TB) *Script {
+	return &Script{
+		t:       t,
+		timeout: DefaultScriptTimeout,
+	}
+}
+
+// SetTimeout sets the limit on how long the Script waits for each expected
+// imsg, which defaults to DefaultScriptTimeout.
+func (s *Script) SetTimeout(d time.Duration) *Script {
+	s.timeout = d
+	return s
+}
+
+// Expect adds a step which receives an imsg and checks that it's of the
+// provided type and that match, if not nil, reports its data as acceptable.
+func (s *Script) Expect(typ uint32, match func(data []byte) bool) *Script {
+	desc := "any data"
+	if match == nil {
+		match = func([]byte) bool { return true }
+	} else {
+		desc = "data accepted by the matcher"
+	}
+	s.steps = append(s.steps, scriptStep{typ: typ, desc: desc, match: match})
+
+	return s
+}
+
+// ExpectData adds a step which receives an imsg and checks that it's of the
+// provided type with exactly the provided data. A mismatch is reported with a
+// dump of both.
+func (s *Script) ExpectData(typ uint32, data []byte) *Script {
+	s.steps = append(s.steps, scriptStep{
+		typ:  typ,
+		desc: "exact data",
+		match: func(got []byte) bool {
+			return bytes.Equal(got, data)
+		},
+		data: data,
+	})
+
+	return s
+}
+
+// Reply adds a step which sends an imsg of the provided type and data.
+func (s *Script) Reply(typ uint32, data []byte) *Script {
+	s.steps = append(s.steps, scriptStep{reply: &imsg.IMsg{Type: typ, Data: data}})
+	return s
+}
+
+// Run plays out the steps against c in the background. The Script takes
+// ownership of c, closing it when the test ends, at which point the test waits
+// for the Script to finish and fails if any expectations remain unmet or any
+// imsgs arrived once it was complete. Wait may be used to do so sooner.
+func (s *Script) Run(c *imsg.Conn) {
+	s.conn = c
+	s.done = make(chan struct{})
+	s.recv = make(chan *imsg.IMsg, 64)
+	s.stop = make(chan struct{})
+
+	go s.read()
+	go s.play()
+
+	s.t.Cleanup(func() {
+		s.Wait()
+		close(s.stop)
+		c.Close()
+	})
+}
+
+// read receives imsgs from the connection until it fails.
+func (s *Script) read() {
+	defer close(s.recv)
+
+	for {
+		im, err := s.conn.Recv()
+		if err != nil {
+			return
+		}
+		select {
+		case s.recv <- im:
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// play performs each step in turn, stopping at the first failure.
+func (s *Script) play() {
+	defer close(s.done)
+
+	s.failed = true
+	for i, step := range s.steps {
+		if step.reply != nil {
+			err := s.conn.Send(step.reply.Clone())
+			if err != nil {
+				s.t.Errorf("imsgtest: step %d: failed to send reply of type %d: %s", i+1, step.reply.Type, err)
+				return
+			}
+			continue
+		}
+
+		timer := time.NewTimer(s.timeout)
+		select {
+		case im, ok := <-s.recv:
+			timer.Stop()
+			if !ok {
+				s.t.Errorf(
+					"imsgtest: step %d: connection closed while expecting type %d with %s (%d steps remaining)",
+					i+1,
+					step.typ,
+					step.desc,
+					len(s.steps)-i,
+				)
+				return
+			}
+			if im.Type != step.typ || !step.match(im.Data) {
+				s.t.Errorf("imsgtest: step %d: %s", i+1, step.mismatch(im))
+				return
+			}
+		case <-timer.C:
+			s.t.Errorf(
+				"imsgtest: step %d: nothing received within %s while expecting type %d with %s",
+				i+1,
+				s.timeout,
+				step.typ,
+				step.desc,
+			)
+			return
+		}
+	}
+	s.failed = false
+}
+
+// mismatch describes how im fails to meet the step's expectation.
+func (step *scriptStep) mismatch(im *imsg.IMsg) string {
+	got := fmt.Sprintf("got type %d (peer %d, pid %d) with %d bytes of data", im.Type, im.PeerID, im.PID, len(im.Data))
+	if step.data == nil || im.Type != step.typ {
+		return fmt.Sprintf("expected type %d with %s, %s:\n%s", step.typ, step.desc, got, hex.Dump(im.Data))
+	}
+
+	return fmt.Sprintf(
+		"expected type %d with %d bytes of data:\n%s%s:\n%s",
+		step.typ,
+		len(step.data),
+		hex.Dump(step.data),
+		got,
+		hex.Dump(im.Data),
+	)
+}
+
+// Wait waits for the Script to play out, failing the test if any imsgs have
+// arrived beyond its last expectation. It's called when the test ends, and
+// calling it more than once is harmless.
+func (s *Script) Wait() {
+	<-s.done
+	if s.failed {
+		// The failed step has already been reported.
+		return
+	}
+
+	s.once.Do(func() {
+		for {
+			select {
+			case im, ok := <-s.recv:
+				if !ok {
+					return
+				}
+				s.t.Errorf("imsgtest: unexpected imsg once the script was complete: type %d with %d bytes of data", im.Type, len(im.Data))
+			default:
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsgtest
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	imsg "github.com/schultz-is/go-imsg"
+)
+
+// A fakeT collects the failures reported by a Script, along with its cleanup
+// functions, so that failures can be checked without failing the real test.
+type fakeT struct {
+	testing.TB
+
+	mu       sync.Mutex
+	errs     []string
+	cleanups []func()
+}
+
+func (t *fakeT) Errorf(format string, args ...any) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.errs = append(t.errs, fmt.Sprintf(format, args...))
+}
+
+func (t *fakeT) Cleanup(f func()) {
+	t.cleanups = append(t.cleanups, f)
+}
+
+// end runs the cleanup functions, as at the end of a test, and returns the
+// failures reported.
+func (t *fakeT) end() []string {
+	for i := len(t.cleanups) - 1; i >= 0; i-- {
+		t.cleanups[i]()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.errs
+}
+
+// runScript runs a script against one end of a Pipe, passing the other end to
+// component, and returns the failures reported.
+func runScript(t *testing.T, build func(*Script), component func(c *imsg.Conn)) []string {
+	ft := &fakeT{TB: t}
+	a, b := Pipe()
+	defer a.Close()
+
+	s := NewScript(ft).SetTimeout(50 * time.Millisecond)
+	build(s)
+	s.Run(b)
+	component(a)
+
+	return ft.end()
+}
+
+// expectFailure checks that exactly one failure was reported, containing each
+// of the provided substrings.
+func expectFailure(t *testing.T, errs []string, substrs ...string) {
+	t.Helper()
+
+	if len(errs) != 1 {
+		t.Fatalf("expected one failure, got: %q", errs)
+	}
+	for _, substr := range substrs {
+		if !strings.Contains(errs[0], substr) {
+			t.Fatalf("failure does not mention %q: %s", substr, errs[0])
+		}
+	}
+}
+
+func TestScript(t *testing.T) {
+	hello := func(s *Script) {
+		s.ExpectData(1, []byte("hello")).
+			Reply(2, []byte("welcome")).
+			Expect(3, func(data []byte) bool { return bytes.HasPrefix(data, []byte("ready")) })
+	}
+
+	errs := runScript(t, hello, func(c *imsg.Conn) {
+		c.Send(&imsg.IMsg{Type: 1, Data: []byte("hello")})
+		im, err := c.Recv()
+		if err != nil || im.Type != 2 || string(im.Data) != "welcome" {
+			t.Fatalf("unexpected reply (%v, %v)", im, err)
+		}
+		c.Send(&imsg.IMsg{Type: 3, Data: []byte("ready: 1")})
+	})
+	if len(errs) != 0 {
+		t.Fatalf("unexpected failures: %q", errs)
+	}
+
+	// The wrong data is reported with a dump of both.
+	errs = runScript(t, hello, func(c *imsg.Conn) {
+		c.Send(&imsg.IMsg{Type: 1, Data: []byte("howdy")})
+	})
+	expectFailure(t, errs, "step 1", "expected type 1 with 5 bytes", "|hello|", "|howdy|")
+
+	// So are imsgs out of order.
+	errs = runScript(t, hello, func(c *imsg.Conn) {
+		c.Send(&imsg.IMsg{Type: 3, Data: []byte("ready")})
+	})
+	expectFailure(t, errs, "step 1", "expected type 1", "got type 3")
+
+	// And data rejected by a matcher.
+	errs = runScript(t, hello, func(c *imsg.Conn) {
+		c.Send(&imsg.IMsg{Type: 1, Data: []byte("hello")})
+		c.Recv()
+		c.Send(&imsg.IMsg{Type: 3, Data: []byte("not ready")})
+	})
+	expectFailure(t, errs, "step 3", "data accepted by the matcher")
+
+	// Imsgs beyond the end of the script are unexpected.
+	errs = runScript(t, hello, func(c *imsg.Conn) {
+		c.Send(&imsg.IMsg{Type: 1, Data: []byte("hello")})
+		c.Recv()
+		c.Send(&imsg.IMsg{Type: 3, Data: []byte("ready")})
+		c.Send(&imsg.IMsg{Type: 4})
+		time.Sleep(20 * time.Millisecond)
+	})
+	expectFailure(t, errs, "unexpected imsg", "type 4")
+}
+
+func TestScriptTimeout(t *testing.T) {
+	hello := func(s *Script) {
+		s.Expect(1, nil).Expect(2, nil)
+	}
+
+	// A component which never sends an expected imsg times out.
+	start := time.Now()
+	errs := runScript(t, hello, func(c *imsg.Conn) {
+		c.Send(&imsg.IMsg{Type: 1})
+	})
+	expectFailure(t, errs, "step 2", "nothing received within 50ms", "expecting type 2")
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatalf("script gave up before its timeout")
+	}
+
+	// Expectations left unmet when the component closes the connection fail
+	// the test without waiting for the timeout.
+	errs = runScript(t, hello, func(c *imsg.Conn) {
+		c.Close()
+	})
+	expectFailure(t, errs, "step 1", "connection closed", "2 steps remaining")
+}
@@ -0,0 +1,17 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build !unix
+
+package imsgtest
+
+import (
+	imsg "github.com/schultz-is/go-imsg"
+)
+
+// SocketPair is unsupported on this platform, and returns the
+// imsg.ErrUnsupportedPlatform reported by imsg.SocketPair.
+func SocketPair(opts ...imsg.ConnOption) (a, b *imsg.Conn, err error) {
+	return imsg.SocketPair()
+}
@@ -0,0 +1,31 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsgtest
+
+import (
+	imsg "github.com/schultz-is/go-imsg"
+)
+
+// SocketPair constructs a pair of connected Conns backed by a unix domain
+// socketpair, with the provided options applied to both and descriptor passing
+// allowed on both, so that code which passes descriptors can be tested. It's
+// only available on platforms which support SCM_RIGHTS; elsewhere it returns
+// imsg.ErrUnsupportedPlatform.
+func SocketPair(opts ...imsg.ConnOption) (a, b *imsg.Conn, err error) {
+	a, b, err = imsg.SocketPair()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, opt := range opts {
+		opt(a)
+		opt(b)
+	}
+	a.AllowFDPass(true)
+	b.AllowFDPass(true)
+
+	return a, b, nil
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsgtest
+
+import (
+	"io"
+	"os"
+	"testing"
+
+	imsg "github.com/schultz-is/go-imsg"
+)
+
+func TestSocketPair(t *testing.T) {
+	a, b, err := SocketPair()
+	if err != nil {
+		t.Fatalf("unexpected SocketPair failure: %s", err)
+	}
+	defer a.Close()
+	defer b.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %s", err)
+	}
+	defer r.Close()
+
+	im, _ := imsg.ComposeIMsgWithFile(1, 0, []byte("test"), w)
+	err = a.Send(im)
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+
+	im, err = b.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	f := im.File()
+	if f == nil {
+		t.Fatalf("received imsg has no file attached")
+	}
+
+	// The received descriptor refers to the write end of the pipe.
+	f.Write([]byte("passed"))
+	f.Close()
+	bs, err := io.ReadAll(r)
+	if err != nil || string(bs) != "passed" {
+		t.Fatalf("unexpected data through passed descriptor (%q, %v)", bs, err)
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build imsg_cgo_interop && cgo && unix
+
+package interop
+
+/*
+#cgo openbsd LDFLAGS: -lutil
+
+#include <sys/types.h>
+#include <sys/queue.h>
+#include <sys/uio.h>
+#include <errno.h>
+#include <stdint.h>
+#include <stdlib.h>
+#include <string.h>
+
+#if defined(__has_include)
+#if __has_include(<imsg.h>)
+#include <imsg.h>
+#define HAVE_IMSG 1
+#endif
+#endif
+#ifndef HAVE_IMSG
+#define HAVE_IMSG 0
+#endif
+
+// A cimsg_msg is a received imsg copied out of the C library's structures.
+struct cimsg_msg {
+	uint32_t type;
+	uint16_t len;
+	uint16_t flags;
+	uint32_t peerid;
+	uint32_t pid;
+	int fd;
+	void *data;
+	size_t datalen;
+};
+
+#if HAVE_IMSG
+static void *
+cimsg_new(int fd)
+{
+	struct imsgbuf *ib;
+
+	if ((ib = calloc(1, sizeof(*ib))) != NULL)
+		imsg_init(ib, fd);
+	return ib;
+}
+
+static int
+cimsg_compose(void *ib, uint32_t type, uint32_t peerid, uint32_t pid, int fd,
+    const void *data, size_t len)
+{
+	if (imsg_compose(ib, type, peerid, pid, fd, data, len) == -1)
+		return -1;
+	return imsg_flush(ib);
+}
+
+// cimsg_recv returns 1 once an imsg has been received, 0 at the end of the
+// stream, and -1 on failure.
+static int
+cimsg_recv(void *ib, struct cimsg_msg *m)
+{
+	struct imsg imsg;
+	ssize_t n;
+
+	for (;;) {
+		if ((n = imsg_get(ib, &imsg)) == -1)
+			return -1;
+		if (n > 0)
+			break;
+		if ((n = imsg_read(ib)) == -1 && errno != EAGAIN)
+			return -1;
+		if (n == 0)
+			return 0;
+	}
+
+	m->type = imsg.hdr.type;
+	m->len = imsg.hdr.len;
+	m->flags = imsg.hdr.flags;
+	m->peerid = imsg.hdr.peerid;
+	m->pid = imsg.hdr.pid;
+	m->fd = imsg.fd;
+	m->datalen = imsg.hdr.len - IMSG_HEADER_SIZE;
+	m->data = NULL;
+	if (m->datalen > 0) {
+		if ((m->data = malloc(m->datalen)) == NULL) {
+			imsg_free(&imsg);
+			return -1;
+		}
+		memcpy(m->data, imsg.data, m->datalen);
+	}
+	imsg_free(&imsg);
+
+	return 1;
+}
+
+static void
+cimsg_free(void *ib)
+{
+	imsg_clear(ib);
+	free(ib);
+}
+#else
+static void *cimsg_new(int fd) { return NULL; }
+static int cimsg_compose(void *ib, uint32_t type, uint32_t peerid, uint32_t pid,
+    int fd, const void *data, size_t len) { errno = ENOSYS; return -1; }
+static int cimsg_recv(void *ib, struct cimsg_msg *m) { errno = ENOSYS; return -1; }
+static void cimsg_free(void *ib) {}
+#endif
+*/
+import "C"
+
+import (
+	"io"
+	"unsafe"
+)
+
+// available reports whether the C implementation was found.
+func available() bool {
+	return C.HAVE_IMSG == 1
+}
+
+// A cBuf is an imsgbuf of the C implementation.
+type cBuf struct {
+	ib unsafe.Pointer
+}
+
+// newCBuf constructs a cBuf which reads from and writes to the descriptor fd,
+// which remains owned by the caller.
+func newCBuf(fd int) *cBuf {
+	return &cBuf{C.cimsg_new(C.int(fd))}
+}
+
+// compose sends an imsg, passing fd alongside it unless it's -1. The C
+// implementation takes ownership of the descriptor, closing it once sent.
+func (b *cBuf) compose(typ, peerID, pid uint32, fd int, data []byte) error {
+	var p unsafe.Pointer
+	if len(data) > 0 {
+		p = C.CBytes(data)
+		defer C.free(p)
+	}
+
+	rc, err := C.cimsg_compose(
+		b.ib,
+		C.uint32_t(typ),
+		C.uint32_t(peerID),
+		C.uint32_t(pid),
+		C.int(fd),
+		p,
+		C.size_t(len(data)),
+	)
+	if rc == -1 {
+		return err
+	}
+
+	return nil
+}
+
+// A cMsg is an imsg received by the C implementation.
+type cMsg struct {
+	Type   uint32
+	Len    uint16
+	Flags  uint16
+	PeerID uint32
+	PID    uint32
+	FD     int
+	Data   []byte
+}
+
+// recv receives the next imsg, returning io.EOF at the end of the stream.
+func (b *cBuf) recv() (cMsg, error) {
+	var m C.struct_cimsg_msg
+
+	rc, err := C.cimsg_recv(b.ib, &m)
+	switch rc {
+	case 0:
+		return cMsg{}, io.EOF
+	case -1:
+		return cMsg{}, err
+	}
+
+	msg := cMsg{
+		Type:   uint32(m._type),
+		Len:    uint16(m.len),
+		Flags:  uint16(m.flags),
+		PeerID: uint32(m.peerid),
+		PID:    uint32(m.pid),
+		FD:     int(m.fd),
+	}
+	if m.data != nil {
+		msg.Data = C.GoBytes(m.data, C.int(m.datalen))
+		C.free(m.data)
+	}
+
+	return msg, nil
+}
+
+// free releases the imsgbuf, closing any descriptors it holds.
+func (b *cBuf) free() {
+	C.cimsg_free(b.ib)
+}
@@ -0,0 +1,14 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+// Package interop holds differential tests which exchange imsgs between this
+// package and the C implementation from OpenBSD's libutil over a socketpair,
+// comparing the frames each produces byte for byte. The tests are only built
+// with the imsg_cgo_interop tag, and they skip unless imsg.h can be found:
+//
+//	go test -tags imsg_cgo_interop ./interop
+//
+// On systems other than OpenBSD, CGO_CFLAGS and CGO_LDFLAGS may be used to
+// point at a portable build of the library.
+package interop
@@ -0,0 +1,287 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build imsg_cgo_interop && cgo && unix
+
+package interop
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"testing"
+
+	imsg "github.com/schultz-is/go-imsg"
+	"golang.org/x/sys/unix"
+)
+
+// These are the imsgs exchanged with the C implementation.
+var interopCases = []struct {
+	name   string
+	typ    uint32
+	peerID uint32
+	pid    uint32
+	data   []byte
+	fd     bool
+}{
+	{"empty", 1, 0, 100, nil, false},
+	{"data", 2, 7, 100, []byte("hello, world"), false},
+	{"largest", 3, 0xffffffff, 0, bytes.Repeat([]byte{0xa5}, imsg.MaxSizeInBytes-imsg.HeaderSizeInBytes), false},
+	{"descriptor", 4, 1, 100, []byte("fd"), true},
+}
+
+// skipUnlessAvailable skips the test if the C implementation wasn't found.
+func skipUnlessAvailable(t *testing.T) {
+	t.Helper()
+
+	if !available() {
+		t.Skip("imsg.h not found; see the package documentation")
+	}
+}
+
+// socketPair returns the descriptors of a new socketpair, which are closed when
+// the test ends.
+func socketPair(t *testing.T) (int, int) {
+	t.Helper()
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("failed to create socketpair: %s", err)
+	}
+	t.Cleanup(func() {
+		unix.Close(fds[0])
+		unix.Close(fds[1])
+	})
+
+	return fds[0], fds[1]
+}
+
+// newConn constructs a Conn over a duplicate of fd, allowing descriptor
+// passing.
+func newConn(t *testing.T, fd int) *imsg.Conn {
+	t.Helper()
+
+	dup, err := unix.Dup(fd)
+	if err != nil {
+		t.Fatalf("failed to duplicate socket: %s", err)
+	}
+	f := os.NewFile(uintptr(dup), "interop")
+	defer f.Close()
+	nc, err := net.FileConn(f)
+	if err != nil {
+		t.Fatalf("failed to wrap socket: %s", err)
+	}
+
+	c := imsg.NewConn(nc.(*net.UnixConn))
+	c.AllowFDPass(true)
+	t.Cleanup(func() { c.Close() })
+
+	return c
+}
+
+// newPipe returns the ends of a new pipe, which are closed when the test ends.
+func newPipe(t *testing.T) (*os.File, *os.File) {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %s", err)
+	}
+	t.Cleanup(func() {
+		r.Close()
+		w.Close()
+	})
+
+	return r, w
+}
+
+// capture reads n bytes from the socket fd, returning them along with the
+// number of descriptors which accompanied them. The descriptors are closed.
+func capture(t *testing.T, fd, n int) ([]byte, int) {
+	t.Helper()
+
+	var (
+		bs   = make([]byte, n)
+		oob  = make([]byte, unix.CmsgSpace(4*4))
+		got  int
+		nfds int
+		rn   int
+		oobn int
+		err  error
+		scms []unix.SocketControlMessage
+		rfds []int
+	)
+	for got < n {
+		rn, oobn, _, _, err = unix.Recvmsg(fd, bs[got:], oob, 0)
+		if err != nil || rn == 0 {
+			t.Fatalf("failed to capture frame after %d bytes: %v", got, err)
+		}
+		got += rn
+
+		scms, err = unix.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			t.Fatalf("failed to parse control message: %s", err)
+		}
+		for _, scm := range scms {
+			rfds, err = unix.ParseUnixRights(&scm)
+			if err != nil {
+				t.Fatalf("failed to parse rights: %s", err)
+			}
+			for _, rfd := range rfds {
+				unix.Close(rfd)
+			}
+			nfds += len(rfds)
+		}
+	}
+
+	return bs, nfds
+}
+
+// expectPassed checks that f refers to the write end of the pipe whose read
+// end is r, closing f.
+func expectPassed(t *testing.T, f *os.File, r *os.File) {
+	t.Helper()
+
+	_, err := f.Write([]byte("passed"))
+	f.Close()
+	if err != nil {
+		t.Fatalf("failed to write to passed descriptor: %s", err)
+	}
+
+	bs := make([]byte, 6)
+	_, err = io.ReadFull(r, bs)
+	if err != nil || string(bs) != "passed" {
+		t.Fatalf("unexpected data through passed descriptor (%q, %v)", bs, err)
+	}
+}
+
+func TestFramesMatch(t *testing.T) {
+	skipUnlessAvailable(t)
+
+	for _, test := range interopCases {
+		t.Run(test.name, func(t *testing.T) {
+			n := imsg.HeaderSizeInBytes + len(test.data)
+
+			// The C implementation composes the imsg.
+			cfd, craw := socketPair(t)
+			cb := newCBuf(cfd)
+			defer cb.free()
+			fd := -1
+			if test.fd {
+				_, w := newPipe(t)
+				fd, _ = unix.Dup(int(w.Fd()))
+			}
+			err := cb.compose(test.typ, test.peerID, test.pid, fd, test.data)
+			if err != nil {
+				t.Fatalf("unexpected imsg_compose failure: %s", err)
+			}
+			cframe, cfds := capture(t, craw, n)
+
+			// This package composes the same imsg.
+			gfd, graw := socketPair(t)
+			c := newConn(t, gfd)
+			opts := []imsg.ComposeOption{imsg.WithPID(test.pid)}
+			if test.fd {
+				_, w := newPipe(t)
+				opts = append(opts, imsg.WithFile(w))
+			}
+			im, err := imsg.ComposeIMsg(test.typ, test.peerID, test.data, opts...)
+			if err != nil {
+				t.Fatalf("unexpected ComposeIMsg failure: %s", err)
+			}
+			err = c.Send(im)
+			if err != nil {
+				t.Fatalf("unexpected Send failure: %s", err)
+			}
+			gframe, gfds := capture(t, graw, n)
+
+			if !bytes.Equal(cframe, gframe) {
+				k := min(n, 32)
+				t.Fatalf("frames differ:\nC:  % x\nGo: % x", cframe[:k], gframe[:k])
+			}
+			if cfds != gfds {
+				t.Fatalf("descriptor counts differ (C %d != Go %d)", cfds, gfds)
+			}
+		})
+	}
+}
+
+func TestCToGo(t *testing.T) {
+	skipUnlessAvailable(t)
+
+	cfd, gfd := socketPair(t)
+	cb := newCBuf(cfd)
+	defer cb.free()
+	c := newConn(t, gfd)
+
+	for _, test := range interopCases {
+		fd := -1
+		var r *os.File
+		if test.fd {
+			var w *os.File
+			r, w = newPipe(t)
+			fd, _ = unix.Dup(int(w.Fd()))
+		}
+		err := cb.compose(test.typ, test.peerID, test.pid, fd, test.data)
+		if err != nil {
+			t.Fatalf("%s: unexpected imsg_compose failure: %s", test.name, err)
+		}
+
+		im, err := c.Recv()
+		if err != nil {
+			t.Fatalf("%s: unexpected Recv failure: %s", test.name, err)
+		}
+		if im.Type != test.typ || im.PeerID != test.peerID || im.PID != test.pid || !bytes.Equal(im.Data, test.data) {
+			t.Fatalf("%s: received imsg does not match: %v", test.name, im)
+		}
+		if test.fd != (im.File() != nil) {
+			t.Fatalf("%s: unexpected attached file: %v", test.name, im.File())
+		}
+		if test.fd {
+			expectPassed(t, im.File(), r)
+		}
+	}
+}
+
+func TestGoToC(t *testing.T) {
+	skipUnlessAvailable(t)
+
+	gfd, cfd := socketPair(t)
+	c := newConn(t, gfd)
+	cb := newCBuf(cfd)
+	defer cb.free()
+
+	for _, test := range interopCases {
+		opts := []imsg.ComposeOption{imsg.WithPID(test.pid)}
+		var r *os.File
+		if test.fd {
+			var w *os.File
+			r, w = newPipe(t)
+			opts = append(opts, imsg.WithFile(w))
+		}
+		im, _ := imsg.ComposeIMsg(test.typ, test.peerID, test.data, opts...)
+		err := c.Send(im)
+		if err != nil {
+			t.Fatalf("%s: unexpected Send failure: %s", test.name, err)
+		}
+
+		m, err := cb.recv()
+		if err != nil {
+			t.Fatalf("%s: unexpected imsg_get failure: %s", test.name, err)
+		}
+		if m.Type != test.typ || m.PeerID != test.peerID || m.PID != test.pid || !bytes.Equal(m.Data, test.data) {
+			t.Fatalf("%s: imsg received by C does not match: %+v", test.name, m)
+		}
+		if int(m.Len) != imsg.HeaderSizeInBytes+len(test.data) {
+			t.Fatalf("%s: unexpected length (%d)", test.name, m.Len)
+		}
+		if test.fd != (m.FD != -1) {
+			t.Fatalf("%s: unexpected descriptor (%d)", test.name, m.FD)
+		}
+		if test.fd {
+			expectPassed(t, os.NewFile(uintptr(m.FD), "passed"), r)
+		}
+	}
+}
@@ -0,0 +1,13 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build !(imsg_cgo_interop && cgo && unix)
+
+package interop
+
+import "testing"
+
+func TestInterop(t *testing.T) {
+	t.Skip("interop tests require cgo and the imsg_cgo_interop build tag")
+}
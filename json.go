@@ -0,0 +1,132 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// errTrailingJSON is wrapped in an ErrPayloadCodec when the ancillary data of
+// an imsg continues past the JSON document it holds.
+var errTrailingJSON = errors.New("invalid data after top-level JSON value")
+
+// This is the JSON representation of an IMsg. Fields which are required when
+// decoding are pointers so that their absence can be detected.
+type jsonIMsg struct {
+	Type     *uint32 `json:"type"`
+	TypeName string  `json:"type_name,omitempty"`
+	PeerID   uint32  `json:"peer_id"`
+	PID      uint32  `json:"pid"`
+	Data     []byte  `json:"data"`
+
+	// The header flags are reported for inspection, but are ignored when
+	// decoding so that an imsg can't be altered by way of its JSON.
+	Flags uint16 `json:"internal_flags"`
+}
+
+// MarshalJSON implements the json.Marshaler interface. Data is encoded as
+// base64, and the header flags are included under the informational
+// internal_flags key. If the type has a registered name, it's included under
+// the informational type_name key.
+func (im IMsg) MarshalJSON() ([]byte, error) {
+	name, _ := TypeName(im.Type)
+
+	return json.Marshal(jsonIMsg{
+		Type:     &im.Type,
+		TypeName: name,
+		PeerID:   im.PeerID,
+		PID:      im.PID,
+		Data:     im.Data,
+		Flags:    uint16(im.flags),
+	})
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface. The type field is
+// required and unknown fields are rejected. The type_name and internal_flags
+// fields are accepted but ignored, so the decoded imsg has no flags set.
+func (im *IMsg) UnmarshalJSON(data []byte) error {
+	var j jsonIMsg
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&j)
+	if err != nil {
+		return err
+	}
+
+	if j.Type == nil {
+		return &ErrMissingField{"type"}
+	}
+	if len(j.Data) > (MaxSizeInBytes - HeaderSizeInBytes) {
+		return &ErrDataTooLarge{
+			DataLengthInBytes: len(j.Data),
+			MaxLengthInBytes:  MaxSizeInBytes - HeaderSizeInBytes,
+			Type:              *j.Type,
+			PeerID:            j.PeerID,
+		}
+	}
+
+	im.Type = *j.Type
+	im.PeerID = j.PeerID
+	im.PID = j.PID
+	im.Data = j.Data
+	im.flags = 0
+
+	return nil
+}
+
+// ComposeJSON constructs an IMsg of the provided type whose ancillary data is v
+// encoded with encoding/json. An error from encoding/json is wrapped in an
+// ErrPayloadCodec, and if the encoded document is too large, ErrDataTooLarge
+// is returned with its encoded size. The PID field is filled in as with
+// ComposeIMsg.
+func ComposeJSON(typ, peerID uint32, v any) (*IMsg, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, &ErrPayloadCodec{"marshal", err}
+	}
+
+	return ComposeIMsg(typ, peerID, data)
+}
+
+// DataJSON decodes the ancillary data of the imsg into v with encoding/json.
+// The data must hold exactly one JSON document, optionally surrounded by
+// whitespace. An error from encoding/json is wrapped in an ErrPayloadCodec.
+func (im *IMsg) DataJSON(v any) error {
+	return decodeJSON(im.Data, v, false)
+}
+
+// DataJSONStrict decodes the ancillary data of the imsg as DataJSON does, but
+// rejects objects with fields which don't match any in v.
+func (im *IMsg) DataJSONStrict(v any) error {
+	return decodeJSON(im.Data, v, true)
+}
+
+// decodeJSON decodes the single JSON document in data into v, optionally
+// rejecting unknown fields.
+func decodeJSON(data []byte, v any, strict bool) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	err := dec.Decode(v)
+	if err != nil {
+		return &ErrPayloadCodec{"unmarshal", err}
+	}
+
+	// Anything but whitespace after the document is an error.
+	_, err = dec.Token()
+	switch err {
+	case io.EOF:
+		return nil
+	case nil:
+		err = errTrailingJSON
+	}
+
+	return &ErrPayloadCodec{"unmarshal", err}
+}
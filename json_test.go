@@ -0,0 +1,159 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestMarshalJSON(t *testing.T) {
+	im := &IMsg{Type: 42, PeerID: 7, PID: 1234, Data: []byte("test"), flags: FlagHasFD}
+
+	bs, err := json.Marshal(im)
+	if err != nil {
+		t.Fatalf("unexpected Marshal failure: %s", err)
+	}
+
+	expected := `{"type":42,"peer_id":7,"pid":1234,"data":"dGVzdA==","internal_flags":1}`
+	if string(bs) != expected {
+		t.Fatalf("marshaled JSON does not match expected output (%s != %s)", bs, expected)
+	}
+
+	var out IMsg
+	err = json.Unmarshal(bs, &out)
+	if err != nil {
+		t.Fatalf("unexpected Unmarshal failure: %s", err)
+	}
+	if out.Type != im.Type || out.PeerID != im.PeerID || out.PID != im.PID || !bytes.Equal(out.Data, im.Data) {
+		t.Fatalf("round-tripped imsg does not match (%#v != %#v)", out, im)
+	}
+	if out.flags != 0 {
+		t.Fatalf("flags were set from JSON (%#x)", out.flags)
+	}
+}
+
+func TestUnmarshalJSON(t *testing.T) {
+	doc := `{
+		"type": 3,
+		"peer_id": 4,
+		"pid": 5,
+		"data": "aGk="
+	}`
+
+	var im IMsg
+	err := json.Unmarshal([]byte(doc), &im)
+	if err != nil {
+		t.Fatalf("unexpected Unmarshal failure: %s", err)
+	}
+	if im.Type != 3 || im.PeerID != 4 || im.PID != 5 || !bytes.Equal(im.Data, []byte("hi")) {
+		t.Fatalf("decoded imsg does not match expected value (%#v)", im)
+	}
+
+	var emf *ErrMissingField
+	err = json.Unmarshal([]byte(`{"peer_id": 4}`), &im)
+	if !errors.As(err, &emf) || emf.Field != "type" {
+		t.Fatalf("expected ErrMissingField, got: %v", err)
+	}
+
+	err = json.Unmarshal([]byte(`{"type": 1, "len": 16}`), &im)
+	if err == nil || !strings.Contains(err.Error(), "unknown field") {
+		t.Fatalf("expected unknown field error, got: %v", err)
+	}
+
+	var edtl *ErrDataTooLarge
+	big, _ := json.Marshal(IMsg{Type: 1, Data: make([]byte, MaxSizeInBytes)})
+	err = json.Unmarshal(big, &im)
+	if !errors.As(err, &edtl) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+}
+
+func TestComposeJSON(t *testing.T) {
+	type doc struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+
+	im, err := ComposeJSON(42, 7, doc{"test", 3})
+	if err != nil {
+		t.Fatalf("unexpected ComposeJSON failure: %s", err)
+	}
+	if im.Type != 42 || im.PeerID != 7 || string(im.Data) != `{"name":"test","count":3}` {
+		t.Fatalf("unexpected ComposeJSON result: %v", im)
+	}
+
+	var out doc
+	err = im.DataJSON(&out)
+	if err != nil || out != (doc{"test", 3}) {
+		t.Fatalf("unexpected DataJSON result (%v, %v)", out, err)
+	}
+
+	// The encoded size is reported for an oversized document.
+	big := strings.Repeat("a", MaxSizeInBytes)
+	_, err = ComposeJSON(42, 7, big)
+	var tooLarge *ErrDataTooLarge
+	if !errors.As(err, &tooLarge) || tooLarge.DataLengthInBytes != len(big)+2 {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+
+	// Errors from encoding/json are wrapped.
+	_, err = ComposeJSON(42, 7, make(chan int))
+	var codecErr *ErrPayloadCodec
+	var typeErr *json.UnsupportedTypeError
+	if !errors.As(err, &codecErr) || codecErr.Op != "marshal" || !errors.As(err, &typeErr) {
+		t.Fatalf("expected ErrPayloadCodec, got: %v", err)
+	}
+}
+
+func TestDataJSON(t *testing.T) {
+	type doc struct {
+		Name string `json:"name"`
+	}
+
+	tests := []struct {
+		data   string
+		strict bool
+		ok     bool
+	}{
+		{` {"name":"test"} `, false, true},
+		{`{"name":"test","extra":1}`, false, true},
+		{`{"name":"test","extra":1}`, true, false},
+		{`{"name":"test"} garbage`, false, false},
+		{`{"name":"test"}{}`, false, false},
+		{`{"name":`, false, false},
+	}
+	for _, test := range tests {
+		im := &IMsg{Data: []byte(test.data)}
+
+		var out doc
+		var err error
+		if test.strict {
+			err = im.DataJSONStrict(&out)
+		} else {
+			err = im.DataJSON(&out)
+		}
+		if test.ok {
+			if err != nil || out.Name != "test" {
+				t.Fatalf("unexpected DataJSON result for %q (%v, %v)", test.data, out, err)
+			}
+			continue
+		}
+		var codecErr *ErrPayloadCodec
+		if !errors.As(err, &codecErr) || codecErr.Op != "unmarshal" || codecErr.Unwrap() == nil {
+			t.Fatalf("expected ErrPayloadCodec for %q, got: %v", test.data, err)
+		}
+	}
+
+	// The error from encoding/json is preserved.
+	err := (&IMsg{Data: []byte(`{"name":1}`)}).DataJSON(&doc{})
+	var typeErr *json.UnmarshalTypeError
+	if !errors.As(err, &typeErr) {
+		t.Fatalf("expected json.UnmarshalTypeError, got: %v", err)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// This is the state of a Conn's keepalive, which is set by WithKeepalive.
+type keepalive struct {
+	interval time.Duration
+	timeout  time.Duration
+	typ      uint32
+
+	lastSend atomic.Int64 // When an imsg was last sent, in Unix nanoseconds
+	lastRecv atomic.Int64 // When data was last received, in Unix nanoseconds
+	sending  atomic.Bool  // Set while a heartbeat is being sent
+
+	err     atomic.Pointer[error] // Set if the Conn was closed for unresponsiveness
+	closing atomic.Bool           // Set once the background goroutine closes the Conn
+	once    sync.Once
+	stop    chan struct{} // Closed by Close
+	done    chan struct{} // Closed once the background goroutine has exited
+}
+
+// WithKeepalive causes the Conn to send a heartbeat imsg of the provided type
+// whenever nothing has been sent for the interval, and to absorb heartbeats of
+// that type from the peer, which are never returned by Recv. If nothing at all
+// is received from the peer for the timeout, the Conn is closed, and Recv
+// returns ErrPeerUnresponsive. This detects a peer which has wedged without
+// closing its end of the connection, as long as the peer either sends its own
+// heartbeats or echoes those it receives. Since heartbeats are only seen as
+// they're received, the Conn must be read from continuously, such as by Serve.
+// The heartbeats are sent by a background goroutine, which Close waits for.
+func WithKeepalive(interval, timeout time.Duration, typ uint32) ConnOption {
+	return func(c *Conn) {
+		c.ka = &keepalive{
+			interval: interval,
+			timeout:  timeout,
+			typ:      typ,
+			stop:     make(chan struct{}),
+			done:     make(chan struct{}),
+		}
+	}
+}
+
+// startKeepalive starts the background goroutine which sends heartbeats and
+// watches for an unresponsive peer.
+func (c *Conn) startKeepalive() {
+	now := time.Now().UnixNano()
+	c.ka.lastSend.Store(now)
+	c.ka.lastRecv.Store(now)
+
+	tick := c.ka.interval
+	if c.ka.timeout < tick {
+		tick = c.ka.timeout
+	}
+
+	go func() {
+		defer close(c.ka.done)
+
+		ticker := time.NewTicker(tick)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-c.ka.stop:
+				return
+			case <-ticker.C:
+			}
+
+			now := time.Now()
+			if now.Sub(time.Unix(0, c.ka.lastRecv.Load())) >= c.ka.timeout {
+				var err error = &ErrPeerUnresponsive{c.ka.timeout}
+				c.ka.err.Store(&err)
+				c.fail(err)
+				if c.debugEnabled() {
+					c.logDebug("imsg peer unresponsive")
+				}
+				c.ka.closing.Store(true)
+				c.Close()
+				return
+			}
+			if now.Sub(time.Unix(0, c.ka.lastSend.Load())) >= c.ka.interval {
+				c.sendHeartbeat()
+			}
+		}
+	}()
+}
+
+// sendHeartbeat sends a heartbeat imsg in the background, giving up after the
+// keepalive interval where the connection's writes can be interrupted. Either
+// way, a peer which has stopped reading doesn't stall the keepalive, and at
+// most one heartbeat is in flight at a time.
+func (c *Conn) sendHeartbeat() {
+	if !c.ka.sending.CompareAndSwap(false, true) {
+		return
+	}
+
+	go func() {
+		defer c.ka.sending.Store(false)
+
+		ctx, cancel := context.WithTimeout(context.Background(), c.ka.interval)
+		defer cancel()
+
+		c.SendContext(ctx, &IMsg{Type: c.ka.typ})
+	}()
+}
+
+// stopKeepalive stops the background goroutine, if any, and waits for it to
+// exit, unless it's the goroutine closing the Conn.
+func (c *Conn) stopKeepalive() {
+	if c.ka == nil {
+		return
+	}
+
+	c.ka.once.Do(func() { close(c.ka.stop) })
+	if !c.ka.closing.Load() {
+		<-c.ka.done
+	}
+}
+
+// keepaliveErr returns ErrPeerUnresponsive if the Conn was closed because the
+// peer was unresponsive, and nil otherwise.
+func (c *Conn) keepaliveErr() error {
+	if c.ka == nil {
+		return nil
+	}
+	errp := c.ka.err.Load()
+	if errp == nil {
+		return nil
+	}
+
+	return *errp
+}
+
+// isHeartbeat reports whether a received imsg is a heartbeat to be absorbed.
+func (c *Conn) isHeartbeat(im *IMsg) bool {
+	return c.ka != nil && im.Type == c.ka.typ
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testTypeHeartbeat = 99
+
+func TestConnKeepalive(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	a = rewrapTestConn(t, a, WithKeepalive(10*time.Millisecond, 100*time.Millisecond, testTypeHeartbeat))
+
+	// The peer echoes heartbeats until told to stop, and then goes quiet
+	// without closing the connection.
+	var (
+		echoing    atomic.Bool
+		heartbeats atomic.Int32
+	)
+	echoing.Store(true)
+	go func() {
+		for {
+			im, err := b.Recv()
+			if err != nil {
+				return
+			}
+			if im.Type == testTypeHeartbeat {
+				heartbeats.Add(1)
+				if echoing.Load() {
+					b.Send(im)
+				}
+			}
+		}
+	}()
+
+	type result struct {
+		im  *IMsg
+		err error
+	}
+	results := make(chan result, 1)
+	go func() {
+		for {
+			im, err := a.Recv()
+			results <- result{im, err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	// Heartbeats keep the connection alive well beyond the timeout, and are
+	// never returned by Recv.
+	time.Sleep(300 * time.Millisecond)
+	if heartbeats.Load() == 0 {
+		t.Fatalf("no heartbeats were sent")
+	}
+	err := b.Send(&IMsg{Type: 1})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	r := <-results
+	if r.err != nil || r.im.Type != 1 {
+		t.Fatalf("unexpected Recv result (%v, %v)", r.im, r.err)
+	}
+
+	echoing.Store(false)
+	var epu *ErrPeerUnresponsive
+	select {
+	case r = <-results:
+		if !errors.As(r.err, &epu) || epu.Timeout != 100*time.Millisecond {
+			t.Fatalf("expected ErrPeerUnresponsive, got: %v, %v", r.im, r.err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("unresponsive peer was not detected")
+	}
+
+	select {
+	case <-a.ka.done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("keepalive goroutine did not exit")
+	}
+	_, err = a.Recv()
+	if !errors.As(err, &epu) {
+		t.Fatalf("expected ErrPeerUnresponsive from subsequent Recv, got: %v", err)
+	}
+}
+
+func TestConnKeepaliveClose(t *testing.T) {
+	a, _ := newTestSocketPair(t)
+	a = rewrapTestConn(t, a, WithKeepalive(time.Hour, time.Hour, testTypeHeartbeat))
+
+	err := a.Close()
+	if err != nil {
+		t.Fatalf("unexpected Close failure: %s", err)
+	}
+	select {
+	case <-a.ka.done:
+	default:
+		t.Fatalf("keepalive goroutine had not exited when Close returned")
+	}
+	if err := a.keepaliveErr(); err != nil {
+		t.Fatalf("unexpected keepalive error after Close: %s", err)
+	}
+}
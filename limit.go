@@ -0,0 +1,53 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+)
+
+// A Limiter paces the imsgs sent by a Conn. WaitN blocks until n units may be
+// consumed or the context is done. It's satisfied by the Limiter of
+// golang.org/x/time/rate, which refuses waits larger than its burst size.
+type Limiter interface {
+	WaitN(ctx context.Context, n int) error
+}
+
+// A LimitUnit determines what a Limiter provided to WithSendLimiter counts.
+type LimitUnit int
+
+const (
+	// LimitMessages consumes one unit per imsg.
+	LimitMessages LimitUnit = iota
+	// LimitBytes consumes one unit per byte of each imsg, header included.
+	LimitBytes
+)
+
+// WithSendLimiter paces the imsgs sent by the Conn with the provided Limiter,
+// counting either imsgs or bytes. Send, Composev, and Broadcast block until the
+// Limiter allows each imsg; SendContext additionally gives up when its context
+// is done. Imsgs which have already been queued are written without further
+// delay.
+func WithSendLimiter(l Limiter, unit LimitUnit) ConnOption {
+	return func(c *Conn) {
+		c.limiter = l
+		c.limitUnit = unit
+	}
+}
+
+// wait blocks until the send limiter, if any, allows an imsg of size bytes to
+// be sent.
+func (c *Conn) wait(ctx context.Context, size int) error {
+	if c.limiter == nil {
+		return nil
+	}
+
+	n := 1
+	if c.limitUnit == LimitBytes {
+		n = size
+	}
+
+	return c.limiter.WaitN(ctx, n)
+}
@@ -0,0 +1,160 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+// This is a Limiter which records each wait and can be made to block until
+// the context is done.
+type fakeLimiter struct {
+	mu    sync.Mutex
+	waits []int
+	block bool
+}
+
+func (l *fakeLimiter) WaitN(ctx context.Context, n int) error {
+	l.mu.Lock()
+	l.waits = append(l.waits, n)
+	block := l.block
+	l.mu.Unlock()
+
+	if block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+// This is a Limiter which allows one unit per interval.
+type intervalLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func (l *intervalLimiter) WaitN(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(time.Duration(n) * l.interval)
+	l.mu.Unlock()
+
+	select {
+	case <-time.After(time.Until(at)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// newLimitedTestConn constructs a Conn with the provided options along with
+// its peer.
+func newLimitedTestConn(t *testing.T, opts ...ConnOption) (*Conn, *Conn) {
+	t.Helper()
+
+	a, b := newTestSocketPair(t)
+	return rewrapTestConn(t, a, opts...), b
+}
+
+func TestConnSendLimiter(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		unit     LimitUnit
+		expected []int
+	}{
+		{"messages", LimitMessages, []int{1, 1, 1}},
+		{"bytes", LimitBytes, []int{20, 16, 20}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			l := &fakeLimiter{}
+			a, b := newLimitedTestConn(t, WithSendLimiter(l, tt.unit))
+
+			err := a.Send(&IMsg{Type: 1, Data: []byte("test")})
+			if err != nil {
+				t.Fatalf("unexpected Send failure: %s", err)
+			}
+			err = a.SendContext(context.Background(), &IMsg{Type: 2})
+			if err != nil {
+				t.Fatalf("unexpected SendContext failure: %s", err)
+			}
+			err = a.Composev(3, 0, []byte("te"), []byte("st"))
+			if err != nil {
+				t.Fatalf("unexpected Composev failure: %s", err)
+			}
+
+			if len(l.waits) != len(tt.expected) {
+				t.Fatalf("unexpected waits (%v != %v)", l.waits, tt.expected)
+			}
+			for i := range l.waits {
+				if l.waits[i] != tt.expected[i] {
+					t.Fatalf("unexpected waits (%v != %v)", l.waits, tt.expected)
+				}
+			}
+			for i := 0; i < 3; i++ {
+				_, err := b.Recv()
+				if err != nil {
+					t.Fatalf("unexpected Recv failure: %s", err)
+				}
+			}
+		})
+	}
+}
+
+func TestConnSendContextCancel(t *testing.T) {
+	l := &fakeLimiter{block: true}
+	a, b := newLimitedTestConn(t, WithSendLimiter(l, LimitMessages))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := a.SendContext(ctx, &IMsg{Type: 1})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got: %v", err)
+	}
+
+	// Nothing was sent.
+	l.block = false
+	a.Send(&IMsg{Type: 2})
+	im, err := b.Recv()
+	if err != nil || im.Type != 2 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+}
+
+func TestConnSendLimiterTiming(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping timing test in short mode")
+	}
+
+	l := &intervalLimiter{interval: 10 * time.Millisecond}
+	a, b := newLimitedTestConn(t, WithSendLimiter(l, LimitMessages))
+	go func() {
+		for {
+			if _, err := b.Recv(); err != nil {
+				return
+			}
+		}
+	}()
+
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		err := a.Send(&IMsg{Type: 1})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("sends were not paced (%s elapsed)", elapsed)
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+	"log/slog"
+)
+
+// These are the attribute keys used in records logged by a Conn.
+const (
+	logKeyType    = "type"
+	logKeyPeerID  = "peer_id"
+	logKeyPID     = "pid"
+	logKeyLen     = "len"
+	logKeyFD      = "fd"
+	logKeyPending = "pending"
+	logKeyErr     = "err"
+)
+
+// WithLogger causes the Conn to log debug-level records to the provided logger
+// when it's opened and closed, for each imsg sent and received, when a send
+// stalls, and when received data can't be decoded. Records describe imsgs by
+// their header fields and never include their ancillary data. Nothing is
+// logged, and no work is done to build records, unless the logger is enabled
+// at the debug level.
+func WithLogger(l *slog.Logger) ConnOption {
+	return func(c *Conn) {
+		c.logger = l
+	}
+}
+
+// debugEnabled reports whether the Conn has a logger enabled at the debug
+// level.
+func (c *Conn) debugEnabled() bool {
+	return c.logger != nil && c.logger.Enabled(context.Background(), slog.LevelDebug)
+}
+
+// logDebug logs a debug-level record. Callers check debugEnabled first so that
+// the attributes aren't built needlessly.
+func (c *Conn) logDebug(msg string, attrs ...slog.Attr) {
+	c.logger.LogAttrs(context.Background(), slog.LevelDebug, msg, attrs...)
+}
+
+// logIMsg logs a debug-level record describing an imsg. Since an attached
+// file is detached once it's sent, whether the imsg carried a descriptor is
+// provided separately.
+func (c *Conn) logIMsg(msg string, im *IMsg, hasFD bool) {
+	c.logDebug(
+		msg,
+		slog.Uint64(logKeyType, uint64(im.Type)),
+		slog.Uint64(logKeyPeerID, uint64(im.PeerID)),
+		slog.Uint64(logKeyPID, uint64(im.PID)),
+		slog.Int(logKeyLen, im.Len()),
+		slog.Bool(logKeyFD, hasFD),
+	)
+}
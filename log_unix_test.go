@@ -0,0 +1,131 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// This is an slog.Handler which records each record as a message followed by
+// its sorted attribute keys and values.
+type recordingHandler struct {
+	level slog.Level
+
+	mu      sync.Mutex
+	records []string
+}
+
+func (h *recordingHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level
+}
+
+func (h *recordingHandler) Handle(_ context.Context, r slog.Record) error {
+	var attrs []string
+	r.Attrs(func(a slog.Attr) bool {
+		attrs = append(attrs, a.String())
+		return true
+	})
+	sort.Strings(attrs)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.records = append(h.records, strings.TrimSpace(r.Message+" "+strings.Join(attrs, " ")))
+
+	return nil
+}
+
+func (h *recordingHandler) WithAttrs([]slog.Attr) slog.Handler { return h }
+func (h *recordingHandler) WithGroup(string) slog.Handler      { return h }
+
+func TestConnLogger(t *testing.T) {
+	h := &recordingHandler{level: slog.LevelDebug}
+
+	a, b, err := SocketPair()
+	if err != nil {
+		t.Fatalf("failed to create socketpair: %s", err)
+	}
+	defer b.Close()
+	a = rewrapTestConn(t, a, WithLogger(slog.New(h)))
+
+	err = a.Send(&IMsg{Type: 1, PeerID: 2, PID: 3, Data: []byte("secret")})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	err = b.Send(&IMsg{Type: 4, PeerID: 5, PID: 6})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	_, err = a.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	b.conn.Write(make([]byte, HeaderSizeInBytes))
+	_, err = a.Recv()
+	if err == nil {
+		t.Fatalf("expected Recv failure for invalid frame")
+	}
+	a.Close()
+
+	expected := []string{
+		"imsg connection opened",
+		"imsg sent fd=false len=22 peer_id=2 pid=3 type=1",
+		"imsg received fd=false len=16 peer_id=5 pid=6 type=4",
+		"imsg decode failed err=" + (&ErrLengthOutOfBounds{0, HeaderSizeInBytes, MaxSizeInBytes}).Error(),
+		"imsg connection closed",
+	}
+	if fmt.Sprint(h.records) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected log records:\n%s\nexpected:\n%s", strings.Join(h.records, "\n"), strings.Join(expected, "\n"))
+	}
+	for _, r := range h.records {
+		if strings.Contains(r, "secret") {
+			t.Fatalf("log record includes ancillary data (%q)", r)
+		}
+	}
+}
+
+func TestConnLoggerDisabled(t *testing.T) {
+	h := &recordingHandler{level: slog.LevelInfo}
+
+	a, b, err := SocketPair()
+	if err != nil {
+		t.Fatalf("failed to create socketpair: %s", err)
+	}
+	defer b.Close()
+	a = rewrapTestConn(t, a, WithLogger(slog.New(h)))
+	defer a.Close()
+
+	im := &IMsg{Type: 1}
+	allocs := testing.AllocsPerRun(100, func() {
+		a.Send(im)
+		b.Recv()
+	})
+
+	// Compare against a Conn with no logger at all.
+	c, d, err := SocketPair()
+	if err != nil {
+		t.Fatalf("failed to create socketpair: %s", err)
+	}
+	defer c.Close()
+	defer d.Close()
+	baseline := testing.AllocsPerRun(100, func() {
+		c.Send(im)
+		d.Recv()
+	})
+
+	if allocs != baseline {
+		t.Fatalf("disabled logger added allocations (%.0f != %.0f)", allocs, baseline)
+	}
+	if len(h.records) != 0 {
+		t.Fatalf("disabled logger received records (%q)", h.records)
+	}
+}
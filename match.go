@@ -0,0 +1,129 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrRecvConflict is returned when RecvMatching is used on a Conn at the same
+// time as Serve or Router.Run.
+var ErrRecvConflict = errors.New("imsg: RecvMatching can't be used while the Conn is being served")
+
+// This is the most imsgs which RecvMatching leaves awaiting Recv.
+const maxMatchBacklog = 1024
+
+// RecvMatching receives imsgs until one satisfies match, which it returns. Imsgs
+// which don't match aren't lost: they're held, in the order they arrived, for
+// subsequent calls to Recv, as are any imsgs already held. If the context is
+// done first, the context's error is returned. Once 1024 imsgs are held,
+// RecvMatching gives up with ErrBacklogFull rather than reading more, unless a
+// limit is set with WithRecvQueueLimit, in which case it waits for Recv to
+// make room. The match function is called while the Conn is reading, so it
+// must not itself read from the Conn.
+//
+// RecvMatching can't be used while Serve or Router.Run is running on the Conn,
+// since the imsgs it holds would never be dispatched; ErrRecvConflict is
+// returned by whichever is called second.
+func (c *Conn) RecvMatching(ctx context.Context, match func(*IMsg) bool) (*IMsg, error) {
+	if !c.enterRecvMode(-1) {
+		return nil, ErrRecvConflict
+	}
+	defer c.recvMode.Add(1)
+
+	return c.awaitMatch(ctx, match, maxMatchBacklog)
+}
+
+// awaitMatch receives imsgs until one satisfies match, holding the rest for
+// Recv. If limit is positive and no limit is set with WithRecvQueueLimit,
+// ErrBacklogFull is returned once that many imsgs are held. Replies awaited by
+// Call are delivered along the way.
+func (c *Conn) awaitMatch(ctx context.Context, match func(*IMsg) bool, limit int) (*IMsg, error) {
+	for {
+		select {
+		case c.rsem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		im, space, err := c.recvMatch(ctx, match, limit)
+		<-c.rsem
+		if space == nil {
+			return im, err
+		}
+
+		// Whoever reads next makes room.
+		select {
+		case <-space:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// recvMatch does the work of awaitMatch, unless the backlog has no room, in
+// which case it returns a channel which is closed once it may. The caller must
+// hold rsem.
+func (c *Conn) recvMatch(
+	ctx context.Context,
+	match func(*IMsg) bool,
+	limit int,
+) (*IMsg, <-chan struct{}, error) {
+	defer c.interruptOnDone(ctx)()
+
+	c.rmu.Lock()
+	defer c.rmu.Unlock()
+
+	if im := c.takeUnreadMatching(match); im != nil {
+		return im, nil, nil
+	}
+	for i, im := range c.backlog {
+		if match(im) {
+			return c.takeBacklog(i), nil, nil
+		}
+	}
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, nil, err
+		}
+		if space := c.backlogSpace(); space != nil {
+			return nil, space, nil
+		}
+		if (c.rqueue == nil || !c.rqueue.limited) && limit > 0 && len(c.backlog) >= limit {
+			return nil, nil, &ErrBacklogFull{limit}
+		}
+
+		im, err := c.recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, nil, ctx.Err()
+			}
+			return nil, nil, err
+		}
+		if c.deliver(im) {
+			continue
+		}
+		if match(im) {
+			return im, nil, nil
+		}
+		c.pushBacklog(im)
+	}
+}
+
+// enterRecvMode records that Serve, for a delta of 1, or RecvMatching, for a
+// delta of -1, is running, unless the other already is, in which case it
+// returns false. Leaving is a matter of subtracting delta from recvMode.
+func (c *Conn) enterRecvMode(delta int32) bool {
+	for {
+		n := c.recvMode.Load()
+		if n*delta < 0 {
+			return false
+		}
+		if c.recvMode.CompareAndSwap(n, n+delta) {
+			return true
+		}
+	}
+}
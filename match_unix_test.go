@@ -0,0 +1,145 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestConnRecvMatching(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	// Three unrelated imsgs precede the match.
+	for typ := uint32(1); typ <= 4; typ++ {
+		err := a.Send(&IMsg{Type: typ})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+	isFour := func(im *IMsg) bool { return im.Type == 4 }
+	im, err := b.RecvMatching(context.Background(), isFour)
+	if err != nil || im.Type != 4 {
+		t.Fatalf("unexpected RecvMatching result (%v, %v)", im, err)
+	}
+
+	// Held imsgs are searched before reading more.
+	isTwo := func(im *IMsg) bool { return im.Type == 2 }
+	im, err = b.RecvMatching(context.Background(), isTwo)
+	if err != nil || im.Type != 2 {
+		t.Fatalf("unexpected RecvMatching result (%v, %v)", im, err)
+	}
+
+	// The rest are still delivered, in order.
+	for _, typ := range []uint32{1, 3} {
+		im, err := b.Recv()
+		if err != nil || im.Type != typ {
+			t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+		}
+	}
+}
+
+func TestConnRecvMatchingCancel(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	err := a.Send(&IMsg{Type: 1})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	never := func(im *IMsg) bool { return false }
+	_, err = b.RecvMatching(ctx, never)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got: %v", err)
+	}
+
+	// The unmatched imsg is still delivered.
+	im, err := b.Recv()
+	if err != nil || im.Type != 1 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+}
+
+func TestConnRecvMatchingBacklogFull(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	go func() {
+		for i := 0; i <= maxMatchBacklog; i++ {
+			if a.Send(&IMsg{Type: uint32(i)}) != nil {
+				return
+			}
+		}
+	}()
+	never := func(im *IMsg) bool { return false }
+	_, err := b.RecvMatching(context.Background(), never)
+	var full *ErrBacklogFull
+	if !errors.As(err, &full) || full.Limit != maxMatchBacklog {
+		t.Fatalf("expected ErrBacklogFull, got: %v", err)
+	}
+	for i := 0; i <= maxMatchBacklog; i++ {
+		im, err := b.Recv()
+		if err != nil || im.Type != uint32(i) {
+			t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+		}
+	}
+}
+
+func TestConnRecvMatchingServe(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	m := NewMux()
+	served := make(chan struct{}, 1)
+	m.HandleDefault(func(im *IMsg) error {
+		served <- struct{}{}
+		return nil
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- Serve(ctx, b, m) }()
+
+	// Once Serve is dispatching, RecvMatching refuses to run.
+	err := a.Send(&IMsg{Type: 1})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	<-served
+	match := func(im *IMsg) bool { return true }
+	_, err = b.RecvMatching(context.Background(), match)
+	if err != ErrRecvConflict {
+		t.Fatalf("expected ErrRecvConflict, got: %v", err)
+	}
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+
+	// Likewise Serve while RecvMatching is waiting.
+	ctx, cancel = context.WithCancel(context.Background())
+	go func() {
+		_, err := b.RecvMatching(ctx, match)
+		errc <- err
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for b.recvMode.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	err = Serve(context.Background(), b, m)
+	if err != ErrRecvConflict {
+		t.Fatalf("expected ErrRecvConflict, got: %v", err)
+	}
+	err = NewRouter().Run(context.Background(), b)
+	if err != ErrRecvConflict {
+		t.Fatalf("expected ErrRecvConflict, got: %v", err)
+	}
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+}
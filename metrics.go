@@ -0,0 +1,68 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+// A MetricsHook is notified of the activity of a Conn or Buffer as it happens,
+// which allows it to be fed into an external metrics system. Its methods are
+// called synchronously on the send and receive paths, possibly while internal
+// locks are held, so they must be fast and must not call back into the Conn or
+// Buffer.
+type MetricsHook interface {
+	// OnSend is called once an imsg has been completely written, with its
+	// size in bytes.
+	OnSend(typ uint32, bytes int)
+	// OnRecv is called once an imsg has been decoded, with its size in bytes.
+	OnRecv(typ uint32, bytes int)
+	// OnError is called when reading, writing, or decoding fails. The stage is
+	// "read", "write", or "decode".
+	OnError(stage string, err error)
+	// OnQueueDepth is called with the number of imsgs waiting to be written
+	// each time it changes.
+	OnQueueDepth(n int)
+}
+
+// NopMetricsHook is a MetricsHook which does nothing. It's used when no other
+// MetricsHook is provided.
+type NopMetricsHook struct{}
+
+// OnSend implements the MetricsHook interface.
+func (NopMetricsHook) OnSend(uint32, int) {}
+
+// OnRecv implements the MetricsHook interface.
+func (NopMetricsHook) OnRecv(uint32, int) {}
+
+// OnError implements the MetricsHook interface.
+func (NopMetricsHook) OnError(string, error) {}
+
+// OnQueueDepth implements the MetricsHook interface.
+func (NopMetricsHook) OnQueueDepth(int) {}
+
+// WithMetricsHook causes the Conn to notify the provided MetricsHook of its
+// activity. A nil MetricsHook is replaced by NopMetricsHook.
+func WithMetricsHook(h MetricsHook) ConnOption {
+	return func(c *Conn) {
+		c.setMetricsHook(h)
+	}
+}
+
+// setMetricsHook sets the MetricsHook of the Conn and its send queue.
+func (c *Conn) setMetricsHook(h MetricsHook) {
+	if h == nil {
+		h = NopMetricsHook{}
+	}
+	c.metrics = h
+	c.wq.metrics = h
+}
+
+// SetMetricsHook causes the Buffer to notify the provided MetricsHook of its
+// activity. A nil MetricsHook is replaced by NopMetricsHook. It must be called
+// before the Buffer is used.
+func (b *Buffer) SetMetricsHook(h MetricsHook) {
+	if h == nil {
+		h = NopMetricsHook{}
+	}
+	b.metrics = h
+	b.wq.metrics = h
+}
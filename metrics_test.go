@@ -0,0 +1,98 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// This is an example adapter which aggregates MetricsHook notifications the way
+// a metrics library would, keeping labeled counters and a gauge.
+type counterMetrics struct {
+	mu       sync.Mutex
+	counters map[string]int
+	depth    []int
+}
+
+func newCounterMetrics() *counterMetrics {
+	return &counterMetrics{counters: make(map[string]int)}
+}
+
+func (m *counterMetrics) add(name string, n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters[name] += n
+}
+
+func (m *counterMetrics) OnSend(typ uint32, bytes int) {
+	m.add(fmt.Sprintf("sent{type=%d}", typ), 1)
+	m.add("sent_bytes", bytes)
+}
+
+func (m *counterMetrics) OnRecv(typ uint32, bytes int) {
+	m.add(fmt.Sprintf("received{type=%d}", typ), 1)
+	m.add("received_bytes", bytes)
+}
+
+func (m *counterMetrics) OnError(stage string, err error) {
+	m.add(fmt.Sprintf("errors{stage=%s}", stage), 1)
+}
+
+func (m *counterMetrics) OnQueueDepth(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.depth = append(m.depth, n)
+}
+
+func TestBufferMetricsHook(t *testing.T) {
+	var wire bytes.Buffer
+	b := NewBuffer(&wire)
+	metrics := newCounterMetrics()
+	b.SetMetricsHook(metrics)
+
+	b.Compose(1, 0, 0, []byte("test"))
+	b.Compose(1, 0, 0, nil)
+	b.Compose(2, 0, 0, nil)
+	err := b.Flush()
+	if err != nil {
+		t.Fatalf("unexpected Flush failure: %s", err)
+	}
+
+	wire.Write(make([]byte, HeaderSizeInBytes))
+	b.Read()
+	for {
+		im, err := b.Get()
+		if im == nil || err != nil {
+			break
+		}
+	}
+
+	expected := map[string]int{
+		"sent{type=1}":         2,
+		"sent{type=2}":         1,
+		"sent_bytes":           52,
+		"received{type=1}":     2,
+		"received{type=2}":     1,
+		"received_bytes":       52,
+		"errors{stage=decode}": 1,
+	}
+	if fmt.Sprint(metrics.counters) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected counters (%v != %v)", metrics.counters, expected)
+	}
+	if fmt.Sprint(metrics.depth) != "[1 2 3 2 1 0]" {
+		t.Fatalf("unexpected queue depths (%v)", metrics.depth)
+	}
+
+	// Removing the hook falls back to the no-op.
+	b.SetMetricsHook(nil)
+	b.Compose(1, 0, 0, nil)
+	b.Flush()
+	if metrics.counters["sent{type=1}"] != 2 {
+		t.Fatalf("removed hook was notified")
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestConnMetricsHook(t *testing.T) {
+	a, b, err := SocketPair()
+	if err != nil {
+		t.Fatalf("failed to create socketpair: %s", err)
+	}
+	metrics := newCounterMetrics()
+	a = rewrapTestConn(t, a, WithMetricsHook(metrics))
+	defer a.Close()
+	defer b.Close()
+
+	err = a.Send(&IMsg{Type: 1, Data: []byte("test")})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	err = b.Send(&IMsg{Type: 2})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	_, err = a.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+
+	expected := map[string]int{
+		"sent{type=1}":     1,
+		"sent_bytes":       20,
+		"received{type=2}": 1,
+		"received_bytes":   16,
+	}
+	if fmt.Sprint(metrics.counters) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected counters (%v != %v)", metrics.counters, expected)
+	}
+	if fmt.Sprint(metrics.depth) != "[1 0]" {
+		t.Fatalf("unexpected queue depths (%v)", metrics.depth)
+	}
+}
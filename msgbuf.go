@@ -0,0 +1,609 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrWouldBlock is returned when a non-blocking descriptor can't be read from
+// or written to without blocking. Queued data is retained, and a subsequent
+// Flush resumes where the previous one left off.
+var ErrWouldBlock = errors.New("imsg: operation would block")
+
+// This is an imsg waiting to be written by a MsgBuf.
+type msgBufEntry struct {
+	bs   []byte   // Marshaled imsg, or only its header when data is set
+	data []byte   // Ancillary data borrowed from the sender, written after bs
+	file *os.File // Attached file whose descriptor has yet to be passed
+
+	wipe bool   // Whether the entry is wiped once written or discarded
+	orig []byte // Sender's data, wiped along with the entry
+
+	expires time.Time // When the entry is discarded unwritten, if set
+	prio    Priority  // Lane in which the entry is queued
+	queued  time.Time // When the entry was queued, if stampQueued is set
+
+	acct Accounting // Charged for the entry's length, if set
+}
+
+// len returns the length in bytes of the entry's imsg.
+func (e *msgBufEntry) len() int {
+	return len(e.bs) + len(e.data)
+}
+
+// unwritten returns the slices of the entry's imsg which follow the first off
+// bytes.
+func (e *msgBufEntry) unwritten(off int) [][]byte {
+	if off >= len(e.bs) {
+		return [][]byte{e.data[off-len(e.bs):]}
+	}
+	if len(e.data) == 0 {
+		return [][]byte{e.bs[off:]}
+	}
+
+	return [][]byte{e.bs[off:], e.data}
+}
+
+// A MsgBuf is a queue of imsgs waiting to be written to an io.Writer. It
+// mirrors the msgbuf of the C implementation: when the writer accepts only
+// part of an imsg, the MsgBuf remembers how much was written and resumes from
+// that point on the next Flush, keeping the stream intact. A MsgBuf is safe for
+// concurrent use.
+type MsgBuf struct {
+	w  io.Writer
+	uc fdConn // Set when w supports descriptor passing
+
+	fmu sync.Mutex // Serializes calls to Flush
+
+	maxSize atomic.Uint32    // Maximum size in bytes of a queued imsg
+	order   binary.ByteOrder // Byte order of headers as written
+
+	sendCreds atomic.Bool // Whether credentials are sent alongside each write
+
+	stampQueued bool // Whether entries record when they were queued
+	packet      bool // Whether each entry is written as a datagram of its own
+
+	mu       sync.Mutex
+	q        []msgBufEntry
+	off      int    // Bytes of the head of q which have already been written
+	pending  int    // Bytes of q which have yet to be written
+	gen      uint64 // Incremented each time q is cleared
+	inflight int    // Entries at the head of q being written by Flush
+
+	unwiped []msgBufEntry // Entries cleared while being written, to be wiped
+
+	highWater int          // Largest length q has reached
+	sent      sendCounters // Updated as imsgs are written
+	metrics   MetricsHook  // Notified as imsgs are queued and written
+
+	limitMsgs  int                // Limit on the length of q, if nonzero
+	limitLanes [numPriorities]int // Limits on the entries of each priority, if nonzero
+	limitBytes int                // Limit on pending, if nonzero
+	policy     QueuePolicy        // Applied when a limit would be exceeded
+	space      chan struct{}      // Closed when room is made in q
+	dropped    atomic.Uint64      // Entries discarded by QueueDropOldest
+	expired    atomic.Uint64      // Entries discarded once their TTL passed
+
+	acct Accounting // Charged for the length of each entry queued, if set
+}
+
+// NewMsgBuf constructs a MsgBuf which writes to the provided io.Writer. If the
+// writer is a *net.UnixConn, descriptors attached to queued imsgs are passed
+// to the peer.
+func NewMsgBuf(w io.Writer) *MsgBuf {
+	m := &MsgBuf{w: w, order: endianness, metrics: NopMetricsHook{}}
+	m.uc, _ = w.(fdConn)
+	m.maxSize.Store(MaxSizeInBytes)
+
+	return m
+}
+
+// SetMaxSize sets the maximum size in bytes of an imsg which may be queued,
+// which defaults to MaxSizeInBytes. Sizes smaller than HeaderSizeInBytes are
+// rejected.
+func (m *MsgBuf) SetMaxSize(n uint16) error {
+	err := validateMaxSize(n)
+	if err != nil {
+		return err
+	}
+
+	m.maxSize.Store(uint32(n))
+
+	return nil
+}
+
+// Enqueue marshals an imsg and queues it to be written by a subsequent call to
+// Flush. If a file is attached to the imsg, ownership of it passes to the
+// MsgBuf, which closes it once its descriptor has been passed, and the has-fd
+// flag is set in the queued header. If the queue is at the limit set with
+// SetQueueLimit, the queue's policy applies.
+func (m *MsgBuf) Enqueue(im *IMsg) error {
+	return m.EnqueueContext(context.Background(), im)
+}
+
+// EnqueueContext behaves like Enqueue, except that when waiting for room in the
+// queue under the QueueBlock policy, it gives up once the context is done and
+// returns the context's error.
+func (m *MsgBuf) EnqueueContext(ctx context.Context, im *IMsg) error {
+	return m.enqueue(ctx, im, false)
+}
+
+// enqueue queues an imsg. If borrow is set, the imsg's data is referenced by
+// the queue rather than copied, and the caller must not modify it until it has
+// been written or detached by flushBorrowed.
+func (m *MsgBuf) enqueue(ctx context.Context, im *IMsg, borrow bool) error {
+	if im.file == nil && im.flags&FlagHasFD != 0 {
+		return &ErrNoAttachment{im.Type}
+	}
+	if im.file != nil && m.uc == nil {
+		return &ErrFDPassUnsupported{im.Type}
+	}
+
+	hdrIM := *im
+	if im.file != nil {
+		hdrIM.flags |= FlagHasFD
+	}
+
+	var e msgBufEntry
+	if borrow {
+		err := hdrIM.ValidateMax(uint16(m.maxSize.Load()))
+		if err != nil {
+			return err
+		}
+
+		e.bs = make([]byte, HeaderSizeInBytes)
+		hdrIM.putHeader(e.bs)
+		e.data = im.Data
+	} else {
+		bs, err := hdrIM.marshalBinary(uint16(m.maxSize.Load()))
+		if err != nil {
+			return err
+		}
+
+		e.bs = bs
+	}
+	e.file = im.file
+	e.expires = im.expires
+	e.prio = im.prio
+	if im.wipe {
+		e.wipe = true
+		e.orig = im.Data
+	}
+
+	err := m.push(ctx, e)
+	if err != nil {
+		return err
+	}
+	im.file = nil
+
+	return nil
+}
+
+// enqueuev marshals an imsg whose ancillary data is the concatenation of the
+// provided slices and queues it, without first joining the slices.
+func (m *MsgBuf) enqueuev(typ, peerID, pid uint32, data [][]byte) error {
+	bs, err := marshalv(typ, peerID, pid, data, uint16(m.maxSize.Load()))
+	if err != nil {
+		return err
+	}
+
+	return m.push(context.Background(), msgBufEntry{bs: bs})
+}
+
+// push adds entries to the queue once the queue's limits allow all of them.
+// Either every entry is queued or none are. Each entry's header is marshaled in
+// the system's byte order, and is converted in place if the MsgBuf writes
+// another. Entries are queued behind any of the same or higher priority, as
+// described by WithPriority.
+func (m *MsgBuf) push(ctx context.Context, es ...msgBufEntry) error {
+	var size int
+	for i := range es {
+		size += es[i].len()
+		if m.order != endianness {
+			swapHeader(es[i].bs)
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	err := m.makeRoom(ctx, es, size)
+	if err != nil {
+		return err
+	}
+	err = m.charge(es)
+	if err != nil {
+		return err
+	}
+
+	var now time.Time
+	if m.stampQueued {
+		now = time.Now()
+	}
+	for i := range es {
+		es[i].queued = now
+		m.insert(es[i])
+	}
+	m.pending += size
+	if len(m.q) > m.highWater {
+		m.highWater = len(m.q)
+	}
+	m.metrics.OnQueueDepth(len(m.q))
+
+	return nil
+}
+
+// This is implemented by writers, such as a net.Conn, whose writes can be
+// interrupted by a deadline.
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
+}
+
+// Flush writes queued imsgs to the underlying writer until the queue is empty
+// or an error occurs, returning the number of imsgs which were completely
+// written. If the writer reports that it would block, ErrWouldBlock is
+// returned. Other errors from the writer are wrapped in an ErrWrite.
+func (m *MsgBuf) Flush() (int, error) {
+	return m.FlushContext(context.Background())
+}
+
+// FlushContext behaves like Flush, except that it stops once the context is
+// done and returns the context's error. If the writer supports write deadlines,
+// as a net.Conn does, a write blocked on a peer which has stopped reading is
+// interrupted; otherwise the context is only checked between writes. Whatever
+// remains, including the rest of a partially written imsg, stays queued for a
+// subsequent Flush.
+func (m *MsgBuf) FlushContext(ctx context.Context) (int, error) {
+	m.fmu.Lock()
+	defer m.fmu.Unlock()
+
+	err := ctx.Err()
+	if err != nil {
+		return 0, err
+	}
+
+	defer m.interruptOnDone(ctx)()
+
+	return m.flush(ctx, false)
+}
+
+// FlushDeadline behaves like FlushContext with a context which expires at the
+// provided time, returning context.DeadlineExceeded once it passes.
+func (m *MsgBuf) FlushDeadline(t time.Time) (int, error) {
+	ctx, cancel := context.WithDeadline(context.Background(), t)
+	defer cancel()
+
+	return m.FlushContext(ctx)
+}
+
+// TryFlush behaves like Flush, except that it never waits for the underlying
+// socket to become writable: once the socket accepts no more, or if another
+// flush is in progress, ErrWouldBlock is returned, and whatever remains stays
+// queued. TryFlush is intended for use in a poll loop, which calls it once the
+// socket is writable. If the writer isn't a unix domain socket, ErrUnsupported
+// is returned.
+func (m *MsgBuf) TryFlush() (int, error) {
+	if m.uc == nil {
+		return 0, &ErrUnsupported{"non-blocking flushes"}
+	}
+	if !m.fmu.TryLock() {
+		return 0, ErrWouldBlock
+	}
+	defer m.fmu.Unlock()
+
+	return m.flush(context.Background(), true)
+}
+
+// This is the largest number of slices gathered into a single write.
+const maxGatherBufs = 1024
+
+// gather returns the unwritten slices of the entries at the head of the queue
+// which may be written together, along with the number of entries involved. An
+// entry with an attached file is written alone, since its descriptor is passed
+// with the first byte of the write. Entries are only combined when the writer
+// supports descriptor passing, as writev is the point of combining them, and an
+// arbitrary io.Writer can't be relied upon to write a set of slices as a
+// whole. Nor are they combined in packet mode, where each write is a datagram.
+// The caller must hold mu.
+func (m *MsgBuf) gather() ([][]byte, int) {
+	bufs := m.q[0].unwritten(m.off)
+	if m.q[0].file != nil || m.uc == nil || m.packet {
+		return bufs, 1
+	}
+
+	var now time.Time
+	count := 1
+	for _, e := range m.q[1:] {
+		if e.file != nil || len(bufs)+2 > maxGatherBufs {
+			break
+		}
+		if !e.expires.IsZero() {
+			// An expired entry is left at the head of the queue for the next
+			// write to discard.
+			if now.IsZero() {
+				now = time.Now()
+			}
+			if e.expired(now) {
+				break
+			}
+		}
+		bufs = append(bufs, e.unwritten(0)...)
+		count++
+	}
+
+	return bufs, count
+}
+
+// flushBorrowed behaves like FlushContext, after which the data of any imsgs
+// queued with borrowed data which remain queued is copied, so that the senders
+// of those imsgs may modify it.
+func (m *MsgBuf) flushBorrowed(ctx context.Context) (int, error) {
+	m.fmu.Lock()
+	defer m.fmu.Unlock()
+
+	var (
+		n   int
+		err error
+	)
+	if err = ctx.Err(); err == nil {
+		stop := m.interruptOnDone(ctx)
+		n, err = m.flush(ctx, false)
+		stop()
+	}
+
+	// No write is in progress while fmu is held, so nothing refers to the
+	// borrowed data once it has been replaced.
+	m.mu.Lock()
+	for i := range m.q {
+		e := &m.q[i]
+		if e.data != nil {
+			e.bs = append(e.bs[:len(e.bs):len(e.bs)], e.data...)
+			e.data = nil
+		}
+	}
+	m.mu.Unlock()
+
+	return n, err
+}
+
+// interruptOnDone expires the write deadline of the underlying writer when ctx
+// is done, unblocking any pending write. The returned function must be called
+// once the writes are complete; it restores the deadline if it was expired.
+// A connection layered over another, such as a *tls.Conn, is never
+// interrupted, since a write which times out leaves its stream unusable; the
+// context is only checked between writes. The caller must hold fmu.
+func (m *MsgBuf) interruptOnDone(ctx context.Context) func() {
+	wd, ok := m.w.(writeDeadliner)
+	if _, layered := m.w.(interface{ NetConn() net.Conn }); layered {
+		ok = false
+	}
+	if !ok || ctx.Done() == nil {
+		return func() {}
+	}
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			wd.SetWriteDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+		if ctx.Err() != nil {
+			// Leave the writer usable for subsequent flushes.
+			wd.SetWriteDeadline(time.Time{})
+		}
+	}
+}
+
+// flush writes queued imsgs until the queue is empty, an error occurs, or the
+// context is done. If try is set, the writes never wait for the socket to become
+// writable, which requires that uc be set. The caller must hold fmu.
+func (m *MsgBuf) flush(ctx context.Context, try bool) (int, error) {
+	var drained int
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for len(m.q) > 0 {
+		if ctx.Err() != nil {
+			return drained, ctx.Err()
+		}
+		if m.dropExpired() {
+			continue
+		}
+
+		e := m.q[0]
+		gen := m.gen
+		bufs, count := m.gather()
+
+		// The queue lock is released for the duration of the write so that the
+		// queue may be inspected or cleared while the writer is blocked.
+		m.inflight = count
+		m.mu.Unlock()
+
+		var (
+			n   int
+			err error
+		)
+		if creds := m.sendCreds.Load(); try || e.file != nil || creds || m.packet {
+			n, err = writeWithFD(m.uc, bufs, e.file, creds, !try)
+		} else if len(bufs) == 1 {
+			n, err = m.w.Write(bufs[0])
+		} else {
+			// A *net.UnixConn writes all of the slices with a single writev.
+			var n64 int64
+			n64, err = (*net.Buffers)(&bufs).WriteTo(m.w)
+			n = int(n64)
+		}
+
+		m.mu.Lock()
+		m.inflight = 0
+
+		if n > 0 {
+			m.sent.bytes.Add(uint64(n))
+			if e.file != nil {
+				m.sent.fds.Add(1)
+			}
+			m.signalSpace()
+		}
+
+		if e.file != nil && (n > 0 || gen != m.gen) {
+			// The descriptor accompanies the first byte written. If the queue was
+			// cleared during the write, the descriptor is no longer needed.
+			e.file.Close()
+			e.file = nil
+			if gen == m.gen {
+				m.q[0].file = nil
+			}
+		}
+
+		if gen != m.gen {
+			// The queue was cleared during the write, so there's nothing left to
+			// account for besides the entries which were being written.
+			for i := range m.unwiped {
+				m.unwiped[i].release()
+			}
+			m.unwiped = nil
+			if err != nil {
+				return drained, &ErrWrite{err}
+			}
+			return drained, nil
+		}
+
+		m.pending -= n
+		for rem := n; rem > 0; {
+			head := m.q[0]
+			left := head.len() - m.off
+			if rem < left {
+				m.off += rem
+				break
+			}
+			rem -= left
+
+			m.discharge(&m.q[0])
+			m.q[0].release()
+			m.q[0] = msgBufEntry{}
+			m.q = m.q[1:]
+			m.off = 0
+			drained++
+			m.sent.messages.Add(1)
+			m.metrics.OnSend(m.order.Uint32(head.bs[0:4]), head.len())
+			m.metrics.OnQueueDepth(len(m.q))
+		}
+
+		if err != nil {
+			if isWouldBlock(err) {
+				return drained, ErrWouldBlock
+			}
+			if m.packet && n == 0 && isMessageTooLong(err) {
+				// The datagram was refused whole, and would be again, so the
+				// imsg is dropped rather than left to block the queue.
+				return drained, m.dropTooLarge(err)
+			}
+			if ctx.Err() != nil && errors.Is(err, os.ErrDeadlineExceeded) {
+				return drained, ctx.Err()
+			}
+			m.metrics.OnError("write", err)
+			return drained, &ErrWrite{err}
+		}
+		if n == 0 {
+			return drained, io.ErrShortWrite
+		}
+	}
+
+	return drained, nil
+}
+
+// dropTooLarge drops the imsg at the head of the queue, which was refused
+// with err for being too large for a datagram, returning ErrPacketTooLarge.
+// The caller must hold mu.
+func (m *MsgBuf) dropTooLarge(err error) error {
+	e := m.q[0]
+	if e.file != nil {
+		e.file.Close()
+	}
+	m.pending -= e.len()
+	m.discharge(&e)
+	e.release()
+	m.q[0] = msgBufEntry{}
+	m.q = m.q[1:]
+	m.metrics.OnError("write", err)
+	m.metrics.OnQueueDepth(len(m.q))
+	m.signalSpace()
+
+	return &ErrPacketTooLarge{
+		Type:          m.order.Uint32(e.bs[0:4]),
+		LengthInBytes: e.len(),
+		Err:           err,
+	}
+}
+
+// QueueLen returns the number of imsgs which have not been completely written,
+// including one which has been partially written. This is the equivalent of
+// msgbuf_queuelen.
+func (m *MsgBuf) QueueLen() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return len(m.q)
+}
+
+// PendingBytes returns the number of queued bytes which have yet to be
+// written.
+func (m *MsgBuf) PendingBytes() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.pending
+}
+
+// Clear drops all queued imsgs, closing any attached files. If an imsg has
+// been partially written, the peer will receive a truncated imsg, so Clear is
+// intended for use once the peer has gone away. This is the equivalent of
+// msgbuf_clear.
+func (m *MsgBuf) Clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i, e := range m.q {
+		m.discharge(&e)
+
+		// Entries being written by an in-progress Flush are left for Flush to
+		// wipe, and a file being passed is closed by Flush, once the write
+		// completes.
+		if i < m.inflight {
+			if e.wipe {
+				m.unwiped = append(m.unwiped, e)
+			}
+			continue
+		}
+		if e.file != nil {
+			e.file.Close()
+		}
+		e.release()
+	}
+
+	m.q = nil
+	m.off = 0
+	m.pending = 0
+	m.gen++
+	m.signalSpace()
+}
@@ -0,0 +1,219 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// This is a writer which accepts at most perCall bytes in each call to Write,
+// and at most budget bytes in total before reporting errFull.
+type throttledWriter struct {
+	bytes.Buffer
+	perCall int
+	budget  int
+}
+
+var errFull = errors.New("writer full")
+
+func (w *throttledWriter) Write(p []byte) (int, error) {
+	if w.budget == 0 {
+		return 0, errFull
+	}
+
+	n := len(p)
+	if n > w.perCall {
+		n = w.perCall
+	}
+	if n > w.budget {
+		n = w.budget
+	}
+	w.budget -= n
+
+	return w.Buffer.Write(p[:n])
+}
+
+func TestMsgBufPartialWrites(t *testing.T) {
+	w := &throttledWriter{perCall: 3, budget: 25}
+	m := NewMsgBuf(w)
+
+	var expected []byte
+	for i := 0; i < 3; i++ {
+		im := &IMsg{Type: uint32(i), Data: []byte("test")}
+		err := m.Enqueue(im)
+		if err != nil {
+			t.Fatalf("unexpected Enqueue failure: %s", err)
+		}
+
+		bs, _ := im.MarshalBinary()
+		expected = append(expected, bs...)
+	}
+
+	// The first imsg fits within the budget, but the second is cut off partway
+	// through.
+	n, err := m.Flush()
+	if !errors.Is(err, errFull) {
+		t.Fatalf("expected errFull, got: %v", err)
+	}
+	if n != 1 {
+		t.Fatalf("unexpected number of imsgs drained (%d != 1)", n)
+	}
+
+	// Resuming must pick up exactly where the previous Flush stopped.
+	w.budget = len(expected)
+	n, err = m.Flush()
+	if err != nil {
+		t.Fatalf("unexpected Flush failure: %s", err)
+	}
+	if n != 2 {
+		t.Fatalf("unexpected number of imsgs drained (%d != 2)", n)
+	}
+	if !bytes.Equal(w.Bytes(), expected) {
+		t.Fatalf("written data does not match expected output (% x != % x)", w.Bytes(), expected)
+	}
+
+	r := bytes.NewReader(w.Bytes())
+	for i := 0; i < 3; i++ {
+		im, err := ReadIMsg(r)
+		if err != nil {
+			t.Fatalf("unexpected ReadIMsg failure: %s", err)
+		}
+		if im.Type != uint32(i) {
+			t.Fatalf("unexpected imsg read back (%#v)", im)
+		}
+	}
+}
+
+func TestMsgBufShortWriteWithoutError(t *testing.T) {
+	m := NewMsgBuf(writerFunc(func(p []byte) (int, error) { return 0, nil }))
+
+	err := m.Enqueue(&IMsg{})
+	if err != nil {
+		t.Fatalf("unexpected Enqueue failure: %s", err)
+	}
+
+	_, err = m.Flush()
+	if err != io.ErrShortWrite {
+		t.Fatalf("expected io.ErrShortWrite, got: %v", err)
+	}
+}
+
+func TestMsgBufEnqueueInvalid(t *testing.T) {
+	m := NewMsgBuf(io.Discard)
+
+	var edtl *ErrDataTooLarge
+	err := m.Enqueue(&IMsg{Data: make([]byte, MaxSizeInBytes)})
+	if !errors.As(err, &edtl) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+
+	var ena *ErrNoAttachment
+	err = m.Enqueue(&IMsg{flags: FlagHasFD})
+	if !errors.As(err, &ena) {
+		t.Fatalf("expected ErrNoAttachment, got: %v", err)
+	}
+}
+
+// This adapts a function to the io.Writer interface.
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) {
+	return f(p)
+}
+
+func TestMsgBufQueueIntrospection(t *testing.T) {
+	w := &throttledWriter{perCall: 1024, budget: 10}
+	m := NewMsgBuf(w)
+
+	if m.QueueLen() != 0 || m.PendingBytes() != 0 {
+		t.Fatalf("new MsgBuf reports queued data")
+	}
+
+	for i := 0; i < 3; i++ {
+		err := m.Enqueue(&IMsg{Type: uint32(i), Data: []byte("test")})
+		if err != nil {
+			t.Fatalf("unexpected Enqueue failure: %s", err)
+		}
+	}
+	if m.QueueLen() != 3 || m.PendingBytes() != 60 {
+		t.Fatalf("unexpected queue state (%d imsgs, %d bytes)", m.QueueLen(), m.PendingBytes())
+	}
+
+	// Partially write the head of the queue.
+	_, err := m.Flush()
+	if !errors.Is(err, errFull) {
+		t.Fatalf("expected errFull, got: %v", err)
+	}
+	if m.QueueLen() != 3 || m.PendingBytes() != 50 {
+		t.Fatalf("unexpected queue state (%d imsgs, %d bytes)", m.QueueLen(), m.PendingBytes())
+	}
+
+	m.Clear()
+	if m.QueueLen() != 0 || m.PendingBytes() != 0 {
+		t.Fatalf("cleared MsgBuf reports queued data")
+	}
+
+	// Nothing further is written once the queue is cleared.
+	w.budget = 1024
+	n, err := m.Flush()
+	if n != 0 || err != nil {
+		t.Fatalf("unexpected Flush result (%d, %v)", n, err)
+	}
+	if w.Len() != 10 {
+		t.Fatalf("data was written after Clear (%d bytes)", w.Len())
+	}
+}
+
+// This is a writer which blocks until released, then fails.
+type blockingWriter struct {
+	entered chan struct{}
+	release chan struct{}
+}
+
+func (w *blockingWriter) Write(p []byte) (int, error) {
+	w.entered <- struct{}{}
+	<-w.release
+	return 0, errFull
+}
+
+func TestMsgBufClearDuringFlush(t *testing.T) {
+	w := &blockingWriter{
+		entered: make(chan struct{}),
+		release: make(chan struct{}),
+	}
+	m := NewMsgBuf(w)
+
+	for i := 0; i < 3; i++ {
+		err := m.Enqueue(&IMsg{Type: uint32(i)})
+		if err != nil {
+			t.Fatalf("unexpected Enqueue failure: %s", err)
+		}
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := m.Flush()
+		done <- err
+	}()
+
+	// Clear the queue while Flush is blocked writing its head.
+	<-w.entered
+	if m.QueueLen() != 3 {
+		t.Fatalf("unexpected queue length during Flush (%d)", m.QueueLen())
+	}
+	m.Clear()
+	close(w.release)
+
+	err := <-done
+	if !errors.Is(err, errFull) {
+		t.Fatalf("expected errFull, got: %v", err)
+	}
+	if m.QueueLen() != 0 || m.PendingBytes() != 0 {
+		t.Fatalf("cleared MsgBuf reports queued data")
+	}
+}
@@ -0,0 +1,263 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// This is a writer backed directly by a descriptor, bypassing the runtime
+// poller so that EAGAIN is reported to the caller.
+type fdWriter int
+
+func (fd fdWriter) Write(p []byte) (int, error) {
+	n, err := unix.Write(int(fd), p)
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+func TestMsgBufWouldBlock(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("failed to create socketpair: %s", err)
+	}
+	defer unix.Close(fds[0])
+	defer unix.Close(fds[1])
+
+	err = unix.SetNonblock(fds[0], true)
+	if err != nil {
+		t.Fatalf("failed to set non-blocking mode: %s", err)
+	}
+
+	m := NewMsgBuf(fdWriter(fds[0]))
+
+	// Queue imsgs until the socket buffer is certain to fill up.
+	data := bytes.Repeat([]byte{0xaa}, 1000)
+	const count = 2000
+	for i := 0; i < count; i++ {
+		err = m.Enqueue(&IMsg{Type: uint32(i), Data: data})
+		if err != nil {
+			t.Fatalf("unexpected Enqueue failure: %s", err)
+		}
+	}
+
+	total, err := m.Flush()
+	if err != ErrWouldBlock {
+		t.Fatalf("expected ErrWouldBlock, got: %v", err)
+	}
+
+	// Alternate between draining the peer and flushing until everything has
+	// been written, then confirm every frame arrived intact.
+	var (
+		received []byte
+		buf      = make([]byte, 65536)
+	)
+	for total < count {
+		n, err := unix.Read(fds[1], buf)
+		if err != nil {
+			t.Fatalf("failed to read from peer: %s", err)
+		}
+		received = append(received, buf[:n]...)
+
+		n, err = m.Flush()
+		if err != nil && err != ErrWouldBlock {
+			t.Fatalf("unexpected Flush failure: %s", err)
+		}
+		total += n
+	}
+
+	err = unix.SetNonblock(fds[1], true)
+	if err != nil {
+		t.Fatalf("failed to set non-blocking mode: %s", err)
+	}
+	for {
+		n, err := unix.Read(fds[1], buf)
+		if err != nil {
+			break
+		}
+		received = append(received, buf[:n]...)
+	}
+
+	r := bytes.NewReader(received)
+	for i := 0; i < count; i++ {
+		im, err := ReadIMsg(r)
+		if err != nil {
+			t.Fatalf("unexpected ReadIMsg failure at imsg %d: %s", i, err)
+		}
+		if im.Type != uint32(i) || !bytes.Equal(im.Data, data) {
+			t.Fatalf("imsg %d was corrupted", i)
+		}
+	}
+	if r.Len() != 0 {
+		t.Fatalf("unexpected trailing data (%d bytes)", r.Len())
+	}
+}
+
+func TestBufferReadWouldBlock(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("failed to create socketpair: %s", err)
+	}
+	defer unix.Close(fds[0])
+	defer unix.Close(fds[1])
+
+	err = unix.SetNonblock(fds[1], true)
+	if err != nil {
+		t.Fatalf("failed to set non-blocking mode: %s", err)
+	}
+
+	b := NewBuffer(fdReadWriter(fds[1]))
+
+	err = b.Read()
+	if err != ErrWouldBlock {
+		t.Fatalf("expected ErrWouldBlock, got: %v", err)
+	}
+
+	frame, _ := IMsg{Type: 7}.MarshalBinary()
+	_, err = unix.Write(fds[0], frame)
+	if err != nil {
+		t.Fatalf("failed to write frame: %s", err)
+	}
+
+	err = b.Read()
+	if err != nil {
+		t.Fatalf("unexpected Read failure: %s", err)
+	}
+	im, err := b.Get()
+	if err != nil || im == nil || im.Type != 7 {
+		t.Fatalf("unexpected Get result (%#v, %v)", im, err)
+	}
+}
+
+// This is a reader and writer backed directly by a descriptor, bypassing the
+// runtime poller so that EAGAIN is reported to the caller.
+type fdReadWriter int
+
+func (fd fdReadWriter) Read(p []byte) (int, error) {
+	n, err := unix.Read(int(fd), p)
+	if n < 0 {
+		n = 0
+	}
+	return n, err
+}
+
+func (fd fdReadWriter) Write(p []byte) (int, error) {
+	return fdWriter(fd).Write(p)
+}
+
+func TestMsgBufClearClosesFiles(t *testing.T) {
+	a, _ := newTestSocketPair(t)
+	m := NewMsgBuf(a.conn)
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %s", err)
+	}
+	defer pr.Close()
+
+	err = m.Enqueue(&IMsg{Type: 1, file: pw})
+	if err != nil {
+		t.Fatalf("unexpected Enqueue failure: %s", err)
+	}
+
+	m.Clear()
+
+	// With the only write end closed, reading reports EOF.
+	_, err = pr.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("attached file was not closed by Clear: %v", err)
+	}
+}
+
+func TestMsgBufFlushContext(t *testing.T) {
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("failed to create socketpair: %s", err)
+	}
+	peer := os.NewFile(uintptr(fds[1]), "peer")
+	defer peer.Close()
+
+	// Keep the socket buffer well short of a single imsg.
+	err = unix.SetsockoptInt(fds[0], unix.SOL_SOCKET, unix.SO_SNDBUF, 4096)
+	if err != nil {
+		t.Fatalf("failed to set send buffer size: %s", err)
+	}
+
+	conn, err := unixConnFromFD(fds[0], "test")
+	if err != nil {
+		t.Fatalf("failed to wrap socket: %s", err)
+	}
+	defer conn.Close()
+
+	m := NewMsgBuf(conn)
+	m.SetMaxSize(65535)
+
+	data := bytes.Repeat([]byte{0xaa}, 65535-HeaderSizeInBytes)
+	for typ := uint32(1); typ <= 2; typ++ {
+		err = m.Enqueue(&IMsg{Type: typ, Data: data})
+		if err != nil {
+			t.Fatalf("unexpected Enqueue failure: %s", err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	n, err := m.FlushContext(ctx)
+	if err != context.DeadlineExceeded || n != 0 {
+		t.Fatalf("expected context.DeadlineExceeded, got: %d, %v", n, err)
+	}
+
+	m.mu.Lock()
+	off := m.off
+	m.mu.Unlock()
+	if off == 0 || m.QueueLen() != 2 {
+		t.Fatalf("flush was not interrupted mid-imsg (%d bytes written)", off)
+	}
+
+	// A flush which has already expired writes nothing.
+	_, err = m.FlushDeadline(time.Now().Add(-time.Second))
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got: %v", err)
+	}
+
+	received := make(chan []byte)
+	go func() {
+		bs, _ := io.ReadAll(peer)
+		received <- bs
+	}()
+
+	n, err = m.FlushDeadline(time.Now().Add(5 * time.Second))
+	if err != nil || n != 2 {
+		t.Fatalf("unexpected Flush result (%d, %v)", n, err)
+	}
+	conn.Close()
+
+	r := bytes.NewReader(<-received)
+	d := NewDecoder(r)
+	d.SetMaxSize(65535)
+	for typ := uint32(1); typ <= 2; typ++ {
+		im, err := d.Decode()
+		if err != nil {
+			t.Fatalf("written data does not decode cleanly: %s", err)
+		}
+		if im.Type != typ || !bytes.Equal(im.Data, data) {
+			t.Fatalf("imsg %d was corrupted", typ)
+		}
+	}
+	if r.Len() != 0 {
+		t.Fatalf("unexpected trailing data (%d bytes)", r.Len())
+	}
+}
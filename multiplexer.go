@@ -0,0 +1,193 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+)
+
+// DefaultMultiplexerBuffer is the default number of received imsgs a
+// Multiplexer holds before its connections stop being read.
+const DefaultMultiplexerBuffer = 16
+
+// ErrRemoved is reported by a Multiplexer, wrapped in ErrConnFailed, for a
+// connection which was removed with Remove.
+var ErrRemoved = errors.New("imsg: connection removed")
+
+// A Multiplexer merges the imsgs received from several Conns into a single
+// stream. Each Conn is read by its own goroutine, and the imsgs received are
+// buffered up to a fixed limit, beyond which the Conns are left unread until
+// Recv catches up. A Multiplexer doesn't take ownership of its Conns, which
+// remain usable once removed.
+type Multiplexer struct {
+	events chan muxEvent
+
+	mu     sync.Mutex
+	conns  map[string]*muxConn
+	closed chan struct{}
+	wg     sync.WaitGroup
+}
+
+// A muxEvent is an imsg or error received from a connection.
+type muxEvent struct {
+	name string
+	im   *IMsg
+	err  error
+}
+
+// A muxConn tracks a connection being read by a Multiplexer.
+type muxConn struct {
+	cancel context.CancelFunc
+}
+
+// NewMultiplexer constructs an empty Multiplexer which buffers up to n received
+// imsgs. If n isn't positive, DefaultMultiplexerBuffer is used.
+func NewMultiplexer(n int) *Multiplexer {
+	if n <= 0 {
+		n = DefaultMultiplexerBuffer
+	}
+
+	return &Multiplexer{
+		events: make(chan muxEvent, n),
+		conns:  make(map[string]*muxConn),
+		closed: make(chan struct{}),
+	}
+}
+
+// Add starts receiving imsgs from c, which are reported by Recv under the
+// provided name. ErrNameInUse is returned if another connection was added
+// under that name and hasn't yet stopped.
+func (m *Multiplexer) Add(name string, c *Conn) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	select {
+	case <-m.closed:
+		return net.ErrClosed
+	default:
+	}
+
+	if _, ok := m.conns[name]; ok {
+		return &ErrNameInUse{name}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	mc := &muxConn{cancel}
+	m.conns[name] = mc
+
+	m.wg.Add(1)
+	go m.pump(ctx, name, c, mc)
+
+	return nil
+}
+
+// Remove stops receiving imsgs from the connection added under the provided
+// name, reporting whether there was one. Recv subsequently reports
+// ErrConnFailed wrapping ErrRemoved for the connection. Imsgs already buffered
+// are still delivered.
+func (m *Multiplexer) Remove(name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	mc, ok := m.conns[name]
+	if ok {
+		mc.cancel()
+	}
+
+	return ok
+}
+
+// Recv returns the next imsg received from any of the connections, along with
+// the name of the connection. When a connection stops delivering imsgs, because
+// it failed or was closed or removed, ErrConnFailed is returned bearing its
+// name; the remaining connections are unaffected. If the context is done, its
+// error is returned, and once the Multiplexer is closed, net.ErrClosed is.
+func (m *Multiplexer) Recv(ctx context.Context) (string, *IMsg, error) {
+	select {
+	case ev := <-m.events:
+		return ev.name, ev.im, ev.err
+	case <-ctx.Done():
+		return "", nil, ctx.Err()
+	case <-m.closed:
+		return "", nil, net.ErrClosed
+	}
+}
+
+// Close stops receiving imsgs from all connections and discards any imsgs
+// which have been buffered, closing their attached files. The connections
+// themselves are left open.
+func (m *Multiplexer) Close() error {
+	m.mu.Lock()
+	select {
+	case <-m.closed:
+		m.mu.Unlock()
+		return nil
+	default:
+	}
+	close(m.closed)
+	for _, mc := range m.conns {
+		mc.cancel()
+	}
+	m.mu.Unlock()
+
+	m.wg.Wait()
+
+	for {
+		select {
+		case ev := <-m.events:
+			if ev.im != nil {
+				ev.im.closeFile()
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// pump reads imsgs from a connection until it fails or the context is
+// cancelled, passing them to Recv.
+func (m *Multiplexer) pump(ctx context.Context, name string, c *Conn, mc *muxConn) {
+	defer m.wg.Done()
+
+	err := m.forward(ctx, name, c)
+
+	m.mu.Lock()
+	if m.conns[name] == mc {
+		delete(m.conns, name)
+	}
+	m.mu.Unlock()
+	mc.cancel()
+
+	select {
+	case m.events <- muxEvent{name, nil, &ErrConnFailed{name, err}}:
+	case <-m.closed:
+	}
+}
+
+// forward passes imsgs read from a connection to Recv, returning the error
+// which stopped it.
+func (m *Multiplexer) forward(ctx context.Context, name string, c *Conn) error {
+	defer c.interruptOnDone(ctx)()
+
+	for {
+		im, err := c.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ErrRemoved
+			}
+			return err
+		}
+
+		select {
+		case m.events <- muxEvent{name, im, nil}:
+		case <-ctx.Done():
+			im.closeFile()
+			return ErrRemoved
+		}
+	}
+}
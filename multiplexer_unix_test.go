@@ -0,0 +1,130 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestMultiplexer(t *testing.T) {
+	a, childA := newTestSocketPair(t)
+	b, childB := newTestSocketPair(t)
+
+	m := NewMultiplexer(2)
+	defer m.Close()
+	for name, c := range map[string]*Conn{"a": a, "b": b} {
+		err := m.Add(name, c)
+		if err != nil {
+			t.Fatalf("unexpected Add failure: %s", err)
+		}
+	}
+
+	var enu *ErrNameInUse
+	err := m.Add("a", b)
+	if !errors.As(err, &enu) || enu.Name != "a" {
+		t.Fatalf("expected ErrNameInUse, got: %v", err)
+	}
+
+	// Interleave imsgs from both children, then have one of them die
+	// mid-stream.
+	for i := uint32(0); i < 4; i++ {
+		childA.Send(&IMsg{Type: 1, PeerID: i})
+		childB.Send(&IMsg{Type: 2, PeerID: i})
+	}
+	childA.Close()
+	childB.Send(&IMsg{Type: 2, PeerID: 4})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	next := map[string]uint32{}
+	var failed string
+	for next["b"] < 5 || failed == "" {
+		name, im, err := m.Recv(ctx)
+		if err != nil {
+			var ecf *ErrConnFailed
+			if !errors.As(err, &ecf) || ecf.Name != name || !errors.Is(err, io.EOF) {
+				t.Fatalf("expected ErrConnFailed wrapping io.EOF, got: (%q, %v)", name, err)
+			}
+			failed = name
+			continue
+		}
+
+		expectedType := map[string]uint32{"a": 1, "b": 2}[name]
+		if im.Type != expectedType || im.PeerID != next[name] {
+			t.Fatalf("unexpected imsg from %q (%v)", name, im)
+		}
+		next[name]++
+	}
+	if failed != "a" || next["a"] != 4 {
+		t.Fatalf("unexpected failure (%q after %d imsgs)", failed, next["a"])
+	}
+
+	// The failed connection's name may be reused.
+	a2, childA2 := newTestSocketPair(t)
+	err = m.Add("a", a2)
+	if err != nil {
+		t.Fatalf("unexpected Add failure: %s", err)
+	}
+	childA2.Send(&IMsg{Type: 3})
+	name, im, err := m.Recv(ctx)
+	if err != nil || name != "a" || im.Type != 3 {
+		t.Fatalf("unexpected Recv result (%q, %v, %v)", name, im, err)
+	}
+}
+
+func TestMultiplexerRemove(t *testing.T) {
+	a, childA := newTestSocketPair(t)
+
+	m := NewMultiplexer(0)
+	err := m.Add("a", a)
+	if err != nil {
+		t.Fatalf("unexpected Add failure: %s", err)
+	}
+	if m.Remove("missing") {
+		t.Fatalf("removed a connection which was never added")
+	}
+	if !m.Remove("a") {
+		t.Fatalf("failed to remove connection")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	name, _, err := m.Recv(ctx)
+	if name != "a" || !errors.Is(err, ErrRemoved) {
+		t.Fatalf("expected ErrRemoved for %q, got: (%q, %v)", "a", name, err)
+	}
+
+	// The removed connection remains usable.
+	childA.Send(&IMsg{Type: 1})
+	im, err := a.Recv()
+	if err != nil || im.Type != 1 {
+		t.Fatalf("unexpected Recv result after removal (%v, %v)", im, err)
+	}
+
+	shortCtx, shortCancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer shortCancel()
+	_, _, err = m.Recv(shortCtx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got: %v", err)
+	}
+
+	m.Close()
+	_, _, err = m.Recv(ctx)
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected net.ErrClosed, got: %v", err)
+	}
+	err = m.Add("a", a)
+	if !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected net.ErrClosed, got: %v", err)
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"runtime/debug"
+	"sync"
+)
+
+// A HandlerFunc handles a received imsg.
+type HandlerFunc func(*IMsg) error
+
+// A Mux routes received imsgs to handlers according to their type. Handlers
+// may be registered and imsgs dispatched concurrently. The zero value is an
+// empty Mux ready for use.
+type Mux struct {
+	mu         sync.RWMutex
+	handlers   map[uint32]HandlerFunc
+	subsystems map[uint16]HandlerFunc
+	def        HandlerFunc
+	sizeCheck  bool // Set by SetSizeCheck
+}
+
+// NewMux constructs an empty Mux.
+func NewMux() *Mux {
+	return &Mux{}
+}
+
+// Handle registers h as the handler for imsgs of the provided type, replacing
+// any handler previously registered for that type. A nil h removes the
+// registration.
+func (m *Mux) Handle(typ uint32, h HandlerFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if h == nil {
+		delete(m.handlers, typ)
+		return
+	}
+	if m.handlers == nil {
+		m.handlers = make(map[uint32]HandlerFunc)
+	}
+	m.handlers[typ] = h
+}
+
+// HandleSubsystem registers h as the handler for imsgs whose type, as split by
+// SplitType, belongs to the provided subsystem, replacing any handler previously
+// registered for that subsystem. A handler registered with Handle for a
+// particular type takes precedence. A nil h removes the registration.
+func (m *Mux) HandleSubsystem(subsystem uint16, h HandlerFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if h == nil {
+		delete(m.subsystems, subsystem)
+		return
+	}
+	if m.subsystems == nil {
+		m.subsystems = make(map[uint16]HandlerFunc)
+	}
+	m.subsystems[subsystem] = h
+}
+
+// HandleDefault registers h as the handler for imsgs whose type has no handler
+// of its own, replacing any previously registered default. A nil h removes the
+// default.
+func (m *Mux) HandleDefault(h HandlerFunc) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.def = h
+}
+
+// Dispatch invokes the handler registered for the type of the imsg, falling
+// back to the handler for its subsystem and then to the default handler, and
+// returns its error. If size checks are enabled with SetSizeCheck, an imsg
+// which fails them is refused with ErrSizeMismatch. If no handler applies,
+// ErrNoHandler is returned. A panicking handler is recovered and reported as
+// ErrHandlerPanic.
+func (m *Mux) Dispatch(im *IMsg) error {
+	m.mu.RLock()
+	h, ok := m.handlers[im.Type]
+	if !ok {
+		subsystem, _ := SplitType(im.Type)
+		h, ok = m.subsystems[subsystem]
+	}
+	if !ok {
+		h = m.def
+	}
+	sizeCheck := m.sizeCheck
+	m.mu.RUnlock()
+
+	if sizeCheck {
+		err := checkSize(im)
+		if err != nil {
+			return err
+		}
+	}
+
+	if h == nil {
+		return &ErrNoHandler{im.Type}
+	}
+
+	return invokeHandler(h, im)
+}
+
+// invokeHandler calls h with the provided imsg, converting a panic into an
+// ErrHandlerPanic.
+func invokeHandler(h HandlerFunc, im *IMsg) (err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			err = &ErrHandlerPanic{im.Type, v, debug.Stack()}
+		}
+	}()
+
+	return h(im)
+}
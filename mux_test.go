@@ -0,0 +1,152 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestMux(t *testing.T) {
+	m := NewMux()
+
+	var got []string
+	m.Handle(1, func(*IMsg) error { got = append(got, "first"); return nil })
+	m.Handle(2, func(*IMsg) error { got = append(got, "two"); return nil })
+	// A later registration for the same type replaces the earlier one.
+	m.Handle(1, func(*IMsg) error { got = append(got, "second"); return nil })
+
+	for _, typ := range []uint32{1, 2} {
+		err := m.Dispatch(&IMsg{Type: typ})
+		if err != nil {
+			t.Fatalf("unexpected Dispatch failure: %s", err)
+		}
+	}
+	if strings.Join(got, ",") != "second,two" {
+		t.Fatalf("unexpected handlers invoked (%v)", got)
+	}
+
+	var enh *ErrNoHandler
+	err := m.Dispatch(&IMsg{Type: 3})
+	if !errors.As(err, &enh) || enh.Type != 3 {
+		t.Fatalf("expected ErrNoHandler for type 3, got: %v", err)
+	}
+
+	// Removing a registration makes the type unhandled again.
+	m.Handle(2, nil)
+	err = m.Dispatch(&IMsg{Type: 2})
+	if !errors.As(err, &enh) {
+		t.Fatalf("expected ErrNoHandler, got: %v", err)
+	}
+
+	errTest := errors.New("test")
+	var defTypes []uint32
+	m.HandleDefault(func(im *IMsg) error {
+		defTypes = append(defTypes, im.Type)
+		return errTest
+	})
+	err = m.Dispatch(&IMsg{Type: 3})
+	if err != errTest {
+		t.Fatalf("expected default handler error, got: %v", err)
+	}
+	err = m.Dispatch(&IMsg{Type: 1})
+	if err != nil {
+		t.Fatalf("unexpected Dispatch failure: %s", err)
+	}
+	if len(defTypes) != 1 || defTypes[0] != 3 {
+		t.Fatalf("default handler invoked for unexpected types (%v)", defTypes)
+	}
+}
+
+func TestMuxZeroValue(t *testing.T) {
+	var m Mux
+
+	var enh *ErrNoHandler
+	err := m.Dispatch(&IMsg{Type: 1})
+	if !errors.As(err, &enh) {
+		t.Fatalf("expected ErrNoHandler, got: %v", err)
+	}
+
+	m.Handle(1, func(*IMsg) error { return nil })
+	err = m.Dispatch(&IMsg{Type: 1})
+	if err != nil {
+		t.Fatalf("unexpected Dispatch failure: %s", err)
+	}
+}
+
+func TestMuxPanic(t *testing.T) {
+	m := NewMux()
+	m.Handle(7, func(*IMsg) error { panic("boom") })
+
+	var ehp *ErrHandlerPanic
+	err := m.Dispatch(&IMsg{Type: 7})
+	if !errors.As(err, &ehp) {
+		t.Fatalf("expected ErrHandlerPanic, got: %v", err)
+	}
+	if ehp.Type != 7 || ehp.Value != "boom" {
+		t.Fatalf("unexpected panic details (%d, %v)", ehp.Type, ehp.Value)
+	}
+	if !strings.Contains(string(ehp.Stack), "TestMuxPanic") {
+		t.Fatalf("stack does not include the panicking handler:\n%s", ehp.Stack)
+	}
+}
+
+func TestMuxConcurrent(t *testing.T) {
+	m := NewMux()
+	m.HandleDefault(func(*IMsg) error { return nil })
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(typ uint32) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				m.Handle(typ, func(*IMsg) error { return nil })
+			}
+		}(uint32(i))
+		go func(typ uint32) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				err := m.Dispatch(&IMsg{Type: typ})
+				if err != nil {
+					t.Errorf("unexpected Dispatch failure: %s", err)
+					return
+				}
+			}
+		}(uint32(i))
+	}
+	wg.Wait()
+}
+
+func TestMuxSubsystem(t *testing.T) {
+	m := NewMux()
+
+	var got []string
+	m.HandleSubsystem(1, func(*IMsg) error { got = append(got, "subsystem"); return nil })
+	m.Handle(MakeType(1, 2), func(*IMsg) error { got = append(got, "op"); return nil })
+	m.HandleDefault(func(*IMsg) error { got = append(got, "default"); return nil })
+
+	// The handler for an operation takes precedence over its subsystem's, which
+	// takes precedence over the default.
+	for _, typ := range []uint32{MakeType(1, 1), MakeType(1, 2), MakeType(2, 2)} {
+		err := m.Dispatch(&IMsg{Type: typ})
+		if err != nil {
+			t.Fatalf("unexpected Dispatch failure: %s", err)
+		}
+	}
+	if strings.Join(got, ",") != "subsystem,op,default" {
+		t.Fatalf("unexpected handlers invoked (%v)", got)
+	}
+
+	m.HandleSubsystem(1, nil)
+	m.HandleDefault(nil)
+	var enh *ErrNoHandler
+	err := m.Dispatch(&IMsg{Type: MakeType(1, 1)})
+	if !errors.As(err, &enh) {
+		t.Fatalf("expected ErrNoHandler, got: %v", err)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"os"
+)
+
+// A filer is a listener or connection whose socket descriptor can be
+// duplicated, such as a *net.TCPListener or *net.UnixConn.
+type filer interface {
+	File() (*os.File, error)
+}
+
+// sendDup sends an imsg of the provided type over c with a duplicate of the
+// descriptor of v attached.
+func sendDup(c *Conn, typ, peerID uint32, v filer) error {
+	f, err := v.File()
+	if err != nil {
+		return &ErrNotTransferable{fmt.Sprintf("%T", v), err.Error()}
+	}
+
+	im, err := ComposeIMsgWithFile(typ, peerID, nil, f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = c.Send(im)
+	if err != nil {
+		im.Close()
+	}
+
+	return err
+}
+
+// SendListener passes a listening socket to the peer of c, in an imsg of the
+// provided type to be reconstructed with RecvListener. This allows a
+// privileged process to bind a socket on behalf of an unprivileged one. The
+// peer receives a duplicate of the listener's descriptor, so l remains open
+// and continues to accept connections on the same socket until it's closed,
+// which the sender typically does once SendListener succeeds. Descriptor
+// passing must be allowed on c with AllowFDPass. A unix domain socket listener
+// stops removing its socket file once closed, as the file is then in use by
+// the peer. Only TCP and unix domain socket listeners can be passed; others are
+// refused with ErrNotTransferable.
+func SendListener(c *Conn, typ, peerID uint32, l net.Listener) error {
+	switch l := l.(type) {
+	case *net.TCPListener:
+		return sendDup(c, typ, peerID, l)
+	case *net.UnixListener:
+		// The socket file, if any, is left in place for the recipient. Not
+		// every platform's listener removes its file.
+		if u, ok := any(l).(interface{ SetUnlinkOnClose(bool) }); ok {
+			u.SetUnlinkOnClose(false)
+		}
+		return sendDup(c, typ, peerID, l)
+	}
+
+	return &ErrNotTransferable{fmt.Sprintf("%T", l), "only TCP and unix listeners are backed by a socket descriptor"}
+}
+
+// RecvListener reconstructs a listener passed by SendListener from the file
+// attached to the received imsg. The file is consumed, being closed once the
+// listener has its own duplicate of the descriptor, regardless of whether an
+// error is returned. ErrMissingFD is returned if no file is attached.
+func RecvListener(im *IMsg) (net.Listener, error) {
+	f := im.Detach()
+	if f == nil {
+		return nil, &ErrMissingFD{im.Type}
+	}
+	defer f.Close()
+
+	return net.FileListener(f)
+}
+
+// SendConn passes an established connection to the peer of c, in an imsg of
+// the provided type to be reconstructed with RecvConn, such as to hand a
+// connection accepted by a frontend process to a worker. The peer receives a
+// duplicate of the connection's descriptor, so both ends refer to the same
+// socket until nc is closed, and the sender should close nc once SendConn
+// succeeds, lest both processes read from or write to it. Descriptor passing
+// must be allowed on c with AllowFDPass.
+//
+// Only TCP and unix domain socket connections can be passed; others are
+// refused with ErrNotTransferable. This includes a *tls.Conn, whose session
+// state lives in the sending process and can't accompany the socket.
+func SendConn(c *Conn, typ, peerID uint32, nc net.Conn) error {
+	switch nc := nc.(type) {
+	case *net.TCPConn:
+		return sendDup(c, typ, peerID, nc)
+	case *net.UnixConn:
+		return sendDup(c, typ, peerID, nc)
+	case *tls.Conn:
+		return &ErrNotTransferable{"*tls.Conn", "its session state can't accompany the socket to another process"}
+	}
+
+	return &ErrNotTransferable{fmt.Sprintf("%T", nc), "only TCP and unix connections are backed by a socket descriptor"}
+}
+
+// RecvConn reconstructs a connection passed by SendConn from the file attached
+// to the received imsg. The file is consumed, being closed once the connection
+// has its own duplicate of the descriptor, regardless of whether an error is
+// returned. ErrMissingFD is returned if no file is attached.
+func RecvConn(im *IMsg) (net.Conn, error) {
+	f := im.Detach()
+	if f == nil {
+		return nil, &ErrMissingFD{im.Type}
+	}
+	defer f.Close()
+
+	return net.FileConn(f)
+}
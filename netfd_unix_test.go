@@ -0,0 +1,222 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// newTestFDPassPair constructs a connected pair of Conns over which
+// descriptors may be passed.
+func newTestFDPassPair(t *testing.T) (*Conn, *Conn) {
+	t.Helper()
+
+	a, b := newTestSocketPair(t)
+	a.AllowFDPass(true)
+	b.AllowFDPass(true)
+
+	return a, b
+}
+
+// fakeListener is a net.Listener without a socket descriptor.
+type fakeListener struct {
+	net.Listener
+}
+
+func TestSendListener(t *testing.T) {
+	a, b := newTestFDPassPair(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected Listen failure: %s", err)
+	}
+	addr := l.Addr().String()
+
+	err = SendListener(a, 1, 2, l)
+	if err != nil {
+		t.Fatalf("unexpected SendListener failure: %s", err)
+	}
+	// The sender's copy is closed, leaving only the peer's.
+	l.Close()
+
+	im, err := b.Recv()
+	if err != nil || im.Type != 1 || im.PeerID != 2 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+	rl, err := RecvListener(im)
+	if err != nil {
+		t.Fatalf("unexpected RecvListener failure: %s", err)
+	}
+	defer rl.Close()
+	if im.File() != nil {
+		t.Fatalf("file was left attached to the imsg")
+	}
+	if rl.Addr().String() != addr {
+		t.Fatalf("unexpected listener address (%s != %s)", rl.Addr(), addr)
+	}
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		nc, err := rl.Accept()
+		if err != nil {
+			t.Errorf("unexpected Accept failure: %s", err)
+		}
+		accepted <- nc
+	}()
+	nc, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("unexpected dial failure: %s", err)
+	}
+	defer nc.Close()
+	sc := <-accepted
+	if sc == nil {
+		t.FailNow()
+	}
+	defer sc.Close()
+
+	_, err = nc.Write([]byte("hello"))
+	if err != nil {
+		t.Fatalf("unexpected write failure: %s", err)
+	}
+	bs := make([]byte, 5)
+	_, err = io.ReadFull(sc, bs)
+	if err != nil || string(bs) != "hello" {
+		t.Fatalf("unexpected read result (%q, %v)", bs, err)
+	}
+}
+
+func TestSendListenerErrors(t *testing.T) {
+	a, _ := newTestFDPassPair(t)
+
+	err := SendListener(a, 1, 0, fakeListener{})
+	var notTransferable *ErrNotTransferable
+	if !errors.As(err, &notTransferable) {
+		t.Fatalf("expected ErrNotTransferable, got: %v", err)
+	}
+
+	_, err = RecvListener(&IMsg{Type: 1})
+	var missing *ErrMissingFD
+	if !errors.As(err, &missing) {
+		t.Fatalf("expected ErrMissingFD, got: %v", err)
+	}
+}
+
+func TestSendConn(t *testing.T) {
+	a, b := newTestFDPassPair(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected Listen failure: %s", err)
+	}
+	defer l.Close()
+	remote, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected dial failure: %s", err)
+	}
+	defer remote.Close()
+	nc, err := l.Accept()
+	if err != nil {
+		t.Fatalf("unexpected Accept failure: %s", err)
+	}
+
+	err = SendConn(a, 1, 0, nc)
+	if err != nil {
+		t.Fatalf("unexpected SendConn failure: %s", err)
+	}
+	nc.Close()
+
+	im, err := b.Recv()
+	if err != nil || im.Type != 1 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+	rc, err := RecvConn(im)
+	if err != nil {
+		t.Fatalf("unexpected RecvConn failure: %s", err)
+	}
+	defer rc.Close()
+	if _, ok := rc.(*net.TCPConn); !ok {
+		t.Fatalf("unexpected connection type %T", rc)
+	}
+
+	// The connection remains established across the transfer.
+	_, err = remote.Write([]byte("from the remote end"))
+	if err != nil {
+		t.Fatalf("unexpected write failure: %s", err)
+	}
+	bs := make([]byte, len("from the remote end"))
+	_, err = io.ReadFull(rc, bs)
+	if err != nil || string(bs) != "from the remote end" {
+		t.Fatalf("unexpected read result (%q, %v)", bs, err)
+	}
+	_, err = rc.Write([]byte("reply"))
+	if err != nil {
+		t.Fatalf("unexpected write failure: %s", err)
+	}
+	bs = make([]byte, 5)
+	_, err = io.ReadFull(remote, bs)
+	if err != nil || string(bs) != "reply" {
+		t.Fatalf("unexpected read result (%q, %v)", bs, err)
+	}
+}
+
+func TestSendConnUnix(t *testing.T) {
+	a, b := newTestFDPassPair(t)
+	c, d := newTestSocketPair(t)
+
+	err := SendConn(a, 1, 0, c.uc)
+	if err != nil {
+		t.Fatalf("unexpected SendConn failure: %s", err)
+	}
+	im, err := b.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	rc, err := RecvConn(im)
+	if err != nil {
+		t.Fatalf("unexpected RecvConn failure: %s", err)
+	}
+	defer rc.Close()
+
+	// An imsg written to the reconstructed connection reaches the peer.
+	err = NewConn(rc).Send(&IMsg{Type: 2, Data: []byte("relayed")})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	im, err = d.Recv()
+	if err != nil || im.Type != 2 || string(im.Data) != "relayed" {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+}
+
+func TestSendConnErrors(t *testing.T) {
+	a, _ := newTestFDPassPair(t)
+
+	pa, pb := net.Pipe()
+	defer pa.Close()
+	defer pb.Close()
+
+	var notTransferable *ErrNotTransferable
+	for _, nc := range []net.Conn{pa, tls.Client(pa, &tls.Config{})} {
+		err := SendConn(a, 1, 0, nc)
+		if !errors.As(err, &notTransferable) {
+			t.Fatalf("expected ErrNotTransferable for %T, got: %v", nc, err)
+		}
+	}
+	if notTransferable.Type != "*tls.Conn" {
+		t.Fatalf("unexpected type in ErrNotTransferable: %s", notTransferable.Type)
+	}
+
+	_, err := RecvConn(&IMsg{Type: 1})
+	var missing *ErrMissingFD
+	if !errors.As(err, &missing) {
+		t.Fatalf("expected ErrMissingFD, got: %v", err)
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"go/build"
+	"testing"
+)
+
+// The package must build without importing unsafe on every platform,
+// including those which are big-endian.
+func TestNoUnsafeImport(t *testing.T) {
+	platforms := [][2]string{
+		{"linux", "amd64"},
+		{"linux", "arm64"},
+		{"linux", "s390x"},
+		{"linux", "ppc64"},
+		{"linux", "mips"},
+		{"openbsd", "amd64"},
+		{"darwin", "arm64"},
+		{"windows", "amd64"},
+		{"plan9", "386"},
+		{"js", "wasm"},
+	}
+
+	for _, p := range platforms {
+		ctx := build.Default
+		ctx.GOOS, ctx.GOARCH = p[0], p[1]
+		ctx.CgoEnabled = false
+
+		pkg, err := ctx.ImportDir(".", 0)
+		if err != nil {
+			t.Fatalf("unexpected ImportDir failure for %s/%s: %s", p[0], p[1], err)
+		}
+		for _, path := range pkg.Imports {
+			if path == "unsafe" {
+				t.Fatalf("package imports unsafe on %s/%s", p[0], p[1])
+			}
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import "net"
+
+// A datagram longer than any imsg is truncated to this length, one byte more
+// than the largest Length a header can hold, so that it's still recognized as
+// too long.
+const packetBufSizeInBytes = 1<<16 + 1
+
+// NewPacketConn constructs a Conn over a unix domain socket of type
+// SOCK_SEQPACKET or SOCK_DGRAM, which carries each imsg in a datagram of its
+// own rather than as part of a byte stream.
+//
+// Each imsg sent is written with a single sendmsg, never combined with others,
+// even when sends are coalesced. An imsg which doesn't fit in a datagram is
+// dropped and ErrPacketTooLarge is returned. Each datagram received must hold
+// exactly one imsg, whose header's Length matches the length of the datagram;
+// one which doesn't is discarded along with any descriptors which accompanied
+// it, and ErrPacketLength is returned. Since datagram boundaries are kept by
+// the socket, neither leaves the Conn unusable.
+func NewPacketConn(uc *net.UnixConn, opts ...ConnOption) *Conn {
+	c := NewStreamConn(uc, opts...)
+	c.packet = true
+	c.wq.packet = true
+
+	return c
+}
+
+// SocketPairOption configures the socketpair constructed by SocketPair.
+type SocketPairOption func(*socketPairConfig)
+
+// This holds the configuration assembled from SocketPairOptions.
+type socketPairConfig struct {
+	seqPacket bool
+}
+
+// WithSeqPacket causes SocketPair to construct a SOCK_SEQPACKET socketpair,
+// whose ends are Conns constructed with NewPacketConn.
+func WithSeqPacket() SocketPairOption {
+	return func(cfg *socketPairConfig) {
+		cfg.seqPacket = true
+	}
+}
+
+// checkPacket returns ErrPacketLength unless the datagram p holds exactly one
+// imsg.
+func (c *Conn) checkPacket(p []byte) error {
+	if len(p) < HeaderSizeInBytes {
+		return &ErrPacketLength{PacketBytes: len(p)}
+	}
+
+	hdr := parseHeader(p, c.order)
+	if int(hdr.Length) != len(p) {
+		return &ErrPacketLength{PacketBytes: len(p), HeaderLength: int(hdr.Length)}
+	}
+
+	return nil
+}
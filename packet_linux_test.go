@@ -0,0 +1,57 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestPacketConnTooLarge(t *testing.T) {
+	a, b := newTestPacketPair(t)
+	a.AllowFDPass(true)
+	for _, c := range []*Conn{a, b} {
+		err := c.SetMaxSize(65535)
+		if err != nil {
+			t.Fatalf("unexpected SetMaxSize failure: %s", err)
+		}
+	}
+
+	// Linux refuses a datagram larger than the send buffer outright.
+	err := a.uc.(*net.UnixConn).SetWriteBuffer(1024)
+	if err != nil {
+		t.Fatalf("failed to shrink send buffer: %s", err)
+	}
+
+	big := &IMsg{Type: 1, Data: make([]byte, MaxSizeInBytes*2)}
+	err = a.Send(big)
+	var tooLarge *ErrPacketTooLarge
+	if !errors.As(err, &tooLarge) || tooLarge.Type != 1 || tooLarge.LengthInBytes != big.Len() {
+		t.Fatalf("expected ErrPacketTooLarge, got: %v", err)
+	}
+	if !errors.Is(err, unix.EMSGSIZE) {
+		t.Fatalf("ErrPacketTooLarge does not wrap EMSGSIZE: %v", err)
+	}
+	if a.State() != StateActive || a.wq.QueueLen() != 0 {
+		t.Fatalf("oversized imsg was not dropped (%v, %d)", a.State(), a.wq.QueueLen())
+	}
+
+	// Smaller imsgs continue to be sent.
+	small, _ := ComposeIMsg(2, 0, []byte("test"))
+	err = a.Send(small)
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	im, err := b.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	if !im.Equal(small) {
+		t.Fatalf("received imsg does not match sent imsg (%v)", im)
+	}
+}
@@ -0,0 +1,242 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// newTestPacketPair constructs a pair of connected Conns in packet mode which
+// are closed when the test completes. The test is skipped on platforms without
+// SOCK_SEQPACKET unix domain sockets.
+func newTestPacketPair(t *testing.T, opts ...ConnOption) (*Conn, *Conn) {
+	t.Helper()
+
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_SEQPACKET, 0)
+	if errors.Is(err, unix.EPROTONOSUPPORT) || errors.Is(err, unix.EPROTOTYPE) {
+		t.Skipf("SOCK_SEQPACKET is unsupported: %s", err)
+	}
+	if err != nil {
+		t.Fatalf("failed to create socketpair: %s", err)
+	}
+	ua, err := unixConnFromFD(fds[0], "a")
+	if err != nil {
+		t.Fatalf("failed to wrap socket: %s", err)
+	}
+	ub, err := unixConnFromFD(fds[1], "b")
+	if err != nil {
+		t.Fatalf("failed to wrap socket: %s", err)
+	}
+
+	a, b := NewPacketConn(ua, opts...), NewPacketConn(ub, opts...)
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	return a, b
+}
+
+func TestSocketPairSeqPacket(t *testing.T) {
+	a, b, err := SocketPair(WithSeqPacket())
+	if errors.Is(err, unix.EPROTONOSUPPORT) || errors.Is(err, unix.EPROTOTYPE) {
+		t.Skipf("SOCK_SEQPACKET is unsupported: %s", err)
+	}
+	if err != nil {
+		t.Fatalf("failed to create socketpair: %s", err)
+	}
+	defer a.Close()
+	defer b.Close()
+
+	rc, err := a.uc.SyscallConn()
+	if err != nil {
+		t.Fatalf("unexpected SyscallConn failure: %s", err)
+	}
+	var typ int
+	rc.Control(func(fd uintptr) {
+		typ, err = unix.GetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_TYPE)
+	})
+	if err != nil || typ != unix.SOCK_SEQPACKET || !a.packet || !b.packet {
+		t.Fatalf("socketpair is not in packet mode (%d, %v)", typ, err)
+	}
+
+	im, _ := ComposeIMsg(1, 2, []byte("test"))
+	err = a.Send(im)
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	got, err := b.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	if !got.Equal(im) {
+		t.Fatalf("received imsg does not match sent imsg (%v)", got)
+	}
+}
+
+func TestPacketConnSendRecv(t *testing.T) {
+	a, b := newTestPacketPair(t)
+
+	sizes := []int{0, 1, 100, MaxSizeInBytes - HeaderSizeInBytes}
+	for i, size := range sizes {
+		im, err := ComposeIMsg(uint32(i), 0, bytes.Repeat([]byte{byte(i)}, size))
+		if err != nil {
+			t.Fatalf("failed to compose imsg: %s", err)
+		}
+		err = a.Send(im)
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+
+	for i, size := range sizes {
+		im, err := b.Recv()
+		if err != nil {
+			t.Fatalf("unexpected Recv failure: %s", err)
+		}
+		if im.Type != uint32(i) || !bytes.Equal(im.Data, bytes.Repeat([]byte{byte(i)}, size)) {
+			t.Fatalf("received imsg does not match sent imsg (%v)", im)
+		}
+	}
+}
+
+func TestPacketConnCoalesced(t *testing.T) {
+	// Coalesced imsgs are still written one datagram apiece, each of which
+	// would otherwise be rejected by the receiver.
+	a, b := newTestPacketPair(t, WithWriteBufferSize(1<<16))
+
+	for i := 0; i < 3; i++ {
+		im, _ := ComposeIMsg(uint32(i), 0, []byte("test"))
+		err := a.Send(im)
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+	err := a.Flush()
+	if err != nil {
+		t.Fatalf("unexpected Flush failure: %s", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		im, err := b.Recv()
+		if err != nil {
+			t.Fatalf("unexpected Recv failure: %s", err)
+		}
+		if im.Type != uint32(i) {
+			t.Fatalf("received imsg does not match sent imsg (%v)", im)
+		}
+	}
+}
+
+func TestPacketConnSendRecvFile(t *testing.T) {
+	a, b := newTestPacketPair(t)
+	a.AllowFDPass(true)
+	b.AllowFDPass(true)
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %s", err)
+	}
+	defer pr.Close()
+
+	im, _ := ComposeIMsg(1, 0, nil)
+	err = a.Send(im)
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	im, _ = ComposeIMsgWithFile(2, 0, []byte("pipe"), pw)
+	err = a.Send(im)
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+
+	im, err = b.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	if im.Type != 1 || im.File() != nil {
+		t.Fatalf("descriptor attached to the wrong imsg (%v)", im)
+	}
+	im, err = b.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	if im.Type != 2 || im.File() == nil {
+		t.Fatalf("received imsg is missing its descriptor (%v)", im)
+	}
+	im.File().Close()
+}
+
+func TestPacketConnBadLength(t *testing.T) {
+	a, b := newTestPacketPair(t)
+	b.AllowFDPass(true)
+	raw := a.uc.(*net.UnixConn)
+
+	good, _ := ComposeIMsg(1, 0, []byte("test"))
+	frame, err := good.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected MarshalBinary failure: %s", err)
+	}
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %s", err)
+	}
+	defer pr.Close()
+	defer pw.Close()
+
+	tests := []struct {
+		name   string
+		packet []byte
+		length int
+	}{
+		{"short", frame[:HeaderSizeInBytes-1], 0},
+		{"truncated", frame[:len(frame)-1], len(frame)},
+		{"trailing", append(append([]byte(nil), frame...), frame...), len(frame)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// A descriptor accompanying the datagram is discarded with it.
+			_, _, err := raw.WriteMsgUnix(test.packet, unix.UnixRights(int(pr.Fd())), nil)
+			if err != nil {
+				t.Fatalf("failed to write datagram: %s", err)
+			}
+			err = a.Send(good)
+			if err != nil {
+				t.Fatalf("unexpected Send failure: %s", err)
+			}
+
+			_, err = b.Recv()
+			var plen *ErrPacketLength
+			if !errors.As(err, &plen) || plen.PacketBytes != len(test.packet) || plen.HeaderLength != test.length {
+				t.Fatalf("expected ErrPacketLength, got: %v", err)
+			}
+			if b.State() != StateActive {
+				t.Fatalf("Conn failed after a bad datagram (%v)", b.Err())
+			}
+
+			// The next datagram is received intact.
+			im, err := b.Recv()
+			if err != nil {
+				t.Fatalf("unexpected Recv failure: %s", err)
+			}
+			if !im.Equal(good) || im.File() != nil {
+				t.Fatalf("received imsg does not match sent imsg (%v)", im)
+			}
+			if pending := len(b.fds); pending != 0 {
+				t.Fatalf("descriptors were retained: %d", pending)
+			}
+		})
+	}
+}
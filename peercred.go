@@ -0,0 +1,53 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+// PeerCred describes the process on the other end of a Conn, as reported by
+// the kernel. PID is zero on platforms which report only the user and group.
+type PeerCred struct {
+	PID uint32
+	UID uint32
+	GID uint32
+}
+
+// PeerCred returns the credentials of the process on the other end of the
+// underlying socket. Where the platform or socket type doesn't support looking
+// up peer credentials, ErrUnsupported is returned. The result of the first
+// successful lookup is cached for the lifetime of the Conn.
+func (c *Conn) PeerCred() (PeerCred, error) {
+	c.credMu.Lock()
+	defer c.credMu.Unlock()
+
+	if c.cred != nil {
+		return *c.cred, nil
+	}
+
+	if c.uc == nil {
+		return PeerCred{}, &ErrUnsupported{"peer credentials"}
+	}
+
+	rc, err := c.uc.SyscallConn()
+	if err != nil {
+		return PeerCred{}, err
+	}
+
+	var (
+		cred PeerCred
+		cerr error
+	)
+	err = rc.Control(func(fd uintptr) {
+		cred, cerr = getPeerCred(fd)
+	})
+	if err != nil {
+		return PeerCred{}, err
+	}
+	if cerr != nil {
+		return PeerCred{}, cerr
+	}
+
+	c.cred = &cred
+
+	return cred, nil
+}
@@ -0,0 +1,48 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Peer credentials can be looked up on this platform.
+const peerCredSupported = true
+
+// getPeerCred looks up peer credentials using LOCAL_PEERCRED, along with the
+// peer's PID using LOCAL_PEERPID.
+func getPeerCred(fd uintptr) (PeerCred, error) {
+	xucred, err := unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	if err != nil {
+		return PeerCred{}, peerCredError(err)
+	}
+
+	pid, err := unix.GetsockoptInt(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERPID)
+	if err != nil {
+		return PeerCred{}, peerCredError(err)
+	}
+
+	cred := PeerCred{
+		PID: uint32(pid),
+		UID: xucred.Uid,
+	}
+	if xucred.Ngroups > 0 {
+		cred.GID = xucred.Groups[0]
+	}
+
+	return cred, nil
+}
+
+// peerCredError maps errors indicating the socket type doesn't support peer
+// credentials onto ErrUnsupported.
+func peerCredError(err error) error {
+	if err == unix.ENOPROTOOPT || err == unix.EOPNOTSUPP {
+		return &ErrUnsupported{"peer credentials"}
+	}
+
+	return os.NewSyscallError("getsockopt", err)
+}
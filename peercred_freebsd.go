@@ -0,0 +1,33 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Peer credentials can be looked up on this platform.
+const peerCredSupported = true
+
+// getPeerCred looks up peer credentials using LOCAL_PEERCRED. The peer's PID
+// isn't reported.
+func getPeerCred(fd uintptr) (PeerCred, error) {
+	xucred, err := unix.GetsockoptXucred(int(fd), 0, unix.LOCAL_PEERCRED)
+	if err != nil {
+		if err == unix.ENOPROTOOPT || err == unix.EOPNOTSUPP {
+			return PeerCred{}, &ErrUnsupported{"peer credentials"}
+		}
+		return PeerCred{}, os.NewSyscallError("getsockopt", err)
+	}
+
+	cred := PeerCred{UID: xucred.Uid}
+	if xucred.Ngroups > 0 {
+		cred.GID = xucred.Groups[0]
+	}
+
+	return cred, nil
+}
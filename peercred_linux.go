@@ -0,0 +1,38 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Peer credentials can be looked up on this platform.
+const peerCredSupported = true
+
+// getPeerCred looks up peer credentials using SO_PEERCRED.
+func getPeerCred(fd uintptr) (PeerCred, error) {
+	ucred, err := unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	if err != nil {
+		return PeerCred{}, peerCredError(err)
+	}
+
+	return PeerCred{
+		PID: uint32(ucred.Pid),
+		UID: ucred.Uid,
+		GID: ucred.Gid,
+	}, nil
+}
+
+// peerCredError maps errors indicating the socket type doesn't support peer
+// credentials onto ErrUnsupported.
+func peerCredError(err error) error {
+	if err == unix.ENOPROTOOPT || err == unix.EOPNOTSUPP {
+		return &ErrUnsupported{"peer credentials"}
+	}
+
+	return os.NewSyscallError("getsockopt", err)
+}
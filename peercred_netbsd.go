@@ -0,0 +1,42 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Peer credentials can be looked up on this platform.
+const peerCredSupported = true
+
+// These are the level and name of the LOCAL_PEEREID socket option, which x/sys
+// doesn't define.
+const (
+	solLocal     = 0
+	localPeerEID = 3
+)
+
+// getPeerCred looks up peer credentials, including the peer's PID, using
+// LOCAL_PEEREID, which fills in a struct unpcbid holding the pid_t, uid_t and
+// gid_t of the peer in turn.
+func getPeerCred(fd uintptr) (PeerCred, error) {
+	// As x/sys doesn't wrap struct unpcbid, it's read into the array of
+	// uint32s of an ICMPv6Filter, which is large enough to hold it.
+	buf, err := unix.GetsockoptICMPv6Filter(int(fd), solLocal, localPeerEID)
+	if err != nil {
+		if err == unix.ENOPROTOOPT || err == unix.EOPNOTSUPP {
+			return PeerCred{}, &ErrUnsupported{"peer credentials"}
+		}
+		return PeerCred{}, os.NewSyscallError("getsockopt", err)
+	}
+
+	return PeerCred{
+		PID: buf.Filt[0],
+		UID: buf.Filt[1],
+		GID: buf.Filt[2],
+	}, nil
+}
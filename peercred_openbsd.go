@@ -0,0 +1,35 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Peer credentials can be looked up on this platform.
+const peerCredSupported = true
+
+// getPeerCred looks up peer credentials, including the peer's PID, using
+// SO_PEERCRED, which fills in a struct sockpeercred holding the uid_t, gid_t
+// and pid_t of the peer in turn.
+func getPeerCred(fd uintptr) (PeerCred, error) {
+	// As x/sys doesn't wrap struct sockpeercred, it's read into the array of
+	// uint32s of an ICMPv6Filter, which is large enough to hold it.
+	buf, err := unix.GetsockoptICMPv6Filter(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	if err != nil {
+		if err == unix.ENOPROTOOPT || err == unix.EOPNOTSUPP {
+			return PeerCred{}, &ErrUnsupported{"peer credentials"}
+		}
+		return PeerCred{}, os.NewSyscallError("getsockopt", err)
+	}
+
+	return PeerCred{
+		UID: buf.Filt[0],
+		GID: buf.Filt[1],
+		PID: buf.Filt[2],
+	}, nil
+}
@@ -0,0 +1,26 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"os"
+	"testing"
+)
+
+// Unlike elsewhere, the peer's PID is always reported on this platform.
+func TestConnPeerCredPID(t *testing.T) {
+	a, _ := newTestSocketPair(t)
+
+	cred, err := a.PeerCred()
+	if err != nil {
+		t.Fatalf("unexpected PeerCred failure: %s", err)
+	}
+	if cred.PID != uint32(os.Getpid()) {
+		t.Fatalf("peer PID does not match (%d != %d)", cred.PID, os.Getpid())
+	}
+	if cred.UID != uint32(os.Geteuid()) || cred.GID != uint32(os.Getegid()) {
+		t.Fatalf("peer credentials do not match (%#v)", cred)
+	}
+}
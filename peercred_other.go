@@ -0,0 +1,15 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+
+package imsg
+
+// Peer credentials can't be looked up on this platform.
+const peerCredSupported = false
+
+// getPeerCred is unsupported on this platform.
+func getPeerCred(fd uintptr) (PeerCred, error) {
+	return PeerCred{}, &ErrUnsupported{"peer credentials"}
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestConnPeerCred(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	var eu *ErrUnsupported
+	cred, err := a.PeerCred()
+	if errors.As(err, &eu) {
+		t.Skipf("peer credentials unsupported: %s", err)
+	}
+	if err != nil {
+		t.Fatalf("unexpected PeerCred failure: %s", err)
+	}
+
+	if cred.UID != uint32(os.Getuid()) {
+		t.Fatalf("peer UID does not match (%d != %d)", cred.UID, os.Getuid())
+	}
+	if cred.PID != 0 && cred.PID != uint32(os.Getpid()) {
+		t.Fatalf("peer PID does not match (%d != %d)", cred.PID, os.Getpid())
+	}
+
+	// Subsequent lookups are served from the cache, even once the socket is
+	// no longer usable.
+	b.Close()
+	a.Close()
+	cached, err := a.PeerCred()
+	if err != nil {
+		t.Fatalf("unexpected failure looking up cached credentials: %s", err)
+	}
+	if cached != cred {
+		t.Fatalf("cached credentials do not match (%#v != %#v)", cached, cred)
+	}
+}
+
+func TestConnVerifyPID(t *testing.T) {
+	a, raw, err := SocketPair()
+	if err != nil {
+		t.Fatalf("failed to create socketpair: %s", err)
+	}
+	defer a.Close()
+	defer raw.Close()
+	b := rewrapTestConn(t, raw, WithVerifyPID())
+
+	var eu *ErrUnsupported
+	cred, err := b.PeerCred()
+	if errors.As(err, &eu) || (err == nil && cred.PID == 0) {
+		t.Skip("peer PID unsupported")
+	}
+
+	pid := uint32(os.Getpid())
+	msgs := []*IMsg{
+		{Type: 1, PID: pid},
+		{Type: 2, PID: pid + 1}, // Spoofed
+		{Type: 3, PID: 0},       // Exempt
+		{Type: 4, PID: pid},
+	}
+	for _, im := range msgs {
+		err = a.Send(im)
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+
+	im, err := b.Recv()
+	if err != nil || im.Type != 1 {
+		t.Fatalf("unexpected Recv result (%#v, %v)", im, err)
+	}
+
+	var epm *ErrPIDMismatch
+	_, err = b.Recv()
+	if !errors.As(err, &epm) {
+		t.Fatalf("expected ErrPIDMismatch, got: %v", err)
+	}
+	if epm.HeaderPID != pid+1 || epm.PeerPID != pid {
+		t.Fatalf("error reports unexpected PIDs (%#v)", epm)
+	}
+
+	// The spoofed imsg is consumed without disturbing those that follow.
+	for _, typ := range []uint32{3, 4} {
+		im, err = b.Recv()
+		if err != nil || im.Type != typ {
+			t.Fatalf("unexpected Recv result (%#v, %v)", im, err)
+		}
+	}
+}
+
+func TestConnVerifyZeroPID(t *testing.T) {
+	a, b, err := SocketPair()
+	if err != nil {
+		t.Fatalf("failed to create socketpair: %s", err)
+	}
+	defer a.Close()
+	defer b.Close()
+	c := rewrapTestConn(t, b, WithVerifyZeroPID())
+
+	cred, err := c.PeerCred()
+	if err != nil || cred.PID == 0 {
+		t.Skip("peer PID unsupported")
+	}
+
+	err = a.Send(&IMsg{Type: 1})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+
+	var epm *ErrPIDMismatch
+	_, err = c.Recv()
+	if !errors.As(err, &epm) {
+		t.Fatalf("expected ErrPIDMismatch, got: %v", err)
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+// WithExplicitPeerID marks the PeerID of the IMsg as deliberately chosen, so
+// that a PeerID of zero is sent as zero rather than replaced by the default
+// set with Conn.SetDefaultPeerID.
+func WithExplicitPeerID() ComposeOption {
+	return func(c *composeConfig) {
+		c.explicitPeerID = true
+	}
+}
+
+// SetDefaultPeerID sets the PeerID with which the Conn stamps the imsgs it
+// sends whose PeerID is zero, for programs in which every imsg sent over a
+// Conn carries the same PeerID, such as one identifying a subsystem. This
+// applies to Send and everything built on it, such as SendValue, as well as to
+// Composev, SendBatch, SendFromReader and Broadcast. Imsgs with a non-zero
+// PeerID are left alone, as are those composed with WithExplicitPeerID and
+// those relayed with Forward. The imsgs passed in are never modified: the
+// PeerID is filled in on a copy, which is what trace functions and metrics
+// hooks see. A default of zero, as initially set, disables stamping.
+func (c *Conn) SetDefaultPeerID(id uint32) {
+	c.defaultPeerID.Store(id)
+}
+
+// stampPeerID returns an imsg about to be sent with the default PeerID of the
+// Conn filled in, if it applies. The imsg itself belongs to the caller, so a
+// shallow copy is stamped in its place.
+func (c *Conn) stampPeerID(im *IMsg) *IMsg {
+	if im.PeerID != 0 || im.explicitPeerID {
+		return im
+	}
+	id := c.defaultPeerID.Load()
+	if id == 0 {
+		return im
+	}
+
+	stamped := *im
+	stamped.PeerID = id
+
+	return &stamped
+}
+
+// peerIDOr returns peerID, or the default PeerID of the Conn if peerID is
+// zero.
+func (c *Conn) peerIDOr(peerID uint32) uint32 {
+	if peerID == 0 {
+		return c.defaultPeerID.Load()
+	}
+
+	return peerID
+}
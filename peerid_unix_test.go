@@ -0,0 +1,128 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"testing"
+)
+
+func TestConnDefaultPeerID(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	var traced []uint32
+	WithTraceFunc(func(dir Direction, im *IMsg, _ int) {
+		if dir == Outbound {
+			traced = append(traced, im.PeerID)
+		}
+	})(a)
+	a.SetDefaultPeerID(7)
+
+	zero := &IMsg{Type: 1}
+	explicit, err := ComposeIMsg(3, 0, nil, WithExplicitPeerID())
+	if err != nil {
+		t.Fatalf("unexpected ComposeIMsg failure: %s", err)
+	}
+	for _, im := range []*IMsg{zero, {Type: 2, PeerID: 9}, explicit} {
+		err = a.Send(im)
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+	err = a.SendValue(4, 0, "test")
+	if err != nil {
+		t.Fatalf("unexpected SendValue failure: %s", err)
+	}
+	err = a.Composev(5, 0, []byte("test"))
+	if err != nil {
+		t.Fatalf("unexpected Composev failure: %s", err)
+	}
+	batched := &IMsg{Type: 6}
+	err = a.SendBatch(batched)
+	if err != nil {
+		t.Fatalf("unexpected SendBatch failure: %s", err)
+	}
+
+	want := []uint32{7, 9, 0, 7, 7, 7}
+	for i, peerID := range want {
+		im, err := b.Recv()
+		if err != nil {
+			t.Fatalf("unexpected Recv failure: %s", err)
+		}
+		if im.PeerID != peerID {
+			t.Fatalf("unexpected PeerID of imsg of type %d (%d != %d)", im.Type, im.PeerID, peerID)
+		}
+		if traced[i] != peerID {
+			t.Fatalf("unexpected PeerID traced for imsg of type %d (%d != %d)", im.Type, traced[i], peerID)
+		}
+	}
+	// The imsgs passed in are left as they were.
+	if zero.PeerID != 0 || batched.PeerID != 0 {
+		t.Fatalf("imsgs sent modified (PeerIDs %d, %d)", zero.PeerID, batched.PeerID)
+	}
+
+	// Stamping stops once the default is reset to zero.
+	a.SetDefaultPeerID(0)
+	err = a.Send(&IMsg{Type: 7})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	im, err := b.Recv()
+	if err != nil || im.PeerID != 0 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+}
+
+func TestConnDefaultPeerIDBroadcast(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	c, d := newTestSocketPair(t)
+	a.SetDefaultPeerID(7)
+
+	// Only the Conn with a default stamps the shared imsg, which is left as
+	// it was.
+	im := &IMsg{Type: 1, Data: []byte("test")}
+	err := Broadcast(im, a, c)
+	if err != nil {
+		t.Fatalf("unexpected Broadcast failure: %s", err)
+	}
+	if im.PeerID != 0 {
+		t.Fatalf("broadcast imsg modified (PeerID %d)", im.PeerID)
+	}
+	for _, tc := range []struct {
+		conn   *Conn
+		peerID uint32
+	}{{b, 7}, {d, 0}} {
+		got, err := tc.conn.Recv()
+		if err != nil || got.PeerID != tc.peerID || string(got.Data) != "test" {
+			t.Fatalf("unexpected Recv result (%v, %v)", got, err)
+		}
+	}
+}
+
+func TestForwardDefaultPeerID(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	c, d := newTestSocketPair(t)
+	c.SetDefaultPeerID(7)
+
+	err := a.Send(&IMsg{Type: 1})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	im, err := b.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+
+	// Forwarded imsgs are relayed as received.
+	err = c.Forward(im)
+	if err != nil {
+		t.Fatalf("unexpected Forward failure: %s", err)
+	}
+	im, err = d.Recv()
+	if err != nil || im.PeerID != 0 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// A Pending tracks requests awaiting replies, keyed by an application-chosen
+// correlation ID, independently of how imsgs are sent and received. It holds
+// the bookkeeping behind Conn.Call for use by event loops built on a Buffer,
+// Decoder, or other transport: a request is registered before it's sent, and
+// each reply received is resolved against the table, which hands it to the
+// waiting request. The zero value is an empty table ready for use. A Pending
+// is safe for concurrent use.
+type Pending struct {
+	mu      sync.Mutex
+	entries map[uint32]*pendingEntry
+}
+
+// A pendingEntry is a registered request awaiting its reply.
+type pendingEntry struct {
+	ch     chan *IMsg
+	accept func(*IMsg) bool // Restricts which imsgs resolve the entry, if set
+	stop   func() bool      // Stops the entry's expiry, if set
+}
+
+// Register adds a request with the provided ID to the table, returning a
+// channel on which its reply is delivered and a function which cancels it. The
+// channel receives the reply passed to Resolve, and is closed without a reply
+// if the request is cancelled first. The cancel function must be called once
+// the request is no longer awaited, whether or not its reply arrived, and
+// calling it more than once is harmless. Registering an ID which is already
+// pending cancels the earlier request.
+func (p *Pending) Register(id uint32) (<-chan *IMsg, func()) {
+	return p.register(id, nil)
+}
+
+// RegisterContext behaves like Register, additionally cancelling the request
+// once the context is done.
+func (p *Pending) RegisterContext(ctx context.Context, id uint32) (<-chan *IMsg, func()) {
+	ch, cancel := p.register(id, nil)
+	if ctx.Done() != nil {
+		p.setStop(id, ch, context.AfterFunc(ctx, cancel))
+	}
+
+	return ch, cancel
+}
+
+// RegisterTimeout behaves like Register, additionally cancelling the request
+// once the provided duration has elapsed.
+func (p *Pending) RegisterTimeout(id uint32, d time.Duration) (<-chan *IMsg, func()) {
+	ch, cancel := p.register(id, nil)
+	p.setStop(id, ch, time.AfterFunc(d, cancel).Stop)
+
+	return ch, cancel
+}
+
+// register behaves like Register. If accept is set, only imsgs for which it
+// returns true resolve the request.
+func (p *Pending) register(id uint32, accept func(*IMsg) bool) (<-chan *IMsg, func()) {
+	e := &pendingEntry{ch: make(chan *IMsg, 1), accept: accept}
+
+	p.mu.Lock()
+	if p.entries == nil {
+		p.entries = make(map[uint32]*pendingEntry)
+	}
+	prev := p.entries[id]
+	p.entries[id] = e
+	p.mu.Unlock()
+
+	if prev != nil {
+		prev.finish()
+		close(prev.ch)
+	}
+
+	return e.ch, func() {
+		p.mu.Lock()
+		if p.entries[id] != e {
+			// The request was resolved or cancelled already.
+			p.mu.Unlock()
+			return
+		}
+		delete(p.entries, id)
+		p.mu.Unlock()
+
+		e.finish()
+		close(e.ch)
+	}
+}
+
+// setStop records the function which stops the expiry of the request with the
+// provided ID, if it's still pending with the provided channel.
+func (p *Pending) setStop(id uint32, ch <-chan *IMsg, stop func() bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	e := p.entries[id]
+	if e == nil || e.ch != ch {
+		// The request is already complete, so its expiry is unnecessary.
+		stop()
+		return
+	}
+	e.stop = stop
+}
+
+// finish stops the entry's expiry, if any. The entry must have been removed
+// from the table.
+func (e *pendingEntry) finish() {
+	if e.stop != nil {
+		e.stop()
+	}
+}
+
+// Resolve delivers an imsg to the request with the provided ID, removing the
+// request from the table. It reports whether such a request was pending; an
+// imsg resolving a request which was already resolved, cancelled, or never
+// registered is left to the caller.
+func (p *Pending) Resolve(id uint32, im *IMsg) bool {
+	p.mu.Lock()
+	e, ok := p.entries[id]
+	if !ok || (e.accept != nil && !e.accept(im)) {
+		p.mu.Unlock()
+		return false
+	}
+	delete(p.entries, id)
+	p.mu.Unlock()
+
+	e.finish()
+	e.ch <- im
+
+	return true
+}
+
+// Len returns the number of requests awaiting replies.
+func (p *Pending) Len() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return len(p.entries)
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPendingResolve(t *testing.T) {
+	var p Pending
+
+	ch, cancel := p.Register(1)
+	defer cancel()
+
+	reply := &IMsg{Type: 2, PeerID: 1}
+	if !p.Resolve(1, reply) {
+		t.Fatalf("pending request was not resolved")
+	}
+	if im := <-ch; im != reply {
+		t.Fatalf("unexpected reply delivered (%v)", im)
+	}
+
+	// A second reply to the same request is left to the caller.
+	if p.Resolve(1, reply) {
+		t.Fatalf("request was resolved twice")
+	}
+	if p.Resolve(2, reply) {
+		t.Fatalf("unregistered request was resolved")
+	}
+	if p.Len() != 0 {
+		t.Fatalf("pending table was not emptied (%d entries)", p.Len())
+	}
+
+	// Cancelling a resolved request is harmless.
+	cancel()
+}
+
+func TestPendingCancel(t *testing.T) {
+	var p Pending
+
+	ch, cancel := p.Register(1)
+	cancel()
+	cancel()
+
+	if p.Resolve(1, &IMsg{}) {
+		t.Fatalf("cancelled request was resolved")
+	}
+	if im, ok := <-ch; ok {
+		t.Fatalf("cancelled request received a reply (%v)", im)
+	}
+	if p.Len() != 0 {
+		t.Fatalf("pending table was not emptied (%d entries)", p.Len())
+	}
+}
+
+func TestPendingReregister(t *testing.T) {
+	var p Pending
+
+	first, cancelFirst := p.Register(1)
+	second, cancelSecond := p.Register(1)
+	defer cancelSecond()
+
+	if _, ok := <-first; ok {
+		t.Fatalf("superseded request was not cancelled")
+	}
+
+	// Cancelling the superseded request leaves the new one pending.
+	cancelFirst()
+	reply := &IMsg{}
+	if !p.Resolve(1, reply) || <-second != reply {
+		t.Fatalf("new request was not resolved")
+	}
+}
+
+func TestPendingExpiry(t *testing.T) {
+	var p Pending
+
+	ctx, cancelCtx := context.WithCancel(context.Background())
+	ch, cancel := p.RegisterContext(ctx, 1)
+	defer cancel()
+	cancelCtx()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatalf("expired request received a reply")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("request did not expire with its context")
+	}
+	if p.Resolve(1, &IMsg{}) {
+		t.Fatalf("expired request was resolved")
+	}
+
+	ch, cancel = p.RegisterTimeout(2, 10*time.Millisecond)
+	defer cancel()
+	select {
+	case _, ok := <-ch:
+		if ok {
+			t.Fatalf("expired request received a reply")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("request did not expire after its timeout")
+	}
+	if p.Len() != 0 {
+		t.Fatalf("pending table was not emptied (%d entries)", p.Len())
+	}
+
+	// A request resolved before its timeout receives its reply.
+	ch, cancel = p.RegisterTimeout(3, time.Hour)
+	defer cancel()
+	reply := &IMsg{}
+	if !p.Resolve(3, reply) || <-ch != reply {
+		t.Fatalf("request was not resolved before its timeout")
+	}
+}
+
+func TestPendingConcurrent(t *testing.T) {
+	var p Pending
+
+	const (
+		workers  = 8
+		requests = 200
+	)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < requests; i++ {
+				id := uint32(w*requests + i)
+				ch, cancel := p.Register(id)
+
+				// Every third request is abandoned, racing with its reply.
+				resolved := make(chan bool, 1)
+				go func() {
+					resolved <- p.Resolve(id, &IMsg{PeerID: id})
+				}()
+				if i%3 == 0 {
+					cancel()
+					if <-resolved {
+						if im, ok := <-ch; !ok || im.PeerID != id {
+							t.Errorf("resolved request %d received no reply", id)
+						}
+					}
+					continue
+				}
+
+				im := <-ch
+				cancel()
+				if im == nil || im.PeerID != id || !<-resolved {
+					t.Errorf("request %d received an unexpected reply (%v)", id, im)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if p.Len() != 0 {
+		t.Fatalf("pending table was not emptied (%d entries)", p.Len())
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"os"
+	"sync/atomic"
+)
+
+// This holds the function used to fill in the PID field of composed imsgs. A
+// nil function leaves the PID field zero.
+type pidSource struct {
+	f func() uint32
+}
+
+// This is the package-level PID source, which defaults to os.Getpid.
+var pidFunc atomic.Pointer[pidSource]
+
+func init() {
+	pidFunc.Store(&pidSource{getpid})
+}
+
+// getpid returns the PID of the current process.
+func getpid() uint32 {
+	return uint32(os.Getpid())
+}
+
+// SetPIDFunc sets the function consulted to fill in the PID field of imsgs
+// composed by this package, which defaults to one calling os.Getpid. This is
+// useful within PID namespaces, where the peer knows the process by a different
+// PID, and for proxies which compose imsgs on behalf of other processes. If f
+// is nil, the PID field is left zero. A Conn may override this with
+// WithPIDFunc.
+func SetPIDFunc(f func() uint32) {
+	pidFunc.Store(&pidSource{f})
+}
+
+// currentPID returns the PID with which composed imsgs are stamped.
+func currentPID() uint32 {
+	src := pidFunc.Load()
+	if src.f == nil {
+		return 0
+	}
+
+	return src.f()
+}
+
+// WithPIDFunc sets the function consulted to fill in the PID field of imsgs
+// composed by the Conn, overriding the package-level function set by
+// SetPIDFunc. If f is nil, the PID field is left zero.
+func WithPIDFunc(f func() uint32) ConnOption {
+	return func(c *Conn) {
+		c.pidSrc = &pidSource{f}
+	}
+}
+
+// pid returns the PID with which imsgs composed by the Conn are stamped.
+func (c *Conn) pid() uint32 {
+	if c.pidSrc == nil {
+		return currentPID()
+	}
+	if c.pidSrc.f == nil {
+		return 0
+	}
+
+	return c.pidSrc.f()
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"os"
+	"testing"
+)
+
+// setTestPIDFunc sets the package-level PID source for the duration of a test.
+func setTestPIDFunc(t *testing.T, f func() uint32) {
+	prev := pidFunc.Load()
+	t.Cleanup(func() { pidFunc.Store(prev) })
+
+	SetPIDFunc(f)
+}
+
+func TestDefaultPIDFunc(t *testing.T) {
+	im, err := ComposeIMsg(1, 2, nil)
+	if err != nil {
+		t.Fatalf("unexpected ComposeIMsg failure: %s", err)
+	}
+	if im.PID != uint32(os.Getpid()) {
+		t.Fatalf("unexpected default PID (%d != %d)", im.PID, os.Getpid())
+	}
+}
+
+func TestSetPIDFunc(t *testing.T) {
+	var calls int
+	setTestPIDFunc(t, func() uint32 {
+		calls++
+		return 4242
+	})
+
+	for _, compose := range []func() (*IMsg, error){
+		func() (*IMsg, error) { return ComposeIMsg(1, 2, nil) },
+		func() (*IMsg, error) { return ComposeIMsgv(1, 2, []byte("a"), []byte("b")) },
+		func() (*IMsg, error) { return ComposeStringIMsg(1, 2, "test") },
+		func() (*IMsg, error) { return ComposeTyped(1, 2, uint32(0)) },
+	} {
+		im, err := compose()
+		if err != nil {
+			t.Fatalf("unexpected compose failure: %s", err)
+		}
+		if im.PID != 4242 {
+			t.Fatalf("PID function was not used (%d)", im.PID)
+		}
+	}
+	if calls != 4 {
+		t.Fatalf("unexpected number of PID function calls (%d != 4)", calls)
+	}
+
+	// Explicit options still take precedence.
+	im, _ := ComposeIMsg(1, 2, nil, WithPID(7))
+	if im.PID != 7 {
+		t.Fatalf("WithPID was overridden by the PID function (%d)", im.PID)
+	}
+
+	SetPIDFunc(nil)
+	im, _ = ComposeIMsg(1, 2, nil)
+	if im.PID != 0 {
+		t.Fatalf("nil PID function did not leave PID zero (%d)", im.PID)
+	}
+}
+
+func TestWithPIDFunc(t *testing.T) {
+	setTestPIDFunc(t, func() uint32 { return 1 })
+
+	c := NewConn(nil)
+	if c.pid() != 1 {
+		t.Fatalf("Conn did not use package-level PID function (%d)", c.pid())
+	}
+
+	c = NewConn(nil, WithPIDFunc(func() uint32 { return 2 }))
+	if c.pid() != 2 {
+		t.Fatalf("Conn did not use its own PID function (%d)", c.pid())
+	}
+
+	c = NewConn(nil, WithPIDFunc(nil))
+	if c.pid() != 0 {
+		t.Fatalf("Conn with nil PID function did not leave PID zero (%d)", c.pid())
+	}
+}
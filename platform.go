@@ -0,0 +1,18 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+// SupportsFDPassing reports whether descriptors can be passed over unix domain
+// sockets on this platform. Where they can't, SocketPair returns
+// ErrUnsupportedPlatform, and imsgs with attached files can't be sent.
+func SupportsFDPassing() bool {
+	return fdPassing
+}
+
+// SupportsPeerCred reports whether the credentials of the process on the other
+// end of a unix domain socket can be looked up with PeerCred on this platform.
+func SupportsPeerCred() bool {
+	return peerCredSupported
+}
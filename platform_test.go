@@ -0,0 +1,59 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+)
+
+func TestSupportsFDPassing(t *testing.T) {
+	a, b, err := SocketPair()
+	if SupportsFDPassing() {
+		if err != nil {
+			t.Fatalf("unexpected SocketPair failure: %s", err)
+		}
+		a.Close()
+		b.Close()
+		return
+	}
+
+	var platform *ErrUnsupportedPlatform
+	if !errors.As(err, &platform) || platform.GOOS != runtime.GOOS {
+		t.Fatalf("expected ErrUnsupportedPlatform, got: %v", err)
+	}
+	var unsupported *ErrUnsupported
+	if !errors.As(err, &unsupported) {
+		t.Fatalf("ErrUnsupportedPlatform does not wrap ErrUnsupported")
+	}
+}
+
+func TestSupportsPeerCred(t *testing.T) {
+	switch runtime.GOOS {
+	case "linux", "darwin", "freebsd", "netbsd", "openbsd":
+		if !SupportsPeerCred() {
+			t.Fatalf("peer credentials reported unsupported on %s", runtime.GOOS)
+		}
+	default:
+		if SupportsPeerCred() {
+			t.Fatalf("peer credentials reported supported on %s", runtime.GOOS)
+		}
+	}
+
+	if !SupportsPeerCred() || !SupportsFDPassing() {
+		return
+	}
+	a, b, err := SocketPair()
+	if err != nil {
+		t.Fatalf("unexpected SocketPair failure: %s", err)
+	}
+	defer a.Close()
+	defer b.Close()
+	_, err = a.PeerCred()
+	if err != nil {
+		t.Fatalf("unexpected PeerCred failure: %s", err)
+	}
+}
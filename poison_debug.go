@@ -0,0 +1,15 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build imsgdebug
+
+package imsg
+
+// poisonReleased is set when built with the imsgdebug tag, causing buffers
+// which callers may no longer use to be poisoned.
+const poisonReleased = true
+
+// checkPeeked is set when built with the imsgdebug tag, causing imsgs returned
+// by Buffer.Peek to be checked for modification once they're dequeued.
+const checkPeeked = true
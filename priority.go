@@ -0,0 +1,123 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+// A Priority determines the order in which queued imsgs are written.
+type Priority int
+
+const (
+	// PriorityLow is for bulk data which may wait behind everything else.
+	PriorityLow Priority = -1
+	// PriorityNormal is the priority of imsgs composed without WithPriority.
+	PriorityNormal Priority = 0
+	// PriorityHigh is for control imsgs, such as shutdown requests, which
+	// should be written ahead of anything else queued.
+	PriorityHigh Priority = 1
+)
+
+// This is the number of priorities, each of which has its own lane in a send
+// queue.
+const numPriorities = 3
+
+// WithPriority sets the priority with which the IMsg is queued by a Conn or
+// MsgBuf. Queued imsgs are written strictly in order of priority, and in the
+// order they were queued within a priority, except that an imsg which has
+// begun to be written is always completed first, so the stream remains intact.
+// An imsg of a higher priority may therefore overtake one sent before it by the
+// same goroutine. A priority outside of the range of PriorityLow to
+// PriorityHigh is treated as the nearest one within it.
+func WithPriority(p Priority) ComposeOption {
+	return func(c *composeConfig) {
+		c.prio = clampPriority(p)
+	}
+}
+
+// SetPriorityLimit limits the number of imsgs of the provided priority which
+// may be queued at once, where a limit of zero means no limit. When queueing an
+// imsg would exceed the limit, the policy set with SetQueueLimit applies, and
+// QueueDropOldest discards the oldest imsg of that priority. As with the limits
+// of the whole queue, an imsg is always accepted when none of its priority are
+// queued.
+func (m *MsgBuf) SetPriorityLimit(p Priority, maxMessages int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.limitLanes[laneIndex(clampPriority(p))] = maxMessages
+	m.signalSpace()
+}
+
+// WithSendPriorityLimit limits the send queue of the Conn as described by
+// MsgBuf.SetPriorityLimit.
+func WithSendPriorityLimit(p Priority, maxMessages int) ConnOption {
+	return func(c *Conn) {
+		c.wq.SetPriorityLimit(p, maxMessages)
+	}
+}
+
+// clampPriority returns the priority nearest to p which has a lane.
+func clampPriority(p Priority) Priority {
+	switch {
+	case p < PriorityLow:
+		return PriorityLow
+	case p > PriorityHigh:
+		return PriorityHigh
+	}
+
+	return p
+}
+
+// laneIndex returns the index of the lane of priority p, with the lane of
+// PriorityHigh first.
+func laneIndex(p Priority) int {
+	return int(PriorityHigh - p)
+}
+
+// lanePriority returns the priority of the lane at index i.
+func lanePriority(i int) Priority {
+	return PriorityHigh - Priority(i)
+}
+
+// countPriority returns the number of entries of priority p.
+func countPriority(es []msgBufEntry, p Priority) int {
+	var n int
+	for i := range es {
+		if es[i].prio == p {
+			n++
+		}
+	}
+
+	return n
+}
+
+// unstarted returns the index of the first queued entry which hasn't begun to
+// be written. The caller must hold mu.
+func (m *MsgBuf) unstarted() int {
+	if m.inflight == 0 && m.off > 0 {
+		return 1
+	}
+
+	return m.inflight
+}
+
+// insert adds an entry to the queue behind every entry of the same or higher
+// priority and every entry which has begun to be written. The caller must hold
+// mu.
+func (m *MsgBuf) insert(e msgBufEntry) {
+	i := len(m.q)
+	start := m.unstarted()
+	for i > start && m.q[i-1].prio < e.prio {
+		i--
+	}
+
+	m.q = append(m.q, msgBufEntry{})
+	copy(m.q[i+1:], m.q[i:])
+	m.q[i] = e
+}
+
+// laneLen returns the number of queued entries of priority p. The caller must
+// hold mu.
+func (m *MsgBuf) laneLen(p Priority) int {
+	return countPriority(m.q, p)
+}
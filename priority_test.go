@@ -0,0 +1,117 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// enqueueTestPriority queues an imsg of the provided type and priority.
+func enqueueTestPriority(t *testing.T, m *MsgBuf, typ uint32, p Priority) error {
+	t.Helper()
+
+	im, err := ComposeIMsg(typ, 0, []byte("test"), WithPriority(p))
+	if err != nil {
+		t.Fatalf("unexpected ComposeIMsg failure: %s", err)
+	}
+
+	return m.Enqueue(im)
+}
+
+func TestMsgBufPriority(t *testing.T) {
+	// The writer accepts only part of the first imsg before blocking.
+	w := &throttledWriter{perCall: 1024, budget: 5}
+	m := NewMsgBuf(w)
+
+	err := enqueueTestPriority(t, m, 1, PriorityNormal)
+	if err != nil {
+		t.Fatalf("unexpected Enqueue failure: %s", err)
+	}
+	_, err = m.Flush()
+	if !errors.Is(err, errFull) {
+		t.Fatalf("expected errFull, got: %v", err)
+	}
+
+	queued := []struct {
+		typ  uint32
+		prio Priority
+	}{
+		{2, PriorityLow},
+		{3, PriorityHigh},
+		{4, PriorityNormal},
+		{5, PriorityHigh},
+		{6, PriorityLow},
+		{7, PriorityNormal},
+	}
+	for _, q := range queued {
+		err := enqueueTestPriority(t, m, q.typ, q.prio)
+		if err != nil {
+			t.Fatalf("unexpected Enqueue failure: %s", err)
+		}
+	}
+
+	var s Stats
+	m.fillStats(&s)
+	if s.SendQueueHigh != 2 || s.SendQueueNormal != 3 || s.SendQueueLow != 2 {
+		t.Fatalf("unexpected lane lengths (%d, %d, %d)", s.SendQueueHigh, s.SendQueueNormal, s.SendQueueLow)
+	}
+
+	// The partially written imsg is completed ahead of the higher priorities.
+	w.budget = 1024
+	_, err = m.Flush()
+	if err != nil {
+		t.Fatalf("unexpected Flush failure: %s", err)
+	}
+	r := bytes.NewReader(w.Bytes())
+	for _, typ := range []uint32{1, 3, 5, 4, 7, 2, 6} {
+		im, err := ReadIMsg(r)
+		if err != nil || im.Type != typ {
+			t.Fatalf("unexpected ReadIMsg result (%v, %v)", im, err)
+		}
+	}
+}
+
+func TestMsgBufPriorityLimit(t *testing.T) {
+	m := NewMsgBuf(&throttledWriter{})
+	m.SetQueueLimit(0, 0, QueueError)
+	m.SetPriorityLimit(PriorityLow, 2)
+
+	for typ := uint32(0); typ < 2; typ++ {
+		err := enqueueTestPriority(t, m, typ, PriorityLow)
+		if err != nil {
+			t.Fatalf("unexpected Enqueue failure: %s", err)
+		}
+	}
+	var full *ErrQueueFull
+	err := enqueueTestPriority(t, m, 2, PriorityLow)
+	if !errors.As(err, &full) {
+		t.Fatalf("expected ErrQueueFull, got: %v", err)
+	}
+
+	// Other priorities are unaffected.
+	err = enqueueTestPriority(t, m, 3, PriorityHigh)
+	if err != nil {
+		t.Fatalf("unexpected Enqueue failure: %s", err)
+	}
+
+	// Dropping discards the oldest imsg of the full lane.
+	m.SetQueueLimit(0, 0, QueueDropOldest)
+	err = enqueueTestPriority(t, m, 4, PriorityLow)
+	if err != nil {
+		t.Fatalf("unexpected Enqueue failure: %s", err)
+	}
+	if m.Dropped() != 1 || m.QueueLen() != 3 {
+		t.Fatalf("unexpected queue state (%d dropped, %d queued)", m.Dropped(), m.QueueLen())
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, typ := range []uint32{3, 1, 4} {
+		if got := m.order.Uint32(m.q[i].bs[0:4]); got != typ {
+			t.Fatalf("unexpected queued imsg %d (type %d != %d)", i, got, typ)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package privsep
+
+import "fmt"
+
+// ErrUnknownRole is returned when starting or running a child whose role
+// wasn't passed to Main.
+type ErrUnknownRole struct {
+	Role string
+}
+
+// Error implements the error interface.
+func (e *ErrUnknownRole) Error() string {
+	return fmt.Sprintf("privsep: unknown role %q", e.Role)
+}
+
+// ErrPrivDrop is reported by a child when the function set by WithPrivDrop
+// fails.
+type ErrPrivDrop struct {
+	Role string
+	Err  error
+}
+
+// Error implements the error interface.
+func (e *ErrPrivDrop) Error() string {
+	return fmt.Sprintf("privsep: dropping privileges for %s: %s", e.Role, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *ErrPrivDrop) Unwrap() error {
+	return e.Err
+}
@@ -0,0 +1,197 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+// Package privsep provides the scaffolding of an OpenBSD-style privilege
+// separated program, in which a parent process re-executes itself once for
+// each child role, communicating with each child over an imsg channel on an
+// inherited socket. The child drops its privileges before running the code for
+// its role.
+//
+// A program calls Main at the start of its main function with the functions
+// implementing its roles. In the parent, Main returns a Parent with which to
+// start children; in a child, Main runs the function for the child's role and
+// exits.
+package privsep
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+
+	imsg "github.com/schultz-is/go-imsg"
+)
+
+// The role of a child is passed to it in this environment variable, which
+// distinguishes it from the parent.
+const roleEnv = "IMSG_PRIVSEP_ROLE"
+
+// A child inherits its end of the imsg channel as this descriptor, the first
+// after standard error.
+const childFD = 3
+
+// A ChildFunc implements a child role, communicating with the parent over the
+// provided Conn. When it returns, the child exits, successfully if it returns
+// nil or io.EOF, which a ChildFunc typically receives once the parent closes
+// its end of the channel.
+type ChildFunc func(c *imsg.Conn) error
+
+// An Option configures Main.
+type Option func(*config)
+
+// This is the configuration set by Options.
+type config struct {
+	drop     func(role string) error
+	connOpts []imsg.ConnOption
+}
+
+// WithPrivDrop sets a function which a child calls with its role before running
+// the ChildFunc for it, and which is expected to drop the child's privileges,
+// such as by calling chroot and setuid. If it fails, the child exits without
+// running the ChildFunc.
+func WithPrivDrop(f func(role string) error) Option {
+	return func(cfg *config) {
+		cfg.drop = f
+	}
+}
+
+// WithConnOptions applies the provided options to the Conns on both ends of
+// each imsg channel.
+func WithConnOptions(opts ...imsg.ConnOption) Option {
+	return func(cfg *config) {
+		cfg.connOpts = append(cfg.connOpts, opts...)
+	}
+}
+
+// Main determines whether this process is the parent or a child. In the
+// parent, it returns a Parent which starts children with the provided roles.
+// In a child, it never returns: it builds a Conn from the inherited socket,
+// drops privileges with the function set by WithPrivDrop, if any, runs the
+// ChildFunc for the child's role, and exits, reporting any failure on standard
+// error and exiting with a status of 1.
+//
+// Main should be called before the program does anything else, since a child
+// runs the same program with the same arguments as the parent.
+func Main(roles map[string]ChildFunc, opts ...Option) (*Parent, error) {
+	var cfg config
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	role, ok := os.LookupEnv(roleEnv)
+	if !ok {
+		return &Parent{roles: roles, cfg: cfg}, nil
+	}
+
+	// Children of the child are parents in their own right.
+	os.Unsetenv(roleEnv)
+
+	err := runChild(role, roles, &cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "privsep: %s: %s\n", role, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+
+	return nil, nil
+}
+
+// runChild runs the ChildFunc for the provided role.
+func runChild(role string, roles map[string]ChildFunc, cfg *config) error {
+	f, ok := roles[role]
+	if !ok {
+		return &ErrUnknownRole{role}
+	}
+
+	c, err := childConn(cfg.connOpts)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if cfg.drop != nil {
+		err = cfg.drop(role)
+		if err != nil {
+			return &ErrPrivDrop{role, err}
+		}
+	}
+
+	err = f(c)
+	if err == io.EOF {
+		return nil
+	}
+
+	return err
+}
+
+// A Parent starts the children of a privilege separated program.
+type Parent struct {
+	roles map[string]ChildFunc
+	cfg   config
+
+	mu   sync.Mutex
+	cmds []*exec.Cmd
+}
+
+// StartChild starts a child with the provided role by re-executing the
+// program with the same arguments, and returns the Conn over which to
+// communicate with it. Descriptor passing is allowed on both ends. Closing the
+// Conn signals the child to exit, which Wait then waits for. ErrUnknownRole is
+// returned if the role wasn't passed to Main.
+func (p *Parent) StartChild(role string) (*imsg.Conn, error) {
+	if _, ok := p.roles[role]; !ok {
+		return nil, &ErrUnknownRole{role}
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	local, remote, err := socketPair()
+	if err != nil {
+		return nil, err
+	}
+	defer remote.Close()
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), roleEnv+"="+role)
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err = cmd.Start()
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+
+	p.mu.Lock()
+	p.cmds = append(p.cmds, cmd)
+	p.mu.Unlock()
+
+	c := imsg.NewConn(local, p.cfg.connOpts...)
+	c.AllowFDPass(true)
+
+	return c, nil
+}
+
+// Wait waits for every child started so far to exit, returning the first
+// failure, such as an *exec.ExitError for a child which exited unsuccessfully.
+func (p *Parent) Wait() error {
+	p.mu.Lock()
+	cmds := p.cmds
+	p.cmds = nil
+	p.mu.Unlock()
+
+	var first error
+	for _, cmd := range cmds {
+		err := cmd.Wait()
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+
+	return first
+}
@@ -0,0 +1,25 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build !unix
+
+package privsep
+
+import (
+	"net"
+	"os"
+	"runtime"
+
+	imsg "github.com/schultz-is/go-imsg"
+)
+
+// socketPair is unsupported on this platform.
+func socketPair() (net.Conn, *os.File, error) {
+	return nil, nil, &imsg.ErrUnsupportedPlatform{Feature: "privilege separation", GOOS: runtime.GOOS}
+}
+
+// childConn is unsupported on this platform.
+func childConn(opts []imsg.ConnOption) (*imsg.Conn, error) {
+	return nil, &imsg.ErrUnsupportedPlatform{Feature: "privilege separation", GOOS: runtime.GOOS}
+}
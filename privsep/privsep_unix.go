@@ -0,0 +1,59 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package privsep
+
+import (
+	"net"
+	"os"
+	"syscall"
+
+	imsg "github.com/schultz-is/go-imsg"
+	"golang.org/x/sys/unix"
+)
+
+// socketPair constructs a connected pair of unix domain sockets, returning the
+// parent's end as a net.Conn and the child's as a file for it to inherit.
+func socketPair() (net.Conn, *os.File, error) {
+	// SOCK_CLOEXEC isn't available everywhere, so the descriptors are marked
+	// close-on-exec separately, holding the fork lock so that no child started
+	// in between inherits them.
+	syscall.ForkLock.RLock()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err == nil {
+		unix.CloseOnExec(fds[0])
+		unix.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+	if err != nil {
+		return nil, nil, os.NewSyscallError("socketpair", err)
+	}
+
+	f := os.NewFile(uintptr(fds[0]), "privsep-parent")
+	defer f.Close()
+	local, err := net.FileConn(f)
+	if err != nil {
+		unix.Close(fds[1])
+		return nil, nil, err
+	}
+
+	return local, os.NewFile(uintptr(fds[1]), "privsep-child"), nil
+}
+
+// childConn builds a Conn from the socket inherited by a child.
+func childConn(opts []imsg.ConnOption) (*imsg.Conn, error) {
+	f := os.NewFile(childFD, "privsep-child")
+	defer f.Close()
+
+	conn, err := net.FileConn(f)
+	if err != nil {
+		return nil, err
+	}
+	c := imsg.NewConn(conn, opts...)
+	c.AllowFDPass(true)
+
+	return c, nil
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package privsep
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	imsg "github.com/schultz-is/go-imsg"
+)
+
+const (
+	testTypeData    = 1
+	testTypeDropped = 2
+)
+
+// The role recorded by the privilege dropping hook in a child.
+var droppedRole string
+
+// The roles of the test children, which answer imsgs of testTypeData with a
+// transformation of their data and imsgs of testTypeDropped with the role for
+// which privileges were dropped.
+var testRoles = map[string]ChildFunc{
+	"echo":    serveTestRole(func(b []byte) []byte { return b }),
+	"reverse": serveTestRole(reverse),
+}
+
+var testParent *Parent
+
+func TestMain(m *testing.M) {
+	var err error
+	testParent, err = Main(testRoles, WithPrivDrop(func(role string) error {
+		droppedRole = role
+		return nil
+	}))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "unexpected Main failure: %s\n", err)
+		os.Exit(1)
+	}
+
+	os.Exit(m.Run())
+}
+
+// serveTestRole returns a ChildFunc which answers imsgs until EOF.
+func serveTestRole(transform func([]byte) []byte) ChildFunc {
+	return func(c *imsg.Conn) error {
+		for {
+			im, err := c.Recv()
+			if err != nil {
+				return err
+			}
+			reply := &imsg.IMsg{Type: im.Type}
+			switch im.Type {
+			case testTypeData:
+				reply.Data = transform(im.Data)
+			case testTypeDropped:
+				reply.Data = []byte(droppedRole)
+			}
+			err = c.Send(reply)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// reverse returns a reversed copy of b.
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i := range b {
+		r[len(b)-1-i] = b[i]
+	}
+
+	return r
+}
+
+func TestParentChildren(t *testing.T) {
+	tests := []struct {
+		role string
+		want []byte
+	}{
+		{"echo", []byte("privsep")},
+		{"reverse", []byte("pesvirp")},
+	}
+
+	conns := make([]*imsg.Conn, len(tests))
+	for i, test := range tests {
+		c, err := testParent.StartChild(test.role)
+		if err != nil {
+			t.Fatalf("unexpected StartChild failure: %s", err)
+		}
+		conns[i] = c
+	}
+
+	for i, test := range tests {
+		c := conns[i]
+		err := c.Send(&imsg.IMsg{Type: testTypeData, Data: []byte("privsep")})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+		im, err := c.Recv()
+		if err != nil || !bytes.Equal(im.Data, test.want) {
+			t.Fatalf("unexpected reply from %s (%v, %v)", test.role, im, err)
+		}
+
+		// Privileges were dropped for the child's own role.
+		err = c.Send(&imsg.IMsg{Type: testTypeDropped})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+		im, err = c.Recv()
+		if err != nil || string(im.Data) != test.role {
+			t.Fatalf("unexpected reply from %s (%v, %v)", test.role, im, err)
+		}
+	}
+
+	// Closing the channels lets the children exit cleanly.
+	for _, c := range conns {
+		c.Close()
+	}
+	err := testParent.Wait()
+	if err != nil {
+		t.Fatalf("unexpected Wait failure: %s", err)
+	}
+}
+
+func TestParentUnknownRole(t *testing.T) {
+	_, err := testParent.StartChild("nonexistent")
+	var unknown *ErrUnknownRole
+	if !errors.As(err, &unknown) || unknown.Role != "nonexistent" {
+		t.Fatalf("expected ErrUnknownRole, got: %v", err)
+	}
+}
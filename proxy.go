@@ -0,0 +1,121 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// A ProxyFunc inspects an imsg being forwarded by Proxy, returning the imsg to
+// forward in its place. The imsg may be modified or replaced. Returning a nil
+// IMsg drops it, and returning an error stops the Proxy.
+type ProxyFunc func(*IMsg) (*IMsg, error)
+
+// A ProxyOption configures optional behavior of Proxy.
+type ProxyOption func(*proxyConfig)
+
+type proxyConfig struct {
+	aToB ProxyFunc
+	bToA ProxyFunc
+}
+
+// WithAToB sets a function which inspects each imsg forwarded from a to b.
+func WithAToB(f ProxyFunc) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.aToB = f
+	}
+}
+
+// WithBToA sets a function which inspects each imsg forwarded from b to a.
+func WithBToA(f ProxyFunc) ProxyOption {
+	return func(cfg *proxyConfig) {
+		cfg.bToA = f
+	}
+}
+
+// Proxy forwards imsgs received from a to b, and those received from b to a,
+// until the context is cancelled or either direction fails. The fields and
+// flags of each imsg are preserved, and attached descriptors are forwarded,
+// which requires descriptor passing to be allowed on both Conns. The first
+// failure in either direction stops both and is returned; if it's the clean
+// closure of a connection, nil is returned. If the context is cancelled, its
+// error is returned.
+func Proxy(ctx context.Context, a, b *Conn, opts ...ProxyOption) error {
+	var cfg proxyConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	pctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		once sync.Once
+		err  error
+		wg   sync.WaitGroup
+	)
+	pump := func(src, dst *Conn, f ProxyFunc) {
+		defer wg.Done()
+		perr := proxyPump(pctx, src, dst, f)
+		once.Do(func() {
+			err = perr
+			cancel()
+		})
+	}
+
+	wg.Add(2)
+	go pump(a, b, cfg.aToB)
+	go pump(b, a, cfg.bToA)
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// proxyPump forwards imsgs from src to dst until the context is cancelled or
+// either Conn fails. The clean closure of src is reported as a nil error.
+func proxyPump(ctx context.Context, src, dst *Conn, f ProxyFunc) error {
+	defer src.interruptOnDone(ctx)()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		im, err := src.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		if f != nil {
+			out, err := f(im)
+			if out == nil || err != nil {
+				im.closeFile()
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			im = out
+		}
+
+		err = dst.Send(im)
+		if err != nil {
+			im.closeFile()
+			return err
+		}
+	}
+}
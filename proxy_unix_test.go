@@ -0,0 +1,127 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestProxy(t *testing.T) {
+	parent, pa := newTestSocketPair(t)
+	pb, child := newTestSocketPair(t)
+	for _, c := range []*Conn{parent, pa, pb, child} {
+		c.AllowFDPass(true)
+	}
+
+	const dropped = 99
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() {
+		errc <- Proxy(ctx, pa, pb,
+			WithAToB(func(im *IMsg) (*IMsg, error) {
+				if im.Type == dropped {
+					return nil, nil
+				}
+				return im, nil
+			}),
+			WithBToA(func(im *IMsg) (*IMsg, error) {
+				im.PeerID = 42
+				return im, nil
+			}),
+		)
+	}()
+
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("failed to open %s: %s", os.DevNull, err)
+	}
+	im, _ := ComposeIMsgWithFile(1, 2, []byte("test"), f)
+	for _, im := range []*IMsg{{Type: dropped}, im} {
+		err = parent.Send(im)
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+
+	im, err = child.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	if im.Type != 1 || im.PeerID != 2 || string(im.Data) != "test" {
+		t.Fatalf("forwarded imsg has unexpected contents (%v)", im)
+	}
+	if !im.HasFD() || im.File() == nil {
+		t.Fatalf("forwarded imsg is missing its descriptor")
+	}
+	im.File().Close()
+
+	err = child.Send(&IMsg{Type: 3, PeerID: 7})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	im, err = parent.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	if im.Type != 3 || im.PeerID != 42 {
+		t.Fatalf("reverse imsg was not rewritten (%v)", im)
+	}
+
+	cancel()
+	select {
+	case err = <-errc:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Proxy did not return after cancellation")
+	}
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+}
+
+func TestProxyFailure(t *testing.T) {
+	parent, pa := newTestSocketPair(t)
+	pb, child := newTestSocketPair(t)
+
+	errTest := errors.New("test")
+	errc := make(chan error, 1)
+	go func() {
+		errc <- Proxy(context.Background(), pa, pb,
+			WithBToA(func(*IMsg) (*IMsg, error) { return nil, errTest }),
+		)
+	}()
+
+	err := child.Send(&IMsg{Type: 1})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+
+	// The failure in one direction stops the other as well.
+	select {
+	case err = <-errc:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Proxy did not return after failure")
+	}
+	if err != errTest {
+		t.Fatalf("expected callback error, got: %v", err)
+	}
+
+	// Closure of one side ends the Proxy cleanly.
+	go func() { errc <- Proxy(context.Background(), pa, pb) }()
+	parent.Close()
+	select {
+	case err = <-errc:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Proxy did not return after closure")
+	}
+	if err != nil {
+		t.Fatalf("expected clean closure, got: %v", err)
+	}
+}
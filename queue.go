@@ -0,0 +1,159 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+)
+
+// A QueuePolicy determines what happens when an imsg is queued for sending
+// while the send queue is at its limit.
+type QueuePolicy int
+
+const (
+	// QueueBlock waits until enough of the queue has been written to make
+	// room, or until the context is done.
+	QueueBlock QueuePolicy = iota
+	// QueueError refuses the imsg with ErrQueueFull.
+	QueueError
+	// QueueDropOldest discards the oldest imsgs which haven't begun to be
+	// written until there's room, counting them as dropped.
+	QueueDropOldest
+)
+
+// SetQueueLimit limits the send queue to maxMessages imsgs and maxBytes bytes
+// which have yet to be written, where a limit of zero means no limit. The
+// unwritten remainder of a partially written imsg counts against both limits.
+// When queueing an imsg would exceed a limit, the provided policy applies. An
+// imsg is always accepted by an empty queue, so an imsg larger than maxBytes
+// may still be sent.
+func (m *MsgBuf) SetQueueLimit(maxMessages, maxBytes int, policy QueuePolicy) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.limitMsgs = maxMessages
+	m.limitBytes = maxBytes
+	m.policy = policy
+	m.signalSpace()
+}
+
+// Dropped returns the number of queued imsgs which have been discarded under
+// the QueueDropOldest policy.
+func (m *MsgBuf) Dropped() uint64 {
+	return m.dropped.Load()
+}
+
+// SetQueueLimit limits the send queue as described by MsgBuf.SetQueueLimit.
+func (b *Buffer) SetQueueLimit(maxMessages, maxBytes int, policy QueuePolicy) {
+	b.wq.SetQueueLimit(maxMessages, maxBytes, policy)
+}
+
+// WithSendQueueLimit limits the send queue of the Conn as described by
+// MsgBuf.SetQueueLimit. Imsgs are queued while an earlier imsg is being
+// written, so the queue grows when the peer stops reading.
+func WithSendQueueLimit(maxMessages, maxBytes int, policy QueuePolicy) ConnOption {
+	return func(c *Conn) {
+		c.wq.SetQueueLimit(maxMessages, maxBytes, policy)
+	}
+}
+
+// full reports whether queueing the provided entries, totaling size bytes,
+// would exceed a limit. If only the limit on the entries of a particular
+// priority would be exceeded, a function matching the entries of that priority
+// is returned as well. The caller must hold mu.
+func (m *MsgBuf) full(es []msgBufEntry, size int) (bool, func(*msgBufEntry) bool) {
+	if len(m.q) == 0 {
+		return false, nil
+	}
+
+	if (m.limitMsgs > 0 && len(m.q)+len(es) > m.limitMsgs) ||
+		(m.limitBytes > 0 && m.pending+size > m.limitBytes) {
+		return true, nil
+	}
+
+	for i, limit := range m.limitLanes {
+		if limit == 0 {
+			continue
+		}
+		p := lanePriority(i)
+		queued := m.laneLen(p)
+		if queued > 0 && queued+countPriority(es, p) > limit {
+			return true, func(e *msgBufEntry) bool { return e.prio == p }
+		}
+	}
+
+	return false, nil
+}
+
+// makeRoom applies the queue policy until the provided entries, totaling size
+// bytes, may be queued. The caller must hold mu, which is released while
+// waiting.
+func (m *MsgBuf) makeRoom(ctx context.Context, es []msgBufEntry, size int) error {
+	for {
+		full, lane := m.full(es, size)
+		if !full {
+			return nil
+		}
+
+		switch m.policy {
+		case QueueError:
+			return &ErrQueueFull{Messages: len(m.q), Bytes: m.pending}
+		case QueueDropOldest:
+			if !m.dropOldest(lane) {
+				return &ErrQueueFull{Messages: len(m.q), Bytes: m.pending}
+			}
+		default:
+			if m.space == nil {
+				m.space = make(chan struct{})
+			}
+			space := m.space
+
+			m.mu.Unlock()
+			select {
+			case <-space:
+			case <-ctx.Done():
+			}
+			m.mu.Lock()
+
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// dropOldest discards the oldest entry which hasn't begun to be written and,
+// if match isn't nil, which satisfies it, reporting whether there was one. The
+// caller must hold mu.
+func (m *MsgBuf) dropOldest(match func(*msgBufEntry) bool) bool {
+	i := m.unstarted()
+	for i < len(m.q) && match != nil && !match(&m.q[i]) {
+		i++
+	}
+	if i >= len(m.q) {
+		return false
+	}
+
+	e := m.q[i]
+	if e.file != nil {
+		e.file.Close()
+	}
+	m.pending -= e.len()
+	m.discharge(&e)
+	e.release()
+	m.q = append(m.q[:i], m.q[i+1:]...)
+	m.dropped.Add(1)
+	m.metrics.OnQueueDepth(len(m.q))
+
+	return true
+}
+
+// signalSpace wakes any waiters in makeRoom. The caller must hold mu.
+func (m *MsgBuf) signalSpace() {
+	if m.space != nil {
+		close(m.space)
+		m.space = nil
+	}
+}
@@ -0,0 +1,173 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// This is a writer which accepts up to budget bytes and then stops draining,
+// failing every write until it's given more budget.
+type stalledWriter struct {
+	buf    bytes.Buffer
+	budget int
+}
+
+var errStalled = errors.New("stalled")
+
+func (w *stalledWriter) Write(p []byte) (int, error) {
+	if w.budget == 0 {
+		return 0, errStalled
+	}
+	if len(p) > w.budget {
+		p = p[:w.budget]
+	}
+	w.budget -= len(p)
+	w.buf.Write(p)
+	return len(p), nil
+}
+
+func TestMsgBufQueueLimitError(t *testing.T) {
+	m := NewMsgBuf(&stalledWriter{})
+	m.SetQueueLimit(2, 0, QueueError)
+
+	for i := 0; i < 2; i++ {
+		err := m.Enqueue(&IMsg{Type: 1, Data: []byte("test")})
+		if err != nil {
+			t.Fatalf("unexpected Enqueue failure: %s", err)
+		}
+	}
+
+	var eqf *ErrQueueFull
+	err := m.Enqueue(&IMsg{Type: 2})
+	if !errors.As(err, &eqf) || eqf.Messages != 2 || eqf.Bytes != 40 {
+		t.Fatalf("expected ErrQueueFull, got: %v", err)
+	}
+
+	// Limits can be lifted.
+	m.SetQueueLimit(0, 0, QueueError)
+	err = m.Enqueue(&IMsg{Type: 2})
+	if err != nil {
+		t.Fatalf("unexpected Enqueue failure: %s", err)
+	}
+}
+
+func TestMsgBufQueueLimitPartialHead(t *testing.T) {
+	w := &stalledWriter{budget: 10}
+	m := NewMsgBuf(w)
+	m.SetQueueLimit(0, 40, QueueError)
+
+	m.Enqueue(&IMsg{Type: 1, Data: []byte("test")})
+	m.Enqueue(&IMsg{Type: 2, Data: []byte("test")})
+	_, err := m.Flush()
+	if !errors.Is(err, errStalled) {
+		t.Fatalf("expected stalled writer, got: %v", err)
+	}
+
+	// Only the unwritten 30 bytes count, which leaves room for 10 more.
+	var eqf *ErrQueueFull
+	err = m.Enqueue(&IMsg{Type: 3})
+	if !errors.As(err, &eqf) || eqf.Bytes != 30 {
+		t.Fatalf("expected ErrQueueFull with 30 bytes, got: %v", err)
+	}
+
+	w.budget = 6
+	m.Flush()
+	err = m.Enqueue(&IMsg{Type: 3})
+	if err != nil {
+		t.Fatalf("unexpected Enqueue failure: %s", err)
+	}
+}
+
+func TestMsgBufQueueLimitDropOldest(t *testing.T) {
+	w := &stalledWriter{budget: 10}
+	m := NewMsgBuf(w)
+	m.SetQueueLimit(2, 0, QueueDropOldest)
+
+	for typ := uint32(1); typ <= 2; typ++ {
+		m.Enqueue(&IMsg{Type: typ, Data: []byte("test")})
+	}
+	m.Flush()
+
+	// The partially written head is kept, so the second imsg is dropped, and
+	// then the third.
+	for typ := uint32(3); typ <= 4; typ++ {
+		err := m.Enqueue(&IMsg{Type: typ})
+		if err != nil {
+			t.Fatalf("unexpected Enqueue failure: %s", err)
+		}
+	}
+	if m.Dropped() != 2 || m.QueueLen() != 2 {
+		t.Fatalf("unexpected queue state (%d dropped, %d queued)", m.Dropped(), m.QueueLen())
+	}
+
+	w.budget = 1 << 20
+	_, err := m.Flush()
+	if err != nil {
+		t.Fatalf("unexpected Flush failure: %s", err)
+	}
+
+	ims, err := DecodeAll(w.buf.Bytes())
+	if err != nil {
+		t.Fatalf("written data does not decode cleanly: %s", err)
+	}
+	if len(ims) != 2 || ims[0].Type != 1 || ims[1].Type != 4 {
+		t.Fatalf("unexpected imsgs written (%v)", ims)
+	}
+
+	// A lone partially written imsg can't be dropped.
+	m = NewMsgBuf(&stalledWriter{budget: 10})
+	m.SetQueueLimit(1, 0, QueueDropOldest)
+	m.Enqueue(&IMsg{Type: 1, Data: []byte("test")})
+	m.Flush()
+	var eqf *ErrQueueFull
+	err = m.Enqueue(&IMsg{Type: 2})
+	if !errors.As(err, &eqf) {
+		t.Fatalf("expected ErrQueueFull, got: %v", err)
+	}
+}
+
+func TestMsgBufQueueLimitBlock(t *testing.T) {
+	w := &stalledWriter{}
+	m := NewMsgBuf(w)
+	m.SetQueueLimit(1, 0, QueueBlock)
+	m.Enqueue(&IMsg{Type: 1})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := m.EnqueueContext(ctx, &IMsg{Type: 2})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got: %v", err)
+	}
+	if m.QueueLen() != 1 {
+		t.Fatalf("unexpected queue length (%d != 1)", m.QueueLen())
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- m.Enqueue(&IMsg{Type: 3}) }()
+	select {
+	case err = <-errc:
+		t.Fatalf("Enqueue returned while the queue was full (%v)", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+
+	// Clear makes room for the blocked imsg.
+	m.Clear()
+	select {
+	case err = <-errc:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Enqueue did not return once room was made")
+	}
+	if err != nil {
+		t.Fatalf("unexpected Enqueue failure: %s", err)
+	}
+	if m.QueueLen() != 1 {
+		t.Fatalf("unexpected queue length (%d != 1)", m.QueueLen())
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// A QuotaFunc is called when a peer exceeds a receive quota of a Conn. It
+// returns whether the Conn should be closed. If it returns false, the imsg or
+// descriptors which exceeded the quota are received as usual. The function is
+// called while the Conn is reading, so it must neither read from nor close the
+// Conn itself.
+type QuotaFunc func(c *Conn, err *ErrQuotaExceeded) bool
+
+// A quotaCounter counts what has been received in the current window against
+// a limit.
+type quotaCounter struct {
+	limit uint64 // Zero for no limit
+	used  uint64
+}
+
+// charge counts n more units, returning whether the limit is exceeded.
+func (qc *quotaCounter) charge(n uint64) bool {
+	qc.used += n
+	return qc.limit > 0 && qc.used > qc.limit
+}
+
+// A quotaWindow is a fixed window over which quotaCounters accumulate.
+type quotaWindow struct {
+	length time.Duration // Zero for a window spanning the life of the Conn
+	start  time.Time
+}
+
+// expired reports whether the window has ended by now.
+func (qw *quotaWindow) expired(now time.Time) bool {
+	return qw.length > 0 && now.Sub(qw.start) >= qw.length
+}
+
+// This is the state of a Conn's receive quotas, which are set by
+// WithRecvQuota and WithRecvFDQuota.
+type recvQuota struct {
+	mu sync.Mutex
+
+	msgWindow quotaWindow
+	messages  quotaCounter
+	bytes     quotaCounter
+
+	fdWindow quotaWindow
+	fds      quotaCounter
+
+	exceeded uint64    // Times a quota was exceeded
+	f        QuotaFunc // Set by WithQuotaFunc
+}
+
+// WithRecvQuota limits the imsgs the Conn receives from the peer to
+// maxMessages imsgs and maxBytes bytes, headers included, in each window of
+// the provided duration. A limit of zero isn't enforced, and a window of zero
+// applies the limits over the life of the Conn. Windows are fixed rather than
+// sliding: each starts with the first imsg received after the previous one
+// ended. An imsg which exceeds a quota is discarded, closing any attached file,
+// and ErrQuotaExceeded is returned by Recv, unless a function set with
+// WithQuotaFunc decides otherwise. Imsgs are counted as they're decoded, before
+// any verification or filtering.
+func WithRecvQuota(maxMessages, maxBytes uint64, window time.Duration) ConnOption {
+	return func(c *Conn) {
+		q := c.recvQuota()
+		q.msgWindow.length = window
+		q.messages.limit = maxMessages
+		q.bytes.limit = maxBytes
+	}
+}
+
+// WithRecvFDQuota limits the descriptors the Conn receives from the peer to
+// maxFDs in each window of the provided duration, which are counted as they're
+// read, separately from the imsgs they're attached to. Descriptors which exceed
+// the quota are closed, and ErrQuotaExceeded is returned by Recv, unless a
+// function set with WithQuotaFunc decides otherwise. The imsgs they were sent
+// with are then received without them, resulting in ErrMissingFD.
+func WithRecvFDQuota(maxFDs uint64, window time.Duration) ConnOption {
+	return func(c *Conn) {
+		q := c.recvQuota()
+		q.fdWindow.length = window
+		q.fds.limit = maxFDs
+	}
+}
+
+// WithQuotaFunc sets a function which is called whenever a quota set with
+// WithRecvQuota or WithRecvFDQuota is exceeded, and which can choose to close
+// the Conn, such as to disconnect a runaway peer, or to let the traffic through.
+// If the Conn is closed, ErrQuotaExceeded is returned by Recv.
+func WithQuotaFunc(f QuotaFunc) ConnOption {
+	return func(c *Conn) {
+		c.recvQuota().f = f
+	}
+}
+
+// recvQuota returns the receive quotas of the Conn, creating them if none have
+// been set.
+func (c *Conn) recvQuota() *recvQuota {
+	if c.quota == nil {
+		c.quota = &recvQuota{}
+	}
+
+	return c.quota
+}
+
+// chargeMessage counts a received imsg against the receive quotas, returning
+// ErrQuotaExceeded if it should be refused. The caller must hold rmu.
+func (c *Conn) chargeMessage(im *IMsg) error {
+	if c.quota == nil {
+		return nil
+	}
+
+	q := c.quota
+	q.mu.Lock()
+	now := time.Now()
+	if q.msgWindow.expired(now) || q.msgWindow.start.IsZero() {
+		q.msgWindow.start = now
+		q.messages.used, q.bytes.used = 0, 0
+	}
+	var qe *ErrQuotaExceeded
+	overMessages := q.messages.charge(1)
+	overBytes := q.bytes.charge(uint64(im.Len()))
+	switch {
+	case overMessages:
+		qe = &ErrQuotaExceeded{"messages", q.messages.limit, q.msgWindow.length}
+	case overBytes:
+		qe = &ErrQuotaExceeded{"bytes", q.bytes.limit, q.msgWindow.length}
+	}
+	q.mu.Unlock()
+
+	if qe == nil || !c.quotaExceeded(qe) {
+		return nil
+	}
+	im.closeFile()
+
+	return qe
+}
+
+// chargeFDs counts n received descriptors against the receive quota, returning
+// ErrQuotaExceeded if they should be refused. The caller must hold rmu.
+func (c *Conn) chargeFDs(n int) error {
+	if c.quota == nil || n == 0 {
+		return nil
+	}
+
+	q := c.quota
+	q.mu.Lock()
+	now := time.Now()
+	if q.fdWindow.expired(now) || q.fdWindow.start.IsZero() {
+		q.fdWindow.start = now
+		q.fds.used = 0
+	}
+	var qe *ErrQuotaExceeded
+	if q.fds.charge(uint64(n)) {
+		qe = &ErrQuotaExceeded{"descriptors", q.fds.limit, q.fdWindow.length}
+	}
+	q.mu.Unlock()
+
+	if qe == nil || !c.quotaExceeded(qe) {
+		return nil
+	}
+
+	return qe
+}
+
+// quotaExceeded consults the QuotaFunc, if any, about an exceeded quota,
+// closing the Conn if it says to. It returns whether the traffic which exceeded
+// the quota should be refused. The caller must hold rmu.
+func (c *Conn) quotaExceeded(qe *ErrQuotaExceeded) bool {
+	q := c.quota
+	q.mu.Lock()
+	q.exceeded++
+	f := q.f
+	q.mu.Unlock()
+
+	if c.debugEnabled() {
+		c.logDebug("imsg receive quota exceeded", slog.Any(logKeyErr, qe))
+	}
+	if f == nil {
+		return true
+	}
+	if !f(c, qe) {
+		return false
+	}
+	c.closeHeld()
+
+	return true
+}
+
+// fill copies the state of the receive quotas into s.
+func (q *recvQuota) fill(s *Stats) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := time.Now()
+	if !q.msgWindow.expired(now) {
+		s.QuotaMessages = q.messages.used
+		s.QuotaBytes = q.bytes.used
+	}
+	if !q.fdWindow.expired(now) {
+		s.QuotaFDs = q.fds.used
+	}
+	s.QuotaExceeded = q.exceeded
+}
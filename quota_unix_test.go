@@ -0,0 +1,216 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestQuotaPair constructs a connected pair of Conns, the second of which
+// is configured with opts, such as its receive quotas.
+func newTestQuotaPair(t *testing.T, opts ...ConnOption) (*Conn, *Conn) {
+	t.Helper()
+
+	a, b := newTestFDPassPair(t)
+	b = rewrapTestConn(t, b, opts...)
+	b.AllowFDPass(true)
+
+	return a, b
+}
+
+// sendTestIMsgs sends n imsgs carrying size bytes of data each.
+func sendTestIMsgs(t *testing.T, c *Conn, n, size int) {
+	t.Helper()
+
+	for i := 0; i < n; i++ {
+		err := c.Send(&IMsg{Type: uint32(i), Data: make([]byte, size)})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+}
+
+func TestRecvQuotaMessages(t *testing.T) {
+	a, b := newTestQuotaPair(t, WithRecvQuota(3, 0, time.Hour))
+
+	// Just below the quota.
+	sendTestIMsgs(t, a, 4, 0)
+	for i := 0; i < 3; i++ {
+		im, err := b.Recv()
+		if err != nil || im.Type != uint32(i) {
+			t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+		}
+	}
+	s := b.Stats()
+	if s.QuotaMessages != 3 || s.QuotaExceeded != 0 {
+		t.Fatalf("unexpected quota stats (%d, %d)", s.QuotaMessages, s.QuotaExceeded)
+	}
+
+	// Just above it.
+	_, err := b.Recv()
+	var quota *ErrQuotaExceeded
+	if !errors.As(err, &quota) || quota.Resource != "messages" || quota.Limit != 3 {
+		t.Fatalf("expected ErrQuotaExceeded, got: %v", err)
+	}
+	if s := b.Stats(); s.QuotaExceeded != 1 {
+		t.Fatalf("unexpected count of exceeded quotas: %d", s.QuotaExceeded)
+	}
+}
+
+func TestRecvQuotaBytes(t *testing.T) {
+	const size = 100
+	a, b := newTestQuotaPair(t, WithRecvQuota(0, 2*(HeaderSizeInBytes+size), time.Hour))
+
+	sendTestIMsgs(t, a, 2, size)
+	sendTestIMsgs(t, a, 1, 0)
+	for i := 0; i < 2; i++ {
+		_, err := b.Recv()
+		if err != nil {
+			t.Fatalf("unexpected Recv failure: %s", err)
+		}
+	}
+	if s := b.Stats(); s.QuotaBytes != 2*(HeaderSizeInBytes+size) {
+		t.Fatalf("unexpected count of quota bytes: %d", s.QuotaBytes)
+	}
+
+	// Even a header alone exceeds the quota now.
+	_, err := b.Recv()
+	var quota *ErrQuotaExceeded
+	if !errors.As(err, &quota) || quota.Resource != "bytes" {
+		t.Fatalf("expected ErrQuotaExceeded, got: %v", err)
+	}
+}
+
+func TestRecvQuotaWindow(t *testing.T) {
+	const window = 50 * time.Millisecond
+	a, b := newTestQuotaPair(t, WithRecvQuota(1, 0, window))
+
+	sendTestIMsgs(t, a, 2, 0)
+	_, err := b.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	_, err = b.Recv()
+	var quota *ErrQuotaExceeded
+	if !errors.As(err, &quota) || quota.Window != window {
+		t.Fatalf("expected ErrQuotaExceeded, got: %v", err)
+	}
+
+	// A new window starts once the last has ended.
+	time.Sleep(window)
+	if s := b.Stats(); s.QuotaMessages != 0 {
+		t.Fatalf("unexpected count of quota messages: %d", s.QuotaMessages)
+	}
+	sendTestIMsgs(t, a, 1, 0)
+	_, err = b.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+}
+
+func TestRecvQuotaFunc(t *testing.T) {
+	var calls int
+	allow := func(c *Conn, err *ErrQuotaExceeded) bool {
+		calls++
+		return false
+	}
+	a, b := newTestQuotaPair(t, WithRecvQuota(1, 0, 0), WithQuotaFunc(allow))
+
+	// The function lets the traffic through.
+	sendTestIMsgs(t, a, 2, 0)
+	for i := 0; i < 2; i++ {
+		_, err := b.Recv()
+		if err != nil {
+			t.Fatalf("unexpected Recv failure: %s", err)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("unexpected count of QuotaFunc calls: %d", calls)
+	}
+
+	disconnect := func(c *Conn, err *ErrQuotaExceeded) bool {
+		return true
+	}
+	a, b = newTestQuotaPair(t, WithRecvQuota(1, 0, 0), WithQuotaFunc(disconnect), WithFlushInterval(time.Hour))
+	err := b.Send(&IMsg{Type: 1})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+
+	// The function closes the Conn, discarding the queued imsg rather than
+	// lingering to write it.
+	sendTestIMsgs(t, a, 2, 0)
+	_, err = b.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	_, err = b.Recv()
+	var quota *ErrQuotaExceeded
+	if !errors.As(err, &quota) {
+		t.Fatalf("expected ErrQuotaExceeded, got: %v", err)
+	}
+	_, err = b.Recv()
+	if err == nil {
+		t.Fatalf("Recv succeeded on a closed Conn")
+	}
+	_, err = a.Recv()
+	if err != io.EOF {
+		t.Fatalf("expected EOF, got: %v", err)
+	}
+}
+
+func TestRecvFDQuota(t *testing.T) {
+	a, b := newTestQuotaPair(t, WithRecvFDQuota(2, time.Hour))
+
+	sendFile := func(typ uint32) {
+		t.Helper()
+
+		f, err := os.Open(os.DevNull)
+		if err != nil {
+			t.Fatalf("unexpected Open failure: %s", err)
+		}
+		defer f.Close()
+		im, err := ComposeIMsgWithFile(typ, 0, nil, f)
+		if err != nil {
+			t.Fatalf("unexpected ComposeIMsgWithFile failure: %s", err)
+		}
+		err = a.Send(im)
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+
+	// Just below the quota.
+	for typ := uint32(1); typ <= 2; typ++ {
+		sendFile(typ)
+		im, err := b.Recv()
+		if err != nil || im.File() == nil {
+			t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+		}
+		im.Close()
+	}
+	if s := b.Stats(); s.QuotaFDs != 2 || s.QuotaExceeded != 0 {
+		t.Fatalf("unexpected quota stats (%d, %d)", s.QuotaFDs, s.QuotaExceeded)
+	}
+
+	// Just above it, the descriptor is refused, and its imsg arrives without it.
+	sendFile(3)
+	_, err := b.Recv()
+	var quota *ErrQuotaExceeded
+	if !errors.As(err, &quota) || quota.Resource != "descriptors" || quota.Limit != 2 {
+		t.Fatalf("expected ErrQuotaExceeded, got: %v", err)
+	}
+	_, err = b.Recv()
+	var missing *ErrMissingFD
+	if !errors.As(err, &missing) {
+		t.Fatalf("expected ErrMissingFD, got: %v", err)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// This is implemented by readers, such as a net.Conn, whose reads can be
+// interrupted by a deadline.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// ReadIMsgContext behaves like ReadIMsg, except that it gives up once the
+// context is done, returning the context's error wrapped in an ErrInterrupted
+// which records whether the header or the body was being read.
+//
+// If the reader supports read deadlines, as a net.Conn does, a blocked read is
+// interrupted by expiring its deadline, which is cleared again afterwards.
+// Otherwise, the read is performed in a separate goroutine, which is abandoned
+// if the context is done first and continues to read from the reader until its
+// read completes. Either way, the reader may have consumed part of an imsg, so
+// once ErrInterrupted has been returned the stream should be discarded.
+func ReadIMsgContext(ctx context.Context, r io.Reader) (*IMsg, error) {
+	err := ctx.Err()
+	if err != nil {
+		return nil, &ErrInterrupted{"header", err}
+	}
+
+	if rd, ok := r.(readDeadliner); ok {
+		return readIMsgDeadline(ctx, r, rd)
+	}
+
+	return readIMsgAsync(ctx, r)
+}
+
+// readIMsgDeadline reads an imsg from r, expiring the read deadline of rd, its
+// underlying connection, once the context is done.
+func readIMsgDeadline(ctx context.Context, r io.Reader, rd readDeadliner) (*IMsg, error) {
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			rd.SetReadDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	im, _, err := readIMsgN(r, MaxSizeInBytes)
+
+	close(stop)
+	<-done
+	if ctx.Err() != nil {
+		// Leave the reader usable, should the caller insist on reusing it.
+		rd.SetReadDeadline(time.Time{})
+
+		var er *ErrRead
+		if errors.As(err, &er) {
+			return nil, &ErrInterrupted{er.Stage, ctx.Err()}
+		}
+	}
+
+	return im, err
+}
+
+// readIMsgAsync reads an imsg from r in a separate goroutine, abandoning it if
+// the context is done first.
+func readIMsgAsync(ctx context.Context, r io.Reader) (*IMsg, error) {
+	type result struct {
+		im  *IMsg
+		err error
+	}
+
+	cr := &countingReader{r: r}
+	results := make(chan result, 1)
+	go func() {
+		im, _, err := readIMsgN(cr, MaxSizeInBytes)
+		results <- result{im, err}
+	}()
+
+	select {
+	case res := <-results:
+		return res.im, res.err
+	case <-ctx.Done():
+		stage := "header"
+		if cr.n.Load() >= HeaderSizeInBytes {
+			stage = "body"
+		}
+		return nil, &ErrInterrupted{stage, ctx.Err()}
+	}
+}
+
+// A countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n atomic.Int64
+}
+
+// Read implements the io.Reader interface.
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n.Add(int64(n))
+
+	return n, err
+}
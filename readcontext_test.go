@@ -0,0 +1,71 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestReadIMsgContext(t *testing.T) {
+	frame, _ := (&IMsg{Type: 1, Data: []byte("test")}).MarshalBinary()
+
+	// Each reader is interrupted while blocked in the header and in the body,
+	// whether or not it supports read deadlines.
+	for _, sent := range []struct {
+		n     int
+		stage string
+	}{
+		{0, "header"},
+		{HeaderSizeInBytes - 1, "header"},
+		{HeaderSizeInBytes + 1, "body"},
+	} {
+		pipes := map[string]func() (io.Reader, io.WriteCloser){
+			"net.Pipe": func() (io.Reader, io.WriteCloser) { return net.Pipe() },
+			"io.Pipe":  func() (io.Reader, io.WriteCloser) { return io.Pipe() },
+		}
+		for name, pipe := range pipes {
+			r, w := pipe()
+			go w.Write(frame[:sent.n])
+
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(20*time.Millisecond, cancel)
+
+			var ei *ErrInterrupted
+			_, err := ReadIMsgContext(ctx, r)
+			if !errors.As(err, &ei) || ei.Stage != sent.stage || !errors.Is(err, context.Canceled) {
+				t.Fatalf("%s: expected ErrInterrupted in %s after %d bytes, got: %v", name, sent.stage, sent.n, err)
+			}
+			w.Close()
+		}
+	}
+
+	// Reads which complete in time succeed, and a reader whose deadline was
+	// used is left without one.
+	r, w := net.Pipe()
+	defer w.Close()
+	go w.Write(frame)
+	ctx, cancel := context.WithCancel(context.Background())
+	im, err := ReadIMsgContext(ctx, r)
+	if err != nil || im.Type != 1 || string(im.Data) != "test" {
+		t.Fatalf("unexpected ReadIMsgContext result (%v, %v)", im, err)
+	}
+	cancel()
+	go w.Write(frame)
+	im, err = ReadIMsg(r)
+	if err != nil || im.Type != 1 {
+		t.Fatalf("unexpected ReadIMsg result after cancellation (%v, %v)", im, err)
+	}
+
+	// A context which is already done prevents the read entirely.
+	_, err = ReadIMsgContext(ctx, r)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import "io"
+
+// ReadFrom reads a single imsg from r into im, returning the number of bytes
+// read. Unlike ReadIMsg, it reuses the imsg's Data: the incoming data is read
+// into Data's existing backing storage if it has sufficient capacity, and only
+// into newly allocated storage otherwise, so reading into imsgs drawn from a
+// sync.Pool after Reset needn't allocate. The aliasing rules of Reset apply
+// here as well. An attached file is detached but not closed. Errors are
+// reported as ReadIMsg reports them, and on failure, im is left in an
+// unspecified but valid state.
+func (im *IMsg) ReadFrom(r io.Reader) (int64, error) {
+	buf := im.Data[:cap(im.Data)]
+
+	// The start of Data doubles as space for the header, which is decoded
+	// before any data is read.
+	hdr := buf
+	if len(hdr) < HeaderSizeInBytes {
+		hdr = make([]byte, HeaderSizeInBytes)
+	}
+
+	*im = IMsg{}
+	n, err := readIMsgInto(r, hdr[:HeaderSizeInBytes], MaxSizeInBytes, im, buf)
+	if im.Data == nil {
+		// Keep the capacity for the next read, such as after io.EOF.
+		im.Data = buf[:0]
+	}
+
+	return int64(n), err
+}
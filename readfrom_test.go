@@ -0,0 +1,68 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestReadFromReusesData(t *testing.T) {
+	frame, _ := IMsg{Type: 1, PeerID: 2, PID: 3, Data: []byte("test")}.MarshalBinary()
+	r := bytes.NewReader(frame)
+
+	im := &IMsg{Type: 4, Data: make([]byte, 0, 64)}
+	backing := &im.Data[:1][0]
+
+	n, err := im.ReadFrom(r)
+	if err != nil {
+		t.Fatalf("unexpected ReadFrom failure: %s", err)
+	}
+	if n != int64(len(frame)) {
+		t.Fatalf("unexpected number of bytes read (%d != %d)", n, len(frame))
+	}
+	if !im.Equal(&IMsg{Type: 1, PeerID: 2, PID: 3, Data: []byte("test")}) {
+		t.Fatalf("unexpected imsg read (%#v)", im)
+	}
+	if &im.Data[0] != backing {
+		t.Fatalf("existing data capacity was not reused")
+	}
+
+	// Data larger than the existing capacity is read into new storage.
+	frame, _ = IMsg{Type: 1, Data: make([]byte, 128)}.MarshalBinary()
+	r.Reset(frame)
+	_, err = im.ReadFrom(r)
+	if err != nil {
+		t.Fatalf("unexpected ReadFrom failure: %s", err)
+	}
+	if len(im.Data) != 128 {
+		t.Fatalf("unexpected data length (%d)", len(im.Data))
+	}
+
+	// N.B. A sync.Pool isn't used here, since the race detector causes pools
+	// to drop items at random.
+	allocs := testing.AllocsPerRun(100, func() {
+		r.Reset(frame)
+		_, _ = im.ReadFrom(r)
+		im.Reset()
+	})
+	if allocs != 0 {
+		t.Fatalf("reused ReadFrom allocated (%.0f allocations)", allocs)
+	}
+}
+
+func TestReadFromErrors(t *testing.T) {
+	frame, _ := IMsg{Type: 1, Data: []byte("test")}.MarshalBinary()
+
+	for i := 0; i < len(frame); i++ {
+		im := &IMsg{}
+		_, err := im.ReadFrom(bytes.NewReader(frame[:i]))
+		_, want := ReadIMsg(bytes.NewReader(frame[:i]))
+		if err == nil || reflect.TypeOf(err) != reflect.TypeOf(want) {
+			t.Fatalf("unexpected error reading %d bytes (%v, expected %v)", i, err, want)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// A recording begins with this magic, after which each record holds a
+// direction byte, the time in nanoseconds since the recording began as a
+// big-endian 64-bit integer, and the imsg as it appears on the wire.
+const (
+	recordMagic      = "imsgrec1"
+	recordPrefixSize = 9
+)
+
+// A Recorder captures imsgs, along with their direction and the time at which
+// they were seen, to a recording which can later be read with OpenRecording or
+// replayed with Replay. Attached descriptors can't be recorded, so only the
+// has-fd flag of an imsg which carried one is preserved. A Recorder is safe for
+// concurrent use.
+type Recorder struct {
+	mu     sync.Mutex
+	w      io.Writer
+	closer io.Closer
+	start  time.Time
+	buf    []byte
+	err    error
+}
+
+// NewRecorder constructs a Recorder which writes a recording to w, beginning
+// with its magic. Times are recorded relative to when the Recorder was
+// constructed.
+func NewRecorder(w io.Writer) (*Recorder, error) {
+	_, err := io.WriteString(w, recordMagic)
+	if err != nil {
+		return nil, &ErrWrite{err}
+	}
+
+	return &Recorder{w: w, start: time.Now()}, nil
+}
+
+// CreateRecording creates or truncates the named file and constructs a Recorder
+// which writes a recording to it. The file is closed by the Recorder's Close.
+func CreateRecording(path string) (*Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r, err := NewRecorder(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	r.closer = f
+
+	return r, nil
+}
+
+// WithRecorder causes the Conn to record each imsg it sends or receives to the
+// provided Recorder, as seen by its trace function. A function set earlier with
+// WithTraceFunc continues to be called.
+func WithRecorder(r *Recorder) ConnOption {
+	return func(c *Conn) {
+		prev := c.trace
+		c.trace = func(dir Direction, im *IMsg, wireLen int) {
+			if prev != nil {
+				prev(dir, im, wireLen)
+			}
+			r.Trace(dir, im, wireLen)
+		}
+	}
+}
+
+// Record appends an imsg to the recording. Each record is written with a
+// single write. Errors are sticky: once writing fails, nothing more is
+// recorded, and the error is returned by each subsequent Record and by Err.
+func (r *Recorder) Record(dir Direction, im *IMsg) error {
+	elapsed := time.Since(r.start)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.err != nil {
+		return r.err
+	}
+
+	n := recordPrefixSize + im.Len()
+	if cap(r.buf) < n {
+		r.buf = make([]byte, n)
+	}
+	bs := r.buf[:n]
+	bs[0] = byte(dir)
+	binary.BigEndian.PutUint64(bs[1:recordPrefixSize], uint64(elapsed))
+	im.putHeader(bs[recordPrefixSize:])
+	copy(bs[recordPrefixSize+HeaderSizeInBytes:], im.Data)
+
+	_, err := r.w.Write(bs)
+	if err != nil {
+		r.err = &ErrWrite{err}
+	}
+
+	return r.err
+}
+
+// Trace records an imsg, ignoring errors, which are reported by Err. It's a
+// TraceFunc, so it may be provided to an Encoder's or Decoder's SetTraceFunc.
+func (r *Recorder) Trace(dir Direction, im *IMsg, wireLen int) {
+	r.Record(dir, im)
+}
+
+// Err returns the error which stopped the recording, if any.
+func (r *Recorder) Err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.err
+}
+
+// Close stops the recording, closing its file if it was created by
+// CreateRecording. It returns the error which stopped the recording, if any,
+// or the error from closing the file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.err
+	if r.err == nil {
+		r.err = &ErrWrite{os.ErrClosed}
+	}
+	if r.closer != nil {
+		cerr := r.closer.Close()
+		if err == nil {
+			err = cerr
+		}
+		r.closer = nil
+	}
+
+	return err
+}
+
+// A Recording reads the imsgs captured by a Recorder.
+type Recording struct {
+	r      *bufio.Reader
+	closer io.Closer
+	off    int64
+	prefix [recordPrefixSize + HeaderSizeInBytes]byte
+}
+
+// NewRecording constructs a Recording which reads from r, checking that it
+// begins with a recording's magic.
+func NewRecording(r io.Reader) (*Recording, error) {
+	rec := &Recording{r: bufio.NewReader(r)}
+
+	magic := make([]byte, len(recordMagic))
+	n, err := io.ReadFull(rec.r, magic)
+	switch {
+	case err == io.ErrUnexpectedEOF || err == io.EOF:
+		return nil, &ErrTruncatedRecording{Offset: 0, Expected: len(magic), Got: n}
+	case err != nil:
+		return nil, &ErrRead{"stream", err}
+	case string(magic) != recordMagic:
+		return nil, &ErrCorruptRecording{Offset: 0, Reason: "not a recording"}
+	}
+	rec.off = int64(n)
+
+	return rec, nil
+}
+
+// OpenRecording opens the named file and constructs a Recording which reads
+// from it. The file is closed by the Recording's Close.
+func OpenRecording(path string) (*Recording, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rec, err := NewRecording(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	rec.closer = f
+
+	return rec, nil
+}
+
+// Next returns the next recorded imsg, along with its direction and the time
+// at which it was recorded relative to the start of the recording. At the end
+// of the recording, Next returns io.EOF. A recording which ends partway
+// through a record results in ErrTruncatedRecording, and a record which can't
+// be parsed in ErrCorruptRecording, each with the offset of the record.
+func (rec *Recording) Next() (Direction, time.Duration, *IMsg, error) {
+	off := rec.off
+
+	n, err := io.ReadFull(rec.r, rec.prefix[:])
+	rec.off += int64(n)
+	if err != nil {
+		return rec.fail(off, err, len(rec.prefix), n)
+	}
+
+	dir := Direction(rec.prefix[0])
+	if dir != Outbound && dir != Inbound {
+		return 0, 0, nil, &ErrCorruptRecording{
+			Offset: off,
+			Reason: fmt.Sprintf("unknown direction %d", rec.prefix[0]),
+		}
+	}
+	elapsed := time.Duration(binary.BigEndian.Uint64(rec.prefix[1:recordPrefixSize]))
+
+	hdr := parseHeader(rec.prefix[recordPrefixSize:], endianness)
+	if hdr.Length < HeaderSizeInBytes || hdr.Length > MaxSizeInBytes {
+		return 0, 0, nil, &ErrCorruptRecording{
+			Offset: off,
+			Reason: fmt.Sprintf("message length %d out of bounds", hdr.Length),
+		}
+	}
+
+	im := &IMsg{
+		Type:   hdr.Type,
+		PeerID: hdr.PeerID,
+		PID:    hdr.PID,
+		flags:  hdr.Flags,
+	}
+	if hdr.Length > HeaderSizeInBytes {
+		im.Data = make([]byte, int(hdr.Length)-HeaderSizeInBytes)
+		n, err = io.ReadFull(rec.r, im.Data)
+		rec.off += int64(n)
+		if err != nil {
+			return rec.fail(off, err, recordPrefixSize+int(hdr.Length), len(rec.prefix)+n)
+		}
+	}
+
+	return dir, elapsed, im, nil
+}
+
+// fail converts an error encountered partway through reading the record at off
+// into the error returned by Next.
+func (rec *Recording) fail(off int64, err error, expected, got int) (Direction, time.Duration, *IMsg, error) {
+	switch {
+	case err == io.EOF && got == 0:
+		return 0, 0, nil, io.EOF
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		return 0, 0, nil, &ErrTruncatedRecording{Offset: off, Expected: expected, Got: got}
+	}
+
+	return 0, 0, nil, &ErrRead{"stream", err}
+}
+
+// Close closes the recording's file if it was opened by OpenRecording.
+func (rec *Recording) Close() error {
+	if rec.closer == nil {
+		return nil
+	}
+
+	err := rec.closer.Close()
+	rec.closer = nil
+
+	return err
+}
+
+// A ReplayOption configures optional behavior of Replay.
+type ReplayOption func(*replayConfig)
+
+type replayConfig struct {
+	timing bool
+}
+
+// WithOriginalTiming causes Replay to reproduce the intervals between the
+// recorded imsgs, waiting before each is sent until as much time has passed
+// since the first was sent as had passed when it was recorded.
+func WithOriginalTiming() ReplayOption {
+	return func(cfg *replayConfig) {
+		cfg.timing = true
+	}
+}
+
+// Replay sends each outbound imsg in the recording to c, in order, until the
+// recording ends, the context is cancelled, or a send fails. Inbound imsgs are
+// skipped. Since descriptors can't be recorded, the has-fd flag is cleared
+// from imsgs which carried one. Replay returns nil once the whole recording has
+// been sent.
+func Replay(ctx context.Context, rec *Recording, c *Conn, opts ...ReplayOption) error {
+	var cfg replayConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	var (
+		start time.Time
+		first time.Duration
+	)
+	for {
+		dir, elapsed, im, err := rec.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if dir != Outbound {
+			continue
+		}
+		im.flags &^= FlagHasFD
+
+		if cfg.timing {
+			if start.IsZero() {
+				start, first = time.Now(), elapsed
+			}
+			err = sleepUntil(ctx, start.Add(elapsed-first))
+			if err != nil {
+				return err
+			}
+		}
+
+		err = c.SendContext(ctx, im)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// sleepUntil waits until the provided time or until the context is cancelled,
+// in which case it returns the context's error.
+func sleepUntil(ctx context.Context, t time.Time) error {
+	d := time.Until(t)
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
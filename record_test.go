@@ -0,0 +1,165 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// recordTestIMsgs records a few imsgs in each direction to a new recording,
+// returning its path and the imsgs in the order they were recorded.
+func recordTestIMsgs(t *testing.T) (string, []Direction, []*IMsg) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "test.rec")
+	rec, err := CreateRecording(path)
+	if err != nil {
+		t.Fatalf("unexpected CreateRecording failure: %s", err)
+	}
+
+	dirs := []Direction{Outbound, Inbound, Outbound, Inbound}
+	ims := []*IMsg{
+		{Type: 1, PeerID: 2, PID: 3, Data: []byte("test")},
+		{Type: 4, flags: FlagHasFD},
+		{Type: 5, Data: bytes.Repeat([]byte{5}, MaxSizeInBytes-HeaderSizeInBytes)},
+		{Type: 6, PeerID: 7, Data: []byte("testing")},
+	}
+
+	// Outbound imsgs are recorded as an Encoder's sink, and inbound ones
+	// directly.
+	enc := NewEncoder(io.Discard)
+	enc.SetTraceFunc(rec.Trace)
+	for i, im := range ims {
+		if dirs[i] == Outbound {
+			err = enc.Encode(im)
+		} else {
+			err = rec.Record(Inbound, im)
+		}
+		if err != nil {
+			t.Fatalf("failed to record imsg: %s", err)
+		}
+	}
+
+	err = rec.Close()
+	if err != nil {
+		t.Fatalf("unexpected Close failure: %s", err)
+	}
+
+	return path, dirs, ims
+}
+
+func TestRecording(t *testing.T) {
+	path, dirs, ims := recordTestIMsgs(t)
+
+	rec, err := OpenRecording(path)
+	if err != nil {
+		t.Fatalf("unexpected OpenRecording failure: %s", err)
+	}
+	defer rec.Close()
+
+	var prev time.Duration
+	for i, expected := range ims {
+		dir, elapsed, im, err := rec.Next()
+		if err != nil {
+			t.Fatalf("unexpected Next failure: %s", err)
+		}
+		if dir != dirs[i] || !im.Equal(expected) {
+			t.Fatalf("recorded imsg does not match (%v %v != %v %v)", dir, im, dirs[i], expected)
+		}
+		if elapsed < prev {
+			t.Fatalf("recorded time went backwards (%s < %s)", elapsed, prev)
+		}
+		prev = elapsed
+	}
+
+	_, _, _, err = rec.Next()
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF, got: %v", err)
+	}
+
+	// A closed Recorder records nothing more.
+	r, _ := NewRecorder(io.Discard)
+	r.Close()
+	if r.Record(Outbound, ims[0]) == nil {
+		t.Fatalf("closed Recorder recorded an imsg")
+	}
+}
+
+func TestRecordingCorrupt(t *testing.T) {
+	path, _, _ := recordTestIMsgs(t)
+	recording, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read recording: %s", err)
+	}
+
+	// The second record begins after the magic, the first record's prefix, and
+	// the first imsg.
+	second := int64(len(recordMagic) + recordPrefixSize + HeaderSizeInBytes + 4)
+	corrupt := func(f func(bs []byte) []byte) error {
+		bs := f(append([]byte(nil), recording...))
+		rec, err := NewRecording(bytes.NewReader(bs))
+		if err != nil {
+			return err
+		}
+		for {
+			_, _, _, err = rec.Next()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var ecr *ErrCorruptRecording
+	err = corrupt(func(bs []byte) []byte {
+		bs[0] = 'x'
+		return bs
+	})
+	if !errors.As(err, &ecr) || ecr.Offset != 0 {
+		t.Fatalf("expected ErrCorruptRecording for the magic, got: %v", err)
+	}
+
+	err = corrupt(func(bs []byte) []byte {
+		bs[second] = 9
+		return bs
+	})
+	if !errors.As(err, &ecr) || ecr.Offset != second {
+		t.Fatalf("expected ErrCorruptRecording for the direction, got: %v", err)
+	}
+
+	err = corrupt(func(bs []byte) []byte {
+		endianness.PutUint16(bs[second+recordPrefixSize+4:], HeaderSizeInBytes-1)
+		return bs
+	})
+	if !errors.As(err, &ecr) || ecr.Offset != second {
+		t.Fatalf("expected ErrCorruptRecording for the length, got: %v", err)
+	}
+
+	var etr *ErrTruncatedRecording
+	for _, n := range []int64{second + 1, second + recordPrefixSize + HeaderSizeInBytes - 1} {
+		err = corrupt(func(bs []byte) []byte {
+			return bs[:n]
+		})
+		if !errors.As(err, &etr) || etr.Offset != second || !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Fatalf("expected ErrTruncatedRecording, got: %v", err)
+		}
+	}
+
+	// The third record is truncated partway through its data, and the fourth
+	// is missing.
+	fourth := recordPrefixSize + HeaderSizeInBytes + 7
+	err = corrupt(func(bs []byte) []byte {
+		return bs[:len(bs)-fourth-10]
+	})
+	third := second + recordPrefixSize + HeaderSizeInBytes
+	if !errors.As(err, &etr) || etr.Offset != third || etr.Got != etr.Expected-10 {
+		t.Fatalf("expected ErrTruncatedRecording, got: %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplay(t *testing.T) {
+	const gap = 50 * time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "test.rec")
+	rec, err := CreateRecording(path)
+	if err != nil {
+		t.Fatalf("unexpected CreateRecording failure: %s", err)
+	}
+
+	var traced int
+	a, b := newTestSocketPair(t)
+	a = rewrapTestConn(t, a, WithTraceFunc(func(Direction, *IMsg, int) { traced++ }), WithRecorder(rec))
+
+	sent := []*IMsg{
+		{Type: 1, Data: []byte("first")},
+		{Type: 2, Data: []byte("second")},
+	}
+	for i, im := range sent {
+		if i > 0 {
+			time.Sleep(gap)
+		}
+		err = a.Send(im)
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+		b.Send(&IMsg{Type: 100 + im.Type})
+		b.Recv()
+		a.Recv()
+	}
+	rec.Close()
+	if traced != 4 {
+		t.Fatalf("unexpected trace count (%d != 4)", traced)
+	}
+
+	// Only the outbound imsgs are replayed, with their original spacing.
+	c, d := newTestSocketPair(t)
+	recording, err := OpenRecording(path)
+	if err != nil {
+		t.Fatalf("unexpected OpenRecording failure: %s", err)
+	}
+	defer recording.Close()
+
+	start := time.Now()
+	err = Replay(context.Background(), recording, c, WithOriginalTiming())
+	if err != nil {
+		t.Fatalf("unexpected Replay failure: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed < gap {
+		t.Fatalf("replay was faster than the recording (%s < %s)", elapsed, gap)
+	}
+	c.Close()
+
+	for _, expected := range sent {
+		im, err := d.Recv()
+		if err != nil {
+			t.Fatalf("unexpected Recv failure: %s", err)
+		}
+		if im.Type != expected.Type || string(im.Data) != string(expected.Data) {
+			t.Fatalf("replayed imsg does not match (%v != %v)", im, expected)
+		}
+	}
+	_, err = d.Recv()
+	if err == nil {
+		t.Fatalf("expected the replay to end after the outbound imsgs")
+	}
+
+	// Cancelling the context stops a timed replay.
+	recording, _ = OpenRecording(path)
+	defer recording.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), gap/5)
+	defer cancel()
+	e, _ := newTestSocketPair(t)
+	err = Replay(ctx, recording, e, WithOriginalTiming())
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got: %v", err)
+	}
+}
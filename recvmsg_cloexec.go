@@ -0,0 +1,16 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build dragonfly || freebsd || linux || netbsd || openbsd
+
+package imsg
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+// These are the flags with which descriptors are received, which mark them
+// close-on-exec as they arrive, so that a concurrent fork and exec can't leak
+// them to a child.
+const recvmsgFlags = unix.MSG_CMSG_CLOEXEC
@@ -0,0 +1,11 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix && !(dragonfly || freebsd || linux || netbsd || openbsd)
+
+package imsg
+
+// MSG_CMSG_CLOEXEC isn't available on this platform, so received descriptors
+// are only marked close-on-exec once they've been parsed.
+const recvmsgFlags = 0
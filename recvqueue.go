@@ -0,0 +1,194 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"sync"
+)
+
+// This governs the backlog of a Conn, the imsgs which Call, RecvMatching and
+// the like have read on behalf of Recv, as set by WithRecvQueueLimit and
+// WithAccounting.
+type recvQueue struct {
+	limited     bool // Whether WithRecvQueueLimit was provided
+	maxMessages int  // Zero for no limit
+	maxBytes    int  // Zero for no limit
+
+	acct Accounting // Charged for the length of each imsg held, if set
+
+	mu      sync.Mutex
+	space   chan struct{} // Closed once the backlog shrinks or the Conn closes
+	closed  bool
+	charged map[*IMsg]int // Lengths acquired from acct for imsgs held
+	refused bool          // Whether acct refused an imsg since the backlog last shrank
+}
+
+// WithRecvQueueLimit limits the imsgs which are read from the socket while
+// waiting for a particular imsg, such as the reply awaited by Call or the imsg
+// sought by RecvMatching, and held until Recv returns them. Once maxMessages
+// imsgs or maxBytes bytes of them, headers included, are held, nothing more is
+// read from the socket until Recv has made room, leaving the peer to be held
+// up by the socket's own buffering rather than dropping anything. A limit of
+// zero isn't enforced. The byte limit may be exceeded by the last imsg read.
+//
+// Since a limited Conn stops reading, Call and RecvMatching can then only make
+// progress if another goroutine is receiving from the Conn, such as with
+// Serve or a loop calling Recv; otherwise they wait until their context is
+// done, leaving the imsgs already held for Recv. In particular, a handler
+// which calls Call from within Serve holds up the very Serve which would make
+// room, so its Call can only complete if its reply arrives before the limit is
+// reached. Without a limit, RecvMatching gives up with ErrBacklogFull once 1024
+// imsgs are held, whereas with one it waits for room instead.
+func WithRecvQueueLimit(maxMessages, maxBytes int) ConnOption {
+	return func(c *Conn) {
+		q := c.ensureRecvQueue()
+		q.limited = true
+		q.maxMessages = maxMessages
+		q.maxBytes = maxBytes
+	}
+}
+
+// ensureRecvQueue returns the recvQueue of the Conn, creating it if need be.
+func (c *Conn) ensureRecvQueue() *recvQueue {
+	if c.rqueue == nil {
+		c.rqueue = &recvQueue{}
+	}
+
+	return c.rqueue
+}
+
+// pushBacklog adds an imsg to the end of the backlog. The caller must hold rmu.
+func (c *Conn) pushBacklog(im *IMsg) {
+	c.backlog = append(c.backlog, im)
+	c.grewBacklog(im)
+}
+
+// grewBacklog accounts for the addition of an imsg to the backlog or to the
+// imsgs pushed back by Unread. The caller must hold rmu or umu respectively.
+func (c *Conn) grewBacklog(im *IMsg) {
+	n := c.recvd.queued.Add(1)
+	c.recvd.queuedBytes.Add(int64(im.Len()))
+	for {
+		high := c.recvd.queueHigh.Load()
+		if n <= high || c.recvd.queueHigh.CompareAndSwap(high, n) {
+			break
+		}
+	}
+
+	if q := c.rqueue; q != nil && q.acct != nil {
+		q.mu.Lock()
+		if !q.closed {
+			if err := q.acct.Acquire(im.Len()); err != nil {
+				q.refused = true
+			} else {
+				if q.charged == nil {
+					q.charged = make(map[*IMsg]int)
+				}
+				q.charged[im] = im.Len()
+			}
+		}
+		q.mu.Unlock()
+	}
+}
+
+// popBacklog removes the imsg at the front of the backlog, returning nil if
+// the backlog is empty. Imsgs pushed back by Unread come first. The caller must
+// hold rmu.
+func (c *Conn) popBacklog() *IMsg {
+	if im := c.popUnread(); im != nil {
+		return im
+	}
+	if len(c.backlog) == 0 {
+		return nil
+	}
+
+	im := c.backlog[0]
+	c.backlog[0] = nil
+	c.backlog = c.backlog[1:]
+	c.shrankBacklog(im)
+
+	return im
+}
+
+// takeBacklog removes the imsg at index i of the backlog. The caller must hold
+// rmu.
+func (c *Conn) takeBacklog(i int) *IMsg {
+	im := c.backlog[i]
+	c.backlog = append(c.backlog[:i], c.backlog[i+1:]...)
+	c.shrankBacklog(im)
+
+	return im
+}
+
+// shrankBacklog accounts for the removal of an imsg from the backlog or from
+// the imsgs pushed back by Unread, waking anyone waiting for room. The caller
+// must hold rmu or umu respectively.
+func (c *Conn) shrankBacklog(im *IMsg) {
+	c.recvd.queued.Add(-1)
+	c.recvd.queuedBytes.Add(-int64(im.Len()))
+
+	if q := c.rqueue; q != nil {
+		q.mu.Lock()
+		if n, ok := q.charged[im]; ok {
+			delete(q.charged, im)
+			q.acct.Release(n)
+		}
+		q.refused = false
+		if q.space != nil {
+			close(q.space)
+			q.space = nil
+		}
+		q.mu.Unlock()
+	}
+}
+
+// backlogSpace returns nil if there's room in the backlog for another imsg,
+// and otherwise a channel which is closed once there may be. There's no room
+// once the Accounting has refused an imsg, until the backlog shrinks. Once the
+// Conn is closed, there's always room, so that reading fails as usual. The
+// caller must hold rmu.
+func (c *Conn) backlogSpace() <-chan struct{} {
+	q := c.rqueue
+	if q == nil {
+		return nil
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	full := (q.maxMessages > 0 && len(c.backlog) >= q.maxMessages) ||
+		(q.maxBytes > 0 && c.recvd.queuedBytes.Load() >= int64(q.maxBytes)) ||
+		q.refused
+	if !full || q.closed {
+		return nil
+	}
+	if q.space == nil {
+		q.space = make(chan struct{})
+	}
+
+	return q.space
+}
+
+// wakeBacklogWaiters wakes anyone waiting for room in the backlog once the
+// Conn is closing, and releases whatever the backlog had acquired from the
+// Accounting, since imsgs left in it are no longer accounted for.
+func (c *Conn) wakeBacklogWaiters() {
+	q := c.rqueue
+	if q == nil {
+		return
+	}
+
+	q.mu.Lock()
+	q.closed = true
+	for _, n := range q.charged {
+		q.acct.Release(n)
+	}
+	q.charged = nil
+	if q.space != nil {
+		close(q.space)
+		q.space = nil
+	}
+	q.mu.Unlock()
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// floodThenReply has the peer answer the next query with n notices followed by
+// the reply.
+func floodThenReply(t *testing.T, peer *Conn, n int) {
+	t.Helper()
+
+	go func() {
+		q, err := peer.Recv()
+		if err != nil {
+			return
+		}
+		for i := 0; i < n; i++ {
+			peer.Send(&IMsg{Type: testTypeNotice, Data: []byte{byte(i)}})
+		}
+		peer.Send(&IMsg{Type: testTypeReply, PeerID: q.PeerID})
+	}()
+}
+
+func TestRecvQueueLimitCall(t *testing.T) {
+	const limit, flood = 4, 32
+	a, b := newTestSocketPair(t)
+	a = rewrapTestConn(t, a, WithRecvQueueLimit(limit, 0))
+	floodThenReply(t, b, flood)
+
+	// Another reader drains the notices, making room for Call to reach the
+	// reply.
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < flood; i++ {
+			im, err := a.Recv()
+			if err != nil {
+				done <- err
+				return
+			}
+			if im.Type != testTypeNotice || im.Data[0] != byte(i) {
+				t.Errorf("unexpected notice received: %v", im)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		done <- nil
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reply, err := a.Call(ctx, &IMsg{Type: testTypeQuery}, testTypeReply)
+	if err != nil || reply.Type != testTypeReply {
+		t.Fatalf("unexpected Call result (%v, %v)", reply, err)
+	}
+	err = <-done
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	if s := a.Stats(); s.RecvQueueHighWater > limit || s.RecvQueueLen != 0 || s.RecvQueueBytes != 0 {
+		t.Fatalf("unexpected receive queue stats (%d, %d, %d)", s.RecvQueueHighWater, s.RecvQueueLen, s.RecvQueueBytes)
+	}
+}
+
+func TestRecvQueueLimitCallUndrained(t *testing.T) {
+	const limit, flood = 4, 32
+	a, b := newTestSocketPair(t)
+	a = rewrapTestConn(t, a, WithRecvQueueLimit(limit, 0))
+	floodThenReply(t, b, flood)
+
+	// With nobody else reading, Call stops once the limit is reached.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := a.Call(ctx, &IMsg{Type: testTypeQuery}, testTypeReply)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got: %v", err)
+	}
+	s := a.Stats()
+	if s.RecvQueueLen != limit || s.RecvQueueHighWater != limit || s.RecvQueueBytes != limit*(HeaderSizeInBytes+1) {
+		t.Fatalf("unexpected receive queue stats (%d, %d, %d)", s.RecvQueueLen, s.RecvQueueHighWater, s.RecvQueueBytes)
+	}
+
+	// Nothing was dropped.
+	for i := 0; i < flood; i++ {
+		im, err := a.Recv()
+		if err != nil || im.Type != testTypeNotice || im.Data[0] != byte(i) {
+			t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+		}
+	}
+	im, err := a.Recv()
+	if err != nil || im.Type != testTypeReply {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+}
+
+func TestRecvQueueLimitRecvMatching(t *testing.T) {
+	const flood = 16
+	a, b := newTestSocketPair(t)
+	b = rewrapTestConn(t, b, WithRecvQueueLimit(0, 2*HeaderSizeInBytes))
+
+	for i := 0; i < flood; i++ {
+		err := a.Send(&IMsg{Type: testTypeNotice})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+	err := a.Send(&IMsg{Type: testTypeReply})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		for i := 0; i < flood; i++ {
+			_, err := b.Recv()
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+
+	isReply := func(im *IMsg) bool { return im.Type == testTypeReply }
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	im, err := b.RecvMatching(ctx, isReply)
+	if err != nil || im.Type != testTypeReply {
+		t.Fatalf("unexpected RecvMatching result (%v, %v)", im, err)
+	}
+	err = <-done
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	if s := b.Stats(); s.RecvQueueHighWater > 2 {
+		t.Fatalf("unexpected receive queue high-water mark: %d", s.RecvQueueHighWater)
+	}
+}
+
+func TestRecvQueueLimitClose(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	b = rewrapTestConn(t, b, WithRecvQueueLimit(1, 0))
+
+	for typ := uint32(1); typ <= 2; typ++ {
+		err := a.Send(&IMsg{Type: typ})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+
+	// Closing the Conn releases RecvMatching from its wait for room.
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		b.Close()
+	}()
+	never := func(im *IMsg) bool { return false }
+	_, err := b.RecvMatching(context.Background(), never)
+	if err == nil {
+		t.Fatalf("RecvMatching succeeded on a closed Conn")
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// A RecvRateAction tells a Conn what to do when imsgs arrive faster than the
+// rate set with WithMaxRecvRate.
+type RecvRateAction int
+
+const (
+	// RecvRateDelay stops reading from the socket until the rate allows
+	// another imsg, so that the kernel's socket buffer fills and the peer's
+	// sends block.
+	RecvRateDelay RecvRateAction = iota
+	// RecvRateFail discards each imsg which exceeds the rate, closing any
+	// attached file, and reports ErrRecvRateExceeded to the reader.
+	RecvRateFail
+)
+
+// errRecvDelayed is returned internally when a non-blocking receive must wait
+// for the receive rate to allow another imsg.
+var errRecvDelayed = errors.New("imsg: receive delayed by rate limit")
+
+// This is the state of a Conn's receive rate guard, which is set by
+// WithMaxRecvRate. The token bucket is only accessed while holding rmu.
+type recvRate struct {
+	rate   float64 // Tokens added per second
+	burst  float64 // Capacity of the bucket
+	action RecvRateAction
+
+	tokens float64
+	last   time.Time
+
+	once sync.Once
+	stop chan struct{} // Closed by Close, which interrupts any delay
+
+	dmu      sync.Mutex
+	deadline time.Time     // Read deadline of the socket, which bounds any delay
+	changed  chan struct{} // Closed when the read deadline changes
+}
+
+// WithMaxRecvRate limits the imsgs received from the peer to msgsPerSecond on
+// average, with bursts of up to burst imsgs, using a token bucket. This guards
+// against a peer which floods the Conn with small imsgs, consuming time in
+// decoding and dispatching them, while staying within any quota on bytes.
+// Every decoded imsg counts, including heartbeats. By default, reading is
+// delayed until the rate allows another imsg, which pushes back on the peer
+// through the socket; WithRecvRateAction selects another action. The delay
+// ends early once the read deadline passes or the context of the receive is
+// done, as a read would. Non-blocking receives such as TryRecv never wait,
+// instead reporting that no imsg is available.
+func WithMaxRecvRate(msgsPerSecond float64, burst int) ConnOption {
+	return func(c *Conn) {
+		if burst < 1 {
+			burst = 1
+		}
+		rr := c.recvRateState()
+		rr.rate = msgsPerSecond
+		rr.burst = float64(burst)
+		rr.tokens = float64(burst)
+	}
+}
+
+// WithRecvRateAction sets what happens when imsgs arrive faster than the rate
+// set with WithMaxRecvRate, which defaults to RecvRateDelay.
+func WithRecvRateAction(action RecvRateAction) ConnOption {
+	return func(c *Conn) {
+		c.recvRateState().action = action
+	}
+}
+
+// recvRateState returns the receive rate guard of the Conn, creating it if none
+// has been set.
+func (c *Conn) recvRateState() *recvRate {
+	if c.rate == nil {
+		c.rate = &recvRate{stop: make(chan struct{})}
+	}
+
+	return c.rate
+}
+
+// refill adds the tokens accrued since the bucket was last used.
+func (rr *recvRate) refill(now time.Time) {
+	if !rr.last.IsZero() {
+		rr.tokens += now.Sub(rr.last).Seconds() * rr.rate
+		if rr.tokens > rr.burst {
+			rr.tokens = rr.burst
+		}
+	}
+	rr.last = now
+}
+
+// take consumes a token if one is available, reporting whether it was.
+func (rr *recvRate) take() bool {
+	rr.refill(time.Now())
+	if rr.tokens < 1 {
+		return false
+	}
+	rr.tokens--
+
+	return true
+}
+
+// reserve consumes a token, returning how long to wait until it's available.
+func (rr *recvRate) reserve() time.Duration {
+	rr.refill(time.Now())
+	rr.tokens--
+	if rr.tokens >= 0 || rr.rate <= 0 {
+		return 0
+	}
+
+	return time.Duration(-rr.tokens / rr.rate * float64(time.Second))
+}
+
+// setDeadline records the read deadline of the socket, waking any delay so
+// that it observes the change.
+func (rr *recvRate) setDeadline(t time.Time) {
+	rr.dmu.Lock()
+	defer rr.dmu.Unlock()
+
+	rr.deadline = t
+	if rr.changed != nil {
+		close(rr.changed)
+		rr.changed = nil
+	}
+}
+
+// readDeadline returns the read deadline of the socket, along with a channel
+// which is closed when it changes.
+func (rr *recvRate) readDeadline() (time.Time, <-chan struct{}) {
+	rr.dmu.Lock()
+	defer rr.dmu.Unlock()
+
+	if rr.changed == nil {
+		rr.changed = make(chan struct{})
+	}
+
+	return rr.deadline, rr.changed
+}
+
+// noteReadDeadline informs the receive rate guard, if any, that the read
+// deadline of the socket was set to t.
+func (c *Conn) noteReadDeadline(t time.Time) {
+	if c.rate != nil {
+		c.rate.setDeadline(t)
+	}
+}
+
+// awaitRecvRate waits, before a buffered imsg is decoded, until the receive
+// rate allows it. Unless wait is set, errRecvDelayed is returned instead of
+// waiting. Since the socket isn't read in the meantime, the read deadline is
+// observed directly, including its expiry when the context of a receive is
+// done; the imsg is then left buffered, and os.ErrDeadlineExceeded returned.
+// The caller must hold rmu.
+func (c *Conn) awaitRecvRate(wait bool) error {
+	rr := c.rate
+	if rr == nil || rr.action != RecvRateDelay || rr.rate <= 0 {
+		return nil
+	}
+	n, err := frameLength(c.rbuf, uint16(c.maxSize.Load()), c.order)
+	if err != nil || n == 0 {
+		return nil
+	}
+
+	if !wait {
+		if !rr.take() {
+			return errRecvDelayed
+		}
+		return nil
+	}
+
+	d := rr.reserve()
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	for {
+		deadline, changed := rr.readDeadline()
+		if deadline.IsZero() {
+			select {
+			case <-t.C:
+				return nil
+			case <-rr.stop:
+				return nil
+			case <-changed:
+				continue
+			}
+		}
+
+		dt := time.NewTimer(time.Until(deadline))
+		select {
+		case <-t.C:
+			dt.Stop()
+			return nil
+		case <-rr.stop:
+			dt.Stop()
+			return nil
+		case <-changed:
+			dt.Stop()
+		case <-dt.C:
+			// The token is given back for the imsg to take once it's
+			// received after all.
+			rr.tokens++
+			return os.ErrDeadlineExceeded
+		}
+	}
+}
+
+// checkRecvRate refuses a decoded imsg which exceeds the receive rate under
+// RecvRateFail. The caller must hold rmu.
+func (c *Conn) checkRecvRate(im *IMsg) error {
+	rr := c.rate
+	if rr == nil || rr.action != RecvRateFail || rr.rate <= 0 || rr.take() {
+		return nil
+	}
+	im.closeFile()
+
+	return &ErrRecvRateExceeded{rr.rate, int(rr.burst)}
+}
+
+// stopRecvRate interrupts any delay imposed by the receive rate guard.
+func (c *Conn) stopRecvRate() {
+	if c.rate != nil {
+		c.rate.once.Do(func() { close(c.rate.stop) })
+	}
+}
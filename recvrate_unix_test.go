@@ -0,0 +1,177 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConnMaxRecvRateDelay(t *testing.T) {
+	const rate = 50
+	a, b := newTestSocketPair(t)
+	b = rewrapTestConn(t, b, WithMaxRecvRate(rate, 5))
+
+	var received atomic.Int64
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			_, err := b.Recv()
+			if err != nil {
+				return
+			}
+			received.Add(1)
+		}
+	}()
+	t.Cleanup(func() {
+		b.Close()
+		<-done
+	})
+
+	// The receiver stops reading, so the sender soon blocks once the socket
+	// buffer fills.
+	data := make([]byte, 1024)
+	start := time.Now()
+	var sent int
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		err := a.SendContext(ctx, &IMsg{Type: 1, Data: data})
+		cancel()
+		if err == context.DeadlineExceeded {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected SendContext failure: %s", err)
+		}
+		sent++
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("sender never observed backpressure (%d imsgs sent)", sent)
+		}
+	}
+
+	elapsed := time.Since(start)
+	if n := received.Load(); n > 5+int64(elapsed.Seconds()*rate)+1 {
+		t.Fatalf("received %d imsgs in %s, exceeding the rate", n, elapsed)
+	}
+	if received.Load() >= int64(sent) {
+		t.Fatalf("receiver kept up with the sender")
+	}
+}
+
+func TestConnMaxRecvRateFail(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	b = rewrapTestConn(t, b, WithMaxRecvRate(1, 3), WithRecvRateAction(RecvRateFail))
+
+	for i := 0; i < 5; i++ {
+		err := a.Send(&IMsg{Type: uint32(i)})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+
+	// The burst is allowed, and everything beyond it is refused.
+	for i := 0; i < 3; i++ {
+		im, err := b.Recv()
+		if err != nil || im.Type != uint32(i) {
+			t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+		}
+	}
+	for i := 3; i < 5; i++ {
+		_, err := b.Recv()
+		var rate *ErrRecvRateExceeded
+		if !errors.As(err, &rate) || rate.Burst != 3 {
+			t.Fatalf("expected ErrRecvRateExceeded, got: %v", err)
+		}
+	}
+}
+
+func TestConnMaxRecvRateTryRecv(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	b = rewrapTestConn(t, b, WithMaxRecvRate(1, 1))
+
+	for i := 0; i < 2; i++ {
+		err := a.Send(&IMsg{Type: uint32(i)})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+
+	var im *IMsg
+	for deadline := time.Now().Add(5 * time.Second); im == nil; {
+		var err error
+		im, err = b.TryRecv()
+		if err != nil {
+			t.Fatalf("unexpected TryRecv failure: %s", err)
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("imsg never arrived")
+		}
+	}
+
+	// The second imsg is buffered, but TryRecv doesn't wait for the rate.
+	im, err := b.TryRecv()
+	if im != nil || err != nil {
+		t.Fatalf("unexpected TryRecv result (%v, %v)", im, err)
+	}
+
+	// Close interrupts a delayed Recv.
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		b.Close()
+	}()
+	start := time.Now()
+	b.Recv()
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("Close didn't interrupt a delayed Recv (%s)", elapsed)
+	}
+}
+
+func TestConnMaxRecvRateDeadline(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	b = rewrapTestConn(t, b, WithMaxRecvRate(0.1, 1))
+
+	for i := 0; i < 2; i++ {
+		err := a.Send(&IMsg{Type: uint32(i)})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+	_, err := b.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+
+	// The read deadline bounds the delay, leaving the Conn usable.
+	start := time.Now()
+	_, err = b.RecvTimeout(50 * time.Millisecond)
+	if !os.IsTimeout(err) {
+		t.Fatalf("expected timeout, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("read deadline didn't interrupt a delayed Recv (%s)", elapsed)
+	}
+	if s := b.State(); s != StateActive {
+		t.Fatalf("unexpected state after timeout (%s)", s)
+	}
+
+	// So does the context of a receive.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = b.RecvMatching(ctx, func(*IMsg) bool { return true })
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected DeadlineExceeded, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("context didn't interrupt a delayed Recv (%s)", elapsed)
+	}
+}
@@ -0,0 +1,190 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// This is the size of each read made while scanning for a header.
+const resyncReadSize = 512
+
+// A pushbackReader returns buffered bytes before reading from r. A Decoder
+// reads through one after Resync has read beyond the header it found.
+type pushbackReader struct {
+	buf []byte
+	r   io.Reader
+}
+
+// Read implements the io.Reader interface.
+func (pr *pushbackReader) Read(p []byte) (int, error) {
+	if len(pr.buf) == 0 {
+		return pr.r.Read(p)
+	}
+
+	n := copy(p, pr.buf)
+	pr.buf = pr.buf[n:]
+
+	return n, nil
+}
+
+// SetResyncTypes restricts the headers found by Resync to those of the provided
+// types, such as the types registered with RegisterTypeName, which makes a
+// spurious match less likely. Providing no types lifts the restriction.
+func (d *Decoder) SetResyncTypes(types ...uint32) {
+	if len(types) == 0 {
+		d.resyncTypes = nil
+		return
+	}
+
+	d.resyncTypes = make(map[uint32]bool, len(types))
+	for _, typ := range types {
+		d.resyncTypes[typ] = true
+	}
+}
+
+// Resync makes a best-effort attempt to recover from a corrupt imsg by scanning
+// forward, a byte at a time, for the next plausible header: one whose length
+// is within bounds, with no unknown flags set, and of one of the types set with
+// SetResyncTypes, if any, which is followed either by the end of the stream or
+// by another plausible header once its length is skipped. If the previous
+// Decode failed with ErrLengthOutOfBounds, the scan begins with the second byte
+// of the offending header; otherwise it begins at the current position. Resync
+// returns the number of bytes skipped, after which the next Decode begins at
+// the header it found.
+//
+// At most maxScan bytes are skipped before Resync gives up, returning
+// ErrResyncFailed. If the stream ends first, io.EOF is returned. Since
+// plausible headers may occur by chance within an imsg's data, Resync is
+// intended for inspecting captured streams, and is never performed
+// automatically.
+func (d *Decoder) Resync(maxScan int) (int, error) {
+	r := resyncer{src: d.r}
+	if d.badHdr {
+		// The first byte of the offending header has already been ruled out.
+		r.buf = append(r.buf, d.hdr[1:]...)
+		r.skipped = 1
+		d.badHdr = false
+	}
+	if pr, ok := r.src.(*pushbackReader); ok {
+		r.buf = append(r.buf, pr.buf...)
+		r.src = pr.r
+	}
+	defer func() {
+		d.off += r.read
+		d.setPushback(r.src, r.buf)
+	}()
+
+	err := r.scan(endianness, d.plausibleHeader, maxScan)
+
+	return r.skipped, err
+}
+
+// A resyncer holds the bytes being scanned by Resync and AnalyzeStream.
+type resyncer struct {
+	src     io.Reader
+	buf     []byte // Bytes read which haven't been ruled out
+	skipped int    // Bytes which have been ruled out
+	read    int64  // Bytes read from src
+	err     error  // Error from the last read of src
+}
+
+// fill reads from src until at least n bytes are buffered, reporting whether
+// they are.
+func (r *resyncer) fill(n int) bool {
+	for len(r.buf) < n && r.err == nil {
+		var m int
+		r.buf = append(r.buf, make([]byte, resyncReadSize)...)
+		m, r.err = r.src.Read(r.buf[len(r.buf)-resyncReadSize:])
+		r.buf = r.buf[:len(r.buf)-resyncReadSize+m]
+		r.read += int64(m)
+	}
+
+	return len(r.buf) >= n
+}
+
+// scan skips buffered bytes until plausible reports that a header, encoded in
+// the provided byte order, begins at the first of them, and the stream
+// continues plausibly after its imsg. It gives up once more than limit bytes
+// have been skipped in total.
+func (r *resyncer) scan(order binary.ByteOrder, plausible func(hdr []byte) bool, limit int) error {
+	for {
+		if !r.fill(HeaderSizeInBytes) {
+			if r.err == io.EOF {
+				r.skip(len(r.buf))
+				return io.EOF
+			}
+			return &ErrRead{"header", r.err}
+		}
+
+		if plausible(r.buf[:HeaderSizeInBytes]) {
+			length := int(order.Uint16(r.buf[4:6]))
+			r.fill(length + HeaderSizeInBytes)
+			switch {
+			case len(r.buf) >= length+HeaderSizeInBytes:
+				if plausible(r.buf[length : length+HeaderSizeInBytes]) {
+					return nil
+				}
+			case len(r.buf) == length && r.err == io.EOF:
+				return nil
+			case r.err != io.EOF:
+				return &ErrRead{"body", r.err}
+			}
+		}
+
+		r.skip(1)
+		if r.skipped > limit {
+			return &ErrResyncFailed{limit}
+		}
+	}
+}
+
+// skip rules out the first n buffered bytes.
+func (r *resyncer) skip(n int) {
+	r.buf = r.buf[n:]
+	r.skipped += n
+}
+
+// setPushback arranges for the Decoder to read buf before reading from src.
+func (d *Decoder) setPushback(src io.Reader, buf []byte) {
+	d.off -= int64(len(buf))
+	if len(buf) == 0 {
+		d.r = src
+		return
+	}
+
+	d.r = &pushbackReader{buf, src}
+}
+
+// plausibleHeader reports whether hdr could be the header of an imsg which the
+// Decoder would accept.
+func (d *Decoder) plausibleHeader(hdr []byte) bool {
+	if !plausibleHeader(hdr, endianness, d.maxSize, d.knownFlags()) {
+		return false
+	}
+
+	return d.resyncTypes == nil || d.resyncTypes[endianness.Uint32(hdr[0:4])]
+}
+
+// plausibleHeader reports whether hdr, encoded in the provided byte order,
+// could be the header of an imsg of at most maxSize bytes with no flags other
+// than those of known set.
+func plausibleHeader(hdr []byte, order binary.ByteOrder, maxSize uint16, known Flags) bool {
+	length := order.Uint16(hdr[4:6])
+	if length < HeaderSizeInBytes || length > maxSize {
+		return false
+	}
+
+	return checkFlags(Flags(order.Uint16(hdr[6:8])), known) == nil
+}
+
+// isBadHeader reports whether err indicates that the header most recently read
+// by a Decoder is corrupt.
+func isBadHeader(err error) bool {
+	var eloob *ErrLengthOutOfBounds
+	return errors.As(err, &eloob)
+}
@@ -0,0 +1,97 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// corruptStream returns the encoding of three imsgs with the length of the
+// second corrupted, along with the encoded length of the second.
+func corruptStream(length uint16) ([]byte, int) {
+	first, _ := (&IMsg{Type: 1, Data: []byte("first")}).MarshalBinary()
+	second, _ := (&IMsg{Type: 2, Data: []byte("second")}).MarshalBinary()
+	third, _ := (&IMsg{Type: 3, Data: []byte("third")}).MarshalBinary()
+	endianness.PutUint16(second[4:6], length)
+
+	var stream []byte
+	for _, bs := range [][]byte{first, second, third} {
+		stream = append(stream, bs...)
+	}
+
+	return stream, len(second)
+}
+
+func TestDecoderResync(t *testing.T) {
+	for _, length := range []uint16{4, MaxSizeInBytes + 1} {
+		stream, skip := corruptStream(length)
+		dec := NewDecoder(&chunkedReader{r: bytes.NewReader(stream), chunks: []int{7}})
+
+		im, err := dec.Decode()
+		if err != nil || im.Type != 1 {
+			t.Fatalf("length %d: unexpected Decode result (%v, %v)", length, im, err)
+		}
+		_, err = dec.Decode()
+		var eloob *ErrLengthOutOfBounds
+		if !errors.As(err, &eloob) {
+			t.Fatalf("length %d: expected ErrLengthOutOfBounds, got: %v", length, err)
+		}
+
+		n, err := dec.Resync(1024)
+		if err != nil {
+			t.Fatalf("length %d: unexpected Resync failure: %s", length, err)
+		}
+		if n != skip {
+			t.Fatalf("length %d: unexpected number of bytes skipped (%d != %d)", length, n, skip)
+		}
+
+		im, err = dec.Decode()
+		if err != nil || im.Type != 3 || string(im.Data) != "third" {
+			t.Fatalf("length %d: unexpected Decode result after Resync (%v, %v)", length, im, err)
+		}
+		_, err = dec.Decode()
+		if err != io.EOF {
+			t.Fatalf("length %d: expected io.EOF, got: %v", length, err)
+		}
+		if dec.off != int64(len(stream)) {
+			t.Fatalf("length %d: unexpected offset (%d != %d)", length, dec.off, len(stream))
+		}
+	}
+}
+
+func TestDecoderResyncLimits(t *testing.T) {
+	stream, skip := corruptStream(4)
+
+	// A scan which is too short fails, but may be resumed.
+	dec := NewDecoder(bytes.NewReader(stream))
+	dec.Decode()
+	dec.Decode()
+	n, err := dec.Resync(skip - 2)
+	var erf *ErrResyncFailed
+	if !errors.As(err, &erf) || n != skip-1 {
+		t.Fatalf("expected ErrResyncFailed after %d bytes, got: (%d, %v)", skip-1, n, err)
+	}
+	n, err = dec.Resync(10)
+	if err != nil || n != 1 {
+		t.Fatalf("unexpected Resync result (%d, %v)", n, err)
+	}
+	im, err := dec.Decode()
+	if err != nil || im.Type != 3 {
+		t.Fatalf("unexpected Decode result after Resync (%v, %v)", im, err)
+	}
+
+	// Only the allowed types are found.
+	dec = NewDecoder(bytes.NewReader(stream))
+	dec.SetResyncTypes(1, 2)
+	dec.Decode()
+	dec.Decode()
+	_, err = dec.Resync(1024)
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF, got: %v", err)
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"io"
+)
+
+// A RingDecoder reads imsgs from a stream by way of a fixed-size ring buffer,
+// twice the maximum imsg size, which it fills with one large read whenever no
+// complete imsg is buffered. Every imsg which arrived in that read is then
+// decoded straight out of the ring, so a burst of imsgs costs a single read
+// from the underlying io.Reader. Unlike a Decoder, a RingDecoder may consume
+// more of the reader than the imsgs it has returned.
+type RingDecoder struct {
+	r       io.Reader
+	maxSize uint16
+
+	ring  []byte // Bytes read but not yet decoded, beginning at start
+	start int    // Offset within ring of the first buffered byte
+	n     int    // Number of bytes buffered, which may wrap around the ring
+
+	hdr [HeaderSizeInBytes]byte
+
+	zeroCopy bool   // Set by SetZeroCopy
+	zim      IMsg   // Returned by each Decode in zero-copy mode
+	zbuf     []byte // Holds the data of a zero-copy imsg which wraps the ring
+}
+
+// NewRingDecoder constructs a RingDecoder which reads from the provided
+// io.Reader.
+func NewRingDecoder(r io.Reader) *RingDecoder {
+	return &RingDecoder{
+		r:       r,
+		maxSize: MaxSizeInBytes,
+	}
+}
+
+// SetMaxSize sets the maximum size in bytes of an imsg which may be decoded,
+// which defaults to MaxSizeInBytes, and resizes the ring to match. Sizes
+// smaller than HeaderSizeInBytes are rejected. Buffered data is retained, so
+// the ring may remain larger than twice the maximum size until it drains.
+func (d *RingDecoder) SetMaxSize(n uint16) error {
+	err := validateMaxSize(n)
+	if err != nil {
+		return err
+	}
+
+	d.maxSize = n
+	d.zbuf = nil
+	if d.ring != nil {
+		size := 2 * int(n)
+		if size < d.n {
+			size = d.n
+		}
+		ring := make([]byte, size)
+		d.copyOut(ring[:d.n], 0)
+		d.ring = ring
+		d.start = 0
+	}
+
+	return nil
+}
+
+// SetZeroCopy controls whether the RingDecoder avoids allocating for each imsg
+// it decodes. In zero-copy mode, Decode returns the same IMsg each time, and
+// its Data aliases the ring, or for an imsg which wraps around the end of the
+// ring, a buffer belonging to the RingDecoder. Both are only valid until the
+// next call to Decode, so callers which need to retain an imsg beyond that must
+// copy it, such as with Clone or DataCopy.
+func (d *RingDecoder) SetZeroCopy(enabled bool) {
+	d.zeroCopy = enabled
+	d.zim = IMsg{}
+}
+
+// Buffered returns the number of bytes which have been read from the
+// underlying io.Reader but not yet decoded.
+func (d *RingDecoder) Buffered() int {
+	return d.n
+}
+
+// Decode returns the next imsg, reading from the underlying io.Reader only if
+// no complete imsg is buffered. Errors are reported as ReadIMsg does. In
+// zero-copy mode, the returned imsg is only valid until the next call to
+// Decode.
+func (d *RingDecoder) Decode() (*IMsg, error) {
+	if d.zeroCopy {
+		d.zim = IMsg{}
+		err := d.decode(&d.zim, true)
+		if err != nil {
+			return nil, err
+		}
+		return &d.zim, nil
+	}
+
+	im := &IMsg{}
+	err := d.decode(im, false)
+	if err != nil {
+		return nil, err
+	}
+
+	return im, nil
+}
+
+// DecodeInto behaves like Decode, decoding the next imsg into im instead. The
+// imsg's data is copied into its existing Data if that has sufficient capacity,
+// so a steady stream of imsgs may be decoded without allocating. On failure, im
+// is left in an unspecified state.
+func (d *RingDecoder) DecodeInto(im *IMsg) error {
+	return d.decode(im, false)
+}
+
+// decode decodes the next imsg into im, aliasing the ring if alias is set.
+func (d *RingDecoder) decode(im *IMsg, alias bool) error {
+	if d.ring == nil {
+		d.ring = make([]byte, 2*int(d.maxSize))
+	}
+
+	for {
+		if d.n >= HeaderSizeInBytes {
+			d.copyOut(d.hdr[:], 0)
+			length, err := im.getHeader(d.hdr[:], d.maxSize)
+			if err != nil {
+				return err
+			}
+
+			if d.n >= length {
+				d.take(im, length, alias)
+				return nil
+			}
+		}
+
+		err := d.fill()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// take removes an imsg of length bytes, whose header has already been
+// decoded into im, from the ring.
+func (d *RingDecoder) take(im *IMsg, length int, alias bool) {
+	size := length - HeaderSizeInBytes
+	off := (d.start + HeaderSizeInBytes) % len(d.ring)
+
+	switch {
+	case size == 0:
+		im.Data = nil
+	case alias && off+size <= len(d.ring):
+		im.Data = d.ring[off : off+size]
+	default:
+		buf := im.Data
+		if alias {
+			if d.zbuf == nil {
+				d.zbuf = make([]byte, int(d.maxSize)-HeaderSizeInBytes)
+			}
+			buf = d.zbuf
+		}
+		if cap(buf) < size {
+			buf = make([]byte, size)
+		}
+		im.Data = buf[:size]
+		d.copyOut(im.Data, HeaderSizeInBytes)
+	}
+
+	d.start = (d.start + length) % len(d.ring)
+	d.n -= length
+}
+
+// copyOut copies len(dst) buffered bytes, beginning skip bytes past the first,
+// into dst. The caller must ensure that skip+len(dst) bytes are buffered.
+func (d *RingDecoder) copyOut(dst []byte, skip int) {
+	off := (d.start + skip) % len(d.ring)
+	n := copy(dst, d.ring[off:])
+	copy(dst[n:], d.ring)
+}
+
+// fill performs a single read from the underlying io.Reader into the free
+// space of the ring.
+func (d *RingDecoder) fill() error {
+	if d.n == 0 {
+		// Reading into the start of the ring leaves as much contiguous space as
+		// possible for the next burst.
+		d.start = 0
+	}
+
+	end := (d.start + d.n) % len(d.ring)
+	free := d.ring[end:]
+	if end < d.start || (end == d.start && d.n > 0) {
+		free = d.ring[end:d.start]
+	}
+
+	n, err := d.r.Read(free)
+	d.n += n
+	if n > 0 {
+		return nil
+	}
+
+	switch {
+	case err == io.EOF && d.n == 0:
+		// A clean end of stream between imsgs isn't an error.
+		return io.EOF
+	case err == io.EOF && d.n < HeaderSizeInBytes:
+		return &ErrTruncated{HeaderSizeInBytes, d.n, "header"}
+	case err == io.EOF:
+		d.copyOut(d.hdr[:], 0)
+		length := int(endianness.Uint16(d.hdr[4:6]))
+		return &ErrTruncated{
+			length - HeaderSizeInBytes,
+			d.n - HeaderSizeInBytes,
+			"body",
+		}
+	case err != nil && d.n < HeaderSizeInBytes:
+		return &ErrRead{"header", err}
+	case err != nil:
+		return &ErrRead{"body", err}
+	}
+
+	return nil
+}
@@ -0,0 +1,225 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// This is a reader which returns at most the next of a list of chunk sizes from
+// each call to Read, cycling through the list, and counts the calls made.
+type chunkedReader struct {
+	r      io.Reader
+	chunks []int
+	reads  int
+}
+
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	if len(cr.chunks) > 0 {
+		if n := cr.chunks[cr.reads%len(cr.chunks)]; len(p) > n {
+			p = p[:n]
+		}
+	}
+	cr.reads++
+	return cr.r.Read(p)
+}
+
+// testRingBatch returns a batch of imsgs of random sizes no larger than
+// maxSize bytes along with their encoding.
+func testRingBatch(rng *rand.Rand, count int, maxSize uint16) ([]*IMsg, []byte) {
+	batch := make([]*IMsg, count)
+	for i := range batch {
+		data := make([]byte, rng.Intn(int(maxSize)-HeaderSizeInBytes+1))
+		rng.Read(data)
+		batch[i] = &IMsg{Type: uint32(i), PeerID: rng.Uint32(), PID: rng.Uint32(), Data: data}
+	}
+	stream, _ := MarshalAll(batch)
+
+	return batch, stream
+}
+
+func TestRingDecoder(t *testing.T) {
+	const maxSize = 64
+	rng := rand.New(rand.NewSource(1))
+	batch, stream := testRingBatch(rng, 1000, maxSize)
+
+	modes := []struct {
+		name   string
+		decode func(d *RingDecoder) (*IMsg, error)
+	}{
+		{"Decode", (*RingDecoder).Decode},
+		{"DecodeZeroCopy", func(d *RingDecoder) (*IMsg, error) {
+			d.SetZeroCopy(true)
+			return d.Decode()
+		}},
+		{"DecodeInto", func(d *RingDecoder) (*IMsg, error) {
+			im := &IMsg{Data: make([]byte, 0, 8)}
+			return im, d.DecodeInto(im)
+		}},
+	}
+	for _, mode := range modes {
+		for _, chunks := range [][]int{nil, {1}, {7, 100, 3}, {maxSize + 5}} {
+			d := NewRingDecoder(&chunkedReader{r: bytes.NewReader(stream), chunks: chunks})
+			d.SetMaxSize(maxSize)
+
+			for _, expected := range batch {
+				im, err := mode.decode(d)
+				if err != nil {
+					t.Fatalf("%s with chunks %v: unexpected failure: %s", mode.name, chunks, err)
+				}
+				if !im.Equal(expected) {
+					t.Fatalf("%s with chunks %v: decoded imsg does not match (%v != %v)", mode.name, chunks, im, expected)
+				}
+			}
+
+			_, err := d.Decode()
+			if err != io.EOF {
+				t.Fatalf("%s with chunks %v: expected io.EOF, got: %v", mode.name, chunks, err)
+			}
+		}
+	}
+}
+
+func TestRingDecoderWrap(t *testing.T) {
+	const maxSize = 64
+
+	// With a ring of 128 bytes, reads of 100 and then 28 bytes leave the first
+	// two imsgs whole and the start of the third at the end of the ring, with
+	// the rest of it to be read into the start of the ring.
+	tests := []struct {
+		name      string
+		sizes     []int
+		start     int
+		wrapsData bool
+	}{
+		{"header", []int{60, 60, 60, 60}, 120, false},
+		{"data", []int{44, 60, 60, 60}, 104, true},
+	}
+	for _, test := range tests {
+		var batch []*IMsg
+		for i, size := range test.sizes {
+			data := bytes.Repeat([]byte{byte(i)}, size-HeaderSizeInBytes)
+			batch = append(batch, &IMsg{Type: uint32(i), Data: data})
+		}
+		stream, _ := MarshalAll(batch)
+
+		cr := &chunkedReader{r: bytes.NewReader(stream), chunks: []int{100, 28, 100}}
+		d := NewRingDecoder(cr)
+		d.SetMaxSize(maxSize)
+		d.SetZeroCopy(true)
+
+		for i, expected := range batch {
+			im, err := d.Decode()
+			if err != nil {
+				t.Fatalf("%s: unexpected Decode failure: %s", test.name, err)
+			}
+			if !im.Equal(expected) {
+				t.Fatalf("%s: decoded imsg does not match (%v != %v)", test.name, im, expected)
+			}
+
+			switch i {
+			case 1:
+				if d.start != test.start || d.start+d.n != 128 {
+					t.Fatalf("%s: unexpected ring state (start %d, %d bytes)", test.name, d.start, d.n)
+				}
+			case 2:
+				// Data which wraps is copied out of the ring.
+				copied := d.zbuf != nil && &im.Data[0] == &d.zbuf[0]
+				if copied != test.wrapsData {
+					t.Fatalf("%s: unexpected aliasing of imsg data", test.name)
+				}
+			}
+		}
+	}
+}
+
+func TestRingDecoderErrors(t *testing.T) {
+	frame, _ := (&IMsg{Type: 1, Data: []byte("test")}).MarshalBinary()
+
+	var et *ErrTruncated
+	_, err := NewRingDecoder(bytes.NewReader(frame[:10])).Decode()
+	if !errors.As(err, &et) || et.Stage != "header" || et.Expected != 16 || et.Got != 10 {
+		t.Fatalf("expected truncated header, got: %v", err)
+	}
+
+	_, err = NewRingDecoder(bytes.NewReader(frame[:18])).Decode()
+	if !errors.As(err, &et) || et.Stage != "body" || et.Expected != 4 || et.Got != 2 {
+		t.Fatalf("expected truncated body, got: %v", err)
+	}
+
+	var eloob *ErrLengthOutOfBounds
+	bad := append([]byte{}, frame...)
+	endianness.PutUint16(bad[4:6], 8)
+	_, err = NewRingDecoder(bytes.NewReader(bad)).Decode()
+	if !errors.As(err, &eloob) {
+		t.Fatalf("expected ErrLengthOutOfBounds, got: %v", err)
+	}
+
+	readErr := errors.New("test")
+	_, err = NewRingDecoder(&failingReader{bytes.NewReader(frame[:18]), readErr}).Decode()
+	var er *ErrRead
+	if !errors.As(err, &er) || er.Stage != "body" || !errors.Is(err, readErr) {
+		t.Fatalf("expected wrapped read error, got: %v", err)
+	}
+
+	// Shrinking the maximum size keeps buffered imsgs intact.
+	stream := bytes.Repeat(frame, 10)
+	d := NewRingDecoder(bytes.NewReader(stream))
+	d.Decode()
+	d.SetMaxSize(HeaderSizeInBytes + 4)
+	for i := 1; i < 10; i++ {
+		im, err := d.Decode()
+		if err != nil || string(im.Data) != "test" {
+			t.Fatalf("unexpected Decode result after SetMaxSize (%v, %v)", im, err)
+		}
+	}
+}
+
+func BenchmarkRingDecoder(b *testing.B) {
+	frame, _ := (&IMsg{Type: 1, Data: make([]byte, 64)}).MarshalBinary()
+	stream := bytes.Repeat(frame, 1000)
+	r := bytes.NewReader(stream)
+	cr := &chunkedReader{r: r}
+
+	d := NewRingDecoder(cr)
+	im := &IMsg{}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if r.Len() == 0 && d.Buffered() == 0 {
+			r.Reset(stream)
+		}
+		err := d.DecodeInto(im)
+		if err != nil {
+			b.Fatalf("unexpected DecodeInto failure: %s", err)
+		}
+	}
+	b.ReportMetric(float64(cr.reads)/float64(b.N), "reads/op")
+}
+
+func BenchmarkRingDecoderReadIMsg(b *testing.B) {
+	frame, _ := (&IMsg{Type: 1, Data: make([]byte, 64)}).MarshalBinary()
+	stream := bytes.Repeat(frame, 1000)
+	r := bytes.NewReader(stream)
+	cr := &chunkedReader{r: r}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if r.Len() == 0 {
+			r.Reset(stream)
+		}
+		_, err := ReadIMsg(cr)
+		if err != nil {
+			b.Fatalf("unexpected ReadIMsg failure: %s", err)
+		}
+	}
+	b.ReportMetric(float64(cr.reads)/float64(b.N), "reads/op")
+}
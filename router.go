@@ -0,0 +1,253 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// A Router fans received imsgs out to channels according to their type, for
+// programs which would rather receive from channels than register handlers
+// with a Mux. Any number of subscribers may receive imsgs of the same type,
+// and imsgs of types nobody subscribed to go to the default subscribers. The
+// zero value is an empty Router ready for use.
+//
+// When a subscriber's buffer is full, the imsg is dropped for that subscriber
+// and counted by Dropped, unless SetBlocking makes the Router wait instead.
+type Router struct {
+	mu    sync.Mutex
+	subs  map[uint32][]*subscription
+	def   []*subscription
+	block bool // Set by SetBlocking
+
+	dropped atomic.Uint64
+}
+
+// A subscription is a channel subscribed to imsgs of a Router.
+type subscription struct {
+	ch   chan *IMsg
+	done chan struct{} // Closed when unsubscribing, to unblock the Router
+
+	mu     sync.Mutex // Held while sending on ch
+	closed bool
+}
+
+// NewRouter constructs an empty Router.
+func NewRouter() *Router {
+	return &Router{}
+}
+
+// SetBlocking controls what the Router does when a subscriber's buffer is full.
+// By default, the imsg is dropped for that subscriber. If enabled, the Router
+// waits for the subscriber to make room, holding up every other subscriber in
+// the meantime.
+func (r *Router) SetBlocking(enabled bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.block = enabled
+}
+
+// Subscribe returns a channel which receives imsgs of the provided type,
+// buffering up to the provided number of them, along with a function which
+// unsubscribes, closing the channel. Imsgs left in the channel when it's
+// closed are discarded, closing their attached files.
+func (r *Router) Subscribe(typ uint32, buffer int) (<-chan *IMsg, func()) {
+	s := newSubscription(buffer)
+
+	r.mu.Lock()
+	if r.subs == nil {
+		r.subs = make(map[uint32][]*subscription)
+	}
+	r.subs[typ] = append(r.subs[typ], s)
+	r.mu.Unlock()
+
+	return s.ch, r.unsubscriber(s, func() {
+		r.subs[typ] = removeSubscription(r.subs[typ], s)
+		if len(r.subs[typ]) == 0 {
+			delete(r.subs, typ)
+		}
+	})
+}
+
+// SubscribeDefault returns a channel which receives imsgs of any type without
+// subscribers of its own. It otherwise behaves like Subscribe.
+func (r *Router) SubscribeDefault(buffer int) (<-chan *IMsg, func()) {
+	s := newSubscription(buffer)
+
+	r.mu.Lock()
+	r.def = append(r.def, s)
+	r.mu.Unlock()
+
+	return s.ch, r.unsubscriber(s, func() {
+		r.def = removeSubscription(r.def, s)
+	})
+}
+
+// Dropped returns the number of imsgs dropped for subscribers, because their
+// buffers were full or because they unsubscribed while the Router waited.
+func (r *Router) Dropped() uint64 {
+	return r.dropped.Load()
+}
+
+// Route passes an imsg to its subscribers. Each subscriber receives its own
+// Clone, except that one of them receives the imsg itself, along with any
+// attached file. If no subscriber receives the imsg, its attached file is
+// closed. When blocking is enabled with SetBlocking, Route can only be
+// interrupted by the context, whose error it returns; otherwise it never fails.
+func (r *Router) Route(ctx context.Context, im *IMsg) error {
+	r.mu.Lock()
+	subs, ok := r.subs[im.Type]
+	if !ok {
+		subs = r.def
+	}
+	subs = append([]*subscription(nil), subs...)
+	block := r.block
+	r.mu.Unlock()
+
+	given := false
+	for _, s := range subs {
+		out := im
+		if given {
+			out = im.Clone()
+		}
+		ok, err := s.send(ctx, out, block)
+		if err != nil {
+			if !given {
+				im.closeFile()
+			}
+			return err
+		}
+		if ok {
+			given = true
+		} else {
+			r.dropped.Add(1)
+		}
+	}
+	if !given {
+		im.closeFile()
+	}
+
+	return nil
+}
+
+// Run receives imsgs from c and routes them until the context is cancelled or
+// the Conn fails, in the manner of Serve. If the peer closes the connection
+// cleanly between imsgs, Run returns nil. Like Serve, Run can't be used at the
+// same time as RecvMatching.
+func (r *Router) Run(ctx context.Context, c *Conn) error {
+	if !c.enterRecvMode(1) {
+		return ErrRecvConflict
+	}
+	defer c.recvMode.Add(-1)
+	defer c.interruptOnDone(ctx)()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		im, err := c.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		err = r.Route(ctx, im)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// unsubscriber returns the function which unsubscribes s, removing it from
+// the Router with remove, which is called holding mu.
+func (r *Router) unsubscriber(s *subscription, remove func()) func() {
+	var once sync.Once
+
+	return func() {
+		once.Do(func() {
+			r.mu.Lock()
+			remove()
+			r.mu.Unlock()
+
+			s.close()
+		})
+	}
+}
+
+// newSubscription constructs a subscription buffering up to n imsgs.
+func newSubscription(n int) *subscription {
+	if n < 0 {
+		n = 0
+	}
+
+	return &subscription{
+		ch:   make(chan *IMsg, n),
+		done: make(chan struct{}),
+	}
+}
+
+// send passes an imsg to the subscriber, reporting whether it was accepted.
+// If block is set, send waits for room in the buffer until the subscriber
+// unsubscribes or the context is done.
+func (s *subscription) send(ctx context.Context, im *IMsg, block bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return false, nil
+	}
+	if !block {
+		select {
+		case s.ch <- im:
+			return true, nil
+		default:
+			return false, nil
+		}
+	}
+
+	select {
+	case s.ch <- im:
+		return true, nil
+	case <-s.done:
+		return false, nil
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+// close closes the subscription's channel, discarding any imsgs left in it.
+func (s *subscription) close() {
+	close(s.done)
+
+	s.mu.Lock()
+	s.closed = true
+	close(s.ch)
+	s.mu.Unlock()
+
+	for im := range s.ch {
+		im.closeFile()
+	}
+}
+
+// removeSubscription returns subs without s.
+func removeSubscription(subs []*subscription, s *subscription) []*subscription {
+	for i, other := range subs {
+		if other == s {
+			return append(subs[:i:i], subs[i+1:]...)
+		}
+	}
+
+	return subs
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRouterSubscribers(t *testing.T) {
+	r := NewRouter()
+	first, unsubFirst := r.Subscribe(1, 1)
+	defer unsubFirst()
+	second, unsubSecond := r.Subscribe(1, 1)
+	defer unsubSecond()
+	def, unsubDef := r.SubscribeDefault(1)
+	defer unsubDef()
+
+	im := &IMsg{Type: 1, Data: []byte{1, 2, 3}}
+	err := r.Route(context.Background(), im)
+	if err != nil {
+		t.Fatalf("unexpected Route failure: %s", err)
+	}
+
+	// Each subscriber gets its own copy.
+	a, b := <-first, <-second
+	if !a.Equal(im) || !b.Equal(im) {
+		t.Fatalf("unexpected imsgs routed (%v, %v)", a, b)
+	}
+	a.Data[0] = 9
+	if b.Data[0] != 1 {
+		t.Fatalf("subscribers share imsg data")
+	}
+
+	// Unmatched types go to the default subscriber.
+	err = r.Route(context.Background(), &IMsg{Type: 2})
+	if err != nil {
+		t.Fatalf("unexpected Route failure: %s", err)
+	}
+	select {
+	case im := <-def:
+		if im.Type != 2 {
+			t.Fatalf("unexpected imsg routed to default (%v)", im)
+		}
+	default:
+		t.Fatalf("no imsg routed to default")
+	}
+	if len(first) != 0 || len(second) != 0 {
+		t.Fatalf("unmatched imsg routed to type subscribers")
+	}
+}
+
+func TestRouterFullBuffer(t *testing.T) {
+	r := NewRouter()
+	slow, unsubSlow := r.Subscribe(1, 1)
+	defer unsubSlow()
+	fast, unsubFast := r.Subscribe(1, 2)
+	defer unsubFast()
+
+	for i := uint32(0); i < 2; i++ {
+		err := r.Route(context.Background(), &IMsg{Type: 1, PeerID: i})
+		if err != nil {
+			t.Fatalf("unexpected Route failure: %s", err)
+		}
+	}
+
+	// The second imsg was dropped for the full subscriber only.
+	if n := r.Dropped(); n != 1 {
+		t.Fatalf("unexpected count of dropped imsgs: %d", n)
+	}
+	if im := <-slow; im.PeerID != 0 || len(slow) != 0 {
+		t.Fatalf("unexpected imsgs for full subscriber (%v, %d)", im, len(slow))
+	}
+	if len(fast) != 2 {
+		t.Fatalf("unexpected imsgs for subscriber with room (%d)", len(fast))
+	}
+}
+
+func TestRouterBlocking(t *testing.T) {
+	r := NewRouter()
+	r.SetBlocking(true)
+	ch, unsub := r.Subscribe(1, 0)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	err := r.Route(ctx, &IMsg{Type: 1})
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got: %v", err)
+	}
+
+	// Unsubscribing unblocks the Router and closes the channel.
+	errc := make(chan error, 1)
+	go func() { errc <- r.Route(context.Background(), &IMsg{Type: 1}) }()
+	time.Sleep(10 * time.Millisecond)
+	unsub()
+	select {
+	case err = <-errc:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Route did not return after unsubscribing")
+	}
+	if err != nil {
+		t.Fatalf("unexpected Route failure: %s", err)
+	}
+	if _, ok := <-ch; ok {
+		t.Fatalf("channel not closed by unsubscribing")
+	}
+	unsub()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.subs) != 0 {
+		t.Fatalf("subscription retained after unsubscribing")
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRouterRun(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	r := NewRouter()
+	ch, unsub := r.Subscribe(1, 1)
+	defer unsub()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- r.Run(ctx, b) }()
+
+	err := a.Send(&IMsg{Type: 1, PeerID: 7})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	if im := <-ch; im.PeerID != 7 {
+		t.Fatalf("unexpected imsg routed (%v)", im)
+	}
+
+	cancel()
+	select {
+	case err = <-errc:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return after cancellation")
+	}
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+}
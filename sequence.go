@@ -0,0 +1,177 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// A SequenceField reads and writes the sequence number carried by an imsg.
+type SequenceField struct {
+	Get func(im *IMsg) uint32
+	Set func(im *IMsg, seq uint32)
+}
+
+// PeerIDSequence carries the sequence number in the PeerID field.
+var PeerIDSequence = SequenceField{
+	Get: func(im *IMsg) uint32 { return im.PeerID },
+	Set: func(im *IMsg, seq uint32) { im.PeerID = seq },
+}
+
+// DataPrefixSequence carries the sequence number in the first four bytes of the
+// imsg's data, in the system's byte order. Set prepends the sequence number to
+// the existing data, which the receiver recovers with im.Data[4:]. Get returns
+// zero for an imsg with fewer than four bytes of data.
+var DataPrefixSequence = SequenceField{
+	Get: func(im *IMsg) uint32 {
+		if len(im.Data) < 4 {
+			return 0
+		}
+		return endianness.Uint32(im.Data)
+	},
+	Set: func(im *IMsg, seq uint32) {
+		data := make([]byte, 4+len(im.Data))
+		endianness.PutUint32(data, seq)
+		copy(data[4:], im.Data)
+		im.Data = data
+	},
+}
+
+// A Sequencer stamps imsgs with consecutive sequence numbers, starting from
+// zero and wrapping around after 2^32-1, so that a Tracker at the receiving end
+// can detect imsgs which were lost or duplicated in transit. This is only
+// useful when imsgs are carried over a transport which doesn't itself
+// guarantee delivery, since a socket never loses or repeats them. Imsgs are
+// stamped explicitly before they're sent, so a Sequencer works with an Encoder
+// as well as with a Conn. A Sequencer is safe for concurrent use.
+type Sequencer struct {
+	field SequenceField
+	next  atomic.Uint32
+}
+
+// NewSequencer constructs a Sequencer which stores sequence numbers in the
+// provided field, such as PeerIDSequence.
+func NewSequencer(field SequenceField) *Sequencer {
+	return &Sequencer{field: field}
+}
+
+// Stamp stores the next sequence number in the imsg, returning it.
+func (s *Sequencer) Stamp(im *IMsg) uint32 {
+	seq := s.next.Add(1) - 1
+	s.field.Set(im, seq)
+
+	return seq
+}
+
+// A SequenceStatus describes how an imsg observed by a Tracker relates to the
+// imsgs observed before it.
+type SequenceStatus int
+
+const (
+	// InSequence imsgs are the ones expected.
+	InSequence SequenceStatus = iota
+	// SequenceGap imsgs follow one or more missing imsgs.
+	SequenceGap
+	// SequenceDuplicate imsgs have already been observed.
+	SequenceDuplicate
+)
+
+// String implements the fmt.Stringer interface.
+func (s SequenceStatus) String() string {
+	switch s {
+	case InSequence:
+		return "in sequence"
+	case SequenceGap:
+		return "gap"
+	case SequenceDuplicate:
+		return "duplicate"
+	}
+
+	return "unknown"
+}
+
+// A Tracker checks the sequence numbers stamped by a Sequencer as imsgs are
+// received, reporting gaps and duplicates. The first imsg observed establishes
+// the expected sequence. Sequence numbers are compared modulo 2^32, so an imsg
+// up to 2^31-1 ahead of the one expected is taken to follow a gap, and any
+// other unexpected imsg is taken to be a duplicate, or one which arrived too
+// late to be distinguished from one. Since a late imsg has already been
+// accounted for by a gap, it doesn't move the expected sequence back. A
+// Tracker is safe for concurrent use.
+type Tracker struct {
+	field SequenceField
+
+	mu      sync.Mutex
+	started bool
+	next    uint32
+	onGap   func(expected, got uint32)
+	onDup   func(seq uint32)
+}
+
+// NewTracker constructs a Tracker which reads sequence numbers from the
+// provided field, which should match that of the sending Sequencer.
+func NewTracker(field SequenceField) *Tracker {
+	return &Tracker{field: field}
+}
+
+// SetGapFunc sets a function which is called by Observe for an imsg which
+// follows a gap, with the sequence number expected and the one received. The
+// number of missing imsgs is got-expected.
+func (t *Tracker) SetGapFunc(f func(expected, got uint32)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.onGap = f
+}
+
+// SetDuplicateFunc sets a function which is called by Observe for a duplicate
+// imsg, with its sequence number.
+func (t *Tracker) SetDuplicateFunc(f func(seq uint32)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.onDup = f
+}
+
+// Observe checks the sequence number of a received imsg, calling the function
+// set with SetGapFunc or SetDuplicateFunc if it's unexpected, and returns its
+// status.
+func (t *Tracker) Observe(im *IMsg) SequenceStatus {
+	seq := t.field.Get(im)
+
+	t.mu.Lock()
+	if !t.started {
+		t.started = true
+		t.next = seq + 1
+		t.mu.Unlock()
+		return InSequence
+	}
+
+	expected := t.next
+	ahead := seq - expected
+	switch {
+	case ahead == 0:
+		t.next++
+		t.mu.Unlock()
+		return InSequence
+	case ahead < 1<<31:
+		t.next = seq + 1
+		onGap := t.onGap
+		t.mu.Unlock()
+		if onGap != nil {
+			onGap(expected, seq)
+		}
+		return SequenceGap
+	}
+
+	onDup := t.onDup
+	t.mu.Unlock()
+	if onDup != nil {
+		onDup(seq)
+	}
+
+	return SequenceDuplicate
+}
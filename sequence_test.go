@@ -0,0 +1,121 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestSequenceReplay(t *testing.T) {
+	for _, field := range []struct {
+		name  string
+		field SequenceField
+	}{
+		{"peer id", PeerIDSequence},
+		{"data prefix", DataPrefixSequence},
+	} {
+		t.Run(field.name, func(t *testing.T) {
+			// Record a stamped sequence, then replay it with the third imsg
+			// deleted and the fifth duplicated.
+			var recorded bytes.Buffer
+			enc := NewEncoder(&recorded)
+			seq := NewSequencer(field.field)
+			for i := 0; i < 8; i++ {
+				im := &IMsg{Type: 1, Data: []byte{byte(i)}}
+				seq.Stamp(im)
+				err := enc.Encode(im)
+				if err != nil {
+					t.Fatalf("unexpected Encode failure: %s", err)
+				}
+			}
+			ims, err := DecodeAll(recorded.Bytes())
+			if err != nil {
+				t.Fatalf("unexpected DecodeAll failure: %s", err)
+			}
+			replayed := append(append(append([]*IMsg{}, ims[:2]...), ims[3:6]...), ims[5:]...)
+			stream, _ := MarshalAll(replayed)
+
+			var events []string
+			tr := NewTracker(field.field)
+			tr.SetGapFunc(func(expected, got uint32) {
+				events = append(events, fmt.Sprintf("gap %d-%d", expected, got))
+			})
+			tr.SetDuplicateFunc(func(seq uint32) {
+				events = append(events, fmt.Sprintf("duplicate %d", seq))
+			})
+
+			var statuses []SequenceStatus
+			dec := NewDecoder(bytes.NewReader(stream))
+			for {
+				im, err := dec.Decode()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("unexpected Decode failure: %s", err)
+				}
+				statuses = append(statuses, tr.Observe(im))
+			}
+
+			expectedStatuses := []SequenceStatus{
+				InSequence, InSequence, SequenceGap, InSequence, InSequence,
+				SequenceDuplicate, InSequence, InSequence,
+			}
+			if !reflect.DeepEqual(statuses, expectedStatuses) {
+				t.Fatalf("unexpected statuses (%v != %v)", statuses, expectedStatuses)
+			}
+			expectedEvents := []string{"gap 2-3", "duplicate 5"}
+			if !reflect.DeepEqual(events, expectedEvents) {
+				t.Fatalf("unexpected events (%v != %v)", events, expectedEvents)
+			}
+		})
+	}
+}
+
+func TestSequenceWraparound(t *testing.T) {
+	seq := NewSequencer(PeerIDSequence)
+	seq.next.Store(1<<32 - 2)
+
+	tr := NewTracker(PeerIDSequence)
+	var stamped []uint32
+	for i := 0; i < 4; i++ {
+		im := &IMsg{}
+		stamped = append(stamped, seq.Stamp(im))
+		if status := tr.Observe(im); status != InSequence {
+			t.Fatalf("imsg %d is %s", im.PeerID, status)
+		}
+	}
+	expected := []uint32{1<<32 - 2, 1<<32 - 1, 0, 1}
+	if !reflect.DeepEqual(stamped, expected) {
+		t.Fatalf("unexpected sequence numbers (%v != %v)", stamped, expected)
+	}
+
+	// A gap spanning the wraparound is still a gap, and an imsg from before it
+	// is a duplicate.
+	if status := tr.Observe(&IMsg{PeerID: 5}); status != SequenceGap {
+		t.Fatalf("expected a gap, got: %s", status)
+	}
+	if status := tr.Observe(&IMsg{PeerID: 1<<32 - 1}); status != SequenceDuplicate {
+		t.Fatalf("expected a duplicate, got: %s", status)
+	}
+	if status := tr.Observe(&IMsg{PeerID: 6}); status != InSequence {
+		t.Fatalf("expected the sequence to continue, got: %s", status)
+	}
+}
+
+func TestDataPrefixSequence(t *testing.T) {
+	im := &IMsg{Data: []byte("test")}
+	DataPrefixSequence.Set(im, 42)
+	if DataPrefixSequence.Get(im) != 42 || string(im.Data[4:]) != "test" {
+		t.Fatalf("unexpected data after stamping (%x)", im.Data)
+	}
+	if DataPrefixSequence.Get(&IMsg{Data: []byte{1}}) != 0 {
+		t.Fatalf("short data should yield a zero sequence number")
+	}
+}
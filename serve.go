@@ -0,0 +1,79 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+	"io"
+)
+
+// A ServeOption configures optional behavior of Serve.
+type ServeOption func(*serveConfig)
+
+type serveConfig struct {
+	onError func(*IMsg, error) error
+}
+
+// WithErrorHandler provides a function which is called with each error
+// returned by a handler, along with the imsg which caused it. Serve continues
+// if the function returns nil and stops with the returned error otherwise.
+func WithErrorHandler(f func(im *IMsg, err error) error) ServeOption {
+	return func(cfg *serveConfig) {
+		cfg.onError = f
+	}
+}
+
+// Serve receives imsgs from c and dispatches each to m until the context is
+// cancelled, the Conn fails, or a handler returns an error. Cancelling the
+// context unblocks a pending Recv by expiring the read deadline of the
+// underlying socket, and Serve returns the context's error. If the peer closes
+// the connection cleanly between imsgs, Serve returns nil.
+//
+// A file attached to an imsg is closed once its handler returns, or if no
+// handler applies. A handler which retains the file must take ownership of it
+// with Detach.
+func Serve(ctx context.Context, c *Conn, m *Mux, opts ...ServeOption) error {
+	var cfg serveConfig
+	for _, opt := range opts {
+		opt(&cfg)
+	}
+
+	if !c.enterRecvMode(1) {
+		return ErrRecvConflict
+	}
+	defer c.recvMode.Add(-1)
+	defer c.interruptOnDone(ctx)()
+
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		im, err := c.Recv()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+
+		err = m.Dispatch(im)
+		if !c.isUnread(im) {
+			im.Close()
+		}
+		if err != nil {
+			if cfg.onError == nil {
+				return err
+			}
+			err = cfg.onError(im, err)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
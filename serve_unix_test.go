@@ -0,0 +1,139 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestServeCancel(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	m := NewMux()
+	received := make(chan uint32, 1)
+	m.HandleDefault(func(im *IMsg) error {
+		received <- im.Type
+		return nil
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- Serve(ctx, b, m) }()
+
+	err := a.Send(&IMsg{Type: 1})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	if typ := <-received; typ != 1 {
+		t.Fatalf("unexpected type dispatched (%d != 1)", typ)
+	}
+
+	// Serve is now blocked in Recv waiting for the next imsg.
+	cancel()
+	select {
+	case err = <-errc:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve did not return after cancellation")
+	}
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+
+	// The Conn remains usable after Serve returns.
+	err = a.Send(&IMsg{Type: 2})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	im, err := b.Recv()
+	if err != nil || im.Type != 2 {
+		t.Fatalf("unexpected Recv result after Serve (%v, %v)", im, err)
+	}
+}
+
+func TestServeHandlerError(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	errTest := errors.New("test")
+	m := NewMux()
+	m.Handle(1, func(*IMsg) error { return errTest })
+	m.Handle(2, func(*IMsg) error { return nil })
+
+	for _, typ := range []uint32{2, 1, 2} {
+		err := a.Send(&IMsg{Type: typ})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+
+	err := Serve(context.Background(), b, m)
+	if err != errTest {
+		t.Fatalf("expected handler error, got: %v", err)
+	}
+
+	// The imsg following the failure was left unread.
+	im, err := b.Recv()
+	if err != nil || im.Type != 2 {
+		t.Fatalf("unexpected Recv result after Serve (%v, %v)", im, err)
+	}
+}
+
+func TestServeErrorHandler(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	errTest := errors.New("test")
+	m := NewMux()
+	m.Handle(1, func(*IMsg) error { return errTest })
+
+	var handled []error
+	for _, typ := range []uint32{1, 3} {
+		err := a.Send(&IMsg{Type: typ})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+	a.Close()
+
+	err := Serve(context.Background(), b, m, WithErrorHandler(func(im *IMsg, err error) error {
+		handled = append(handled, err)
+		return nil
+	}))
+	if err != nil {
+		t.Fatalf("expected clean EOF, got: %v", err)
+	}
+
+	var enh *ErrNoHandler
+	if len(handled) != 2 || handled[0] != errTest || !errors.As(handled[1], &enh) {
+		t.Fatalf("unexpected errors passed to error handler (%v)", handled)
+	}
+}
+
+func TestServeEOF(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	var count int
+	m := NewMux()
+	m.HandleDefault(func(*IMsg) error { count++; return nil })
+
+	for i := 0; i < 3; i++ {
+		err := a.Send(&IMsg{Type: uint32(i)})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+	a.Close()
+
+	err := Serve(context.Background(), b, m)
+	if err != nil {
+		t.Fatalf("expected clean EOF, got: %v", err)
+	}
+	if count != 3 {
+		t.Fatalf("unexpected number of imsgs dispatched (%d != 3)", count)
+	}
+}
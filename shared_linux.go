@@ -0,0 +1,51 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// These seals prevent the contents of shared memory from changing once sent.
+const sharedSeals = unix.F_SEAL_SHRINK | unix.F_SEAL_GROW | unix.F_SEAL_WRITE | unix.F_SEAL_SEAL
+
+// createShared returns a sealed memfd holding data.
+func createShared(data []byte) (*os.File, error) {
+	fd, err := unix.MemfdCreate("imsg-shared", unix.MFD_CLOEXEC|unix.MFD_ALLOW_SEALING)
+	if err != nil {
+		return nil, os.NewSyscallError("memfd_create", err)
+	}
+	f := os.NewFile(uintptr(fd), "imsg-shared")
+
+	err = writeShared(f, data)
+	if err == nil {
+		_, err = unix.FcntlInt(f.Fd(), unix.F_ADD_SEALS, sharedSeals)
+		if err != nil {
+			err = os.NewSyscallError("fcntl", err)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// checkSeals returns ErrInvalidShared unless f is sealed against writes and
+// shrinking, either of which could change the data or fault its mapping.
+func checkSeals(f *os.File) error {
+	seals, err := unix.FcntlInt(f.Fd(), unix.F_GET_SEALS, 0)
+	if err != nil {
+		return &ErrInvalidShared{"not a sealed memfd"}
+	}
+	if seals&(unix.F_SEAL_SHRINK|unix.F_SEAL_WRITE) != unix.F_SEAL_SHRINK|unix.F_SEAL_WRITE {
+		return &ErrInvalidShared{"not sealed against modification"}
+	}
+
+	return nil
+}
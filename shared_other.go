@@ -0,0 +1,22 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build !unix
+
+package imsg
+
+import "runtime"
+
+// SendShared is unsupported on this platform, and returns
+// ErrUnsupportedPlatform.
+func SendShared(c *Conn, typ, peerID uint32, data []byte) error {
+	return &ErrUnsupportedPlatform{"shared memory", runtime.GOOS}
+}
+
+// RecvShared is unsupported on this platform, and returns
+// ErrUnsupportedPlatform. The file attached to the imsg is closed.
+func RecvShared(im *IMsg) ([]byte, func() error, error) {
+	im.Close()
+	return nil, nil, &ErrUnsupportedPlatform{"shared memory", runtime.GOOS}
+}
@@ -0,0 +1,32 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix && !linux
+
+package imsg
+
+import "os"
+
+// createShared returns an unlinked temporary file holding data, as memfds
+// aren't available on this platform.
+func createShared(data []byte) (*os.File, error) {
+	f, err := os.CreateTemp("", "imsg-shared-")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(f.Name())
+
+	err = writeShared(f, data)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// checkSeals does nothing, as files can't be sealed on this platform.
+func checkSeals(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// SendShared passes data to the peer of c in shared memory rather than in the
+// imsg itself, which allows payloads far larger than the maximum imsg size to be
+// transferred without being copied through the socket. The data is written to
+// an anonymous file whose descriptor is attached to an imsg of the provided
+// type, along with the length of the data, to be mapped by the peer with
+// RecvShared. On Linux, the file is a memfd sealed against further writes and
+// shrinking, so that the peer can trust its contents not to change; elsewhere
+// it's an unlinked temporary file, and the peer must trust the sender not to
+// modify it. Descriptor passing must be allowed on c with AllowFDPass.
+func SendShared(c *Conn, typ, peerID uint32, data []byte) error {
+	f, err := createShared(data)
+	if err != nil {
+		return err
+	}
+
+	var size [8]byte
+	endianness.PutUint64(size[:], uint64(len(data)))
+	im, err := ComposeIMsgWithFile(typ, peerID, size[:], f)
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = c.Send(im)
+	if err != nil {
+		im.Close()
+	}
+
+	return err
+}
+
+// writeShared writes data to f and rewinds it.
+func writeShared(f *os.File, data []byte) error {
+	_, err := f.Write(data)
+	if err != nil {
+		return err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+
+	return err
+}
+
+// RecvShared maps the shared memory passed by SendShared with the received
+// imsg, returning the data along with a function which unmaps it and closes the
+// underlying file. The data is read-only, and must not be used once the release
+// function has been called. The attached file is consumed, and is closed if an
+// error is returned. ErrInvalidShared is returned if the file is smaller than
+// the advertised length or, on Linux, if it isn't sealed against modification.
+func RecvShared(im *IMsg) ([]byte, func() error, error) {
+	if len(im.Data) != 8 {
+		im.Close()
+		return nil, nil, &ErrDataSizeMismatch{8, len(im.Data)}
+	}
+	f := im.Detach()
+	if f == nil {
+		return nil, nil, &ErrMissingFD{im.Type}
+	}
+
+	size := endianness.Uint64(im.Data)
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	if uint64(fi.Size()) < size || size > uint64(int(^uint(0)>>1)) {
+		f.Close()
+		return nil, nil, &ErrInvalidShared{fmt.Sprintf("%d bytes advertised, but only %d shared", size, fi.Size())}
+	}
+	err = checkSeals(f)
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+
+	if size == 0 {
+		return []byte{}, f.Close, nil
+	}
+
+	data, err := unix.Mmap(int(f.Fd()), 0, int(size), unix.PROT_READ, unix.MAP_SHARED)
+	if err != nil {
+		f.Close()
+		return nil, nil, os.NewSyscallError("mmap", err)
+	}
+
+	release := func() error {
+		err := unix.Munmap(data)
+		cerr := f.Close()
+		if err != nil {
+			return os.NewSyscallError("munmap", err)
+		}
+		return cerr
+	}
+
+	return data, release, nil
+}
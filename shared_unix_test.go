@@ -0,0 +1,98 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestSendShared(t *testing.T) {
+	a, b := newTestFDPassPair(t)
+
+	data := make([]byte, 10<<20)
+	_, err := rand.Read(data)
+	if err != nil {
+		t.Fatalf("unexpected rand.Read failure: %s", err)
+	}
+
+	for _, blob := range [][]byte{data, {}} {
+		err = SendShared(a, 1, 2, blob)
+		if err != nil {
+			t.Fatalf("unexpected SendShared failure: %s", err)
+		}
+		im, err := b.Recv()
+		if err != nil || im.Type != 1 || im.PeerID != 2 {
+			t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+		}
+
+		got, release, err := RecvShared(im)
+		if err != nil {
+			t.Fatalf("unexpected RecvShared failure: %s", err)
+		}
+		if sha256.Sum256(got) != sha256.Sum256(blob) || len(got) != len(blob) {
+			t.Fatalf("shared data does not match what was sent (%d bytes)", len(got))
+		}
+		err = release()
+		if err != nil {
+			t.Fatalf("unexpected release failure: %s", err)
+		}
+	}
+}
+
+func TestRecvSharedInvalid(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "shared")
+	if err != nil {
+		t.Fatalf("unexpected CreateTemp failure: %s", err)
+	}
+	_, err = f.Write([]byte("short"))
+	if err != nil {
+		t.Fatalf("unexpected write failure: %s", err)
+	}
+
+	// More is advertised than is shared.
+	var size [8]byte
+	endianness.PutUint64(size[:], 100)
+	im, err := ComposeIMsgWithFile(1, 0, size[:], f)
+	if err != nil {
+		t.Fatalf("unexpected ComposeIMsgWithFile failure: %s", err)
+	}
+	_, _, err = RecvShared(im)
+	var invalid *ErrInvalidShared
+	if !errors.As(err, &invalid) {
+		t.Fatalf("expected ErrInvalidShared, got: %v", err)
+	}
+
+	// An unsealed file could be modified by the sender.
+	f, err = os.Open(f.Name())
+	if err != nil {
+		t.Fatalf("unexpected Open failure: %s", err)
+	}
+	endianness.PutUint64(size[:], 5)
+	im, _ = ComposeIMsgWithFile(1, 0, size[:], f)
+	data, release, err := RecvShared(im)
+	if runtime.GOOS == "linux" {
+		if !errors.As(err, &invalid) {
+			t.Fatalf("expected ErrInvalidShared, got: %v", err)
+		}
+	} else {
+		if err != nil || string(data) != "short" {
+			t.Fatalf("unexpected RecvShared result (%q, %v)", data, err)
+		}
+		release()
+	}
+
+	_, _, err = RecvShared(&IMsg{Type: 1, Data: size[:]})
+	var missing *ErrMissingFD
+	if !errors.As(err, &missing) {
+		t.Fatalf("expected ErrMissingFD, got: %v", err)
+	}
+}
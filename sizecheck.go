@@ -0,0 +1,90 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"fmt"
+	"sync"
+)
+
+// A sizeRange is the range of data lengths expected of an imsg type.
+type sizeRange struct {
+	min, max int
+}
+
+// This is the registry of expected data lengths for imsg types.
+var expectedSizes = struct {
+	sync.RWMutex
+	m map[uint32]sizeRange
+}{m: make(map[uint32]sizeRange)}
+
+// RegisterExpectedSize registers the exact length in bytes of the data carried
+// by imsgs of the provided type, typically the size of the structure they
+// carry, replacing any previous registration for the type. Imsgs are only
+// checked against it where size checks are enabled, such as with
+// WithSizeCheck, in the manner of the C implementation's IMSG_SIZE_CHECK. This
+// catches peers which disagree on the layout of a structure, such as two
+// binaries built from different versions. RegisterExpectedSize panics if size
+// is negative.
+func RegisterExpectedSize(typ uint32, size int) {
+	RegisterSizeRange(typ, size, size)
+}
+
+// RegisterSizeRange registers the range of lengths in bytes, inclusive, of the
+// data carried by imsgs of the provided type, as RegisterExpectedSize does.
+// RegisterSizeRange panics if min is negative or greater than max.
+func RegisterSizeRange(typ uint32, min, max int) {
+	if min < 0 || min > max {
+		panic(fmt.Sprintf("imsg: invalid size range %d to %d for type %d", min, max, typ))
+	}
+
+	expectedSizes.Lock()
+	defer expectedSizes.Unlock()
+
+	expectedSizes.m[typ] = sizeRange{min, max}
+}
+
+// checkSize returns ErrSizeMismatch if the data carried by the imsg doesn't
+// have the length registered for its type. Imsgs of unregistered types pass.
+func checkSize(im *IMsg) error {
+	expectedSizes.RLock()
+	r, ok := expectedSizes.m[im.Type]
+	expectedSizes.RUnlock()
+
+	if !ok || (len(im.Data) >= r.min && len(im.Data) <= r.max) {
+		return nil
+	}
+
+	return &ErrSizeMismatch{im.Type, r.min, r.max, len(im.Data)}
+}
+
+// WithSizeCheck causes Recv to refuse imsgs whose data doesn't have the length
+// registered for their type with RegisterExpectedSize or RegisterSizeRange,
+// returning ErrSizeMismatch. The imsg is consumed, with its attached descriptor
+// closed, so subsequent imsgs may still be received. Imsgs of unregistered
+// types are received as usual.
+func WithSizeCheck() ConnOption {
+	return func(c *Conn) {
+		c.sizeCheck = true
+	}
+}
+
+// SetSizeCheck controls whether the Decoder refuses imsgs whose data doesn't
+// have the length registered for their type, returning ErrSizeMismatch, as
+// WithSizeCheck does for a Conn. The imsg is consumed, so subsequent imsgs may
+// still be decoded.
+func (d *Decoder) SetSizeCheck(enabled bool) {
+	d.sizeCheck = enabled
+}
+
+// SetSizeCheck controls whether the Mux refuses imsgs whose data doesn't have
+// the length registered for their type, returning ErrSizeMismatch from Dispatch
+// before any handler is invoked, as WithSizeCheck does for a Conn.
+func (m *Mux) SetSizeCheck(enabled bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sizeCheck = enabled
+}
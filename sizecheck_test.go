@@ -0,0 +1,120 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+// These are the types for which sizes are registered by the tests.
+const (
+	testTypeSizeExact uint32 = 0x5a00 + iota
+	testTypeSizeRange
+	testTypeSizeUnregistered
+)
+
+// registerTestSizes registers expected sizes for the test types, removing them
+// when the test completes.
+func registerTestSizes(t *testing.T) {
+	RegisterExpectedSize(testTypeSizeExact, 8)
+	RegisterSizeRange(testTypeSizeRange, 4, 16)
+	t.Cleanup(func() {
+		expectedSizes.Lock()
+		delete(expectedSizes.m, testTypeSizeExact)
+		delete(expectedSizes.m, testTypeSizeRange)
+		expectedSizes.Unlock()
+	})
+}
+
+// sizeCheckTests are the imsgs checked against the registered test sizes, with
+// whether each should pass.
+var sizeCheckTests = []struct {
+	typ  uint32
+	size int
+	ok   bool
+}{
+	{testTypeSizeExact, 8, true},
+	{testTypeSizeExact, 7, false},
+	{testTypeSizeExact, 9, false},
+	{testTypeSizeRange, 4, true},
+	{testTypeSizeRange, 16, true},
+	{testTypeSizeRange, 3, false},
+	{testTypeSizeRange, 17, false},
+	{testTypeSizeUnregistered, 0, true},
+	{testTypeSizeUnregistered, 100, true},
+}
+
+func TestDecoderSizeCheck(t *testing.T) {
+	registerTestSizes(t)
+
+	var buf bytes.Buffer
+	for _, test := range sizeCheckTests {
+		im := &IMsg{Type: test.typ, Data: make([]byte, test.size)}
+		bs, err := im.MarshalBinary()
+		if err != nil {
+			t.Fatalf("unexpected MarshalBinary failure: %s", err)
+		}
+		buf.Write(bs)
+	}
+
+	d := NewDecoder(&buf)
+	d.SetSizeCheck(true)
+	for _, test := range sizeCheckTests {
+		im, err := d.Decode()
+		if test.ok {
+			if err != nil || len(im.Data) != test.size {
+				t.Fatalf("unexpected Decode result (%v, %v)", im, err)
+			}
+			continue
+		}
+
+		// A refused imsg is consumed, leaving the next to be decoded.
+		var mismatch *ErrSizeMismatch
+		if !errors.As(err, &mismatch) || mismatch.Type != test.typ || mismatch.Got != test.size {
+			t.Fatalf("expected ErrSizeMismatch for %d bytes of type %#x, got: %v", test.size, test.typ, err)
+		}
+	}
+}
+
+func TestMuxSizeCheck(t *testing.T) {
+	registerTestSizes(t)
+
+	m := NewMux()
+	var handled int
+	m.HandleDefault(func(*IMsg) error { handled++; return nil })
+
+	// Sizes aren't checked until enabled.
+	err := m.Dispatch(&IMsg{Type: testTypeSizeExact})
+	if err != nil || handled != 1 {
+		t.Fatalf("unexpected Dispatch result (%d, %v)", handled, err)
+	}
+
+	m.SetSizeCheck(true)
+	handled = 0
+	for _, test := range sizeCheckTests {
+		err := m.Dispatch(&IMsg{Type: test.typ, Data: make([]byte, test.size)})
+		var mismatch *ErrSizeMismatch
+		if test.ok && err != nil || !test.ok && !errors.As(err, &mismatch) {
+			t.Fatalf("unexpected Dispatch result for %d bytes of type %#x: %v", test.size, test.typ, err)
+		}
+	}
+	// Handlers only ran for imsgs which passed.
+	if handled != 5 {
+		t.Fatalf("unexpected count of handled imsgs: %d", handled)
+	}
+}
+
+func TestErrSizeMismatch(t *testing.T) {
+	err := &ErrSizeMismatch{Type: 1, Want: 8, WantMax: 8, Got: 4}
+	if err.Error() != "imsg: type 1 carries 4 bytes of data (want 8)" {
+		t.Fatalf("unexpected error message: %s", err)
+	}
+	err = &ErrSizeMismatch{Type: 1, Want: 4, WantMax: 16, Got: 2}
+	if err.Error() != "imsg: type 1 carries 2 bytes of data (want 4 to 16)" {
+		t.Fatalf("unexpected error message: %s", err)
+	}
+}
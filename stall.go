@@ -0,0 +1,159 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A StallFunc is called when a Conn's writes have stalled, just before the
+// Conn is closed, so that the application can record diagnostics.
+type StallFunc func(c *Conn, err *ErrWriteStalled)
+
+// This is the state of a Conn's write stall watchdog, which is set by
+// WithWriteStallTimeout.
+type writeStall struct {
+	d time.Duration
+	f StallFunc // Set by WithWriteStallFunc
+
+	mu           sync.Mutex
+	t            *time.Timer
+	stopped      bool
+	lastBytes    uint64    // Bytes written as of the last check
+	lastProgress time.Time // When the queue was last empty or bytes were written
+
+	err atomic.Pointer[error] // Set if the Conn was closed for stalling
+}
+
+// WithWriteStallTimeout causes the Conn to be closed once imsgs have been
+// queued for sending for the provided duration without a single byte being
+// written, after which sends and Recv return ErrWriteStalled. This tells a peer
+// which has stopped reading apart from one which is merely slow, since any
+// progress at all postpones the timeout. The queue is checked periodically, so
+// a stall is detected within a quarter of the duration of its expiry.
+func WithWriteStallTimeout(d time.Duration) ConnOption {
+	return func(c *Conn) {
+		c.stallState().d = d
+		c.wq.stampQueued = true
+	}
+}
+
+// WithWriteStallFunc sets a function which is called when the timeout set with
+// WithWriteStallTimeout expires, before the Conn is closed.
+func WithWriteStallFunc(f StallFunc) ConnOption {
+	return func(c *Conn) {
+		c.stallState().f = f
+	}
+}
+
+// stallState returns the write stall state of the Conn, creating it if none
+// has been set.
+func (c *Conn) stallState() *writeStall {
+	if c.stall == nil {
+		c.stall = &writeStall{}
+	}
+
+	return c.stall
+}
+
+// stallInterval returns how often the send queue is checked for progress.
+func (ws *writeStall) stallInterval() time.Duration {
+	if d := ws.d / 4; d > time.Millisecond {
+		return d
+	}
+
+	return time.Millisecond
+}
+
+// startStallTimer starts the timer which checks the send queue for progress.
+func (c *Conn) startStallTimer() {
+	ws := c.stall
+	ws.mu.Lock()
+	ws.lastProgress = time.Now()
+	ws.t = time.AfterFunc(ws.stallInterval(), c.checkStall)
+	ws.mu.Unlock()
+}
+
+// checkStall is called by the timer to check the send queue for progress. If
+// imsgs have been queued without any being written for the timeout, the Conn
+// is closed; otherwise the timer is rearmed.
+func (c *Conn) checkStall() {
+	ws := c.stall
+	ws.mu.Lock()
+	if ws.stopped {
+		ws.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	written := c.wq.sent.bytes.Load()
+	queued, age := c.wq.head(now)
+	if queued == 0 || written != ws.lastBytes {
+		ws.lastBytes = written
+		ws.lastProgress = now
+	}
+	if now.Sub(ws.lastProgress) < ws.d {
+		ws.t.Reset(ws.stallInterval())
+		ws.mu.Unlock()
+		return
+	}
+	ws.stopped = true
+	ws.mu.Unlock()
+
+	stallErr := &ErrWriteStalled{queued, age, ws.d}
+	if ws.f != nil {
+		ws.f(c, stallErr)
+	}
+	var err error = stallErr
+	ws.err.Store(&err)
+	c.fail(err)
+	if c.debugEnabled() {
+		c.logDebug("imsg writes stalled", slog.Any(logKeyErr, stallErr))
+	}
+	c.Close()
+}
+
+// stopStallTimer stops the write stall timer, if any.
+func (c *Conn) stopStallTimer() {
+	if c.stall == nil {
+		return
+	}
+
+	c.stall.mu.Lock()
+	c.stall.stopped = true
+	if c.stall.t != nil {
+		c.stall.t.Stop()
+	}
+	c.stall.mu.Unlock()
+}
+
+// stallErr returns ErrWriteStalled if the Conn was closed because its writes
+// stalled, and nil otherwise.
+func (c *Conn) stallErr() error {
+	if c.stall == nil {
+		return nil
+	}
+	errp := c.stall.err.Load()
+	if errp == nil {
+		return nil
+	}
+
+	return *errp
+}
+
+// head returns the number of queued imsgs, along with how long ago the imsg at
+// the head of the queue was queued if queueing times are being recorded.
+func (m *MsgBuf) head(now time.Time) (int, time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(m.q) == 0 || m.q[0].queued.IsZero() {
+		return len(m.q), 0
+	}
+
+	return len(m.q), now.Sub(m.q[0].queued)
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"errors"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// This is a stream which accepts writes of at most budget bytes in total,
+// optionally pausing before each write, and then blocks until closed. Reads
+// block until the stream is closed.
+type stallingStream struct {
+	mu      sync.Mutex
+	budget  int
+	pause   time.Duration
+	perCall int
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+func newStallingStream(budget, perCall int, pause time.Duration) *stallingStream {
+	return &stallingStream{
+		budget:  budget,
+		perCall: perCall,
+		pause:   pause,
+		closed:  make(chan struct{}),
+	}
+}
+
+func (s *stallingStream) Read(p []byte) (int, error) {
+	<-s.closed
+	return 0, os.ErrClosed
+}
+
+func (s *stallingStream) Write(p []byte) (int, error) {
+	time.Sleep(s.pause)
+
+	s.mu.Lock()
+	n := min(len(p), s.budget, s.perCall)
+	s.budget -= n
+	s.mu.Unlock()
+	if n > 0 {
+		return n, nil
+	}
+
+	<-s.closed
+	return 0, os.ErrClosed
+}
+
+func (s *stallingStream) Close() error {
+	s.closeOnce.Do(func() { close(s.closed) })
+	return nil
+}
+
+func TestWriteStallTimeout(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+
+	var stalled *ErrWriteStalled
+	s := newStallingStream(5, 1024, 0)
+	c := NewStreamConn(s,
+		WithWriteStallTimeout(timeout),
+		WithWriteStallFunc(func(c *Conn, err *ErrWriteStalled) {
+			stalled = err
+		}),
+	)
+
+	// The head of the queue is partially written before the writer blocks.
+	err := c.Send(&IMsg{Type: 1, Data: []byte("test")})
+	var stallErr *ErrWriteStalled
+	if !errors.As(err, &stallErr) {
+		t.Fatalf("expected ErrWriteStalled, got: %v", err)
+	}
+	if stalled == nil || stalled.QueueLen != 1 || stalled.HeadAge < timeout || stalled.Timeout != timeout {
+		t.Fatalf("unexpected stall reported (%v)", stalled)
+	}
+
+	_, err = c.Recv()
+	if !errors.As(err, &stallErr) {
+		t.Fatalf("expected ErrWriteStalled, got: %v", err)
+	}
+}
+
+func TestWriteStallProgress(t *testing.T) {
+	const timeout = 50 * time.Millisecond
+
+	// A byte every 10ms is slow, but it's progress.
+	s := newStallingStream(1024, 1, 10*time.Millisecond)
+	c := NewStreamConn(s, WithWriteStallTimeout(timeout))
+	defer c.Close()
+
+	err := c.Send(&IMsg{Type: 1})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	if err := c.stallErr(); err != nil {
+		t.Fatalf("unexpected stall: %s", err)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A ConnState is a stage in the life of a Conn, as reported by State.
+type ConnState int32
+
+const (
+	// StateActive is the state of a Conn which is sending and receiving imsgs.
+	StateActive ConnState = iota
+	// StateDraining is the state of a Conn which is no longer sending imsgs,
+	// either because CloseWrite was called or because Close is writing out
+	// the imsgs which remain queued, but which may still receive them.
+	StateDraining
+	// StateClosed is the state of a Conn once Close has been called, or once
+	// the Conn has closed itself, such as under WithCloseOnDisallowedType.
+	StateClosed
+	// StateFailed is the state of a Conn which has encountered an error which
+	// leaves its stream unusable, as reported by Err.
+	StateFailed
+)
+
+// String returns the name of the state.
+func (s ConnState) String() string {
+	switch s {
+	case StateActive:
+		return "active"
+	case StateDraining:
+		return "draining"
+	case StateClosed:
+		return "closed"
+	case StateFailed:
+		return "failed"
+	}
+
+	return fmt.Sprintf("ConnState(%d)", int32(s))
+}
+
+// A StateFunc is called when a Conn changes state. It's called once for each
+// transition, from the goroutine which caused it, so it must not block, and it
+// may be called while the Conn is reading, so it must neither read from nor
+// close the Conn itself.
+type StateFunc func(c *Conn, from, to ConnState)
+
+// WithStateFunc sets a function which is called whenever the Conn changes
+// state, such as to count failures or to log them.
+func WithStateFunc(f StateFunc) ConnOption {
+	return func(c *Conn) {
+		c.stateFunc = f
+	}
+}
+
+// State returns the current state of the Conn. A Conn starts out active, and
+// once closed or failed, its state no longer changes.
+func (c *Conn) State() ConnState {
+	return ConnState(c.state.Load())
+}
+
+// Err returns the error which caused the Conn to fail, or nil if it hasn't.
+// Once a Conn has failed, because its stream was left unusable by an error
+// such as ErrLengthOutOfBounds, a truncated imsg or a failed write, every
+// subsequent Send and Recv returns that same error wrapped in ErrConnFailed.
+// The Conn must still be closed.
+func (c *Conn) Err() error {
+	if p := c.ferr.Load(); p != nil {
+		return *p
+	}
+
+	return nil
+}
+
+// failure returns the error to be returned by Send and Recv once the Conn has
+// failed, or nil if it hasn't.
+func (c *Conn) failure() error {
+	if err := c.Err(); err != nil {
+		return &ErrConnFailed{Err: err}
+	}
+
+	return nil
+}
+
+// fail records err as the error which caused the Conn to fail, unless the Conn
+// has already failed or is closing, and returns the error to be returned in
+// its place: err itself if the Conn has now failed, or ErrConnFailed if it
+// already had.
+func (c *Conn) fail(err error) error {
+	if c.closed.Load() {
+		return err
+	}
+	if !c.setState(StateFailed, err) {
+		if ferr := c.failure(); ferr != nil {
+			return ferr
+		}
+	}
+
+	return err
+}
+
+// failOnRead fails the Conn if err, returned while reading from the underlying
+// socket, leaves the stream unusable, returning the error to be returned in
+// its place. A timeout does so only partway through an imsg, and only when the
+// read wasn't interrupted by a done context. The caller must hold rmu.
+func (c *Conn) failOnRead(err error) error {
+	var er *ErrRead
+	if !errors.As(err, &er) {
+		return err
+	}
+	if isTimeout(er.Err) && (len(c.rbuf) == 0 || c.interrupts.Load() > 0) {
+		return err
+	}
+
+	return c.fail(err)
+}
+
+// failOnWrite fails the Conn if err, returned while writing to the underlying
+// socket, leaves the stream unusable, returning the error to be returned in
+// its place. A write which fails after CloseWrite is expected, and doesn't.
+func (c *Conn) failOnWrite(err error) error {
+	var ew *ErrWrite
+	if !errors.As(err, &ew) || isTimeout(ew.Err) || c.State() != StateActive {
+		return err
+	}
+
+	return c.fail(err)
+}
+
+// setState moves the Conn into the provided state, recording err as the cause
+// of a failure, and calls the StateFunc, if any. It returns false without
+// doing so if the Conn is already in that state or has closed or failed.
+func (c *Conn) setState(to ConnState, err error) bool {
+	c.smu.Lock()
+	from := c.State()
+	if from == to || from == StateClosed || from == StateFailed {
+		c.smu.Unlock()
+		return false
+	}
+	if to == StateFailed {
+		c.ferr.Store(&err)
+	}
+	c.state.Store(int32(to))
+	c.smu.Unlock()
+
+	if c.stateFunc != nil {
+		c.stateFunc(c, from, to)
+	}
+
+	return true
+}
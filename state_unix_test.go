@@ -0,0 +1,225 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// This records the transitions reported to a StateFunc.
+type stateRecorder struct {
+	mu          sync.Mutex
+	transitions []string
+}
+
+func (r *stateRecorder) record(c *Conn, from, to ConnState) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.transitions = append(r.transitions, fmt.Sprintf("%s->%s", from, to))
+}
+
+func (r *stateRecorder) String() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return fmt.Sprint(r.transitions)
+}
+
+func TestConnStateFailed(t *testing.T) {
+	var r stateRecorder
+	a, b := newTestSocketPair(t)
+	a = rewrapTestConn(t, a, WithStateFunc(r.record))
+
+	if s := a.State(); s != StateActive {
+		t.Fatalf("unexpected initial state: %s", s)
+	}
+
+	// An invalid frame leaves the stream unusable.
+	b.conn.Write(make([]byte, HeaderSizeInBytes))
+	_, err := a.Recv()
+	var bounds *ErrLengthOutOfBounds
+	if !errors.As(err, &bounds) {
+		t.Fatalf("expected ErrLengthOutOfBounds, got: %v", err)
+	}
+	if a.State() != StateFailed || a.Err() != err {
+		t.Fatalf("unexpected state after failure (%s, %v)", a.State(), a.Err())
+	}
+
+	// Every subsequent call returns the same error.
+	_, err = a.Recv()
+	var failed *ErrConnFailed
+	if !errors.As(err, &failed) || failed.Err != a.Err() {
+		t.Fatalf("expected ErrConnFailed, got: %v", err)
+	}
+	err = a.Send(&IMsg{Type: 1})
+	if !errors.As(err, &failed) || failed.Err != a.Err() {
+		t.Fatalf("expected ErrConnFailed, got: %v", err)
+	}
+
+	// Closing doesn't change the state.
+	a.Close()
+	if a.State() != StateFailed {
+		t.Fatalf("unexpected state after Close: %s", a.State())
+	}
+	if s := r.String(); s != "[active->failed]" {
+		t.Fatalf("unexpected transitions: %s", s)
+	}
+}
+
+func TestConnStateNotFailed(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	// Neither an interrupted read nor a clean close are failures.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := a.RecvMatching(ctx, func(*IMsg) bool { return true })
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got: %v", err)
+	}
+	b.Close()
+	for i := 0; i < 2; i++ {
+		_, err = a.Recv()
+		if err != io.EOF {
+			t.Fatalf("expected io.EOF, got: %v", err)
+		}
+	}
+	if a.State() != StateActive || a.Err() != nil {
+		t.Fatalf("unexpected state (%s, %v)", a.State(), a.Err())
+	}
+}
+
+func TestConnStateDoubleFailure(t *testing.T) {
+	var r stateRecorder
+	a, _ := newTestSocketPair(t)
+	a = rewrapTestConn(t, a, WithStateFunc(r.record))
+
+	// Of several simultaneous failures, only the first is recorded.
+	const n = 8
+	errs := make([]error, n)
+	results := make([]error, n)
+	var wg sync.WaitGroup
+	for i := range errs {
+		errs[i] = fmt.Errorf("failure %d", i)
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = a.fail(errs[i])
+		}(i)
+	}
+	wg.Wait()
+
+	var first int
+	for i, err := range results {
+		if err == errs[i] {
+			first++
+			if a.Err() != err {
+				t.Fatalf("unexpected Err result (%v != %v)", a.Err(), err)
+			}
+			continue
+		}
+		var failed *ErrConnFailed
+		if !errors.As(err, &failed) || failed.Err != a.Err() {
+			t.Fatalf("expected ErrConnFailed, got: %v", err)
+		}
+	}
+	if first != 1 {
+		t.Fatalf("unexpected count of recorded failures: %d", first)
+	}
+	if s := r.String(); s != "[active->failed]" {
+		t.Fatalf("unexpected transitions: %s", s)
+	}
+}
+
+func TestConnStateCloseWhileDraining(t *testing.T) {
+	var r stateRecorder
+	a, b := newTestSocketPair(t)
+	a = rewrapTestConn(t, a, WithLinger(100*time.Millisecond), WithStateFunc(r.record))
+	a.SetMaxSize(65535)
+
+	// Send until the socket buffer fills, leaving an imsg queued.
+	data := bytes.Repeat([]byte{0xaa}, 65535-HeaderSizeInBytes)
+	for i := 0; ; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		err := a.SendContext(ctx, &IMsg{Type: 1, Data: data})
+		cancel()
+		if err == context.DeadlineExceeded {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected SendContext failure: %s", err)
+		}
+		if i == 100 {
+			t.Fatalf("socket buffer never filled")
+		}
+	}
+
+	// The Conn drains the queue while it lingers, and is closed and read
+	// from meanwhile.
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			a.Close()
+		}()
+		go func() {
+			defer wg.Done()
+			a.Recv()
+			a.State()
+		}()
+	}
+	wg.Wait()
+	b.Close()
+
+	if a.State() != StateClosed || a.Err() != nil {
+		t.Fatalf("unexpected state after Close (%s, %v)", a.State(), a.Err())
+	}
+	if s := r.String(); s != "[active->draining draining->closed]" {
+		t.Fatalf("unexpected transitions: %s", s)
+	}
+}
+
+func TestConnStateCloseWrite(t *testing.T) {
+	var r stateRecorder
+	a, b := newTestSocketPair(t)
+	a = rewrapTestConn(t, a, WithStateFunc(r.record))
+
+	err := a.CloseWrite()
+	if err != nil {
+		t.Fatalf("unexpected CloseWrite failure: %s", err)
+	}
+	if a.State() != StateDraining {
+		t.Fatalf("unexpected state after CloseWrite: %s", a.State())
+	}
+
+	// Sending once closed for writing fails without failing the Conn.
+	err = a.Send(&IMsg{Type: 1})
+	if err == nil {
+		t.Fatalf("Send succeeded after CloseWrite")
+	}
+	err = b.Send(&IMsg{Type: 2})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	im, err := a.Recv()
+	if err != nil || im.Type != 2 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+
+	a.Close()
+	if s := r.String(); s != "[active->draining draining->closed]" {
+		t.Fatalf("unexpected transitions: %s", s)
+	}
+}
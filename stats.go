@@ -0,0 +1,109 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"sync/atomic"
+)
+
+// Stats is a snapshot of the activity of a Conn or Buffer. Imsgs and bytes are
+// counted as they're actually written to or read from the underlying
+// connection, rather than when they're queued or returned to the caller.
+type Stats struct {
+	MessagesSent       uint64 // Imsgs completely written
+	MessagesReceived   uint64 // Imsgs decoded, including filtered ones
+	MessagesFiltered   uint64 // Imsgs dropped or rejected by a receive filter
+	BytesSent          uint64 // Bytes written
+	BytesReceived      uint64 // Bytes read
+	SendQueueLen       int    // Imsgs currently waiting to be written
+	SendQueueHigh      int    // Imsgs of PriorityHigh waiting to be written
+	SendQueueNormal    int    // Imsgs of PriorityNormal waiting to be written
+	SendQueueLow       int    // Imsgs of PriorityLow waiting to be written
+	SendQueueHighWater int    // Most imsgs ever waiting to be written at once
+	SendQueueDropped   uint64 // Imsgs discarded under QueueDropOldest
+	SendQueueExpired   uint64 // Imsgs discarded unwritten once their TTL passed
+	FDsSent            uint64 // Descriptors passed to the peer
+	FDsReceived        uint64 // Descriptors received from the peer
+	DecodeErrors       uint64 // Failures to decode received data
+	QuotaMessages      uint64 // Imsgs counted in the current receive quota window
+	QuotaBytes         uint64 // Bytes counted in the current receive quota window
+	QuotaFDs           uint64 // Descriptors counted in the current quota window
+	QuotaExceeded      uint64 // Times a receive quota was exceeded
+	RecvQueueLen       int    // Imsgs read on behalf of Recv and awaiting it
+	RecvQueueBytes     int    // Bytes of the imsgs awaiting Recv, headers included
+	RecvQueueHighWater int    // Most imsgs ever awaiting Recv at once
+}
+
+// recvCounters tracks the receive side of a Stats.
+type recvCounters struct {
+	messages     atomic.Uint64
+	filtered     atomic.Uint64
+	bytes        atomic.Uint64
+	fds          atomic.Uint64
+	decodeErrors atomic.Uint64
+
+	queued      atomic.Int64 // Length of the backlog
+	queuedBytes atomic.Int64 // Size of the imsgs in the backlog
+	queueHigh   atomic.Int64 // Greatest length of the backlog
+}
+
+// sendCounters tracks the send side of a Stats.
+type sendCounters struct {
+	messages atomic.Uint64
+	bytes    atomic.Uint64
+	fds      atomic.Uint64
+}
+
+// fill copies the receive counters into s.
+func (rc *recvCounters) fill(s *Stats) {
+	s.MessagesReceived = rc.messages.Load()
+	s.MessagesFiltered = rc.filtered.Load()
+	s.BytesReceived = rc.bytes.Load()
+	s.FDsReceived = rc.fds.Load()
+	s.DecodeErrors = rc.decodeErrors.Load()
+	s.RecvQueueLen = int(rc.queued.Load())
+	s.RecvQueueBytes = int(rc.queuedBytes.Load())
+	s.RecvQueueHighWater = int(rc.queueHigh.Load())
+}
+
+// fillStats copies the send counters and queue state of the MsgBuf into s.
+func (m *MsgBuf) fillStats(s *Stats) {
+	s.MessagesSent = m.sent.messages.Load()
+	s.BytesSent = m.sent.bytes.Load()
+	s.FDsSent = m.sent.fds.Load()
+	s.SendQueueDropped = m.dropped.Load()
+	s.SendQueueExpired = m.expired.Load()
+
+	m.mu.Lock()
+	s.SendQueueLen = len(m.q)
+	s.SendQueueHigh = m.laneLen(PriorityHigh)
+	s.SendQueueNormal = m.laneLen(PriorityNormal)
+	s.SendQueueLow = m.laneLen(PriorityLow)
+	s.SendQueueHighWater = m.highWater
+	m.mu.Unlock()
+}
+
+// Stats returns a snapshot of the activity of the Conn.
+func (c *Conn) Stats() Stats {
+	var s Stats
+	c.recvd.fill(&s)
+	c.wq.fillStats(&s)
+	if c.quota != nil {
+		c.quota.fill(&s)
+	}
+
+	return s
+}
+
+// Stats returns a snapshot of the activity of the Buffer. Bytes passed to Feed
+// are counted as received. Since a Buffer doesn't pass descriptors, FDsSent and
+// FDsReceived are always zero.
+func (b *Buffer) Stats() Stats {
+	var s Stats
+	b.recvd.fill(&s)
+	b.wq.fillStats(&s)
+
+	return s
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"os"
+	"testing"
+)
+
+func TestConnStats(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	a.AllowFDPass(true)
+	b.AllowFDPass(true)
+	b.SetRecvFilter(func(im *IMsg) FilterAction {
+		if im.Type == testTypeKeepalive {
+			return Drop
+		}
+		return Accept
+	})
+
+	f, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatalf("failed to open %s: %s", os.DevNull, err)
+	}
+	withFile, _ := ComposeIMsgWithFile(1, 0, []byte("test"), f)
+	for _, im := range []*IMsg{withFile, {Type: testTypeKeepalive}, {Type: 2}} {
+		err = a.Send(im)
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+
+	for _, typ := range []uint32{1, 2} {
+		im, err := b.Recv()
+		if err != nil || im.Type != typ {
+			t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+		}
+		im.closeFile()
+	}
+
+	s := a.Stats()
+	expected := Stats{
+		MessagesSent:       3,
+		BytesSent:          52,
+		SendQueueHighWater: 1,
+		FDsSent:            1,
+	}
+	if s != expected {
+		t.Fatalf("unexpected sender stats (%+v != %+v)", s, expected)
+	}
+
+	s = b.Stats()
+	expected = Stats{
+		MessagesReceived: 3,
+		MessagesFiltered: 1,
+		BytesReceived:    52,
+		FDsReceived:      1,
+	}
+	if s != expected {
+		t.Fatalf("unexpected receiver stats (%+v != %+v)", s, expected)
+	}
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+	"io"
+)
+
+// A dataWriter streams data to the peer of a Conn as a series of imsgs.
+type dataWriter struct {
+	c      *Conn
+	typ    uint32
+	peerID uint32
+	closed bool
+}
+
+// NewDataWriter constructs an io.WriteCloser which sends the data written to
+// it over the Conn as imsgs of the provided type, each carrying as much of the
+// data as fits. Closing the writer sends an imsg of the same type with no data,
+// which marks the end of the stream, so the data of the stream's imsgs is never
+// empty. The peer may read the stream with NewDataReader.
+func NewDataWriter(c *Conn, typ, peerID uint32) io.WriteCloser {
+	return &dataWriter{c: c, typ: typ, peerID: peerID}
+}
+
+// Write implements the io.Writer interface.
+func (w *dataWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, io.ErrClosedPipe
+	}
+
+	max := int(w.c.maxSize.Load()) - HeaderSizeInBytes
+	var n int
+	for n < len(p) {
+		end := n + max
+		if end > len(p) {
+			end = len(p)
+		}
+
+		err := w.c.Composev(w.typ, w.peerID, p[n:end])
+		if err != nil {
+			return n, err
+		}
+		n = end
+	}
+
+	return n, nil
+}
+
+// Close sends the imsg marking the end of the stream. Closing the writer more
+// than once has no further effect.
+func (w *dataWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	return w.c.Composev(w.typ, w.peerID)
+}
+
+// A dataReader reads a stream of data sent by the peer of a Conn with a
+// dataWriter.
+type dataReader struct {
+	c   *Conn
+	typ uint32
+	buf []byte // Data received but not yet read
+	eof bool
+}
+
+// NewDataReader constructs an io.Reader which reads the stream sent by the
+// peer with NewDataWriter as imsgs of the provided type, returning io.EOF once
+// the end of the stream is received. Imsgs of other types which arrive while
+// the stream is being read remain available to Recv. Since the stream's imsgs
+// are otherwise indistinguishable, imsgs of the stream's type shouldn't be
+// received by other means, such as by Recv in another goroutine, while it's
+// read.
+func NewDataReader(c *Conn, typ uint32) io.Reader {
+	return &dataReader{c: c, typ: typ}
+}
+
+// Read implements the io.Reader interface.
+func (r *dataReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+
+		im, err := r.c.recvType(r.typ)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		r.buf = im.Data
+		r.eof = len(im.Data) == 0
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+
+	return n, nil
+}
+
+// recvType receives the next imsg of the provided type, leaving any others it
+// reads for Recv.
+func (c *Conn) recvType(typ uint32) (*IMsg, error) {
+	return c.awaitMatch(context.Background(), func(im *IMsg) bool {
+		return im.Type == typ
+	}, 0)
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+func TestDataStream(t *testing.T) {
+	const (
+		streamType = 7
+		otherType  = 8
+	)
+	a, b := newTestSocketPair(t)
+
+	data := make([]byte, 4<<20+123)
+	rand.New(rand.NewSource(1)).Read(data)
+
+	// Writes of assorted sizes are interleaved with imsgs of another type.
+	var others int
+	errs := make(chan error, 1)
+	go func() {
+		rng := rand.New(rand.NewSource(2))
+		w := NewDataWriter(a, streamType, 0)
+		rest := data
+		for i := 0; len(rest) > 0; i++ {
+			n := rng.Intn(3 * MaxSizeInBytes)
+			if n > len(rest) {
+				n = len(rest)
+			}
+			_, err := w.Write(rest[:n])
+			if err != nil {
+				errs <- err
+				return
+			}
+			rest = rest[n:]
+
+			if i%10 == 0 {
+				err = a.Composev(otherType, uint32(i/10))
+				if err != nil {
+					errs <- err
+					return
+				}
+				others++
+			}
+		}
+		errs <- w.Close()
+	}()
+
+	h := sha256.New()
+	n, err := io.Copy(h, NewDataReader(b, streamType))
+	if err != nil {
+		t.Fatalf("unexpected failure reading stream: %s", err)
+	}
+	if err = <-errs; err != nil {
+		t.Fatalf("unexpected failure writing stream: %s", err)
+	}
+	if n != int64(len(data)) {
+		t.Fatalf("unexpected stream length (%d != %d)", n, len(data))
+	}
+	if expected := sha256.Sum256(data); !bytes.Equal(h.Sum(nil), expected[:]) {
+		t.Fatalf("stream hash does not match")
+	}
+
+	// The interleaved imsgs are left for Recv, in order.
+	for i := 0; i < others; i++ {
+		im, err := b.Recv()
+		if err != nil {
+			t.Fatalf("unexpected Recv failure: %s", err)
+		}
+		if im.Type != otherType || im.PeerID != uint32(i) {
+			t.Fatalf("unexpected imsg received (%v)", im)
+		}
+	}
+}
+
+func TestDataStreamClosed(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	w := NewDataWriter(a, 1, 0)
+	w.Write([]byte("test"))
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected Close failure: %s", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("unexpected failure closing twice: %s", err)
+	}
+	if _, err := w.Write([]byte("test")); err != io.ErrClosedPipe {
+		t.Fatalf("expected io.ErrClosedPipe, got: %v", err)
+	}
+
+	r := NewDataReader(b, 1)
+	bs, err := io.ReadAll(r)
+	if err != nil || string(bs) != "test" {
+		t.Fatalf("unexpected stream contents (%q, %v)", bs, err)
+	}
+	if _, err = r.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected io.EOF after end of stream, got: %v", err)
+	}
+
+	// A stream cut off before its end is reported.
+	w = NewDataWriter(a, 2, 0)
+	w.Write([]byte("test"))
+	a.Close()
+	_, err = io.ReadAll(NewDataReader(b, 2))
+	if err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got: %v", err)
+	}
+}
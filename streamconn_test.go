@@ -0,0 +1,203 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestStreamPair constructs a pair of Conns connected by a net.Pipe, which
+// are closed when the test completes.
+func newTestStreamPair(t *testing.T, opts ...ConnOption) (*Conn, *Conn) {
+	t.Helper()
+
+	pa, pb := net.Pipe()
+	a, b := NewStreamConn(pa, opts...), NewStreamConn(pb, opts...)
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	return a, b
+}
+
+func TestStreamConnSendRecv(t *testing.T) {
+	a, b := newTestStreamPair(t, WithCompression(64), WithDecompressionLimit(MaxSizeInBytes))
+
+	// A net.Pipe is unbuffered, so each send completes only as it's received.
+	sent := []*IMsg{
+		{Type: 1, PeerID: 2, PID: 3, Data: []byte("test")},
+		{Type: 2},
+		{Type: 3, Data: bytes.Repeat([]byte{0xaa}, 1024)},
+	}
+	errc := make(chan error, 1)
+	go func() {
+		err := a.SendBatch(sent[:2]...)
+		if err == nil {
+			err = a.Send(sent[2])
+		}
+		errc <- err
+	}()
+
+	for _, expected := range sent {
+		im, err := b.Recv()
+		if err != nil {
+			t.Fatalf("unexpected Recv failure: %s", err)
+		}
+		if !im.Equal(expected) {
+			t.Fatalf("received imsg does not match (%v != %v)", im, expected)
+		}
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("unexpected send failure: %s", err)
+	}
+	if s := b.Stats(); s.MessagesReceived != 3 {
+		t.Fatalf("unexpected number of imsgs received (%d)", s.MessagesReceived)
+	}
+
+	// Closing one end delivers io.EOF to the other.
+	a.Close()
+	_, err := b.Recv()
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF, got: %v", err)
+	}
+}
+
+func TestStreamConnServeCall(t *testing.T) {
+	a, b := newTestStreamPair(t)
+
+	m := NewMux()
+	const query, reply = 1, 2
+	m.Handle(query, func(im *IMsg) error {
+		return b.Send(&IMsg{Type: reply, PeerID: im.PeerID, Data: im.Data})
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, b, m)
+	}()
+
+	for i := byte(0); i < 3; i++ {
+		im, err := a.Call(context.Background(), &IMsg{Type: query, Data: []byte{i}}, reply)
+		if err != nil {
+			t.Fatalf("unexpected Call failure: %s", err)
+		}
+		if len(im.Data) != 1 || im.Data[0] != i {
+			t.Fatalf("reply does not match request %d (%v)", i, im.Data)
+		}
+	}
+
+	// Cancelling the context interrupts the blocked read.
+	cancel()
+	select {
+	case err := <-served:
+		if err != context.Canceled {
+			t.Fatalf("expected context.Canceled, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Serve did not return once its context was cancelled")
+	}
+}
+
+func TestStreamConnDeadlines(t *testing.T) {
+	a, _ := newTestStreamPair(t, WithLinger(0))
+
+	_, err := a.RecvTimeout(10 * time.Millisecond)
+	if !os.IsTimeout(err) {
+		t.Fatalf("expected a timeout, got: %v", err)
+	}
+
+	err = a.SendTimeout(&IMsg{Type: 1}, 10*time.Millisecond)
+	if !os.IsTimeout(err) {
+		t.Fatalf("expected a timeout, got: %v", err)
+	}
+}
+
+func TestStreamConnUnsupported(t *testing.T) {
+	a, _ := newTestStreamPair(t)
+	a.AllowFDPass(true)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %s", err)
+	}
+	defer r.Close()
+	defer w.Close()
+	im, _ := ComposeIMsgWithFile(1, 0, nil, w)
+	err = a.Send(im)
+	var efpu *ErrFDPassUnsupported
+	if !errors.As(err, &efpu) || efpu.Type != 1 {
+		t.Fatalf("expected ErrFDPassUnsupported, got: %v", err)
+	}
+	err = a.Forward(im)
+	if !errors.As(err, &efpu) {
+		t.Fatalf("expected ErrFDPassUnsupported from Forward, got: %v", err)
+	}
+
+	var eu *ErrUnsupported
+	_, err = a.PeerCred()
+	if !errors.As(err, &eu) {
+		t.Fatalf("expected ErrUnsupported from PeerCred, got: %v", err)
+	}
+	if fds := a.TakePendingFDs(); len(fds) != 0 {
+		t.Fatalf("unexpected pending descriptors (%d)", len(fds))
+	}
+}
+
+// A plainStream is a byte stream with no deadline support.
+type plainStream struct {
+	io.Reader
+	io.Writer
+	closers []io.Closer
+}
+
+func (s *plainStream) Close() error {
+	for _, c := range s.closers {
+		c.Close()
+	}
+
+	return nil
+}
+
+func TestStreamConnWithoutDeadlines(t *testing.T) {
+	ar, bw := io.Pipe()
+	br, aw := io.Pipe()
+	a := NewStreamConn(&plainStream{ar, aw, []io.Closer{ar, aw}})
+	b := NewStreamConn(&plainStream{br, bw, []io.Closer{br, bw}})
+	defer a.Close()
+	defer b.Close()
+
+	go a.Send(&IMsg{Type: 1, Data: []byte("test")})
+	im, err := b.Recv()
+	if err != nil || im.Type != 1 || string(im.Data) != "test" {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+
+	var eu *ErrUnsupported
+	if err := a.SetReadDeadline(time.Now()); !errors.As(err, &eu) {
+		t.Fatalf("expected ErrUnsupported from SetReadDeadline, got: %v", err)
+	}
+	if err := a.SetWriteDeadline(time.Now()); !errors.As(err, &eu) {
+		t.Fatalf("expected ErrUnsupported from SetWriteDeadline, got: %v", err)
+	}
+	if _, err := a.RecvTimeout(time.Millisecond); !errors.As(err, &eu) {
+		t.Fatalf("expected ErrUnsupported from RecvTimeout, got: %v", err)
+	}
+
+	// Without deadlines, a done context is still honored between reads.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = Serve(ctx, a, NewMux())
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+// MakeType packs a subsystem and an operation within it into an imsg type, for
+// daemons which partition the type space by convention. The subsystem occupies
+// the high 16 bits of the type and the operation the low 16 bits, so that
+// MakeType(1, 2) is 0x00010002. Since peers must agree on this layout, it won't
+// change.
+func MakeType(subsystem, op uint16) uint32 {
+	return uint32(subsystem)<<16 | uint32(op)
+}
+
+// SplitType unpacks an imsg type built by MakeType into its subsystem, from the
+// high 16 bits, and operation, from the low 16 bits.
+func SplitType(typ uint32) (subsystem, op uint16) {
+	return uint16(typ >> 16), uint16(typ)
+}
@@ -0,0 +1,33 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"testing"
+)
+
+func TestMakeType(t *testing.T) {
+	tests := []struct {
+		subsystem, op uint16
+		typ           uint32
+	}{
+		{0, 0, 0},
+		{1, 2, 0x00010002},
+		{0xffff, 0, 0xffff0000},
+		{0, 0xffff, 0x0000ffff},
+		{0xabcd, 0x1234, 0xabcd1234},
+	}
+
+	for _, test := range tests {
+		typ := MakeType(test.subsystem, test.op)
+		if typ != test.typ {
+			t.Fatalf("unexpected MakeType result (%#08x != %#08x)", typ, test.typ)
+		}
+		subsystem, op := SplitType(typ)
+		if subsystem != test.subsystem || op != test.op {
+			t.Fatalf("unexpected SplitType result (%d, %d)", subsystem, op)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// defaultBackoff is the delay before the first restart when Backoff.Initial
+// isn't set, so that a child which fails immediately isn't restarted in a
+// tight loop.
+const defaultBackoff = 100 * time.Millisecond
+
+// Backoff is the policy by which a Supervisor restarts a child. The delay
+// before the first restart is Initial, or 100ms if it isn't set, and it doubles
+// with each subsequent restart up to Max. A child which stays up for
+// ResetAfter, if set, resets both the delay and the count of restarts.
+type Backoff struct {
+	Initial     time.Duration // Delay before the first restart
+	Max         time.Duration // Maximum delay between restarts
+	MaxRestarts int           // Restarts before giving up, or zero for no limit
+	ResetAfter  time.Duration // Uptime after which the policy starts over
+}
+
+// initial returns the delay before the first restart.
+func (b Backoff) initial() time.Duration {
+	if b.Initial <= 0 {
+		return defaultBackoff
+	}
+
+	return b.Initial
+}
+
+// next returns the delay which follows d.
+func (b Backoff) next(d time.Duration) time.Duration {
+	if d*2 > b.Max {
+		return max(b.Max, b.initial())
+	}
+
+	return d * 2
+}
+
+// A ChildSpec describes a child to be run by a Supervisor.
+type ChildSpec struct {
+	// Name identifies the child in its events.
+	Name string
+
+	// Command returns the command with which to start the child, which it's
+	// called for each time the child is started, since an exec.Cmd can't be
+	// reused. The command is started with ExecChild. It must be set.
+	Command func() *exec.Cmd
+
+	// Options are applied to the Conn of the child each time it's started.
+	Options []ConnOption
+
+	// Backoff is the policy by which the child is restarted.
+	Backoff Backoff
+
+	// OnConnect, if set, is called with the Conn of the child each time it's
+	// started, such as to send it the state it needs. The Conn remains
+	// usable until the child exits. If OnConnect fails, the Conn is closed,
+	// and the child restarted once it exits.
+	OnConnect func(c *Conn) error
+
+	// OnEvent, if set, is called with each Event in the life of the child.
+	// It's called from the goroutine supervising the child, so it shouldn't
+	// block.
+	OnEvent func(ev Event)
+}
+
+// An EventKind is the kind of an Event.
+type EventKind int
+
+const (
+	// EventStarted is reported when a child has been started.
+	EventStarted EventKind = iota
+	// EventExited is reported when a child has exited.
+	EventExited
+	// EventGaveUp is reported when a child won't be restarted again because
+	// it was restarted Backoff.MaxRestarts times.
+	EventGaveUp
+)
+
+// String returns the name of the kind of event.
+func (k EventKind) String() string {
+	switch k {
+	case EventStarted:
+		return "started"
+	case EventExited:
+		return "exited"
+	case EventGaveUp:
+		return "gave up"
+	}
+
+	return fmt.Sprintf("EventKind(%d)", int(k))
+}
+
+// An Event is a change in the life of a supervised child.
+type Event struct {
+	Kind EventKind
+	Name string
+
+	PID   int              // Process ID of the child, with EventStarted and EventExited
+	State *os.ProcessState // Exit status of the child, with EventExited
+	Err   error            // Cause of the exit, with EventExited, or of the last failure, with EventGaveUp
+}
+
+// A Supervisor runs children, restarting each whenever it exits according to
+// its Backoff, until Stop is called.
+type Supervisor struct {
+	mu      sync.Mutex
+	stopped bool
+	wg      sync.WaitGroup
+
+	stop     chan struct{}
+	kill     chan struct{}
+	killOnce sync.Once
+}
+
+// NewSupervisor returns a Supervisor which isn't yet running any children.
+func NewSupervisor() *Supervisor {
+	return &Supervisor{
+		stop: make(chan struct{}),
+		kill: make(chan struct{}),
+	}
+}
+
+// Start starts a child as described by spec, and keeps restarting it whenever
+// it exits, successfully or not, until the Backoff gives up or Stop is called.
+// A child is also killed, and so restarted, if reading from or writing to its
+// Conn fails, other than by timing out. A child which fails to start is
+// restarted like one which exited. ErrSupervisorStopped is returned if Stop has
+// been called.
+func (s *Supervisor) Start(spec ChildSpec) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopped {
+		return &ErrSupervisorStopped{spec.Name}
+	}
+	s.wg.Add(1)
+	go s.supervise(spec)
+
+	return nil
+}
+
+// Stop stops restarting children and closes their Conns, signalling them to
+// exit, and waits for them to do so. If the context is done first, the
+// children which remain are killed, and the context's error is returned once
+// they've exited.
+func (s *Supervisor) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.stopped {
+		s.stopped = true
+		close(s.stop)
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.killOnce.Do(func() { close(s.kill) })
+		<-done
+		return ctx.Err()
+	}
+}
+
+// supervise runs the child described by spec until the Backoff gives up or the
+// Supervisor is stopped.
+func (s *Supervisor) supervise(spec ChildSpec) {
+	defer s.wg.Done()
+
+	delay := spec.Backoff.initial()
+	restarts := 0
+	for {
+		started := time.Now()
+		err := s.run(spec)
+
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+
+		if spec.Backoff.ResetAfter > 0 && time.Since(started) >= spec.Backoff.ResetAfter {
+			delay = spec.Backoff.initial()
+			restarts = 0
+		}
+		if spec.Backoff.MaxRestarts > 0 && restarts >= spec.Backoff.MaxRestarts {
+			emit(spec, Event{Kind: EventGaveUp, Name: spec.Name, Err: err})
+			return
+		}
+		restarts++
+
+		t := time.NewTimer(delay)
+		select {
+		case <-t.C:
+		case <-s.stop:
+			t.Stop()
+			return
+		}
+		delay = spec.Backoff.next(delay)
+	}
+}
+
+// run starts the child described by spec and waits for it to exit, returning
+// the cause.
+func (s *Supervisor) run(spec ChildSpec) error {
+	failed := make(chan error, 1)
+	opts := append([]ConnOption(nil), spec.Options...)
+	opts = append(opts, withFailureSignal(failed))
+
+	cmd := spec.Command()
+	c, err := ExecChild(cmd, opts...)
+	if err != nil {
+		return err
+	}
+	pid := cmd.Process.Pid
+	emit(spec, Event{Kind: EventStarted, Name: spec.Name, PID: pid})
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	connected := make(chan error, 1)
+	go func() {
+		if spec.OnConnect == nil {
+			connected <- nil
+			return
+		}
+		connected <- spec.OnConnect(c)
+	}()
+
+	// Each case is disabled once handled, leaving the exit of the child to
+	// end the loop.
+	var cause, werr error
+	wait, conn, fail := (<-chan error)(exited), (<-chan error)(connected), (<-chan error)(failed)
+	stop, kill := s.stop, s.kill
+	for wait != nil {
+		select {
+		case werr = <-wait:
+			wait = nil
+		case err := <-conn:
+			conn = nil
+			// Once stopping, the Conn is expected to fail.
+			if err != nil && stop != nil {
+				cause = err
+				c.Close()
+			}
+		case err := <-fail:
+			fail = nil
+			if cause == nil && stop != nil {
+				cause = err
+				cmd.Process.Kill()
+			}
+		case <-stop:
+			stop = nil
+			c.Close()
+		case <-kill:
+			kill = nil
+			cmd.Process.Kill()
+		}
+	}
+
+	// Closing the Conn unblocks OnConnect if it's still running.
+	c.Close()
+	if conn != nil {
+		<-conn
+	}
+
+	if cause == nil {
+		cause = werr
+	}
+	emit(spec, Event{Kind: EventExited, Name: spec.Name, PID: pid, State: cmd.ProcessState, Err: cause})
+
+	return cause
+}
+
+// emit reports ev to the OnEvent function of spec, if any.
+func emit(spec ChildSpec, ev Event) {
+	if spec.OnEvent != nil {
+		spec.OnEvent(ev)
+	}
+}
+
+// failureHook is a MetricsHook which reports the first failure of a Conn to a
+// channel, besides notifying the MetricsHook it wraps.
+type failureHook struct {
+	MetricsHook
+	failed chan<- error
+}
+
+// OnError implements the MetricsHook interface.
+func (h *failureHook) OnError(stage string, err error) {
+	h.MetricsHook.OnError(stage, err)
+
+	// A timeout leaves the Conn usable, and closing it is deliberate.
+	if isTimeout(err) || errors.Is(err, net.ErrClosed) {
+		return
+	}
+	select {
+	case h.failed <- err:
+	default:
+	}
+}
+
+// withFailureSignal causes the first failure of the Conn to be sent to the
+// channel. It must follow any option setting a MetricsHook.
+func withFailureSignal(failed chan<- error) ConnOption {
+	return func(c *Conn) {
+		c.setMetricsHook(&failureHook{c.metrics, failed})
+	}
+}
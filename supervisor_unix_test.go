@@ -0,0 +1,326 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// testChildEnv holds the behavior of the test binary when it's started as a
+// child by newTestChild: the number of imsgs it echoes before exiting
+// unsuccessfully, or zero to echo until EOF, or "garbage" to write a malformed
+// imsg and then wait for EOF.
+const testChildEnv = "IMSG_TEST_CHILD"
+
+// TestMain runs a test child in place of the tests when started by
+// newTestChild.
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(testChildEnv); mode != "" {
+		os.Exit(runTestChild(mode))
+	}
+
+	os.Exit(m.Run())
+}
+
+// runTestChild serves the Conn inherited from ExecChild as described by
+// testChildEnv, returning the exit status.
+func runTestChild(mode string) int {
+	nc, err := net.FileConn(os.NewFile(3, "imsg"))
+	if err != nil {
+		return 2
+	}
+	c := NewConn(nc)
+	defer c.Close()
+
+	if mode == "garbage" {
+		// The length is shorter than the header.
+		_, err = nc.Write(make([]byte, HeaderSizeInBytes))
+		if err != nil {
+			return 2
+		}
+		_, err = io.Copy(io.Discard, nc)
+		if err != nil {
+			return 2
+		}
+		return 0
+	}
+
+	limit, err := strconv.Atoi(mode)
+	if err != nil {
+		return 2
+	}
+	for i := 0; limit == 0 || i < limit; i++ {
+		im, err := c.Recv()
+		if err == io.EOF {
+			return 0
+		}
+		if err != nil {
+			return 2
+		}
+		err = c.Send(im)
+		if err != nil {
+			return 2
+		}
+	}
+
+	return 1
+}
+
+// newTestChild returns a command which starts the test binary as a test child
+// with the provided mode.
+func newTestChild(mode string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), testChildEnv+"="+mode)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+// awaitEvent returns the next event reported to the channel, failing the test
+// if none arrives in time or it isn't of the expected kind.
+func awaitEvent(t *testing.T, events <-chan Event, kind EventKind) Event {
+	t.Helper()
+
+	select {
+	case ev := <-events:
+		if ev.Kind != kind {
+			t.Fatalf("expected %s event, got: %+v", kind, ev)
+		}
+		return ev
+	case <-time.After(10 * time.Second):
+		t.Fatalf("timed out awaiting %s event", kind)
+	}
+
+	return Event{}
+}
+
+// stopSupervisor stops the Supervisor, failing the test if it can't.
+func stopSupervisor(t *testing.T, s *Supervisor) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	err := s.Stop(ctx)
+	if err != nil {
+		t.Fatalf("unexpected Stop failure: %s", err)
+	}
+}
+
+func TestExecChild(t *testing.T) {
+	cmd := newTestChild("0")
+	c, err := ExecChild(cmd)
+	if err != nil {
+		t.Fatalf("unexpected ExecChild failure: %s", err)
+	}
+
+	err = c.Send(&IMsg{Type: 1, Data: []byte("test")})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	im, err := c.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	if im.Type != 1 || !bytes.Equal(im.Data, []byte("test")) {
+		t.Fatalf("unexpected imsg echoed (%v)", im)
+	}
+
+	// Closing the Conn signals the child to exit.
+	c.Close()
+	err = cmd.Wait()
+	if err != nil {
+		t.Fatalf("unexpected child failure: %s", err)
+	}
+}
+
+func TestSupervisorRestart(t *testing.T) {
+	const limit = 2
+
+	events := make(chan Event, 16)
+	connects := 0
+	s := NewSupervisor()
+	err := s.Start(ChildSpec{
+		Name:    "countdown",
+		Command: func() *exec.Cmd { return newTestChild(strconv.Itoa(limit)) },
+		Backoff: Backoff{Initial: 10 * time.Millisecond, Max: 20 * time.Millisecond, MaxRestarts: 2},
+		OnConnect: func(c *Conn) error {
+			connects++
+			for i := 0; i < limit; i++ {
+				err := c.Send(&IMsg{Type: 1, Data: []byte("test")})
+				if err != nil {
+					return err
+				}
+				im, err := c.Recv()
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(im.Data, []byte("test")) {
+					t.Errorf("unexpected reply (%v)", im)
+				}
+			}
+			return nil
+		},
+		OnEvent: func(ev Event) { events <- ev },
+	})
+	if err != nil {
+		t.Fatalf("unexpected Start failure: %s", err)
+	}
+
+	// The child is started once and restarted twice, exiting unsuccessfully
+	// each time, before the Supervisor gives up.
+	for i := 0; i < 3; i++ {
+		started := awaitEvent(t, events, EventStarted)
+		exited := awaitEvent(t, events, EventExited)
+		if exited.PID != started.PID || exited.State == nil || exited.State.ExitCode() != 1 {
+			t.Fatalf("unexpected exit of child %d (%+v)", started.PID, exited)
+		}
+		var ee *exec.ExitError
+		if !errors.As(exited.Err, &ee) {
+			t.Fatalf("expected ExitError, got: %v", exited.Err)
+		}
+	}
+	gaveUp := awaitEvent(t, events, EventGaveUp)
+	if gaveUp.Name != "countdown" || gaveUp.Err == nil {
+		t.Fatalf("unexpected event (%+v)", gaveUp)
+	}
+
+	stopSupervisor(t, s)
+	if connects != 3 {
+		t.Fatalf("unexpected number of connections (%d)", connects)
+	}
+}
+
+func TestSupervisorOnConnectFailure(t *testing.T) {
+	events := make(chan Event, 16)
+	errConnect := errors.New("test failure")
+	s := NewSupervisor()
+	err := s.Start(ChildSpec{
+		Command:   func() *exec.Cmd { return newTestChild("0") },
+		Backoff:   Backoff{MaxRestarts: 1},
+		OnConnect: func(c *Conn) error { return errConnect },
+		OnEvent:   func(ev Event) { events <- ev },
+	})
+	if err != nil {
+		t.Fatalf("unexpected Start failure: %s", err)
+	}
+
+	// Closing the Conn lets the child exit cleanly, but the failure is
+	// reported as the cause.
+	for i := 0; i < 2; i++ {
+		awaitEvent(t, events, EventStarted)
+		exited := awaitEvent(t, events, EventExited)
+		if exited.State.ExitCode() != 0 || exited.Err != errConnect {
+			t.Fatalf("unexpected exit (%+v)", exited)
+		}
+	}
+	gaveUp := awaitEvent(t, events, EventGaveUp)
+	if gaveUp.Err != errConnect {
+		t.Fatalf("unexpected event (%+v)", gaveUp)
+	}
+
+	stopSupervisor(t, s)
+}
+
+func TestSupervisorConnFailure(t *testing.T) {
+	events := make(chan Event, 16)
+	s := NewSupervisor()
+	err := s.Start(ChildSpec{
+		Command: func() *exec.Cmd { return newTestChild("garbage") },
+		Backoff: Backoff{MaxRestarts: 1},
+		OnConnect: func(c *Conn) error {
+			// The Conn fails after OnConnect has returned.
+			go c.Recv()
+			return nil
+		},
+		OnEvent: func(ev Event) { events <- ev },
+	})
+	if err != nil {
+		t.Fatalf("unexpected Start failure: %s", err)
+	}
+
+	// The child, which would otherwise wait for its Conn to be closed, is
+	// killed once the Conn fails.
+	awaitEvent(t, events, EventStarted)
+	exited := awaitEvent(t, events, EventExited)
+	var bounds *ErrLengthOutOfBounds
+	if exited.State.Exited() || !errors.As(exited.Err, &bounds) {
+		t.Fatalf("unexpected exit (%+v)", exited)
+	}
+
+	stopSupervisor(t, s)
+}
+
+func TestSupervisorStop(t *testing.T) {
+	events := make(chan Event, 16)
+	ready := make(chan struct{})
+	s := NewSupervisor()
+	err := s.Start(ChildSpec{
+		Command: func() *exec.Cmd { return newTestChild("0") },
+		Backoff: Backoff{Initial: 10 * time.Millisecond},
+		OnConnect: func(c *Conn) error {
+			err := c.Send(&IMsg{Type: 1})
+			if err != nil {
+				return err
+			}
+			_, err = c.Recv()
+			close(ready)
+			return err
+		},
+		OnEvent: func(ev Event) { events <- ev },
+	})
+	if err != nil {
+		t.Fatalf("unexpected Start failure: %s", err)
+	}
+	awaitEvent(t, events, EventStarted)
+	<-ready
+
+	// Stopping closes the Conn, and the child exits cleanly without being
+	// restarted.
+	stopSupervisor(t, s)
+	exited := awaitEvent(t, events, EventExited)
+	if exited.State.ExitCode() != 0 || exited.Err != nil {
+		t.Fatalf("unexpected exit (%+v)", exited)
+	}
+	select {
+	case ev := <-events:
+		t.Fatalf("unexpected event after Stop (%+v)", ev)
+	default:
+	}
+
+	err = s.Start(ChildSpec{Name: "echo"})
+	var stopped *ErrSupervisorStopped
+	if !errors.As(err, &stopped) {
+		t.Fatalf("expected ErrSupervisorStopped, got: %v", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	b := Backoff{}
+	if d := b.initial(); d != defaultBackoff {
+		t.Fatalf("unexpected initial delay (%s)", d)
+	}
+	if d := b.next(b.initial()); d != defaultBackoff {
+		t.Fatalf("unexpected delay after the initial delay (%s)", d)
+	}
+
+	b = Backoff{Initial: time.Second, Max: 3 * time.Second}
+	d := b.initial()
+	for _, want := range []time.Duration{2 * time.Second, 3 * time.Second, 3 * time.Second} {
+		d = b.next(d)
+		if d != want {
+			t.Fatalf("unexpected delay (%s != %s)", d, want)
+		}
+	}
+}
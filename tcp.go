@@ -0,0 +1,182 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"os"
+	"time"
+)
+
+// A NetOption configures optional behavior of Listen and Dial.
+type NetOption func(*netConfig)
+
+type netConfig struct {
+	maxSize  uint16
+	timeout  time.Duration
+	connOpts []ConnOption
+}
+
+// WithNetMaxSize sets the maximum size in bytes of an imsg which may be sent or
+// received over each connection, as with SetMaxSize.
+func WithNetMaxSize(n uint16) NetOption {
+	return func(cfg *netConfig) {
+		cfg.maxSize = n
+	}
+}
+
+// WithNetDeadline sets read and write deadlines on each connection d after it's
+// established, which bounds how long a slow or silent peer can hold it, such as
+// during a handshake. The deadlines may be extended or cleared with the Conn's
+// SetReadDeadline and SetWriteDeadline.
+func WithNetDeadline(d time.Duration) NetOption {
+	return func(cfg *netConfig) {
+		cfg.timeout = d
+	}
+}
+
+// WithNetConnOptions applies the provided options to each connection's Conn.
+// WithByteOrder may be among them, overriding the big-endian default.
+func WithNetConnOptions(opts ...ConnOption) NetOption {
+	return func(cfg *netConfig) {
+		cfg.connOpts = append(cfg.connOpts, opts...)
+	}
+}
+
+// newNetConfig applies opts to a default configuration.
+func newNetConfig(opts []NetOption) (*netConfig, error) {
+	cfg := &netConfig{maxSize: MaxSizeInBytes}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	err := validateMaxSize(cfg.maxSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// checkNetwork refuses networks other than TCP.
+func checkNetwork(network string) error {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+		return nil
+	}
+
+	return &ErrUnsupported{"network " + network}
+}
+
+// newConn constructs a Conn over an established connection. Headers are
+// exchanged in big-endian byte order unless the connection is a unix domain
+// socket, whose peer shares the host.
+func (cfg *netConfig) newConn(nc net.Conn) *Conn {
+	opts := cfg.connOpts
+	if _, ok := nc.(*net.UnixConn); !ok {
+		opts = append([]ConnOption{WithByteOrder(binary.BigEndian)}, opts...)
+	}
+	c := NewConn(nc, opts...)
+
+	// The size was validated by newNetConfig.
+	c.SetMaxSize(cfg.maxSize)
+	if cfg.timeout > 0 {
+		nc.SetDeadline(time.Now().Add(cfg.timeout))
+	}
+
+	return c
+}
+
+// A Listener accepts TCP connections, over which imsgs are exchanged with
+// headers in big-endian byte order, since the peers' hosts may differ in
+// endianness. Descriptors can't be passed over these connections, so imsgs
+// with attached files are refused with ErrFDPassUnsupported. A Listener
+// constructed with ListenPath instead accepts unix domain socket connections,
+// which exchange imsgs as a SocketPair does.
+type Listener struct {
+	l    net.Listener
+	cfg  *netConfig
+	path string // Socket file removed by Close, if any
+	name string // Name assigned by the service manager, if any
+}
+
+// Listen listens for TCP connections on the provided network, which must be
+// "tcp", "tcp4", or "tcp6", and address, as with net.Listen.
+func Listen(network, addr string, opts ...NetOption) (*Listener, error) {
+	err := checkNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := newNetConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Listener{l: l, cfg: cfg}, nil
+}
+
+// Accept waits for the next connection and returns a Conn over it.
+func (l *Listener) Accept() (*Conn, error) {
+	nc, err := l.l.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return l.cfg.newConn(nc), nil
+}
+
+// Close stops listening. Conns already accepted remain open. The socket file of
+// a Listener constructed with ListenPath is removed.
+func (l *Listener) Close() error {
+	err := l.l.Close()
+	if err == nil && l.path != "" {
+		// The file is only removed by the first Close, lest it belong to
+		// another Listener by the time of a later one.
+		os.Remove(l.path)
+	}
+
+	return err
+}
+
+// Name returns the name assigned to the Listener's socket by the service
+// manager, for a Listener returned by ListenersFromActivation, or an empty
+// string otherwise.
+func (l *Listener) Name() string {
+	return l.name
+}
+
+// Addr returns the address on which the Listener is listening.
+func (l *Listener) Addr() net.Addr {
+	return l.l.Addr()
+}
+
+// Dial connects to a Listener, or any peer which exchanges imsgs with
+// big-endian headers, at the provided TCP address. The context bounds how long
+// establishing the connection may take, but has no effect once Dial returns.
+func Dial(ctx context.Context, network, addr string, opts ...NetOption) (*Conn, error) {
+	err := checkNetwork(network)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := newNetConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg.newConn(nc), nil
+}
@@ -0,0 +1,186 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestTCPPair constructs a pair of Conns connected over loopback TCP with
+// the provided options.
+func newTestTCPPair(t *testing.T, opts ...NetOption) (*Conn, *Conn) {
+	t.Helper()
+
+	l, err := Listen("tcp", "127.0.0.1:0", opts...)
+	if err != nil {
+		t.Fatalf("unexpected Listen failure: %s", err)
+	}
+	defer l.Close()
+
+	accepted := make(chan *Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Errorf("unexpected Accept failure: %s", err)
+		}
+		accepted <- c
+	}()
+
+	a, err := Dial(context.Background(), "tcp", l.Addr().String(), opts...)
+	if err != nil {
+		t.Fatalf("unexpected Dial failure: %s", err)
+	}
+	b := <-accepted
+	if b == nil {
+		t.FailNow()
+	}
+	t.Cleanup(func() {
+		a.Close()
+		b.Close()
+	})
+
+	return a, b
+}
+
+func TestTCPExchange(t *testing.T) {
+	a, b := newTestTCPPair(t, WithNetMaxSize(65535))
+
+	sizes := []int{0, 1, 15, 16, 1000, MaxSizeInBytes - HeaderSizeInBytes, 65535 - HeaderSizeInBytes}
+	go func() {
+		for i, size := range sizes {
+			err := a.Send(&IMsg{Type: uint32(i), PeerID: 0x01020304, PID: uint32(size), Data: bytes.Repeat([]byte{byte(i)}, size)})
+			if err != nil {
+				t.Errorf("unexpected Send failure: %s", err)
+				return
+			}
+		}
+	}()
+
+	for i, size := range sizes {
+		im, err := b.Recv()
+		if err != nil {
+			t.Fatalf("unexpected Recv failure: %s", err)
+		}
+		if im.Type != uint32(i) || im.PeerID != 0x01020304 || im.PID != uint32(size) ||
+			!bytes.Equal(im.Data, bytes.Repeat([]byte{byte(i)}, size)) {
+			t.Fatalf("unexpected imsg received (type %d, peer %d, pid %d, %d bytes)", im.Type, im.PeerID, im.PID, len(im.Data))
+		}
+	}
+
+	// Replies travel the other way.
+	err := b.SendBatch(&IMsg{Type: 100, Data: []byte("batch")}, &IMsg{Type: 101})
+	if err != nil {
+		t.Fatalf("unexpected SendBatch failure: %s", err)
+	}
+	for _, typ := range []uint32{100, 101} {
+		im, err := a.Recv()
+		if err != nil || im.Type != typ {
+			t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+		}
+	}
+}
+
+func TestTCPBigEndianWire(t *testing.T) {
+	l, err := Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unexpected Listen failure: %s", err)
+	}
+	defer l.Close()
+
+	nc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("unexpected dial failure: %s", err)
+	}
+	defer nc.Close()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatalf("unexpected Accept failure: %s", err)
+	}
+	defer c.Close()
+
+	err = c.Send(&IMsg{Type: 1, PeerID: 2, PID: 3, Data: []byte("hi")})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	bs := make([]byte, HeaderSizeInBytes+2)
+	_, err = io.ReadFull(nc, bs)
+	if err != nil {
+		t.Fatalf("unexpected read failure: %s", err)
+	}
+	hdr := parseHeader(bs, binary.BigEndian)
+	if hdr.Type != 1 || hdr.Length != HeaderSizeInBytes+2 || hdr.PeerID != 2 || hdr.PID != 3 {
+		t.Fatalf("header not written in big-endian order: % x", bs)
+	}
+
+	// A big-endian header written by the peer is understood.
+	im := &IMsg{Type: 0x0a0b0c0d, PID: 7, Data: []byte("there")}
+	bs, err = im.MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected MarshalBinary failure: %s", err)
+	}
+	if endianness != binary.BigEndian {
+		swapHeader(bs)
+	}
+	_, err = nc.Write(bs)
+	if err != nil {
+		t.Fatalf("unexpected write failure: %s", err)
+	}
+	got, err := c.Recv()
+	if err != nil || got.Type != im.Type || got.PID != 7 || string(got.Data) != "there" {
+		t.Fatalf("unexpected Recv result (%v, %v)", got, err)
+	}
+}
+
+func TestTCPFDPassUnsupported(t *testing.T) {
+	a, _ := newTestTCPPair(t)
+	a.AllowFDPass(true)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("unexpected Pipe failure: %s", err)
+	}
+	defer r.Close()
+
+	im, err := ComposeIMsgWithFile(1, 0, nil, w)
+	if err != nil {
+		t.Fatalf("unexpected ComposeIMsgWithFile failure: %s", err)
+	}
+	err = a.Send(im)
+	var unsupported *ErrFDPassUnsupported
+	if !errors.As(err, &unsupported) {
+		t.Fatalf("expected ErrFDPassUnsupported, got: %v", err)
+	}
+}
+
+func TestTCPDeadline(t *testing.T) {
+	_, b := newTestTCPPair(t, WithNetDeadline(20*time.Millisecond))
+
+	_, err := b.Recv()
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected os.ErrDeadlineExceeded, got: %v", err)
+	}
+}
+
+func TestTCPOptionErrors(t *testing.T) {
+	_, err := Listen("unix", "/nonexistent")
+	var unsupported *ErrUnsupported
+	if !errors.As(err, &unsupported) {
+		t.Fatalf("expected ErrUnsupported, got: %v", err)
+	}
+
+	_, err = Dial(context.Background(), "tcp", "127.0.0.1:0", WithNetMaxSize(HeaderSizeInBytes-1))
+	var bounds *ErrLengthOutOfBounds
+	if !errors.As(err, &bounds) {
+		t.Fatalf("expected ErrLengthOutOfBounds, got: %v", err)
+	}
+}
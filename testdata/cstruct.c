@@ -0,0 +1,74 @@
+/*
+ * Generates the C struct layout fixtures used by cstruct_test.go. Build and
+ * run on the target platform with:
+ *
+ *   cc -o cstruct testdata/cstruct.c && ./cstruct testdata
+ */
+
+#include <stdint.h>
+#include <stdio.h>
+#include <string.h>
+
+struct mixed {
+	uint8_t		a;
+	uint32_t	b;
+	uint8_t		c;
+	uint64_t	d;
+	uint8_t		e;
+};
+
+struct nested {
+	uint16_t	x;
+	struct mixed	m;
+	uint8_t		name[3];
+	int32_t		y;
+	uint8_t		z;
+};
+
+static int
+dump(const char *dir, const char *name, const void *p, size_t len)
+{
+	char	 path[1024];
+	FILE	*f;
+
+	snprintf(path, sizeof(path), "%s/%s", dir, name);
+	if ((f = fopen(path, "wb")) == NULL)
+		return -1;
+	fwrite(p, len, 1, f);
+	return fclose(f);
+}
+
+int
+main(int argc, char *argv[])
+{
+	struct mixed	m;
+	struct nested	n;
+
+	if (argc != 2) {
+		fprintf(stderr, "usage: %s dir\n", argv[0]);
+		return 1;
+	}
+
+	/* Zero everything, including padding. */
+	memset(&m, 0, sizeof(m));
+	m.a = 0x11;
+	m.b = 0x22334455;
+	m.c = 0x66;
+	m.d = 0x778899aabbccddeeULL;
+	m.e = 0xff;
+
+	memset(&n, 0, sizeof(n));
+	n.x = 0x0102;
+	n.m = m;
+	memcpy(n.name, "em0", 3);
+	n.y = -2;
+	n.z = 0x03;
+
+	if (dump(argv[1], "cstruct_mixed.bin", &m, sizeof(m)) == -1 ||
+	    dump(argv[1], "cstruct_nested.bin", &n, sizeof(n)) == -1) {
+		perror("dump");
+		return 1;
+	}
+
+	return 0;
+}
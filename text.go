@@ -0,0 +1,126 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
+// MarshalText implements the encoding.TextMarshaler interface. The imsg is
+// rendered on a single line, with its ancillary data in hex:
+//
+//	type=42 peer=7 pid=1234 len=20 data=74657374
+//
+// If the type has a registered name, it's included after the type:
+//
+//	type=42 name=IMSG_CTL_SHOW peer=7 pid=1234 len=20 data=74657374
+func (im IMsg) MarshalText() ([]byte, error) {
+	var b strings.Builder
+
+	b.WriteString("type=")
+	b.WriteString(strconv.FormatUint(uint64(im.Type), 10))
+	if name, ok := TypeName(im.Type); ok {
+		b.WriteString(" name=")
+		b.WriteString(name)
+	}
+	b.WriteString(" peer=")
+	b.WriteString(strconv.FormatUint(uint64(im.PeerID), 10))
+	b.WriteString(" pid=")
+	b.WriteString(strconv.FormatUint(uint64(im.PID), 10))
+	b.WriteString(" len=")
+	b.WriteString(strconv.Itoa(im.Len()))
+	b.WriteString(" data=")
+	b.WriteString(hex.EncodeToString(im.Data))
+
+	return []byte(b.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface, parsing the
+// format produced by MarshalText. Fields may appear in any order. The type and
+// data fields are required, and if the len field is present it must agree with
+// the length of the data. The name field is informational and is ignored.
+func (im *IMsg) UnmarshalText(text []byte) error {
+	var (
+		out    IMsg
+		seen   = make(map[string]bool)
+		length = -1
+	)
+
+	for _, field := range strings.Fields(string(text)) {
+		key, val, ok := strings.Cut(field, "=")
+		if !ok {
+			return &ErrInvalidText{field, "expected key=value"}
+		}
+		if seen[key] {
+			return &ErrInvalidText{key, "duplicate field"}
+		}
+		seen[key] = true
+
+		var err error
+		switch key {
+		case "type":
+			out.Type, err = parseTextUint32(key, val)
+		case "name":
+		case "peer":
+			out.PeerID, err = parseTextUint32(key, val)
+		case "pid":
+			out.PID, err = parseTextUint32(key, val)
+		case "len":
+			var n uint64
+			n, err = strconv.ParseUint(val, 10, 16)
+			if err != nil {
+				err = &ErrInvalidText{key, "not a 16-bit unsigned integer"}
+				break
+			}
+			if n < HeaderSizeInBytes || n > MaxSizeInBytes {
+				err = &ErrLengthOutOfBounds{uint16(n), HeaderSizeInBytes, MaxSizeInBytes}
+				break
+			}
+			length = int(n)
+		case "data":
+			if len(val)/2 > (MaxSizeInBytes - HeaderSizeInBytes) {
+				err = NewErrDataTooLarge(len(val)/2, MaxSizeInBytes-HeaderSizeInBytes)
+				break
+			}
+			out.Data, err = hex.DecodeString(val)
+			if err != nil {
+				err = &ErrInvalidText{key, "not valid hex"}
+			}
+			if len(out.Data) == 0 {
+				out.Data = nil
+			}
+		default:
+			err = &ErrInvalidText{key, "unknown field"}
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, key := range []string{"type", "data"} {
+		if !seen[key] {
+			return &ErrMissingField{key}
+		}
+	}
+	if length >= 0 && length != out.Len() {
+		return &ErrInvalidText{"len", "does not match length of data"}
+	}
+
+	*im = out
+
+	return nil
+}
+
+// parseTextUint32 parses a 32-bit unsigned integer field of the text format.
+func parseTextUint32(key, val string) (uint32, error) {
+	n, err := strconv.ParseUint(val, 10, 32)
+	if err != nil {
+		return 0, &ErrInvalidText{key, "not a 32-bit unsigned integer"}
+	}
+
+	return uint32(n), nil
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestMarshalText(t *testing.T) {
+	var tests = []struct {
+		name     string
+		im       IMsg
+		expected string
+	}{
+		{
+			"with data",
+			IMsg{Type: 42, PeerID: 7, PID: 1234, Data: []byte("test")},
+			"type=42 peer=7 pid=1234 len=20 data=74657374",
+		},
+		{
+			"without data",
+			IMsg{Type: 4294967295},
+			"type=4294967295 peer=0 pid=0 len=16 data=",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bs, err := tt.im.MarshalText()
+			if err != nil {
+				t.Fatalf("unexpected MarshalText failure: %s", err)
+			}
+			if string(bs) != tt.expected {
+				t.Fatalf("marshaled text does not match expected output (%q != %q)", bs, tt.expected)
+			}
+
+			var out IMsg
+			err = out.UnmarshalText(bs)
+			if err != nil {
+				t.Fatalf("unexpected UnmarshalText failure: %s", err)
+			}
+			if out.Type != tt.im.Type || out.PeerID != tt.im.PeerID || out.PID != tt.im.PID || !bytes.Equal(out.Data, tt.im.Data) {
+				t.Fatalf("round-tripped imsg does not match (%#v != %#v)", out, tt.im)
+			}
+		})
+	}
+}
+
+func TestUnmarshalText(t *testing.T) {
+	var im IMsg
+	err := im.UnmarshalText([]byte("data=6869  pid=5 type=3\tpeer=4"))
+	if err != nil {
+		t.Fatalf("unexpected UnmarshalText failure: %s", err)
+	}
+	if im.Type != 3 || im.PeerID != 4 || im.PID != 5 || !bytes.Equal(im.Data, []byte("hi")) {
+		t.Fatalf("decoded imsg does not match expected value (%#v)", im)
+	}
+
+	var tests = []struct {
+		name        string
+		text        string
+		expectedErr error
+	}{
+		{"missing type", "peer=1 data=", &ErrMissingField{}},
+		{"missing data", "type=1", &ErrMissingField{}},
+		{"not key=value", "type=1 data= junk", &ErrInvalidText{}},
+		{"unknown field", "type=1 data= flags=1", &ErrInvalidText{}},
+		{"duplicate field", "type=1 type=2 data=", &ErrInvalidText{}},
+		{"invalid integer", "type=-1 data=", &ErrInvalidText{}},
+		{"integer overflow", "type=4294967296 data=", &ErrInvalidText{}},
+		{"invalid hex", "type=1 data=6g", &ErrInvalidText{}},
+		{"odd hex", "type=1 data=686", &ErrInvalidText{}},
+		{"length mismatch", "type=1 len=17 data=6869", &ErrInvalidText{}},
+		{"length too small", "type=1 len=15 data=", &ErrLengthOutOfBounds{}},
+		{"length too large", "type=1 len=16385 data=", &ErrLengthOutOfBounds{}},
+		{"data too large", "type=1 data=" + strings.Repeat("00", MaxSizeInBytes), &ErrDataTooLarge{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := IMsg{Type: 99}
+			err := out.UnmarshalText([]byte(tt.text))
+			if !errorIsType(err, tt.expectedErr) {
+				t.Fatalf("expected %T, got: %v", tt.expectedErr, err)
+			}
+			if out.Type != 99 {
+				t.Fatalf("imsg was modified despite failure")
+			}
+		})
+	}
+}
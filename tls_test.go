@@ -0,0 +1,206 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// newTestTLSConfigs constructs server and client configurations around a
+// self-signed certificate for imsg.test.
+func newTestTLSConfigs(t *testing.T) (*tls.Config, *tls.Config) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unexpected GenerateKey failure: %s", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "imsg.test"},
+		DNSNames:     []string{"imsg.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("unexpected CreateCertificate failure: %s", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("unexpected ParseCertificate failure: %s", err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+
+	server := &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	}
+	client := &tls.Config{RootCAs: roots, ServerName: "imsg.test"}
+
+	return server, client
+}
+
+// newTestTLSPair constructs a pair of Conns connected by TLS over a net.Pipe,
+// with the provided options applied to the first, once the handshake has
+// completed.
+func newTestTLSPair(t *testing.T, opts ...ConnOption) (*Conn, *Conn) {
+	t.Helper()
+
+	serverConfig, clientConfig := newTestTLSConfigs(t)
+	pa, pb := net.Pipe()
+	ta, tb := tls.Client(pa, clientConfig), tls.Server(pb, serverConfig)
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- tb.Handshake()
+	}()
+	err := ta.Handshake()
+	if err == nil {
+		err = <-errs
+	}
+	if err != nil {
+		t.Fatalf("unexpected Handshake failure: %s", err)
+	}
+
+	a, b := NewConn(ta, opts...), NewConn(tb)
+	t.Cleanup(func() {
+		// The pipe is closed first, as closing a tls.Conn otherwise waits for
+		// the peer to read its closure alert.
+		pa.Close()
+		pb.Close()
+		a.Close()
+		b.Close()
+	})
+
+	return a, b
+}
+
+func TestTLSExchange(t *testing.T) {
+	a, b := newTestTLSPair(t)
+
+	go func() {
+		for typ := uint32(0); typ < 3; typ++ {
+			err := a.Send(&IMsg{Type: typ, PID: 1, Data: make([]byte, typ*1000)})
+			if err != nil {
+				t.Errorf("unexpected Send failure: %s", err)
+				return
+			}
+		}
+	}()
+	for typ := uint32(0); typ < 3; typ++ {
+		im, err := b.Recv()
+		if err != nil || im.Type != typ || im.PID != 1 || len(im.Data) != int(typ*1000) {
+			t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+		}
+	}
+}
+
+func TestTLSRecvTimeout(t *testing.T) {
+	a, b := newTestTLSPair(t)
+
+	_, err := b.RecvTimeout(20 * time.Millisecond)
+	if !os.IsTimeout(err) {
+		t.Fatalf("expected a timeout, got: %v", err)
+	}
+
+	// The TLS stream survives the timeout.
+	go a.Send(&IMsg{Type: 1, Data: []byte("late")})
+	im, err := b.RecvTimeout(time.Second)
+	if err != nil || im.Type != 1 || string(im.Data) != "late" {
+		t.Fatalf("unexpected RecvTimeout result (%v, %v)", im, err)
+	}
+}
+
+func TestTLSFDPassUnsupported(t *testing.T) {
+	a, _ := newTestTLSPair(t)
+	a.AllowFDPass(true)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("unexpected Pipe failure: %s", err)
+	}
+	defer r.Close()
+	defer w.Close()
+
+	err = a.Send(&IMsg{Type: 1, file: w})
+	var unsupported *ErrFDPassUnsupported
+	if !errors.As(err, &unsupported) || unsupported.Type != 1 {
+		t.Fatalf("expected ErrFDPassUnsupported, got: %v", err)
+	}
+
+	_, err = a.PeerCred()
+	var noCred *ErrUnsupported
+	if !errors.As(err, &noCred) {
+		t.Fatalf("expected ErrUnsupported, got: %v", err)
+	}
+}
+
+func TestTLSKeepalive(t *testing.T) {
+	a, b := newTestTLSPair(t, WithKeepalive(10*time.Millisecond, 100*time.Millisecond, 99))
+
+	// The peer echoes heartbeats for a while, and then stops reading
+	// altogether, so that a heartbeat blocks mid-write.
+	stop := make(chan struct{})
+	go func() {
+		for {
+			im, err := b.Recv()
+			if err != nil {
+				return
+			}
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			b.Send(im)
+		}
+	}()
+
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			_, err := a.Recv()
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	select {
+	case err := <-errs:
+		t.Fatalf("unexpected Recv failure while the peer was responsive: %v", err)
+	case <-time.After(300 * time.Millisecond):
+	}
+	close(stop)
+
+	select {
+	case err := <-errs:
+		var unresponsive *ErrPeerUnresponsive
+		if !errors.As(err, &unresponsive) {
+			t.Fatalf("expected ErrPeerUnresponsive, got: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("unresponsive peer was not detected")
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+// A Direction distinguishes imsgs being sent from those being received.
+type Direction int
+
+const (
+	// Outbound imsgs are being encoded or sent.
+	Outbound Direction = iota
+	// Inbound imsgs are being decoded or received.
+	Inbound
+)
+
+// String implements the fmt.Stringer interface.
+func (d Direction) String() string {
+	switch d {
+	case Outbound:
+		return "outbound"
+	case Inbound:
+		return "inbound"
+	}
+
+	return "unknown"
+}
+
+// A TraceFunc observes an imsg which was successfully encoded or decoded, along
+// with its size in bytes on the wire. The imsg must be treated as read-only and
+// must not be retained once the function returns. A TraceFunc is called
+// synchronously, so it should be quick.
+type TraceFunc func(dir Direction, im *IMsg, wireLen int)
+
+// A DecodeErrorFunc observes a failure to decode an imsg. The header holds as
+// much of the imsg's header as was read, and must not be retained once the
+// function returns.
+type DecodeErrorFunc func(header []byte, err error)
+
+// SetTraceFunc sets a function which is called with each imsg the Encoder
+// writes. A nil function disables tracing.
+func (e *Encoder) SetTraceFunc(f TraceFunc) {
+	e.trace = f
+}
+
+// SetTraceFunc sets a function which is called with each imsg the Decoder
+// reads. A nil function disables tracing.
+func (d *Decoder) SetTraceFunc(f TraceFunc) {
+	d.trace = f
+}
+
+// SetDecodeErrorFunc sets a function which is called when the Decoder fails to
+// decode an imsg. Reaching the end of the stream between imsgs isn't a failure.
+// A nil function disables it.
+func (d *Decoder) SetDecodeErrorFunc(f DecodeErrorFunc) {
+	d.traceErr = f
+}
+
+// WithTraceFunc sets a function which is called with each imsg the Conn sends
+// or receives. Sent imsgs are traced once they've been written to the socket,
+// and received imsgs once they've passed verification and filtering.
+func WithTraceFunc(f TraceFunc) ConnOption {
+	return func(c *Conn) {
+		c.trace = f
+	}
+}
+
+// WithDecodeErrorFunc sets a function which is called when the Conn receives
+// data which can't be decoded as an imsg.
+func WithDecodeErrorFunc(f DecodeErrorFunc) ConnOption {
+	return func(c *Conn) {
+		c.traceErr = f
+	}
+}
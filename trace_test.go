@@ -0,0 +1,89 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"testing"
+)
+
+// This records the events observed by trace hooks.
+type traceRecorder struct {
+	events []string
+}
+
+func (r *traceRecorder) trace(dir Direction, im *IMsg, wireLen int) {
+	r.events = append(r.events, fmt.Sprintf("%s type=%d len=%d", dir, im.Type, wireLen))
+}
+
+func (r *traceRecorder) traceErr(hdr []byte, err error) {
+	r.events = append(r.events, fmt.Sprintf("error hdr=%x %T", hdr, err))
+}
+
+func TestEncoderDecoderTrace(t *testing.T) {
+	var (
+		buf bytes.Buffer
+		rec traceRecorder
+	)
+
+	enc := NewEncoder(&buf)
+	enc.SetTraceFunc(rec.trace)
+	for _, im := range []*IMsg{{Type: 1, Data: []byte("test")}, {Type: 2}} {
+		err := enc.Encode(im)
+		if err != nil {
+			t.Fatalf("unexpected Encode failure: %s", err)
+		}
+	}
+	// A failed encode isn't traced.
+	enc.Encode(&IMsg{Type: 3, Data: make([]byte, MaxSizeInBytes)})
+	buf.Write([]byte{1, 2, 3})
+
+	dec := NewDecoder(&buf)
+	dec.SetTraceFunc(rec.trace)
+	dec.SetDecodeErrorFunc(rec.traceErr)
+	for {
+		_, err := dec.Decode()
+		if err != nil {
+			break
+		}
+	}
+	_, err := dec.Decode()
+	if err != io.EOF {
+		t.Fatalf("expected io.EOF, got: %v", err)
+	}
+
+	expected := []string{
+		"outbound type=1 len=20",
+		"outbound type=2 len=16",
+		"inbound type=1 len=20",
+		"inbound type=2 len=16",
+		"error hdr=010203 *imsg.ErrTruncated",
+	}
+	if fmt.Sprint(rec.events) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected trace events (%q != %q)", rec.events, expected)
+	}
+}
+
+func TestDecoderTraceUnset(t *testing.T) {
+	bs, _ := (&IMsg{Type: 1}).MarshalBinary()
+	r := bytes.NewReader(bs)
+	dec := NewDecoder(r)
+
+	traced := testing.AllocsPerRun(100, func() {
+		r.Reset(bs)
+		dec.Decode()
+	})
+	dec.SetTraceFunc(func(Direction, *IMsg, int) {})
+	dec.SetTraceFunc(nil)
+	untraced := testing.AllocsPerRun(100, func() {
+		r.Reset(bs)
+		dec.Decode()
+	})
+	if traced != untraced {
+		t.Fatalf("unset trace hook changed allocations (%.0f != %.0f)", untraced, traced)
+	}
+}
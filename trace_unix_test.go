@@ -0,0 +1,68 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestConnTrace(t *testing.T) {
+	var (
+		mu  sync.Mutex
+		rec traceRecorder
+	)
+	trace := func(dir Direction, im *IMsg, wireLen int) {
+		mu.Lock()
+		defer mu.Unlock()
+		rec.trace(dir, im, wireLen)
+	}
+
+	a, b := newTestSocketPair(t)
+	WithTraceFunc(trace)(a)
+	WithTraceFunc(trace)(b)
+	WithDecodeErrorFunc(rec.traceErr)(a)
+
+	err := a.Send(&IMsg{Type: 1, Data: []byte("test")})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	_, err = b.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	err = b.Composev(2, 0, []byte("te"), []byte("st"))
+	if err != nil {
+		t.Fatalf("unexpected Composev failure: %s", err)
+	}
+	_, err = a.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+
+	// A frame with an invalid length can't be decoded.
+	bad := make([]byte, HeaderSizeInBytes)
+	bad[0] = 3
+	b.conn.Write(bad)
+	_, err = a.Recv()
+	if err == nil {
+		t.Fatalf("expected Recv failure for invalid frame")
+	}
+
+	expected := []string{
+		"outbound type=1 len=20",
+		"inbound type=1 len=20",
+		"outbound type=2 len=20",
+		"inbound type=2 len=20",
+		"error hdr=03" + strings.Repeat("00", HeaderSizeInBytes-1) + " *imsg.ErrLengthOutOfBounds",
+	}
+	if fmt.Sprint(rec.events) != fmt.Sprint(expected) {
+		t.Fatalf("unexpected trace events (%q != %q)", rec.events, expected)
+	}
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+// Framing extensions, such as an HMAC or a checksum, append a trailer to the
+// data of each imsg which is computed over the imsg's header and data. When
+// several are enabled, an Encoder applies them in the order compression, HMAC,
+// checksum, and a Decoder removes them in the opposite order.
+
+// appendTrailer returns an imsg equivalent to im whose data has a trailer of
+// size bytes appended, as computed by sum from the header of the returned imsg
+// and the data of im. An error is returned if the trailer makes the imsg larger
+// than maxSize bytes.
+func appendTrailer(
+	im *IMsg,
+	size int,
+	maxSize uint16,
+	sum func(dst, hdr, data []byte) []byte,
+) (*IMsg, error) {
+	if im.Len()+size > int(maxSize) {
+		return nil, &ErrDataTooLarge{
+			DataLengthInBytes: len(im.Data),
+			MaxLengthInBytes:  int(maxSize) - HeaderSizeInBytes - size,
+			Type:              im.Type,
+			PeerID:            im.PeerID,
+		}
+	}
+
+	out := &IMsg{
+		Type:   im.Type,
+		PeerID: im.PeerID,
+		PID:    im.PID,
+		Data:   make([]byte, len(im.Data), len(im.Data)+size),
+		flags:  im.flags,
+		file:   im.file,
+		wipe:   im.wipe,
+	}
+	copy(out.Data, im.Data)
+
+	var hdr [HeaderSizeInBytes]byte
+	endianness.PutUint32(hdr[0:4], im.Type)
+	endianness.PutUint16(hdr[4:6], uint16(im.Len()+size))
+	endianness.PutUint16(hdr[6:8], uint16(im.flags))
+	endianness.PutUint32(hdr[8:12], im.PeerID)
+	endianness.PutUint32(hdr[12:16], im.PID)
+
+	out.Data = sum(out.Data, hdr[:], im.Data)
+
+	return out, nil
+}
+
+// splitTrailer separates the trailer of size bytes from the data of a received
+// imsg, returning the imsg's header as it was received along with the data and
+// the trailer. It reports false if the data is too short to hold a trailer.
+func splitTrailer(im *IMsg, size int) (hdr [HeaderSizeInBytes]byte, data, trailer []byte, ok bool) {
+	if len(im.Data) < size {
+		return hdr, nil, nil, false
+	}
+
+	// The header is reproduced as it was received, with the length including
+	// the trailer.
+	im.putHeader(hdr[:])
+
+	n := len(im.Data) - size
+
+	return hdr, im.Data[:n], im.Data[n:], true
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"time"
+)
+
+// WithTTL limits how long the IMsg may wait in a send queue, for imsgs such as
+// status reports which are worthless once stale. If the imsg hasn't begun to be
+// written by a Conn or MsgBuf within the provided duration of being composed,
+// it's silently discarded instead, closing any attached file, and counted in
+// Stats as SendQueueExpired. An imsg which has been partially written is always
+// completed, so the stream remains intact. Imsgs composed without a TTL never
+// expire.
+func WithTTL(ttl time.Duration) ComposeOption {
+	return func(c *composeConfig) {
+		c.ttl = ttl
+	}
+}
+
+// expired reports whether the entry's TTL had passed by now.
+func (e *msgBufEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && now.After(e.expires)
+}
+
+// dropExpired discards the head of the queue if its TTL has passed and it
+// hasn't begun to be written, reporting whether it did. The caller must hold
+// mu.
+func (m *MsgBuf) dropExpired() bool {
+	e := m.q[0]
+	if m.off > 0 || m.inflight > 0 || e.expires.IsZero() || !e.expired(time.Now()) {
+		return false
+	}
+
+	if e.file != nil {
+		e.file.Close()
+	}
+	m.pending -= e.len()
+	m.discharge(&e)
+	e.release()
+	m.q[0] = msgBufEntry{}
+	m.q = m.q[1:]
+	m.expired.Add(1)
+	m.metrics.OnQueueDepth(len(m.q))
+	m.signalSpace()
+
+	return true
+}
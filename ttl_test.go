@@ -0,0 +1,72 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMsgBufTTL(t *testing.T) {
+	const ttl = 20 * time.Millisecond
+
+	// The writer accepts only part of the first imsg before blocking.
+	w := &throttledWriter{perCall: 1024, budget: 5}
+	m := NewMsgBuf(w)
+
+	enqueue := func(typ uint32, opts ...ComposeOption) {
+		t.Helper()
+
+		im, err := ComposeIMsg(typ, 0, []byte("test"), opts...)
+		if err != nil {
+			t.Fatalf("unexpected ComposeIMsg failure: %s", err)
+		}
+		err = m.Enqueue(im)
+		if err != nil {
+			t.Fatalf("unexpected Enqueue failure: %s", err)
+		}
+	}
+	enqueue(1, WithTTL(ttl))
+	enqueue(2, WithTTL(ttl))
+	enqueue(3)
+	enqueue(4, WithTTL(time.Hour))
+	enqueue(5, WithTTL(ttl))
+
+	_, err := m.Flush()
+	if !errors.Is(err, errFull) {
+		t.Fatalf("expected errFull, got: %v", err)
+	}
+
+	// Once the TTLs lapse, the partially written imsg is still completed, but
+	// the stale imsgs behind it are discarded.
+	time.Sleep(2 * ttl)
+	w.budget = 1024
+	n, err := m.Flush()
+	if err != nil {
+		t.Fatalf("unexpected Flush failure: %s", err)
+	}
+	if n != 3 || m.QueueLen() != 0 || m.PendingBytes() != 0 {
+		t.Fatalf("unexpected Flush result (%d, %d imsgs, %d bytes)", n, m.QueueLen(), m.PendingBytes())
+	}
+
+	r := bytes.NewReader(w.Bytes())
+	for _, typ := range []uint32{1, 3, 4} {
+		im, err := ReadIMsg(r)
+		if err != nil || im.Type != typ {
+			t.Fatalf("unexpected ReadIMsg result (%v, %v)", im, err)
+		}
+	}
+	if r.Len() != 0 {
+		t.Fatalf("unexpected data written (%d bytes)", r.Len())
+	}
+
+	var s Stats
+	m.fillStats(&s)
+	if s.SendQueueExpired != 2 || s.MessagesSent != 3 {
+		t.Fatalf("unexpected send stats (%d expired, %d sent)", s.SendQueueExpired, s.MessagesSent)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"reflect"
+)
+
+// ComposeTyped constructs an IMsg of the provided type whose ancillary data is
+// v encoded with encoding/binary in the system byte order. Only fixed-size
+// types, such as fixed-width integers and arrays or structs of them, may be
+// encoded. Note that encoding/binary doesn't insert padding, so the layout of a
+// struct matches a C struct only when no padding is required; see
+// MarshalCStruct otherwise. The PID field is filled in as with ComposeIMsg.
+func ComposeTyped[T any](typ, peerID uint32, v T) (*IMsg, error) {
+	size := fixedSize(v)
+	if size < 0 {
+		return nil, &ErrNotFixedSize{fmt.Sprintf("%T", v)}
+	}
+	if size > (MaxSizeInBytes - HeaderSizeInBytes) {
+		return nil, &ErrDataTooLarge{
+			DataLengthInBytes: size,
+			MaxLengthInBytes:  MaxSizeInBytes - HeaderSizeInBytes,
+			Type:              typ,
+			PeerID:            peerID,
+		}
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, size))
+	err := binary.Write(buf, endianness, v)
+	if err != nil {
+		return nil, err
+	}
+
+	return ComposeIMsg(typ, peerID, buf.Bytes())
+}
+
+// DataAs decodes the ancillary data of the imsg into a value of type T using
+// encoding/binary in the system byte order. The length of the data must
+// exactly match the size of T.
+func DataAs[T any](im *IMsg) (T, error) {
+	var v T
+
+	size := fixedSize(v)
+	if size < 0 {
+		return v, &ErrNotFixedSize{fmt.Sprintf("%T", v)}
+	}
+	if len(im.Data) != size {
+		return v, &ErrDataSizeMismatch{size, len(im.Data)}
+	}
+
+	err := binary.Read(bytes.NewReader(im.Data), endianness, &v)
+	if err != nil {
+		return v, err
+	}
+
+	return v, nil
+}
+
+// ComposeFrom constructs an IMsg of the provided type whose ancillary data is
+// the result of m.MarshalBinary. An error from MarshalBinary is wrapped in an
+// ErrPayloadCodec. The PID field is filled in as with ComposeIMsg.
+func ComposeFrom(
+	typ, peerID uint32,
+	m encoding.BinaryMarshaler,
+) (*IMsg, error) {
+	data, err := m.MarshalBinary()
+	if err != nil {
+		return nil, &ErrPayloadCodec{"marshal", err}
+	}
+
+	return ComposeIMsg(typ, peerID, data)
+}
+
+// DecodeData passes the ancillary data of the imsg to u.UnmarshalBinary. An
+// error from UnmarshalBinary is wrapped in an ErrPayloadCodec.
+func (im *IMsg) DecodeData(u encoding.BinaryUnmarshaler) error {
+	err := u.UnmarshalBinary(im.Data)
+	if err != nil {
+		return &ErrPayloadCodec{"unmarshal", err}
+	}
+
+	return nil
+}
+
+// fixedSize returns the size in bytes of v when encoded with encoding/binary,
+// or -1 if v's type doesn't have a fixed size. Unlike binary.Size, slices are
+// rejected, since their size depends on their value.
+func fixedSize(v any) int {
+	t := reflect.TypeOf(v)
+	if t == nil || t.Kind() == reflect.Slice {
+		return -1
+	}
+
+	return binary.Size(v)
+}
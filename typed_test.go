@@ -0,0 +1,173 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+type typedTestPayload struct {
+	Index uint32
+	Flags uint16
+	Kind  uint8
+	Up    bool
+	Addr  [4]byte
+	MTU   int64
+}
+
+func TestComposeTypedStruct(t *testing.T) {
+	in := typedTestPayload{
+		Index: 0x01020304,
+		Flags: 0x0506,
+		Kind:  7,
+		Up:    true,
+		Addr:  [4]byte{192, 0, 2, 1},
+		MTU:   -1,
+	}
+
+	im, err := ComposeTyped(1, 2, in)
+	if err != nil {
+		t.Fatalf("unexpected ComposeTyped failure: %s", err)
+	}
+	if len(im.Data) != 20 {
+		t.Fatalf("unexpected data length (%d != 20)", len(im.Data))
+	}
+
+	b := NewIBuf()
+	b.AddUint32(in.Index)
+	b.AddUint16(in.Flags)
+	b.AddUint8(in.Kind)
+	b.AddUint8(1)
+	b.Add(in.Addr[:])
+	b.AddUint64(uint64(in.MTU))
+	if !bytes.Equal(im.Data, b.Bytes()) {
+		t.Fatalf("encoded data does not match expected output (% x != % x)", im.Data, b.Bytes())
+	}
+
+	out, err := DataAs[typedTestPayload](im)
+	if err != nil {
+		t.Fatalf("unexpected DataAs failure: %s", err)
+	}
+	if out != in {
+		t.Fatalf("decoded value does not match (%#v != %#v)", out, in)
+	}
+}
+
+func TestComposeTypedArray(t *testing.T) {
+	in := [3]uint16{1, 2, 3}
+
+	im, err := ComposeTyped(1, 2, in)
+	if err != nil {
+		t.Fatalf("unexpected ComposeTyped failure: %s", err)
+	}
+
+	out, err := DataAs[[3]uint16](im)
+	if err != nil {
+		t.Fatalf("unexpected DataAs failure: %s", err)
+	}
+	if out != in {
+		t.Fatalf("decoded value does not match (%v != %v)", out, in)
+	}
+}
+
+func TestComposeTypedErrors(t *testing.T) {
+	var enfs *ErrNotFixedSize
+	_, err := ComposeTyped(1, 2, []byte("test"))
+	if !errors.As(err, &enfs) {
+		t.Fatalf("expected ErrNotFixedSize, got: %v", err)
+	}
+	_, err = ComposeTyped(1, 2, struct{ S string }{"test"})
+	if !errors.As(err, &enfs) {
+		t.Fatalf("expected ErrNotFixedSize, got: %v", err)
+	}
+
+	var edtl *ErrDataTooLarge
+	_, err = ComposeTyped(1, 2, [MaxSizeInBytes]byte{})
+	if !errors.As(err, &edtl) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+
+	var edsm *ErrDataSizeMismatch
+	_, err = DataAs[uint32](&IMsg{Data: []byte{1, 2, 3}})
+	if !errors.As(err, &edsm) {
+		t.Fatalf("expected ErrDataSizeMismatch, got: %v", err)
+	}
+	_, err = DataAs[uint32](&IMsg{Data: []byte{1, 2, 3, 4, 5}})
+	if !errors.As(err, &edsm) {
+		t.Fatalf("expected ErrDataSizeMismatch, got: %v", err)
+	}
+
+	_, err = DataAs[[]byte](&IMsg{Data: []byte{1}})
+	if !errors.As(err, &enfs) {
+		t.Fatalf("expected ErrNotFixedSize, got: %v", err)
+	}
+}
+
+// This is a payload which implements its own binary encoding.
+type binaryTestPayload struct {
+	Name string
+	Err  error
+}
+
+func (p binaryTestPayload) MarshalBinary() ([]byte, error) {
+	if p.Err != nil {
+		return nil, p.Err
+	}
+	return []byte(p.Name), nil
+}
+
+func (p *binaryTestPayload) UnmarshalBinary(data []byte) error {
+	if p.Err != nil {
+		return p.Err
+	}
+	p.Name = string(data)
+	return nil
+}
+
+// This is an error returned by a payload's codec.
+type errTestPayload struct{}
+
+func (errTestPayload) Error() string { return "test payload error" }
+
+func TestComposeFromDecodeData(t *testing.T) {
+	im, err := ComposeFrom(1, 2, binaryTestPayload{Name: "em0"})
+	if err != nil {
+		t.Fatalf("unexpected ComposeFrom failure: %s", err)
+	}
+	if !bytes.Equal(im.Data, []byte("em0")) {
+		t.Fatalf("composed imsg data does not match expected output (% x)", im.Data)
+	}
+
+	var out binaryTestPayload
+	err = im.DecodeData(&out)
+	if err != nil {
+		t.Fatalf("unexpected DecodeData failure: %s", err)
+	}
+	if out.Name != "em0" {
+		t.Fatalf("decoded value does not match (%q)", out.Name)
+	}
+}
+
+func TestComposeFromDecodeDataErrors(t *testing.T) {
+	var edtl *ErrDataTooLarge
+	_, err := ComposeFrom(1, 2, binaryTestPayload{Name: string(make([]byte, MaxSizeInBytes))})
+	if !errors.As(err, &edtl) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+
+	var epc *ErrPayloadCodec
+	var etp errTestPayload
+	_, err = ComposeFrom(1, 2, binaryTestPayload{Err: errTestPayload{}})
+	if !errors.As(err, &epc) || epc.Op != "marshal" || !errors.As(err, &etp) {
+		t.Fatalf("expected wrapped marshal error, got: %v", err)
+	}
+
+	err = (&IMsg{}).DecodeData(&binaryTestPayload{Err: errTestPayload{}})
+	if !errors.As(err, &epc) || epc.Op != "unmarshal" || !errors.As(err, &etp) {
+		t.Fatalf("expected wrapped unmarshal error, got: %v", err)
+	}
+}
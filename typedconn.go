@@ -0,0 +1,98 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+// A TypedConn exchanges Go values over a Conn for protocols in which each
+// direction carries a single type of value: values of type S are sent and
+// values of type R are received, each encoded with a Codec as the ancillary
+// data of imsgs of one imsg type. Imsgs of other types on the same Conn may be
+// handed to a fallback handler set with SetFallback.
+type TypedConn[S, R any] struct {
+	c        *Conn
+	typ      uint32
+	codec    Codec
+	fallback HandlerFunc
+}
+
+// NewTypedConn constructs a TypedConn which exchanges values over the provided
+// Conn as imsgs of the provided type, encoded with the provided Codec. A nil
+// Codec uses the Conn's, which is set with WithCodec.
+func NewTypedConn[S, R any](c *Conn, typ uint32, codec Codec) *TypedConn[S, R] {
+	if codec == nil {
+		codec = c.codec
+	}
+
+	return &TypedConn[S, R]{
+		c:     c,
+		typ:   typ,
+		codec: codec,
+	}
+}
+
+// SetFallback sets a handler for received imsgs of types other than the
+// TypedConn's, which Recv invokes before moving on to the next imsg. An error
+// from the handler is returned by Recv. Without a fallback, such imsgs are
+// refused by Recv with ErrNoHandler, and any attached file is closed.
+func (tc *TypedConn[S, R]) SetFallback(h HandlerFunc) {
+	tc.fallback = h
+}
+
+// Conn returns the Conn underlying the TypedConn.
+func (tc *TypedConn[S, R]) Conn() *Conn {
+	return tc.c
+}
+
+// Send encodes v and sends it to the peer. The PID field is filled in as
+// described by WithPIDFunc. An error from the Codec is wrapped in an
+// ErrPayloadCodec, and if the encoded value is too large, ErrDataTooLarge is
+// returned.
+func (tc *TypedConn[S, R]) Send(v S) error {
+	data, err := tc.codec.Marshal(v)
+	if err != nil {
+		return &ErrPayloadCodec{"marshal", err}
+	}
+
+	return tc.c.Send(&IMsg{
+		Type: tc.typ,
+		PID:  tc.c.pid(),
+		Data: data,
+	})
+}
+
+// Recv receives the next value from the peer. If an imsg of the TypedConn's
+// type can't be decoded, ErrUndecodable is returned carrying the imsg. Any file
+// attached to a received imsg is closed, unless the imsg is handed to the
+// fallback.
+func (tc *TypedConn[S, R]) Recv() (R, error) {
+	var v R
+
+	for {
+		im, err := tc.c.Recv()
+		if err != nil {
+			return v, err
+		}
+
+		if im.Type != tc.typ {
+			if tc.fallback == nil {
+				im.closeFile()
+				return v, &ErrNoHandler{im.Type}
+			}
+			err = invokeHandler(tc.fallback, im)
+			if err != nil {
+				return v, err
+			}
+			continue
+		}
+
+		im.closeFile()
+		err = tc.codec.Unmarshal(im.Data, &v)
+		if err != nil {
+			var zero R
+			return zero, &ErrUndecodable{im, err}
+		}
+
+		return v, nil
+	}
+}
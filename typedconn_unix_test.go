@@ -0,0 +1,123 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type typedTestRequest struct {
+	Name string
+	Port int
+}
+
+type typedTestReply struct {
+	OK    bool
+	Addrs []string
+}
+
+func TestTypedConn(t *testing.T) {
+	req := typedTestRequest{"em0", 8080}
+	reply := typedTestReply{true, []string{"192.0.2.1", "2001:db8::1"}}
+
+	for _, codec := range []Codec{GobCodec{}, JSONCodec{}} {
+		t.Run(reflect.TypeOf(codec).Name(), func(t *testing.T) {
+			a, b := newTestSocketPair(t)
+			client := NewTypedConn[typedTestRequest, typedTestReply](a, 1, codec)
+			server := NewTypedConn[typedTestReply, typedTestRequest](b, 1, codec)
+
+			err := client.Send(req)
+			if err != nil {
+				t.Fatalf("unexpected Send failure: %s", err)
+			}
+			gotReq, err := server.Recv()
+			if err != nil || !reflect.DeepEqual(gotReq, req) {
+				t.Fatalf("unexpected Recv result (%v, %v)", gotReq, err)
+			}
+
+			err = server.Send(reply)
+			if err != nil {
+				t.Fatalf("unexpected Send failure: %s", err)
+			}
+			gotReply, err := client.Recv()
+			if err != nil || !reflect.DeepEqual(gotReply, reply) {
+				t.Fatalf("unexpected Recv result (%v, %v)", gotReply, err)
+			}
+		})
+	}
+}
+
+func TestTypedConnFallback(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	client := NewTypedConn[typedTestRequest, typedTestReply](a, 1, JSONCodec{})
+	server := NewTypedConn[typedTestReply, typedTestRequest](b, 1, JSONCodec{})
+
+	// Without a fallback, imsgs of other types are refused.
+	err := a.Send(&IMsg{Type: 2})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	_, err = server.Recv()
+	var enh *ErrNoHandler
+	if !errors.As(err, &enh) || enh.Type != 2 {
+		t.Fatalf("expected ErrNoHandler, got: %v", err)
+	}
+
+	var other []uint32
+	server.SetFallback(func(im *IMsg) error {
+		other = append(other, im.Type)
+		return nil
+	})
+	for _, typ := range []uint32{2, 3} {
+		err = a.Send(&IMsg{Type: typ})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+	err = client.Send(typedTestRequest{Name: "em1"})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	got, err := server.Recv()
+	if err != nil || got.Name != "em1" {
+		t.Fatalf("unexpected Recv result (%v, %v)", got, err)
+	}
+	if !reflect.DeepEqual(other, []uint32{2, 3}) {
+		t.Fatalf("unexpected types handed to the fallback (%v)", other)
+	}
+}
+
+func TestTypedConnErrors(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	server := NewTypedConn[typedTestReply, typedTestRequest](b, 1, JSONCodec{})
+
+	err := a.Send(&IMsg{Type: 1, Data: []byte("not json")})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	_, err = server.Recv()
+	var undecodable *ErrUndecodable
+	if !errors.As(err, &undecodable) || string(undecodable.IMsg.Data) != "not json" {
+		t.Fatalf("expected ErrUndecodable, got: %v", err)
+	}
+
+	client := NewTypedConn[typedTestRequest, typedTestReply](a, 1, failingCodec{})
+	err = client.Send(typedTestRequest{})
+	var epc *ErrPayloadCodec
+	if !errors.As(err, &epc) || !errors.Is(err, errFailingCodec) {
+		t.Fatalf("expected ErrPayloadCodec, got: %v", err)
+	}
+
+	client = NewTypedConn[typedTestRequest, typedTestReply](a, 1, bloatedCodec{})
+	err = client.Send(typedTestRequest{})
+	var tooLarge *ErrDataTooLarge
+	if !errors.As(err, &tooLarge) {
+		t.Fatalf("expected ErrDataTooLarge, got: %v", err)
+	}
+}
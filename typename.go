@@ -0,0 +1,54 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"sync"
+)
+
+// This is the registry of human-readable names for imsg types.
+var typeNames = struct {
+	sync.RWMutex
+	m map[uint32]string
+}{m: make(map[uint32]string)}
+
+// RegisterTypeName registers a human-readable name for an imsg type, such as
+// "IMSG_CTL_SHOW". Registered names are used when imsgs are printed or
+// marshaled to text or JSON. Registering the same name again is permitted, but
+// registering a different name for a type returns ErrTypeNameConflict.
+func RegisterTypeName(typ uint32, name string) error {
+	return RegisterTypeNames(map[uint32]string{typ: name})
+}
+
+// RegisterTypeNames registers human-readable names for several imsg types at
+// once. If any of the names conflicts with an existing registration, none of
+// them are registered.
+func RegisterTypeNames(names map[uint32]string) error {
+	typeNames.Lock()
+	defer typeNames.Unlock()
+
+	for typ, name := range names {
+		existing, ok := typeNames.m[typ]
+		if ok && existing != name {
+			return &ErrTypeNameConflict{typ, existing, name}
+		}
+	}
+
+	for typ, name := range names {
+		typeNames.m[typ] = name
+	}
+
+	return nil
+}
+
+// TypeName returns the name registered for an imsg type, if any.
+func TypeName(typ uint32) (string, bool) {
+	typeNames.RLock()
+	defer typeNames.RUnlock()
+
+	name, ok := typeNames.m[typ]
+
+	return name, ok
+}
@@ -0,0 +1,157 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+// unregisterTypeNames removes registered names so tests don't affect one
+// another.
+func unregisterTypeNames(t *testing.T, types ...uint32) {
+	t.Cleanup(func() {
+		typeNames.Lock()
+		defer typeNames.Unlock()
+		for _, typ := range types {
+			delete(typeNames.m, typ)
+		}
+	})
+}
+
+func TestRegisterTypeName(t *testing.T) {
+	unregisterTypeNames(t, 0xf001, 0xf002, 0xf003)
+
+	_, ok := TypeName(0xf001)
+	if ok {
+		t.Fatalf("unregistered type has a name")
+	}
+
+	err := RegisterTypeName(0xf001, "IMSG_CTL_SHOW")
+	if err != nil {
+		t.Fatalf("unexpected RegisterTypeName failure: %s", err)
+	}
+	name, ok := TypeName(0xf001)
+	if !ok || name != "IMSG_CTL_SHOW" {
+		t.Fatalf("unexpected name (%q, %t)", name, ok)
+	}
+
+	// Registering the same name again is fine.
+	err = RegisterTypeName(0xf001, "IMSG_CTL_SHOW")
+	if err != nil {
+		t.Fatalf("unexpected failure re-registering name: %s", err)
+	}
+
+	var etnc *ErrTypeNameConflict
+	err = RegisterTypeName(0xf001, "IMSG_RECONF")
+	if !errors.As(err, &etnc) || etnc.ExistingName != "IMSG_CTL_SHOW" {
+		t.Fatalf("expected ErrTypeNameConflict, got: %v", err)
+	}
+
+	// A conflicting batch registers nothing.
+	err = RegisterTypeNames(map[uint32]string{
+		0xf001: "IMSG_RECONF",
+		0xf002: "IMSG_CTL_END",
+	})
+	if !errors.As(err, &etnc) {
+		t.Fatalf("expected ErrTypeNameConflict, got: %v", err)
+	}
+	if _, ok := TypeName(0xf002); ok {
+		t.Fatalf("conflicting batch was partially registered")
+	}
+
+	err = RegisterTypeNames(map[uint32]string{
+		0xf002: "IMSG_CTL_END",
+		0xf003: "IMSG_RECONF",
+	})
+	if err != nil {
+		t.Fatalf("unexpected RegisterTypeNames failure: %s", err)
+	}
+	if name, _ := TypeName(0xf003); name != "IMSG_RECONF" {
+		t.Fatalf("unexpected name (%q)", name)
+	}
+}
+
+func TestRegisterTypeNameConcurrent(t *testing.T) {
+	const n = 64
+
+	types := make([]uint32, n)
+	for i := range types {
+		types[i] = 0xf100 + uint32(i)
+	}
+	unregisterTypeNames(t, types...)
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			err := RegisterTypeName(types[i], fmt.Sprintf("IMSG_%d", i))
+			if err != nil {
+				t.Errorf("unexpected RegisterTypeName failure: %s", err)
+			}
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			TypeName(types[(i+1)%n])
+			_ = (&IMsg{Type: types[i]}).String()
+		}(i)
+	}
+	wg.Wait()
+
+	for i, typ := range types {
+		name, ok := TypeName(typ)
+		if !ok || name != fmt.Sprintf("IMSG_%d", i) {
+			t.Fatalf("unexpected name for type %#x (%q, %t)", typ, name, ok)
+		}
+	}
+}
+
+func TestTypeNameOutput(t *testing.T) {
+	unregisterTypeNames(t, 0xf201)
+	err := RegisterTypeName(0xf201, "IMSG_CTL_SHOW")
+	if err != nil {
+		t.Fatalf("unexpected RegisterTypeName failure: %s", err)
+	}
+
+	im := &IMsg{Type: 0xf201, PeerID: 7, PID: 1234, Data: []byte("test")}
+
+	s := im.String()
+	expected := "imsg type=IMSG_CTL_SHOW(0xf201) peer=0x7 pid=0x4d2 len=20"
+	if s != expected {
+		t.Fatalf("string does not match expected output (%q != %q)", s, expected)
+	}
+
+	s = fmt.Sprintf("%v", im)
+	expected = "type=IMSG_CTL_SHOW(61953) peer=7 pid=1234 len=20"
+	if s != expected {
+		t.Fatalf("formatted output does not match expected output (%q != %q)", s, expected)
+	}
+
+	bs, _ := im.MarshalText()
+	expected = "type=61953 name=IMSG_CTL_SHOW peer=7 pid=1234 len=20 data=74657374"
+	if string(bs) != expected {
+		t.Fatalf("text does not match expected output (%q != %q)", bs, expected)
+	}
+	var out IMsg
+	err = out.UnmarshalText(bs)
+	if err != nil || out.Type != im.Type {
+		t.Fatalf("unexpected UnmarshalText result (%#v, %v)", out, err)
+	}
+
+	bs, _ = json.Marshal(im)
+	expected = `{"type":61953,"type_name":"IMSG_CTL_SHOW","peer_id":7,"pid":1234,"data":"dGVzdA==","internal_flags":0}`
+	if string(bs) != expected {
+		t.Fatalf("JSON does not match expected output (%s != %s)", bs, expected)
+	}
+	out = IMsg{}
+	err = json.Unmarshal(bs, &out)
+	if err != nil || out.Type != im.Type {
+		t.Fatalf("unexpected UnmarshalJSON result (%#v, %v)", out, err)
+	}
+}
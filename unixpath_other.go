@@ -0,0 +1,25 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build !unix
+
+package imsg
+
+import (
+	"context"
+	"os"
+	"runtime"
+)
+
+// ListenPath is unsupported on this platform, and returns
+// ErrUnsupportedPlatform.
+func ListenPath(path string, mode os.FileMode, opts ...NetOption) (*Listener, error) {
+	return nil, &ErrUnsupportedPlatform{"unix socket paths", runtime.GOOS}
+}
+
+// DialPath is unsupported on this platform, and returns
+// ErrUnsupportedPlatform.
+func DialPath(ctx context.Context, path string, opts ...NetOption) (*Conn, error) {
+	return nil, &ErrUnsupportedPlatform{"unix socket paths", runtime.GOOS}
+}
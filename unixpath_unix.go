@@ -0,0 +1,152 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// This bounds how long ListenPath waits to learn whether an existing socket is
+// being listened on.
+const staleCheckTimeout = time.Second
+
+// ListenPath listens for unix domain socket connections at the provided path,
+// such as a daemon's control socket. A socket file left behind by a process
+// which is no longer listening is replaced, whereas ErrSocketInUse is returned
+// if a process is still listening on it, and any other kind of file is left
+// alone. The socket file is created with the provided permission bits, which
+// it has from the moment it appears at path, and it's removed once the
+// Listener is closed.
+//
+// On Linux, a path beginning with '@' names a socket in the abstract
+// namespace, which has no file and so no permissions; mode is ignored. Abstract
+// names are refused with ErrUnsupportedPlatform elsewhere.
+func ListenPath(path string, mode os.FileMode, opts ...NetOption) (*Listener, error) {
+	cfg, err := newNetConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(path, "@") {
+		if runtime.GOOS != "linux" {
+			return nil, &ErrUnsupportedPlatform{"abstract socket addresses", runtime.GOOS}
+		}
+		l, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		return &Listener{l: l, cfg: cfg}, nil
+	}
+
+	err = removeStale(path)
+	if err != nil {
+		return nil, err
+	}
+
+	// The socket is bound under a temporary name, given its permissions, and
+	// only then linked into place, so that it's never reachable at path with
+	// the permissions granted by the umask. Unlike a rename, the link fails
+	// rather than replacing a file which appeared at path in the meantime.
+	ul, tmp, err := listenTemp(filepath.Dir(path))
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(tmp, mode.Perm())
+	if err == nil {
+		err = os.Link(tmp, path)
+	}
+	os.Remove(tmp)
+	if err != nil {
+		ul.Close()
+		return nil, err
+	}
+
+	return &Listener{l: ul, cfg: cfg, path: path}, nil
+}
+
+// listenTemp listens on a socket bound under an unused temporary name in dir,
+// returning the name. The name is at most 8 bytes long, so it fits in a socket
+// address wherever a path in dir with a base name at least as long does. The
+// socket file isn't removed when the listener is closed.
+func listenTemp(dir string) (*net.UnixListener, string, error) {
+	var err error
+	for i := 0; i < 8; i++ {
+		tmp := filepath.Join(dir, "."+strconv.FormatUint(uint64(rand.Uint32()), 36))
+		var ul *net.UnixListener
+		ul, err = net.ListenUnix("unix", &net.UnixAddr{Name: tmp, Net: "unix"})
+		if err == nil {
+			ul.SetUnlinkOnClose(false)
+			return ul, tmp, nil
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			break
+		}
+	}
+
+	return nil, "", err
+}
+
+// removeStale removes the socket file at path if nothing is listening on it.
+// Anything other than a socket is left in place, for linking the new socket to
+// report.
+func removeStale(path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Type() != fs.ModeSocket {
+		return nil
+	}
+
+	nc, err := net.DialTimeout("unix", path, staleCheckTimeout)
+	if err == nil {
+		nc.Close()
+		return &ErrSocketInUse{path}
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// DialPath connects to the unix domain socket at the provided path, which may
+// name a socket in the abstract namespace on Linux, as with ListenPath. The
+// context bounds how long establishing the connection may take, but has no
+// effect once DialPath returns.
+func DialPath(ctx context.Context, path string, opts ...NetOption) (*Conn, error) {
+	cfg, err := newNetConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(path, "@") && runtime.GOOS != "linux" {
+		return nil, &ErrUnsupportedPlatform{"abstract socket addresses", runtime.GOOS}
+	}
+
+	var d net.Dialer
+	nc, err := d.DialContext(ctx, "unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg.newConn(nc), nil
+}
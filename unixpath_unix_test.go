@@ -0,0 +1,176 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// exchangeOverListener dials l at path and confirms that an imsg with an
+// attached file makes it across.
+func exchangeOverListener(t *testing.T, l *Listener, path string) {
+	t.Helper()
+
+	accepted := make(chan *Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			t.Errorf("unexpected Accept failure: %s", err)
+		}
+		accepted <- c
+	}()
+
+	a, err := DialPath(context.Background(), path)
+	if err != nil {
+		t.Fatalf("unexpected DialPath failure: %s", err)
+	}
+	defer a.Close()
+	b := <-accepted
+	if b == nil {
+		t.FailNow()
+	}
+	defer b.Close()
+	a.AllowFDPass(true)
+	b.AllowFDPass(true)
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("unexpected Pipe failure: %s", err)
+	}
+	defer r.Close()
+	im, err := ComposeIMsgWithFile(1, 0, []byte("path"), w)
+	if err != nil {
+		t.Fatalf("unexpected ComposeIMsgWithFile failure: %s", err)
+	}
+	err = a.Send(im)
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	im, err = b.Recv()
+	if err != nil || im.Type != 1 || string(im.Data) != "path" || im.File() == nil {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+	im.Close()
+}
+
+func TestListenPath(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "imsg.sock")
+
+	l, err := ListenPath(path, 0o600)
+	if err != nil {
+		t.Fatalf("unexpected ListenPath failure: %s", err)
+	}
+	fi, err := os.Lstat(path)
+	if err != nil {
+		t.Fatalf("unexpected Lstat failure: %s", err)
+	}
+	if fi.Mode().Type() != fs.ModeSocket || fi.Mode().Perm() != 0o600 {
+		t.Fatalf("unexpected socket file mode: %s", fi.Mode())
+	}
+	exchangeOverListener(t, l, path)
+
+	// A socket which is being listened on isn't replaced.
+	_, err = ListenPath(path, 0o600)
+	var inUse *ErrSocketInUse
+	if !errors.As(err, &inUse) || inUse.Path != path {
+		t.Fatalf("expected ErrSocketInUse, got: %v", err)
+	}
+
+	err = l.Close()
+	if err != nil {
+		t.Fatalf("unexpected Close failure: %s", err)
+	}
+	_, err = os.Lstat(path)
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("socket file was not removed by Close: %v", err)
+	}
+
+	// Other kinds of files are left alone.
+	err = os.WriteFile(path, []byte("keep"), 0o644)
+	if err != nil {
+		t.Fatalf("unexpected WriteFile failure: %s", err)
+	}
+	_, err = ListenPath(path, 0o600)
+	if err == nil {
+		t.Fatalf("ListenPath replaced a regular file")
+	}
+	bs, err := os.ReadFile(path)
+	if err != nil || string(bs) != "keep" {
+		t.Fatalf("regular file was disturbed (%q, %v)", bs, err)
+	}
+}
+
+func TestListenPathStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "imsg.sock")
+
+	// A listener which exits without cleaning up leaves its socket behind.
+	ul, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatalf("unexpected ListenUnix failure: %s", err)
+	}
+	ul.SetUnlinkOnClose(false)
+	ul.Close()
+
+	l, err := ListenPath(path, 0o660)
+	if err != nil {
+		t.Fatalf("unexpected ListenPath failure: %s", err)
+	}
+	defer l.Close()
+
+	fi, err := os.Lstat(path)
+	if err != nil || fi.Mode().Perm() != 0o660 {
+		t.Fatalf("unexpected socket file mode (%v, %v)", fi, err)
+	}
+	exchangeOverListener(t, l, path)
+}
+
+func TestListenPathLong(t *testing.T) {
+	// The path is as long as a socket address allows everywhere, leaving no
+	// room for a longer temporary name.
+	dir := t.TempDir()
+	n := 103 - len(dir) - 1
+	if n < 8 {
+		t.Skipf("temporary directory is too long (%s)", dir)
+	}
+	path := filepath.Join(dir, strings.Repeat("s", n))
+
+	l, err := ListenPath(path, 0o600)
+	if err != nil {
+		t.Fatalf("unexpected ListenPath failure: %s", err)
+	}
+	defer l.Close()
+
+	exchangeOverListener(t, l, path)
+}
+
+func TestListenPathAbstract(t *testing.T) {
+	path := "@imsg-test-" + strconv.Itoa(os.Getpid())
+
+	l, err := ListenPath(path, 0)
+	if runtime.GOOS != "linux" {
+		var unsupported *ErrUnsupportedPlatform
+		if !errors.As(err, &unsupported) {
+			t.Fatalf("expected ErrUnsupportedPlatform, got: %v", err)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatalf("unexpected ListenPath failure: %s", err)
+	}
+	defer l.Close()
+
+	exchangeOverListener(t, l, path)
+}
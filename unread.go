@@ -0,0 +1,99 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+// This is the most imsgs which may await Recv after being pushed back with
+// Unread.
+const maxUnread = 8
+
+// Unread pushes a received imsg back onto the front of the Conn's receive
+// queue, so that it's returned by the next Recv, TryRecv or RecvBatch, and by
+// the next iteration of Serve or Router.Run, ahead of anything received since.
+// RecvMatching and Call consider it before anything else. Imsgs unread one
+// after another are returned in the reverse order, the last unread first. This
+// lets a dispatch layer defer an imsg which belongs to a later phase, such as
+// configuration which arrives during a handshake.
+//
+// The imsg, including any attached file, is owned by the Conn until it's
+// returned again; an imsg unread by a handler called from Serve isn't closed
+// when the handler returns. Up to 8 imsgs may be awaiting Recv after being
+// unread, beyond which ErrUnreadFull is returned. Once the Conn has failed,
+// Unread returns the error Recv would.
+//
+// Unread never waits for a Recv blocked reading from the socket, so it may be
+// called from any goroutine, such as by a subscriber of a running Router. Such
+// a Recv returns what it reads, and the unread imsg follows.
+func (c *Conn) Unread(im *IMsg) error {
+	c.umu.Lock()
+	defer c.umu.Unlock()
+
+	if err := c.failure(); err != nil {
+		return err
+	}
+	if len(c.unread) >= maxUnread {
+		return &ErrUnreadFull{maxUnread}
+	}
+
+	c.unread = append(c.unread, im)
+	c.grewBacklog(im)
+
+	return nil
+}
+
+// popUnread removes the imsg most recently pushed back by Unread, returning
+// nil if there's none.
+func (c *Conn) popUnread() *IMsg {
+	c.umu.Lock()
+	defer c.umu.Unlock()
+
+	if len(c.unread) == 0 {
+		return nil
+	}
+
+	return c.takeUnread(len(c.unread) - 1)
+}
+
+// takeUnreadMatching removes the first imsg pushed back by Unread which
+// satisfies match, in the order in which they're returned, or returns nil if
+// none does.
+func (c *Conn) takeUnreadMatching(match func(*IMsg) bool) *IMsg {
+	c.umu.Lock()
+	defer c.umu.Unlock()
+
+	for i := len(c.unread) - 1; i >= 0; i-- {
+		if match(c.unread[i]) {
+			return c.takeUnread(i)
+		}
+	}
+
+	return nil
+}
+
+// takeUnread removes the imsg at index i of those pushed back by Unread. The
+// caller must hold umu.
+func (c *Conn) takeUnread(i int) *IMsg {
+	im := c.unread[i]
+	copy(c.unread[i:], c.unread[i+1:])
+	c.unread[len(c.unread)-1] = nil
+	c.unread = c.unread[:len(c.unread)-1]
+	c.shrankBacklog(im)
+
+	return im
+}
+
+// isUnread reports whether an imsg is awaiting Recv after being pushed back by
+// Unread.
+func (c *Conn) isUnread(im *IMsg) bool {
+	c.umu.Lock()
+	defer c.umu.Unlock()
+
+	for _, held := range c.unread {
+		if held == im {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,279 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestConnUnread(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	for typ := uint32(1); typ <= 4; typ++ {
+		err := a.Send(&IMsg{Type: typ})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+
+	first, err := b.Recv()
+	if err != nil || first.Type != 1 {
+		t.Fatalf("unexpected Recv result (%v, %v)", first, err)
+	}
+	second, err := b.Recv()
+	if err != nil || second.Type != 2 {
+		t.Fatalf("unexpected Recv result (%v, %v)", second, err)
+	}
+
+	// The imsgs are pushed back in front of fresh traffic, the last unread
+	// first.
+	for _, im := range []*IMsg{first, second} {
+		err = b.Unread(im)
+		if err != nil {
+			t.Fatalf("unexpected Unread failure: %s", err)
+		}
+	}
+	for _, typ := range []uint32{2, 1, 3} {
+		im, err := b.Recv()
+		if err != nil || im.Type != typ {
+			t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+		}
+	}
+
+	// TryRecv sees an unread imsg without reading from the socket.
+	err = b.Unread(first)
+	if err != nil {
+		t.Fatalf("unexpected Unread failure: %s", err)
+	}
+	im, err := b.TryRecv()
+	if err != nil || im != first {
+		t.Fatalf("unexpected TryRecv result (%v, %v)", im, err)
+	}
+	im, err = b.TryRecv()
+	if err != nil || im.Type != 4 {
+		t.Fatalf("unexpected TryRecv result (%v, %v)", im, err)
+	}
+}
+
+func TestConnUnreadLimit(t *testing.T) {
+	_, b := newTestSocketPair(t)
+
+	for i := 0; i < maxUnread; i++ {
+		err := b.Unread(&IMsg{Type: uint32(i)})
+		if err != nil {
+			t.Fatalf("unexpected Unread failure: %s", err)
+		}
+	}
+	err := b.Unread(&IMsg{})
+	var full *ErrUnreadFull
+	if !errors.As(err, &full) || full.Limit != maxUnread {
+		t.Fatalf("expected ErrUnreadFull, got: %v", err)
+	}
+
+	// Room is made as unread imsgs are received.
+	_, err = b.Recv()
+	if err != nil {
+		t.Fatalf("unexpected Recv failure: %s", err)
+	}
+	err = b.Unread(&IMsg{})
+	if err != nil {
+		t.Fatalf("unexpected Unread failure: %s", err)
+	}
+}
+
+func TestConnUnreadRecvMatching(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	for _, typ := range []uint32{1, 2} {
+		err := a.Send(&IMsg{Type: typ})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+	err := b.Unread(&IMsg{Type: 3})
+	if err != nil {
+		t.Fatalf("unexpected Unread failure: %s", err)
+	}
+	err = b.Unread(&IMsg{Type: 4})
+	if err != nil {
+		t.Fatalf("unexpected Unread failure: %s", err)
+	}
+
+	// An unread imsg may be matched, and the others keep their places.
+	isThree := func(im *IMsg) bool { return im.Type == 3 }
+	im, err := b.RecvMatching(context.Background(), isThree)
+	if err != nil || im.Type != 3 {
+		t.Fatalf("unexpected RecvMatching result (%v, %v)", im, err)
+	}
+	isTwo := func(im *IMsg) bool { return im.Type == 2 }
+	im, err = b.RecvMatching(context.Background(), isTwo)
+	if err != nil || im.Type != 2 {
+		t.Fatalf("unexpected RecvMatching result (%v, %v)", im, err)
+	}
+	for _, typ := range []uint32{4, 1} {
+		im, err := b.Recv()
+		if err != nil || im.Type != typ {
+			t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+		}
+	}
+
+	// The matched unread imsg no longer counts against the limit.
+	if len(b.unread) != 0 {
+		t.Fatalf("unexpected count of unread imsgs: %d", len(b.unread))
+	}
+}
+
+func TestServeUnread(t *testing.T) {
+	a, b := newTestSocketPair(t)
+	a.AllowFDPass(true)
+	b.AllowFDPass(true)
+
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("failed to create pipe: %s", err)
+	}
+	defer pr.Close()
+
+	im, _ := ComposeIMsgWithFile(1, 0, nil, pw)
+	err = a.Send(im)
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	err = a.Send(&IMsg{Type: 2})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	a.CloseWrite()
+
+	// The handler defers the first imsg once, which is dispatched again
+	// before the imsg which follows it, with its descriptor left open.
+	var (
+		order    []uint32
+		deferred bool
+		file     *os.File
+	)
+	m := NewMux()
+	m.HandleDefault(func(im *IMsg) error {
+		order = append(order, im.Type)
+		if im.Type == 1 && !deferred {
+			deferred = true
+			return b.Unread(im)
+		}
+		if im.Type == 1 {
+			file = im.Detach()
+		}
+		return nil
+	})
+
+	err = Serve(context.Background(), b, m)
+	if err != nil {
+		t.Fatalf("unexpected Serve failure: %s", err)
+	}
+	if len(order) != 3 || order[0] != 1 || order[1] != 1 || order[2] != 2 {
+		t.Fatalf("unexpected order of dispatch: %v", order)
+	}
+	if file == nil {
+		t.Fatalf("deferred imsg lost its descriptor")
+	}
+	_, err = file.Write([]byte("hello"))
+	file.Close()
+	if err != nil {
+		t.Fatalf("failed to write through deferred descriptor: %s", err)
+	}
+	bs, err := io.ReadAll(pr)
+	if err != nil || string(bs) != "hello" {
+		t.Fatalf("unexpected data read from pipe (%q, %v)", bs, err)
+	}
+}
+
+func TestRouterRunUnread(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	for _, typ := range []uint32{1, 2} {
+		err := a.Send(&IMsg{Type: typ})
+		if err != nil {
+			t.Fatalf("unexpected Send failure: %s", err)
+		}
+	}
+	a.CloseWrite()
+
+	// The handshake phase receives an imsg meant for the next phase, which
+	// the Router then routes ahead of anything still to be read.
+	im, err := b.Recv()
+	if err != nil || im.Type != 1 {
+		t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+	}
+	err = b.Unread(im)
+	if err != nil {
+		t.Fatalf("unexpected Unread failure: %s", err)
+	}
+
+	r := NewRouter()
+	ch, unsub := r.SubscribeDefault(2)
+	defer unsub()
+	err = r.Run(context.Background(), b)
+	if err != nil {
+		t.Fatalf("unexpected Run failure: %s", err)
+	}
+	for _, typ := range []uint32{1, 2} {
+		if im := <-ch; im.Type != typ {
+			t.Fatalf("unexpected imsg routed (%v)", im)
+		}
+	}
+}
+
+func TestRouterRunUnreadWhileReading(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	r := NewRouter()
+	ch, unsub := r.SubscribeDefault(2)
+	defer unsub()
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error, 1)
+	go func() { errc <- r.Run(ctx, b) }()
+
+	err := a.Send(&IMsg{Type: 1})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	im := <-ch
+
+	// The subscriber defers the imsg, which doesn't wait for Run to stop
+	// reading the socket.
+	unread := make(chan error, 1)
+	go func() { unread <- b.Unread(im) }()
+	select {
+	case err := <-unread:
+		if err != nil {
+			t.Fatalf("unexpected Unread failure: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Unread waited for Run to read")
+	}
+	err = a.Send(&IMsg{Type: 2})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	// Which is routed first depends on whether Run was already reading.
+	routed := map[uint32]bool{}
+	for i := 0; i < 2; i++ {
+		routed[(<-ch).Type] = true
+	}
+	if !routed[1] || !routed[2] {
+		t.Fatalf("unexpected imsgs routed (%v)", routed)
+	}
+
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got: %v", err)
+	}
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+// WithWipe marks the IMsg as carrying sensitive data, such as a key. Once the
+// imsg has been completely written by a Conn, MsgBuf, or Encoder, or discarded
+// from a send queue, its Data is overwritten with zeros, along with any copies
+// of it made along the way. Marked imsgs are never compressed, and can't be
+// sent with Broadcast. If WithDataCopy is also provided, only the copy is wiped.
+func WithWipe() ComposeOption {
+	return func(c *composeConfig) {
+		c.wipe = true
+	}
+}
+
+// Wipe overwrites the imsg's ancillary data with zeros. It's useful for
+// discarding sensitive data from a received imsg once it has been consumed.
+func (im *IMsg) Wipe() {
+	wipeBytes(im.Data)
+}
+
+// wipeBytes overwrites bs with zeros.
+func wipeBytes(bs []byte) {
+	for i := range bs {
+		bs[i] = 0
+	}
+}
+
+// release wipes the entry if it's marked for wiping. It's called once the
+// entry has been written or discarded, and must not be called while the entry
+// is being written.
+func (e *msgBufEntry) release() {
+	if !e.wipe {
+		return
+	}
+
+	wipeBytes(e.bs)
+	wipeBytes(e.data)
+	wipeBytes(e.orig)
+}
@@ -0,0 +1,137 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+package imsg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"testing"
+)
+
+// isWiped reports whether bs has been overwritten with zeros.
+func isWiped(bs []byte) bool {
+	return len(bs) > 0 && bytes.Count(bs, []byte{0}) == len(bs)
+}
+
+func TestComposeWithWipe(t *testing.T) {
+	im, err := ComposeIMsg(1, 0, []byte("secret"), WithWipe())
+	if err != nil {
+		t.Fatalf("failed to compose imsg: %s", err)
+	}
+	if !im.wipe || !im.Clone().wipe {
+		t.Fatalf("expected imsg and its clone to be marked for wiping")
+	}
+
+	im.Wipe()
+	if !isWiped(im.Data) {
+		t.Fatalf("expected data to be wiped, got: %q", im.Data)
+	}
+}
+
+func TestMsgBufWipe(t *testing.T) {
+	w := &stalledWriter{budget: HeaderSizeInBytes + 2}
+	m := NewMsgBuf(w)
+
+	secret := []byte("secret")
+	err := m.Enqueue(&IMsg{Type: 1, Data: secret, wipe: true})
+	if err != nil {
+		t.Fatalf("unexpected Enqueue failure: %s", err)
+	}
+	copied := m.q[0].bs
+
+	// Nothing is wiped while the imsg is partially written.
+	m.Flush()
+	if string(secret) != "secret" || isWiped(copied) {
+		t.Fatalf("data wiped before the imsg was written")
+	}
+
+	w.budget = 100
+	_, err = m.Flush()
+	if err != nil {
+		t.Fatalf("unexpected Flush failure: %s", err)
+	}
+	if !isWiped(secret) || !isWiped(copied) {
+		t.Fatalf("expected data and its copy to be wiped (%q, %q)", secret, copied)
+	}
+	if !bytes.Contains(w.buf.Bytes(), []byte("secret")) {
+		t.Fatalf("imsg was not written intact")
+	}
+
+	// Discarded imsgs are wiped as well.
+	w.budget = 0
+	secret = []byte("secret")
+	m.Enqueue(&IMsg{Type: 2, Data: []byte("other")})
+	m.Enqueue(&IMsg{Type: 3, Data: secret, wipe: true})
+	copied = m.q[1].bs
+	m.Clear()
+	if !isWiped(secret) || !isWiped(copied) {
+		t.Fatalf("expected cleared data to be wiped (%q, %q)", secret, copied)
+	}
+
+	secret = []byte("secret")
+	m.SetQueueLimit(1, 0, QueueDropOldest)
+	m.Enqueue(&IMsg{Type: 4, Data: secret, wipe: true})
+	m.Enqueue(&IMsg{Type: 5})
+	if !isWiped(secret) {
+		t.Fatalf("expected dropped data to be wiped, got: %q", secret)
+	}
+
+	// Unmarked imsgs are left alone.
+	w.budget = 100
+	data := []byte("data")
+	m.Clear()
+	m.Enqueue(&IMsg{Type: 6, Data: data})
+	m.Flush()
+	if string(data) != "data" {
+		t.Fatalf("unmarked data was modified: %q", data)
+	}
+}
+
+func TestEncoderWipe(t *testing.T) {
+	var buf bytes.Buffer
+	enc := NewEncoder(&buf)
+	enc.SetWriteBufferSize(4096)
+	enc.SetHMAC([]byte("key"), sha256.New)
+	enc.SetChecksum(true)
+
+	// An unmarked imsg is left buffered.
+	err := enc.Encode(&IMsg{Type: 1, Data: []byte("data")})
+	if err != nil {
+		t.Fatalf("unexpected Encode failure: %s", err)
+	}
+
+	// The trace function observes the copy made by the framing extensions.
+	var out *IMsg
+	enc.SetTraceFunc(func(_ Direction, im *IMsg, _ int) {
+		out = im
+	})
+
+	secret := []byte("secret")
+	err = enc.Encode(&IMsg{Type: 2, Data: secret, wipe: true})
+	if err != nil {
+		t.Fatalf("unexpected Encode failure: %s", err)
+	}
+
+	if !isWiped(secret) || !isWiped(out.Data) {
+		t.Fatalf("expected data and its copy to be wiped (%q, %q)", secret, out.Data)
+	}
+	if enc.bw.Buffered() != 0 {
+		t.Fatalf("expected write buffer to be flushed")
+	}
+	internal := enc.bw.AvailableBuffer()
+	if bytes.Contains(internal[:cap(internal)], []byte("secret")) {
+		t.Fatalf("write buffer was not wiped")
+	}
+
+	dec := NewDecoder(&buf)
+	dec.SetHMAC([]byte("key"), sha256.New)
+	dec.SetChecksum(true)
+	for _, expected := range []string{"data", "secret"} {
+		im, err := dec.Decode()
+		if err != nil || string(im.Data) != expected {
+			t.Fatalf("unexpected Decode result (%v, %v)", im, err)
+		}
+	}
+}
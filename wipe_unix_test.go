@@ -0,0 +1,84 @@
+// Copyright (c) 2020 Matt Schultz <schultz@sent.com>. All rights reserved.
+// Use of this source code is governed by an ISC license that can be found in
+// the LICENSE file.
+
+//go:build unix
+
+package imsg
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestConnSendWipe(t *testing.T) {
+	a, b := newTestSocketPair(t)
+
+	secret := []byte("secret")
+	im, _ := ComposeIMsg(1, 0, secret, WithWipe())
+	err := a.Send(im)
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	if !isWiped(secret) {
+		t.Fatalf("expected data to be wiped after Send, got: %q", secret)
+	}
+
+	batch := [][]byte{[]byte("first"), []byte("second")}
+	err = a.SendBatch(&IMsg{Type: 2, Data: batch[0], wipe: true}, &IMsg{Type: 3, Data: batch[1], wipe: true})
+	if err != nil {
+		t.Fatalf("unexpected SendBatch failure: %s", err)
+	}
+	if !isWiped(batch[0]) || !isWiped(batch[1]) {
+		t.Fatalf("expected data to be wiped after SendBatch, got: %q", batch)
+	}
+
+	for _, expected := range []string{"secret", "first", "second"} {
+		im, err := b.Recv()
+		if err != nil || string(im.Data) != expected {
+			t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+		}
+	}
+
+	err = Broadcast(&IMsg{Type: 4, Data: []byte("secret"), wipe: true}, a)
+	var eu *ErrUnsupported
+	if !errors.As(err, &eu) {
+		t.Fatalf("expected ErrUnsupported from Broadcast, got: %v", err)
+	}
+}
+
+func TestCoalescedSendWipe(t *testing.T) {
+	a, b := newCoalescingTestConns(t, WithWriteBufferSize(1024))
+
+	secret := []byte("secret")
+	err := a.Send(&IMsg{Type: 1, Data: secret, wipe: true})
+	if err != nil {
+		t.Fatalf("unexpected Send failure: %s", err)
+	}
+	batch := []byte("batched")
+	err = a.SendBatch(&IMsg{Type: 2, Data: batch, wipe: true})
+	if err != nil {
+		t.Fatalf("unexpected SendBatch failure: %s", err)
+	}
+
+	// The imsgs are still queued, as are their copies.
+	if isWiped(secret) || isWiped(batch) {
+		t.Fatalf("data wiped before the imsgs were written")
+	}
+	copies := [][]byte{a.wq.q[0].bs, a.wq.q[1].bs}
+
+	err = a.Flush()
+	if err != nil {
+		t.Fatalf("unexpected Flush failure: %s", err)
+	}
+	if !isWiped(secret) || !isWiped(batch) || !isWiped(copies[0]) || !isWiped(copies[1]) {
+		t.Fatalf("expected data and copies to be wiped (%q, %q, %q)", secret, batch, copies)
+	}
+
+	for _, expected := range []string{"secret", "batched"} {
+		im, err := b.Recv()
+		if err != nil || string(im.Data) != expected {
+			t.Fatalf("unexpected Recv result (%v, %v)", im, err)
+		}
+	}
+}